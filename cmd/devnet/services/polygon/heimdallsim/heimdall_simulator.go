@@ -28,7 +28,7 @@ type HeimdallSimulator struct {
 var _ heimdall.HeimdallClient = (*HeimdallSimulator)(nil)
 
 func NewHeimdallSimulator(ctx context.Context, snapDir string, logger log.Logger, iterations []uint64) (*HeimdallSimulator, error) {
-	snapshots := freezeblocks.NewBorRoSnapshots(ethconfig.Defaults.Snapshot, snapDir, 0, logger)
+	snapshots := freezeblocks.NewBorRoSnapshots(ethconfig.Defaults.Snapshot, snapDir, 0, nil, logger)
 
 	// index local files
 	localFiles, err := os.ReadDir(snapDir)
@@ -141,7 +141,7 @@ func aggregateResultsFromStateTests(
 	defer _db.Close()
 
 	cr := rawdb.NewCanonicalReader()
-	agg, err := libstate.NewAggregator(context.Background(), dirs, config3.HistoryV3AggregationStep, _db, cr, log.New())
+	agg, err := libstate.NewAggregator(context.Background(), dirs, config3.HistoryV3AggregationStep, _db, cr, libstate.DefaultCommitmentValuesTransform, log.New())
 	if err != nil {
 		return nil, err
 	}
@@ -1303,8 +1303,11 @@ var _aggSingleton *libstate.Aggregator
 func allSnapshots(ctx context.Context, db kv.RoDB, logger log.Logger) (*freezeblocks.RoSnapshots, *freezeblocks.BorRoSnapshots, *libstate.Aggregator, *freezeblocks.CaplinSnapshots) {
 	openSnapshotOnce.Do(func() {
 		var useSnapshots bool
+		var chainConfig *chain2.Config // nil on not initialized db: then all snapshot types are used
 		_ = db.View(context.Background(), func(tx kv.Tx) error {
 			useSnapshots, _ = snap.Enabled(tx)
+			genesisHash, _ := rawdb.ReadCanonicalHash(tx, 0)
+			chainConfig, _ = rawdb.ReadChainConfig(tx, genesisHash)
 			return nil
 		})
 		dirs := datadir.New(datadirCli)
@@ -1313,10 +1316,10 @@ func allSnapshots(ctx context.Context, db kv.RoDB, logger log.Logger) (*freezebl
 		snapCfg := ethconfig.NewSnapCfg(useSnapshots, true, true, true)
 
 		_allSnapshotsSingleton = freezeblocks.NewRoSnapshots(snapCfg, dirs.Snap, 0, logger)
-		_allBorSnapshotsSingleton = freezeblocks.NewBorRoSnapshots(snapCfg, dirs.Snap, 0, logger)
+		_allBorSnapshotsSingleton = freezeblocks.NewBorRoSnapshots(snapCfg, dirs.Snap, 0, chainConfig, logger)
 		var err error
 		cr := rawdb.NewCanonicalReader()
-		_aggSingleton, err = libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, cr, logger)
+		_aggSingleton, err = libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, cr, libstate.DefaultCommitmentValuesTransform, logger)
 		if err != nil {
 			panic(err)
 		}
@@ -1458,6 +1461,7 @@ func newSync(ctx context.Context, db kv.RwDB, miningConfig *params.MiningConfig,
 
 	notifications := &shards.Notifications{}
 	blockRetire := freezeblocks.NewBlockRetire(1, dirs, blockReader, blockWriter, db, chainConfig, notifications.Events, blockSnapBuildSema, logger)
+	blockRetire.SetProvenance(freezeblocks.Provenance{Version: params.VersionWithCommit(params.GitCommit)})
 
 	var (
 		snapDb     kv.RwDB
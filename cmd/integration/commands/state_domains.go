@@ -36,6 +36,11 @@ func init() {
 	withStartTx(readDomains)
 
 	rootCmd.AddCommand(readDomains)
+
+	withDataDir(convertHistoryLayout)
+	withChain(convertHistoryLayout)
+
+	rootCmd.AddCommand(convertHistoryLayout)
 }
 
 // if trie variant is not hex, we could not have another rootHash with to verify it
@@ -104,6 +109,46 @@ var readDomains = &cobra.Command{
 	},
 }
 
+// convert DB part of domain history written with other historyLargeValues layout - instead of full resync
+var convertHistoryLayout = &cobra.Command{
+	Use:       "convert_history_layout",
+	Short:     `Convert history of domain written with other historyLargeValues layout to layout of this binary.`,
+	Example:   "go run ./cmd/integration convert_history_layout --datadir=... --chain=... accounts",
+	ValidArgs: []string{"accounts", "storage", "code", "commitment"},
+	Args:      cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := debug.SetupCobra(cmd, "integration")
+		ctx, _ := libcommon.RootContext()
+		domain, err := kv.String2Domain(args[0])
+		if err != nil {
+			logger.Error("invalid domain to convert", "arg", args[0], "err", err)
+			return
+		}
+
+		dirs := datadir.New(datadirCli)
+		chainDb, err := openDB(dbCfg(kv.ChainDB, dirs.Chaindata), true, logger)
+		if err != nil {
+			logger.Error("Opening DB", "error", err)
+			return
+		}
+		defer chainDb.Close()
+
+		sn, bsn, agg, _ := allSnapshots(ctx, chainDb, logger)
+		defer sn.Close()
+		defer bsn.Close()
+		defer agg.Close()
+
+		if err := chainDb.Update(ctx, func(tx kv.RwTx) error {
+			return agg.ConvertHistoryLayout(ctx, tx, domain, dirs.Tmp)
+		}); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logger.Error(err.Error())
+			}
+			return
+		}
+	},
+}
+
 func requestDomains(chainDb, stateDb kv.RwDB, ctx context.Context, readDomain string, addrs [][]byte, logger log.Logger) error {
 	sn, bsn, agg, _ := allSnapshots(ctx, chainDb, logger)
 	defer sn.Close()
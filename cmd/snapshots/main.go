@@ -17,6 +17,7 @@ import (
 	"github.com/ledgerwatch/erigon/cmd/snapshots/cmp"
 	"github.com/ledgerwatch/erigon/cmd/snapshots/copy"
 	"github.com/ledgerwatch/erigon/cmd/snapshots/manifest"
+	"github.com/ledgerwatch/erigon/cmd/snapshots/provenance"
 	"github.com/ledgerwatch/erigon/cmd/snapshots/sync"
 	"github.com/ledgerwatch/erigon/cmd/snapshots/torrents"
 	"github.com/ledgerwatch/erigon/cmd/snapshots/verify"
@@ -40,6 +41,7 @@ func main() {
 		&verify.Command,
 		&torrents.Command,
 		&manifest.Command,
+		&provenance.Command,
 	}
 
 	app.Flags = []cli.Flag{}
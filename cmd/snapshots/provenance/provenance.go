@@ -0,0 +1,44 @@
+package provenance
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync/freezeblocks"
+)
+
+var Command = cli.Command{
+	Action:      provenance,
+	Name:        "provenance",
+	Usage:       "print chain of custody of snapshot segment: producer version, creation time and merged source files",
+	ArgsUsage:   "<file>",
+	Description: ``,
+}
+
+func provenance(cliCtx *cli.Context) error {
+	if cliCtx.Args().Len() != 1 {
+		return fmt.Errorf("expected 1 argument: <file>, got %d", cliCtx.Args().Len())
+	}
+	r, err := freezeblocks.ProvenanceChain(cliCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	printProvenance(cliCtx.App.Writer, r, 0)
+	return nil
+}
+
+func printProvenance(w io.Writer, r *freezeblocks.ProvenanceRecord, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if r.Version == "" && len(r.Sources) == 0 {
+		fmt.Fprintf(w, "%s%s: no provenance\n", indent, r.File)
+		return
+	}
+	fmt.Fprintf(w, "%s%s: version=%s chain=%s created=%s\n", indent, r.File, r.Version, r.Chain, r.CreatedAt.Format(time.RFC3339))
+	for _, s := range r.Sources {
+		printProvenance(w, s, depth+1)
+	}
+}
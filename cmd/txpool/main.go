@@ -57,9 +57,13 @@ var (
 	totalBlobPoolLimit uint64
 	priceBump          uint64
 	blobPriceBump      uint64
+	queuedLifetime     time.Duration
 
 	noTxGossip bool
 
+	revalidateOnRegression int
+	announceDelayJitter    time.Duration
+
 	commitEvery time.Duration
 )
 
@@ -85,7 +89,10 @@ func init() {
 	rootCmd.PersistentFlags().Uint64Var(&totalBlobPoolLimit, "txpool.totalblobpoollimit", txpoolcfg.DefaultConfig.TotalBlobPoolLimit, "Total limit of number of all blobs in txs within the txpool")
 	rootCmd.PersistentFlags().Uint64Var(&priceBump, "txpool.pricebump", txpoolcfg.DefaultConfig.PriceBump, "Price bump percentage to replace an already existing transaction")
 	rootCmd.PersistentFlags().Uint64Var(&blobPriceBump, "txpool.blobpricebump", txpoolcfg.DefaultConfig.BlobPriceBump, "Price bump percentage to replace an existing blob (type-3) transaction")
+	rootCmd.PersistentFlags().DurationVar(&queuedLifetime, "txpool.lifetime", txpoolcfg.DefaultConfig.QueuedLifetime, "Maximum amount of time non-executable transaction are queued")
 	rootCmd.PersistentFlags().DurationVar(&commitEvery, utils.TxPoolCommitEveryFlag.Name, utils.TxPoolCommitEveryFlag.Value, utils.TxPoolCommitEveryFlag.Usage)
+	rootCmd.PersistentFlags().IntVar(&revalidateOnRegression, utils.TxPoolRevalidateOnRegressionFlag.Name, utils.TxPoolRevalidateOnRegressionFlag.Value, utils.TxPoolRevalidateOnRegressionFlag.Usage)
+	rootCmd.PersistentFlags().DurationVar(&announceDelayJitter, utils.TxPoolAnnounceDelayJitterFlag.Name, utils.TxPoolAnnounceDelayJitterFlag.Value, utils.TxPoolAnnounceDelayJitterFlag.Usage)
 	rootCmd.PersistentFlags().BoolVar(&noTxGossip, utils.TxPoolGossipDisableFlag.Name, utils.TxPoolGossipDisableFlag.Value, utils.TxPoolGossipDisableFlag.Usage)
 	rootCmd.Flags().StringSliceVar(&traceSenders, utils.TxPoolTraceSendersFlag.Name, []string{}, utils.TxPoolTraceSendersFlag.Usage)
 }
@@ -154,7 +161,10 @@ func doTxpool(ctx context.Context, logger log.Logger) error {
 	cfg.TotalBlobPoolLimit = totalBlobPoolLimit
 	cfg.PriceBump = priceBump
 	cfg.BlobPriceBump = blobPriceBump
+	cfg.QueuedLifetime = queuedLifetime
 	cfg.NoGossip = noTxGossip
+	cfg.RevalidateSendersOnRegression = revalidateOnRegression
+	cfg.AnnounceDelayJitter = announceDelayJitter
 
 	cacheConfig := kvcache.DefaultCoherentConfig
 	cacheConfig.MetricsLabel = "txpool"
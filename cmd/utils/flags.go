@@ -38,6 +38,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/chain/snapcfg"
 	libcommon "github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/common/metrics"
 	libkzg "github.com/ledgerwatch/erigon-lib/crypto/kzg"
 	"github.com/ledgerwatch/erigon-lib/direct"
@@ -225,6 +226,16 @@ var (
 		Usage: "How often transactions should be committed to the storage",
 		Value: txpoolcfg.DefaultConfig.CommitEvery,
 	}
+	TxPoolRevalidateOnRegressionFlag = cli.IntFlag{
+		Name:  "txpool.regression.revalidate",
+		Usage: "Max number of senders, whose state is re-read when state version of new block goes backwards. 0 - only senders changed by block",
+		Value: txpoolcfg.DefaultConfig.RevalidateSendersOnRegression,
+	}
+	TxPoolAnnounceDelayJitterFlag = cli.DurationFlag{
+		Name:  "txpool.announce.jitter",
+		Usage: "Max random delay of announcements of local transactions (also shuffles their order) - to not reveal node as origin of transactions. 0 - disabled",
+		Value: txpoolcfg.DefaultConfig.AnnounceDelayJitter,
+	}
 	// Miner settings
 	MiningEnabledFlag = cli.BoolFlag{
 		Name:  "mine",
@@ -691,6 +702,38 @@ var (
 		Name:  ethconfig.FlagSnapStateStop,
 		Usage: "Workaround to stop producing new state files, if you meet some state-related critical bug. It will stop aggregate DB history in a state files. DB will grow and may slightly slow-down - and removing this flag in future will not fix this effect (db size will not greatly reduce).",
 	}
+	SnapStateCodeHashIndexFlag = cli.BoolFlag{
+		Name:  ethconfig.FlagSnapStateCodeHashIndex,
+		Usage: "Build code-hash index of code state files: allows to get contract code by its hash (without address). Slows down state files build. Files built before enabling get index in background",
+	}
+	SnapStateCompressionDictionaryFlag = cli.StringSliceFlag{
+		Name:  ethconfig.FlagSnapStateCompressionDictionary,
+		Usage: "Dictionary of .kv state files of domain: <domain>=<file> (domain: accounts, storage, code, commitment). Files built with dictionary can be opened only with same dictionary. Can be repeated",
+	}
+	SnapFsyncFlag = cli.StringFlag{
+		Name:  ethconfig.FlagSnapFsync,
+		Usage: "Fsync of produced block and state files: full (every file and dir after every rename), final (files only once - right before they are used, and dirs; for battery-backed RAID), none (unsafe)",
+		Value: dir.FsyncFull.String(),
+	}
+	SnapVerifyOpenFilesIntervalFlag = cli.DurationFlag{
+		Name:  ethconfig.FlagSnapVerifyOpenFilesInterval,
+		Usage: "Reads of block snapshot re-check (stat) that file was not modified on disk after open, not more often than this interval. Modified file is refused until reopen. 0 - disabled",
+		Value: time.Minute,
+	}
+	SnapQuarantineEmptySegmentsFlag = cli.BoolFlag{
+		Name:  ethconfig.FlagSnapQuarantineEmptySegments,
+		Usage: "Rename empty block snapshots (no items) to .broken on open: Downloader re-fetches them. Without flag empty snapshot is only skipped",
+	}
+	SnapTxnHashIdxShardsFlag = cli.IntFlag{
+		Name:  ethconfig.FlagSnapTxnHashIdxShards,
+		Usage: "Build txn-hash indices of new transactions snapshots as this amount of shards (2..256): bad shard can be rebuilt alone. Already indexed snapshots keep their layout. 0 - single files",
+		Value: 0,
+	}
+	SnapOpenFilesSoftLimitFlag = cli.IntFlag{
+		Name:  "snap.open-files-soft-limit",
+		Usage: "Log warning (with biggest contributors by file type) when amount of open snapshot/state files exceeds this limit. Keep it below `ulimit -n`. 0 - disabled",
+		Value: 0,
+	}
 	TorrentVerbosityFlag = cli.IntFlag{
 		Name:  "torrent.verbosity",
 		Value: 2,
@@ -1514,6 +1557,12 @@ func setTxPool(ctx *cli.Context, fullCfg *ethconfig.Config) {
 	if ctx.IsSet(TxPoolBlobPriceBumpFlag.Name) {
 		fullCfg.TxPool.BlobPriceBump = ctx.Uint64(TxPoolBlobPriceBumpFlag.Name)
 	}
+	if ctx.IsSet(TxPoolRevalidateOnRegressionFlag.Name) {
+		fullCfg.TxPool.RevalidateSendersOnRegression = ctx.Int(TxPoolRevalidateOnRegressionFlag.Name)
+	}
+	if ctx.IsSet(TxPoolAnnounceDelayJitterFlag.Name) {
+		fullCfg.TxPool.AnnounceDelayJitter = ctx.Duration(TxPoolAnnounceDelayJitterFlag.Name)
+	}
 	cfg.CommitEvery = common2.RandomizeDuration(ctx.Duration(TxPoolCommitEveryFlag.Name))
 }
 
@@ -1767,6 +1816,29 @@ func SetEthConfig(ctx *cli.Context, nodeConfig *nodecfg.Config, cfg *ethconfig.C
 	cfg.Snapshot.KeepBlocks = ctx.Bool(SnapKeepBlocksFlag.Name)
 	cfg.Snapshot.ProduceE2 = !ctx.Bool(SnapStopFlag.Name)
 	cfg.Snapshot.ProduceE3 = !ctx.Bool(SnapStateStopFlag.Name)
+	cfg.Snapshot.CodeHashIndex = ctx.Bool(SnapStateCodeHashIndexFlag.Name)
+	for _, v := range ctx.StringSlice(SnapStateCompressionDictionaryFlag.Name) {
+		domain, fPath, ok := strings.Cut(v, "=")
+		if !ok || domain == "" || fPath == "" {
+			Fatalf("--%s: expected <domain>=<file>, got %q", SnapStateCompressionDictionaryFlag.Name, v)
+		}
+		if cfg.Snapshot.CompressionDictionaries == nil {
+			cfg.Snapshot.CompressionDictionaries = map[string]string{}
+		}
+		cfg.Snapshot.CompressionDictionaries[domain] = fPath
+	}
+	fsync, err := dir.ParseFsyncPolicy(ctx.String(SnapFsyncFlag.Name))
+	if err != nil {
+		Fatalf("--%s: %s", SnapFsyncFlag.Name, err)
+	}
+	cfg.Snapshot.Fsync = fsync
+	cfg.Snapshot.VerifyOpenFilesInterval = ctx.Duration(SnapVerifyOpenFilesIntervalFlag.Name)
+	cfg.Snapshot.QuarantineEmptySegments = ctx.Bool(SnapQuarantineEmptySegmentsFlag.Name)
+	cfg.Snapshot.TxnHashIdxShards = ctx.Int(SnapTxnHashIdxShardsFlag.Name)
+	if cfg.Snapshot.TxnHashIdxShards < 0 || cfg.Snapshot.TxnHashIdxShards > 256 {
+		Fatalf("--%s: must be in [0, 256], got %d", SnapTxnHashIdxShardsFlag.Name, cfg.Snapshot.TxnHashIdxShards)
+	}
+	dir.SetOpenFilesSoftLimit(ctx.Int(SnapOpenFilesSoftLimitFlag.Name))
 	cfg.Snapshot.NoDownloader = ctx.Bool(NoDownloaderFlag.Name)
 	cfg.Snapshot.Verify = ctx.Bool(DownloaderVerifyFlag.Name)
 	cfg.Snapshot.DownloaderAddr = strings.TrimSpace(ctx.String(DownloaderAddrFlag.Name))
@@ -554,7 +554,7 @@ func GenesisToBlock(g *types.Genesis, tmpDir string, logger log.Logger) (*types.
 		defer genesisTmpDB.Close()
 
 		cr := rawdb.NewCanonicalReader()
-		agg, err := state2.NewAggregator(context.Background(), datadir.New(tmpDir), config3.HistoryV3AggregationStep, genesisTmpDB, cr, logger)
+		agg, err := state2.NewAggregator(context.Background(), datadir.New(tmpDir), config3.HistoryV3AggregationStep, genesisTmpDB, cr, state2.DefaultCommitmentValuesTransform, logger)
 		if err != nil {
 			return err
 		}
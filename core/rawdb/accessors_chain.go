@@ -1289,8 +1289,17 @@ func IsPosBlock(db kv.Getter, blockHash common.Hash) (trans bool, err error) {
 }
 
 var SnapshotsKey = []byte("snapshots")
+var SnapshotsChecksumsKey = []byte("snapshots_checksums")
+
+// SnapshotsHistoryKey - deprecated: json of state files list, the only one which old versions read. Still written as copy
+// of records of SnapshotsHistoryFilePrefix: node can be downgraded by 1 release. Downgraded node writes only it - then it
+// is newer than records and replaces them by next write. TODO: stop writing it in next release
 var SnapshotsHistoryKey = []byte("snapshots_history")
 
+// SnapshotsHistoryFilePrefix - state files list: 1 record per file SnapshotsHistoryFilePrefix+fileName -> empty value.
+// Then change of list writes only added and removed files. See also SnapshotsHistoryKey
+var SnapshotsHistoryFilePrefix = []byte("snapshots_history/")
+
 func ReadSnapshots(tx kv.Tx) ([]string, []string, error) {
 	v, err := tx.GetOne(kv.DatabaseInfo, SnapshotsKey)
 	if err != nil {
@@ -1303,28 +1312,232 @@ func ReadSnapshots(tx kv.Tx) ([]string, []string, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	_ = json.Unmarshal(v, &resHist)
+	if v != nil { // same as records, or newer: written by old version
+		_ = json.Unmarshal(v, &resHist)
+		return res, resHist, nil
+	}
+	if resHist, err = readSnapshotsHistoryFiles(tx); err != nil {
+		return nil, nil, err
+	}
 	return res, resHist, nil
 }
 
+func readSnapshotsHistoryFiles(tx kv.Tx) (res []string, err error) {
+	it, err := tx.Prefix(kv.DatabaseInfo, SnapshotsHistoryFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for it.HasNext() {
+		k, _, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, string(k[len(SnapshotsHistoryFilePrefix):]))
+	}
+	return res, nil
+}
+
+func snapshotsHistoryFileKey(fileName string) []byte {
+	return append(common.Copy(SnapshotsHistoryFilePrefix), fileName...)
+}
+
 func WriteSnapshots(tx kv.RwTx, list, histList []string) error {
-	res, err := json.Marshal(list)
+	if err := writeSnapshotsList(tx, list); err != nil {
+		return err
+	}
+	if err := setSnapshotsHistoryFiles(tx, histList); err != nil {
+		return err
+	}
+	return writeLegacySnapshotsHistory(tx)
+}
+
+// UpdateSnapshots - same as WriteSnapshots, but list of state files is updated incrementally: `histRemoved` are deleted
+// from stored list, `histAdded` are added to it. Only records of these files are written
+func UpdateSnapshots(tx kv.RwTx, list, histAdded, histRemoved []string) error {
+	if err := writeSnapshotsList(tx, list); err != nil {
+		return err
+	}
+	legacy, err := tx.GetOne(kv.DatabaseInfo, SnapshotsHistoryKey)
 	if err != nil {
 		return err
 	}
-	if err := tx.Put(kv.DatabaseInfo, SnapshotsKey, res); err != nil {
+	if legacy != nil { // records may be older: list was written by old version
+		var histList []string
+		_ = json.Unmarshal(legacy, &histList)
+		if err := setSnapshotsHistoryFiles(tx, histList); err != nil {
+			return err
+		}
+	}
+	if err := updateSnapshotsHistoryFiles(tx, histAdded, histRemoved); err != nil {
+		return err
+	}
+	return writeLegacySnapshotsHistory(tx)
+}
+
+// setSnapshotsHistoryFiles - records of state files are replaced by `histList`. Only records of changed files are written
+func setSnapshotsHistoryFiles(tx kv.RwTx, histList []string) error {
+	stored, err := readSnapshotsHistoryFiles(tx)
+	if err != nil {
+		return err
+	}
+	storedSet := make(map[string]struct{}, len(stored))
+	for _, f := range stored {
+		storedSet[f] = struct{}{}
+	}
+	var added []string
+	for _, f := range histList {
+		if _, ok := storedSet[f]; ok {
+			delete(storedSet, f)
+			continue
+		}
+		added = append(added, f)
+	}
+	removed := make([]string, 0, len(storedSet))
+	for f := range storedSet {
+		removed = append(removed, f)
+	}
+	return updateSnapshotsHistoryFiles(tx, added, removed)
+}
+
+// writeLegacySnapshotsHistory - copy of records of state files under SnapshotsHistoryKey. Not written if not changed
+func writeLegacySnapshotsHistory(tx kv.RwTx) error {
+	files, err := readSnapshotsHistoryFiles(tx)
+	if err != nil {
 		return err
 	}
-	res, err = json.Marshal(histList)
+	res, err := json.Marshal(files)
 	if err != nil {
 		return err
 	}
-	if err := tx.Put(kv.DatabaseInfo, SnapshotsHistoryKey, res); err != nil {
+	stored, err := tx.GetOne(kv.DatabaseInfo, SnapshotsHistoryKey)
+	if err != nil {
 		return err
 	}
+	if stored != nil && bytes.Equal(stored, res) {
+		return nil
+	}
+	return tx.Put(kv.DatabaseInfo, SnapshotsHistoryKey, res)
+}
+
+func updateSnapshotsHistoryFiles(tx kv.RwTx, added, removed []string) error {
+	for _, f := range removed {
+		if err := tx.Delete(kv.DatabaseInfo, snapshotsHistoryFileKey(f)); err != nil {
+			return err
+		}
+	}
+	for _, f := range added {
+		if err := tx.Put(kv.DatabaseInfo, snapshotsHistoryFileKey(f), []byte{}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// writeSnapshotsList - list of block files. Not written if not changed
+func writeSnapshotsList(tx kv.RwTx, list []string) error {
+	res, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	stored, err := tx.GetOne(kv.DatabaseInfo, SnapshotsKey)
+	if err != nil {
+		return err
+	}
+	if stored != nil && bytes.Equal(stored, res) {
+		return nil
+	}
+	return tx.Put(kv.DatabaseInfo, SnapshotsKey, res)
+}
+
+var SnapshotsListIDKey = []byte("snapshots_list_id")
+
+// ReadSnapshotsListID - marker written together with files list: writer which doesn't commit tx itself checks by it
+// that its write was committed. 0 - not written
+func ReadSnapshotsListID(tx kv.Tx) (uint64, error) {
+	v, err := tx.GetOne(kv.DatabaseInfo, SnapshotsListIDKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func WriteSnapshotsListID(tx kv.RwTx, id uint64) error {
+	return tx.Put(kv.DatabaseInfo, SnapshotsListIDKey, binary.BigEndian.AppendUint64(nil, id))
+}
+
+// ReadSnapshotsChecksums - fileName -> checksum. Records written by old versions have no checksums - empty map returned.
+func ReadSnapshotsChecksums(tx kv.Tx) (map[string]string, error) {
+	v, err := tx.GetOne(kv.DatabaseInfo, SnapshotsChecksumsKey)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	if len(v) == 0 {
+		return res, nil
+	}
+	if err := json.Unmarshal(v, &res); err != nil {
+		return nil, fmt.Errorf("parse snapshots checksums: %w", err)
+	}
+	return res, nil
+}
+
+func WriteSnapshotsChecksums(tx kv.RwTx, checksums map[string]string) error {
+	res, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return tx.Put(kv.DatabaseInfo, SnapshotsChecksumsKey, res)
+}
+
+var RetireProgressKey = []byte("retire_progress")
+
+// RetireProgress - phases of not finished blocks retire cycle, to not repeat them after restart. Deleted when cycle finishes.
+type RetireProgress struct {
+	Dumped   map[string]RetireRange `json:"dumped,omitempty"`   // snapshot type -> last segment dumped with its indices
+	Merged   RetireRange            `json:"merged,omitempty"`   // last merged range
+	Notified RetireRange            `json:"notified,omitempty"` // last merged range announced by seedNewSnapshots
+}
+
+type RetireRange struct {
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	LastKey uint64 `json:"lastKey,omitempty"` // returned by dump of segment: last txNum for bodies
+}
+
+func (p RetireProgress) Empty() bool {
+	return len(p.Dumped) == 0 && p.Merged == (RetireRange{}) && p.Notified == (RetireRange{})
+}
+
+func ReadRetireProgress(tx kv.Getter) (RetireProgress, error) {
+	var res RetireProgress
+	v, err := tx.GetOne(kv.DatabaseInfo, RetireProgressKey)
+	if err != nil {
+		return res, err
+	}
+	if len(v) == 0 {
+		return res, nil
+	}
+	if err := json.Unmarshal(v, &res); err != nil {
+		return res, fmt.Errorf("ReadRetireProgress: %w", err)
+	}
+	return res, nil
+}
+
+func WriteRetireProgress(tx kv.RwTx, p RetireProgress) error {
+	if p.Empty() {
+		return tx.Delete(kv.DatabaseInfo, RetireProgressKey)
+	}
+	res, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Put(kv.DatabaseInfo, RetireProgressKey, res)
+}
+
 // PruneTable has `limit` parameter to avoid too large data deletes per one sync cycle - better delete by small portions to reduce db.FreeList size
 func PruneTable(tx kv.RwTx, table string, pruneTo uint64, ctx context.Context, limit int) error {
 	c, err := tx.RwCursor(table)
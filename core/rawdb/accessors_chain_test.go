@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"testing"
@@ -33,6 +34,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/hexutility"
 
 	// "github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/ledgerwatch/erigon/core/rawdb"
 	"github.com/ledgerwatch/erigon/turbo/stages/mock"
@@ -828,3 +830,59 @@ func checkReceiptsRLP(have, want types.Receipts) error {
 	}
 	return nil
 }
+
+func TestUpdateSnapshots(t *testing.T) {
+	t.Parallel()
+	_, tx := memdb.NewTestTx(t)
+
+	// list stored by old version
+	legacy, err := json.Marshal([]string{"v1-accounts.0-1.kv", "v1-accounts.1-2.kv"})
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(kv.DatabaseInfo, rawdb.SnapshotsHistoryKey, legacy))
+	blocks, hist, err := rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Empty(t, blocks)
+	require.Equal(t, []string{"v1-accounts.0-1.kv", "v1-accounts.1-2.kv"}, hist)
+
+	require.NoError(t, rawdb.UpdateSnapshots(tx, []string{"v1-000000-000500-headers.seg"}, []string{"v1-accounts.0-2.kv"}, []string{"v1-accounts.0-1.kv", "v1-accounts.1-2.kv"}))
+	v, err := tx.GetOne(kv.DatabaseInfo, rawdb.SnapshotsHistoryKey)
+	require.NoError(t, err)
+	require.Equal(t, `["v1-accounts.0-2.kv"]`, string(v), "still written for old versions")
+	blocks, hist, err = rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1-000000-000500-headers.seg"}, blocks)
+	require.Equal(t, []string{"v1-accounts.0-2.kv"}, hist)
+
+	// only records of changed files are written
+	require.NoError(t, rawdb.UpdateSnapshots(tx, blocks, []string{"v1-accounts.2-3.kv"}, nil))
+	_, hist, err = rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1-accounts.0-2.kv", "v1-accounts.2-3.kv"}, hist)
+	var records int
+	require.NoError(t, tx.ForEach(kv.DatabaseInfo, rawdb.SnapshotsHistoryFilePrefix, func(k, v []byte) error {
+		if bytes.HasPrefix(k, rawdb.SnapshotsHistoryFilePrefix) {
+			records++
+		}
+		return nil
+	}))
+	require.Equal(t, 2, records)
+
+	// full write replaces list
+	require.NoError(t, rawdb.WriteSnapshots(tx, blocks, []string{"v1-accounts.0-3.kv"}))
+	_, hist, err = rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1-accounts.0-3.kv"}, hist)
+
+	// downgraded node wrote only json list: it replaces records
+	legacy, err = json.Marshal([]string{"v1-accounts.0-3.kv", "v1-accounts.3-4.kv"})
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(kv.DatabaseInfo, rawdb.SnapshotsHistoryKey, legacy))
+	require.NoError(t, rawdb.UpdateSnapshots(tx, blocks, []string{"v1-accounts.4-5.kv"}, nil))
+	_, hist, err = rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1-accounts.0-3.kv", "v1-accounts.3-4.kv", "v1-accounts.4-5.kv"}, hist)
+	require.NoError(t, tx.Delete(kv.DatabaseInfo, rawdb.SnapshotsHistoryKey))
+	_, hist, err = rawdb.ReadSnapshots(tx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1-accounts.0-3.kv", "v1-accounts.3-4.kv", "v1-accounts.4-5.kv"}, hist, "records are same")
+}
@@ -121,3 +121,13 @@ func (w *BlockWriter) PruneBorBlocks(ctx context.Context, tx kv.RwTx, blockTo ui
 	defer mxPruneTookBor.ObserveDuration(time.Now())
 	return bordb.PruneBorBlocks(tx, blockTo, blocksDeleteLimit, SpanIdAt)
 }
+
+// ReadRetireProgress - see rawdb.RetireProgress
+func (w *BlockWriter) ReadRetireProgress(tx kv.Getter) (rawdb.RetireProgress, error) {
+	return rawdb.ReadRetireProgress(tx)
+}
+
+// WriteRetireProgress - empty progress deletes the record
+func (w *BlockWriter) WriteRetireProgress(tx kv.RwTx, p rawdb.RetireProgress) error {
+	return rawdb.WriteRetireProgress(tx, p)
+}
@@ -0,0 +1,318 @@
+package snaptype
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon-lib/chain"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/seg"
+	types2 "github.com/ledgerwatch/erigon-lib/types"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+const maxTxnHashIdxShards = 256 // shard per leading byte of hash
+
+// BuildTxnHashIdxShards - builds txn-hash indices (TxnHash, TxnHash2BlockNum) of transactions segment `sn` as `shards`
+// shards: key space is partitioned by leading byte of txn hash, see snaptype.IdxShardOf. Bad shard can be rebuilt alone
+// by BuildTxnHashIdxShard. Ordinal lookups (txn by txnID) are served by separated TxnHash.Ordinals() index.
+// Layout of already indexed segments is detected on open: datadir may have both layouts. See BlocksFreezing.TxnHashIdxShards
+func BuildTxnHashIdxShards(ctx context.Context, sn snaptype.FileInfo, shards int, chainConfig *chain.Config, tmpDir string, p *background.Progress, logger log.Logger) error {
+	salt, err := snaptype.GetIndexSalt(sn.Dir())
+	if err != nil {
+		return err
+	}
+	return buildTxnHashIdxShards(ctx, sn, salt, chainConfig, tmpDir, p, shards, -1, logger)
+}
+
+// BuildTxnHashIdxShard - rebuilds `shard`-th shard of sharded txn-hash indices of transactions segment `sn`. Other shards
+// and ordinals index are not touched; transactions of other shards are not parsed
+func BuildTxnHashIdxShard(ctx context.Context, sn snaptype.FileInfo, shard int, chainConfig *chain.Config, tmpDir string, p *background.Progress, logger log.Logger) error {
+	txnHashShards, err := Indexes.TxnHash.Shards(sn)
+	if err != nil {
+		return fmt.Errorf("BuildTxnHashIdxShard: %w", err)
+	}
+	toBlockShards, err := Indexes.TxnHash2BlockNum.Shards(sn)
+	if err != nil {
+		return fmt.Errorf("BuildTxnHashIdxShard: %w", err)
+	}
+	if txnHashShards != 0 && toBlockShards != 0 && txnHashShards != toBlockShards {
+		return fmt.Errorf("BuildTxnHashIdxShard: %s: indices have different amount of shards: %d and %d", sn.Name(), txnHashShards, toBlockShards)
+	}
+	shards := max(txnHashShards, toBlockShards) // any shard may be removed
+	if shards == 0 {
+		return fmt.Errorf("BuildTxnHashIdxShard: %s: txn-hash indices are not sharded", sn.Name())
+	}
+	if shard < 0 || shard >= shards {
+		return fmt.Errorf("BuildTxnHashIdxShard: %s: shard %d out of %d", sn.Name(), shard, shards)
+	}
+	salt, err := snaptype.GetIndexSalt(sn.Dir())
+	if err != nil {
+		return err
+	}
+	return buildTxnHashIdxShards(ctx, sn, salt, chainConfig, tmpDir, p, shards, shard, logger)
+}
+
+// txnHashShardIndices - recsplits of one shard
+type txnHashShardIndices struct {
+	txnHash, txnHash2BlockNum *recsplit.RecSplit
+}
+
+// buildTxnHashIdxShards - builds ordinals index and all `shards` shards of txn-hash indices, or only shard `only` if >= 0.
+// Shards have same format as single files: TxnHash maps hash to offset in segment, TxnHash2BlockNum - to block number
+func buildTxnHashIdxShards(ctx context.Context, sn snaptype.FileInfo, salt uint32, chainConfig *chain.Config, tmpDir string, p *background.Progress, shards, only int, logger log.Logger) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("index panic: at=%s, %v, %s", sn.Name(), rec, dbg.Stack())
+		}
+	}()
+	if shards < 2 || shards > maxTxnHashIdxShards {
+		return fmt.Errorf("TransactionsIdx: at=%d-%d, shards must be in [2, %d], got %d", sn.From, sn.To, maxTxnHashIdxShards, shards)
+	}
+	firstBlockNum := sn.From
+
+	bodiesSegment, err := seg.NewDecompressor(sn.As(Bodies).Path)
+	if err != nil {
+		return fmt.Errorf("can't open %s for indexing: %w", sn.As(Bodies).Name(), err)
+	}
+	defer bodiesSegment.Close()
+
+	baseTxnID, expectedCount, err := txsAmountBasedOnBodiesSnapshots(bodiesSegment, sn.Len()-1)
+	if err != nil {
+		return err
+	}
+
+	d, err := seg.NewDecompressor(sn.Path)
+	if err != nil {
+		return fmt.Errorf("can't open %s for indexing: %w", sn.Path, err)
+	}
+	defer d.Close()
+	if d.Count() != expectedCount {
+		return fmt.Errorf("TransactionsIdx: at=%d-%d, pre index building, expect: %d, got %d", sn.From, sn.To, expectedCount, d.Count())
+	}
+
+	defer d.EnableReadAhead().DisableReadAhead()
+	defer bodiesSegment.EnableReadAhead().DisableReadAhead()
+
+	// segment stores first byte of txn hash: shard of each txn is known without parsing
+	shardOf := func(txnID uint64, word []byte) int {
+		if len(word) == 0 { // system-txs hash:pad32(txnID)
+			return snaptype.IdxShardOf([]byte{byte(txnID >> 56)}, shards)
+		}
+		return snaptype.IdxShardOf(word, shards)
+	}
+	if p != nil {
+		name := sn.Name()
+		p.Name.Store(&name)
+		p.Total.Store(uint64(d.Count() * 2))
+	}
+
+	keyCounts := make([]int, shards)
+	g, word := d.MakeGetter(), make([]byte, 0, 4096)
+	for ti := uint64(0); g.HasNext(); ti++ {
+		if p != nil {
+			p.Processed.Add(1)
+		}
+		word, _ = g.Next(word[:0])
+		keyCounts[shardOf(baseTxnID.U64()+ti, word)]++
+	}
+	// all shards are built at once: share RAM limit of one index
+	shardEtlBufLimit := etl.BufferOptimalSize / 4 / datasize.ByteSize(shards)
+
+	var ordinals *recsplit.RecSplit
+	if only < 0 {
+		ordinals, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
+			KeyCount:   d.Count(),
+			Enums:      true,
+			BucketSize: 2000,
+			LeafSize:   8,
+			TmpDir:     tmpDir,
+			IndexFile:  filepath.Join(sn.Dir(), snaptype.IdxFileName(sn.Version, sn.From, sn.To, Indexes.TxnHash.Ordinals().Name)),
+			BaseDataID: baseTxnID.U64(),
+			Salt:       &salt,
+		}, logger)
+		if err != nil {
+			return err
+		}
+		defer ordinals.Close()
+		ordinals.LogLvl(log.LvlDebug)
+	}
+
+	indices := make([]*txnHashShardIndices, shards)
+	for shard := range indices {
+		if only >= 0 && shard != only {
+			continue
+		}
+		txnHashIdx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+			KeyCount: keyCounts[shard],
+
+			Enums:              true,
+			LessFalsePositives: true,
+
+			BucketSize:  2000,
+			LeafSize:    8,
+			TmpDir:      tmpDir,
+			IndexFile:   filepath.Join(sn.Dir(), snaptype.IdxShardFileName(sn.Version, sn.From, sn.To, Indexes.TxnHash.Name, shard, shards)),
+			BaseDataID:  baseTxnID.U64(),
+			Salt:        &salt,
+			EtlBufLimit: shardEtlBufLimit,
+		}, logger)
+		if err != nil {
+			return err
+		}
+		defer txnHashIdx.Close()
+		txnHash2BlockNumIdx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+			KeyCount:    keyCounts[shard],
+			Enums:       false,
+			BucketSize:  2000,
+			LeafSize:    8,
+			TmpDir:      tmpDir,
+			IndexFile:   filepath.Join(sn.Dir(), snaptype.IdxShardFileName(sn.Version, sn.From, sn.To, Indexes.TxnHash2BlockNum.Name, shard, shards)),
+			BaseDataID:  firstBlockNum,
+			Salt:        &salt,
+			EtlBufLimit: shardEtlBufLimit,
+		}, logger)
+		if err != nil {
+			return err
+		}
+		defer txnHash2BlockNumIdx.Close()
+		txnHashIdx.LogLvl(log.LvlDebug)
+		txnHash2BlockNumIdx.LogLvl(log.LvlDebug)
+		indices[shard] = &txnHashShardIndices{txnHash: txnHashIdx, txnHash2BlockNum: txnHash2BlockNumIdx}
+	}
+	resetNextSalt := func() {
+		if ordinals != nil {
+			ordinals.ResetNextSalt()
+		}
+		for _, idx := range indices {
+			if idx != nil {
+				idx.txnHash.ResetNextSalt()
+				idx.txnHash2BlockNum.ResetNextSalt()
+			}
+		}
+	}
+
+	chainId, _ := uint256.FromBig(chainConfig.ChainID)
+
+	parseCtx := types2.NewTxParseContext(*chainId)
+	parseCtx.WithSender(false)
+	slot := types2.TxSlot{}
+	bodyBuf := make([]byte, 0, 4096)
+	num := make([]byte, binary.MaxVarintLen64)
+
+	for {
+		g, bodyGetter := d.MakeGetter(), bodiesSegment.MakeGetter()
+		var ti, offset, nextPos uint64
+		blockNum := firstBlockNum
+		body := &types.BodyForStorage{}
+
+		bodyBuf, _ = bodyGetter.Next(bodyBuf[:0])
+		if err := rlp.DecodeBytes(bodyBuf, body); err != nil {
+			return err
+		}
+
+		for g.HasNext() {
+			if p != nil {
+				p.Processed.Add(1)
+			}
+
+			word, nextPos = g.Next(word[:0])
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			for body.BaseTxnID.LastSystemTx(body.TxCount) < baseTxnID.U64()+ti { // skip empty blocks
+				if !bodyGetter.HasNext() {
+					return fmt.Errorf("not enough bodies")
+				}
+
+				bodyBuf, _ = bodyGetter.Next(bodyBuf[:0])
+				if err := rlp.DecodeBytes(bodyBuf, body); err != nil {
+					return err
+				}
+
+				blockNum++
+			}
+
+			if ordinals != nil {
+				n := binary.PutUvarint(num, ti)
+				if err := ordinals.AddKey(num[:n], offset); err != nil {
+					return err
+				}
+			}
+
+			if idx := indices[shardOf(baseTxnID.U64()+ti, word)]; idx != nil {
+				firstTxByteAndlengthOfAddress := 21
+				isSystemTx := len(word) == 0
+				if isSystemTx { // system-txs hash:pad32(txnID)
+					slot.IDHash = common.Hash{}
+					binary.BigEndian.PutUint64(slot.IDHash[:], baseTxnID.U64()+ti)
+				} else {
+					if _, err = parseCtx.ParseTransaction(word[firstTxByteAndlengthOfAddress:], 0, &slot, nil, true /* hasEnvelope */, false /* wrappedWithBlobs */, nil /* validateHash */); err != nil {
+						return fmt.Errorf("ParseTransaction: %w, blockNum: %d, i: %d", err, blockNum, ti)
+					}
+					if slot.IDHash[0] != word[0] {
+						return fmt.Errorf("TransactionsIdx: at=%d-%d, blockNum: %d, i: %d, first byte of txn hash %x doesn't match segment %x", sn.From, sn.To, blockNum, ti, slot.IDHash[0], word[0])
+					}
+				}
+
+				if err := idx.txnHash.AddKey(slot.IDHash[:], offset); err != nil {
+					return err
+				}
+				if err := idx.txnHash2BlockNum.AddKey(slot.IDHash[:], blockNum); err != nil {
+					return err
+				}
+			}
+
+			ti++
+			offset = nextPos
+		}
+
+		if int(ti) != expectedCount {
+			return fmt.Errorf("TransactionsIdx: at=%d-%d, post index building, expect: %d, got %d", sn.From, sn.To, expectedCount, ti)
+		}
+
+		// ordinals first: shards without ordinals index are not complete layout and will be re-indexed
+		rss := make([]*recsplit.RecSplit, 0, 2*shards+1)
+		if ordinals != nil {
+			rss = append(rss, ordinals)
+		}
+		for _, idx := range indices {
+			if idx != nil {
+				rss = append(rss, idx.txnHash, idx.txnHash2BlockNum)
+			}
+		}
+		collision := false
+		for _, rs := range rss {
+			if err := rs.Build(ctx); err != nil {
+				if errors.Is(err, recsplit.ErrCollision) {
+					logger.Warn("Building recsplit. Collision happened. It's ok. Restarting with another salt...", "err", err)
+					collision = true
+					break
+				}
+				return fmt.Errorf("TransactionsIdx: at=%d-%d: %w", sn.From, sn.To, err)
+			}
+		}
+		if collision {
+			resetNextSalt()
+			continue
+		}
+
+		return nil
+	}
+}
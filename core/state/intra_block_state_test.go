@@ -241,7 +241,7 @@ func (test *snapshotTest) run() bool {
 	defer db.Close()
 
 	cr := rawdb.NewCanonicalReader()
-	agg, err := stateLib.NewAggregator(context.Background(), datadir.New(""), 16, db, cr, log.New())
+	agg, err := stateLib.NewAggregator(context.Background(), datadir.New(""), 16, db, cr, stateLib.DefaultCommitmentValuesTransform, log.New())
 	if err != nil {
 		test.err = err
 		return false
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	libcommon "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/kv/temporal"
+	"github.com/ledgerwatch/erigon-lib/state"
+	types2 "github.com/ledgerwatch/erigon-lib/types"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// merge of appendable files must not need bodies of merged steps: they are pruned after files are built
+func TestAppendableMergeAfterBodiesPruned(t *testing.T) {
+	ctx, logger := context.Background(), log.New()
+	aggStep, blockTxs := uint64(16), uint64(8)
+	dirs := datadir.New(t.TempDir())
+	const table = "L2Messages"
+	db := mdbx.NewMDBX(logger).InMem(dirs.Chaindata).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		cfg := kv.TableCfg{table: kv.TableCfgItem{}}
+		for name, item := range kv.ChaindataTablesCfg {
+			cfg[name] = item
+		}
+		return cfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+
+	agg, err := state.NewAggregator(ctx, dirs, aggStep, db, rawdb.NewCanonicalReader(), state.DefaultCommitmentValuesTransform, logger)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	pos := kv.CustomAppendable(0)
+	require.NoError(t, agg.RegisterAppendable(pos, state.AppendableCfg{}, "l2msgs", table))
+	require.NoError(t, agg.OpenFolder())
+	agg.DisableFsync()
+	tdb, err := temporal.New(db, agg)
+	require.NoError(t, err)
+
+	// canonical blocks of `blockTxs` txs: TxnId == txNum
+	writeSteps := func(fromStep, toStep uint64) {
+		t.Helper()
+		tx, err := tdb.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := state.NewSharedDomains(tx, logger)
+		require.NoError(t, err)
+		defer domains.Close()
+
+		for blockNum := fromStep * aggStep / blockTxs; blockNum < toStep*aggStep/blockTxs; blockNum++ {
+			hash := libcommon.Hash{byte(blockNum + 1)}
+			require.NoError(t, rawdb.WriteBodyForStorage(tx, hash, blockNum, &types.BodyForStorage{BaseTxnID: types.BaseTxnID(blockNum * blockTxs), TxCount: uint32(blockTxs)}))
+			require.NoError(t, rawdb.WriteCanonicalHash(tx, hash, blockNum))
+			require.NoError(t, rawdbv3.TxNums.Append(tx, blockNum, (blockNum+1)*blockTxs-1))
+			for txNum := blockNum * blockTxs; txNum < (blockNum+1)*blockTxs; txNum++ {
+				domains.SetTxNum(txNum)
+				addr := make([]byte, length.Addr)
+				binary.BigEndian.PutUint64(addr, txNum)
+				require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, types2.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), nil, 0))
+				require.NoError(t, ac.AppendablePut(pos, kv.TxnId(txNum), hexutility.EncodeTs(txNum), tx))
+			}
+		}
+		require.NoError(t, domains.Flush(ctx, tx))
+		require.NoError(t, tx.Commit())
+	}
+	mergedExists := func() bool {
+		t.Helper()
+		exists, err := dir.FileExist(filepath.Join(dirs.SnapHistory, "v1-l2msgs.0-2.ap"))
+		require.NoError(t, err)
+		return exists
+	}
+
+	writeSteps(0, 2)
+	require.NoError(t, agg.BuildFiles(2*aggStep)) // step 0: last step stays in DB
+	require.False(t, mergedExists())
+
+	// blocks of step 0 are frozen: bodies pruned
+	require.NoError(t, tdb.Update(ctx, func(tx kv.RwTx) error {
+		for blockNum := uint64(0); blockNum < aggStep/blockTxs; blockNum++ {
+			rawdb.DeleteBody(tx, libcommon.Hash{byte(blockNum + 1)}, blockNum)
+		}
+		return nil
+	}))
+
+	writeSteps(2, 3)
+	require.NoError(t, agg.BuildFiles(3*aggStep)) // step 1 and merge of steps 0-2
+	require.True(t, mergedExists())
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.NoError(t, tdb.View(ctx, func(tx kv.Tx) error {
+		for txNum := uint64(0); txNum < 2*aggStep; txNum++ {
+			v, ok, err := ac.AppendableGet(pos, kv.TxnId(txNum), tx)
+			require.NoError(t, err)
+			require.True(t, ok, txNum)
+			require.Equal(t, hexutility.EncodeTs(txNum), v, txNum)
+		}
+		return nil
+	}))
+}
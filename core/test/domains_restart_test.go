@@ -55,7 +55,7 @@ func testDbAndAggregatorv3(t *testing.T, fpath string, aggStep uint64) (kv.RwDB,
 	t.Cleanup(db.Close)
 
 	cr := rawdb.NewCanonicalReader()
-	agg, err := state.NewAggregator(context.Background(), dirs, aggStep, db, cr, logger)
+	agg, err := state.NewAggregator(context.Background(), dirs, aggStep, db, cr, state.DefaultCommitmentValuesTransform, logger)
 	require.NoError(t, err)
 	t.Cleanup(agg.Close)
 	err = agg.OpenFolder()
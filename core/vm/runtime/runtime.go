@@ -131,7 +131,7 @@ func Execute(code, input []byte, cfg *Config, tempdir string) ([]byte, *state.In
 		db := memdb.NewStateDB(tempdir)
 		defer db.Close()
 		cr := rawdb.NewCanonicalReader()
-		agg, err := state3.NewAggregator(context.Background(), datadir.New(tempdir), config3.HistoryV3AggregationStep, db, cr, log.New())
+		agg, err := state3.NewAggregator(context.Background(), datadir.New(tempdir), config3.HistoryV3AggregationStep, db, cr, state3.DefaultCommitmentValuesTransform, log.New())
 		if err != nil {
 			return nil, nil, err
 		}
@@ -194,7 +194,7 @@ func Create(input []byte, cfg *Config, blockNr uint64) ([]byte, libcommon.Addres
 		db := memdb.NewStateDB(tmp)
 		defer db.Close()
 		cr := rawdb.NewCanonicalReader()
-		agg, err := state3.NewAggregator(context.Background(), datadir.New(tmp), config3.HistoryV3AggregationStep, db, cr, log.New())
+		agg, err := state3.NewAggregator(context.Background(), datadir.New(tmp), config3.HistoryV3AggregationStep, db, cr, state3.DefaultCommitmentValuesTransform, log.New())
 		if err != nil {
 			return nil, [20]byte{}, 0, err
 		}
@@ -62,6 +62,9 @@ var (
 	OnlyCreateDB          = EnvBool("ONLY_CREATE_DB", false)
 
 	CommitEachStage = EnvBool("COMMIT_EACH_STAGE", false)
+
+	// panic (with stacks of both holders) if Aggregator's files locks are taken in wrong order
+	AggLockOrderCheck = EnvBool("AGG_LOCK_ORDER_CHECK", false)
 )
 
 func ReadMemStats(m *runtime.MemStats) {
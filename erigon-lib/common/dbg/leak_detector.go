@@ -98,6 +98,17 @@ func (d *LeakDetector) Add() uint64 {
 	return id
 }
 
+// Get - creation stack and time of resource which is not closed yet. ok=false if detector is disabled or resource is closed
+func (d *LeakDetector) Get(id uint64) (stack string, started time.Time, ok bool) {
+	if d == nil || !d.Enabled() {
+		return "", time.Time{}, false
+	}
+	d.listLock.Lock()
+	defer d.listLock.Unlock()
+	item, ok := d.list[id]
+	return item.stack, item.started, ok
+}
+
 func (d *LeakDetector) Enabled() bool { return d.enabled.Load() }
 func (d *LeakDetector) SetSlowThreshold(t time.Duration) {
 	d.slowThreshold.Store(&t)
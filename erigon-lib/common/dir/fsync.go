@@ -0,0 +1,60 @@
+package dir
+
+import (
+	"fmt"
+	"os"
+)
+
+// FsyncPolicy - which writes of produced files must be fsynced
+type FsyncPolicy uint8
+
+const (
+	// FsyncFull - fsync every produced file (including intermediate ones which will be renamed again) and dir after every rename
+	FsyncFull FsyncPolicy = iota
+	// FsyncFinalOnly - fsync only files right before rename-into-place and dir after it. For battery-backed RAID.
+	FsyncFinalOnly
+	// FsyncNone - no fsync at all. For tests.
+	FsyncNone
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncFull:
+		return "full"
+	case FsyncFinalOnly:
+		return "final"
+	case FsyncNone:
+		return "none"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "full", "":
+		return FsyncFull, nil
+	case "final":
+		return FsyncFinalOnly, nil
+	case "none":
+		return FsyncNone, nil
+	default:
+		return FsyncFull, fmt.Errorf("unknown fsync policy %q, supported: full, final, none", s)
+	}
+}
+
+// Final - fsync of files renamed into place and their dirs
+func (p FsyncPolicy) Final() bool { return p != FsyncNone }
+
+// Intermediate - fsync of files which will be renamed again before they are used
+func (p FsyncPolicy) Intermediate() bool { return p == FsyncFull }
+
+// FsyncFile - fsync of already closed file
+func FsyncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
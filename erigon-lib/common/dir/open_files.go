@@ -0,0 +1,93 @@
+package dir
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+// Process-wide accounting of file descriptors kept open by snapshot/state files (.seg, .idx, .kv, .v, .ef, .bt, ...).
+// Open/Close of seg.Decompressor, recsplit.Index, state.BtIndex call TrackOpenFile/UntrackOpenFile.
+// Big datadirs may exceed default `ulimit -n` - then "too many open files" comes from unrelated code,
+// so when amount of open files crosses soft limit - warning with biggest contributors is logged.
+var openFiles = struct {
+	total     atomic.Int64
+	softLimit atomic.Int64 // 0 - no limit
+	warned    atomic.Bool  // warning is logged once per crossing of soft limit
+
+	lock  sync.Mutex
+	byExt map[string]int
+}{byExt: map[string]int{}}
+
+// SetOpenFilesSoftLimit - 0 disables the warning
+func SetOpenFilesSoftLimit(limit int) { openFiles.softLimit.Store(int64(limit)) }
+func OpenFilesSoftLimit() int         { return int(openFiles.softLimit.Load()) }
+
+// OpenFilesCount - amount of snapshot/state files open by this process
+func OpenFilesCount() int { return int(openFiles.total.Load()) }
+
+// OpenFilesByType - file extension -> amount of open files
+func OpenFilesByType() map[string]int {
+	openFiles.lock.Lock()
+	defer openFiles.lock.Unlock()
+	res := make(map[string]int, len(openFiles.byExt))
+	for ext, cnt := range openFiles.byExt {
+		if cnt > 0 {
+			res[ext] = cnt
+		}
+	}
+	return res
+}
+
+// OpenFilesTop - biggest contributors by type, like ".idx=1500, .seg=1200, .kv=300"
+func OpenFilesTop(limit int) string {
+	byExt := OpenFilesByType()
+	exts := make([]string, 0, len(byExt))
+	for ext := range byExt {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if byExt[exts[i]] != byExt[exts[j]] {
+			return byExt[exts[i]] > byExt[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	if limit > 0 && len(exts) > limit {
+		exts = exts[:limit]
+	}
+	parts := make([]string, len(exts))
+	for i, ext := range exts {
+		parts[i] = fmt.Sprintf("%s=%d", ext, byExt[ext])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TrackOpenFile(filePath string) {
+	ext := filepath.Ext(filePath)
+	openFiles.lock.Lock()
+	openFiles.byExt[ext]++
+	openFiles.lock.Unlock()
+
+	total := openFiles.total.Add(1)
+	limit := openFiles.softLimit.Load()
+	if limit > 0 && total > limit && openFiles.warned.CompareAndSwap(false, true) {
+		log.Warn("[dir] too many open snapshot/state files, consider increasing `ulimit -n`", "open", total, "softLimit", limit, "biggest", OpenFilesTop(5))
+	}
+}
+
+func UntrackOpenFile(filePath string) {
+	ext := filepath.Ext(filePath)
+	openFiles.lock.Lock()
+	openFiles.byExt[ext]--
+	openFiles.lock.Unlock()
+
+	total := openFiles.total.Add(-1)
+	if limit := openFiles.softLimit.Load(); limit <= 0 || total <= limit {
+		openFiles.warned.Store(false)
+	}
+}
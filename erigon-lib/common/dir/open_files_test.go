@@ -0,0 +1,66 @@
+package dir
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+func TestOpenFilesCount(t *testing.T) {
+	before, beforeByType := OpenFilesCount(), OpenFilesByType()
+	files := []string{"a/v1-accounts.0-1.kv", "a/v1-accounts.0-1.kvi", "a/v1-accounts.1-2.kv", "b/v1-000000-000500-headers.seg"}
+	for _, f := range files {
+		TrackOpenFile(f)
+	}
+	require.Equal(t, before+len(files), OpenFilesCount())
+	byType := OpenFilesByType()
+	require.Equal(t, beforeByType[".kv"]+2, byType[".kv"])
+	require.Equal(t, beforeByType[".kvi"]+1, byType[".kvi"])
+	require.Equal(t, beforeByType[".seg"]+1, byType[".seg"])
+	require.Contains(t, OpenFilesTop(1), ".kv=")
+
+	for _, f := range files {
+		UntrackOpenFile(f)
+	}
+	require.Equal(t, before, OpenFilesCount())
+	require.Equal(t, beforeByType, OpenFilesByType())
+}
+
+func TestOpenFilesSoftLimitWarning(t *testing.T) {
+	var warnings atomic.Int32
+	root := log.Root()
+	defer root.SetHandler(root.GetHandler())
+	root.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Lvl == log.LvlWarn {
+			warnings.Add(1)
+		}
+		return nil
+	}))
+	defer SetOpenFilesSoftLimit(OpenFilesSoftLimit())
+
+	limit := OpenFilesCount() + 2
+	SetOpenFilesSoftLimit(limit)
+	TrackOpenFile("1.seg")
+	TrackOpenFile("2.seg")
+	require.Zero(t, warnings.Load(), "at limit")
+	TrackOpenFile("3.seg")
+	require.Equal(t, int32(1), warnings.Load(), "above limit")
+	TrackOpenFile("4.seg")
+	require.Equal(t, int32(1), warnings.Load(), "once per crossing")
+
+	// back to limit and crossing it again: warned again
+	UntrackOpenFile("4.seg")
+	UntrackOpenFile("3.seg")
+	TrackOpenFile("3.seg")
+	require.Equal(t, int32(2), warnings.Load())
+
+	SetOpenFilesSoftLimit(0)
+	TrackOpenFile("4.seg")
+	require.Equal(t, int32(2), warnings.Load(), "disabled")
+	for _, f := range []string{"1.seg", "2.seg", "3.seg", "4.seg"} {
+		UntrackOpenFile(f)
+	}
+}
@@ -7,3 +7,14 @@ import "os"
 func ReadDir(name string) ([]os.DirEntry, error) {
 	return os.ReadDir(name)
 }
+
+// FsyncDir - makes creations/renames of files inside `dir` durable. Without it power-off right after `rename`
+// may leave zero-length directory entry (even if file itself was fsynced).
+func FsyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
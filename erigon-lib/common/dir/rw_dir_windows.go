@@ -22,3 +22,6 @@ func ReadDir(name string) ([]os.DirEntry, error) {
 	}
 	return files, err
 }
+
+// FsyncDir - no-op: windows doesn't support fsync of directories, NTFS journals directory entries itself
+func FsyncDir(dir string) error { return nil }
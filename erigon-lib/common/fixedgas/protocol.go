@@ -36,4 +36,7 @@ const (
 	BlobSize                       = FieldElementsPerBlob * 32
 	BlobGasPerBlob          uint64 = 0x20000
 	DefaultMaxBlobsPerBlock uint64 = 6 // lower for Gnosis
+
+	// EIP-7702: Set EOA account code
+	PerEmptyAccountCost uint64 = 25000 // Per authorization in set-code transaction
 )
@@ -0,0 +1,244 @@
+package snapbuild
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Class - kind of heavy files building job
+type Class int
+
+const (
+	BlockRetire Class = iota // blocks snapshots: dump and merge of segments
+	StateBuild               // state files of step
+	Merge                    // merge of state files
+	classesCount
+)
+
+func (c Class) String() string {
+	switch c {
+	case BlockRetire:
+		return "BlockRetire"
+	case StateBuild:
+		return "StateBuild"
+	case Merge:
+		return "Merge"
+	default:
+		return "unknown"
+	}
+}
+
+type waiter struct {
+	class Class
+	ready chan struct{} // closed when waiter's turn to acquire semaphore
+}
+
+// Coordinator - slots of shared semaphore for heavy files building jobs. Fair between classes: when several classes are
+// waiting - they get slots in round-robin (each class `weight` slots in a row, see SetWeight), inside class - FIFO.
+// Jobs must hold slot for one unit of work (one step, one range) and re-acquire for next one - otherwise long catch-up of
+// one class starves others.
+//
+// Acquire is not reentrant: job must not Acquire while holding slot (even of other class) - it may deadlock.
+// nil Coordinator - no limits: all methods succeed immediately.
+type Coordinator struct {
+	sema *semaphore.Weighted // external: builders without Coordinator (caplin antiquary) acquire it directly
+
+	lock      sync.Mutex
+	queues    [classesCount][]*waiter
+	candidate bool // one waiter at a time is acquiring `sema` - others wait for their turn in queues
+	last      Class
+	streak    int
+	weights   [classesCount]int
+	running   [classesCount]int
+	waits     [classesCount]uint64
+}
+
+func NewCoordinator(sema *semaphore.Weighted) *Coordinator {
+	if sema == nil {
+		return nil
+	}
+	c := &Coordinator{sema: sema}
+	for i := range c.weights {
+		c.weights[i] = 1
+	}
+	return c
+}
+
+var shared sync.Map // *semaphore.Weighted -> *Coordinator
+
+// Shared - Coordinator of `sema`: same for all callers - builders configured by same semaphore option (aggregator,
+// blocks retire) are coordinated together. nil `sema` - nil Coordinator
+func Shared(sema *semaphore.Weighted) *Coordinator {
+	if sema == nil {
+		return nil
+	}
+	c, _ := shared.LoadOrStore(sema, NewCoordinator(sema))
+	return c.(*Coordinator)
+}
+
+// SetWeight - slots in a row `class` gets when other classes are waiting. Default 1
+func (c *Coordinator) SetWeight(class Class, weight int) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.weights[class] = max(weight, 1)
+}
+
+// TryAcquire - takes slot only if it's free and nobody is waiting for it
+func (c *Coordinator) TryAcquire(class Class) bool {
+	if c == nil {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.candidate || c.hasWaitersLocked() || !c.sema.TryAcquire(1) {
+		return false
+	}
+	c.running[class]++
+	return true
+}
+
+// Acquire - blocks until slot is taken or `ctx` is done. Caller must Release slot of same class
+func (c *Coordinator) Acquire(ctx context.Context, class Class) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	if !c.candidate && !c.hasWaitersLocked() && c.sema.TryAcquire(1) {
+		c.running[class]++
+		c.lock.Unlock()
+		return nil
+	}
+	w := &waiter{class: class, ready: make(chan struct{})}
+	c.waits[class]++
+	c.queues[class] = append(c.queues[class], w)
+	c.promoteLocked()
+	c.lock.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		select {
+		case <-w.ready: // got turn concurrently - pass it to next waiter
+			c.candidate = false
+			c.promoteLocked()
+		default:
+			c.removeLocked(w)
+		}
+		return ctx.Err()
+	}
+
+	err := c.sema.Acquire(ctx, 1)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.candidate = false
+	if err == nil {
+		c.running[class]++
+	}
+	c.promoteLocked()
+	return err
+}
+
+func (c *Coordinator) Release(class Class) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.running[class]--
+	c.lock.Unlock()
+	c.sema.Release(1)
+}
+
+// Current - classes holding slots now, for logs. Empty if none
+func (c *Coordinator) Current() string {
+	if c == nil {
+		return ""
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var names []string
+	for class, n := range c.running {
+		for i := 0; i < n; i++ {
+			names = append(names, Class(class).String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Waiting - jobs of `class` waiting for slot now
+func (c *Coordinator) Waiting(class Class) int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queues[class])
+}
+
+// Waits - how many times jobs of `class` had to wait for slot since start
+func (c *Coordinator) Waits(class Class) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.waits[class]
+}
+
+func (c *Coordinator) hasWaitersLocked() bool {
+	for _, q := range c.queues {
+		if len(q) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// promoteLocked - gives turn to acquire `sema` to next waiter: class of previous turn keeps it while its streak is below
+// weight, then round-robin to next class with waiters
+func (c *Coordinator) promoteLocked() {
+	if c.candidate {
+		return
+	}
+	next := classesCount
+	if len(c.queues[c.last]) > 0 && c.streak < c.weights[c.last] {
+		next = c.last
+	} else {
+		for i := Class(1); i <= classesCount; i++ {
+			if class := (c.last + i) % classesCount; len(c.queues[class]) > 0 {
+				next = class
+				break
+			}
+		}
+	}
+	if next == classesCount {
+		return
+	}
+	if next == c.last {
+		c.streak++
+	} else {
+		c.last, c.streak = next, 1
+	}
+	w := c.queues[next][0]
+	c.queues[next][0] = nil
+	c.queues[next] = c.queues[next][1:]
+	c.candidate = true
+	close(w.ready)
+}
+
+func (c *Coordinator) removeLocked(w *waiter) {
+	q := c.queues[w.class]
+	for i := range q {
+		if q[i] == w {
+			c.queues[w.class] = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package snapbuild
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+// contend - `jobs` loop: acquire slot, hold it for `hold`, release and immediately acquire again. Until `iterations` of
+// class `until` are done. Returns order in which classes got slots
+func contend(t *testing.T, c *Coordinator, jobs []Class, until Class, iterations int, hold time.Duration) (order []Class) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// all jobs are waiting when first slot is released
+	require.NoError(t, c.Acquire(ctx, Merge))
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, class := range jobs {
+		wg.Add(1)
+		go func(class Class) {
+			defer wg.Done()
+			for {
+				if err := c.Acquire(ctx, class); err != nil {
+					return
+				}
+				lock.Lock()
+				order = append(order, class)
+				done := 0
+				for _, cl := range order {
+					if cl == until {
+						done++
+					}
+				}
+				lock.Unlock()
+				time.Sleep(hold)
+				c.Release(class)
+				if done >= iterations {
+					if class == until {
+						cancel()
+					}
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(class)
+	}
+	require.Eventually(t, func() bool {
+		n := 0
+		for class := Class(0); class < classesCount; class++ {
+			n += c.Waiting(class)
+		}
+		return n == len(jobs)-1 // one of them is acquiring semaphore
+	}, 5*time.Second, time.Millisecond)
+	c.Release(Merge)
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	return order
+}
+
+func TestCoordinatorAlternation(t *testing.T) {
+	c := NewCoordinator(semaphore.NewWeighted(1))
+	order := contend(t, c, []Class{StateBuild, BlockRetire}, BlockRetire, 20, 5*time.Millisecond)
+	require.GreaterOrEqual(t, len(order), 39)
+	for i := 1; i < len(order); i++ {
+		require.NotEqual(t, order[i-1], order[i], "%v", order)
+	}
+	require.Positive(t, c.Waits(StateBuild))
+	require.Positive(t, c.Waits(BlockRetire))
+	require.Empty(t, c.Current())
+}
+
+func TestCoordinatorNoStarvation(t *testing.T) {
+	c := NewCoordinator(semaphore.NewWeighted(1))
+	// 3 state jobs and merge against 1 blocks retire: it gets every 3rd slot
+	order := contend(t, c, []Class{StateBuild, StateBuild, StateBuild, Merge, BlockRetire}, BlockRetire, 10, 3*time.Millisecond)
+	last, got := -1, map[Class]int{}
+	for i, class := range order {
+		got[class]++
+		if class != BlockRetire {
+			continue
+		}
+		require.LessOrEqual(t, i-last-1, 2, "%v", order)
+		last = i
+	}
+	require.Equal(t, 10, got[BlockRetire])
+	require.GreaterOrEqual(t, got[StateBuild], 9)
+	require.GreaterOrEqual(t, got[Merge], 9)
+
+	t.Run("weight", func(t *testing.T) {
+		c := NewCoordinator(semaphore.NewWeighted(1))
+		c.SetWeight(StateBuild, 2)
+		order := contend(t, c, []Class{StateBuild, StateBuild, BlockRetire}, BlockRetire, 10, 3*time.Millisecond)
+		prev := -1
+		for i, class := range order {
+			if class != BlockRetire {
+				continue
+			}
+			if prev >= 0 {
+				require.Equal(t, []Class{StateBuild, StateBuild}, order[prev+1:i], "%v", order)
+			}
+			prev = i
+		}
+	})
+}
+
+func TestCoordinator(t *testing.T) {
+	ctx := context.Background()
+	sema := semaphore.NewWeighted(2)
+	c := NewCoordinator(sema)
+
+	require.True(t, c.TryAcquire(StateBuild))
+	require.NoError(t, c.Acquire(ctx, BlockRetire))
+	require.Equal(t, "BlockRetire,StateBuild", c.Current())
+	require.False(t, c.TryAcquire(Merge))
+
+	// caller of raw semaphore and cancellation
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.Acquire(canceled, Merge), context.DeadlineExceeded)
+	require.Zero(t, c.Waiting(Merge))
+	require.Equal(t, uint64(1), c.Waits(Merge))
+
+	c.Release(StateBuild)
+	require.True(t, sema.TryAcquire(1))
+	require.False(t, c.TryAcquire(Merge))
+	sema.Release(1)
+	require.True(t, c.TryAcquire(Merge))
+	c.Release(Merge)
+	c.Release(BlockRetire)
+	require.Empty(t, c.Current())
+
+	require.Same(t, Shared(sema), Shared(sema))
+	require.Nil(t, Shared(nil))
+	var noLimits *Coordinator
+	require.NoError(t, noLimits.Acquire(ctx, StateBuild))
+	require.True(t, noLimits.TryAcquire(StateBuild))
+	noLimits.Release(StateBuild)
+}
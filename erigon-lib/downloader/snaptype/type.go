@@ -102,6 +102,9 @@ func GetIndexSalt(baseDir string) (uint32, error) {
 		if err := dir.WriteFileWithFsync(fpath, saltBytes, os.ModePerm); err != nil {
 			return 0, err
 		}
+		if err := dir.FsyncDir(baseDir); err != nil {
+			return 0, err
+		}
 	}
 	saltBytes, err := os.ReadFile(fpath)
 	if err != nil {
@@ -145,7 +148,7 @@ func (i Index) HasFile(info FileInfo, logger log.Logger) bool {
 	idx, err := recsplit.OpenIndex(filepath.Join(dir, fName))
 
 	if err != nil {
-		return false
+		return i.hasShardFiles(info)
 	}
 
 	defer idx.Close()
@@ -153,6 +156,72 @@ func (i Index) HasFile(info FileInfo, logger log.Logger) bool {
 	return true // idx.ModTime().After(segment.ModTime())
 }
 
+// Ordinals - index of sharded layout which serves ordinal lookups (recsplit.Index.OrdinalLookup) of index `i`:
+// each shard has only part of keys, so ordinals of shards are not ordinals of segment
+func (i Index) Ordinals() Index {
+	return Index{Name: i.Name + "-ids", Offset: i.Offset}
+}
+
+// Shards - amount of shards of index `i` of segment `info` on disk, 0 if index is not sharded. Error if shard files on
+// disk disagree about amount of shards (leftovers of other layout): such index must be rebuilt
+func (i Index) Shards(info FileInfo) (int, error) {
+	pattern := filepath.Join(info.Dir(), IdxFileName(info.Version, info.From, info.To, i.Name+"-shard*-of-*"))
+	matches, err := filepath.Glob(pattern)
+	if err != nil || len(matches) == 0 {
+		return 0, nil
+	}
+	prefix := FileName(info.Version, info.From, info.To, i.Name+"-shard")
+	res := 0
+	for _, match := range matches {
+		var shard, shards int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(filepath.Base(match), prefix), "%d-of-%d.idx", &shard, &shards); err != nil {
+			return 0, fmt.Errorf("index %s: unexpected shard file name %s: %w", i.Name, filepath.Base(match), err)
+		}
+		if shards < 2 || shard < 0 || shard >= shards {
+			return 0, fmt.Errorf("index %s: unexpected shard file name %s", i.Name, filepath.Base(match))
+		}
+		if res != 0 && shards != res {
+			return 0, fmt.Errorf("index %s of %s: shard files of different amount of shards: %d and %d", i.Name, info.Name(), res, shards)
+		}
+		res = shards
+	}
+	return res, nil
+}
+
+// hasShardFiles - all shards of index and ordinals index of sharded layout can be open
+func (i Index) hasShardFiles(info FileInfo) bool {
+	shards, err := i.Shards(info)
+	if err != nil || shards == 0 {
+		return false
+	}
+	fileNames := make([]string, 0, shards+1)
+	if i.Offset == 0 {
+		fileNames = append(fileNames, IdxFileName(info.Version, info.From, info.To, i.Ordinals().Name))
+	}
+	for shard := 0; shard < shards; shard++ {
+		fileNames = append(fileNames, IdxShardFileName(info.Version, info.From, info.To, i.Name, shard, shards))
+	}
+	for _, fName := range fileNames {
+		idx, err := recsplit.OpenIndex(filepath.Join(info.Dir(), fName))
+		if err != nil {
+			return false
+		}
+		idx.Close()
+	}
+	return true
+}
+
+// IdxShardFileName - name of `shard`-th of `shards` files of index `name`: key space of sharded index is partitioned by
+// leading byte of key, see IdxShardOf
+func IdxShardFileName(version Version, from, to uint64, name string, shard, shards int) string {
+	return IdxFileName(version, from, to, fmt.Sprintf("%s-shard%d-of-%d", name, shard, shards))
+}
+
+// IdxShardOf - shard of `key` in index of `shards` shards: ranges of leading byte of equal size
+func IdxShardOf(key []byte, shards int) int {
+	return int(key[0]) * shards / 256
+}
+
 type Type interface {
 	Enum() Enum
 	Versions() Versions
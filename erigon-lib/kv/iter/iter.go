@@ -17,6 +17,7 @@
 package iter
 
 import (
+	"context"
 	"slices"
 
 	"github.com/ledgerwatch/erigon-lib/kv/order"
@@ -191,6 +192,12 @@ type Intersected[T constraints.Ordered] struct {
 
 func Intersect[T constraints.Ordered](x, y Uno[T], limit int) Uno[T] {
 	if x == nil || y == nil || !x.HasNext() || !y.HasNext() {
+		if x, ok := x.(Closer); ok {
+			x.Close()
+		}
+		if y, ok := y.(Closer); ok {
+			y.Close()
+		}
 		return &Empty[T]{}
 	}
 	m := &Intersected[T]{x: x, y: y, limit: limit}
@@ -327,6 +334,54 @@ func (m *FilteredDuo[K, v]) Close() {
 	}
 }
 
+// TakenWhileDuo - yields elements while `pred` is true. Closes underlying iterator on first element which doesn't match:
+// no reason to keep cursor open.
+type TakenWhileDuo[K, V any] struct {
+	it      Duo[K, V]
+	pred    func(K, V) bool
+	hasNext bool
+	err     error
+	nextK   K
+	nextV   V
+}
+
+func TakeWhileDuo[K, V any](it Duo[K, V], pred func(K, V) bool) *TakenWhileDuo[K, V] {
+	i := &TakenWhileDuo[K, V]{it: it, pred: pred}
+	i.advance()
+	return i
+}
+func (m *TakenWhileDuo[K, V]) advance() {
+	if m.err != nil {
+		return
+	}
+	m.hasNext = false
+	if !m.it.HasNext() {
+		return
+	}
+	key, val, err := m.it.Next()
+	if err != nil {
+		m.err = err
+		return
+	}
+	if !m.pred(key, val) {
+		m.Close()
+		return
+	}
+	m.hasNext = true
+	m.nextK, m.nextV = key, val
+}
+func (m *TakenWhileDuo[K, V]) HasNext() bool { return m.err != nil || m.hasNext }
+func (m *TakenWhileDuo[K, V]) Next() (k K, v V, err error) {
+	k, v, err = m.nextK, m.nextV, m.err
+	m.advance()
+	return k, v, err
+}
+func (m *TakenWhileDuo[K, v]) Close() {
+	if x, ok := m.it.(Closer); ok {
+		x.Close()
+	}
+}
+
 // Filtered - analog `map` (in terms of map-filter-reduce pattern)
 // please avoid reading from Disk/DB more elements and then filter them. Better
 // push-down filter conditions to lower-level iterator to reduce disk reads amount.
@@ -373,6 +428,96 @@ func (m *Filtered[T]) Close() {
 	}
 }
 
+// Cancelable - stops iteration on cancellation of `ctx`: HasNext returns true and Next returns ctx.Err() once, after
+// that HasNext returns false. Underlying iterator is closed on cancellation: no reason to keep cursors open.
+// For long iterations over files, which don't check ctx of `db.Begin(ctx)`.
+type Cancelable[T any] struct {
+	ctx    context.Context
+	it     Uno[T]
+	err    error
+	done   bool
+	closed bool
+}
+
+func WithCtx[T any](ctx context.Context, it Uno[T]) *Cancelable[T] {
+	return &Cancelable[T]{ctx: ctx, it: it}
+}
+func (m *Cancelable[T]) checkCtx() {
+	if m.err == nil && !m.done {
+		if m.err = m.ctx.Err(); m.err != nil {
+			m.Close()
+		}
+	}
+}
+func (m *Cancelable[T]) HasNext() bool {
+	if m.done {
+		return false
+	}
+	m.checkCtx()
+	return m.err != nil || m.it.HasNext()
+}
+func (m *Cancelable[T]) Next() (v T, err error) {
+	m.checkCtx()
+	if m.err != nil {
+		m.done = true
+		return v, m.err
+	}
+	return m.it.Next()
+}
+func (m *Cancelable[T]) Close() {
+	if m.closed {
+		return
+	}
+	m.closed = true
+	if x, ok := m.it.(Closer); ok {
+		x.Close()
+	}
+}
+
+// CancelableDuo - Duo version of Cancelable
+type CancelableDuo[K, V any] struct {
+	ctx    context.Context
+	it     Duo[K, V]
+	err    error
+	done   bool
+	closed bool
+}
+
+func WithCtxDuo[K, V any](ctx context.Context, it Duo[K, V]) *CancelableDuo[K, V] {
+	return &CancelableDuo[K, V]{ctx: ctx, it: it}
+}
+func (m *CancelableDuo[K, V]) checkCtx() {
+	if m.err == nil && !m.done {
+		if m.err = m.ctx.Err(); m.err != nil {
+			m.Close()
+		}
+	}
+}
+func (m *CancelableDuo[K, V]) HasNext() bool {
+	if m.done {
+		return false
+	}
+	m.checkCtx()
+	return m.err != nil || m.it.HasNext()
+}
+func (m *CancelableDuo[K, V]) Next() (k K, v V, err error) {
+	m.checkCtx()
+	if m.err != nil {
+		m.done = true
+		return k, v, m.err
+	}
+	return m.it.Next()
+}
+func (m *CancelableDuo[K, V]) Close() {
+	if m.closed {
+		return
+	}
+	m.closed = true
+	if x, ok := m.it.(Closer); ok {
+		x.Close()
+	}
+}
+
 // PaginatedIter - for remote-list pagination
 //
 //	Rationale: If an API does not support pagination from the start, supporting it later is troublesome because adding pagination breaks the API's behavior. Clients that are unaware that the API now uses pagination could incorrectly assume that they received a complete result, when in fact they only received the first page.
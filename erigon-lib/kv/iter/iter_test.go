@@ -414,3 +414,34 @@ func TestFiler(t *testing.T) {
 		require.Nil(t, res)
 	})
 }
+
+type closeCounter struct {
+	*iter.ArrStream[uint64]
+	closed int
+}
+
+func (c *closeCounter) Close() { c.closed++ }
+
+func TestWithCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	under := &closeCounter{ArrStream: iter.Array[uint64]([]uint64{1, 2, 3, 4})}
+	s := iter.WithCtx[uint64](ctx, under)
+	v, err := s.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), v)
+
+	cancel()
+	require.True(t, s.HasNext())
+	require.True(t, s.HasNext(), "HasNext is idempotent")
+	_, err = s.Next()
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, s.HasNext())
+	require.Equal(t, 1, under.closed, "underlying iterator is closed on cancellation")
+	s.Close()
+	require.Equal(t, 1, under.closed)
+
+	res, err := iter.ToArray[uint64](iter.WithCtx[uint64](context.Background(), iter.Array[uint64]([]uint64{1, 2})))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, res)
+}
@@ -411,6 +411,12 @@ type Tx interface {
 	//StreamDescend(table string, fromPrefix, toPrefix []byte, limit int) (iter.KV, error)
 	// Prefix - is exactly Range(Table, prefix, kv.NextSubtree(prefix))
 	Prefix(table string, prefix []byte) (iter.KV, error)
+	// PrefixLimit - like Prefix but also allow pass Limit parameter. Limit -1 means Unlimited
+	PrefixLimit(table string, prefix []byte, limit int) (iter.KV, error)
+	// PrefixDesc - like PrefixLimit, but in reverse order (for DupSort tables: values of each key are also in reverse order).
+	// Empty prefix means whole table. Prefixes ending on 0xFF are supported.
+	// example: PrefixDesc("Table", txNumPrefix, 10) - 10 most recent entries of time-ordered keys
+	PrefixDesc(table string, prefix []byte, limit int) (iter.KV, error)
 
 	// RangeDupSort - like Range but for fixed single key and iterating over range of values
 	RangeDupSort(table string, key []byte, fromPrefix, toPrefix []byte, asc order.By, limit int) (iter.KV, error)
@@ -565,9 +571,10 @@ type TemporalTx interface {
 	HistorySeek(name History, k []byte, ts uint64) (v []byte, ok bool, err error)
 
 	// IndexRange - return iterator over range of inverted index for given key `k`
-	// Asc semantic:  [from, to) AND from > to
-	// Desc semantic: [from, to) AND from < to
-	// Limit -1 means Unlimited
+	// Asc semantic:  [from, to) AND from <= to
+	// Desc semantic: (to, from] AND from >= to
+	// `from` is inclusive and `to` is exclusive in order of iteration - regardless if data is in files or in DB
+	// Limit -1 means Unlimited. Limit is applied to whole result (not to files and DB parts separately)
 	// from -1, to -1 means unbounded (StartOfTable, EndOfTable)
 	// Example: IndexRange("IndexName", 10, 5, order.Desc, -1)
 	// Example: IndexRange("IndexName", -1, -1, order.Asc, 10)
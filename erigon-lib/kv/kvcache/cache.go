@@ -279,6 +279,10 @@ func (c *Coherent) OnNewBlock(stateChanges *remote.StateChangeBatch) {
 	defer c.lock.Unlock()
 	c.waitExceededCount.Store(0) // reset the circuit breaker
 	id := stateChanges.StateVersionId
+	if id < c.latestStateVersionID {
+		// versions went backwards (for example: restart of node) - roots may have values of another history
+		c.dropRoots()
+	}
 	r := c.advanceRoot(id)
 
 	for _, sc := range stateChanges.ChangeBatch {
@@ -714,6 +718,21 @@ func (c *Coherent) evictRoots() {
 		delete(c.roots, txID)
 	}
 }
+
+// dropRoots - forget all views, next advanceRoot starts from empty cache. Waiters of dropped views (for example of
+// future versions of another history) are woken: their reads fail with "too old ViewID" instead of waiting for timeout
+func (c *Coherent) dropRoots() {
+	for _, r := range c.roots {
+		if r.readyChanClosed.CompareAndSwap(false, true) {
+			close(r.ready)
+		}
+	}
+	c.roots = map[uint64]*CoherentRoot{}
+	c.latestStateView = nil
+	c.stateEvict.Init()
+	c.codeEvict.Init()
+}
+
 func (c *Coherent) Len() int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -170,6 +170,26 @@ func TestEviction(t *testing.T) {
 	require.Equal(int(cfg.CacheSize.Bytes()), c.stateEvict.Size())
 }
 
+func TestDropRootsWakesWaiters(t *testing.T) {
+	require := require.New(t)
+	cfg := DefaultCoherentConfig
+	cfg.NewBlockWait = time.Hour
+	c := New(cfg)
+	c.OnNewBlock(&remote.StateChangeBatch{StateVersionId: 10})
+	future := c.selectOrCreateRoot(20) // View of version 20 waits for its block
+
+	c.OnNewBlock(&remote.StateChangeBatch{StateVersionId: 5}) // versions went backwards
+	select {
+	case <-future.ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiter of dropped view is not woken")
+	}
+	_, _, err := c.getFromCache([]byte{1}, 20, false)
+	require.ErrorContains(err, "too old ViewID")
+	_, _, err = c.getFromCache([]byte{1}, 5, false)
+	require.NoError(err)
+}
+
 func TestAPI(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.Skip("fix me on win please")
@@ -73,6 +73,9 @@ type MdbxOpts struct {
 	verbosity       kv.DBVerbosityLvl
 	label           kv.Label // marker to distinct db instances - one process may open many databases. for example to collect metrics of only 1 database
 	inMem           bool
+
+	trackReaders         bool          // see TrackReaders
+	readersWarnThreshold time.Duration // see TrackReaders
 }
 
 const DefaultMapSize = 2 * datasize.TB
@@ -113,6 +116,14 @@ func (opts MdbxOpts) RoTxsLimiter(l *semaphore.Weighted) MdbxOpts {
 	return opts
 }
 
+// TrackReaders - register open read transactions (with caller and label, see BeginRoLabeled) to report them by
+// LongRunningReaders. If warnThreshold > 0 - logs warning about read transactions living longer than it.
+func (opts MdbxOpts) TrackReaders(warnThreshold time.Duration) MdbxOpts {
+	opts.trackReaders = true
+	opts.readersWarnThreshold = warnThreshold
+	return opts
+}
+
 func (opts MdbxOpts) PageSize(v uint64) MdbxOpts {
 	opts.pageSize = v
 	return opts
@@ -418,6 +429,9 @@ func (opts MdbxOpts) Open(ctx context.Context) (kv.RwDB, error) {
 		MaxBatchSize:  DefaultMaxBatchSize,
 		MaxBatchDelay: DefaultMaxBatchDelay,
 	}
+	if opts.trackReaders {
+		db.readers = newReadersTracker(opts.readersWarnThreshold, opts.label.String(), opts.log)
+	}
 
 	customBuckets := opts.bucketsCfg(kv.ChaindataTablesCfg)
 	for name, cfg := range customBuckets { // copy map to avoid changing global variable
@@ -497,6 +511,7 @@ type MdbxKV struct {
 	txsAllDoneOnCloseCond *sync.Cond
 
 	leakDetector *dbg.LeakDetector
+	readers      *readersTracker // nil if MdbxOpts.TrackReaders is not set
 
 	// MaxBatchSize is the maximum size of a batch. Default value is
 	// copied from DefaultMaxBatchSize in Open.
@@ -750,6 +765,20 @@ func (db *MdbxKV) Close() {
 }
 
 func (db *MdbxKV) BeginRo(ctx context.Context) (txn kv.Tx, err error) {
+	return db.beginRo(ctx, "")
+}
+
+// BeginRoLabeled - same as BeginRo, label is reported by LongRunningReaders (see MdbxOpts.TrackReaders)
+func (db *MdbxKV) BeginRoLabeled(ctx context.Context, label string) (txn kv.Tx, err error) {
+	return db.beginRo(ctx, label)
+}
+
+// LongRunningReaders - open read transactions older than given age, oldest first. nil if MdbxOpts.TrackReaders is not set
+func (db *MdbxKV) LongRunningReaders(olderThan time.Duration) []ReaderInfo {
+	return db.readers.olderThan(olderThan)
+}
+
+func (db *MdbxKV) beginRo(ctx context.Context, label string) (txn kv.Tx, err error) {
 	// don't try to acquire if the context is already done
 	select {
 	case <-ctx.Done():
@@ -788,6 +817,7 @@ func (db *MdbxKV) BeginRo(ctx context.Context) (txn kv.Tx, err error) {
 		tx:       tx,
 		readOnly: true,
 		id:       db.leakDetector.Add(),
+		readerID: db.readers.add(label),
 	}, nil
 }
 
@@ -828,6 +858,7 @@ func (db *MdbxKV) beginRw(ctx context.Context, flags uint) (txn kv.RwTx, err err
 type MdbxTx struct {
 	tx               *mdbx.Txn
 	id               uint64 // set only if TRACE_TX=true
+	readerID         uint64 // set only if MdbxOpts.TrackReaders
 	db               *MdbxKV
 	statelessCursors map[string]kv.RwCursor
 	readOnly         bool
@@ -865,6 +896,9 @@ func (db *MdbxKV) AllTables() kv.TableCfg {
 func (tx *MdbxTx) IsRo() bool     { return tx.readOnly }
 func (tx *MdbxTx) ViewID() uint64 { return tx.tx.ID() }
 
+// Ctx - ctx passed to `db.Begin(ctx)`: long reads on top of transaction (for example over files) can check its cancellation
+func (tx *MdbxTx) Ctx() context.Context { return tx.ctx }
+
 func (tx *MdbxTx) CollectMetrics() {
 	if tx.db.opts.label != kv.ChainDB {
 		return
@@ -1070,8 +1104,10 @@ func (tx *MdbxTx) Commit() error {
 		tx.db.trackTxEnd()
 		if tx.readOnly {
 			tx.db.roTxsLimiter.Release(1)
+			tx.db.readers.del(tx.readerID)
 		} else {
 			runtime.UnlockOSThread()
+			tx.db.readers.warnSlow()
 		}
 		tx.db.leakDetector.Del(tx.id)
 	}()
@@ -1121,6 +1157,7 @@ func (tx *MdbxTx) Rollback() {
 		tx.db.trackTxEnd()
 		if tx.readOnly {
 			tx.db.roTxsLimiter.Release(1)
+			tx.db.readers.del(tx.readerID)
 		} else {
 			runtime.UnlockOSThread()
 		}
@@ -1943,6 +1980,25 @@ func (tx *MdbxTx) Prefix(table string, prefix []byte) (iter.KV, error) {
 	return tx.Range(table, prefix, nextPrefix)
 }
 
+func (tx *MdbxTx) PrefixLimit(table string, prefix []byte, limit int) (iter.KV, error) {
+	nextPrefix, ok := kv.NextSubtree(prefix)
+	if !ok {
+		return tx.RangeAscend(table, prefix, nil, limit)
+	}
+	return tx.RangeAscend(table, prefix, nextPrefix, limit)
+}
+
+// PrefixDesc - there is no exclusive lower bound for `prefix` in descending order (`prefix` itself is a valid key),
+// so iterator stops on first key without `prefix`
+func (tx *MdbxTx) PrefixDesc(table string, prefix []byte, limit int) (iter.KV, error) {
+	s, err := tx.rangeOrderLimit(table, prefix, nil, order.Desc, limit)
+	if err != nil {
+		return nil, err
+	}
+	s.prefix = prefix
+	return s, nil
+}
+
 func (tx *MdbxTx) Range(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
 	return tx.RangeAscend(table, fromPrefix, toPrefix, -1)
 }
@@ -1959,6 +2015,7 @@ type cursor2iter struct {
 	tx *MdbxTx
 
 	fromPrefix, toPrefix, nextK, nextV []byte
+	prefix                             []byte // if not nil: stop on first key without this prefix
 	orderAscend                        order.By
 	limit                              int64
 	ctx                                context.Context
@@ -2091,6 +2148,9 @@ func (s *cursor2iter) HasNext() bool {
 	if s.nextK == nil { // EndOfTable
 		return false
 	}
+	if s.prefix != nil && !bytes.HasPrefix(s.nextK, s.prefix) {
+		return false
+	}
 	if s.toPrefix == nil { // s.nextK == nil check is above
 		return true
 	}
@@ -19,7 +19,9 @@ package mdbx
 import (
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/rand"
 	"sync/atomic"
 	"testing"
@@ -429,6 +431,86 @@ func TestPrefix(t *testing.T) {
 	require.Nil(t, keys2)
 }
 
+func TestPrefixLimitAndDesc(t *testing.T) {
+	plain, dup := "Plain", "Table"
+	db := NewMDBX(log.New()).InMem(t.TempDir()).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.TableCfg{
+			plain: kv.TableCfgItem{},
+			dup:   kv.TableCfgItem{Flags: kv.DupSort},
+		}
+	}).MapSize(128 * datasize.MB).MustOpen()
+	t.Cleanup(db.Close)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(tx.Rollback)
+	for _, k := range []string{"00", "0100", "01ff", "01ff01", "01ffff", "02", "ff", "ff00", "ffff"} {
+		require.NoError(t, tx.Put(plain, hexBytes(t, k), []byte("v")))
+	}
+	for _, pair := range [][2]string{{"01", "v1"}, {"01ff", "a"}, {"01ff", "b"}, {"01ff", "c"}, {"ffff", "x"}, {"ffff", "y"}} {
+		require.NoError(t, tx.Put(dup, hexBytes(t, pair[0]), []byte(pair[1])))
+	}
+
+	tests := []struct {
+		table  string
+		prefix []byte
+		desc   bool
+		limit  int
+		want   []string
+	}{
+		{plain, hexBytes(t, "01ff"), false, -1, []string{"01ff:v", "01ff01:v", "01ffff:v"}},
+		{plain, hexBytes(t, "01ff"), true, -1, []string{"01ffff:v", "01ff01:v", "01ff:v"}},
+		{plain, hexBytes(t, "01ff"), false, 2, []string{"01ff:v", "01ff01:v"}},
+		{plain, hexBytes(t, "01ff"), true, 2, []string{"01ffff:v", "01ff01:v"}},
+		{plain, hexBytes(t, "ff"), false, -1, []string{"ff:v", "ff00:v", "ffff:v"}},
+		{plain, hexBytes(t, "ff"), true, -1, []string{"ffff:v", "ff00:v", "ff:v"}},
+		{plain, hexBytes(t, "ffff"), false, -1, []string{"ffff:v"}},
+		{plain, hexBytes(t, "ffff"), true, -1, []string{"ffff:v"}},
+		{plain, nil, false, -1, []string{"00:v", "0100:v", "01ff:v", "01ff01:v", "01ffff:v", "02:v", "ff:v", "ff00:v", "ffff:v"}},
+		{plain, []byte{}, true, -1, []string{"ffff:v", "ff00:v", "ff:v", "02:v", "01ffff:v", "01ff01:v", "01ff:v", "0100:v", "00:v"}},
+		{plain, nil, true, 3, []string{"ffff:v", "ff00:v", "ff:v"}},
+		{plain, hexBytes(t, "03"), false, -1, nil},
+		{plain, hexBytes(t, "03"), true, -1, nil},
+		{plain, hexBytes(t, "01"), true, 0, nil},
+
+		{dup, hexBytes(t, "01"), false, -1, []string{"01:v1", "01ff:a", "01ff:b", "01ff:c"}},
+		{dup, hexBytes(t, "01"), true, -1, []string{"01ff:c", "01ff:b", "01ff:a", "01:v1"}},
+		{dup, hexBytes(t, "01"), true, 2, []string{"01ff:c", "01ff:b"}},
+		{dup, hexBytes(t, "ff"), true, -1, []string{"ffff:y", "ffff:x"}},
+		{dup, hexBytes(t, "ffff"), false, 1, []string{"ffff:x"}},
+		{dup, nil, true, -1, []string{"ffff:y", "ffff:x", "01ff:c", "01ff:b", "01ff:a", "01:v1"}},
+		{dup, []byte{}, false, 4, []string{"01:v1", "01ff:a", "01ff:b", "01ff:c"}},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s/%x/desc=%t/limit=%d", tt.table, tt.prefix, tt.desc, tt.limit)
+		t.Run(name, func(t *testing.T) {
+			var it iter.KV
+			var err error
+			if tt.desc {
+				it, err = tx.PrefixDesc(tt.table, tt.prefix, tt.limit)
+			} else {
+				it, err = tx.PrefixLimit(tt.table, tt.prefix, tt.limit)
+			}
+			require.NoError(t, err)
+			defer it.Close()
+			var got []string
+			for it.HasNext() {
+				k, v, err := it.Next()
+				require.NoError(t, err)
+				got = append(got, fmt.Sprintf("%x:%s", k, v))
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func hexBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
 func TestAppendFirstLast(t *testing.T) {
 	_, tx, c := BaseCase(t)
 
@@ -1228,3 +1310,34 @@ func BenchmarkDB_Delete(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func TestLongRunningReaders(t *testing.T) {
+	ctx := context.Background()
+	db := NewMDBX(log.New()).InMem(t.TempDir()).TrackReaders(time.Millisecond).MapSize(128 * datasize.MB).MustOpen().(*MdbxKV)
+	t.Cleanup(db.Close)
+
+	tx, err := db.BeginRoLabeled(ctx, "long-reader")
+	require.NoError(t, err)
+	defer tx.Rollback()
+	time.Sleep(10 * time.Millisecond)
+
+	fresh, err := db.BeginRo(ctx) // younger than threshold - not reported
+	require.NoError(t, err)
+	defer fresh.Rollback()
+
+	readers := db.LongRunningReaders(5 * time.Millisecond)
+	require.Len(t, readers, 1)
+	require.Equal(t, "long-reader", readers[0].Label)
+	require.Contains(t, readers[0].Caller, "TestLongRunningReaders")
+	require.NotZero(t, readers[0].StackHash)
+	require.GreaterOrEqual(t, readers[0].Age(), 10*time.Millisecond)
+	require.Len(t, db.LongRunningReaders(0), 2)
+
+	tx.Rollback()
+	require.Empty(t, db.LongRunningReaders(5*time.Millisecond))
+	fresh.Rollback()
+	require.Empty(t, db.LongRunningReaders(0))
+
+	// tracking is disabled by default
+	require.Nil(t, BaseCaseDB(t).(*MdbxKV).LongRunningReaders(0))
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright 2024 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mdbx
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+// ReaderInfo - active read transaction, see MdbxKV.LongRunningReaders
+type ReaderInfo struct {
+	ID        uint64
+	Label     string // see MdbxKV.BeginRoLabeled
+	Caller    string // first frame outside of this package: `func file:line`
+	StackHash uint64 // same for read transactions opened by same call path
+	Started   time.Time
+}
+
+func (r ReaderInfo) Age() time.Duration { return time.Since(r.Started) }
+
+// pkgDir - frames of this package are skipped in ReaderInfo.Caller (Begin/View/etc...)
+var pkgDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// readersTracker - registry of open read transactions. Long-living read transactions prevent MDBX from reusing
+// pages freed by later write transactions - and DB grows. See MdbxOpts.TrackReaders
+type readersTracker struct {
+	warnThreshold time.Duration // 0 - don't warn
+	logger        log.Logger
+	dbLabel       string
+
+	lock          sync.Mutex
+	autoIncrement uint64
+	list          map[uint64]*trackedReader
+}
+
+type trackedReader struct {
+	ReaderInfo
+	warned bool
+}
+
+func newReadersTracker(warnThreshold time.Duration, dbLabel string, logger log.Logger) *readersTracker {
+	return &readersTracker{warnThreshold: warnThreshold, dbLabel: dbLabel, logger: logger, list: map[uint64]*trackedReader{}}
+}
+
+func (t *readersTracker) add(label string) uint64 {
+	if t == nil {
+		return 0
+	}
+	caller, stackHash := readerCaller()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.autoIncrement++
+	id := t.autoIncrement
+	t.list[id] = &trackedReader{ReaderInfo: ReaderInfo{ID: id, Label: label, Caller: caller, StackHash: stackHash, Started: time.Now()}}
+	t.warnSlowLocked()
+	return id
+}
+
+func (t *readersTracker) del(id uint64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.list, id)
+	t.warnSlowLocked()
+}
+
+func (t *readersTracker) warnSlow() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.warnSlowLocked()
+}
+
+// warnSlowLocked - checked lazily (on begin/end of read transactions and commit of write transactions), once per reader
+func (t *readersTracker) warnSlowLocked() {
+	if t.warnThreshold <= 0 {
+		return
+	}
+	for _, r := range t.list {
+		if r.warned || r.Age() < t.warnThreshold {
+			continue
+		}
+		r.warned = true
+		t.logger.Warn("[mdbx] long-running read transaction", "db", t.dbLabel, "label", r.Label, "age", r.Age(),
+			"caller", r.Caller, "stack_hash", fmt.Sprintf("%x", r.StackHash))
+	}
+}
+
+func (t *readersTracker) olderThan(age time.Duration) []ReaderInfo {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var res []ReaderInfo
+	for _, r := range t.list {
+		if r.Age() >= age {
+			res = append(res, r.ReaderInfo)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.Before(res[j].Started) })
+	return res
+}
+
+func readerCaller() (caller string, stackHash uint64) {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(3, pcs)]
+
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, pc := range pcs {
+		for i := range buf {
+			buf[i] = byte(pc >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if filepath.Dir(f.File) != pkgDir || strings.HasSuffix(f.File, "_test.go") {
+			return fmt.Sprintf("%s %s:%d", f.Function, filepath.Base(f.File), f.Line), h.Sum64()
+		}
+		if !more {
+			return "", h.Sum64()
+		}
+	}
+}
@@ -78,6 +78,16 @@ func (m *Mapmutation) Prefix(table string, prefix []byte) (iter.KV, error) {
 	panic("implement me")
 }
 
+func (m *Mapmutation) PrefixLimit(table string, prefix []byte, limit int) (iter.KV, error) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (m *Mapmutation) PrefixDesc(table string, prefix []byte, limit int) (iter.KV, error) {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (m *Mapmutation) RangeDupSort(table string, key []byte, fromPrefix, toPrefix []byte, asc order.By, limit int) (iter.KV, error) {
 	//TODO implement me
 	panic("implement me")
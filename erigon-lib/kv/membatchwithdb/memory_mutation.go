@@ -243,6 +243,20 @@ func (m *MemoryMutation) Prefix(table string, prefix []byte) (iter.KV, error) {
 	}
 	return m.Stream(table, prefix, nextPrefix)
 }
+func (m *MemoryMutation) PrefixLimit(table string, prefix []byte, limit int) (iter.KV, error) {
+	nextPrefix, ok := kv.NextSubtree(prefix)
+	if !ok {
+		return m.RangeAscend(table, prefix, nil, limit)
+	}
+	return m.RangeAscend(table, prefix, nextPrefix, limit)
+}
+func (m *MemoryMutation) PrefixDesc(table string, prefix []byte, limit int) (iter.KV, error) {
+	it, err := m.RangeDescend(table, prefix, nil, limit)
+	if err != nil {
+		return nil, err
+	}
+	return iter.TakeWhileDuo[[]byte, []byte](it, func(k, _ []byte) bool { return bytes.HasPrefix(k, prefix) }), nil
+}
 func (m *MemoryMutation) Stream(table string, fromPrefix, toPrefix []byte) (iter.KV, error) {
 	panic("please implement me")
 }
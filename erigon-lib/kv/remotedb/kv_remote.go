@@ -696,6 +696,22 @@ func (tx *tx) Prefix(table string, prefix []byte) (iter.KV, error) {
 	return tx.Range(table, prefix, nextPrefix)
 }
 
+func (tx *tx) PrefixLimit(table string, prefix []byte, limit int) (iter.KV, error) {
+	nextPrefix, ok := kv.NextSubtree(prefix)
+	if !ok {
+		return tx.RangeAscend(table, prefix, nil, limit)
+	}
+	return tx.RangeAscend(table, prefix, nextPrefix, limit)
+}
+
+func (tx *tx) PrefixDesc(table string, prefix []byte, limit int) (iter.KV, error) {
+	it, err := tx.RangeDescend(table, prefix, nil, limit)
+	if err != nil {
+		return nil, err
+	}
+	return iter.TakeWhileDuo[[]byte, []byte](it, func(k, _ []byte) bool { return bytes.HasPrefix(k, prefix) }), nil
+}
+
 func (tx *tx) rangeOrderLimit(table string, fromPrefix, toPrefix []byte, asc order.By, limit int) (iter.KV, error) {
 	return iter.PaginateKV(func(pageToken string) (keys [][]byte, values [][]byte, nextPageToken string, err error) {
 		req := &remote.RangeReq{TxId: tx.id, Table: table, FromPrefix: fromPrefix, ToPrefix: toPrefix, OrderAscend: bool(asc), Limit: int64(limit)}
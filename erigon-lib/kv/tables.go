@@ -388,6 +388,9 @@ const (
 	TblCodeHistoryKeys = "CodeHistoryKeys"
 	TblCodeHistoryVals = "CodeHistoryVals"
 	TblCodeIdx         = "CodeIdx"
+	// codeHash -> [8bytes of invStep]code, of CodeDomain values not in files yet. Only if code-hash index is enabled,
+	// see state.Aggregator.SetCodeHashIndex
+	TblCodeHashes = "CodeHashes"
 
 	TblCommitmentKeys        = "CommitmentKeys"
 	TblCommitmentVals        = "CommitmentVals"
@@ -411,6 +414,10 @@ const (
 	// and `Tbl{Account,Storage,Code,Commitment}Idx` for inverted indices
 	TblPruningProgress = "PruningProgress"
 
+	// Pruned boundary of history and inverted indices: filenameBase -> [8bytes]txNum. All data of txNum < boundary is deleted from DB.
+	// Updated by each Prune, used to tell "pruned" from "never existed". See state.ErrPrunedHistory
+	TblPrunedUpTo = "PrunedUpTo"
+
 	Snapshots = "Snapshots" // name -> hash
 
 	//State Reconstitution
@@ -626,6 +633,7 @@ var ChaindataTables = []string{
 	TblCodeHistoryKeys,
 	TblCodeHistoryVals,
 	TblCodeIdx,
+	TblCodeHashes,
 
 	TblCommitmentKeys,
 	TblCommitmentVals,
@@ -644,6 +652,7 @@ var ChaindataTables = []string{
 	TblTracesToIdx,
 
 	TblPruningProgress,
+	TblPrunedUpTo,
 
 	Snapshots,
 	MaxTxNum,
@@ -970,8 +979,21 @@ const (
 	//ReceiptsAppendable Appendable = 0
 	//AppendableLen      Appendable = 1
 	AppendableLen Appendable = 0
+
+	// AppendableMax - positions [AppendableLen, AppendableMax) are reserved for custom appendables
+	// (registered by state.Aggregator.RegisterAppendable): use CustomAppendable(i) to get position of i-th one.
+	AppendableMax Appendable = AppendableLen + 8
 )
 
+// CustomAppendable - position of i-th custom appendable in reserved range. Panics if range is exhausted.
+func CustomAppendable(i int) Appendable {
+	pos := AppendableLen + Appendable(i)
+	if i < 0 || pos >= AppendableMax {
+		panic(fmt.Sprintf("custom appendable %d is out of reserved range [%d, %d)", i, AppendableLen, AppendableMax))
+	}
+	return pos
+}
+
 func (iip InvertedIdxPos) String() string {
 	switch iip {
 	case LogAddrIdxPos:
@@ -1022,6 +1044,9 @@ func (iip Appendable) String() string {
 	//case ReceiptsAppendable:
 	//	return "receipts"
 	default:
+		if iip >= AppendableLen && iip < AppendableMax {
+			return fmt.Sprintf("custom%d", iip-AppendableLen)
+		}
 		return "unknown Appendable"
 	}
 }
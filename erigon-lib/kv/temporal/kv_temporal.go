@@ -201,15 +201,35 @@ func (tx *Tx) DomainGetAsOf(name kv.Domain, key, key2 []byte, ts uint64) (v []by
 	if key2 != nil {
 		key = append(common.Copy(key), key2...)
 	}
-	return tx.aggCtx.DomainGetAsOf(tx.MdbxTx, name, key, ts)
+	return tx.aggCtx.DomainGetAsOfCtx(tx.Ctx(), tx.MdbxTx, name, key, ts)
 }
 
 func (tx *Tx) HistorySeek(name kv.History, key []byte, ts uint64) (v []byte, ok bool, err error) {
-	return tx.aggCtx.HistorySeek(name, key, ts, tx.MdbxTx)
+	return tx.aggCtx.HistorySeekCtx(tx.Ctx(), name, key, ts, tx.MdbxTx)
 }
 
 func (tx *Tx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int) (timestamps iter.U64, err error) {
-	timestamps, err = tx.aggCtx.IndexRange(name, k, fromTs, toTs, asc, limit, tx.MdbxTx)
+	timestamps, err = tx.aggCtx.IndexRangeCtx(tx.Ctx(), name, k, fromTs, toTs, asc, limit, tx.MdbxTx)
+	if err != nil {
+		return nil, err
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, timestamps)
+	return timestamps, nil
+}
+
+// IndexIntersect - see state.AggregatorRoTx.IndexIntersect
+func (tx *Tx) IndexIntersect(a, b kv.InvertedIdx, aKey, bKey []byte, fromTs, toTs int, limit int) (timestamps iter.U64, err error) {
+	timestamps, err = tx.aggCtx.IndexIntersect(a, b, aKey, bKey, fromTs, toTs, limit, tx.MdbxTx)
+	if err != nil {
+		return nil, err
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, timestamps)
+	return timestamps, nil
+}
+
+// IndexIntersectMany - see state.AggregatorRoTx.IndexIntersectMany
+func (tx *Tx) IndexIntersectMany(names []kv.InvertedIdx, keys [][]byte, fromTs, toTs int, limit int) (timestamps iter.U64, err error) {
+	timestamps, err = tx.aggCtx.IndexIntersectManyCtx(tx.Ctx(), names, keys, fromTs, toTs, limit, tx.MdbxTx)
 	if err != nil {
 		return nil, err
 	}
@@ -218,7 +238,7 @@ func (tx *Tx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc or
 }
 
 func (tx *Tx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int) (iter.KV, error) {
-	it, err := tx.aggCtx.HistoryRange(name, fromTs, toTs, asc, limit, tx.MdbxTx)
+	it, err := tx.aggCtx.HistoryRangeCtx(tx.Ctx(), name, fromTs, toTs, asc, limit, tx.MdbxTx)
 	if err != nil {
 		return nil, err
 	}
@@ -226,6 +246,19 @@ func (tx *Tx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limi
 	return it, nil
 }
 
+// HistoryRangeWithCoverage - see state.AggregatorRoTx.HistoryRangeWithCoverage
+func (tx *Tx) HistoryRangeWithCoverage(name kv.History, fromTs, toTs int, asc order.By, limit int) (iter.KV, state.Coverage, error) {
+	cov, err := tx.aggCtx.HistoryCoverage(name, fromTs, toTs, tx.MdbxTx)
+	if err != nil {
+		return nil, cov, err
+	}
+	it, err := tx.HistoryRange(name, fromTs, toTs, asc, limit)
+	if err != nil {
+		return nil, cov, err
+	}
+	return it, cov, nil
+}
+
 func (tx *Tx) AppendableGet(name kv.Appendable, ts kv.TxnId) ([]byte, bool, error) {
 	return tx.aggCtx.AppendableGet(name, ts, tx.MdbxTx)
 }
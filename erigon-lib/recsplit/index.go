@@ -32,6 +32,7 @@ import (
 
 	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 	"github.com/ledgerwatch/erigon-lib/mmap"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano16"
@@ -110,17 +111,22 @@ func MustOpen(indexFile string) *Index {
 	return idx
 }
 
-func OpenIndex(indexFilePath string) (*Index, error) {
+func OpenIndex(indexFilePath string) (_ *Index, err error) {
 	_, fName := filepath.Split(indexFilePath)
 	idx := &Index{
 		filePath: indexFilePath,
 		fileName: fName,
 	}
-	var err error
 	idx.f, err = os.Open(indexFilePath)
 	if err != nil {
 		return nil, err
 	}
+	dir.TrackOpenFile(indexFilePath)
+	defer func() {
+		if err != nil {
+			idx.Close()
+		}
+	}()
 	var stat os.FileInfo
 	if stat, err = idx.f.Stat(); err != nil {
 		return nil, err
@@ -240,6 +246,7 @@ func (idx *Index) BaseDataID() uint64 { return idx.baseDataID }
 func (idx *Index) FilePath() string   { return idx.filePath }
 func (idx *Index) FileName() string   { return idx.fileName }
 func (idx *Index) IsOpen() bool       { return idx != nil && idx.f != nil }
+func (idx *Index) Salt() uint32       { return idx.salt }
 
 func (idx *Index) Close() {
 	if idx == nil {
@@ -252,6 +259,7 @@ func (idx *Index) Close() {
 		if err := idx.f.Close(); err != nil {
 			log.Log(dbg.FileCloseLogLevel, "close", "err", err, "file", idx.FileName(), "stack", dbg.Stack())
 		}
+		dir.UntrackOpenFile(idx.filePath)
 		idx.f = nil
 	}
 }
@@ -73,6 +73,13 @@ type Compressor struct {
 	trace            bool
 	logger           log.Logger
 	noFsync          bool // fsync is enabled by default, but tests can manually disable
+	dict             *Dictionary
+	flags            *uint64
+	txNumRange       *[2]uint64
+
+	// onTmpSize - see SetOnTmpSize. tmpSizeReported - sum of deltas passed to it
+	onTmpSize       func(delta int64)
+	tmpSizeReported int64
 }
 
 func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, minPatternScore uint64, workers int, lvl log.Lvl, logger log.Logger) (*Compressor, error) {
@@ -120,15 +127,69 @@ func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, mi
 
 func (c *Compressor) Close() {
 	c.uncompressedFile.CloseAndRemove()
+	if c.onTmpSize != nil && c.tmpSizeReported != 0 {
+		c.onTmpSize(-c.tmpSizeReported)
+		c.tmpSizeReported = 0
+	}
 	for _, collector := range c.suffixCollectors {
 		collector.Close()
 	}
 	c.suffixCollectors = nil
 }
 
+// SetOnTmpSize - `f` gets changes of size of temporary words file of compressor: for accounting of disk used by files
+// which are not built yet. Growth is reported by batches of tmpSizeReportStep and before Compress, removal - by Close
+func (c *Compressor) SetOnTmpSize(f func(delta int64)) { c.onTmpSize = f }
+
+const tmpSizeReportStep = 16 * 1024 * 1024
+
+func (c *Compressor) reportTmpSize(force bool) {
+	if c.onTmpSize == nil {
+		return
+	}
+	delta := c.uncompressedFile.size - c.tmpSizeReported
+	if delta == 0 || (!force && delta < tmpSizeReportStep) {
+		return
+	}
+	c.onTmpSize(delta)
+	c.tmpSizeReported += delta
+}
+
 func (c *Compressor) SetTrace(trace bool) { c.trace = trace }
 func (c *Compressor) Workers() int        { return c.workers }
 
+// SetDictionary - compress by patterns of external dictionary. Produced file can be opened only with same dictionary.
+// nil - patterns are sampled from added words (default)
+func (c *Compressor) SetDictionary(dict *Dictionary) { c.dict = dict }
+
+// flagsMagic - first 8 bytes of optional header section with flags of file, see SetFlags
+const flagsMagic = uint64(0xFF_45_52_47_46_4C_41_47)
+
+// SetFlags - application-defined flags of file, stored in header and available by Decompressor.Flags.
+// Files without flags have same format as before flags existed
+func (c *Compressor) SetFlags(flags uint64) { c.flags = &flags }
+
+// txNumFromMagic, txNumToMagic - first 8 bytes of optional header sections with range of txNums, see SetTxNumRange
+const (
+	txNumFromMagic = uint64(0xFF_45_52_47_54_58_46_52)
+	txNumToMagic   = uint64(0xFF_45_52_47_54_58_54_4F)
+)
+
+// SetTxNumRange - [from, to) range of txNums which file actually has, stored in header and available by
+// Decompressor.TxNumRange. For files whose content doesn't match range in their name
+func (c *Compressor) SetTxNumRange(from, to uint64) { c.txNumRange = &[2]uint64{from, to} }
+
+// headerSections - optional [magic][value] pairs written before words count
+func (c *Compressor) headerSections() (sections []uint64) {
+	if c.flags != nil {
+		sections = append(sections, flagsMagic, *c.flags)
+	}
+	if c.txNumRange != nil {
+		sections = append(sections, txNumFromMagic, c.txNumRange[0], txNumToMagic, c.txNumRange[1])
+	}
+	return sections
+}
+
 func (c *Compressor) Count() int { return int(c.wordsCount) }
 
 func (c *Compressor) AddWord(word []byte) error {
@@ -139,6 +200,10 @@ func (c *Compressor) AddWord(word []byte) error {
 	}
 
 	c.wordsCount++
+	defer c.reportTmpSize(false)
+	if c.dict != nil { // patterns are not sampled
+		return c.uncompressedFile.Append(word)
+	}
 	l := 2*len(word) + 2
 	if c.superstringLen+l > superstringLimit {
 		if c.superstringCount%samplingFactor == 0 {
@@ -168,6 +233,7 @@ func (c *Compressor) AddUncompressedWord(word []byte) error {
 	}
 
 	c.wordsCount++
+	defer c.reportTmpSize(false)
 	return c.uncompressedFile.AppendUncompressed(word)
 }
 
@@ -175,6 +241,7 @@ func (c *Compressor) Compress() error {
 	if err := c.uncompressedFile.Flush(); err != nil {
 		return err
 	}
+	c.reportTmpSize(true)
 
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
@@ -188,10 +255,14 @@ func (c *Compressor) Compress() error {
 		c.logger.Log(c.lvl, fmt.Sprintf("[%s] BuildDict start", c.logPrefix), "workers", c.workers)
 	}
 	t := time.Now()
-	db, err := DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.lvl, c.logger)
-	if err != nil {
-
-		return err
+	var db *DictionaryBuilder
+	if c.dict != nil {
+		db = c.dict.builder()
+	} else {
+		var err error
+		if db, err = DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.lvl, c.logger); err != nil {
+			return err
+		}
 	}
 	if c.trace {
 		_, fileName := filepath.Split(c.outputFile)
@@ -210,7 +281,7 @@ func (c *Compressor) Compress() error {
 	}
 	defer cf.Close()
 	t = time.Now()
-	if err := compressWithPatternCandidates(c.ctx, c.trace, c.logPrefix, c.tmpOutFilePath, cf, c.uncompressedFile, c.workers, db, c.lvl, c.logger); err != nil {
+	if err := compressWithPatternCandidates(c.ctx, c.trace, c.logPrefix, c.tmpOutFilePath, cf, c.uncompressedFile, c.workers, db, c.dict, c.headerSections(), c.lvl, c.logger); err != nil {
 		return err
 	}
 	if err = c.fsync(cf); err != nil {
@@ -794,6 +865,7 @@ type RawWordsFile struct {
 	filePath string
 	buf      []byte
 	count    uint64
+	size     int64 // bytes appended
 }
 
 func NewRawWordsFile(filePath string) (*RawWordsFile, error) {
@@ -827,6 +899,7 @@ func (f *RawWordsFile) Append(v []byte) error {
 	f.count++
 	// For compressed words, the length prefix is shifted to make lowest bit zero
 	n := binary.PutUvarint(f.buf, 2*uint64(len(v)))
+	f.size += int64(n + len(v))
 	if _, e := f.w.Write(f.buf[:n]); e != nil {
 		return e
 	}
@@ -841,6 +914,7 @@ func (f *RawWordsFile) AppendUncompressed(v []byte) error {
 	f.count++
 	// For uncompressed words, the length prefix is shifted to make lowest bit one
 	n := binary.PutUvarint(f.buf, 2*uint64(len(v))+1)
+	f.size += int64(n + len(v))
 	if _, e := f.w.Write(f.buf[:n]); e != nil {
 		return e
 	}
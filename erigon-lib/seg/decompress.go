@@ -35,6 +35,7 @@ import (
 	"github.com/c2h5oh/datasize"
 
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/mmap"
 )
 
@@ -132,6 +133,12 @@ type Decompressor struct {
 	modTime         time.Time
 	wordsCount      uint64
 	emptyWordsCount uint64
+	dictID          uint64 // 0 - file doesn't depend on external Dictionary
+	flags           uint64 // see Compressor.SetFlags
+	hasFlags        bool
+	txNumFrom       uint64 // see Compressor.SetTxNumRange
+	txNumTo         uint64
+	hasTxNumRange   bool
 
 	filePath, FileName1 string
 
@@ -146,6 +153,9 @@ const (
 	compressedMinSize = 32
 )
 
+// MinFileSize - smaller files can't be opened by NewDecompressor: they are broken (for example 0-byte file left by crashed dump)
+const MinFileSize = compressedMinSize
+
 // Tables with bitlen greater than threshold will be condensed.
 // Condensing reduces size of decompression table but leads to slower reads.
 // To disable condesning at all set to 9 (we dont use tables larger than 2^9)
@@ -176,6 +186,12 @@ func SetDecompressionTableCondensity(fromBitSize int) {
 }
 
 func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
+	return NewDecompressorWithDictionary(compressedFilePath, nil)
+}
+
+// NewDecompressorWithDictionary - dict is required if file was compressed with Dictionary (see Compressor.SetDictionary).
+// Files compressed without Dictionary ignore dict.
+func NewDecompressorWithDictionary(compressedFilePath string, dict *Dictionary) (*Decompressor, error) {
 	_, fName := filepath.Split(compressedFilePath)
 	var err error
 	var closeDecompressor = true
@@ -198,6 +214,7 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 	if err != nil {
 		return nil, err
 	}
+	dir.TrackOpenFile(compressedFilePath)
 
 	var stat os.FileInfo
 	if stat, err = d.f.Stat(); err != nil {
@@ -219,11 +236,45 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 	d.data = d.mmapHandle1[:d.size]
 	defer d.EnableReadAhead().DisableReadAhead() //speedup opening on slow drives
 
-	d.wordsCount = binary.BigEndian.Uint64(d.data[:8])
-	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[8:16])
+	var headerStart uint64
+	var patternsDict *Dictionary
+	for { // optional header sections: [magic][value]
+		magic := binary.BigEndian.Uint64(d.data[headerStart : headerStart+8])
+		if magic != dictMagic && magic != flagsMagic && magic != txNumFromMagic && magic != txNumToMagic {
+			break
+		}
+		if d.size < int64(headerStart+16)+compressedMinSize {
+			return nil, &ErrCompressedFileCorrupted{FileName: fName, Reason: fmt.Sprintf("invalid file size %s", datasize.ByteSize(d.size).HR())}
+		}
+		value := binary.BigEndian.Uint64(d.data[headerStart+8 : headerStart+16])
+		headerStart += 16
+		switch magic {
+		case flagsMagic:
+			d.flags, d.hasFlags = value, true
+			continue
+		case txNumFromMagic:
+			d.txNumFrom, d.hasTxNumRange = value, true
+			continue
+		case txNumToMagic:
+			d.txNumTo, d.hasTxNumRange = value, true
+			continue
+		}
+		d.dictID = value
+		if dict == nil || dict.ID() != d.dictID {
+			var provided uint64
+			if dict != nil {
+				provided = dict.ID()
+			}
+			return nil, &ErrDictionaryMismatch{FileName: fName, Expected: d.dictID, Provided: provided}
+		}
+		patternsDict = dict
+	}
+
+	d.wordsCount = binary.BigEndian.Uint64(d.data[headerStart : headerStart+8])
+	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[headerStart+8 : headerStart+16])
 
-	pos := uint64(24)
-	dictSize := binary.BigEndian.Uint64(d.data[16:pos])
+	pos := headerStart + 24
+	dictSize := binary.BigEndian.Uint64(d.data[headerStart+16 : pos])
 
 	if pos+dictSize > uint64(d.size) {
 		return nil, &ErrCompressedFileCorrupted{
@@ -252,6 +303,15 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 			patternMaxDepth = depth
 		}
 		dictPos += uint64(ns)
+		if patternsDict != nil { // file has only reference to pattern
+			i, n := binary.Uvarint(data[dictPos:])
+			dictPos += uint64(n)
+			if i >= uint64(len(patternsDict.patterns)) {
+				return nil, &ErrCompressedFileCorrupted{FileName: fName, Reason: fmt.Sprintf("pattern %d is out of dictionary of %d patterns", i, len(patternsDict.patterns))}
+			}
+			patterns = append(patterns, patternsDict.patterns[i])
+			continue
+		}
 		l, n := binary.Uvarint(data[dictPos:])
 		dictPos += uint64(n)
 		patterns = append(patterns, data[dictPos:dictPos+l])
@@ -273,7 +333,7 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 		}
 	}
 
-	if assert.Enable && pos != 24 {
+	if assert.Enable && pos != headerStart+24 {
 		panic("pos != 24")
 	}
 	pos += dictSize // offset patterns
@@ -456,6 +516,7 @@ func (d *Decompressor) Close() {
 		if err := d.f.Close(); err != nil {
 			log.Log(dbg.FileCloseLogLevel, "close", "err", err, "file", d.FileName(), "stack", dbg.Stack())
 		}
+		dir.UntrackOpenFile(d.filePath)
 		d.f = nil
 		d.data = nil
 		d.posDict = nil
@@ -640,6 +701,17 @@ func (g *Getter) Size() int {
 func (d *Decompressor) Count() int           { return int(d.wordsCount) }
 func (d *Decompressor) EmptyWordsCount() int { return int(d.emptyWordsCount) }
 
+// DictionaryID - id of external Dictionary file was compressed with. 0 - file doesn't depend on external Dictionary
+func (d *Decompressor) DictionaryID() uint64 { return d.dictID }
+
+// Flags - stored by Compressor.SetFlags. ok=false - file has no flags (produced without SetFlags)
+func (d *Decompressor) Flags() (flags uint64, ok bool) { return d.flags, d.hasFlags }
+
+// TxNumRange - stored by Compressor.SetTxNumRange. ok=false - file has no range (content matches range in its name)
+func (d *Decompressor) TxNumRange() (from, to uint64, ok bool) {
+	return d.txNumFrom, d.txNumTo, d.hasTxNumRange
+}
+
 // MakeGetter creates an object that can be used to access superstrings in the decompressor's file
 // Getter is not thread-safe, but there can be multiple getters used simultaneously and concurrently
 // for the same decompressor
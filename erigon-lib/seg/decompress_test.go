@@ -920,3 +920,162 @@ func TestDecompressRandomFastNext(t *testing.T) {
 // 		input_idx++
 // 	}
 // }
+
+func TestDecompressWithDictionary(t *testing.T) {
+	logger := log.New()
+	tmpDir := t.TempDir()
+
+	// words are built from blobs, each blob is used too rarely in one file to be sampled as pattern
+	rnd := rand.New(rand.NewSource(0))
+	blobs := make([][]byte, 64)
+	for i := range blobs {
+		blobs[i] = make([]byte, 32)
+		rnd.Read(blobs[i])
+	}
+	words := make([][]byte, 100)
+	for i := range words {
+		words[i] = append(append([]byte{}, blobs[i%len(blobs)]...), byte(i))
+	}
+	dict, err := NewDictionary(EncodeDictionary(blobs))
+	require.NoError(t, err)
+	require.Equal(t, len(blobs), dict.Len())
+
+	compress := func(name string, dict *Dictionary) string {
+		file := filepath.Join(tmpDir, name)
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, MinPatternScore, 1, log.LvlDebug, logger)
+		require.NoError(t, err)
+		defer c.Close()
+		c.DisableFsync()
+		c.SetDictionary(dict)
+		for _, w := range words {
+			require.NoError(t, c.AddWord(w))
+		}
+		require.NoError(t, c.Compress())
+		return file
+	}
+	readAll := func(d *Decompressor) (res [][]byte) {
+		g := d.MakeGetter()
+		for g.HasNext() {
+			w, _ := g.Next(nil)
+			res = append(res, w)
+		}
+		return res
+	}
+	plainFile, dictFile := compress("plain", nil), compress("dict", dict)
+
+	plain, err := NewDecompressorWithDictionary(plainFile, dict) // files without dictionary ignore it
+	require.NoError(t, err)
+	defer plain.Close()
+	withDict, err := NewDecompressorWithDictionary(dictFile, dict)
+	require.NoError(t, err)
+	defer withDict.Close()
+	require.Zero(t, plain.DictionaryID())
+	require.Equal(t, dict.ID(), withDict.DictionaryID())
+	require.Equal(t, words, readAll(plain))
+	require.Equal(t, words, readAll(withDict))
+	require.Less(t, withDict.Size(), plain.Size())
+
+	_, err = NewDecompressor(dictFile)
+	require.ErrorIs(t, err, &ErrDictionaryMismatch{})
+	require.Contains(t, err.Error(), "not provided")
+
+	other, err := NewDictionary(EncodeDictionary(blobs[1:]))
+	require.NoError(t, err)
+	_, err = NewDecompressorWithDictionary(dictFile, other)
+	var mismatch *ErrDictionaryMismatch
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, dict.ID(), mismatch.Expected)
+	require.Equal(t, other.ID(), mismatch.Provided)
+
+	_, err = NewDictionary(EncodeDictionary([][]byte{blobs[0], blobs[0]}))
+	require.Error(t, err)
+}
+
+func TestDecompressFlags(t *testing.T) {
+	logger := log.New()
+	tmpDir := t.TempDir()
+	dict, err := NewDictionary(EncodeDictionary([][]byte{[]byte("word-pattern")}))
+	require.NoError(t, err)
+
+	compress := func(name string, flags *uint64, dict *Dictionary) *Decompressor {
+		file := filepath.Join(tmpDir, name)
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, MinPatternScore, 1, log.LvlDebug, logger)
+		require.NoError(t, err)
+		defer c.Close()
+		c.DisableFsync()
+		if flags != nil {
+			c.SetFlags(*flags)
+		}
+		c.SetDictionary(dict)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("word-pattern-%d", i))))
+		}
+		require.NoError(t, c.Compress())
+		d, err := NewDecompressorWithDictionary(file, dict)
+		require.NoError(t, err)
+		t.Cleanup(d.Close)
+		g := d.MakeGetter()
+		for i := 0; g.HasNext(); i++ {
+			w, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("word-pattern-%d", i), string(w))
+		}
+		require.Equal(t, 100, d.Count())
+		return d
+	}
+	zero, seven := uint64(0), uint64(7)
+
+	_, ok := compress("no-flags", nil, nil).Flags()
+	require.False(t, ok)
+	flags, ok := compress("zero", &zero, nil).Flags()
+	require.True(t, ok)
+	require.Zero(t, flags)
+	d := compress("seven-dict", &seven, dict)
+	flags, ok = d.Flags()
+	require.True(t, ok)
+	require.Equal(t, seven, flags)
+	require.Equal(t, dict.ID(), d.DictionaryID())
+}
+
+func TestDecompressTxNumRange(t *testing.T) {
+	logger := log.New()
+	tmpDir := t.TempDir()
+
+	compress := func(name string, setup func(c *Compressor)) *Decompressor {
+		file := filepath.Join(tmpDir, name)
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, MinPatternScore, 1, log.LvlDebug, logger)
+		require.NoError(t, err)
+		defer c.Close()
+		c.DisableFsync()
+		setup(c)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("word-%d", i))))
+		}
+		require.NoError(t, c.Compress())
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		t.Cleanup(d.Close)
+		g := d.MakeGetter()
+		for i := 0; g.HasNext(); i++ {
+			w, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("word-%d", i), string(w))
+		}
+		return d
+	}
+
+	_, _, ok := compress("no-range", func(c *Compressor) {}).TxNumRange()
+	require.False(t, ok)
+
+	from, to, ok := compress("range", func(c *Compressor) { c.SetTxNumRange(15, 31) }).TxNumRange()
+	require.True(t, ok)
+	require.Equal(t, uint64(15), from)
+	require.Equal(t, uint64(31), to)
+
+	d := compress("range-flags", func(c *Compressor) { c.SetFlags(3); c.SetTxNumRange(0, 16) })
+	from, to, ok = d.TxNumRange()
+	require.True(t, ok)
+	require.Equal(t, uint64(0), from)
+	require.Equal(t, uint64(16), to)
+	flags, ok := d.Flags()
+	require.True(t, ok)
+	require.Equal(t, uint64(3), flags)
+}
@@ -0,0 +1,96 @@
+package seg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// dictMagic - first 8 bytes of file compressed with external Dictionary. Files without Dictionary start from
+// words count - which can't have such value.
+const dictMagic = uint64(0xFF_45_52_47_44_49_43_54)
+
+// Dictionary - precomputed patterns, shared by many files (catches cross-file patterns which are not visible
+// to sampling of one file). File compressed with Dictionary stores only references to Dictionary's patterns
+// and Dictionary ID in header - such file can't be opened without same Dictionary.
+//
+// Serialized form: sequence of uvarint(len(pattern)) + pattern
+type Dictionary struct {
+	id       uint64
+	patterns [][]byte
+	idx      map[string]uint64 // pattern -> position in patterns
+}
+
+func NewDictionary(data []byte) (*Dictionary, error) {
+	data = common.Copy(data)
+	d := &Dictionary{idx: map[string]uint64{}}
+	for pos := 0; pos < len(data); {
+		l, n := binary.Uvarint(data[pos:])
+		if n <= 0 || uint64(len(data)-pos-n) < l {
+			return nil, fmt.Errorf("compression dictionary: corrupted pattern at offset %d", pos)
+		}
+		if l < minPatternLen || l > maxPatternLen {
+			return nil, fmt.Errorf("compression dictionary: pattern length %d at offset %d, expected [%d, %d]", l, pos, minPatternLen, maxPatternLen)
+		}
+		pos += n
+		pattern := data[pos : pos+int(l)]
+		pos += int(l)
+		if _, ok := d.idx[string(pattern)]; ok {
+			return nil, fmt.Errorf("compression dictionary: duplicated pattern %x", pattern)
+		}
+		d.idx[string(pattern)] = uint64(len(d.patterns))
+		d.patterns = append(d.patterns, pattern)
+	}
+	if len(d.patterns) == 0 {
+		return nil, fmt.Errorf("compression dictionary: empty")
+	}
+	h := sha256.Sum256(data)
+	d.id = binary.BigEndian.Uint64(h[:8])
+	return d, nil
+}
+
+// EncodeDictionary - serialized form of patterns, see NewDictionary
+func EncodeDictionary(patterns [][]byte) []byte {
+	var numBuf [binary.MaxVarintLen64]byte
+	var res []byte
+	for _, p := range patterns {
+		n := binary.PutUvarint(numBuf[:], uint64(len(p)))
+		res = append(res, numBuf[:n]...)
+		res = append(res, p...)
+	}
+	return res
+}
+
+func (d *Dictionary) ID() uint64 { return d.id }
+func (d *Dictionary) Len() int   { return len(d.patterns) }
+
+// builder - patterns of Dictionary as the only candidates for compression (instead of sampled ones)
+func (d *Dictionary) builder() *DictionaryBuilder {
+	db := &DictionaryBuilder{limit: len(d.patterns)}
+	for _, p := range d.patterns {
+		db.items = append(db.items, &Pattern{word: p, score: uint64(len(p))})
+	}
+	return db
+}
+
+// ErrDictionaryMismatch - file was compressed with external Dictionary, but it's not provided or another Dictionary provided
+type ErrDictionaryMismatch struct {
+	FileName string
+	Expected uint64
+	Provided uint64 // 0 - not provided
+}
+
+func (e ErrDictionaryMismatch) Error() string {
+	if e.Provided == 0 {
+		return fmt.Sprintf("compressed file %q requires compression dictionary %016x, but it's not provided", e.FileName, e.Expected)
+	}
+	return fmt.Sprintf("compressed file %q requires compression dictionary %016x, but %016x provided", e.FileName, e.Expected, e.Provided)
+}
+
+func (e ErrDictionaryMismatch) Is(err error) bool {
+	var e1 *ErrDictionaryMismatch
+	return errors.As(err, &e1)
+}
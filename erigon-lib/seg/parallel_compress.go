@@ -238,7 +238,7 @@ func (cq *CompressionQueue) Pop() interface{} {
 	return x
 }
 
-func compressWithPatternCandidates(ctx context.Context, trace bool, logPrefix, segmentFilePath string, cf *os.File, uncompressedFile *RawWordsFile, workers int, dictBuilder *DictionaryBuilder, lvl log.Lvl, logger log.Logger) error {
+func compressWithPatternCandidates(ctx context.Context, trace bool, logPrefix, segmentFilePath string, cf *os.File, uncompressedFile *RawWordsFile, workers int, dictBuilder *DictionaryBuilder, dict *Dictionary, header []uint64, lvl log.Lvl, logger log.Logger) error {
 	logEvery := time.NewTicker(60 * time.Second)
 	defer logEvery.Stop()
 
@@ -519,7 +519,12 @@ func compressWithPatternCandidates(ctx context.Context, trace bool, logPrefix, s
 	// Calculate total size of the dictionary
 	var patternsSize uint64
 	for _, p := range patternList {
-		ns := binary.PutUvarint(numBuf[:], uint64(p.depth))    // Length of the word's depth
+		ns := binary.PutUvarint(numBuf[:], uint64(p.depth)) // Length of the word's depth
+		if dict != nil {
+			n := binary.PutUvarint(numBuf[:], dict.idx[string(p.word)]) // Length of the pattern's position in dictionary
+			patternsSize += uint64(ns + n)
+			continue
+		}
 		n := binary.PutUvarint(numBuf[:], uint64(len(p.word))) // Length of the word's length
 		patternsSize += uint64(ns + n + len(p.word))
 	}
@@ -535,6 +540,22 @@ func compressWithPatternCandidates(ctx context.Context, trace bool, logPrefix, s
 		logger.Log(lvl, fmt.Sprintf("[%s] Effective dictionary", logPrefix), logCtx...)
 	}
 	cw := bufio.NewWriterSize(cf, 2*etl.BufIOSize)
+	for _, v := range header { // optional sections: [magic][value]
+		binary.BigEndian.PutUint64(numBuf[:], v)
+		if _, err = cw.Write(numBuf[:8]); err != nil {
+			return err
+		}
+	}
+	if dict != nil { // file can be decompressed only with same dictionary
+		binary.BigEndian.PutUint64(numBuf[:], dictMagic)
+		if _, err = cw.Write(numBuf[:8]); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(numBuf[:], dict.ID())
+		if _, err = cw.Write(numBuf[:8]); err != nil {
+			return err
+		}
+	}
 	// 1-st, output amount of words - just a useful metadata
 	binary.BigEndian.PutUint64(numBuf[:], inCount) // Dictionary size
 	if _, err = cw.Write(numBuf[:8]); err != nil {
@@ -557,6 +578,13 @@ func compressWithPatternCandidates(ctx context.Context, trace bool, logPrefix, s
 		if _, err = cw.Write(numBuf[:ns]); err != nil {
 			return err
 		}
+		if dict != nil { // only reference to pattern
+			n := binary.PutUvarint(numBuf[:], dict.idx[string(p.word)])
+			if _, err = cw.Write(numBuf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
 		n := binary.PutUvarint(numBuf[:], uint64(len(p.word)))
 		if _, err = cw.Write(numBuf[:n]); err != nil {
 			return err
@@ -0,0 +1,150 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/erigon-lib/commitment"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// CodeHashMismatch - account references code hash, but code of account as of TxNum is missing or has another hash
+type CodeHashMismatch struct {
+	Address  []byte
+	File     string // accounts file where account was found
+	TxNum    uint64 // code and account are read as of
+	CodeHash []byte // expected: from account
+	Code     []byte // actual: nil if missing
+}
+
+func (m *CodeHashMismatch) Error() string {
+	if len(m.Code) == 0 {
+		return fmt.Sprintf("account %x of %s references code %x, but code is missing at txNum=%d", m.Address, m.File, m.CodeHash, m.TxNum)
+	}
+	return fmt.Sprintf("account %x of %s references code %x, but code at txNum=%d has hash %x", m.Address, m.File, m.CodeHash, m.TxNum, keccak(m.Code))
+}
+
+func keccak(b []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// accountsCodeCheckBatch - amount of accounts resolved by 1 GetAsOfMany call
+var accountsCodeCheckBatch = 4096
+
+// DebugAccountsCodeCrossCheck - for every account of visible accounts files (starting from `fromStep`) with non-empty
+// code hash: keccak of code as of end of file must be equal to that hash. historySteps=true - also check state of
+// accounts of file as of end of each step inside file (merged files only). Reads only files.
+// failFast=false - logs all mismatches and returns first of them.
+func (ac *AggregatorRoTx) DebugAccountsCodeCrossCheck(ctx context.Context, failFast bool, fromStep uint64, historySteps bool) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	accounts, code := ac.d[kv.AccountsDomain], ac.d[kv.CodeDomain]
+	stepSize := ac.a.StepSize()
+	fromTxNum := fromStep * stepSize
+
+	var checked int
+	var firstMismatch error
+	checkBatch := func(fileName string, addrs [][]byte, txNum uint64, accVals [][]byte) error {
+		if accVals == nil { // not latest values of file
+			var err error
+			if accVals, _, err = accounts.GetAsOfMany(addrs, txNum, nil); err != nil {
+				return err
+			}
+		}
+		codes, _, err := code.GetAsOfMany(addrs, txNum, nil)
+		if err != nil {
+			return err
+		}
+		for i, addr := range addrs {
+			if len(accVals[i]) == 0 {
+				continue
+			}
+			_, _, codeHash := types.DecodeAccountBytesV3(accVals[i])
+			if len(codeHash) == 0 || bytes.Equal(codeHash, commitment.EmptyCodeHash) {
+				continue
+			}
+			checked++
+			if len(codes[i]) > 0 && bytes.Equal(keccak(codes[i]), codeHash) {
+				continue
+			}
+			mismatch := &CodeHashMismatch{Address: common.Copy(addr), File: fileName, TxNum: txNum, CodeHash: common.Copy(codeHash), Code: common.Copy(codes[i])}
+			if failFast {
+				return mismatch
+			}
+			log.Warn("[integrity] AccountsCode", "err", mismatch)
+			if firstMismatch == nil {
+				firstMismatch = mismatch
+			}
+		}
+		return nil
+	}
+
+	for _, item := range accounts.files {
+		if item.src.decompressor == nil || item.endTxNum <= fromTxNum {
+			continue
+		}
+		fileName := item.src.decompressor.FileName()
+		var txNums []uint64
+		if historySteps {
+			for txNum := item.startTxNum + stepSize; txNum < item.endTxNum; txNum += stepSize {
+				txNums = append(txNums, txNum)
+			}
+		}
+		txNums = append(txNums, item.endTxNum)
+
+		err := func() error {
+			defer item.src.decompressor.EnableReadAhead().DisableReadAhead()
+			g := NewArchiveGetter(item.src.decompressor.MakeGetter(), accounts.d.compression)
+			g.Reset(0)
+			addrs, vals := make([][]byte, 0, accountsCodeCheckBatch), make([][]byte, 0, accountsCodeCheckBatch)
+			flush := func() error {
+				for _, txNum := range txNums {
+					latestVals := vals
+					if txNum != item.endTxNum {
+						latestVals = nil
+					}
+					if err := checkBatch(fileName, addrs, txNum, latestVals); err != nil {
+						return err
+					}
+				}
+				addrs, vals = addrs[:0], vals[:0]
+				return nil
+			}
+			for g.HasNext() {
+				k, _ := g.Next(nil)
+				v, _ := g.Next(nil)
+				addrs, vals = append(addrs, k), append(vals, v)
+				if len(addrs) < accountsCodeCheckBatch {
+					continue
+				}
+				if err := flush(); err != nil {
+					return err
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-logEvery.C:
+					log.Info("[integrity] AccountsCode", "file", fileName, "prefix", fmt.Sprintf("%x", common.Shorten(k, 8)), "checked", checked)
+				default:
+				}
+			}
+			return flush()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	log.Info("[integrity] AccountsCode: done", "checked", checked)
+	return firstMismatch
+}
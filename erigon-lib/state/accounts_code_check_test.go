@@ -0,0 +1,101 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAggregatorV3_AccountsCodeCrossCheck(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		a[0] = byte(i + 1)
+		return a
+	}
+	code := func(i int) []byte { return []byte{0x60, byte(i)} }
+	const broken = 3
+
+	// step 0: even accounts are contracts. Code of contract `broken` is lost: account references it, but it's not in CodeDomain
+	for i := 0; i < 10; i++ {
+		domains.SetTxNum(uint64(i))
+		var codeHash []byte
+		if i%2 == 0 || i == broken {
+			codeHash = keccak(code(i))
+		}
+		if i%2 == 0 {
+			require.NoError(t, domains.DomainPut(kv.CodeDomain, addr(i), nil, code(i), nil, 0))
+		}
+		acc := types.EncodeAccountBytesV3(uint64(i), uint256.NewInt(1), codeHash, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(i), nil, acc, nil, 0))
+	}
+	// steps 1, 2: unrelated accounts
+	for txNum := uint64(16); txNum < 48; txNum += 4 {
+		domains.SetTxNum(txNum)
+		acc := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(int(txNum)), nil, acc, nil, 0))
+	}
+	// step 3: code is restored
+	domains.SetTxNum(50)
+	require.NoError(t, domains.DomainPut(kv.CodeDomain, addr(broken), nil, code(broken), nil, 0))
+	domains.SetTxNum(63)
+	require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(100), nil, types.EncodeAccountBytesV3(1, uint256.NewInt(1), nil, 0), nil, 0))
+
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	for step := uint64(0); step < 4; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	err = ac.DebugAccountsCodeCrossCheck(ctx, true, 0, false)
+	var mismatch *CodeHashMismatch
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, addr(broken), mismatch.Address)
+	require.Equal(t, keccak(code(broken)), mismatch.CodeHash)
+	require.Empty(t, mismatch.Code)
+	require.Equal(t, uint64(16), mismatch.TxNum)
+	require.Contains(t, mismatch.File, "accounts.0-1.kv")
+
+	require.ErrorAs(t, ac.DebugAccountsCodeCrossCheck(ctx, false, 0, true), &mismatch)
+	require.NoError(t, ac.DebugAccountsCodeCrossCheck(ctx, true, 1, false), "files of step 1+ are consistent")
+	ac.Close()
+
+	// after merge: latest state of file is consistent, history steps inside file are not
+	require.NoError(t, agg.MergeLoop(ctx))
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	require.NoError(t, ac.DebugAccountsCodeCrossCheck(ctx, true, 0, false))
+
+	err = ac.DebugAccountsCodeCrossCheck(ctx, true, 0, true)
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, addr(broken), mismatch.Address)
+	require.Equal(t, uint64(16), mismatch.TxNum)
+	require.Contains(t, mismatch.File, "accounts.0-4.kv")
+}
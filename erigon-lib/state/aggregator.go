@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -43,6 +44,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/common/snapbuild"
 	"github.com/ledgerwatch/erigon-lib/diagnostics"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
@@ -56,33 +58,59 @@ type Aggregator struct {
 	db               kv.RoDB
 	d                [kv.DomainLen]*Domain
 	iis              [kv.StandaloneIdxLen]*InvertedIndex
-	ap               [kv.AppendableLen]*Appendable //nolint
+	ap               [kv.AppendableMax]*Appendable // nil: position is not registered. See RegisterAppendable
 	backgroundResult *BackgroundResult
 	dirs             datadir.Dirs
 	tmpdir           string
 	aggregationStep  uint64
 
+	// see lock_order.go: never hold both locks at the same time
 	dirtyFilesLock           sync.Mutex
 	visibleFilesLock         sync.RWMutex
+	lockOrder                *lockOrderChecker
 	visibleFilesMinimaxTxNum atomic.Uint64
-	snapshotBuildSema        *semaphore.Weighted
+	filesGeneration          atomic.Uint64 // incremented when visible files change. See FilesGeneration
+	filesChangeLock          sync.Mutex
+	filesChanged             chan struct{} // closed (and replaced by new one) when visibleFilesMinimaxTxNum is updated. See OnFilesChange
+	snapshotBuildCoord       *snapbuild.Coordinator
+
+	fsyncPolicy dir.FsyncPolicy
+	fsyncDir    func(dir string) error  // dir.FsyncDir, tests can replace
+	fsyncFile   func(path string) error // dir.FsyncFile, tests can replace
 
 	collateAndBuildWorkers int // minimize amount of background workers by default
 	mergeWorkers           int // usually 1
+	mergeMode              MergeMode
+	iiMergeSpanFactor      int // see SetIIMergeSpanFactor. 0 - standalone indices merge together with domains
+	pruneWorkers           int // read-only phase of PruneSmallBatchesDb, see PruneParallel. usually 1
+
+	salt         *uint32
+	iters        CanonicalsReader
+	folderOpened bool // RegisterAppendable is allowed only before OpenFolder
+
+	blockLastTxNum BlockLastTxNumFunc // not nil: block-aligned steps, see SetBlockAlignedSteps
+	skipEmptySteps bool               // see SetSkipEmptySteps
 
-	commitmentValuesTransform bool // enables squeezing commitment values in CommitmentDomain
+	commitmentValuesTransform CommitmentValuesTransformMode // see CommitmentValuesTransformMode
+
+	mergeRatios    mergeRatios // compression ratios of previous merges, see PlanMerge
+	lastBuildStats atomic.Pointer[StepBuildStats]
 
 	// To keep DB small - need move data to small files ASAP.
 	// It means goroutine which creating small files - can't be locked by merge or indexing.
 	buildingFiles           atomic.Bool
 	mergingFiles            atomic.Bool
 	buildingOptionalIndices atomic.Bool
+	pruning                 atomic.Bool // only 1 prune driver at a time, see Prune
+	closing                 atomic.Bool // set by Close: prune loops exit between batches
+	closeTimeout            time.Duration
 
-	//warmupWorking          atomic.Bool
+	warmup    warmupAfterMerge // see SetWarmupAfterMerge
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
 	needSaveFilesListInDB atomic.Bool
+	filesListSave         filesListSave
 
 	wg sync.WaitGroup // goroutines spawned by Aggregator, to ensure all of them are finish at agg.Close
 
@@ -90,20 +118,58 @@ type Aggregator struct {
 
 	ps *background.ProgressSet
 
+	mergeDiskInFlight   atomic.Int64      // see addMergeDiskInFlight
+	onMergeDiskInFlight func(bytes int64) // tests
+
 	// next fields are set only if agg.doTraceCtx is true. can enable by env: TRACE_AGG=true
 	leakDetector *dbg.LeakDetector
 	logger       log.Logger
 
 	ctxAutoIncrement atomic.Uint64
+	views            openViews // live AggregatorRoTx, see FilesRetention
+	// vanishedFiles - files deleted from disk, but still held by open views. Protected by `dirtyFilesLock`. see Refresh
+	vanishedFiles    []*filesItem
+	readSourceWarned atomic.Bool
 
 	produce bool
+
+	skipVersionCheck map[string]struct{} // see SkipFilesVersionCheck
+	integrityPolicy  FileIntegrityPolicy // see SetFileIntegrityPolicy
 }
 
 type OnFreezeFunc func(frozenFileNames []string)
 
-const AggregatorSqueezeCommitmentValues = true
+// CommitmentValuesTransformMode - when keys of accounts/storage in commitment branch values are replaced by shorter
+// references to records of accounts/storage files of same range (and back)
+type CommitmentValuesTransformMode uint8
+
+const (
+	// CommitmentValuesTransformOff - values always store plain keys
+	CommitmentValuesTransformOff CommitmentValuesTransformMode = iota
+	// CommitmentValuesTransformAtMerge - merge and SqueezeCommitmentFiles replace keys by references. Reads replace them back.
+	// Commitment merge depends on results of accounts/storage merge and holds their subset files until it's done
+	CommitmentValuesTransformAtMerge
+	// CommitmentValuesTransformAtRead - values store plain keys. Reads (and merges) replace back references in files
+	// produced with CommitmentValuesTransformAtMerge
+	CommitmentValuesTransformAtRead
+)
+
+const DefaultCommitmentValuesTransform = CommitmentValuesTransformAtMerge
+
+func (m CommitmentValuesTransformMode) String() string {
+	switch m {
+	case CommitmentValuesTransformOff:
+		return "off"
+	case CommitmentValuesTransformAtMerge:
+		return "at-merge"
+	case CommitmentValuesTransformAtRead:
+		return "at-read"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(m))
+	}
+}
 
-func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint64, db kv.RoDB, iters CanonicalsReader, logger log.Logger) (*Aggregator, error) {
+func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint64, db kv.RoDB, iters CanonicalsReader, commitmentValuesTransform CommitmentValuesTransformMode, logger log.Logger) (*Aggregator, error) {
 	tmpdir := dirs.Tmp
 	salt, err := getStateIndicesSalt(dirs.Snap)
 	if err != nil {
@@ -120,52 +186,39 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 		aggregationStep:        aggregationStep,
 		db:                     db,
 		leakDetector:           dbg.NewLeakDetector("agg", dbg.SlowTx()),
+		closeTimeout:           DefaultAggCloseTimeout,
+		filesListSave:          filesListSave{interval: DefaultFilesListSaveInterval},
+		lockOrder:              newLockOrderChecker(dbg.AggLockOrderCheck),
 		ps:                     background.NewProgressSet(),
 		backgroundResult:       &BackgroundResult{},
 		logger:                 logger,
 		collateAndBuildWorkers: 1,
 		mergeWorkers:           1,
+		pruneWorkers:           1,
+		salt:                   salt,
+		iters:                  iters,
 
-		commitmentValuesTransform: AggregatorSqueezeCommitmentValues,
+		commitmentValuesTransform: commitmentValuesTransform,
 
 		produce: true,
-	}
-	commitmentFileMustExist := func(fromStep, toStep uint64) bool {
-		fPath := filepath.Join(dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", kv.CommitmentDomain, fromStep, toStep))
-		exists, err := dir.FileExist(fPath)
-		if err != nil {
-			panic(err)
-		}
-		return exists
-	}
-
-	integrityCheck := func(name kv.Domain, fromStep, toStep uint64) bool {
-		// case1: `kill -9` during building new .kv
-		//  - `accounts` domain may be at step X and `commitment` domain at step X-1
-		//  - not a problem because `commitment` domain still has step X in DB
-		// case2: `kill -9` during building new .kv and `rm -rf chaindata`
-		//  - `accounts` domain may be at step X and `commitment` domain at step X-1
-		//  - problem! `commitment` domain doesn't have step X in DB
-		// solution: ignore step X files in both cases
-		switch name {
-		case kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain:
-			if toStep-fromStep > 1 { // only recently built files
-				return true
-			}
-			return commitmentFileMustExist(fromStep, toStep)
-		default:
-			return true
-		}
-	}
 
+		skipVersionCheck: map[string]struct{}{},
+		fsyncDir:         dir.FsyncDir,
+		fsyncFile:        dir.FsyncFile,
+		integrityPolicy:  CommitmentSkewPolicy{SnapDomain: dirs.SnapDomain},
+	}
+	a.SkipFilesVersionCheck(strings.Split(skipFilesVersionCheck, ",")...)
+	// files of accounts/storage are referenced by transformed commitment files until commitment is merged. Such files may
+	// exist in AtRead mode too: produced before mode change, reads and merges expand them
+	restrictSubsetFileDeletions := a.commitmentValuesTransform != CommitmentValuesTransformOff
 	cfg := domainCfg{
 		hist: histCfg{
 			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
 			withLocalityIndex: false, withExistenceIndex: false, compression: CompressNone, historyLargeValues: false,
 		},
-		restrictSubsetFileDeletions: a.commitmentValuesTransform,
+		restrictSubsetFileDeletions: restrictSubsetFileDeletions,
 	}
-	if a.d[kv.AccountsDomain], err = NewDomain(cfg, aggregationStep, kv.FileAccountDomain, kv.TblAccountKeys, kv.TblAccountVals, kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx, integrityCheck, logger); err != nil {
+	if a.d[kv.AccountsDomain], err = NewDomain(cfg, aggregationStep, kv.FileAccountDomain, kv.TblAccountKeys, kv.TblAccountVals, kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx, a.integrityCheck, logger); err != nil {
 		return nil, err
 	}
 	cfg = domainCfg{
@@ -173,9 +226,9 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
 			withLocalityIndex: false, withExistenceIndex: false, compression: CompressNone, historyLargeValues: false,
 		},
-		restrictSubsetFileDeletions: a.commitmentValuesTransform,
+		restrictSubsetFileDeletions: restrictSubsetFileDeletions,
 	}
-	if a.d[kv.StorageDomain], err = NewDomain(cfg, aggregationStep, kv.FileStorageDomain, kv.TblStorageKeys, kv.TblStorageVals, kv.TblStorageHistoryKeys, kv.TblStorageHistoryVals, kv.TblStorageIdx, integrityCheck, logger); err != nil {
+	if a.d[kv.StorageDomain], err = NewDomain(cfg, aggregationStep, kv.FileStorageDomain, kv.TblStorageKeys, kv.TblStorageVals, kv.TblStorageHistoryKeys, kv.TblStorageHistoryVals, kv.TblStorageIdx, a.integrityCheck, logger); err != nil {
 		return nil, err
 	}
 	cfg = domainCfg{
@@ -184,7 +237,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 			withLocalityIndex: false, withExistenceIndex: false, compression: CompressKeys | CompressVals, historyLargeValues: true,
 		},
 	}
-	if a.d[kv.CodeDomain], err = NewDomain(cfg, aggregationStep, kv.FileCodeDomain, kv.TblCodeKeys, kv.TblCodeVals, kv.TblCodeHistoryKeys, kv.TblCodeHistoryVals, kv.TblCodeIdx, integrityCheck, logger); err != nil {
+	if a.d[kv.CodeDomain], err = NewDomain(cfg, aggregationStep, kv.FileCodeDomain, kv.TblCodeKeys, kv.TblCodeVals, kv.TblCodeHistoryKeys, kv.TblCodeHistoryVals, kv.TblCodeIdx, a.integrityCheck, logger); err != nil {
 		return nil, err
 	}
 	cfg = domainCfg{
@@ -193,11 +246,12 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 			withLocalityIndex: false, withExistenceIndex: false, compression: CompressNone, historyLargeValues: false,
 			snapshotsDisabled: true,
 		},
-		replaceKeysInValues:         a.commitmentValuesTransform,
-		restrictSubsetFileDeletions: a.commitmentValuesTransform,
+		valuesTransform:             a.commitmentValuesTransform,
+		kvFileFlags:                 true,
+		restrictSubsetFileDeletions: restrictSubsetFileDeletions,
 		compress:                    CompressNone,
 	}
-	if a.d[kv.CommitmentDomain], err = NewDomain(cfg, aggregationStep, kv.FileCommitmentDomain, kv.TblCommitmentKeys, kv.TblCommitmentVals, kv.TblCommitmentHistoryKeys, kv.TblCommitmentHistoryVals, kv.TblCommitmentIdx, integrityCheck, logger); err != nil {
+	if a.d[kv.CommitmentDomain], err = NewDomain(cfg, aggregationStep, kv.FileCommitmentDomain, kv.TblCommitmentKeys, kv.TblCommitmentVals, kv.TblCommitmentHistoryKeys, kv.TblCommitmentHistoryVals, kv.TblCommitmentIdx, a.integrityCheck, logger); err != nil {
 		return nil, err
 	}
 	//aCfg := AppendableCfg{
@@ -219,7 +273,17 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 		return nil, err
 	}
 	a.KeepRecentTxnsOfHistoriesWithDisabledSnapshots(100_000) // ~1k blocks of history
+	for _, d := range a.d {
+		d.onMergeTmpSize = a.addMergeDiskInFlight
+	}
+	for _, ii := range a.iis {
+		ii.onMergeTmpSize = a.addMergeDiskInFlight
+	}
 	a.recalcVisibleFiles()
+	a.mergeRatios.path = mergeRatiosPath(dirs.Snap)
+	if err := a.mergeRatios.load(); err != nil { // used only by estimations
+		logger.Warn("[snapshots] load merge ratios", "err", err)
+	}
 
 	if dbg.NoSync() {
 		a.DisableFsync()
@@ -242,7 +306,9 @@ func getStateIndicesSalt(baseDir string) (salt *uint32, err error) {
 	}
 
 	if saltExists && !saltStateExists {
-		_ = os.Rename(filepath.Join(baseDir, "salt.txt"), filepath.Join(baseDir, "salt-state.txt"))
+		if err := os.Rename(filepath.Join(baseDir, "salt.txt"), filepath.Join(baseDir, "salt-state.txt")); err == nil {
+			_ = dir.FsyncDir(baseDir)
+		}
 	}
 	fpath := filepath.Join(baseDir, "salt-state.txt")
 	fexists, err := dir.FileExist(fpath)
@@ -259,6 +325,9 @@ func getStateIndicesSalt(baseDir string) (salt *uint32, err error) {
 		if err := dir.WriteFileWithFsync(fpath, saltBytes, os.ModePerm); err != nil {
 			return nil, err
 		}
+		if err := dir.FsyncDir(baseDir); err != nil {
+			return nil, err
+		}
 	}
 	saltBytes, err := os.ReadFile(fpath)
 	if err != nil {
@@ -270,6 +339,9 @@ func getStateIndicesSalt(baseDir string) (salt *uint32, err error) {
 }
 
 func (a *Aggregator) registerII(idx kv.InvertedIdxPos, salt *uint32, dirs datadir.Dirs, db kv.RoDB, aggregationStep uint64, filenameBase, indexKeysTable, indexTable string, logger log.Logger) error {
+	if owner, taken := a.filenameBaseOwner(filenameBase); taken {
+		return fmt.Errorf("registerII %s: name is taken by %s - files would collide", filenameBase, owner)
+	}
 	idxCfg := iiCfg{salt: salt, dirs: dirs, db: db}
 	var err error
 	a.iis[idx], err = NewInvertedIndex(idxCfg, aggregationStep, filenameBase, indexKeysTable, indexTable, nil, logger)
@@ -279,21 +351,163 @@ func (a *Aggregator) registerII(idx kv.InvertedIdxPos, salt *uint32, dirs datadi
 	return nil
 }
 
+var ErrAppendableNotRegistered = errors.New("appendable is not registered")
+
+// RegisterAppendable - adds custom appendable (per-txn data which is frozen into files by steps: receipts, blobs, L2 messages, ...)
+// at `pos` of reserved range [kv.AppendableLen, kv.AppendableMax), see kv.CustomAppendable. Must be called before OpenFolder.
+// `valsTable` (TxnId -> value) must exist in DB. Empty fields of `cfg` are taken from Aggregator.
+func (a *Aggregator) RegisterAppendable(pos kv.Appendable, cfg AppendableCfg, name string, valsTable string) error {
+	if a.folderOpened {
+		return fmt.Errorf("RegisterAppendable %s: must be called before OpenFolder", name)
+	}
+	if pos < kv.AppendableLen || pos >= kv.AppendableMax {
+		return fmt.Errorf("RegisterAppendable %s: position %d is out of reserved range [%d, %d)", name, pos, kv.AppendableLen, kv.AppendableMax)
+	}
+	if a.ap[pos] != nil {
+		return fmt.Errorf("RegisterAppendable %s: position %d is taken by %s", name, pos, a.ap[pos].filenameBase)
+	}
+	if owner, taken := a.filenameBaseOwner(name); taken {
+		return fmt.Errorf("RegisterAppendable %s: name is taken by %s - files would collide", name, owner)
+	}
+	for _, ap := range a.ap {
+		if ap != nil && ap.table == valsTable {
+			return fmt.Errorf("RegisterAppendable %s: table %s is taken by %s", name, valsTable, ap.filenameBase)
+		}
+	}
+	if cfg.Salt == nil {
+		cfg.Salt = a.salt
+	}
+	if cfg.Dirs.SnapHistory == "" {
+		cfg.Dirs = a.dirs
+	}
+	if cfg.DB == nil {
+		cfg.DB = a.db
+	}
+	if cfg.iters == nil {
+		cfg.iters = a.iters
+	}
+	ap, err := NewAppendable(cfg, a.aggregationStep, name, valsTable, nil, a.logger)
+	if err != nil {
+		return err
+	}
+	ap.noFsync = a.fsyncPolicy != dir.FsyncFull
+	ap.compressWorkers = a.d[kv.AccountsDomain].compressWorkers
+	ap.onMergeTmpSize = a.addMergeDiskInFlight
+	a.ap[pos] = ap
+	return nil
+}
+
+// filenameBaseOwner - component which produces files with name `filenameBase`. Domain and its history share the name
+func (a *Aggregator) filenameBaseOwner(filenameBase string) (owner string, taken bool) {
+	for _, d := range a.d {
+		if d != nil && d.filenameBase == filenameBase {
+			return "domain " + d.filenameBase, true
+		}
+	}
+	for _, ii := range a.iis {
+		if ii != nil && ii.filenameBase == filenameBase {
+			return "inverted index " + ii.filenameBase, true
+		}
+	}
+	for pos, ap := range a.ap {
+		if ap != nil && ap.filenameBase == filenameBase {
+			return "appendable " + kv.Appendable(pos).String(), true
+		}
+	}
+	return "", false
+}
+
 func (a *Aggregator) OnFreeze(f OnFreezeFunc) { a.onFreeze = f }
-func (a *Aggregator) DisableFsync() {
+func (a *Aggregator) DisableFsync()           { a.SetFsyncPolicy(dir.FsyncNone) }
+
+// SetFsyncPolicy - must be called before files production. See dir.FsyncPolicy. With FsyncFinalOnly writers of files
+// don't fsync: produced files are fsynced once, right before they become visible - see fsyncProduced
+func (a *Aggregator) SetFsyncPolicy(p dir.FsyncPolicy) {
+	a.fsyncPolicy = p
+	noFsync := p != dir.FsyncFull
 	for _, d := range a.d {
-		d.DisableFsync()
+		d.noFsync = noFsync
 	}
 	for _, ii := range a.iis {
-		ii.DisableFsync()
+		ii.noFsync = noFsync
+	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.noFsync = noFsync
 	}
 }
+func (a *Aggregator) FsyncPolicy() dir.FsyncPolicy { return a.fsyncPolicy }
+
+// fsyncDirs - makes produced (renamed into place) files durable
+func (a *Aggregator) fsyncDirs(dirs ...string) error {
+	if !a.fsyncPolicy.Final() {
+		return nil
+	}
+	for _, d := range dirs {
+		if err := a.fsyncDir(d); err != nil {
+			return fmt.Errorf("fsync dir %s: %w", d, err)
+		}
+	}
+	return nil
+}
+
+func (a *Aggregator) fsyncStateDirs() error {
+	return a.fsyncDirs(a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx, a.dirs.SnapAccessors)
+}
+
+// stateFilesBefore - files of state dirs before production, see fsyncProduced. nil if policy doesn't need it
+func (a *Aggregator) stateFilesBefore() (map[string]struct{}, error) {
+	if a.fsyncPolicy != dir.FsyncFinalOnly {
+		return nil, nil
+	}
+	res := map[string]struct{}{}
+	for _, d := range []string{a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx, a.dirs.SnapAccessors} {
+		fileNames, err := filesFromDir(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range fileNames {
+			res[filepath.Join(d, name)] = struct{}{}
+		}
+	}
+	return res, nil
+}
+
+// fsyncProduced - makes produced files durable: with FsyncFinalOnly - fsync of files which appeared in state dirs
+// after `before` (see stateFilesBefore), then fsync of dirs
+func (a *Aggregator) fsyncProduced(before map[string]struct{}) error {
+	if a.fsyncPolicy == dir.FsyncFinalOnly {
+		after, err := a.stateFilesBefore()
+		if err != nil {
+			return err
+		}
+		for path := range after {
+			if _, ok := before[path]; ok || strings.HasSuffix(path, ".tmp") { // .tmp - not produced yet by concurrent writer
+				continue
+			}
+			if err := a.fsyncFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("fsync %s: %w", path, err)
+			}
+		}
+	}
+	return a.fsyncStateDirs()
+}
 
 func (a *Aggregator) OpenFolder() error {
-	defer a.recalcVisibleFiles()
+	err := a.openFolder()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	return err
+}
 
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+func (a *Aggregator) openFolder() error {
+	if err := a.checkFilesVersions(); err != nil {
+		return fmt.Errorf("OpenFolder: %w", err)
+	}
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
 	eg := &errgroup.Group{}
 	for _, d := range a.d {
 		d := d
@@ -310,17 +524,33 @@ func (a *Aggregator) OpenFolder() error {
 		ii := ii
 		eg.Go(func() error { return ii.OpenFolder() })
 	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap := ap
+		eg.Go(func() error { return ap.OpenFolder(false) })
+	}
 	if err := eg.Wait(); err != nil {
 		return fmt.Errorf("OpenFolder: %w", err)
 	}
+	a.folderOpened = true
 	return nil
 }
 
 func (a *Aggregator) OpenList(files []string, readonly bool) error {
-	defer a.recalcVisibleFiles()
+	err := a.openList()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	return err
+}
 
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+func (a *Aggregator) openList() error {
+	if err := a.checkFilesVersions(); err != nil {
+		return fmt.Errorf("OpenList: %w", err)
+	}
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
 	eg := &errgroup.Group{}
 	for _, d := range a.d {
 		d := d
@@ -330,27 +560,69 @@ func (a *Aggregator) OpenList(files []string, readonly bool) error {
 		ii := ii
 		eg.Go(func() error { return ii.OpenFolder() })
 	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap := ap
+		eg.Go(func() error { return ap.OpenFolder(false) })
+	}
 	if err := eg.Wait(); err != nil {
 		return fmt.Errorf("OpenList: %w", err)
 	}
+	a.folderOpened = true
 	return nil
 }
 
+// DefaultAggCloseTimeout - see SetCloseTimeout
+const DefaultAggCloseTimeout = 10 * time.Second
+
+// SetCloseTimeout - how long Close waits for open AggregatorRoTx (including in-flight prune) before closing files under them
+func (a *Aggregator) SetCloseTimeout(timeout time.Duration) { a.closeTimeout = timeout }
+
 func (a *Aggregator) Close() {
 	if a.ctxCancel == nil { // invariant: it's safe to call Close multiple times
 		return
 	}
+	a.closing.Store(true)
 	a.ctxCancel()
 	a.ctxCancel = nil
 	a.wg.Wait()
+	a.waitOpenViews()
 
 	a.closeDirtyFiles()
 	a.recalcVisibleFiles()
 }
 
+// waitOpenViews - closing files under alive readers leads to SIGSEGV. If views are still open after timeout -
+// logs them (with creation stacks if leak detector is enabled, see dbg.SlowTx) and proceeds
+func (a *Aggregator) waitOpenViews() {
+	stuck := a.views.waitEmpty(a.closeTimeout)
+	if len(stuck) == 0 {
+		return
+	}
+	ids := make([]uint64, len(stuck))
+	for i, ac := range stuck {
+		ids[i] = ac.id
+	}
+	a.logger.Warn("[agg] Close: timeout waiting for open views, closing files anyway", "timeout", a.closeTimeout, "views", fmt.Sprintf("%d", ids))
+	for _, ac := range stuck {
+		if stack, started, ok := a.leakDetector.Get(ac._leakID); ok {
+			a.logger.Warn("[agg] Close: open view", "id", ac.id, "age", time.Since(started), "stack", stack)
+		} else {
+			a.logger.Warn("[agg] Close: open view", "id", ac.id, "age", time.Since(ac.openedAt))
+		}
+	}
+}
+
 func (a *Aggregator) closeDirtyFiles() {
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
+
+	for _, item := range a.vanishedFiles {
+		item.closeFiles()
+	}
+	a.vanishedFiles = nil
 
 	for _, d := range a.d {
 		d.Close()
@@ -358,10 +630,22 @@ func (a *Aggregator) closeDirtyFiles() {
 	for _, ii := range a.iis {
 		ii.Close()
 	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.Close()
+	}
 }
 
 func (a *Aggregator) SetCollateAndBuildWorkers(i int) { a.collateAndBuildWorkers = i }
 func (a *Aggregator) SetMergeWorkers(i int)           { a.mergeWorkers = i }
+
+// SetIIMergeSpanFactor - standalone inverted indices (logs, traces) accumulate many small files while merge waits for domains,
+// and each file adds latency to eth_getLogs. f > 0: merge them up to end of their own files (not limited by domain files)
+// and with up to `f` times bigger span. 0 - disabled
+func (a *Aggregator) SetIIMergeSpanFactor(f int) { a.iiMergeSpanFactor = f }
+func (a *Aggregator) SetPruneWorkers(i int)      { a.pruneWorkers = i }
 func (a *Aggregator) SetCompressWorkers(i int) {
 	for _, d := range a.d {
 		d.compressWorkers = i
@@ -369,6 +653,60 @@ func (a *Aggregator) SetCompressWorkers(i int) {
 	for _, ii := range a.iis {
 		ii.compressWorkers = i
 	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.compressWorkers = i
+	}
+}
+
+// SetSkipEmptySteps - domain without changes in step doesn't produce files for it (common for code on quiet ranges). Step is
+// recorded as covered (see emptySteps): reads of it fall through to older files, merges span it. Not supported with
+// block-aligned steps. Commitment domain and domains referenced by its values (see CommitmentValuesTransformMode) always
+// produce files
+func (a *Aggregator) SetSkipEmptySteps(skip bool) { a.skipEmptySteps = skip }
+
+func (a *Aggregator) canSkipEmptyStep(d *Domain) bool {
+	if !a.skipEmptySteps || a.blockLastTxNum != nil {
+		return false
+	}
+	switch d {
+	case a.d[kv.CommitmentDomain]:
+		return false
+	case a.d[kv.AccountsDomain], a.d[kv.StorageDomain]:
+		return a.commitmentValuesTransform == CommitmentValuesTransformOff
+	}
+	return true
+}
+
+// SetCompressionDictionary - .kv files of domain are built and merged with patterns of external dictionary
+// (see seg.NewDictionary for format). Such files can be opened only with same dictionary. Must be called before OpenFolder.
+func (a *Aggregator) SetCompressionDictionary(domain kv.Domain, dict []byte) error {
+	d, err := seg.NewDictionary(dict)
+	if err != nil {
+		return fmt.Errorf("%s: %w", domain, err)
+	}
+	a.d[domain].compressDict = d
+	return nil
+}
+
+// SetCompressionDictionaryFiles - SetCompressionDictionary by files: domain name -> path of dictionary file
+func (a *Aggregator) SetCompressionDictionaryFiles(files map[string]string) error {
+	for name, fPath := range files {
+		domain, err := kv.String2Domain(name)
+		if err != nil {
+			return fmt.Errorf("compression dictionary %s: %w", fPath, err)
+		}
+		dict, err := os.ReadFile(fPath)
+		if err != nil {
+			return fmt.Errorf("compression dictionary of %s: %w", name, err)
+		}
+		if err := a.SetCompressionDictionary(domain, dict); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *Aggregator) DiscardHistory(name kv.Domain) *Aggregator {
@@ -438,6 +776,10 @@ func (a *Aggregator) BuildOptionalMissedIndices(ctx context.Context, workers int
 }
 
 func (ac *AggregatorRoTx) buildOptionalMissedIndices(ctx context.Context, workers int) error {
+	before, err := ac.a.stateFilesBefore()
+	if err != nil {
+		return err
+	}
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(workers)
 	ps := background.NewProgressSet()
@@ -447,7 +789,18 @@ func (ac *AggregatorRoTx) buildOptionalMissedIndices(ctx context.Context, worker
 			g.Go(func() error { return d.BuildOptionalMissedIndices(ctx, ps) })
 		}
 	}
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := ac.a.fsyncProduced(before); err != nil {
+		return err
+	}
+	if code := ac.a.d[kv.CodeDomain]; code.codeHashIndex {
+		ac.a.lockDirtyFiles()
+		code.openCodeHashIndices()
+		ac.a.unlockDirtyFiles()
+	}
+	return nil
 }
 
 func (a *Aggregator) BuildMissedIndices(ctx context.Context, workers int) error {
@@ -472,6 +825,10 @@ func (a *Aggregator) BuildMissedIndices(ctx context.Context, workers int) error
 				}
 			}
 		}()
+		before, err := a.stateFilesBefore()
+		if err != nil {
+			return err
+		}
 		for _, d := range a.d {
 			d.BuildMissedAccessors(ctx, g, ps)
 		}
@@ -479,12 +836,18 @@ func (a *Aggregator) BuildMissedIndices(ctx context.Context, workers int) error
 			ii.BuildMissedAccessors(ctx, g, ps)
 		}
 		for _, appendable := range a.ap {
+			if appendable == nil {
+				continue
+			}
 			appendable.BuildMissedAccessors(ctx, g, ps)
 		}
 
 		if err := g.Wait(); err != nil {
 			return err
 		}
+		if err := a.fsyncProduced(before); err != nil {
+			return err
+		}
 		if err := a.OpenFolder(); err != nil {
 			return err
 		}
@@ -522,7 +885,7 @@ func (a *Aggregator) BuildMissedIndicesInBackground(ctx context.Context, workers
 			if errors.Is(err, context.Canceled) || errors.Is(err, common2.ErrStopped) {
 				return
 			}
-			a.logger.Warn("[snapshots] BuildOptionalMissedIndicesInBackground", "err", err)
+			a.logger.Warn("[snapshots] BuildMissedIndicesInBackground", errLogArgs(err)...)
 		}
 	}()
 }
@@ -561,7 +924,7 @@ func (c AggV3Collation) Close() {
 type AggV3StaticFiles struct {
 	d          [kv.DomainLen]StaticFiles
 	ivfs       [kv.StandaloneIdxLen]InvertedFiles
-	appendable [kv.AppendableLen]AppendableFiles
+	appendable [kv.AppendableMax]AppendableFiles
 }
 
 // CleanupOnError - call it on collation fail. It's closing all files
@@ -572,6 +935,9 @@ func (sf AggV3StaticFiles) CleanupOnError() {
 	for _, ivf := range sf.ivfs {
 		ivf.CleanupOnError()
 	}
+	for _, ap := range sf.appendable {
+		ap.CleanupOnError()
+	}
 }
 
 func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
@@ -581,9 +947,12 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 		logEvery      = time.NewTicker(time.Second * 30)
 		txFrom        = a.FirstTxNumOfStep(step)
 		txTo          = a.FirstTxNumOfStep(step + 1)
+		dataFrom      = txFrom // history and indices, see SetBlockAlignedSteps
+		dataTo        = txTo
 		stepStartedAt = time.Now()
 
 		static          AggV3StaticFiles
+		stats           = &StepBuildStats{Step: step, CollateWorkers: a.collateAndBuildWorkers, CompressWorkers: a.d[kv.AccountsDomain].compressWorkers}
 		closeCollations = true
 		collListMu      = sync.Mutex{}
 		collations      = make([]Collation, 0)
@@ -599,6 +968,22 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 		}
 	}()
 
+	if err := a.checkStepNotPartiallyInFiles(ctx, step); err != nil {
+		return err
+	}
+	before, err := a.stateFilesBefore()
+	if err != nil {
+		return err
+	}
+	if a.blockLastTxNum != nil {
+		if err := a.db.View(ctx, func(tx kv.Tx) (err error) {
+			dataFrom, dataTo, err = a.stepDataRange(tx, step)
+			return err
+		}); err != nil {
+			return fmt.Errorf("block-aligned step %d: %w", step, err)
+		}
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(a.collateAndBuildWorkers)
 	for _, d := range a.d {
@@ -609,21 +994,30 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 			defer a.wg.Done()
 
 			var collation Collation
+			collateStartedAt := time.Now()
 			if err := a.db.View(ctx, func(tx kv.Tx) (err error) {
-				collation, err = d.collate(ctx, step, txFrom, txTo, tx)
+				collation, err = d.collate(ctx, step, dataFrom, dataTo, tx)
 				return err
 			}); err != nil {
-				return fmt.Errorf("domain collation %q has failed: %w", d.filenameBase, err)
+				return &ErrCollationFailed{Domain: d.filenameBase, Step: step, Err: err}
 			}
+			collateTook := time.Since(collateStartedAt)
 			collListMu.Lock()
 			collations = append(collations, collation)
 			collListMu.Unlock()
 
-			sf, err := d.buildFiles(ctx, step, collation, a.ps)
+			buildStartedAt := time.Now()
+			var sf StaticFiles
+			var err error
+			if collation.isEmpty() && a.canSkipEmptyStep(d) {
+				sf.emptyStep = true
+			} else {
+				sf, err = d.buildFiles(ctx, step, collation, a.ps)
+			}
 			collation.Close()
 			if err != nil {
 				sf.CleanupOnError()
-				return err
+				return &ErrBuildFailed{Domain: d.filenameBase, Step: step, Err: err}
 			}
 
 			dd, err := kv.String2Domain(d.filenameBase)
@@ -631,6 +1025,14 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 				return err
 			}
 			static.d[dd] = sf
+			stats.Domains[dd] = DomainBuildStats{
+				Keys:          collation.valuesCount,
+				HistoryKeys:   collation.historyCount,
+				CollatedBytes: collation.valuesBytes + collation.historyBytes,
+				OutputBytes:   sf.outputBytes(),
+				CollateTook:   collateTook,
+				BuildTook:     time.Since(buildStartedAt),
+			}
 			return nil
 		})
 	}
@@ -645,16 +1047,16 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 
 			var collation InvertedIndexCollation
 			err := a.db.View(ctx, func(tx kv.Tx) (err error) {
-				collation, err = ii.collate(ctx, step, tx)
+				collation, err = ii.collateRange(ctx, step, dataFrom, dataTo, tx)
 				return err
 			})
 			if err != nil {
-				return fmt.Errorf("index collation %q has failed: %w", ii.filenameBase, err)
+				return &ErrCollationFailed{Domain: ii.filenameBase, Step: step, Err: err}
 			}
 			sf, err := ii.buildFiles(ctx, step, collation, a.ps)
 			if err != nil {
 				sf.CleanupOnError()
-				return err
+				return &ErrBuildFailed{Domain: ii.filenameBase, Step: step, Err: err}
 			}
 
 			switch ii.indexKeysTable {
@@ -674,6 +1076,9 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 	}
 
 	for name, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
 		name := name
 		ap := ap
 		a.wg.Add(1)
@@ -686,12 +1091,12 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 				return err
 			})
 			if err != nil {
-				return fmt.Errorf("index collation %q has failed: %w", ap.filenameBase, err)
+				return &ErrCollationFailed{Domain: ap.filenameBase, Step: step, Err: err}
 			}
 			sf, err := ap.buildFiles(ctx, step, collation, a.ps)
 			if err != nil {
 				sf.CleanupOnError()
-				return err
+				return &ErrBuildFailed{Domain: ap.filenameBase, Step: step, Err: err}
 			}
 			static.appendable[name] = sf
 			return nil
@@ -702,9 +1107,16 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 		static.CleanupOnError()
 		return fmt.Errorf("domain collate-build: %w", err)
 	}
+	if err := a.fsyncProduced(before); err != nil {
+		static.CleanupOnError()
+		return err
+	}
 	mxStepTook.ObserveDuration(stepStartedAt)
+	stats.Took = time.Since(stepStartedAt)
+	stats.observe()
+	a.lastBuildStats.Store(stats)
 	a.integrateDirtyFiles(static, txFrom, txTo)
-	a.logger.Info("[snapshots] aggregated", "step", step, "took", time.Since(stepStartedAt))
+	a.logger.Info("[snapshots] aggregated", stats.logArgs()...)
 
 	return nil
 }
@@ -752,6 +1164,14 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context) (somethingDone bool, err
 	if !r.any() {
 		return false, nil
 	}
+	if excluded := a.ExcludedFiles(); len(excluded) > 0 { // merge of range with excluded file would lose its data
+		a.logger.Debug("[agg] merge skipped: some files are excluded from visible files", "files", excluded)
+		return false, nil
+	}
+	if a.mergeSequential() {
+		aggTx.Close() // references input files: they can't be deleted while it's open
+		return true, a.mergeSequentially(ctx, r)
+	}
 
 	outs, err := aggTx.staticFilesInRange(r)
 	defer func() {
@@ -762,6 +1182,10 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context) (somethingDone bool, err
 	if err != nil {
 		return false, err
 	}
+	before, err := a.stateFilesBefore()
+	if err != nil {
+		return false, err
+	}
 
 	in, err := aggTx.mergeFiles(ctx, outs, r)
 	if err != nil {
@@ -772,7 +1196,15 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context) (somethingDone bool, err
 			in.Close()
 		}
 	}()
+	_, outSize := mergeSizes(outs, in)
+	a.addMergeDiskInFlight(outSize)
+	defer a.addMergeDiskInFlight(-outSize)
+	if err := a.fsyncProduced(before); err != nil {
+		return true, err
+	}
+	a.recordMergeRatios(outs, in)
 	a.integrateMergedDirtyFiles(outs, in)
+	a.scheduleWarmup(in)
 	a.cleanAfterMerge(in)
 
 	a.needSaveFilesListInDB.Store(true)
@@ -782,24 +1214,44 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context) (somethingDone bool, err
 	return true, nil
 }
 
+// MergeLoop - merges files until nothing to merge. Slot of snapshotBuildCoord is held per merge range, not for whole
+// loop: other builders get slots between ranges
 func (a *Aggregator) MergeLoop(ctx context.Context) error {
 	for {
+		if err := a.snapshotBuildCoord.Acquire(ctx, snapbuild.Merge); err != nil {
+			return err
+		}
 		somethingMerged, err := a.mergeLoopStep(ctx)
+		a.snapshotBuildCoord.Release(snapbuild.Merge)
 		if err != nil {
 			return err
 		}
 		if !somethingMerged {
+			a.cleanExpiredHistory()
 			return nil
 		}
 	}
 }
 
+// integrateDirtyFiles - ordering guarantees of making new files visible:
+//  1. files are added to `dirtyFiles` (under `dirtyFilesLock`) - they are not visible yet
+//  2. recalcVisibleFiles: visible files of all domains/indices are replaced at once (under `visibleFilesLock`) - every
+//     BeginFilesRo started after this moment sees new files. FilesGeneration is incremented here
+//  3. visibleFilesMinimaxTxNum is updated and OnFilesChange is signaled - after (2): if EndTxNumMinimax() >= X, then
+//     new BeginFilesRo has files up to X. See WaitFilesVisible
+//  4. needSaveFilesListInDB is set - after (3): positive HasNewFrozenFiles implies that files are visible
+//
+// Already open AggregatorRoTx don't see new files. Prune removes DB rows only below files of own RoTx (see pruneTxTo).
 func (a *Aggregator) integrateDirtyFiles(sf AggV3StaticFiles, txNumFrom, txNumTo uint64) {
-	defer a.needSaveFilesListInDB.Store(true)
-	defer a.recalcVisibleFiles()
+	a.integrateDirtyFilesLocked(sf, txNumFrom, txNumTo)
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.needSaveFilesListInDB.Store(true)
+}
 
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+func (a *Aggregator) integrateDirtyFilesLocked(sf AggV3StaticFiles, txNumFrom, txNumTo uint64) {
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
 
 	for id, d := range a.d {
 		d.integrateDirtyFiles(sf.d[id], txNumFrom, txNumTo)
@@ -807,28 +1259,185 @@ func (a *Aggregator) integrateDirtyFiles(sf AggV3StaticFiles, txNumFrom, txNumTo
 	for id, ii := range a.iis {
 		ii.integrateDirtyFiles(sf.ivfs[id], txNumFrom, txNumTo)
 	}
+	for id, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.integrateDirtyFiles(sf.appendable[id], txNumFrom, txNumTo)
+	}
 }
 
+// DefaultFilesListSaveInterval - see SetFilesListSaveInterval
+const DefaultFilesListSaveInterval = 30 * time.Second
+
+// filesListSave - coalescing of DB writes of files list: merge loop integrates files many times per minute
+type filesListSave struct {
+	lock     sync.Mutex
+	interval time.Duration
+	lastSave time.Time           // last positive HasNewFrozenFiles
+	flush    bool                // FlushFilesList requested
+	acked    map[string]struct{} // files list of last AckFilesListDelta. nil - nothing acknowledged yet
+
+	pending   *FilesListDelta // written by tx which may be not committed yet, see PendFilesListDelta
+	pendingID uint64
+	lastID    uint64
+}
+
+// SetFilesListSaveInterval - min interval between positive HasNewFrozenFiles. 0 - report every change
+func (a *Aggregator) SetFilesListSaveInterval(interval time.Duration) {
+	a.filesListSave.lock.Lock()
+	defer a.filesListSave.lock.Unlock()
+	a.filesListSave.interval = interval
+}
+
+// FlushFilesList - next HasNewFrozenFiles reports new files (if any) without waiting for save interval
+func (a *Aggregator) FlushFilesList() {
+	a.filesListSave.lock.Lock()
+	defer a.filesListSave.lock.Unlock()
+	a.filesListSave.flush = true
+}
+
+// HasNewFrozenFiles - files list changed since previous positive call and must be saved in DB (see FilesListDelta).
+// Not more often than once per SetFilesListSaveInterval - unless FlushFilesList requested.
 func (a *Aggregator) HasNewFrozenFiles() bool {
 	if a == nil {
 		return false
 	}
-	return a.needSaveFilesListInDB.CompareAndSwap(true, false)
+	s := &a.filesListSave
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !a.needSaveFilesListInDB.Load() {
+		return false
+	}
+	if !s.flush && !s.lastSave.IsZero() && time.Since(s.lastSave) < s.interval {
+		return false
+	}
+	if !a.needSaveFilesListInDB.CompareAndSwap(true, false) {
+		return false
+	}
+	s.flush = false
+	s.lastSave = time.Now()
+	return true
+}
+
+// FilesListDelta - change of files list since last AckFilesListDelta
+type FilesListDelta struct {
+	// Full - nothing acknowledged yet: Added is the whole list, stored list must be replaced by it
+	Full           bool
+	Added, Removed []string
+}
+
+func (d FilesListDelta) Empty() bool { return !d.Full && len(d.Added) == 0 && len(d.Removed) == 0 }
+
+// FilesListDelta - diff between current files list (see Files) and acknowledged one. Caller writes it to DB and
+// acknowledges by AckFilesListDelta after commit (or by PendFilesListDelta if tx is committed by somebody else). If write
+// was not committed - ResetFilesListDelta: next delta will be Full.
+func (a *Aggregator) FilesListDelta() (delta FilesListDelta) {
+	files := a.Files()
+	s := &a.filesListSave
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.acked == nil {
+		return FilesListDelta{Full: true, Added: files}
+	}
+	current := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		current[f] = struct{}{}
+		if _, ok := s.acked[f]; !ok {
+			delta.Added = append(delta.Added, f)
+		}
+	}
+	for f := range s.acked {
+		if _, ok := current[f]; !ok {
+			delta.Removed = append(delta.Removed, f)
+		}
+	}
+	sort.Strings(delta.Removed)
+	return delta
+}
+
+// AckFilesListDelta - `delta` is written to DB
+func (a *Aggregator) AckFilesListDelta(delta FilesListDelta) {
+	s := &a.filesListSave
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if delta.Full || s.acked == nil {
+		s.acked = make(map[string]struct{}, len(delta.Added))
+	}
+	for _, f := range delta.Added {
+		s.acked[f] = struct{}{}
+	}
+	for _, f := range delta.Removed {
+		delete(s.acked, f)
+	}
+}
+
+// PendFilesListDelta - `delta` is written to DB by tx which is committed by somebody else. Returned id must be written
+// by same tx: delta is acknowledged by ConfirmFilesListDelta when next tx sees this id
+func (a *Aggregator) PendFilesListDelta(delta FilesListDelta) (id uint64) {
+	s := &a.filesListSave
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.lastID == 0 { // ids of previous runs may be in DB
+		s.lastID = uint64(time.Now().UnixNano())
+	}
+	s.lastID++
+	s.pending, s.pendingID = &delta, s.lastID
+	return s.pendingID
+}
+
+// ConfirmFilesListDelta - `committedID` is id read from DB. Pending delta is acknowledged if it's committed. Otherwise
+// it's forgotten and files list must be saved again: next FilesListDelta includes its changes
+func (a *Aggregator) ConfirmFilesListDelta(committedID uint64) {
+	s := &a.filesListSave
+	s.lock.Lock()
+	pending := s.pending
+	committed := pending != nil && s.pendingID == committedID
+	s.pending, s.pendingID = nil, 0
+	s.lock.Unlock()
+	if pending == nil {
+		return
+	}
+	if committed {
+		a.AckFilesListDelta(*pending)
+		return
+	}
+	a.needSaveFilesListInDB.Store(true)
+}
+
+// ResetFilesListDelta - forget acknowledged list: next FilesListDelta is Full
+func (a *Aggregator) ResetFilesListDelta() {
+	s := &a.filesListSave
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.acked = nil
 }
 
 type flusher interface {
 	Flush(ctx context.Context, tx kv.RwTx) error
 }
 
-func (ac *AggregatorRoTx) minimaxTxNumInDomainFiles() uint64 {
-	return min(
-		ac.d[kv.AccountsDomain].files.EndTxNum(),
-		ac.d[kv.CodeDomain].files.EndTxNum(),
-		ac.d[kv.StorageDomain].files.EndTxNum(),
-		ac.d[kv.CommitmentDomain].files.EndTxNum(),
+// MinimaxTxNum - txNum up to which all state domains (accounts, storage, code) have files of this RoTx.
+// Commitment may lag behind (it can be rebuilt from state), so decision must choose:
+//   - includeCommitment=true: for decisions about data of all domains - prune boundary, building/merging files.
+//     Pruning beyond commitment files would lose commitment data which exists only in DB.
+//   - includeCommitment=false: for decisions about state only - unwind limit, state progress (commitment is
+//     recomputed after unwind), rebuild of commitment.
+func (ac *AggregatorRoTx) MinimaxTxNum(includeCommitment bool) uint64 {
+	txNum := min(
+		ac.d[kv.AccountsDomain].endTxNum(),
+		ac.d[kv.CodeDomain].endTxNum(),
+		ac.d[kv.StorageDomain].endTxNum(),
 	)
+	if includeCommitment {
+		txNum = min(txNum, ac.d[kv.CommitmentDomain].endTxNum())
+	}
+	return txNum
 }
 
+// Deprecated: use MinimaxTxNum(true)
+func (ac *AggregatorRoTx) minimaxTxNumInDomainFiles() uint64 { return ac.MinimaxTxNum(true) }
+
 func (ac *AggregatorRoTx) CanPrune(tx kv.Tx, untilTx uint64) bool {
 	if dbg.NoPrune() {
 		return false
@@ -846,11 +1455,47 @@ func (ac *AggregatorRoTx) CanPrune(tx kv.Tx, untilTx uint64) bool {
 	return false
 }
 
+// pruneTxTo - prune boundary by files of this RoTx. Shared visibleFilesMinimaxTxNum may be already changed by
+// recalcVisibleFiles (after merge or failed OpenFolder) - data not covered by files of this RoTx must not be pruned
+func (ac *AggregatorRoTx) pruneTxTo() uint64 {
+	txTo := ac.MinimaxTxNum(true)
+	if shared := ac.a.visibleFilesMinimaxTxNum.Load(); shared < txTo {
+		ac.a.logger.Debug("[snapshots] prune: visible files are behind files of RoTx", "rotx", txTo, "visible", shared)
+	} else if shared > txTo {
+		ac.a.logger.Debug("[snapshots] prune: RoTx doesn't see newest files", "rotx", txTo, "visible", shared)
+	}
+	// files of other step size may end in the middle of step: it stays in DB until it's in files completely
+	return txTo - txTo%ac.a.StepSize()
+}
+
+// PruneBacklog - amount of steps which are already in files but still in DB. 0 - nothing to prune.
+func (ac *AggregatorRoTx) PruneBacklog(tx kv.Tx) (steps float64) {
+	txTo := ac.MinimaxTxNum(true)
+	if txTo == 0 || !ac.CanPrune(tx, txTo) {
+		return 0
+	}
+	filesSteps := float64(txTo) / float64(ac.a.StepSize())
+	for _, d := range ac.d {
+		if from, to := d.d.History.InvertedIndex.stepsRangeInDB(tx); to > 0 && from < filesSteps {
+			steps = max(steps, filesSteps-from)
+		}
+	}
+	for _, ii := range ac.iis {
+		if from, to := ii.ii.stepsRangeInDB(tx); to > 0 && from < filesSteps {
+			steps = max(steps, filesSteps-from)
+		}
+	}
+	return steps
+}
+
 func (ac *AggregatorRoTx) CanUnwindToBlockNum(tx kv.Tx) (uint64, error) {
 	return ReadLowestUnwindableBlock(tx)
 }
+
+// CanUnwindDomainsToTxNum - state domains can't be unwound below their files. Lagging commitment files don't
+// limit unwind: commitment is recomputed after unwind.
 func (ac *AggregatorRoTx) CanUnwindDomainsToTxNum() uint64 {
-	return ac.minimaxTxNumInDomainFiles()
+	return ac.MinimaxTxNum(false)
 }
 
 func (ac *AggregatorRoTx) CanUnwindBeforeBlockNum(blockNum uint64, tx kv.Tx) (uint64, bool, error) {
@@ -862,7 +1507,32 @@ func (ac *AggregatorRoTx) CanUnwindBeforeBlockNum(blockNum uint64, tx kv.Tx) (ui
 	return blockNum, true, nil
 }
 
+// ErrPruneBusy - prune is skipped: other prune of same Aggregator is in progress. Caller can back off and retry later
+var ErrPruneBusy = errors.New("prune skipped: other prune of aggregator is in progress")
+
+// PruneSmallBatchesDb - same as PruneSmallBatches, but each batch is pruned (by PruneParallel) and committed in own RwTx of `db`.
+// Returns ErrPruneBusy immediately if other prune of same Aggregator is in progress.
 func (ac *AggregatorRoTx) PruneSmallBatchesDb(ctx context.Context, timeout time.Duration, db kv.RwDB) (haveMore bool, err error) {
+	haveMore, stat, err := ac.pruneSmallBatchesDb(ctx, timeout, db)
+	if err == nil && stat != nil && stat.SkippedBusy {
+		return false, ErrPruneBusy
+	}
+	if err == nil {
+		err = db.View(ctx, func(tx kv.Tx) error {
+			ac.a.TableWatermarks(tx) // updates mxTableWatermarks
+			return nil
+		})
+	}
+	return haveMore, err
+}
+
+func (ac *AggregatorRoTx) pruneSmallBatchesDb(ctx context.Context, timeout time.Duration, db kv.RwDB) (haveMore bool, fullStat *AggregatorPruneStat, err error) {
+	if !ac.a.pruning.CompareAndSwap(false, true) {
+		ac.a.logger.Debug("[snapshots] PruneSmallBatches skipped: other prune in progress")
+		return false, &AggregatorPruneStat{SkippedBusy: true}, nil
+	}
+	defer ac.a.pruning.Store(false)
+
 	// On tip-of-chain timeout is about `3sec`
 	//  On tip of chain:     must be real-time - prune by small batches and prioritize exact-`timeout`
 	//  Not on tip of chain: must be aggressive (prune as much as possible) by bigger batches
@@ -889,7 +1559,7 @@ func (ac *AggregatorRoTx) PruneSmallBatchesDb(ctx context.Context, timeout time.
 	aggLogEvery := time.NewTicker(600 * time.Second) // to hide specific domain/idx logging
 	defer aggLogEvery.Stop()
 
-	fullStat := newAggregatorPruneStat()
+	fullStat = newAggregatorPruneStat()
 	innerCtx := context.Background()
 	goExit := false
 
@@ -899,7 +1569,8 @@ func (ac *AggregatorRoTx) PruneSmallBatchesDb(ctx context.Context, timeout time.
 			// `context.Background()` is important here!
 			//     it allows keep DB consistent - prune all keys-related data or noting
 			//     can't interrupt by ctrl+c and leave dirt in DB
-			stat, err := ac.Prune(innerCtx, tx, pruneLimit, aggLogEvery)
+			// tx is fresh - read txs of PruneParallel see same data
+			stat, err := ac.prune(innerCtx, db, tx, pruneLimit, ac.a.pruneWorkers, aggLogEvery)
 			if err != nil {
 				ac.a.logger.Warn("[snapshots] PruneSmallBatches failed", "err", err)
 				return err
@@ -928,7 +1599,7 @@ func (ac *AggregatorRoTx) PruneSmallBatchesDb(ctx context.Context, timeout time.
 				ac.a.logger.Info("[snapshots] pruning state",
 					"until commit", time.Until(started.Add(timeout)).String(),
 					"pruneLimit", pruneLimit,
-					"aggregatedStep", (ac.minimaxTxNumInDomainFiles()-1)/ac.a.StepSize(),
+					"aggregatedStep", (ac.MinimaxTxNum(true)-1)/ac.a.StepSize(),
 					"stepsRangeInDB", ac.a.StepsRangeInDBAsStr(tx),
 					"pruned", fullStat.String(),
 				)
@@ -937,24 +1608,45 @@ func (ac *AggregatorRoTx) PruneSmallBatchesDb(ctx context.Context, timeout time.
 			return nil
 		})
 		if err != nil {
-			return false, err
+			return false, fullStat, err
 		}
 		select {
 		case <-localTimeout.C: //must be first to improve responsivness
-			return true, nil
+			return true, fullStat, nil
 		case <-ctx.Done():
-			return false, ctx.Err()
+			return false, fullStat, ctx.Err()
 		default:
 		}
 		if goExit {
-			return false, nil
+			return false, fullStat, nil
+		}
+		if ac.a.closing.Load() { // Close waits for this view
+			return true, fullStat, nil
 		}
 	}
 }
 
 // PruneSmallBatches is not cancellable, it's over when it's over or failed.
 // It fills whole timeout with pruning by small batches (of 100 keys) and making some progress
+// Returns ErrPruneBusy immediately if other prune of same Aggregator is in progress.
 func (ac *AggregatorRoTx) PruneSmallBatches(ctx context.Context, timeout time.Duration, tx kv.RwTx) (haveMore bool, err error) {
+	haveMore, stat, err := ac.pruneSmallBatches(ctx, timeout, tx)
+	if err == nil && stat != nil && stat.SkippedBusy {
+		return false, ErrPruneBusy
+	}
+	if err == nil {
+		ac.a.TableWatermarks(tx) // updates mxTableWatermarks
+	}
+	return haveMore, err
+}
+
+func (ac *AggregatorRoTx) pruneSmallBatches(ctx context.Context, timeout time.Duration, tx kv.RwTx) (haveMore bool, fullStat *AggregatorPruneStat, err error) {
+	if !ac.a.pruning.CompareAndSwap(false, true) {
+		ac.a.logger.Debug("[snapshots] PruneSmallBatches skipped: other prune in progress")
+		return false, &AggregatorPruneStat{SkippedBusy: true}, nil
+	}
+	defer ac.a.pruning.Store(false)
+
 	// On tip-of-chain timeout is about `3sec`
 	//  On tip of chain:     must be real-time - prune by small batches and prioritize exact-`timeout`
 	//  Not on tip of chain: must be aggressive (prune as much as possible) by bigger batches
@@ -976,23 +1668,23 @@ func (ac *AggregatorRoTx) PruneSmallBatches(ctx context.Context, timeout time.Du
 	aggLogEvery := time.NewTicker(600 * time.Second) // to hide specific domain/idx logging
 	defer aggLogEvery.Stop()
 
-	fullStat := newAggregatorPruneStat()
+	fullStat = newAggregatorPruneStat()
 
 	for {
 		iterationStarted := time.Now()
 		// `context.Background()` is important here!
 		//     it allows keep DB consistent - prune all keys-related data or noting
 		//     can't interrupt by ctrl+c and leave dirt in DB
-		stat, err := ac.Prune(context.Background(), tx, pruneLimit, aggLogEvery)
+		stat, err := ac.prune(context.Background(), nil, tx, pruneLimit, 1, aggLogEvery)
 		if err != nil {
 			ac.a.logger.Warn("[snapshots] PruneSmallBatches failed", "err", err)
-			return false, err
+			return false, fullStat, err
 		}
 		if stat == nil || stat.PrunedNothing() {
 			if !fullStat.PrunedNothing() {
 				ac.a.logger.Info("[snapshots] PruneSmallBatches finished", "took", time.Since(started).String(), "stat", fullStat.String())
 			}
-			return false, nil
+			return false, fullStat, nil
 		}
 		fullStat.Accumulate(stat)
 
@@ -1008,37 +1700,137 @@ func (ac *AggregatorRoTx) PruneSmallBatches(ctx context.Context, timeout time.Du
 
 		select {
 		case <-localTimeout.C: //must be first to improve responsivness
-			return true, nil
+			return true, fullStat, nil
 		case <-logEvery.C:
 			ac.a.logger.Info("[snapshots] pruning state",
 				"until commit", time.Until(started.Add(timeout)).String(),
 				"pruneLimit", pruneLimit,
-				"aggregatedStep", (ac.minimaxTxNumInDomainFiles()-1)/ac.a.StepSize(),
+				"aggregatedStep", (ac.MinimaxTxNum(true)-1)/ac.a.StepSize(),
 				"stepsRangeInDB", ac.a.StepsRangeInDBAsStr(tx),
 				"pruned", fullStat.String(),
 			)
 		case <-ctx.Done():
-			return false, ctx.Err()
+			return false, fullStat, ctx.Err()
 		default:
 		}
+		if ac.a.closing.Load() { // Close waits for this view
+			return true, fullStat, nil
+		}
 	}
 }
 
+// StepRange - steps of first and last txNum in DB. Fractional: txNum position inside step
+type StepRange struct {
+	FromStep, ToStep float64
+}
+
+func (r StepRange) Len() float64 { return r.ToStep - r.FromStep }
+
+// StepsRangeInDB - per domain and inverted index (by file name base): range of steps which are still in DB
+func (a *Aggregator) StepsRangeInDB(tx kv.Tx) map[string]StepRange {
+	res := make(map[string]StepRange, len(a.d)+len(a.iis))
+	for _, d := range a.d {
+		from, to := d.History.InvertedIndex.stepsRangeInDB(tx)
+		res[d.filenameBase] = StepRange{FromStep: from, ToStep: to}
+	}
+	for _, ii := range a.iis {
+		from, to := ii.stepsRangeInDB(tx)
+		res[ii.filenameBase] = StepRange{FromStep: from, ToStep: to}
+	}
+	return res
+}
+
 func (a *Aggregator) StepsRangeInDBAsStr(tx kv.Tx) string {
-	steps := make([]string, 0, kv.DomainLen+4)
+	ranges := a.StepsRangeInDB(tx)
+	steps := make([]string, 0, len(ranges))
 	for _, d := range a.d {
-		steps = append(steps, d.stepsRangeInDBAsStr(tx))
+		steps = append(steps, fmt.Sprintf("%s:%.1f", d.filenameBase, ranges[d.filenameBase].Len()))
 	}
 	for _, ii := range a.iis {
-		steps = append(steps, ii.stepsRangeInDBAsStr(tx))
+		steps = append(steps, fmt.Sprintf("%s:%.1f", ii.filenameBase, ranges[ii.filenameBase].Len()))
 	}
 	return strings.Join(steps, ", ")
 }
 
+// Watermark - what DB table has: range of txNums and amount of rows
+type Watermark struct {
+	MinTxNum, MaxTxNum uint64 // both 0 - table is empty or not ordered by txNum (domain latest tables)
+	ApproxRows         uint64 // from table stats: doesn't require tables scan
+}
+
+// TableWatermarks - Watermark of each DB table of domains (latest values), histories and inverted indices: table name -> Watermark.
+// Cheap: reads first and last key of tables ordered by txNum (`txNum -> key` tables of inverted indices). Tables which are
+// written and pruned together with them (`key -> txNum` index, history values) get same txNums range.
+// Domain latest tables are not ordered by txNum - only ApproxRows is set.
+// Also exports watermarks of history keys tables to metrics - called after each PruneSmallBatches.
+func (a *Aggregator) TableWatermarks(tx kv.Tx) map[string]Watermark {
+	res := make(map[string]Watermark, len(a.d)*5+len(a.iis)*2)
+	rows := func(table string) uint64 {
+		c, err := tx.Cursor(table)
+		if err != nil {
+			return 0
+		}
+		defer c.Close()
+		cnt, err := c.Count()
+		if err != nil {
+			return 0
+		}
+		return cnt
+	}
+	addIndex := func(ii *InvertedIndex, companions ...string) {
+		var w Watermark
+		if fst, _ := kv.FirstKey(tx, ii.indexKeysTable); len(fst) >= 8 {
+			w.MinTxNum = binary.BigEndian.Uint64(fst)
+		}
+		if lst, _ := kv.LastKey(tx, ii.indexKeysTable); len(lst) >= 8 {
+			w.MaxTxNum = binary.BigEndian.Uint64(lst)
+		}
+		for _, table := range append([]string{ii.indexKeysTable, ii.indexTable}, companions...) {
+			w.ApproxRows = rows(table)
+			res[table] = w
+		}
+	}
+
+	for _, d := range a.d {
+		res[d.keysTable] = Watermark{ApproxRows: rows(d.keysTable)}
+		res[d.valsTable] = Watermark{ApproxRows: rows(d.valsTable)}
+		addIndex(d.History.InvertedIndex, d.History.historyValsTable)
+	}
+	for _, ii := range a.iis {
+		addIndex(ii)
+	}
+
+	for table, g := range mxTableWatermarks {
+		w, ok := res[table]
+		if !ok {
+			continue
+		}
+		g.min.SetUint64(w.MinTxNum)
+		g.max.SetUint64(w.MaxTxNum)
+		g.rows.SetUint64(w.ApproxRows)
+	}
+	return res
+}
+
+// DbDataLagSteps - max (across domains) amount of full steps which are in DB, but not in files yet
+func (a *Aggregator) DbDataLagSteps(tx kv.Tx) (lag uint64) {
+	ac := a.BeginFilesRo()
+	defer ac.Close()
+	for _, dt := range ac.d {
+		stepInFiles := dt.endTxNum() / a.StepSize()
+		if stepInDB := dt.d.maxStepInDB(tx); stepInDB > stepInFiles {
+			lag = max(lag, stepInDB-stepInFiles)
+		}
+	}
+	return lag
+}
+
 type AggregatorPruneStat struct {
 	Domains    map[string]*DomainPruneStat
 	Indices    map[string]*InvertedIndexPruneStat
-	Appendable map[string]*AppendablePruneStat
+	Appendable map[string]*AppendablePruneStat // key: kv.Appendable.String()
+
+	SkippedBusy bool // nothing done: other prune of same Aggregator is in progress
 }
 
 func (as *AggregatorPruneStat) PrunedNothing() bool {
@@ -1052,6 +1844,11 @@ func (as *AggregatorPruneStat) PrunedNothing() bool {
 			return false
 		}
 	}
+	for _, ap := range as.Appendable {
+		if ap != nil && !ap.PrunedNothing() {
+			return false
+		}
+	}
 	return true
 }
 
@@ -1063,6 +1860,9 @@ func (as *AggregatorPruneStat) String() string {
 	if as == nil {
 		return ""
 	}
+	if as.SkippedBusy {
+		return "skipped: busy"
+	}
 	names := make([]string, 0)
 	for k := range as.Domains {
 		names = append(names, k)
@@ -1089,6 +1889,17 @@ func (as *AggregatorPruneStat) String() string {
 			sb.WriteString(fmt.Sprintf("%s| %s; ", d, v.String()))
 		}
 	}
+	names = names[:0]
+	for k := range as.Appendable {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, d := range names {
+		v, ok := as.Appendable[d]
+		if ok && v != nil && !v.PrunedNothing() {
+			sb.WriteString(fmt.Sprintf("%s| %s; ", d, v.String()))
+		}
+	}
 	return strings.TrimSuffix(sb.String(), "; ")
 }
 
@@ -1111,6 +1922,18 @@ func (as *AggregatorPruneStat) Accumulate(other *AggregatorPruneStat) {
 		}
 		as.Indices[k] = id
 	}
+	for k, v := range other.Appendable {
+		if as.Appendable == nil {
+			as.Appendable = make(map[string]*AppendablePruneStat)
+		}
+		ap, ok := as.Appendable[k]
+		if !ok || ap == nil {
+			ap = v
+		} else {
+			ap.Accumulate(v)
+		}
+		as.Appendable[k] = ap
+	}
 }
 
 // temporal function to prune history straight after commitment is done - reduce history size in db until we build
@@ -1142,7 +1965,39 @@ func (ac *AggregatorRoTx) PruneCommitHistory(ctx context.Context, tx kv.RwTx, lo
 	return nil
 }
 
+// Prune - only 1 prune of Aggregator runs at a time: if other one is in progress (other AggregatorRoTx, other RwTx)
+// returns immediately with SkippedBusy stat. Caller can back off and retry later.
 func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, logEvery *time.Ticker) (*AggregatorPruneStat, error) {
+	if !ac.a.pruning.CompareAndSwap(false, true) {
+		return &AggregatorPruneStat{SkippedBusy: true}, nil
+	}
+	defer ac.a.pruning.Store(false)
+	return ac.prune(ctx, nil, tx, limit, 1, logEvery)
+}
+
+// PruneParallel - same as Prune, but read-only phase of domains and indices prune (search of what to delete) runs
+// in `workers` goroutines - each in own read tx of `db`. Deletions are applied serially in `tx`: all or nothing per call.
+// Read txs don't see uncommitted changes of `tx`: it must not have uncommitted writes to tables of domains and indices
+// (for example: fresh tx of db.Update).
+func (ac *AggregatorRoTx) PruneParallel(ctx context.Context, db kv.RoDB, tx kv.RwTx, limit uint64, workers int, logEvery *time.Ticker) (*AggregatorPruneStat, error) {
+	if !ac.a.pruning.CompareAndSwap(false, true) {
+		return &AggregatorPruneStat{SkippedBusy: true}, nil
+	}
+	defer ac.a.pruning.Store(false)
+	return ac.prune(ctx, db, tx, limit, workers, logEvery)
+}
+
+// pruneJob - Prune of 1 component (domain or inverted index) split in 2 phases:
+//   - collect: read-only walk of component's tables. Jobs touch distinct tables - can run in parallel in own read txs.
+//   - apply: deletions in caller's RwTx. MDBX write txs are single-threaded - serial.
+type pruneJob interface {
+	collect(ctx context.Context, tx kv.Tx) error
+	apply(ctx context.Context, rwTx kv.RwTx, logEvery *time.Ticker) error
+	close()
+}
+
+// prune - db=nil: collect phase runs in `tx`
+func (ac *AggregatorRoTx) prune(ctx context.Context, db kv.RoDB, tx kv.RwTx, limit uint64, workers int, logEvery *time.Ticker) (*AggregatorPruneStat, error) {
 	defer mxPruneTookAgg.ObserveDuration(time.Now())
 
 	if limit == 0 {
@@ -1150,7 +2005,7 @@ func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, l
 	}
 
 	var txFrom, step uint64 // txFrom is always 0 to avoid dangling keys in indices/hist
-	txTo := ac.a.visibleFilesMinimaxTxNum.Load()
+	txTo := ac.pruneTxTo()
 	if txTo > 0 {
 		// txTo is first txNum in next step, has to go 1 tx behind to get correct step number
 		step = (txTo - 1) / ac.a.StepSize()
@@ -1167,40 +2022,74 @@ func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, l
 	//ac.a.logger.Info("aggregator prune", "step", step,
 	//	"txn_range", fmt.Sprintf("[%d,%d)", txFrom, txTo), "limit", limit,
 	//	/*"stepsLimit", limit/ac.a.aggregationStep,*/ "stepsRangeInDB", ac.a.StepsRangeInDBAsStr(tx))
+	var domainJobs [kv.DomainLen]*domainPruneJob
+	var iiJobs [kv.StandaloneIdxLen]*iiPruneJob
+	jobs := make([]pruneJob, 0, len(domainJobs)+len(iiJobs))
+	for id, d := range ac.d {
+		domainJobs[id] = d.pruneJob(tx, step, txFrom, txTo, limit)
+		jobs = append(jobs, domainJobs[id])
+	}
+	for id, ii := range ac.iis {
+		iiJobs[id] = ii.pruneJob(tx, txFrom, txTo, limit)
+		jobs = append(jobs, iiJobs[id])
+	}
+	defer func() {
+		for _, j := range jobs {
+			j.close()
+		}
+	}()
+
+	if db == nil || workers <= 1 {
+		for _, j := range jobs {
+			if err := j.collect(ctx, tx); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		g, gCtx := errgroup.WithContext(ctx)
+		g.SetLimit(workers)
+		for _, j := range jobs {
+			j := j
+			g.Go(func() error {
+				return db.View(gCtx, func(roTx kv.Tx) error { return j.collect(gCtx, roTx) })
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+	}
+
 	aggStat := newAggregatorPruneStat()
-	for id, d := range ac.d {
-		var err error
-		aggStat.Domains[ac.d[id].d.filenameBase], err = d.Prune(ctx, tx, step, txFrom, txTo, limit, logEvery)
+	for id, j := range domainJobs {
+		err := j.apply(ctx, tx, logEvery)
+		aggStat.Domains[ac.d[id].d.filenameBase] = j.stat
 		if err != nil {
 			return aggStat, err
 		}
 	}
-	var stats [kv.StandaloneIdxLen]*InvertedIndexPruneStat
-	for i := 0; i < int(kv.StandaloneIdxLen); i++ {
-		stat, err := ac.iis[i].Prune(ctx, tx, txFrom, txTo, limit, logEvery, false, nil)
-		if err != nil {
+	for id, j := range iiJobs {
+		if err := j.apply(ctx, tx, logEvery); err != nil {
 			return nil, err
 		}
-		stats[i] = stat
+		aggStat.Indices[ac.iis[id].ii.filenameBase] = j.stat
 	}
 
-	for i := 0; i < int(kv.StandaloneIdxLen); i++ {
-		aggStat.Indices[ac.iis[i].ii.filenameBase] = stats[i]
-	}
-
-	for i := 0; i < int(kv.AppendableLen); i++ {
-		var err error
-		aggStat.Appendable[ac.appendable[i].ap.filenameBase], err = ac.appendable[i].Prune(ctx, tx, txFrom, txTo, limit, logEvery, false, nil)
+	for id, ap := range ac.appendable {
+		if ap == nil || ap.ap == nil {
+			continue
+		}
+		stat, err := ap.Prune(ctx, tx, txFrom, txTo, limit, logEvery, false, nil)
 		if err != nil {
 			return nil, err
 		}
+		aggStat.Appendable[kv.Appendable(id).String()] = stat
 	}
 
 	return aggStat, nil
 }
 
 func (ac *AggregatorRoTx) LogStats(tx kv.Tx, tx2block func(endTxNumMinimax uint64) (uint64, error)) {
-	maxTxNum := ac.minimaxTxNumInDomainFiles()
+	maxTxNum := ac.MinimaxTxNum(false) // state progress, commitment progress is logged separately
 	if maxTxNum == 0 {
 		return
 	}
@@ -1257,13 +2146,8 @@ func (ac *AggregatorRoTx) LogStats(tx kv.Tx, tx2block func(endTxNumMinimax uint6
 
 }
 
-func (ac *AggregatorRoTx) EndTxNumNoCommitment() uint64 {
-	return min(
-		ac.d[kv.AccountsDomain].files.EndTxNum(),
-		ac.d[kv.CodeDomain].files.EndTxNum(),
-		ac.d[kv.StorageDomain].files.EndTxNum(),
-	)
-}
+// Deprecated: use MinimaxTxNum(false)
+func (ac *AggregatorRoTx) EndTxNumNoCommitment() uint64 { return ac.MinimaxTxNum(false) }
 
 func (a *Aggregator) EndTxNumMinimax() uint64 { return a.visibleFilesMinimaxTxNum.Load() }
 func (a *Aggregator) FilesAmount() (res []int) {
@@ -1276,6 +2160,33 @@ func (a *Aggregator) FilesAmount() (res []int) {
 	return res
 }
 
+// OpenFilesCount - amount of files (data files and accessors) kept open by Aggregator. For whole process see dir.OpenFilesCount
+func (a *Aggregator) OpenFilesCount() (cnt int) {
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
+	count := func(items []*filesItem) bool {
+		for _, item := range items {
+			cnt += item.openFilesCount()
+		}
+		return true
+	}
+	for _, d := range a.d {
+		d.dirtyFiles.Walk(count)
+		d.History.dirtyFiles.Walk(count)
+		d.History.InvertedIndex.dirtyFiles.Walk(count)
+	}
+	for _, ii := range a.iis {
+		ii.dirtyFiles.Walk(count)
+	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.dirtyFiles.Walk(count)
+	}
+	return cnt
+}
+
 func firstTxNumOfStep(step, size uint64) uint64 {
 	return step * size
 }
@@ -1303,27 +2214,115 @@ func (a *Aggregator) EndTxNumDomainsFrozen() uint64 {
 func (a *Aggregator) recalcVisibleFiles() {
 	defer a.recalcVisibleFilesMinimaxTxNum()
 
-	a.visibleFilesLock.Lock()
-	defer a.visibleFilesLock.Unlock()
+	a.lockVisibleFiles()
+	defer a.unlockVisibleFiles()
 
+	before := a.visibleFilesLists()
 	for _, domain := range a.d {
 		domain.reCalcVisibleFiles()
 	}
 	for _, ii := range a.iis {
 		ii.reCalcVisibleFiles()
 	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		ap.reCalcVisibleFiles()
+	}
+	after := a.visibleFilesLists()
+	for i := range before {
+		if !sameVisibleFiles(before[i], after[i]) {
+			a.filesGeneration.Add(1)
+			break
+		}
+	}
+}
+
+// visibleFilesLists - of all domains/histories/indices/appendables. Must be called under visibleFilesLock
+func (a *Aggregator) visibleFilesLists() (res [][]ctxItem) {
+	for _, d := range a.d {
+		res = append(res, d._visibleFiles, d.History._visibleFiles, d.History.InvertedIndex._visibleFiles)
+	}
+	for _, ii := range a.iis {
+		res = append(res, ii._visibleFiles)
+	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		res = append(res, ap._visibleFiles)
+	}
+	return res
+}
+
+func sameVisibleFiles(a, b []ctxItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].src != b[i].src {
+			return false
+		}
+	}
+	return true
 }
 
+// FilesGeneration - monotonically increasing counter of visible files changes (build, merge, open, remove of files).
+// Equal generations imply identical visible file sets: can be used to detect staleness of anything built on top of files view.
+func (a *Aggregator) FilesGeneration() uint64 { return a.filesGeneration.Load() }
+
 func (a *Aggregator) recalcVisibleFilesMinimaxTxNum() {
 	aggTx := a.BeginFilesRo()
 	defer aggTx.Close()
-	a.visibleFilesMinimaxTxNum.Store(aggTx.minimaxTxNumInDomainFiles())
+	// gates building and merging of files - commitment files must catch up with state files
+	a.visibleFilesMinimaxTxNum.Store(aggTx.MinimaxTxNum(true))
+	a.notifyFilesChange()
+}
+
+// OnFilesChange - channel which will be closed when visible files change (and EndTxNumMinimax is updated).
+// Take new channel after each signal.
+func (a *Aggregator) OnFilesChange() <-chan struct{} {
+	a.filesChangeLock.Lock()
+	defer a.filesChangeLock.Unlock()
+	if a.filesChanged == nil {
+		a.filesChanged = make(chan struct{})
+	}
+	return a.filesChanged
+}
+
+func (a *Aggregator) notifyFilesChange() {
+	a.filesChangeLock.Lock()
+	defer a.filesChangeLock.Unlock()
+	if a.filesChanged != nil {
+		close(a.filesChanged)
+		a.filesChanged = nil
+	}
+}
+
+// WaitFilesVisible - blocks until files up to `minTxNum` are visible: BeginFilesRo called after return sees them.
+// For executors which observed new files (for example by HasNewFrozenFiles) and open new RoTx expecting them.
+// See ordering guarantees in integrateDirtyFiles
+func (a *Aggregator) WaitFilesVisible(ctx context.Context, minTxNum uint64) error {
+	for {
+		changed := a.OnFilesChange() // must be taken before check: to not miss signal
+		if a.EndTxNumMinimax() >= minTxNum {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.ctx.Done():
+			return common2.ErrStopped
+		}
+	}
 }
 
 type RangesV3 struct {
 	domain        [kv.DomainLen]DomainRanges
 	invertedIndex [kv.StandaloneIdxLen]*MergeRange
-	appendable    [kv.AppendableLen]*MergeRange
+	appendable    [kv.AppendableMax]*MergeRange
 }
 
 func (r RangesV3) String() string {
@@ -1363,20 +2362,61 @@ func (ac *AggregatorRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) RangesV3 {
 		r.domain[id] = d.findMergeRange(maxEndTxNum, maxSpan)
 	}
 	for id, ii := range ac.iis {
+		if f := ac.a.iiMergeSpanFactor; f > 0 {
+			r.invertedIndex[id] = ii.findMergeRange(ii.files.EndTxNum(), maxSpan*uint64(f))
+			continue
+		}
 		r.invertedIndex[id] = ii.findMergeRange(maxEndTxNum, maxSpan)
 	}
 	for id, ap := range ac.appendable {
+		if ap == nil {
+			continue
+		}
 		r.appendable[id] = ap.findMergeRange(maxEndTxNum, maxSpan)
 	}
+	ac.reconcileCommitmentMergeRange(&r)
 	//log.Info(fmt.Sprintf("findMergeRange(%d, %d)=%s\n", maxEndTxNum/ac.a.aggregationStep, maxSpan/ac.a.aggregationStep, r))
 	return r
 }
 
+// reconcileCommitmentMergeRange - with CommitmentValuesTransformAtMerge, commitment values reference merged accounts/storage
+// files of exactly same range. Ranges are found independently per domain (and may differ: for example after manual files removal),
+// so clamp commitment range to accounts/storage range, or skip commitment values merge in this round if it's impossible.
+func (ac *AggregatorRoTx) reconcileCommitmentMergeRange(r *RangesV3) {
+	if ac.a.commitmentValuesTransform != CommitmentValuesTransformAtMerge {
+		return
+	}
+	cr, ar, sr := &r.domain[kv.CommitmentDomain], r.domain[kv.AccountsDomain], r.domain[kv.StorageDomain]
+	if !cr.values {
+		return
+	}
+	sameAsAccounts := ar.values && ar.valuesStartTxNum == cr.valuesStartTxNum && ar.valuesEndTxNum == cr.valuesEndTxNum
+	sameAsStorage := sr.values && sr.valuesStartTxNum == cr.valuesStartTxNum && sr.valuesEndTxNum == cr.valuesEndTxNum
+	if sameAsAccounts && sameAsStorage {
+		return
+	}
+	from, to := cr.valuesStartTxNum, cr.valuesEndTxNum
+	if ar.values && sr.values && ar.valuesStartTxNum == sr.valuesStartTxNum && ar.valuesEndTxNum == sr.valuesEndTxNum &&
+		ac.d[kv.CommitmentDomain].canMergeRange(ar.valuesStartTxNum, ar.valuesEndTxNum) {
+		cr.valuesStartTxNum, cr.valuesEndTxNum = ar.valuesStartTxNum, ar.valuesEndTxNum
+		ac.a.logger.Warn("[snapshots] commitment merge range clamped to accounts/storage range",
+			"was", fmt.Sprintf("%d-%d", from/cr.aggStep, to/cr.aggStep), "now", fmt.Sprintf("%d-%d", cr.valuesStartTxNum/cr.aggStep, cr.valuesEndTxNum/cr.aggStep))
+		return
+	}
+	cr.values = false
+	ac.a.logger.Warn("[snapshots] commitment merge skipped: accounts/storage merge ranges don't match",
+		"commitment", fmt.Sprintf("%d-%d", from/cr.aggStep, to/cr.aggStep), "accounts", ar.String(), "storage", sr.String())
+}
+
 // SqueezeCommitmentFiles should be called only when NO EXECUTION is running.
 // Removes commitment files and suppose following aggregator shutdown and restart  (to integrate new files and rebuild indexes)
+// Not supported with CommitmentValuesTransformAtRead: it stores plain keys.
 func (ac *AggregatorRoTx) SqueezeCommitmentFiles() error {
-	if !ac.a.commitmentValuesTransform {
+	switch ac.a.commitmentValuesTransform {
+	case CommitmentValuesTransformOff:
 		return nil
+	case CommitmentValuesTransformAtRead:
+		return fmt.Errorf("SqueezeCommitmentFiles: not supported with commitment values transform mode %s", ac.a.commitmentValuesTransform)
 	}
 
 	commitment := ac.d[kv.CommitmentDomain]
@@ -1442,6 +2482,11 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles() error {
 				return err
 			}
 			defer squeezedCompr.Close()
+			squeezedCompr.SetDictionary(commitment.d.compressDict)
+			commitment.d.setKvFileFlags(squeezedCompr, true)
+			if !ac.a.fsyncPolicy.Intermediate() { // will be fsynced right before final rename
+				squeezedCompr.DisableFsync()
+			}
 
 			cf.decompressor.EnableReadAhead()
 			defer cf.decompressor.DisableReadAhead()
@@ -1503,7 +2548,7 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles() error {
 			ac.a.logger.Info("SqueezeCommitmentFiles: file done", "original", filepath.Base(originalPath),
 				"sizeDelta", fmt.Sprintf("%s (%.1f%%)", delta.HR(), deltaP))
 
-			fromStep, toStep := af.startTxNum/ac.a.StepSize(), af.endTxNum/ac.a.StepSize()
+			fromStep, toStep := cf.steps()
 
 			// need to remove all indexes for commitment file as well
 			obsoleteFiles = append(obsoleteFiles,
@@ -1531,11 +2576,19 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles() error {
 	ac.a.logger.Info("SqueezeCommitmentFiles: indices removed, renaming temporal files ")
 
 	for _, path := range temporalFiles {
+		if ac.a.fsyncPolicy.Final() && !ac.a.fsyncPolicy.Intermediate() {
+			if err := dir.FsyncFile(path); err != nil {
+				return err
+			}
+		}
 		if err := os.Rename(path, strings.TrimSuffix(path, sqExt)); err != nil {
 			return err
 		}
 		ac.a.logger.Debug("SqueezeCommitmentFiles: temporal file renaming", "path", path)
 	}
+	if err := ac.a.fsyncDirs(ac.a.dirs.SnapDomain); err != nil {
+		return err
+	}
 	ac.a.logger.Info("SqueezeCommitmentFiles: done", "sizeDelta", sizeDelta.HR(), "files", len(accountFiles))
 
 	return nil
@@ -1548,9 +2601,14 @@ func (ac *AggregatorRoTx) RestrictSubsetFileDeletions(b bool) {
 }
 
 func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFilesV3, r RangesV3) (MergedFilesV3, error) {
+	return ac.mergeFilesWithWorkers(ctx, files, r, ac.a.mergeWorkers)
+}
+
+// mergeFilesWithWorkers - workers=1: domains are merged one by one, accounts and storage before commitment
+func (ac *AggregatorRoTx) mergeFilesWithWorkers(ctx context.Context, files SelectedStaticFilesV3, r RangesV3, workers int) (MergedFilesV3, error) {
 	var mf MergedFilesV3
 	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(ac.a.mergeWorkers)
+	g.SetLimit(workers)
 	closeFiles := true
 	defer func() {
 		if closeFiles {
@@ -1559,6 +2617,7 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 	}()
 
 	ac.a.logger.Info(fmt.Sprintf("[snapshots] merge state %s", r.String()))
+	mergeStartedAt := time.Now()
 
 	accStorageMerged := new(sync.WaitGroup)
 
@@ -1569,22 +2628,27 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 
 		id := id
 		kid := kv.Domain(id)
-		if ac.a.commitmentValuesTransform && (kid == kv.AccountsDomain || kid == kv.StorageDomain) {
+		transformAtMerge := ac.a.commitmentValuesTransform == CommitmentValuesTransformAtMerge
+		if transformAtMerge && (kid == kv.AccountsDomain || kid == kv.StorageDomain) {
 			accStorageMerged.Add(1)
 		}
 
 		g.Go(func() (err error) {
 			var vt valueTransformer
-			if ac.a.commitmentValuesTransform && kid == kv.CommitmentDomain {
+			if transformAtMerge && kid == kv.CommitmentDomain {
 				ac.RestrictSubsetFileDeletions(true)
 				accStorageMerged.Wait()
 
 				vt = ac.d[kv.CommitmentDomain].commitmentValTransformDomain(ac.d[kv.AccountsDomain], ac.d[kv.StorageDomain],
 					mf.d[kv.AccountsDomain], mf.d[kv.StorageDomain])
 			}
+			if ac.a.commitmentValuesTransform == CommitmentValuesTransformAtRead && kid == kv.CommitmentDomain {
+				// merged file must not reference accounts/storage files which will be removed after merge
+				vt = ac.d[kv.CommitmentDomain].commitmentValExpandDomain(ac.d[kv.AccountsDomain], ac.d[kv.StorageDomain])
+			}
 
 			mf.d[id], mf.dIdx[id], mf.dHist[id], err = ac.d[id].mergeFiles(ctx, files.d[id], files.dIdx[id], files.dHist[id], r.domain[id], vt, ac.a.ps)
-			if ac.a.commitmentValuesTransform {
+			if transformAtMerge {
 				if kid == kv.AccountsDomain || kid == kv.StorageDomain {
 					accStorageMerged.Done()
 				}
@@ -1610,7 +2674,7 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 	}
 
 	for id, rng := range r.appendable {
-		if !rng.needMerge {
+		if rng == nil || !rng.needMerge {
 			continue
 		}
 		id := id
@@ -1625,19 +2689,28 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 	err := g.Wait()
 	if err == nil {
 		closeFiles = false
-		ac.a.logger.Info(fmt.Sprintf("[snapshots] state merge done %s", r.String()))
+		inSize, outSize := mergeSizes(files, mf)
+		took := time.Since(mergeStartedAt)
+		mxMergeThroughput.Observe(mbPerSec(outSize, took))
+		ac.a.logger.Info(fmt.Sprintf("[snapshots] state merge done %s", r.String()), "took", took,
+			"in", datasize.ByteSize(inSize).HR(), "out", datasize.ByteSize(outSize).HR(), "mbs", mbPerSec(outSize, took), "merge_workers", workers)
 	} else {
 		ac.a.logger.Warn(fmt.Sprintf("[snapshots] state merge failed err=%v %s", err, r.String()))
+		err = &ErrMergeFailed{Ranges: r.String(), Err: err}
 	}
 	return mf, err
 }
 
 func (a *Aggregator) integrateMergedDirtyFiles(outs SelectedStaticFilesV3, in MergedFilesV3) {
-	defer a.needSaveFilesListInDB.Store(true)
-	defer a.recalcVisibleFiles()
+	a.integrateMergedDirtyFilesLocked(outs, in)
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.needSaveFilesListInDB.Store(true)
+}
 
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+func (a *Aggregator) integrateMergedDirtyFilesLocked(outs SelectedStaticFilesV3, in MergedFilesV3) {
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
 
 	for id, d := range a.d {
 		d.integrateMergedDirtyFiles(outs.d[id], outs.dIdx[id], outs.dHist[id], in.d[id], in.dIdx[id], in.dHist[id])
@@ -1648,6 +2721,9 @@ func (a *Aggregator) integrateMergedDirtyFiles(outs SelectedStaticFilesV3, in Me
 	}
 
 	for id, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
 		ap.integrateMergedDirtyFiles(outs.appendable[id], in.appendable[id])
 	}
 }
@@ -1656,8 +2732,8 @@ func (a *Aggregator) cleanAfterMerge(in MergedFilesV3) {
 	at := a.BeginFilesRo()
 	defer at.Close()
 
-	a.dirtyFilesLock.Lock()
-	defer a.dirtyFilesLock.Unlock()
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
 
 	for id, d := range at.d {
 		d.cleanAfterMerge(in.d[id], in.dHist[id], in.dIdx[id])
@@ -1666,10 +2742,39 @@ func (a *Aggregator) cleanAfterMerge(in MergedFilesV3) {
 		ii.cleanAfterMerge(in.iis[id])
 	}
 	for id, ap := range at.appendable {
+		if ap == nil {
+			continue
+		}
 		ap.cleanAfterMerge(in.appendable[id])
 	}
 }
 
+// SetHistoryExpiry enables history expiry mode for given domain: history files (.v, .ef) older than `keepSteps` steps
+// (counting from the end of latest history file) are deleted after merges. Latest-state domain files are not affected.
+// Reads below expired horizon return ErrHistoryExpired. keepSteps=0 disables expiry.
+func (a *Aggregator) SetHistoryExpiry(domain kv.Domain, keepSteps uint64) *Aggregator {
+	a.d[domain].History.expiryKeepSteps = keepSteps
+	return a
+}
+
+// cleanExpiredHistory - deletes history files behind expiry horizon (see SetHistoryExpiry)
+func (a *Aggregator) cleanExpiredHistory() {
+	a.lockDirtyFiles()
+	var deleted bool
+	for _, d := range a.d {
+		if d != nil && d.History.deleteExpiredFiles() {
+			deleted = true
+		}
+	}
+	a.unlockDirtyFiles()
+	if !deleted {
+		return
+	}
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.needSaveFilesListInDB.Store(true)
+}
+
 // KeepRecentTxnsOfHistoriesWithDisabledSnapshots limits amount of recent transactions protected from prune in domains history.
 // Affects only domains with dontProduceHistoryFiles=true.
 // Usually equal to one a.aggregationStep, but could be set to step/2 or step/4 to reduce size of history tables.
@@ -1683,8 +2788,28 @@ func (a *Aggregator) KeepRecentTxnsOfHistoriesWithDisabledSnapshots(recentTxs ui
 	return a
 }
 
+// HistoryRetentionProvider - txNums >= minKeepTxNum must stay in db: re-org depth of node. For example: txNum of
+// head minus N blocks, or txNum of finalized block
+type HistoryRetentionProvider func(tx kv.Tx) (minKeepTxNum uint64, err error)
+
+// SetHistoryRetentionProvider - dynamic alternative of KeepRecentTxnsOfHistoriesWithDisabledSnapshots, consulted on
+// every prune. nil - static amount of recent txs is kept. Lower boundary than already pruned is no-op: prune never
+// restores data
+func (a *Aggregator) SetHistoryRetentionProvider(provider HistoryRetentionProvider) *Aggregator {
+	for _, d := range a.d {
+		if d != nil && d.History.snapshotsDisabled {
+			d.History.retentionProvider = provider
+		}
+	}
+	return a
+}
+
+// LastBuildStats - stats of last built step. nil if no steps were built since start
+func (a *Aggregator) LastBuildStats() *StepBuildStats { return a.lastBuildStats.Load() }
+
+// SetSnapshotBuildSema - slots of heavy files building shared with blocks retire, see snapbuild.Shared
 func (a *Aggregator) SetSnapshotBuildSema(semaphore *semaphore.Weighted) {
-	a.snapshotBuildSema = semaphore
+	a.snapshotBuildCoord = snapbuild.Shared(semaphore)
 }
 
 // SetProduceMod allows setting produce to false in order to stop making state files (default value is true)
@@ -1705,6 +2830,12 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 		close(fin)
 		return fin
 	}
+	// excluded file lowers visibleFilesMinimaxTxNum: build would re-create its step and overwrite file which is still open
+	if excluded := a.ExcludedFiles(); len(excluded) > 0 {
+		a.logger.Debug("[agg] build skipped: some files are excluded from visible files", "files", excluded)
+		close(fin)
+		return fin
+	}
 
 	if ok := a.buildingFiles.CompareAndSwap(false, true); !ok {
 		close(fin)
@@ -1717,15 +2848,6 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 		defer a.wg.Done()
 		defer a.buildingFiles.Store(false)
 
-		if a.snapshotBuildSema != nil {
-			//we are inside own goroutine - it's fine to block here
-			if err := a.snapshotBuildSema.Acquire(a.ctx, 1); err != nil {
-				a.logger.Warn("[snapshots] buildFilesInBackground", "err", err)
-				return //nolint
-			}
-			defer a.snapshotBuildSema.Release(1)
-		}
-
 		// check if db has enough data (maybe we didn't commit them yet or all keys are unique so history is empty)
 		lastInDB := lastIdInDB(a.db, a.d[kv.AccountsDomain])
 		hasData := lastInDB > step // `step` must be fully-written - means `step+1` records must be visible
@@ -1739,12 +2861,20 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 		// - to remove old data from db as early as possible
 		// - during files build, may happen commit of new data. on each loop step getting latest id in db
 		for ; step < lastIdInDB(a.db, a.d[kv.AccountsDomain]); step++ { //`step` must be fully-written - means `step+1` records must be visible
-			if err := a.buildFiles(a.ctx, step); err != nil {
+			// slot per step: blocks retire must not wait for whole catch-up. We are inside own goroutine - it's fine to block here
+			if err := a.snapshotBuildCoord.Acquire(a.ctx, snapbuild.StateBuild); err != nil {
+				a.logger.Warn("[snapshots] buildFilesInBackground", append(errLogArgs(err), "current", a.snapshotBuildCoord.Current())...)
+				close(fin)
+				return
+			}
+			err := a.buildFiles(a.ctx, step)
+			a.snapshotBuildCoord.Release(snapbuild.StateBuild)
+			if err != nil {
 				if errors.Is(err, context.Canceled) || errors.Is(err, common2.ErrStopped) {
 					close(fin)
 					return
 				}
-				a.logger.Warn("[snapshots] buildFilesInBackground", "err", err)
+				a.logger.Warn("[snapshots] buildFilesInBackground", errLogArgs(err)...)
 				break
 			}
 		}
@@ -1763,14 +2893,12 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 			defer a.wg.Done()
 			defer a.mergingFiles.Store(false)
 
-			//TODO: merge must have own semphore
-
 			defer func() { close(fin) }()
 			if err := a.MergeLoop(a.ctx); err != nil {
 				if errors.Is(err, context.Canceled) || errors.Is(err, common2.ErrStopped) {
 					return
 				}
-				a.logger.Warn("[snapshots] merge", "err", err)
+				a.logger.Warn("[snapshots] merge", errLogArgs(err)...)
 			}
 
 			a.BuildOptionalMissedIndicesInBackground(a.ctx, 1)
@@ -1779,7 +2907,27 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 	return fin
 }
 
+// IndexRange - timestamps of `k` in inverted index (or history) `name`. Same semantic for any index and for any split
+// of data between files and DB: fromTs inclusive, toTs exclusive in order of iteration, limit of merged stream.
+// See InvertedIndexRoTx.IdxRange
 func (ac *AggregatorRoTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (timestamps iter.U64, err error) {
+	return ac.IndexRangeCtx(context.Background(), name, k, fromTs, toTs, asc, limit, tx)
+}
+
+// IndexRangeCtx - IndexRange which stops on cancellation of `ctx`: iteration over many files doesn't check ctx of
+// `db.Begin(ctx)`. Returned iterator returns ctx.Err() from Next, see iter.WithCtx
+func (ac *AggregatorRoTx) IndexRangeCtx(ctx context.Context, name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (timestamps iter.U64, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	timestamps, err = ac.indexRange(name, k, fromTs, toTs, asc, limit, tx)
+	if err != nil || ctx.Done() == nil { // never canceled
+		return timestamps, err
+	}
+	return iter.WithCtx[uint64](ctx, timestamps), nil
+}
+
+func (ac *AggregatorRoTx) indexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (timestamps iter.U64, err error) {
 	switch name {
 	case kv.AccountsHistoryIdx:
 		return ac.d[kv.AccountsDomain].ht.IdxRange(k, fromTs, toTs, asc, limit, tx)
@@ -1788,7 +2936,7 @@ func (ac *AggregatorRoTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs
 	case kv.CodeHistoryIdx:
 		return ac.d[kv.CodeDomain].ht.IdxRange(k, fromTs, toTs, asc, limit, tx)
 	case kv.CommitmentHistoryIdx:
-		return ac.d[kv.StorageDomain].ht.IdxRange(k, fromTs, toTs, asc, limit, tx)
+		return ac.d[kv.CommitmentDomain].ht.IdxRange(k, fromTs, toTs, asc, limit, tx)
 	//case kv.GasUsedHistoryIdx:
 	//	return ac.d[kv.GasUsedDomain].ht.IdxRange(k, fromTs, toTs, asc, limit, tx)
 	case kv.LogTopicIdx:
@@ -1804,12 +2952,60 @@ func (ac *AggregatorRoTx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs
 	}
 }
 
+// IndexIntersect - timestamps present in both indices for given keys (for example: logs of given address with given topic).
+// Lazy: both streams are ascending and are merged in lockstep, stops after `limit` results. Limit -1 means Unlimited
+func (ac *AggregatorRoTx) IndexIntersect(a, b kv.InvertedIdx, aKey, bKey []byte, fromTs, toTs int, limit int, tx kv.Tx) (iter.U64, error) {
+	return ac.IndexIntersectMany([]kv.InvertedIdx{a, b}, [][]byte{aKey, bKey}, fromTs, toTs, limit, tx)
+}
+
+// IndexIntersectMany - N-way IndexIntersect: `names[i]` is index of `keys[i]`
+func (ac *AggregatorRoTx) IndexIntersectMany(names []kv.InvertedIdx, keys [][]byte, fromTs, toTs int, limit int, tx kv.Tx) (iter.U64, error) {
+	return ac.IndexIntersectManyCtx(context.Background(), names, keys, fromTs, toTs, limit, tx)
+}
+
+// IndexIntersectManyCtx - IndexIntersectMany which stops on cancellation of `ctx`, see IndexRangeCtx
+func (ac *AggregatorRoTx) IndexIntersectManyCtx(ctx context.Context, names []kv.InvertedIdx, keys [][]byte, fromTs, toTs int, limit int, tx kv.Tx) (iter.U64, error) {
+	if len(names) == 0 || len(names) != len(keys) {
+		return nil, fmt.Errorf("IndexIntersectMany: %d indices for %d keys", len(names), len(keys))
+	}
+	if len(names) == 1 {
+		return ac.IndexRangeCtx(ctx, names[0], keys[0], fromTs, toTs, order.Asc, limit, tx)
+	}
+	its := make([]iter.U64, 0, len(names))
+	for i, name := range names {
+		it, err := ac.IndexRangeCtx(ctx, name, keys[i], fromTs, toTs, order.Asc, -1, tx)
+		if err != nil {
+			for _, it := range its {
+				if closer, ok := it.(kv.Closer); ok {
+					closer.Close()
+				}
+			}
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	res := its[0]
+	for i := 1; i < len(its); i++ {
+		l := -1
+		if i == len(its)-1 {
+			l = limit
+		}
+		res = iter.Intersect[uint64](res, its[i], l)
+	}
+	return res, nil
+}
+
 // -- range end
 
 func (ac *AggregatorRoTx) HistorySeek(name kv.History, key []byte, ts uint64, tx kv.Tx) (v []byte, ok bool, err error) {
+	return ac.HistorySeekCtx(context.Background(), name, key, ts, tx)
+}
+
+// HistorySeekCtx - HistorySeek which checks `ctx` between file probes and returns ctx.Err() on cancellation
+func (ac *AggregatorRoTx) HistorySeekCtx(ctx context.Context, name kv.History, key []byte, ts uint64, tx kv.Tx) (v []byte, ok bool, err error) {
 	switch name {
 	case kv.AccountsHistory:
-		v, ok, err = ac.d[kv.AccountsDomain].ht.HistorySeek(key, ts, tx)
+		v, ok, err = ac.d[kv.AccountsDomain].ht.HistorySeekCtx(ctx, key, ts, tx)
 		if err != nil {
 			return nil, false, err
 		}
@@ -1818,11 +3014,11 @@ func (ac *AggregatorRoTx) HistorySeek(name kv.History, key []byte, ts uint64, tx
 		}
 		return v, true, nil
 	case kv.StorageHistory:
-		return ac.d[kv.StorageDomain].ht.HistorySeek(key, ts, tx)
+		return ac.d[kv.StorageDomain].ht.HistorySeekCtx(ctx, key, ts, tx)
 	case kv.CodeHistory:
-		return ac.d[kv.CodeDomain].ht.HistorySeek(key, ts, tx)
+		return ac.d[kv.CodeDomain].ht.HistorySeekCtx(ctx, key, ts, tx)
 	case kv.CommitmentHistory:
-		return ac.d[kv.CommitmentDomain].ht.HistorySeek(key, ts, tx)
+		return ac.d[kv.CommitmentDomain].ht.HistorySeekCtx(ctx, key, ts, tx)
 	//case kv.GasUsedHistory:
 	//	return ac.d[kv.GasUsedDomain].ht.HistorySeek(key, ts, tx)
 	default:
@@ -1830,7 +3026,48 @@ func (ac *AggregatorRoTx) HistorySeek(name kv.History, key []byte, ts uint64, tx
 	}
 }
 
+// HistorySeekMany - batch version of HistorySeek. Answers are aligned with `queries`. See HistoryRoTx.HistorySeekMany
+func (ac *AggregatorRoTx) HistorySeekMany(name kv.History, queries []HistoryQuery, tx kv.Tx) ([]HistoryAnswer, error) {
+	switch name {
+	case kv.AccountsHistory:
+		return ac.d[kv.AccountsDomain].ht.HistorySeekMany(queries, tx)
+	case kv.StorageHistory:
+		return ac.d[kv.StorageDomain].ht.HistorySeekMany(queries, tx)
+	case kv.CodeHistory:
+		return ac.d[kv.CodeDomain].ht.HistorySeekMany(queries, tx)
+	case kv.CommitmentHistory:
+		return ac.d[kv.CommitmentDomain].ht.HistorySeekMany(queries, tx)
+	default:
+		panic(fmt.Sprintf("unexpected: %s", name))
+	}
+}
+
+// PrunedUpTo - history of txNum < prunedUpTo is deleted from DB by Prune (it may still be available in files).
+// HistorySeek below it and below files returns ErrPrunedHistory. 0 - nothing pruned yet
+func (ac *AggregatorRoTx) PrunedUpTo(name kv.History, tx kv.Tx) (uint64, error) {
+	switch name {
+	case kv.AccountsHistory:
+		return readPrunedUpTo(tx, ac.d[kv.AccountsDomain].ht.h.InvertedIndex.filenameBase)
+	case kv.StorageHistory:
+		return readPrunedUpTo(tx, ac.d[kv.StorageDomain].ht.h.InvertedIndex.filenameBase)
+	case kv.CodeHistory:
+		return readPrunedUpTo(tx, ac.d[kv.CodeDomain].ht.h.InvertedIndex.filenameBase)
+	case kv.CommitmentHistory:
+		return readPrunedUpTo(tx, ac.d[kv.CommitmentDomain].ht.h.InvertedIndex.filenameBase)
+	default:
+		return 0, fmt.Errorf("unexpected history name: %s", name)
+	}
+}
+
 func (ac *AggregatorRoTx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (it iter.KV, err error) {
+	return ac.HistoryRangeCtx(context.Background(), name, fromTs, toTs, asc, limit, tx)
+}
+
+// HistoryRangeCtx - HistoryRange which stops on cancellation of `ctx`, see IndexRangeCtx
+func (ac *AggregatorRoTx) HistoryRangeCtx(ctx context.Context, name kv.History, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (it iter.KV, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	//TODO: aggTx to store array of histories
 	var domainName kv.Domain
 
@@ -1849,7 +3086,10 @@ func (ac *AggregatorRoTx) HistoryRange(name kv.History, fromTs, toTs int, asc or
 	if err != nil {
 		return nil, err
 	}
-	return iter.WrapKV(hr), nil
+	if ctx.Done() == nil { // never canceled
+		return iter.WrapKV(hr), nil
+	}
+	return iter.WithCtxDuo[[]byte, []byte](ctx, iter.WrapKV(hr)), nil
 }
 
 type FilesStats22 struct{}
@@ -1869,10 +3109,12 @@ type AggregatorRoTx struct {
 	a          *Aggregator
 	d          [kv.DomainLen]*DomainRoTx
 	iis        [kv.StandaloneIdxLen]*InvertedIndexRoTx
-	appendable [kv.AppendableLen]*AppendableRoTx
+	appendable [kv.AppendableMax]*AppendableRoTx
 
-	id      uint64 // auto-increment id of ctx for logs
-	_leakID uint64 // set only if TRACE_AGG=true
+	id         uint64 // auto-increment id of ctx for logs
+	_leakID    uint64 // set only if TRACE_AGG=true
+	generation uint64 // Aggregator.FilesGeneration at BeginFilesRo
+	openedAt   time.Time
 }
 
 func (a *Aggregator) BeginFilesRo() *AggregatorRoTx {
@@ -1882,7 +3124,8 @@ func (a *Aggregator) BeginFilesRo() *AggregatorRoTx {
 		_leakID: a.leakDetector.Add(),
 	}
 
-	a.visibleFilesLock.RLock()
+	a.rlockVisibleFiles()
+	ac.generation = a.filesGeneration.Load()
 	for id, ii := range a.iis {
 		ac.iis[id] = ii.BeginFilesRo()
 	}
@@ -1890,14 +3133,60 @@ func (a *Aggregator) BeginFilesRo() *AggregatorRoTx {
 		ac.d[id] = d.BeginFilesRo()
 	}
 	for id, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
 		ac.appendable[id] = ap.BeginFilesRo()
 	}
-	a.visibleFilesLock.RUnlock()
+	a.runlockVisibleFiles()
+	a.views.add(ac)
 
 	return ac
 }
+
+// Generation - Aggregator.FilesGeneration captured at BeginFilesRo. Equal generations imply identical visible file sets.
+func (ac *AggregatorRoTx) Generation() uint64 { return ac.generation }
+
+// Clone - cheap copy of `ac` for another goroutine (AggregatorRoTx is not thread-safe): sees same files as `ac`,
+// doesn't take visibleFilesLock - only increments files refcount. `ac` must be not closed yet.
+// Clone has own ViewID and must be closed independently from `ac`.
+func (ac *AggregatorRoTx) Clone() *AggregatorRoTx {
+	c := &AggregatorRoTx{
+		a:          ac.a,
+		id:         ac.a.ctxAutoIncrement.Add(1),
+		_leakID:    ac.a.leakDetector.Add(),
+		generation: ac.generation,
+	}
+	for id, ii := range ac.iis {
+		c.iis[id] = ii.clone()
+	}
+	for id, d := range ac.d {
+		c.d[id] = d.clone()
+	}
+	for id, ap := range ac.appendable {
+		if ap == nil {
+			continue
+		}
+		c.appendable[id] = ap.clone()
+	}
+	ac.a.views.add(c)
+	return c
+}
+
 func (ac *AggregatorRoTx) ViewID() uint64 { return ac.id }
 
+// ExistenceFilterStats - usage of existence filters of visible domain files. Counters are accumulated since files open.
+func (ac *AggregatorRoTx) ExistenceFilterStats() (res []ExistenceFilterStats) {
+	for _, d := range ac.d {
+		for _, f := range d.files {
+			if f.src.existence != nil {
+				res = append(res, f.src.existence.Stats())
+			}
+		}
+	}
+	return res
+}
+
 // --- Domain part START ---
 
 func (ac *AggregatorRoTx) DomainRange(tx kv.Tx, domain kv.Domain, fromKey, toKey []byte, ts uint64, asc order.By, limit int) (it iter.KV, err error) {
@@ -1908,13 +3197,62 @@ func (ac *AggregatorRoTx) DomainRangeLatest(tx kv.Tx, domain kv.Domain, from, to
 }
 
 func (ac *AggregatorRoTx) DomainGetAsOf(tx kv.Tx, name kv.Domain, key []byte, ts uint64) (v []byte, ok bool, err error) {
-	v, err = ac.d[name].GetAsOf(key, ts, tx)
+	return ac.DomainGetAsOfCtx(context.Background(), tx, name, key, ts)
+}
+
+// DomainGetAsOfCtx - DomainGetAsOf which checks `ctx` between file probes and returns ctx.Err() on cancellation
+func (ac *AggregatorRoTx) DomainGetAsOfCtx(ctx context.Context, tx kv.Tx, name kv.Domain, key []byte, ts uint64) (v []byte, ok bool, err error) {
+	v, err = ac.d[name].GetAsOfCtx(ctx, key, ts, tx)
 	return v, v != nil, err
 }
+
+// DomainGetAsOfMany - batch version of DomainGetAsOf for many keys at one txNum. Results are aligned with `keys`.
+func (ac *AggregatorRoTx) DomainGetAsOfMany(tx kv.Tx, name kv.Domain, keys [][]byte, ts uint64) (vals [][]byte, oks []bool, err error) {
+	return ac.d[name].GetAsOfMany(keys, ts, tx)
+}
+
+// SetReadSource - debug switch to isolate discrepancy between files and DB: GetLatest/GetAsOf/HistorySeek of `domain`
+// read only files or only DB. Affects only this RoTx (and its clones).
+func (ac *AggregatorRoTx) SetReadSource(domain kv.Domain, src ReadSource) {
+	if src != ReadSourceAuto && ac.a.readSourceWarned.CompareAndSwap(false, true) {
+		ac.a.logger.Warn("[dbg] domain reads are restricted by SetReadSource: results may be incomplete. For debugging only!", "domain", domain, "src", src)
+	}
+	ac.d[domain].readSource = src
+	ac.d[domain].ht.readSource = src
+}
+
 func (ac *AggregatorRoTx) GetLatest(domain kv.Domain, k, k2 []byte, tx kv.Tx) (v []byte, step uint64, ok bool, err error) {
 	return ac.d[domain].GetLatest(k, k2, tx)
 }
 
+// GetLatestInto - see DomainRoTx.GetLatestInto
+func (ac *AggregatorRoTx) GetLatestInto(domain kv.Domain, k, k2, buf []byte, tx kv.Tx) (v []byte, step uint64, ok bool, err error) {
+	return ac.d[domain].GetLatestInto(k, k2, buf, tx)
+}
+
+// GetLatestIntoUnsafe - see DomainRoTx.GetLatestIntoUnsafe. Value is valid until AggregatorRoTx.Close.
+func (ac *AggregatorRoTx) GetLatestIntoUnsafe(domain kv.Domain, k, k2, buf []byte, tx kv.Tx) (v []byte, step uint64, ok bool, err error) {
+	return ac.d[domain].GetLatestIntoUnsafe(k, k2, buf, tx)
+}
+
+// SampleDomainKeys - reservoir-sampling of `n` keys from domain's visible files. Reads all files - slow.
+func (ac *AggregatorRoTx) SampleDomainKeys(ctx context.Context, domain kv.Domain, n int, rnd *rand.Rand) ([][]byte, error) {
+	return ac.d[domain].sampleKeys(ctx, n, rnd)
+}
+
+// EnableDomainReadAhead - enables OS readahead for domain's visible files. Returned func restores default mode.
+func (ac *AggregatorRoTx) EnableDomainReadAhead(domain kv.Domain) (disable func()) {
+	files := ac.d[domain].files
+	for _, item := range files {
+		item.src.decompressor.EnableReadAhead()
+	}
+	return func() {
+		for _, item := range files {
+			item.src.decompressor.DisableReadAhead()
+		}
+	}
+}
+
 // search key in all files of all domains and print file names
 func (ac *AggregatorRoTx) DebugKey(domain kv.Domain, k []byte) error {
 	l, err := ac.d[domain].DebugKVFilesWithKey(k)
@@ -1985,12 +3323,36 @@ func (ac *AggregatorRoTx) DebugEFAllValuesAreInRange(ctx context.Context, name k
 
 // --- Domain part END ---
 
+func (ac *AggregatorRoTx) appendableRoTx(name kv.Appendable) (*AppendableRoTx, error) {
+	if name >= kv.AppendableMax || ac.appendable[name] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrAppendableNotRegistered, name)
+	}
+	return ac.appendable[name], nil
+}
+
 func (ac *AggregatorRoTx) AppendableGet(name kv.Appendable, ts kv.TxnId, tx kv.Tx) (v []byte, ok bool, err error) {
-	return ac.appendable[name].Get(ts, tx)
+	ap, err := ac.appendableRoTx(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return ap.Get(ts, tx)
 }
 
 func (ac *AggregatorRoTx) AppendablePut(name kv.Appendable, txnID kv.TxnId, v []byte, tx kv.RwTx) (err error) {
-	return ac.appendable[name].Append(txnID, v, tx)
+	ap, err := ac.appendableRoTx(name)
+	if err != nil {
+		return err
+	}
+	return ap.Append(txnID, v, tx)
+}
+
+// AppendableBulkAppend - see AppendableRoTx.BulkAppend. Existing values are not replaced
+func (ac *AggregatorRoTx) AppendableBulkAppend(name kv.Appendable, firstTxnID kv.TxnId, values [][]byte, tx kv.RwTx) (fastPath int, err error) {
+	ap, err := ac.appendableRoTx(name)
+	if err != nil {
+		return 0, err
+	}
+	return ap.BulkAppend(firstTxnID, values, false, tx)
 }
 
 func (ac *AggregatorRoTx) Close() {
@@ -1998,6 +3360,7 @@ func (ac *AggregatorRoTx) Close() {
 		return
 	}
 	ac.a.leakDetector.Del(ac._leakID)
+	ac.a.views.del(ac)
 	ac.a = nil
 
 	for _, d := range ac.d {
@@ -2009,6 +3372,9 @@ func (ac *AggregatorRoTx) Close() {
 		ii.Close()
 	}
 	for _, ap := range ac.appendable {
+		if ap == nil {
+			continue
+		}
 		ap.Close()
 	}
 }
@@ -2047,6 +3413,8 @@ type AggregatorStep struct {
 	storage    *HistoryStep
 	code       *HistoryStep
 	commitment *HistoryStep
+	iis        [kv.StandaloneIdxLen]*InvertedIndexStep // nil: index has no file for this step
+	ap         [kv.AppendableMax]*AppendableStep       // nil: appendable is not registered or has no file for this step
 	keyBuf     []byte
 }
 
@@ -2060,6 +3428,27 @@ func (a *Aggregator) MakeSteps() ([]*AggregatorStep, error) {
 	if len(accountSteps) != len(storageSteps) || len(storageSteps) != len(codeSteps) {
 		return nil, fmt.Errorf("different limit of steps (try merge snapshots): accountSteps=%d, storageSteps=%d, codeSteps=%d", len(accountSteps), len(storageSteps), len(codeSteps))
 	}
+
+	// indices and appendables often have more (or less) steps than domains: match them by txNum range
+	type stepRange struct{ from, to uint64 }
+	var iiSteps [kv.StandaloneIdxLen]map[stepRange]*InvertedIndexStep
+	for i, ii := range a.iis {
+		iiSteps[i] = map[stepRange]*InvertedIndexStep{}
+		for _, st := range ii.MakeSteps(frozenAndIndexed) {
+			iiSteps[i][stepRange{st.indexFile.startTxNum, st.indexFile.endTxNum}] = st
+		}
+	}
+	var apSteps [kv.AppendableMax]map[stepRange]*AppendableStep
+	for i, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		apSteps[i] = map[stepRange]*AppendableStep{}
+		for _, st := range ap.MakeSteps(frozenAndIndexed) {
+			apSteps[i][stepRange{st.item.startTxNum, st.item.endTxNum}] = st
+		}
+	}
+
 	steps := make([]*AggregatorStep, len(accountSteps))
 	for i, accountStep := range accountSteps {
 		steps[i] = &AggregatorStep{
@@ -2069,6 +3458,13 @@ func (a *Aggregator) MakeSteps() ([]*AggregatorStep, error) {
 			code:       codeSteps[i],
 			commitment: commitmentSteps[i],
 		}
+		r := stepRange{accountStep.indexFile.startTxNum, accountStep.indexFile.endTxNum}
+		for j := range iiSteps {
+			steps[i].iis[j] = iiSteps[j][r]
+		}
+		for j := range apSteps {
+			steps[i].ap[j] = apSteps[j][r]
+		}
 	}
 	return steps, nil
 }
@@ -2144,11 +3540,46 @@ func (as *AggregatorStep) IterateCodeHistory(txNum uint64) *HistoryIteratorInc {
 	return as.code.interateHistoryBeforeTxNum(txNum)
 }
 
+// IterateLogAddrTxs - nil if log addresses index has no file for this step
+func (as *AggregatorStep) IterateLogAddrTxs() *ScanIteratorInc {
+	return as.IterateIdxTxs(kv.LogAddrIdxPos)
+}
+
+// IterateIdxTxs - nil if standalone inverted index has no file for this step
+func (as *AggregatorStep) IterateIdxTxs(idx kv.InvertedIdxPos) *ScanIteratorInc {
+	if as.iis[idx] == nil {
+		return nil
+	}
+	return as.iis[idx].iterateTxs()
+}
+
+// AppendableValues - values of appendable in order of canonical txnIds. nil if appendable has no file for this step
+func (as *AggregatorStep) AppendableValues(name kv.Appendable) *AppendableValuesIterator {
+	if name >= kv.AppendableMax || as.ap[name] == nil {
+		return nil
+	}
+	return as.ap[name].iterateValues()
+}
+
 func (as *AggregatorStep) Clone() *AggregatorStep {
-	return &AggregatorStep{
+	cl := &AggregatorStep{
 		a:        as.a,
 		accounts: as.accounts.Clone(),
 		storage:  as.storage.Clone(),
 		code:     as.code.Clone(),
 	}
+	if as.commitment != nil {
+		cl.commitment = as.commitment.Clone()
+	}
+	for i, st := range as.iis {
+		if st != nil {
+			cl.iis[i] = st.Clone()
+		}
+	}
+	for i, st := range as.ap {
+		if st != nil {
+			cl.ap[i] = st.Clone()
+		}
+	}
+	return cl
 }
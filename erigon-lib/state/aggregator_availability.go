@@ -0,0 +1,302 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// BlockRange - [From, To] blocks, both inclusive
+type BlockRange struct {
+	From, To uint64
+}
+
+// CapabilityRange - blocks which capability can serve: [From, To] except Gaps. Available=false - nothing can be served
+type CapabilityRange struct {
+	BlockRange
+	Available bool
+	Gaps      []BlockRange
+}
+
+// Availability - what node can serve, for RPC capability advertisement. See AggregatorRoTx.AvailabilityReport
+type Availability struct {
+	HeadBlock       uint64
+	LatestState     CapabilityRange // always head
+	HistoricalState CapabilityRange // accounts, storage, code as of block
+	LogIndex        CapabilityRange // eth_getLogs: LogAddr and LogTopic indices
+	TraceIndex      CapabilityRange // trace_filter: TracesFrom and TracesTo indices
+}
+
+// txRange - [from, to) txNums
+type txRange struct{ from, to uint64 }
+
+// TxNumRange - [From, To) txNums
+type TxNumRange struct{ From, To uint64 }
+
+// Coverage - how window [From, To) of HistoryRange is backed by data sources. Covered - sub-ranges in visible files or DB,
+// Missing - rest of window: pruned from DB but not in files (prune ahead of lagging files build, deleted files). Both are
+// sorted and not adjacent
+type Coverage struct {
+	From, To uint64
+	Covered  []TxNumRange
+	Missing  []TxNumRange
+}
+
+// Complete - whole window is backed by data: no changes in result means no changes in window
+func (c Coverage) Complete() bool { return len(c.Missing) == 0 }
+
+// HistoryRangeWithCoverage - HistoryRange and Coverage of its window [fromTs, toTs). Result has
+// changes of covered sub-ranges only: changes of Missing ones are absent. HistoryRange alone can't distinguish
+// "no changes in window" from "data is missing" - RPC can annotate or reject result by Coverage
+func (ac *AggregatorRoTx) HistoryRangeWithCoverage(name kv.History, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (iter.KV, Coverage, error) {
+	cov, err := ac.HistoryCoverage(name, fromTs, toTs, tx)
+	if err != nil {
+		return nil, cov, err
+	}
+	it, err := ac.HistoryRange(name, fromTs, toTs, asc, limit, tx)
+	if err != nil {
+		return nil, cov, err
+	}
+	return it, cov, nil
+}
+
+// HistoryCoverage - see HistoryRangeWithCoverage, -1 means unbounded. Same sources as AvailabilityReport: visible files,
+// steps without changes and DB above PrunedUpTo
+func (ac *AggregatorRoTx) HistoryCoverage(name kv.History, fromTs, toTs int, tx kv.Tx) (res Coverage, err error) {
+	var d *DomainRoTx
+	switch name {
+	case kv.AccountsHistory:
+		d = ac.d[kv.AccountsDomain]
+	case kv.StorageHistory:
+		d = ac.d[kv.StorageDomain]
+	case kv.CodeHistory:
+		d = ac.d[kv.CodeDomain]
+	default:
+		return res, fmt.Errorf("unexpected history name: %s", name)
+	}
+	res.From, res.To = 0, math.MaxUint64
+	if fromTs >= 0 {
+		res.From = uint64(fromTs)
+	}
+	if toTs >= 0 {
+		res.To = uint64(toTs)
+	}
+	if res.From >= res.To {
+		return res, nil
+	}
+
+	prunedUpTo, err := readPrunedUpTo(tx, d.ht.h.InvertedIndex.filenameBase)
+	if err != nil {
+		return res, err
+	}
+	cov := withEmptySteps(coverageOf(d.ht.files, prunedUpTo, res.To), d.emptySteps, ac.a.StepSize(), res.To)
+	from := res.From
+	for _, r := range intersectCoverage(cov, []txRange{{res.From, res.To}}) {
+		if from < r.from {
+			res.Missing = append(res.Missing, TxNumRange{from, r.from})
+		}
+		res.Covered = append(res.Covered, TxNumRange{r.from, r.to})
+		from = r.to
+	}
+	if from < res.To {
+		res.Missing = append(res.Missing, TxNumRange{from, res.To})
+	}
+	return res, nil
+}
+
+// AvailabilityReport - block ranges of each capability. Coverage of inverted index (or history) is union of visible
+// files and DB. DB has all txNums >= prunedUpTo (see PrunedUpTo): not pruned DB has everything, even if first key of
+// table is > 0 - index may have no events in first txNums. Capability served by several indices - intersection of them.
+// Gaps appear if files of pruned range are missing (deleted by user, not downloaded yet).
+func (ac *AggregatorRoTx) AvailabilityReport(tx kv.Tx, tx2block func(txNum uint64) (uint64, error)) (Availability, error) {
+	var res Availability
+	headTxNum := ac.availabilityHeadTxNum(tx)
+	var err error
+	if res.HeadBlock, err = tx2block(headTxNum); err != nil {
+		return res, err
+	}
+	res.LatestState = CapabilityRange{BlockRange: BlockRange{From: res.HeadBlock, To: res.HeadBlock}, Available: true}
+
+	coverage := func(files visibleFiles, ii *InvertedIndex) ([]txRange, error) {
+		prunedUpTo, err := readPrunedUpTo(tx, ii.filenameBase)
+		if err != nil {
+			return nil, err
+		}
+		return coverageOf(files, prunedUpTo, headTxNum+1), nil
+	}
+
+	var historical []txRange
+	for i, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain} {
+		ht := ac.d[d].ht
+		cov, err := coverage(ht.files, ht.h.InvertedIndex)
+		if err != nil {
+			return res, err
+		}
+		cov = withEmptySteps(cov, ac.d[d].emptySteps, ac.a.StepSize(), headTxNum+1)
+		if i == 0 {
+			historical = cov
+			continue
+		}
+		historical = intersectCoverage(historical, cov)
+	}
+	if res.HistoricalState, err = capabilityRange(historical, headTxNum+1, tx2block); err != nil {
+		return res, err
+	}
+
+	for _, c := range []struct {
+		res  *CapabilityRange
+		a, b kv.InvertedIdxPos
+	}{
+		{&res.LogIndex, kv.LogAddrIdxPos, kv.LogTopicIdxPos},
+		{&res.TraceIndex, kv.TracesFromIdxPos, kv.TracesToIdxPos},
+	} {
+		a, err := coverage(ac.iis[c.a].files, ac.iis[c.a].ii)
+		if err != nil {
+			return res, err
+		}
+		b, err := coverage(ac.iis[c.b].files, ac.iis[c.b].ii)
+		if err != nil {
+			return res, err
+		}
+		if *c.res, err = capabilityRange(intersectCoverage(a, b), headTxNum+1, tx2block); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// availabilityHeadTxNum - last txNum of visible files or DB, what is bigger
+func (ac *AggregatorRoTx) availabilityHeadTxNum(tx kv.Tx) (head uint64) {
+	if files := ac.d[kv.AccountsDomain].ht.files; len(files) > 0 {
+		head = files[len(files)-1].endTxNum - 1
+	}
+	for _, d := range ac.d {
+		if lst, _ := kv.LastKey(tx, d.d.History.InvertedIndex.indexKeysTable); len(lst) >= 8 {
+			head = max(head, binary.BigEndian.Uint64(lst))
+		}
+	}
+	return head
+}
+
+// coverageOf - sorted, not adjacent ranges of txNums < `end` covered by `files` or DB (txNums >= prunedUpTo)
+func coverageOf(files visibleFiles, prunedUpTo, end uint64) (res []txRange) {
+	add := func(r txRange) {
+		r.to = min(r.to, end)
+		if r.from >= r.to {
+			return
+		}
+		if len(res) > 0 && r.from <= res[len(res)-1].to {
+			res[len(res)-1].to = max(res[len(res)-1].to, r.to)
+			return
+		}
+		res = append(res, r)
+	}
+	dbAdded := false
+	for _, f := range files {
+		if !dbAdded && prunedUpTo < f.startTxNum {
+			add(txRange{prunedUpTo, end})
+			dbAdded = true
+		}
+		add(txRange{f.startTxNum, f.endTxNum})
+	}
+	if !dbAdded {
+		add(txRange{prunedUpTo, end})
+	}
+	return res
+}
+
+// withEmptySteps - `cov` and steps without changes of domain (see emptySteps): they have no history files, but are covered
+func withEmptySteps(cov []txRange, steps []uint64, aggregationStep, end uint64) (res []txRange) {
+	if len(steps) == 0 {
+		return cov
+	}
+	all := append([]txRange{}, cov...)
+	for _, step := range steps {
+		all = append(all, txRange{step * aggregationStep, min((step+1)*aggregationStep, end)})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].from < all[j].from })
+	for _, r := range all {
+		if r.from >= r.to {
+			continue
+		}
+		if len(res) > 0 && r.from <= res[len(res)-1].to {
+			res[len(res)-1].to = max(res[len(res)-1].to, r.to)
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// intersectCoverage - txNums covered by both `a` and `b`
+func intersectCoverage(a, b []txRange) (res []txRange) {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		from, to := max(a[i].from, b[j].from), min(a[i].to, b[j].to)
+		if from < to {
+			res = append(res, txRange{from, to})
+		}
+		if a[i].to < b[j].to {
+			i++
+		} else {
+			j++
+		}
+	}
+	return res
+}
+
+// capabilityRange - blocks of covered txNums. Block with any not covered txNum is reported as gap, and partially covered
+// first and last blocks are not reported at all. Coverage up to `end` (head) is not trimmed: txNums of head block after
+// head are not executed yet
+func capabilityRange(cov []txRange, end uint64, tx2block func(txNum uint64) (uint64, error)) (res CapabilityRange, err error) {
+	if len(cov) == 0 {
+		return res, nil
+	}
+	first, last := cov[0].from, cov[len(cov)-1].to
+	if res.From, err = tx2block(first); err != nil {
+		return res, err
+	}
+	if first > 0 {
+		prevBlock, err := tx2block(first - 1)
+		if err != nil {
+			return res, err
+		}
+		if prevBlock == res.From {
+			res.From++
+		}
+	}
+	if res.To, err = tx2block(last - 1); err != nil {
+		return res, err
+	}
+	if last < end {
+		nextBlock, err := tx2block(last)
+		if err != nil {
+			return res, err
+		}
+		if nextBlock == res.To {
+			if res.To == 0 {
+				return CapabilityRange{}, nil
+			}
+			res.To--
+		}
+	}
+	if res.From > res.To {
+		return CapabilityRange{}, nil
+	}
+	res.Available = true
+	for i := 1; i < len(cov); i++ {
+		var gap BlockRange
+		if gap.From, err = tx2block(cov[i-1].to); err != nil {
+			return res, err
+		}
+		if gap.To, err = tx2block(cov[i].from - 1); err != nil {
+			return res, err
+		}
+		res.Gaps = append(res.Gaps, gap)
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package state
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+func TestAggregatorV3_AvailabilityReport(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 5) // txNums 1-80, files of steps 0-4
+
+	tx2block := func(txNum uint64) (uint64, error) { return txNum / 4, nil }
+	report := func() (res Availability) {
+		t.Helper()
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) (err error) {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			res, err = ac.AvailabilityReport(tx, tx2block)
+			return err
+		}))
+		return res
+	}
+	full := CapabilityRange{BlockRange: BlockRange{From: 0, To: 20}, Available: true}
+
+	res := report()
+	require.Equal(t, uint64(20), res.HeadBlock)
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 20, To: 20}, Available: true}, res.LatestState)
+	require.Equal(t, full, res.HistoricalState)
+	require.Equal(t, full, res.LogIndex)
+	require.Equal(t, full, res.TraceIndex)
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+	require.Equal(t, res, report(), "files cover pruned range")
+
+	// history of step 1 of accounts is not in files and not in DB anymore
+	for _, dir := range []string{agg.dirs.SnapHistory, agg.dirs.SnapIdx, agg.dirs.SnapAccessors} {
+		files, err := filepath.Glob(filepath.Join(dir, "*-accounts.1-2.*"))
+		require.NoError(t, err)
+		require.NotEmpty(t, files)
+		for _, f := range files {
+			require.NoError(t, os.Remove(f))
+		}
+	}
+	require.NoError(t, agg.OpenFolder())
+
+	res = report()
+	require.Equal(t, uint64(20), res.HeadBlock)
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 0, To: 20}, Available: true, Gaps: []BlockRange{{From: 4, To: 7}}}, res.HistoricalState)
+	require.Equal(t, full, res.LogIndex)
+	require.Equal(t, full, res.TraceIndex)
+}
+
+func TestCoverage(t *testing.T) {
+	files := visibleFiles{{startTxNum: 0, endTxNum: 16}, {startTxNum: 32, endTxNum: 48}}
+	require.Equal(t, []txRange{{0, 16}, {32, 100}}, coverageOf(files, 40, 100))
+	require.Equal(t, []txRange{{0, 16}, {20, 100}}, coverageOf(files, 20, 100))
+	require.Equal(t, []txRange{{0, 100}}, coverageOf(files, 0, 100))
+	require.Equal(t, []txRange{{0, 16}, {32, 48}}, coverageOf(files, 60, 48))
+	require.Equal(t, []txRange{{50, 100}}, coverageOf(nil, 50, 100))
+
+	require.Equal(t, []txRange{{10, 16}, {32, 40}}, intersectCoverage([]txRange{{0, 16}, {32, 100}}, []txRange{{10, 40}}))
+	require.Nil(t, intersectCoverage([]txRange{{0, 16}}, []txRange{{16, 40}}))
+}
+
+func TestCapabilityRange(t *testing.T) {
+	tx2block := func(txNum uint64) (uint64, error) { return txNum / 4, nil }
+	capabilityRangeOf := func(cov []txRange, end uint64) CapabilityRange {
+		t.Helper()
+		res, err := capabilityRange(cov, end, tx2block)
+		require.NoError(t, err)
+		return res
+	}
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 2, To: 9}, Available: true}, capabilityRangeOf([]txRange{{8, 40}}, 100))
+	// partially covered edge blocks are not available
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 2, To: 9}, Available: true}, capabilityRangeOf([]txRange{{6, 40}}, 100))
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 2, To: 8}, Available: true}, capabilityRangeOf([]txRange{{6, 38}}, 100))
+	// coverage up to head is not trimmed
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 2, To: 9}, Available: true}, capabilityRangeOf([]txRange{{8, 38}}, 38))
+	require.Equal(t, CapabilityRange{}, capabilityRangeOf([]txRange{{5, 7}}, 100))
+	require.Equal(t, CapabilityRange{}, capabilityRangeOf(nil, 100))
+	// blocks with not covered txNums are gaps
+	require.Equal(t, CapabilityRange{BlockRange: BlockRange{From: 0, To: 24}, Available: true, Gaps: []BlockRange{{From: 4, To: 7}}},
+		capabilityRangeOf([]txRange{{0, 18}, {30, 100}}, 100))
+}
+
+func TestAggregatorV3_HistoryRangeWithCoverage(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 3) // txNums 1-48, files of steps 0-2. Each txNum changes own account
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+
+	historyRange := func(fromTs, toTs int) (keys []string, cov Coverage) {
+		t.Helper()
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			it, c, err := ac.HistoryRangeWithCoverage(kv.AccountsHistory, fromTs, toTs, order.Asc, -1, tx)
+			if err != nil {
+				return err
+			}
+			defer it.Close()
+			for it.HasNext() {
+				k, _, err := it.Next()
+				if err != nil {
+					return err
+				}
+				keys = append(keys, string(k))
+			}
+			cov = c
+			return nil
+		}))
+		return keys, cov
+	}
+
+	keys, cov := historyRange(0, 48)
+	require.Len(t, keys, 47)
+	require.Equal(t, Coverage{From: 0, To: 48, Covered: []TxNumRange{{0, 48}}}, cov)
+	require.True(t, cov.Complete())
+
+	// history of step 1 of accounts is not in files and not in DB anymore
+	for _, dir := range []string{agg.dirs.SnapHistory, agg.dirs.SnapIdx, agg.dirs.SnapAccessors} {
+		files, err := filepath.Glob(filepath.Join(dir, "*-accounts.1-2.*"))
+		require.NoError(t, err)
+		require.NotEmpty(t, files)
+		for _, f := range files {
+			require.NoError(t, os.Remove(f))
+		}
+	}
+	require.NoError(t, agg.OpenFolder())
+
+	keys, cov = historyRange(0, 48)
+	require.Equal(t, Coverage{From: 0, To: 48, Covered: []TxNumRange{{0, 16}, {32, 48}}, Missing: []TxNumRange{{16, 32}}}, cov)
+	require.False(t, cov.Complete())
+	// entries come only from covered parts
+	before, _ := historyRange(0, 16)
+	after, _ := historyRange(32, 48)
+	require.Len(t, keys, 15+16)
+	require.ElementsMatch(t, append(before, after...), keys)
+
+	_, cov = historyRange(40, math.MaxInt64) // DB is above files
+	require.Equal(t, Coverage{From: 40, To: math.MaxInt64, Covered: []TxNumRange{{40, math.MaxInt64}}}, cov)
+	_, cov = historyRange(20, 30)
+	require.Equal(t, Coverage{From: 20, To: 30, Missing: []TxNumRange{{20, 30}}}, cov)
+}
@@ -32,7 +32,7 @@ func testDbAndAggregatorBench(b *testing.B, aggStep uint64) (kv.RwDB, *Aggregato
 		return kv.ChaindataTablesCfg
 	}).MustOpen()
 	b.Cleanup(db.Close)
-	agg, err := NewAggregator(context.Background(), dirs, aggStep, db, nil, logger)
+	agg, err := NewAggregator(context.Background(), dirs, aggStep, db, nil, DefaultCommitmentValuesTransform, logger)
 	require.NoError(b, err)
 	b.Cleanup(agg.Close)
 	return db, agg
@@ -92,6 +92,60 @@ func BenchmarkAggregator_Processing(b *testing.B) {
 	}
 }
 
+// BenchmarkAggregatorRoTx_Clone - 64 workers start on same block: BeginFilesRo by each worker vs 1 BeginFilesRo + 63 clones
+func BenchmarkAggregatorRoTx_Clone(b *testing.B) {
+	db, agg := testDbAndAggregatorBench(b, 1000)
+	buildRandomSteps(b, db, agg, 4)
+	const workers = 64
+	txs := make([]*AggregatorRoTx, workers)
+
+	b.Run("BeginFilesRo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range txs {
+				txs[j] = agg.BeginFilesRo()
+			}
+			for _, ac := range txs {
+				ac.Close()
+			}
+		}
+	})
+	b.Run("Clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			txs[0] = agg.BeginFilesRo()
+			for j := 1; j < len(txs); j++ {
+				txs[j] = txs[0].Clone()
+			}
+			for _, ac := range txs {
+				ac.Close()
+			}
+		}
+	})
+}
+
+// BenchmarkAggregatorRoTx_PruneParallel - prune of whole backlog in DB (rolled back after each iteration) by 1 and 4 workers
+func BenchmarkAggregatorRoTx_PruneParallel(b *testing.B) {
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorBench(b, 1000)
+	buildRandomSteps(b, db, agg, 20)
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tx, err := db.BeginRw(ctx)
+				require.NoError(b, err)
+				ac := agg.BeginFilesRo()
+				stat, err := ac.PruneParallel(ctx, db, tx, 0, workers, nil)
+				require.NoError(b, err)
+				require.NotNil(b, stat)
+				ac.Close()
+				tx.Rollback()
+			}
+		})
+	}
+}
+
 func queueKeys(ctx context.Context, seed, ofSize uint64) <-chan []byte {
 	rnd := rand.New(rand.NewSource(int64(seed)))
 	keys := make(chan []byte, 1)
@@ -30,7 +30,7 @@ type SelectedStaticFilesV3 struct {
 	dHist      [kv.DomainLen][]*filesItem
 	dIdx       [kv.DomainLen][]*filesItem
 	ii         [kv.StandaloneIdxLen][]*filesItem
-	appendable [kv.AppendableLen][]*filesItem
+	appendable [kv.AppendableMax][]*filesItem
 }
 
 func (sf SelectedStaticFilesV3) Close() {
@@ -42,6 +42,9 @@ func (sf SelectedStaticFilesV3) Close() {
 	for _, i := range sf.ii {
 		clist = append(clist, i)
 	}
+	for _, i := range sf.appendable {
+		clist = append(clist, i)
+	}
 	for _, group := range clist {
 		for _, item := range group {
 			if item != nil {
@@ -83,7 +86,7 @@ type MergedFilesV3 struct {
 	dHist      [kv.DomainLen]*filesItem
 	dIdx       [kv.DomainLen]*filesItem
 	iis        [kv.StandaloneIdxLen]*filesItem
-	appendable [kv.AppendableLen]*filesItem
+	appendable [kv.AppendableMax]*filesItem
 }
 
 func (mf MergedFilesV3) FrozenList() (frozen []string) {
@@ -106,6 +109,11 @@ func (mf MergedFilesV3) FrozenList() (frozen []string) {
 			frozen = append(frozen, ii.decompressor.FileName())
 		}
 	}
+	for _, ap := range mf.appendable {
+		if ap != nil && ap.frozen {
+			frozen = append(frozen, ap.decompressor.FileName())
+		}
+	}
 	return frozen
 }
 func (mf MergedFilesV3) Close() {
@@ -114,6 +122,7 @@ func (mf MergedFilesV3) Close() {
 		clist = append(clist, mf.d[id], mf.dHist[id], mf.dIdx[id])
 	}
 	clist = append(clist, mf.iis[:]...)
+	clist = append(clist, mf.appendable[:]...)
 
 	for _, item := range clist {
 		if item != nil {
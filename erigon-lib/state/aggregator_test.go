@@ -10,6 +10,10 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -18,10 +22,15 @@ import (
 	"github.com/holiman/uint256"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
 	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/common/snapbuild"
 	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/iter"
@@ -29,6 +38,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv/order"
 	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 	"github.com/ledgerwatch/erigon-lib/seg"
 	"github.com/ledgerwatch/erigon-lib/types"
 )
@@ -166,7 +176,7 @@ func TestAggregatorV3_MergeValTransform(t *testing.T) {
 	txs := uint64(100000)
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	agg.commitmentValuesTransform = true
+	agg.commitmentValuesTransform = CommitmentValuesTransformAtMerge
 
 	state := make(map[string][]byte)
 
@@ -237,6 +247,1848 @@ func TestAggregatorV3_MergeValTransform(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// commitment reads must not depend on mode of values transformation - also for files produced in another mode
+func TestAggregatorV3_CommitmentValuesTransformModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	const stepSize, steps = 100, 20
+	ctx := context.Background()
+
+	// writes random accounts/storage, builds, prunes and merges files
+	write := func(db kv.RwDB, agg *Aggregator, fromTxNum, toTxNum uint64) {
+		rwTx, err := db.BeginRwNosync(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+
+		for txNum := fromTxNum; txNum < toTxNum; txNum++ {
+			domains.SetTxNum(txNum)
+			rnd := rand.New(rand.NewSource(int64(txNum))) // same updates - regardless of ranges of writes
+			addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+			rnd.Read(addr)
+			rnd.Read(loc)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(1, uint256.NewInt(txNum*1e6), nil, 0), nil, 0))
+			require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+			if (txNum+1)%stepSize == 0 {
+				_, err := domains.ComputeCommitment(ctx, true, txNum/10, "")
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		domains.Close()
+		ac.Close()
+		require.NoError(t, rwTx.Commit())
+
+		require.NoError(t, agg.BuildFiles(toTxNum))
+		logEvery := time.NewTicker(30 * time.Second)
+		defer logEvery.Stop()
+		require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			_, err := ac.Prune(ctx, tx, 0, logEvery)
+			return err
+		}))
+		require.NoError(t, agg.MergeLoop(ctx))
+	}
+	// commitment values of all keys of visible files. transformed - amount of values stored with replaced keys
+	read := func(db kv.RwDB, agg *Aggregator) (values map[string]string, transformed int) {
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+
+		values = map[string]string{}
+		for _, f := range ac.d[kv.CommitmentDomain].files {
+			g := NewArchiveGetter(f.src.decompressor.MakeGetter(), agg.d[kv.CommitmentDomain].compression)
+			for g.HasNext() {
+				k, _ := g.Next(nil)
+				stored, _ := g.Next(nil)
+				v, _, err := domains.LatestCommitment(k)
+				require.NoError(t, err)
+				values[string(k)] = string(v)
+				if !bytes.Equal(stored, v) && !bytes.Equal(k, keyCommitmentState) {
+					transformed++
+				}
+			}
+		}
+		require.NotEmpty(t, values)
+		return values, transformed
+	}
+	filesKeysReplaced := func(agg *Aggregator) (res []bool) {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for _, f := range ac.d[kv.CommitmentDomain].files {
+			flags, ok := f.src.decompressor.Flags()
+			require.True(t, ok)
+			res = append(res, flags&commitmentFileKeysReplaced != 0)
+		}
+		return res
+	}
+
+	expected := map[CommitmentValuesTransformMode]map[string]string{}
+	for _, mode := range []CommitmentValuesTransformMode{CommitmentValuesTransformOff, CommitmentValuesTransformAtMerge, CommitmentValuesTransformAtRead} {
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		agg.Close()
+		agg = testAggregatorv3(t, db, agg.dirs, stepSize, mode)
+		// transformed files may exist in AtRead mode too: subset files they reference are held
+		for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CommitmentDomain} {
+			require.Equal(t, mode != CommitmentValuesTransformOff, agg.d[d].restrictSubsetFileDeletions, mode)
+		}
+		write(db, agg, 1, stepSize*steps)
+
+		values, transformed := read(db, agg)
+		expected[mode] = values
+		if mode == CommitmentValuesTransformAtMerge {
+			require.Positive(t, transformed)
+			require.Contains(t, filesKeysReplaced(agg), true)
+		} else {
+			require.Zero(t, transformed)
+			require.NotContains(t, filesKeysReplaced(agg), true)
+		}
+		if mode == CommitmentValuesTransformAtRead {
+			ac := agg.BeginFilesRo()
+			require.ErrorContains(t, ac.SqueezeCommitmentFiles(), "not supported")
+			ac.Close()
+		}
+	}
+	require.Equal(t, expected[CommitmentValuesTransformOff], expected[CommitmentValuesTransformAtMerge])
+	require.Equal(t, expected[CommitmentValuesTransformOff], expected[CommitmentValuesTransformAtRead])
+
+	// switch AtMerge -> AtRead: transformed files of AtMerge mode are read by AtRead mode
+	db, agg := testDbAndAggregatorv3(t, stepSize)
+	write(db, agg, 1, stepSize*steps/2)
+	require.Contains(t, filesKeysReplaced(agg), true)
+	agg.Close()
+	agg = testAggregatorv3(t, db, agg.dirs, stepSize, CommitmentValuesTransformAtRead)
+	_, transformed := read(db, agg)
+	require.Positive(t, transformed)
+
+	// and merged together with files of AtRead mode
+	write(db, agg, stepSize*steps/2, stepSize*steps)
+	values, _ := read(db, agg)
+	require.Equal(t, expected[CommitmentValuesTransformAtRead], values)
+}
+
+// TestDomain_ValuesTransformedWithoutFlags - commitment files produced by older versions (no flags) are transformed by
+// parity of their steps: in step size recorded for file. File without recorded step size is not transformed
+func TestDomain_ValuesTransformedWithoutFlags(t *testing.T) {
+	const stepSize = 16
+	logger := log.New()
+	dir := t.TempDir()
+	fPath := filepath.Join(dir, "v1-commitment.0-2.kv")
+	comp, err := seg.NewCompressor(context.Background(), "test", fPath, dir, seg.MinPatternScore, 1, log.LvlDebug, logger)
+	require.NoError(t, err)
+	require.NoError(t, comp.AddWord([]byte("k")))
+	require.NoError(t, comp.AddWord([]byte("v")))
+	require.NoError(t, comp.Compress())
+	comp.Close()
+	decomp, err := seg.NewDecompressor(fPath)
+	require.NoError(t, err)
+	defer decomp.Close()
+	_, ok := decomp.Flags()
+	require.False(t, ok)
+
+	d := &Domain{valuesTransform: CommitmentValuesTransformAtMerge}
+	item := func(steps, stepSize uint64, stepSizeUnknown bool) *filesItem {
+		item := newFilesItem(0, steps*stepSize, stepSize)
+		item.decompressor, item.stepSizeUnknown = decomp, stepSizeUnknown
+		return item
+	}
+	require.True(t, d.valuesTransformed(item(2, stepSize, false)))
+	require.False(t, d.valuesTransformed(item(1, stepSize, false)))
+	// 2 configured steps, but 1 step of app which produced file
+	require.False(t, d.valuesTransformed(item(1, 2*stepSize, false)))
+	require.False(t, d.valuesTransformed(item(2, stepSize, true)))
+
+	d.valuesTransform = CommitmentValuesTransformOff
+	require.False(t, d.valuesTransformed(item(2, stepSize, false)))
+}
+
+func TestAggregatorV3_PlanMerge(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := uint64(8000)
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		buf := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	// build files step-by-step: without background merge
+	for step := uint64(0); step < txs/agg.StepSize(); step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	ac = agg.BeginFilesRo()
+	plan := ac.PlanMerge(StepsInColdFile * agg.StepSize())
+	ac.Close()
+	require.False(t, plan.Empty())
+	require.False(t, plan.CommitmentValuesTransform)
+	require.Positive(t, plan.InputSize)
+	require.Equal(t, plan.InputSize, plan.EstimatedSize) // no merges happened yet - no ratio known
+	for _, it := range plan.Items {
+		require.NoFileExists(t, it.Path)
+		require.Greater(t, len(it.Inputs), 1, it.Path)
+	}
+
+	somethingMerged, err := agg.mergeLoopStep(ctx)
+	require.NoError(t, err)
+	require.True(t, somethingMerged)
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	for _, it := range plan.Items {
+		require.FileExists(t, it.Path)
+	}
+	require.NotEmpty(t, agg.mergeRatios.ratio)
+
+	// ratios are persisted: dry-run of new process (CLI) uses them
+	loaded := &mergeRatios{path: agg.mergeRatios.path}
+	require.NoError(t, loaded.load())
+	require.Equal(t, len(agg.mergeRatios.ratio), len(loaded.ratio))
+	for k, r := range agg.mergeRatios.ratio {
+		require.InDelta(t, r, loaded.get(k), 0.0001, k)
+	}
+}
+
+// buildRandomSteps - writes random accounts/storage for `steps` steps and builds files for them (without merge)
+func buildRandomSteps(tb testing.TB, db kv.RwDB, agg *Aggregator, steps uint64) {
+	tb.Helper()
+	writeRandomSteps(tb, db, agg, steps)
+	for step := uint64(0); step < steps; step++ {
+		require.NoError(tb, agg.buildFiles(context.Background(), step))
+	}
+}
+
+// writeRandomSteps - writes `steps` of random accounts and storage to db, without building files
+func writeRandomSteps(tb testing.TB, db kv.RwDB, agg *Aggregator, steps uint64) {
+	tb.Helper()
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(tb, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(tb, err)
+	defer domains.Close()
+
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= steps*agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		buf := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum), nil, 0)
+		require.NoError(tb, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		require.NoError(tb, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+	}
+	require.NoError(tb, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(tb, rwTx.Commit())
+}
+
+func TestAggregatorV3_FilesGeneration(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+
+	gen := agg.FilesGeneration()
+	buildRandomSteps(t, db, agg, 4)
+	require.Greater(t, agg.FilesGeneration(), gen)
+
+	gen = agg.FilesGeneration()
+	agg.recalcVisibleFiles() // nothing changed
+	require.Equal(t, gen, agg.FilesGeneration())
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.Equal(t, gen, ac.Generation())
+	clone := ac.Clone()
+	require.Equal(t, gen, clone.Generation())
+	clone.Close()
+
+	somethingMerged, err := agg.mergeLoopStep(ctx)
+	require.NoError(t, err)
+	require.True(t, somethingMerged)
+	require.Greater(t, agg.FilesGeneration(), gen)
+	require.Equal(t, gen, ac.Generation()) // captured view is not affected
+
+	ac2 := agg.BeginFilesRo()
+	defer ac2.Close()
+	require.Equal(t, agg.FilesGeneration(), ac2.Generation())
+	require.NotEqual(t, ac.Files(), ac2.Files())
+}
+
+func TestAggregatorV3_WaitFilesVisible(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	writeRandomSteps(t, db, agg, 3)
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, agg.WaitFilesVisible(ctx, agg.StepSize()), "already visible")
+
+	target := 3 * agg.StepSize()
+	waitErr, visibleAfterWait := make(chan error, 1), make(chan uint64, 1)
+	go func() {
+		err := agg.WaitFilesVisible(ctx, target)
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		visibleAfterWait <- ac.MinimaxTxNum(true)
+		waitErr <- err
+	}()
+
+	require.NoError(t, agg.buildFiles(ctx, 1))
+	select {
+	case <-waitErr:
+		t.Fatal("unblocked before step became visible")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	buildDone := make(chan error, 1)
+	go func() { buildDone <- agg.buildFiles(ctx, 2) }()
+	require.NoError(t, <-buildDone)
+	require.NoError(t, <-waitErr)
+	require.GreaterOrEqual(t, <-visibleAfterWait, target, "new RoTx after wait sees files")
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, agg.WaitFilesVisible(cctx, 100*agg.StepSize()), context.DeadlineExceeded)
+}
+
+func TestAggregatorV3_FsyncPolicy(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+	var synced []string
+	agg.fsyncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return nil
+	}
+	stateDirs := []string{agg.dirs.SnapDomain, agg.dirs.SnapHistory, agg.dirs.SnapIdx, agg.dirs.SnapAccessors}
+
+	agg.SetFsyncPolicy(dir.FsyncNone)
+	buildRandomSteps(t, db, agg, 2)
+	require.Empty(t, synced)
+	for _, d := range agg.d {
+		require.True(t, d.noFsync)
+	}
+
+	// final: writers don't fsync, produced files are fsynced by aggregator before dirs
+	var syncedFiles []string
+	agg.fsyncFile = func(path string) error {
+		syncedFiles = append(syncedFiles, path)
+		return nil
+	}
+	agg.SetFsyncPolicy(dir.FsyncFinalOnly)
+	for _, d := range agg.d {
+		require.True(t, d.noFsync)
+	}
+	somethingMerged, err := agg.mergeLoopStep(ctx)
+	require.NoError(t, err)
+	require.True(t, somethingMerged)
+	require.Equal(t, stateDirs, synced)
+	accounts := agg.d[kv.AccountsDomain]
+	require.Contains(t, syncedFiles, accounts.kvFilePath(0, 2))
+	require.Contains(t, syncedFiles, accounts.kvFilePath(0, 2)+stepSizeSuffix)
+	require.NotContains(t, syncedFiles, accounts.kvFilePath(0, 1), "input of merge was produced before")
+
+	synced, syncedFiles = nil, nil
+	require.NoError(t, agg.buildFiles(ctx, 2))
+	require.Equal(t, stateDirs, synced)
+	require.Contains(t, syncedFiles, accounts.kvFilePath(2, 3))
+	require.Contains(t, syncedFiles, accounts.History.vFilePath(2, 3))
+
+	// full: every writer fsyncs its file
+	agg.SetFsyncPolicy(dir.FsyncFull)
+	for _, d := range agg.d {
+		require.False(t, d.noFsync)
+	}
+	synced, syncedFiles = nil, nil
+	require.NoError(t, agg.buildFiles(ctx, 3))
+	require.Equal(t, stateDirs, synced)
+	require.Empty(t, syncedFiles)
+}
+
+func TestAggregatorV3_FileIntegrityPolicy(t *testing.T) {
+	maxStep := func(agg *Aggregator, name kv.Domain) uint64 {
+		item, ok := agg.d[name].dirtyFiles.Max()
+		if !ok {
+			return 0
+		}
+		return item.endTxNum / agg.StepSize()
+	}
+	// 2 steps of files, then `rm` one .kv file of last step, then open files by new Aggregator
+	reopen := func(t *testing.T, rm kv.Domain, disablePolicy bool) *Aggregator {
+		db, agg := testDbAndAggregatorv3(t, 1000)
+		buildRandomSteps(t, db, agg, 2)
+		require.NoError(t, os.Remove(agg.d[rm].kvFilePath(1, 2)))
+		agg.Close()
+
+		newAgg, err := NewAggregator(context.Background(), agg.dirs, agg.StepSize(), db, nil, agg.commitmentValuesTransform, log.New())
+		require.NoError(t, err)
+		t.Cleanup(newAgg.Close)
+		if disablePolicy {
+			newAgg.SetFileIntegrityPolicy(nil)
+		}
+		require.NoError(t, newAgg.OpenFolder())
+		return newAgg
+	}
+
+	t.Run("accounts newer than commitment", func(t *testing.T) {
+		agg := reopen(t, kv.CommitmentDomain, false)
+		require.Equal(t, uint64(1), maxStep(agg, kv.AccountsDomain))
+		require.Equal(t, uint64(1), maxStep(agg, kv.StorageDomain))
+		require.Equal(t, uint64(1), maxStep(agg, kv.CommitmentDomain))
+	})
+	t.Run("commitment newer than accounts", func(t *testing.T) {
+		agg := reopen(t, kv.AccountsDomain, false)
+		require.Equal(t, uint64(1), maxStep(agg, kv.AccountsDomain))
+		require.Equal(t, uint64(2), maxStep(agg, kv.StorageDomain))
+		require.Equal(t, uint64(1), maxStep(agg, kv.CommitmentDomain))
+	})
+	t.Run("disabled", func(t *testing.T) {
+		agg := reopen(t, kv.CommitmentDomain, true)
+		require.Equal(t, uint64(2), maxStep(agg, kv.AccountsDomain))
+		require.Equal(t, uint64(2), maxStep(agg, kv.StorageDomain))
+		require.Equal(t, uint64(1), maxStep(agg, kv.CommitmentDomain))
+	})
+}
+
+func TestAggregatorV3_IndexIntersect(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	addr, topic, otherTopic := []byte{1}, []byte{2}, []byte{3}
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	var expect []uint64
+	txs := 3 * agg.StepSize()
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		if txNum%2 == 0 {
+			require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, addr))
+		}
+		if txNum%3 == 0 {
+			require.NoError(t, domains.IndexAdd(kv.LogTopicIdx, topic))
+		}
+		if txNum%2 == 1 {
+			require.NoError(t, domains.IndexAdd(kv.LogTopicIdx, otherTopic))
+		}
+		if txNum%6 == 0 {
+			expect = append(expect, txNum)
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	for step := uint64(0); step < 2; step++ { // last step stays in db
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+
+	it, err := ac.IndexIntersect(kv.LogAddrIdx, kv.LogTopicIdx, addr, topic, 0, int(txs)+1, -1, tx)
+	require.NoError(t, err)
+	require.Equal(t, expect, iter.ToArrU64Must(it))
+
+	it, err = ac.IndexIntersect(kv.LogAddrIdx, kv.LogTopicIdx, addr, topic, 10, 40, 3, tx)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{12, 18, 24}, iter.ToArrU64Must(it))
+
+	it, err = ac.IndexIntersect(kv.LogAddrIdx, kv.LogTopicIdx, addr, otherTopic, 0, -1, -1, tx)
+	require.NoError(t, err)
+	require.Empty(t, iter.ToArrU64Must(it))
+
+	it, err = ac.IndexIntersectMany([]kv.InvertedIdx{kv.LogAddrIdx, kv.LogTopicIdx, kv.LogTopicIdx}, [][]byte{addr, topic, topic}, 0, -1, 2, tx)
+	require.NoError(t, err)
+	require.Equal(t, expect[:2], iter.ToArrU64Must(it))
+
+	it, err = ac.IndexIntersectMany([]kv.InvertedIdx{kv.LogTopicIdx}, [][]byte{topic}, 40, -1, -1, tx)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{42, 45, 48}, iter.ToArrU64Must(it))
+
+	_, err = ac.IndexIntersectMany([]kv.InvertedIdx{kv.LogAddrIdx}, [][]byte{addr, topic}, 0, -1, -1, tx)
+	require.Error(t, err)
+}
+
+func TestAggregatorV3_ReadsCtx(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	addr, acc := []byte{1}, make([]byte, length.Addr)
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := 8 * agg.StepSize()
+	var prev []byte
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, addr))
+		v := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, acc, nil, v, prev, (txNum-1)/agg.StepSize()))
+		prev = v
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	for step := uint64(0); step < 7; step++ { // last step stays in db
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+
+	it, err := ac.IndexRangeCtx(cctx, kv.LogAddrIdx, addr, -1, -1, order.Asc, -1, tx)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.True(t, it.HasNext())
+		_, err = it.Next()
+		require.NoError(t, err)
+	}
+	cancel()
+	require.True(t, it.HasNext(), "cancellation is reported by Next")
+	_, err = it.Next()
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, it.HasNext())
+
+	_, err = ac.IndexRangeCtx(cctx, kv.LogAddrIdx, addr, -1, -1, order.Asc, -1, tx)
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = ac.HistoryRangeCtx(cctx, kv.AccountsHistory, -1, -1, order.Asc, -1, tx)
+	require.ErrorIs(t, err, context.Canceled)
+	_, _, err = ac.HistorySeekCtx(cctx, kv.AccountsHistory, acc, 5, tx)
+	require.ErrorIs(t, err, context.Canceled)
+	_, _, err = ac.DomainGetAsOfCtx(cctx, tx, kv.AccountsDomain, acc, 5)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// wrappers without ctx are not affected
+	it, err = ac.IndexRange(kv.LogAddrIdx, addr, -1, -1, order.Asc, -1, tx)
+	require.NoError(t, err)
+	require.Len(t, iter.ToArrU64Must(it), int(txs))
+	_, ok, err := ac.DomainGetAsOf(tx, kv.AccountsDomain, acc, 5)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ac.Close()
+	tx.Rollback()
+	require.Empty(t, db.(*mdbx.MdbxKV).LongRunningReaders(0), "no leaked read transactions")
+}
+
+func TestAggregatorV3_BlockAlignedSteps(t *testing.T) {
+	ctx := context.Background()
+	addr, other := []byte{1}, []byte{2}
+	const blockSize = 5 // block 3 [15, 19] straddles boundary of step 0, block 6 [30, 34] - of step 1
+	account := func(b byte) []byte { return append(make([]byte, length.Addr-1), b) }
+	accountVal := func(txNum uint64) []byte { return types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0) }
+	mid := account(3) // changed at 12 and at 31: last change is in [30, 32) of step 1, which is not in files
+
+	// node: blocks 0..9, `addr` and its account at every txNum. `reexecuted` - straddling block has extra `other`: node
+	// committed it differently before restart
+	node := func(aligned, reexecuted bool) (kv.RwDB, *Aggregator) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		if aligned {
+			agg.SetBlockAlignedSteps(BlockLastTxNumByTxNums)
+		}
+		rwTx, err := db.BeginRwNosync(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		for blockNum := uint64(0); blockNum < 10; blockNum++ {
+			require.NoError(t, rawdbv3.TxNums.Append(rwTx, blockNum, blockNum*blockSize+blockSize-1))
+		}
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		for txNum := uint64(0); txNum < 3*agg.StepSize(); txNum++ {
+			domains.SetTxNum(txNum)
+			require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, addr))
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, account(addr[0]), nil, accountVal(txNum), nil, 0))
+			if reexecuted && txNum == 15 {
+				require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, other))
+				require.NoError(t, domains.DomainPut(kv.AccountsDomain, account(other[0]), nil, accountVal(txNum), nil, 0))
+			}
+			if txNum == 12 || txNum == 31 {
+				require.NoError(t, domains.DomainPut(kv.AccountsDomain, mid, nil, accountVal(txNum), nil, 0))
+			}
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		domains.Close()
+		ac.Close()
+		require.NoError(t, rwTx.Commit())
+		for step := uint64(0); step < 2; step++ { // last step stays in db
+			require.NoError(t, agg.buildFiles(ctx, step))
+		}
+		return db, agg
+	}
+	firstFile := func(agg *Aggregator) []byte {
+		data, err := os.ReadFile(agg.iis[kv.LogAddrIdxPos].efFilePath(0, 1))
+		require.NoError(t, err)
+		return data
+	}
+	firstKvFile := func(agg *Aggregator) []byte {
+		data, err := os.ReadFile(agg.d[kv.AccountsDomain].kvFilePath(0, 1))
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Run("unaligned", func(t *testing.T) {
+		_, a := node(false, false)
+		_, b := node(false, true)
+		require.NotEqual(t, firstFile(a), firstFile(b))
+		require.NotEqual(t, firstKvFile(a), firstKvFile(b))
+	})
+
+	t.Run("aligned", func(t *testing.T) {
+		db, a := node(true, false)
+		_, b := node(true, true)
+		require.Equal(t, firstFile(a), firstFile(b))
+		require.Equal(t, firstKvFile(a), firstKvFile(b))
+
+		ac := a.BeginFilesRo()
+		defer func() { ac.Close() }()
+		files := ac.iis[kv.LogAddrIdxPos].files
+		require.Len(t, files, 2)
+		from, to := files[0].src.dataRange()
+		require.Equal(t, [2]uint64{0, 15}, [2]uint64{from, to})
+		from, to = files[1].src.dataRange()
+		require.Equal(t, [2]uint64{15, 30}, [2]uint64{from, to})
+		kvFiles := ac.d[kv.AccountsDomain].files
+		require.Len(t, kvFiles, 2)
+		from, to = kvFiles[1].src.dataRange()
+		require.Equal(t, [2]uint64{15, 30}, [2]uint64{from, to})
+		v, ok, err := ac.d[kv.AccountsDomain].getFromFile(0, account(addr[0]), nil)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, accountVal(14), v) // value as of end of file data, not of step
+
+		// [30, 32) of step 1 is not in files yet: must survive prune
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		_, err = ac.Prune(ctx, rwTx, math.MaxUint64, time.NewTicker(time.Minute))
+		require.NoError(t, err)
+		it, err := ac.IndexRange(kv.LogAddrIdx, addr, 0, 48, order.Asc, -1, rwTx)
+		require.NoError(t, err)
+		txNums := iter.ToArrU64Must(it)
+		require.Len(t, txNums, 48)
+		require.Equal(t, uint64(47), txNums[len(txNums)-1])
+
+		it, err = ac.IndexRange(kv.LogAddrIdx, addr, 28, 32, order.Asc, -1, rwTx)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{28, 29, 30, 31}, iter.ToArrU64Must(it))
+
+		v, _, ok, err = ac.d[kv.AccountsDomain].GetLatest(mid, nil, rwTx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, accountVal(31), v)
+		v, _, ok, err = ac.d[kv.AccountsDomain].GetLatest(account(addr[0]), nil, rwTx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, accountVal(47), v)
+		latest, err := ac.d[kv.AccountsDomain].DomainRangeLatest(rwTx, mid, nil, -1)
+		require.NoError(t, err)
+		k, v, err := latest.Next()
+		require.NoError(t, err)
+		require.Equal(t, mid, k)
+		require.Equal(t, accountVal(31), v) // DB value of step 1 is newer than file which ends in step 1
+
+		// merge of step files covers data of both
+		rwTx.Rollback()
+		ac.Close()
+		require.NoError(t, a.MergeLoop(ctx))
+		ac = a.BeginFilesRo()
+		files = ac.iis[kv.LogAddrIdxPos].files
+		require.Len(t, files, 1)
+		from, to = files[0].src.dataRange()
+		require.Equal(t, [2]uint64{0, 30}, [2]uint64{from, to})
+		kvFiles = ac.d[kv.AccountsDomain].files
+		require.Len(t, kvFiles, 1)
+		from, to = kvFiles[0].src.dataRange()
+		require.Equal(t, [2]uint64{0, 30}, [2]uint64{from, to})
+	})
+}
+
+// putAccounts - 1 new account per txNum in [1, toTxNum], without building files
+func putAccounts(tb testing.TB, db kv.RwDB, agg *Aggregator, toTxNum uint64) {
+	tb.Helper()
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(tb, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(tb, err)
+	defer domains.Close()
+	for txNum := uint64(1); txNum <= toTxNum; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum)
+		buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+		require.NoError(tb, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+	}
+	require.NoError(tb, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(tb, rwTx.Commit())
+}
+
+func TestAggregatorV3_FilesListSave(t *testing.T) {
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	const steps = 12
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+	for txNum := uint64(0); txNum < (steps+1)*agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, []byte{1}))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+
+	// `stored` - files list in DB, maintained only by deltas
+	stored := map[string]struct{}{}
+	save := func() {
+		delta := agg.FilesListDelta()
+		if delta.Full {
+			stored = map[string]struct{}{}
+		}
+		for _, f := range delta.Added {
+			stored[f] = struct{}{}
+		}
+		for _, f := range delta.Removed {
+			delete(stored, f)
+		}
+		agg.AckFilesListDelta(delta)
+	}
+	storedList := func() []string {
+		res := make([]string, 0, len(stored))
+		for f := range stored {
+			res = append(res, f)
+		}
+		sort.Strings(res)
+		return res
+	}
+	currentList := func() []string {
+		res := agg.Files()
+		sort.Strings(res)
+		return res
+	}
+
+	// rapid integrations: build + merge of every step. Only first one is reported within save interval
+	var positive int
+	for step := uint64(0); step < steps/2; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+		_, err := agg.mergeLoopStep(ctx)
+		require.NoError(t, err)
+		if agg.HasNewFrozenFiles() {
+			positive++
+			save()
+		}
+	}
+	require.Equal(t, 1, positive)
+	require.NotEqual(t, currentList(), storedList())
+
+	// flush reports pending changes immediately
+	agg.FlushFilesList()
+	require.True(t, agg.HasNewFrozenFiles())
+	save()
+	require.Equal(t, currentList(), storedList())
+	require.False(t, agg.HasNewFrozenFiles())
+
+	// no interval: every change reported, deltas are incremental
+	agg.SetFilesListSaveInterval(0)
+	positive = 0
+	for step := uint64(steps / 2); step < steps; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+		for {
+			merged, err := agg.mergeLoopStep(ctx)
+			require.NoError(t, err)
+			if !merged {
+				break
+			}
+		}
+		require.True(t, agg.HasNewFrozenFiles())
+		positive++
+		delta := agg.FilesListDelta()
+		require.False(t, delta.Full)
+		require.NotEmpty(t, delta.Added)
+		save()
+		require.Equal(t, currentList(), storedList())
+	}
+	require.Equal(t, steps/2, positive)
+	require.False(t, agg.HasNewFrozenFiles())
+
+	// not committed write: next delta is full
+	agg.ResetFilesListDelta()
+	require.True(t, agg.FilesListDelta().Full)
+	save()
+	require.Equal(t, currentList(), storedList())
+
+	// tx committed by somebody else: delta is pending until next tx sees id of its write
+	removed := currentList()[0]
+	agg.AckFilesListDelta(FilesListDelta{Removed: []string{removed}})
+	delta := agg.FilesListDelta()
+	require.Equal(t, []string{removed}, delta.Added)
+	id := agg.PendFilesListDelta(delta)
+	require.Equal(t, delta, agg.FilesListDelta())
+	agg.ConfirmFilesListDelta(id - 1) // tx was not committed
+	require.True(t, agg.HasNewFrozenFiles(), "files list must be saved again")
+	require.Equal(t, delta, agg.FilesListDelta())
+	id = agg.PendFilesListDelta(delta)
+	agg.ConfirmFilesListDelta(id)
+	require.True(t, agg.FilesListDelta().Empty())
+	require.False(t, agg.HasNewFrozenFiles())
+}
+
+func TestAggregatorV3_StepsRangeInDB(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+	for txNum := uint64(1); txNum <= 2*agg.StepSize(); txNum++ { // steps 0 and 1 are full, step 2 has 1 txNum
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum)
+		buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+
+	ranges := agg.StepsRangeInDB(rwTx)
+	accounts := ranges[agg.d[kv.AccountsDomain].filenameBase]
+	require.Equal(t, float64(1)/16, accounts.FromStep)
+	require.Equal(t, float64(2), accounts.ToStep)
+	require.Zero(t, ranges[agg.d[kv.StorageDomain].filenameBase].Len())
+	require.Zero(t, ranges[agg.iis[kv.LogAddrIdxPos].filenameBase].Len())
+	require.Contains(t, agg.StepsRangeInDBAsStr(rwTx), agg.d[kv.AccountsDomain].filenameBase+":1.9")
+	require.Equal(t, uint64(2), agg.DbDataLagSteps(rwTx))
+	require.NoError(t, rwTx.Commit())
+
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	require.Equal(t, uint64(1), agg.DbDataLagSteps(tx))
+}
+
+// merge holds slot of shared semaphore per range: blocks retire waiting for slot gets it before merge loop is done
+func TestAggregatorV3_MergeLoopSharesSlots(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	putAccounts(t, db, agg, 3*agg.StepSize()-1) // steps 0-2
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, agg.buildFiles(ctx, 1))
+	sema := semaphore.NewWeighted(1)
+	agg.SetSnapshotBuildSema(sema)
+	coord := snapbuild.Shared(sema)
+
+	require.NoError(t, coord.Acquire(ctx, snapbuild.StateBuild))
+	var mergeErr error
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		mergeErr = agg.MergeLoop(ctx)
+	}()
+	require.Eventually(t, func() bool { return coord.Waits(snapbuild.Merge) == 1 }, 5*time.Second, time.Millisecond)
+	var retireErr error
+	mergeRunning := false
+	retired := make(chan struct{})
+	go func() {
+		defer close(retired)
+		if retireErr = coord.Acquire(ctx, snapbuild.BlockRetire); retireErr != nil {
+			return
+		}
+		select {
+		case <-merged:
+		default:
+			mergeRunning = true
+		}
+		coord.Release(snapbuild.BlockRetire)
+	}()
+	require.Eventually(t, func() bool { return coord.Waiting(snapbuild.BlockRetire) == 1 }, 5*time.Second, time.Millisecond)
+	coord.Release(snapbuild.StateBuild) // merge gets slot first, blocks retire - after first range
+
+	<-retired
+	require.NoError(t, retireErr)
+	require.True(t, mergeRunning, "blocks retire waited for whole merge loop")
+	<-merged
+	require.NoError(t, mergeErr)
+	require.GreaterOrEqual(t, coord.Waits(snapbuild.Merge), uint64(2))
+	require.Empty(t, coord.Current())
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	from, to := ac.d[kv.AccountsDomain].files[0].src.dataRange()
+	require.Equal(t, [2]uint64{0, 2 * agg.StepSize()}, [2]uint64{from, to})
+}
+
+func TestAggregatorV3_MinimaxTxNumCommitmentLags(t *testing.T) {
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	buildRandomSteps(t, db, agg, 2)
+	// commitment files lag one step behind state files
+	require.NoError(t, os.Remove(agg.d[kv.CommitmentDomain].kvFilePath(1, 2)))
+	agg.Close()
+	agg, err := NewAggregator(ctx, agg.dirs, agg.StepSize(), db, nil, agg.commitmentValuesTransform, log.New())
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	agg.SetFileIntegrityPolicy(nil)
+	require.NoError(t, agg.OpenFolder())
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.Equal(t, 1*agg.StepSize(), ac.MinimaxTxNum(true))
+	require.Equal(t, 2*agg.StepSize(), ac.MinimaxTxNum(false))
+	require.Equal(t, ac.MinimaxTxNum(true), ac.minimaxTxNumInDomainFiles())
+	require.Equal(t, ac.MinimaxTxNum(false), ac.EndTxNumNoCommitment())
+
+	// build/merge of files waits for commitment
+	require.Equal(t, 1*agg.StepSize(), agg.EndTxNumMinimax())
+	// unwind is limited by state files only
+	require.Equal(t, 2*agg.StepSize(), ac.CanUnwindDomainsToTxNum())
+
+	// prune must not go beyond commitment files
+	require.Equal(t, 1*agg.StepSize(), ac.pruneTxTo())
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	_, err = ac.Prune(ctx, rwTx, 0, nil)
+	require.NoError(t, err)
+	accounts := agg.StepsRangeInDB(rwTx)[agg.d[kv.AccountsDomain].filenameBase]
+	require.GreaterOrEqual(t, accounts.FromStep, float64(1))
+	require.Less(t, accounts.FromStep, float64(2))
+}
+
+func TestAggregatorV3_PruneByRoTxFiles(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	putAccounts(t, db, agg, 3*agg.StepSize()-1) // steps 0-2
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, agg.buildFiles(ctx, 1))
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.Equal(t, 2*agg.StepSize(), ac.MinimaxTxNum(true))
+	agg.visibleFilesMinimaxTxNum.Store(3 * agg.StepSize()) // stale/foreign value: no file of RoTx covers step 2
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	_, err = ac.Prune(ctx, rwTx, 0, nil)
+	require.NoError(t, err)
+
+	accounts := agg.StepsRangeInDB(rwTx)[agg.d[kv.AccountsDomain].filenameBase]
+	require.GreaterOrEqual(t, accounts.FromStep, float64(2))
+	require.Less(t, accounts.FromStep, float64(3))
+	for txNum := 2 * agg.StepSize(); txNum < 3*agg.StepSize(); txNum++ {
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum)
+		_, _, ok, err := ac.GetLatest(kv.AccountsDomain, addr, nil, rwTx)
+		require.NoError(t, err)
+		require.True(t, ok, txNum)
+	}
+}
+
+func TestAggregatorV3_TableWatermarks(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	putAccounts(t, db, agg, 2*agg.StepSize()-1) // steps 0-1
+	require.NoError(t, agg.buildFiles(ctx, 0))
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+
+	before := agg.TableWatermarks(rwTx)
+	for _, table := range []string{kv.TblAccountKeys, kv.TblAccountVals, kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx, kv.TblLogAddressKeys, kv.TblTracesToIdx} {
+		require.Contains(t, before, table)
+	}
+	hist := before[kv.TblAccountHistoryKeys]
+	require.Equal(t, uint64(1), hist.MinTxNum)
+	require.Equal(t, 2*agg.StepSize()-1, hist.MaxTxNum)
+	require.Equal(t, 2*agg.StepSize()-1, hist.ApproxRows)
+	require.Equal(t, hist.MinTxNum, before[kv.TblAccountHistoryVals].MinTxNum)
+	require.Equal(t, hist.MaxTxNum, before[kv.TblAccountIdx].MaxTxNum)
+	require.Equal(t, Watermark{}, before[kv.TblLogAddressKeys])
+	require.Equal(t, Watermark{ApproxRows: 2*agg.StepSize() - 1}, before[kv.TblAccountKeys])
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	_, err = ac.PruneSmallBatches(ctx, time.Hour, rwTx)
+	require.NoError(t, err)
+	require.Equal(t, float64(agg.StepSize()), mxTableWatermarks[kv.TblAccountHistoryKeys].min.GetValue()) // prune exports metrics
+
+	after := agg.TableWatermarks(rwTx)
+	for _, table := range []string{kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx} {
+		require.Equal(t, Watermark{MinTxNum: agg.StepSize(), MaxTxNum: 2*agg.StepSize() - 1, ApproxRows: agg.StepSize()}, after[table], table)
+	}
+	// latest values of step 1 are still in domain tables
+	for _, table := range []string{kv.TblAccountKeys, kv.TblAccountVals} {
+		require.Zero(t, after[table].MinTxNum)
+		require.Zero(t, after[table].MaxTxNum)
+		require.GreaterOrEqual(t, after[table].ApproxRows, agg.StepSize(), table)
+	}
+}
+
+func TestAggregatorV3_PruneParallel(t *testing.T) {
+	ctx := context.Background()
+	seqDB, seqAgg := testDbAndAggregatorv3(t, 16)
+	parDB, parAgg := testDbAndAggregatorv3(t, 16)
+	buildRandomSteps(t, seqDB, seqAgg, 4)
+	buildRandomSteps(t, parDB, parAgg, 4)
+
+	dump := func(db kv.RoDB, agg *Aggregator) map[string][]string { return dumpPruneTables(t, db, agg) }
+	require.Equal(t, dump(seqDB, seqAgg), dump(parDB, parAgg))
+
+	// small limit: prune progress is saved between calls
+	for i := 0; i < 10; i++ {
+		var seqStat, parStat *AggregatorPruneStat
+		require.NoError(t, seqDB.Update(ctx, func(tx kv.RwTx) (err error) {
+			ac := seqAgg.BeginFilesRo()
+			defer ac.Close()
+			seqStat, err = ac.Prune(ctx, tx, 10, nil)
+			return err
+		}))
+		require.NoError(t, parDB.Update(ctx, func(tx kv.RwTx) (err error) {
+			ac := parAgg.BeginFilesRo()
+			defer ac.Close()
+			parStat, err = ac.PruneParallel(ctx, parDB, tx, 10, 4, nil)
+			return err
+		}))
+		require.Equal(t, seqStat, parStat, i)
+		require.Equal(t, dump(seqDB, seqAgg), dump(parDB, parAgg), i)
+	}
+}
+
+// dumpPruneTables - content of all tables touched by prune
+func dumpPruneTables(t *testing.T, db kv.RoDB, agg *Aggregator) map[string][]string {
+	t.Helper()
+	tables := []string{kv.TblPruningProgress}
+	for _, d := range agg.d {
+		tables = append(tables, d.keysTable, d.valsTable, d.History.historyValsTable, d.History.indexKeysTable, d.History.indexTable)
+	}
+	for _, ii := range agg.iis {
+		tables = append(tables, ii.indexKeysTable, ii.indexTable)
+	}
+	res := map[string][]string{}
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		for _, table := range tables {
+			if err := tx.ForEach(table, nil, func(k, v []byte) error {
+				res[table] = append(res[table], fmt.Sprintf("%x:%x", k, v))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return res
+}
+
+func TestAggregatorV3_PruneBusy(t *testing.T) {
+	ctx := context.Background()
+	seqDB, seqAgg := testDbAndAggregatorv3(t, 16)
+	db, agg := testDbAndAggregatorv3(t, 16)
+	buildRandomSteps(t, seqDB, seqAgg, 4)
+	buildRandomSteps(t, db, agg, 4)
+
+	// sequential run
+	seqAc := seqAgg.BeginFilesRo()
+	defer seqAc.Close()
+	_, seqStat, err := seqAc.pruneSmallBatchesDb(ctx, 10*time.Hour, seqDB)
+	require.NoError(t, err)
+	require.False(t, seqStat.SkippedBusy)
+	require.False(t, seqStat.PrunedNothing())
+
+	// hold write tx: 1st prune takes prune lock and waits for it
+	holdTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer holdTx.Rollback()
+
+	type result struct {
+		stat *AggregatorPruneStat
+		err  error
+	}
+	first := make(chan result, 1)
+	go func() {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, stat, err := ac.pruneSmallBatchesDb(ctx, 10*time.Hour, db)
+		first <- result{stat, err}
+	}()
+	require.Eventually(t, agg.pruning.Load, 10*time.Second, time.Millisecond)
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	haveMore, stat, err := ac.pruneSmallBatchesDb(ctx, 10*time.Hour, db)
+	require.NoError(t, err)
+	require.False(t, haveMore)
+	require.True(t, stat.SkippedBusy)
+	require.True(t, stat.PrunedNothing())
+	_, err = ac.PruneSmallBatchesDb(ctx, 10*time.Hour, db)
+	require.ErrorIs(t, err, ErrPruneBusy)
+	_, err = ac.PruneSmallBatches(ctx, 10*time.Hour, holdTx)
+	require.ErrorIs(t, err, ErrPruneBusy)
+	stat, err = ac.Prune(ctx, holdTx, 0, nil)
+	require.NoError(t, err)
+	require.True(t, stat.SkippedBusy)
+	holdTx.Rollback()
+
+	res := <-first
+	require.NoError(t, res.err)
+	require.False(t, res.stat.SkippedBusy)
+	require.Equal(t, seqStat.String(), res.stat.String())
+	require.Equal(t, dumpPruneTables(t, seqDB, seqAgg), dumpPruneTables(t, db, agg))
+
+	// lock released
+	_, stat, err = ac.pruneSmallBatchesDb(ctx, 10*time.Hour, db)
+	require.NoError(t, err)
+	require.False(t, stat.SkippedBusy)
+	require.True(t, stat.PrunedNothing())
+}
+
+func TestAggregatorV3_OpenFilesCount(t *testing.T) {
+	before := dir.OpenFilesCount()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	buildRandomSteps(t, db, agg, 4)
+
+	opened := agg.OpenFilesCount()
+	require.Positive(t, opened)
+	require.Equal(t, before+opened, dir.OpenFilesCount())
+	byType := dir.OpenFilesByType()
+	for _, ext := range []string{".kv", ".v", ".ef", ".efi", ".vi"} {
+		require.Positive(t, byType[ext], ext)
+	}
+
+	// re-open doesn't leak: already open files are kept
+	require.NoError(t, agg.OpenFolder())
+	require.Equal(t, opened, agg.OpenFilesCount())
+	require.Equal(t, before+opened, dir.OpenFilesCount())
+
+	agg.Close()
+	require.Zero(t, agg.OpenFilesCount())
+	require.Equal(t, before, dir.OpenFilesCount())
+}
+
+func TestAggregatorV3_PrunedUpTo(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 5)
+
+	// keys of buildRandomSteps: account of txNum=30
+	rnd := rand.New(rand.NewSource(0))
+	addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+	for txNum := 1; txNum <= 30; txNum++ {
+		rnd.Read(addr)
+		rnd.Read(loc)
+	}
+	seek := func(txNum uint64) (v []byte, ok bool, err error) {
+		err = db.View(ctx, func(tx kv.Tx) error {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			v, ok, err = ac.HistorySeek(kv.AccountsHistory, addr, txNum, tx)
+			return err
+		})
+		return v, ok, err
+	}
+	prunedUpTo := func() (res uint64) {
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) (err error) {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			res, err = ac.PrunedUpTo(kv.AccountsHistory, tx)
+			return err
+		}))
+		return res
+	}
+	v5, ok5, err := seek(5)
+	require.NoError(t, err)
+	v40, ok40, err := seek(40)
+	require.NoError(t, err)
+	require.Zero(t, prunedUpTo())
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+	require.Equal(t, 5*agg.StepSize(), prunedUpTo())
+
+	// files cover pruned range: nothing changed
+	v, ok, err := seek(5)
+	require.NoError(t, err)
+	require.Equal(t, ok5, ok)
+	require.Equal(t, v5, v)
+
+	// 1st step of history is not in files anymore
+	for _, dir := range []string{agg.dirs.SnapHistory, agg.dirs.SnapIdx, agg.dirs.SnapAccessors} {
+		files, err := filepath.Glob(filepath.Join(dir, "*-accounts.0-1.*"))
+		require.NoError(t, err)
+		for _, f := range files {
+			require.NoError(t, os.Remove(f))
+		}
+	}
+	require.NoError(t, agg.OpenFolder())
+
+	_, _, err = seek(5)
+	require.ErrorIs(t, err, ErrPrunedHistory)
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, _, err := ac.DomainGetAsOf(tx, kv.AccountsDomain, addr, 5)
+		require.ErrorIs(t, err, ErrPrunedHistory)
+		return nil
+	}))
+	v, ok, err = seek(40)
+	require.NoError(t, err)
+	require.Equal(t, ok40, ok)
+	require.Equal(t, v40, v)
+}
+
+func TestAggregatorV3_IIMergeSpanFactor(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	ii := agg.iis[kv.LogAddrIdxPos]
+	steps := uint64(8)
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	// only index has data and files: domains have nothing to merge - and limit merge of index by their files end
+	var expect []uint64
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		w := ac.iis[kv.LogAddrIdxPos].NewWriter()
+		defer w.close()
+		for txNum := uint64(0); txNum < steps*agg.StepSize(); txNum++ {
+			w.SetTxNum(txNum)
+			if err := w.Add([]byte{byte(txNum % 7)}); err != nil {
+				return err
+			}
+			if txNum%7 == 3 {
+				expect = append(expect, txNum)
+			}
+		}
+		return w.Flush(ctx, tx)
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		for step := uint64(0); step < steps; step++ {
+			coll, err := ii.collate(ctx, step, tx)
+			require.NoError(t, err)
+			sf, err := ii.buildFiles(ctx, step, coll, background.NewProgressSet())
+			require.NoError(t, err)
+			ii.integrateDirtyFiles(sf, step*agg.StepSize(), (step+1)*agg.StepSize())
+		}
+		return nil
+	}))
+	agg.recalcVisibleFiles()
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.iis[kv.LogAddrIdxPos].Prune(ctx, tx, 0, steps*agg.StepSize(), 0, logEvery, false, nil)
+		return err
+	}))
+	visibleFiles := func() []string {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		return ac.iis[kv.LogAddrIdxPos].Files()
+	}
+	require.Len(t, visibleFiles(), int(steps))
+
+	require.NoError(t, agg.MergeLoop(ctx))
+	require.Len(t, visibleFiles(), int(steps))
+
+	agg.SetIIMergeSpanFactor(1)
+	require.NoError(t, agg.MergeLoop(ctx))
+	require.Equal(t, []string{"v1-logaddrs.0-8.ef"}, visibleFiles())
+
+	// merged-away files are deleted
+	efs, err := filepath.Glob(filepath.Join(agg.dirs.SnapIdx, "*-logaddrs.*.ef"))
+	require.NoError(t, err)
+	require.Len(t, efs, 1)
+
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		it, err := ac.IndexRange(kv.LogAddrIdx, []byte{3}, -1, -1, order.Asc, -1, tx)
+		require.NoError(t, err)
+		txNums, err := iter.ToArrayU64(it)
+		require.NoError(t, err)
+		require.Equal(t, expect, txNums)
+		return nil
+	}))
+}
+
+func TestAggregatorV3_SetReadSource(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	key := make([]byte, length.Addr+length.Hash)
+	key[0] = 1
+	put := func(txNum uint64, v, prev []byte, prevStep uint64) {
+		t.Helper()
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		domains.SetTxNum(txNum)
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, key[:length.Addr], key[length.Addr:], v, prev, prevStep))
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		domains.Close()
+		require.NoError(t, rwTx.Commit())
+	}
+	put(1, []byte("old"), nil, 0)
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	put(agg.StepSize()+4, []byte("new"), []byte("old"), 0) // shadows value of files
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+
+	for _, tc := range []struct {
+		src          ReadSource
+		latest, asOf string
+		histFound    bool
+	}{
+		{ReadSourceAuto, "new", "new", true},
+		{ReadSourceFilesOnly, "old", "old", false},
+		{ReadSourceDbOnly, "new", "new", true},
+	} {
+		ac.SetReadSource(kv.StorageDomain, tc.src)
+		v, _, ok, err := ac.GetLatest(kv.StorageDomain, key[:length.Addr], key[length.Addr:], tx)
+		require.NoError(t, err)
+		require.True(t, ok, tc.src)
+		require.Equal(t, tc.latest, string(v), tc.src)
+
+		v, _, err = ac.DomainGetAsOf(tx, kv.StorageDomain, key, 2*agg.StepSize())
+		require.NoError(t, err)
+		require.Equal(t, tc.asOf, string(v), tc.src)
+
+		// before "new" was written
+		v, ok, err = ac.HistorySeek(kv.StorageHistory, key, agg.StepSize(), tx)
+		require.NoError(t, err)
+		require.Equal(t, tc.histFound, ok, tc.src)
+		if ok {
+			require.Equal(t, "old", string(v), tc.src)
+		}
+	}
+}
+
+func TestAggregatorV3_FilesRetention(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 2)
+	require.Empty(t, agg.FilesRetention())
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.NoError(t, agg.MergeLoop(ctx)) // steps 0-1 and 1-2 merged into 0-2, but `ac` still holds them
+
+	report := agg.FilesRetention()
+	require.NotEmpty(t, report)
+	for _, f := range report {
+		require.True(t, f.CanDelete, f.FileName)
+		require.Positive(t, f.RefCount, f.FileName)
+		require.Len(t, f.Views, 1, f.FileName)
+		require.Equal(t, ac.ViewID(), f.Views[0].ID)
+		require.FileExists(t, f.FilePath)
+	}
+
+	ac.Close()
+	require.Empty(t, agg.FilesRetention())
+	for _, f := range report {
+		require.NoFileExists(t, f.FilePath)
+	}
+}
+
+// registry of open views is sharded: concurrent BeginFilesRo/Close don't share lock, waitEmpty sees all shards
+func TestOpenViews(t *testing.T) {
+	var v openViews
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ac := &AggregatorRoTx{id: uint64(i*1000 + j)}
+				v.add(ac)
+				v.del(ac)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Zero(t, v.count.Load())
+	require.Empty(t, v.waitEmpty(time.Hour))
+
+	ac1, ac2 := &AggregatorRoTx{id: 1}, &AggregatorRoTx{id: 1 + openViewsShards} // same shard
+	v.add(ac1)
+	v.add(ac2)
+	v.del(ac1)
+	require.Equal(t, []*AggregatorRoTx{ac2}, v.waitEmpty(time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		v.del(ac2)
+	}()
+	require.Empty(t, v.waitEmpty(time.Hour))
+}
+
+func TestAggregatorV3_MinimalFileSet(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx, logger := context.Background(), log.New()
+	buildRandomSteps(t, db, agg, 3)
+
+	_, err := agg.MinimalFileSet(agg.StepSize() - 1)
+	require.Error(t, err)
+	set, err := agg.MinimalFileSet(math.MaxUint64)
+	require.NoError(t, err)
+
+	// copy to fresh datadir: only .kv files with accessors and sidecars, empty db
+	dirs := datadir.New(t.TempDir())
+	require.Contains(t, set, agg.d[kv.AccountsDomain].kvFilePath(0, 1)+stepSizeSuffix)
+	for _, f := range set {
+		require.NotContains(t, []string{".v", ".vi", ".ef", ".efi"}, filepath.Ext(strings.TrimSuffix(f, stepSizeSuffix)))
+		rel, err := filepath.Rel(agg.dirs.DataDir, f)
+		require.NoError(t, err)
+		require.NoError(t, os.Link(f, filepath.Join(dirs.DataDir, rel)))
+	}
+	minimalDB := mdbx.NewMDBX(logger).InMem(dirs.Chaindata).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	t.Cleanup(minimalDB.Close)
+	minimal, err := NewAggregator(ctx, dirs, agg.StepSize(), minimalDB, nil, agg.commitmentValuesTransform, logger)
+	require.NoError(t, err)
+	t.Cleanup(minimal.Close)
+	require.NoError(t, minimal.SetLatestStateOnly(true).OpenFolder())
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	minimalTx, err := minimalDB.BeginRo(ctx)
+	require.NoError(t, err)
+	defer minimalTx.Rollback()
+	minimalAc := minimal.BeginFilesRo()
+	defer minimalAc.Close()
+	require.Equal(t, ac.MinimaxTxNum(true), minimalAc.MinimaxTxNum(true))
+
+	rnd := rand.New(rand.NewSource(0)) // same keys as buildRandomSteps
+	for txNum := uint64(1); txNum <= 3*agg.StepSize(); txNum++ {
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		if txNum%5 != 0 {
+			continue
+		}
+		for _, q := range []struct {
+			domain kv.Domain
+			k, k2  []byte
+		}{{kv.AccountsDomain, addr, nil}, {kv.StorageDomain, addr, loc}} {
+			expect, _, ok, err := ac.GetLatest(q.domain, q.k, q.k2, tx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			v, _, ok, err := minimalAc.GetLatest(q.domain, q.k, q.k2, minimalTx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, expect, v)
+		}
+		_, _, err = minimalAc.HistorySeek(kv.AccountsHistory, addr, txNum, minimalTx)
+		require.ErrorIs(t, err, ErrHistoryExpired)
+	}
+}
+
+func TestAggregatorV3_CleanupOrphanedAccessors(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 2)
+
+	d := agg.d[kv.AccountsDomain]
+	legit := d.kvBtFilePath(0, 1)
+	require.FileExists(t, legit)
+	orphan := d.kvBtFilePath(100, 101)
+	require.NoError(t, os.WriteFile(orphan, []byte{1}, 0644))
+	orphanIdx := d.History.InvertedIndex.efAccessorFilePath(100, 101)
+	require.NoError(t, os.WriteFile(orphanIdx, []byte{1}, 0644))
+	orphanStep := d.History.vFilePath(100, 101) + stepSizeSuffix
+	require.NoError(t, os.WriteFile(orphanStep, []byte{1}, 0644))
+	orphans := []string{orphan, orphanIdx, orphanStep}
+
+	removed, err := agg.CleanupOrphanedAccessors(ctx, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, orphans, removed)
+	for _, f := range orphans {
+		require.FileExists(t, f)
+	}
+
+	removed, err = agg.CleanupOrphanedAccessors(ctx, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, orphans, removed)
+	for _, f := range orphans {
+		require.NoFileExists(t, f)
+	}
+	require.FileExists(t, legit)
+	require.FileExists(t, d.kvFilePath(0, 1))
+	require.FileExists(t, d.kvFilePath(0, 1)+stepSizeSuffix)
+	require.FileExists(t, d.History.vFilePath(0, 1)+stepSizeSuffix)
+
+	removed, err = agg.CleanupOrphanedAccessors(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+}
+
+func TestAggregatorV3_CloneRace(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+	buildRandomSteps(t, db, agg, 8)
+
+	ac := agg.BeginFilesRo()
+	clone := ac.Clone()
+	require.NotEqual(t, ac.ViewID(), clone.ViewID())
+	require.Equal(t, ac.Files(), clone.Files())
+	clone.Close()
+	clone.Close() // safe to close twice
+	require.NotEmpty(t, ac.Files())
+
+	var captured []*filesItem
+	for _, d := range ac.d {
+		for _, f := range d.files {
+			captured = append(captured, f.src)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c := ac.Clone()
+				c2 := c.Clone()
+				c.Close()
+				if len(c2.Files()) == 0 {
+					panic("clone must see files of parent")
+				}
+				c2.Close()
+			}
+		}()
+	}
+	for {
+		somethingMerged, err := agg.mergeLoopStep(ctx)
+		require.NoError(t, err)
+		if !somethingMerged {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// merged files are still used by `ac` - can't be removed yet
+	for _, src := range captured {
+		require.NotNil(t, src.decompressor)
+	}
+	ac.Close()
+	for _, src := range captured {
+		require.Zero(t, src.refcount.Load())
+		if src.canDelete.Load() {
+			require.Nil(t, src.decompressor) // last reader removed it
+		}
+	}
+}
+
+func TestAggregatorV3_UnsupportedFileVersion(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	buildRandomSteps(t, db, agg, 2)
+	filesBefore := agg.Files()
+	require.NotEmpty(t, filesBefore)
+
+	// file produced by newer Erigon
+	future := "v2-accounts.0-1.kv"
+	require.NoError(t, os.WriteFile(filepath.Join(agg.dirs.SnapDomain, future), []byte("future format"), 0644))
+	futureAccessor := "v3-storage.0-1.kvi"
+	require.NoError(t, os.WriteFile(filepath.Join(agg.dirs.SnapAccessors, futureAccessor), []byte("future format"), 0644))
+
+	err := agg.OpenFolder()
+	var versionErr *UnsupportedFileVersionError
+	require.ErrorAs(t, err, &versionErr)
+	require.Len(t, versionErr.Files, 2)
+	require.Equal(t, future, versionErr.Files[0].Name)
+	require.Equal(t, uint64(2), versionErr.Files[0].Version)
+	require.Equal(t, futureAccessor, versionErr.Files[1].Name)
+	require.ErrorContains(t, err, future)
+	require.ErrorAs(t, agg.OpenList(nil, false), &versionErr)
+
+	// escape hatch: skipped files are not opened, rest of folder is opened
+	agg.SkipFilesVersionCheck(future, futureAccessor)
+	require.NoError(t, agg.OpenFolder())
+	require.Equal(t, filesBefore, agg.Files())
+}
+
+func TestAggregatorV3_CommitmentMergeRangeReconcile(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	agg.commitmentValuesTransform = CommitmentValuesTransformAtMerge
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := uint64(4000)
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		buf := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum*1e6), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+		if (txNum+1)%agg.StepSize() == 0 {
+			_, err := domains.ComputeCommitment(ctx, true, txNum/10, "")
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	for step := uint64(0); step < txs/agg.StepSize(); step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	r := ac.findMergeRange(agg.visibleFilesMinimaxTxNum.Load(), StepsInColdFile*agg.StepSize())
+	require.True(t, r.domain[kv.CommitmentDomain].values)
+
+	// accounts/storage qualify only for 2-step merge, while commitment for 4-step merge
+	step := agg.StepSize()
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		r.domain[d].valuesStartTxNum, r.domain[d].valuesEndTxNum = 0, 2*step
+	}
+	r.domain[kv.CommitmentDomain].valuesStartTxNum, r.domain[kv.CommitmentDomain].valuesEndTxNum = 0, 4*step
+	ac.reconcileCommitmentMergeRange(&r)
+	require.True(t, r.domain[kv.CommitmentDomain].values)
+	require.Equal(t, uint64(0), r.domain[kv.CommitmentDomain].valuesStartTxNum)
+	require.Equal(t, 2*step, r.domain[kv.CommitmentDomain].valuesEndTxNum)
+
+	sf, err := ac.staticFilesInRange(r)
+	require.NoError(t, err)
+	mf, err := ac.mergeFiles(ctx, sf, r)
+	require.NoError(t, err)
+	agg.integrateMergedDirtyFiles(sf, mf)
+	require.FileExists(t, agg.d[kv.CommitmentDomain].kvFilePath(0, 2))
+
+	// accounts and storage ranges don't match each other: commitment values merge skipped
+	r.domain[kv.StorageDomain].valuesEndTxNum = 4 * step
+	r.domain[kv.CommitmentDomain].valuesStartTxNum, r.domain[kv.CommitmentDomain].valuesEndTxNum = 0, 4*step
+	ac.reconcileCommitmentMergeRange(&r)
+	require.False(t, r.domain[kv.CommitmentDomain].values)
+}
+
+func TestAggregatorV3_CommitmentFilesRoots(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 10)
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	// commitment is computed at the last txNum of each step: file of step S stores root of block S
+	txs := 4 * agg.StepSize()
+	roots := map[uint64][]byte{} // blockNum -> root
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(0); txNum < txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		rnd.Read(addr)
+		buf := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum*1e6), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		if (txNum+1)%agg.StepSize() == 0 {
+			blockNum := txNum / agg.StepSize()
+			rh, err := domains.ComputeCommitment(ctx, true, blockNum, "")
+			require.NoError(t, err)
+			roots[blockNum] = rh
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	require.NoError(t, agg.BuildFiles(txs))
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	fileRoots, err := ac.CommitmentFilesRoots()
+	require.NoError(t, err)
+	require.NotEmpty(t, fileRoots)
+	for _, fr := range fileRoots {
+		require.Equal(t, fr.EndTxNum-1, fr.TxNum, fr.FileName)
+		require.Equal(t, roots[fr.BlockNum], fr.Root, fr.FileName)
+	}
+}
+
+func TestAggregatorV3_BuildStats(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 1000)
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		buf := types.EncodeAccountBytesV3(1, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	require.Nil(t, agg.LastBuildStats())
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	stats := agg.LastBuildStats()
+	require.NotNil(t, stats)
+	require.Equal(t, uint64(0), stats.Step)
+	require.Positive(t, stats.Took)
+	require.Positive(t, stats.CollateWorkers)
+	require.Positive(t, stats.CompressWorkers)
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		ds := stats.Domains[d]
+		require.Equal(t, int(agg.StepSize()), ds.Keys, d.String())
+		require.Positive(t, ds.HistoryKeys, d.String())
+		require.Positive(t, ds.CollatedBytes, d.String())
+		require.Positive(t, ds.OutputBytes, d.String())
+		require.Positive(t, ds.CollateTook, d.String())
+		require.Positive(t, ds.BuildTook, d.String())
+	}
+	require.Zero(t, stats.Domains[kv.CodeDomain].Keys)
+	require.Equal(t, 2*int(agg.StepSize()), stats.Keys())
+	require.Positive(t, stats.OutputBytes())
+	require.Positive(t, stats.CollateMBs())
+	require.Positive(t, stats.BuildMBs())
+}
+
 func TestAggregatorV3_RestartOnDatadir(t *testing.T) {
 	//t.Skip()
 	t.Run("BPlus", func(t *testing.T) {
@@ -349,7 +2201,7 @@ func aggregatorV3_RestartOnDatadir(t *testing.T, rc runCfg) {
 		AnyTimes()
 
 	// Start another aggregator on same datadir
-	anotherAgg, err := NewAggregator(context.Background(), agg.dirs, aggStep, db, canonicalsReader, logger)
+	anotherAgg, err := NewAggregator(context.Background(), agg.dirs, aggStep, db, canonicalsReader, agg.commitmentValuesTransform, logger)
 	require.NoError(t, err)
 	defer anotherAgg.Close()
 
@@ -799,7 +2651,7 @@ func TestAggregatorV3_RestartOnFiles(t *testing.T) {
 			return it, nil
 		}).
 		AnyTimes()
-	newAgg, err := NewAggregator(context.Background(), agg.dirs, aggStep, newDb, canonicalsReader, logger)
+	newAgg, err := NewAggregator(context.Background(), agg.dirs, aggStep, newDb, canonicalsReader, agg.commitmentValuesTransform, logger)
 	require.NoError(t, err)
 	require.NoError(t, newAgg.OpenFolder())
 
@@ -819,11 +2671,12 @@ func TestAggregatorV3_RestartOnFiles(t *testing.T) {
 	t.Logf("seek to latest_tx=%d", latestTx)
 
 	miss := uint64(0)
+	var stored []byte
 	for i, key := range keys {
 		if uint64(i+1) >= txs-aggStep {
 			continue // finishtx always stores last agg step in db which we deleted, so missing  values which were not aggregated is expected
 		}
-		stored, _, _, err := ac.GetLatest(kv.AccountsDomain, key[:length.Addr], nil, newTx)
+		stored, _, _, err = ac.GetLatestInto(kv.AccountsDomain, key[:length.Addr], nil, stored, newTx)
 		require.NoError(t, err)
 		if len(stored) == 0 {
 			miss++
@@ -1081,16 +2934,382 @@ func generateKV(tb testing.TB, tmp string, keySize, valueSize, keyCount int, log
 	return decomp.FilePath()
 }
 
+func TestAggregatorV3_RegisterAppendable(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New()
+	aggStep, steps := uint64(16), uint64(4)
+	dirs := datadir.New(t.TempDir())
+	const table = "L2Messages"
+	db := mdbx.NewMDBX(logger).InMem(dirs.Chaindata).GrowthStep(32 * datasize.MB).MapSize(2 * datasize.GB).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		cfg := kv.TableCfg{table: kv.TableCfgItem{}}
+		for name, item := range kv.ChaindataTablesCfg {
+			cfg[name] = item
+		}
+		return cfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+
+	// all txs are canonical: TxnId == txNum
+	ctrl := gomock.NewController(t)
+	canonicalsReader := NewMockCanonicalsReader(ctrl)
+	canonicalsReader.EXPECT().TxnIdsOfCanonicalBlocks(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(tx kv.Tx, txFrom, txTo int, by order.By, limit int) (iter.U64, error) {
+			if txTo < 0 {
+				txTo = txFrom + limit
+			}
+			return iter.Range[uint64](uint64(txFrom), uint64(txTo)), nil
+		}).
+		AnyTimes()
+
+	agg, err := NewAggregator(ctx, dirs, aggStep, db, canonicalsReader, DefaultCommitmentValuesTransform, logger)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	pos := kv.CustomAppendable(0)
+	require.NoError(t, agg.RegisterAppendable(pos, AppendableCfg{}, "l2msgs", table))
+	require.Error(t, agg.RegisterAppendable(pos, AppendableCfg{}, "other", "Other"))
+	require.Error(t, agg.RegisterAppendable(kv.AppendableMax, AppendableCfg{}, "other", "Other"))
+	// file names would collide with other components
+	require.ErrorContains(t, agg.RegisterAppendable(kv.CustomAppendable(1), AppendableCfg{}, "l2msgs", "Other"), "name is taken")
+	require.ErrorContains(t, agg.RegisterAppendable(kv.CustomAppendable(1), AppendableCfg{}, kv.FileAccountDomain, "Other"), "name is taken")
+	require.ErrorContains(t, agg.RegisterAppendable(kv.CustomAppendable(1), AppendableCfg{}, kv.FileLogAddressIdx, "Other"), "name is taken")
+	require.ErrorContains(t, agg.RegisterAppendable(kv.CustomAppendable(1), AppendableCfg{}, "other", table), "table")
+	require.NoError(t, agg.OpenFolder())
+	agg.DisableFsync()
+	require.Error(t, agg.RegisterAppendable(kv.CustomAppendable(1), AppendableCfg{}, "late", "Late"))
+
+	// last step stays in DB
+	txs := (steps + 1) * aggStep
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for i := uint64(0); i < txs; i++ {
+			if err := ac.AppendablePut(pos, kv.TxnId(i), hexutility.EncodeTs(i), tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	buildRandomSteps(t, db, agg, steps)
+
+	ac := agg.BeginFilesRo()
+	require.Len(t, ac.appendable[pos].files, int(steps))
+	ac.Close()
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, stat, err := ac.pruneSmallBatches(ctx, time.Hour, tx)
+		if err != nil {
+			return err
+		}
+		// keyed by position: unique, unlike names
+		require.Len(t, stat.Appendable, 1)
+		require.NotNil(t, stat.Appendable[pos.String()])
+		require.NotZero(t, stat.Appendable[pos.String()].PruneCountTx)
+		return nil
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		from, _ := agg.ap[pos].stepsRangeInDB(tx)
+		require.Equal(t, float64(steps), from)
+		return nil
+	}))
+
+	require.NoError(t, agg.MergeLoop(ctx))
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	require.Less(t, len(ac.appendable[pos].files), int(steps))
+	require.Equal(t, steps*aggStep, ac.appendable[pos].files.EndTxNum())
+
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		for i := uint64(0); i < txs; i++ {
+			v, ok, err := ac.AppendableGet(pos, kv.TxnId(i), tx)
+			require.NoError(t, err)
+			require.True(t, ok, i)
+			require.Equal(t, hexutility.EncodeTs(i), v, i)
+		}
+		return nil
+	}))
+	_, _, err = ac.AppendableGet(kv.CustomAppendable(1), 0, nil)
+	require.ErrorIs(t, err, ErrAppendableNotRegistered)
+}
+
+func TestAggregatorPruneStat_Appendable(t *testing.T) {
+	a, b := newAggregatorPruneStat(), newAggregatorPruneStat()
+	require.True(t, a.PrunedNothing())
+	b.Appendable[kv.CustomAppendable(0).String()] = &AppendablePruneStat{MinTxNum: 10, MaxTxNum: 20, PruneCountTx: 10}
+	b.Appendable[kv.CustomAppendable(1).String()] = &AppendablePruneStat{MinTxNum: math.MaxUint64}
+	require.False(t, b.PrunedNothing())
+
+	a.Accumulate(b)
+	a.Accumulate(&AggregatorPruneStat{Appendable: map[string]*AppendablePruneStat{
+		kv.CustomAppendable(0).String(): {MinTxNum: 20, MaxTxNum: 30, PruneCountTx: 10},
+	}})
+	require.Equal(t, &AppendablePruneStat{MinTxNum: 10, MaxTxNum: 30, PruneCountTx: 20}, a.Appendable[kv.CustomAppendable(0).String()])
+	require.True(t, a.Appendable[kv.CustomAppendable(1).String()].PrunedNothing())
+	require.Equal(t, "custom0| ap 20 txs in 0.00M-0.00M", a.String())
+
+	var empty AggregatorPruneStat // nil maps
+	empty.Accumulate(a)
+	require.Len(t, empty.Appendable, 2)
+}
+
+func TestAggregatorV3_MakeStepsIndicesAndAppendables(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New()
+	aggStep, steps := uint64(2), uint64(StepsInColdFile)
+	dirs := datadir.New(t.TempDir())
+	const table = "L2Messages"
+	db := mdbx.NewMDBX(logger).InMem(dirs.Chaindata).GrowthStep(32 * datasize.MB).MapSize(2 * datasize.GB).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		cfg := kv.TableCfg{table: kv.TableCfgItem{}}
+		for name, item := range kv.ChaindataTablesCfg {
+			cfg[name] = item
+		}
+		return cfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+
+	// all txs are canonical: TxnId == txNum
+	ctrl := gomock.NewController(t)
+	canonicalsReader := NewMockCanonicalsReader(ctrl)
+	canonicalsReader.EXPECT().TxnIdsOfCanonicalBlocks(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(tx kv.Tx, txFrom, txTo int, by order.By, limit int) (iter.U64, error) {
+			if txTo < 0 {
+				txTo = txFrom + limit
+			}
+			return iter.Range[uint64](uint64(txFrom), uint64(txTo)), nil
+		}).
+		AnyTimes()
+
+	agg, err := NewAggregator(ctx, dirs, aggStep, db, canonicalsReader, DefaultCommitmentValuesTransform, logger)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	pos := kv.CustomAppendable(0)
+	require.NoError(t, agg.RegisterAppendable(pos, AppendableCfg{}, "l2msgs", table))
+	require.NoError(t, agg.OpenFolder())
+	agg.DisableFsync()
+
+	txs := steps * aggStep
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(0); txNum < txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(1, uint256.NewInt(txNum), nil, 0), nil, 0))
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc, []byte{addr[0], loc[0]}, nil, 0))
+		require.NoError(t, domains.DomainPut(kv.CodeDomain, addr, nil, []byte{addr[0]}, nil, 0))
+		require.NoError(t, domains.IndexAdd(kv.TblLogAddressIdx, addr))
+		require.NoError(t, ac.AppendablePut(pos, kv.TxnId(txNum), hexutility.EncodeTs(txNum), rwTx))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+
+	for step := uint64(0); step < steps; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	aggSteps, err := agg.MakeSteps()
+	require.NoError(t, err)
+	require.Len(t, aggSteps, 1)
+	st := aggSteps[0]
+	from, to := st.TxNumRange()
+	require.Equal(t, uint64(0), from)
+	require.Equal(t, txs, to)
+
+	// direct read of frozen log addresses file: max txNum of every key
+	var expectTxs []uint64
+	agg.iis[kv.LogAddrIdxPos].dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if !item.frozen {
+				continue
+			}
+			g := item.decompressor.MakeGetter()
+			for g.HasNext() {
+				g.SkipUncompressed()
+				val, _ := g.NextUncompressed()
+				ef, _ := eliasfano32.ReadEliasFano(val)
+				expectTxs = append(expectTxs, ef.Max())
+			}
+		}
+		return true
+	})
+	require.Len(t, expectTxs, int(txs))
+
+	checkStep := func(t *testing.T, st *AggregatorStep) {
+		t.Helper()
+		var logAddrTxs []uint64
+		for it := st.IterateLogAddrTxs(); it.HasNext(); {
+			txNum, err := it.Next()
+			require.NoError(t, err)
+			logAddrTxs = append(logAddrTxs, txNum)
+		}
+		require.Equal(t, expectTxs, logAddrTxs)
+
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		var txNum uint64
+		for it := st.AppendableValues(pos); it.HasNext(); txNum++ {
+			v, err := it.Next()
+			require.NoError(t, err)
+			require.Equal(t, hexutility.EncodeTs(txNum), v, txNum)
+			fromFile, ok := ac.appendable[pos].getFromFiles(txNum)
+			require.True(t, ok)
+			require.Equal(t, fromFile, v, txNum)
+		}
+		require.Equal(t, txs, txNum)
+
+		// other indices have no data, but have files
+		require.NotNil(t, st.IterateIdxTxs(kv.TracesToIdxPos))
+		require.False(t, st.IterateIdxTxs(kv.TracesToIdxPos).HasNext())
+		require.Nil(t, st.AppendableValues(kv.CustomAppendable(1)))
+	}
+	checkStep(t, st)
+	checkStep(t, st.Clone())
+}
+
+func TestAggregatorV3_CloseWaitsForOpenViews(t *testing.T) {
+	t.Run("waits", func(t *testing.T) {
+		_, agg := testDbAndAggregatorv3(t, 16)
+		ac := agg.BeginFilesRo()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			agg.Close()
+		}()
+		select {
+		case <-closed:
+			t.Fatal("Close must wait for open view")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		ac.Close()
+		select {
+		case <-closed:
+		case <-time.After(DefaultAggCloseTimeout / 2):
+			t.Fatal("Close must return after last view closed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, agg := testDbAndAggregatorv3(t, 16)
+		var logs bytes.Buffer
+		logger := log.New()
+		logger.SetHandler(log.StreamHandler(&logs, log.LogfmtFormat()))
+		agg.logger = logger
+		agg.SetCloseTimeout(50 * time.Millisecond)
+
+		ac := agg.BeginFilesRo()
+		started := time.Now()
+		agg.Close()
+		require.Less(t, time.Since(started), DefaultAggCloseTimeout)
+		require.Contains(t, logs.String(), "timeout waiting for open views")
+		require.Contains(t, logs.String(), fmt.Sprintf("id=%d", ac.ViewID()))
+
+		ac.Close() // late close of view: no crash
+	})
+}
+
+func TestAggregatorV3_Refresh(t *testing.T) {
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.SetCloseTimeout(time.Minute)
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	for txNum := uint64(0); txNum < 3*agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, []byte{1}))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	for step := uint64(0); step < 2; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	ii := agg.iis[kv.LogAddrIdxPos]
+	fPath := ii.efFilePath(1, 2)
+	_, fName := filepath.Split(fPath)
+	movedPath := filepath.Join(t.TempDir(), fName)
+	require.Contains(t, agg.Files(), fName)
+
+	t.Run("removed", func(t *testing.T) {
+		old := agg.BeginFilesRo() // holds file
+		defer old.Close()
+		require.NoError(t, os.Rename(fPath, movedPath))
+
+		// file is detached right away, but closed only after `old` view is closed
+		timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		added, removed, err := agg.Refresh(timeoutCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Empty(t, added)
+		require.Equal(t, []string{fName}, removed)
+
+		fresh := agg.BeginFilesRo()
+		defer fresh.Close()
+		require.NotContains(t, fresh.Files(), fName)
+		require.Len(t, fresh.iis[kv.LogAddrIdxPos].files, 1)
+
+		// old view still reads file
+		oldFiles := old.iis[kv.LogAddrIdxPos].files
+		require.Len(t, oldFiles, 2)
+		require.NotNil(t, oldFiles[1].src.decompressor)
+		g := oldFiles[1].src.decompressor.MakeGetter()
+		require.True(t, g.HasNext())
+		item := oldFiles[1].src
+		old.Close()
+
+		added, removed, err = agg.Refresh(ctx)
+		require.NoError(t, err)
+		require.Empty(t, added)
+		require.Empty(t, removed)
+		require.Nil(t, item.decompressor)
+	})
+
+	t.Run("added", func(t *testing.T) {
+		require.NoError(t, os.Rename(movedPath, fPath))
+		added, removed, err := agg.Refresh(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{fName}, added)
+		require.Empty(t, removed)
+
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		require.Contains(t, ac.Files(), fName)
+		require.Len(t, ac.iis[kv.LogAddrIdxPos].files, 2)
+	})
+}
+
 func testDbAndAggregatorv3(t *testing.T, aggStep uint64) (kv.RwDB, *Aggregator) {
 	t.Helper()
-	require := require.New(t)
 	dirs := datadir.New(t.TempDir())
 	logger := log.New()
 	db := mdbx.NewMDBX(logger).InMem(dirs.Chaindata).GrowthStep(32 * datasize.MB).MapSize(2 * datasize.GB).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
 		return kv.ChaindataTablesCfg
-	}).MustOpen()
+	}).TrackReaders(0).MustOpen()
 	t.Cleanup(db.Close)
+	return db, testAggregatorv3(t, db, dirs, aggStep, DefaultCommitmentValuesTransform)
+}
 
+// testAggregatorv3 - opens aggregator on existing db and dirs
+func testAggregatorv3(t *testing.T, db kv.RoDB, dirs datadir.Dirs, aggStep uint64, commitmentValuesTransform CommitmentValuesTransformMode) *Aggregator {
+	t.Helper()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	canonicalsReader := NewMockCanonicalsReader(ctrl)
@@ -1098,13 +3317,13 @@ func testDbAndAggregatorv3(t *testing.T, aggStep uint64) (kv.RwDB, *Aggregator)
 		Return(iter.EmptyU64, nil).
 		AnyTimes()
 
-	agg, err := NewAggregator(context.Background(), dirs, aggStep, db, canonicalsReader, logger)
-	require.NoError(err)
+	agg, err := NewAggregator(context.Background(), dirs, aggStep, db, canonicalsReader, commitmentValuesTransform, log.New())
+	require.NoError(t, err)
 	t.Cleanup(agg.Close)
 	err = agg.OpenFolder()
-	require.NoError(err)
+	require.NoError(t, err)
 	agg.DisableFsync()
-	return db, agg
+	return agg
 }
 
 // generate test data for table tests, containing n; n < 20 keys of length 20 bytes and values of length <= 16 bytes
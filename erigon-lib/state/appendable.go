@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"os"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -86,6 +87,9 @@ type Appendable struct {
 	compression     FileCompression
 	compressWorkers int
 	indexList       idxList
+
+	// onMergeTmpSize - size changes of temporary files of merge, see Aggregator.addMergeDiskInFlight
+	onMergeTmpSize func(delta int64)
 }
 
 type AppendableCfg struct {
@@ -171,8 +175,10 @@ func (ap *Appendable) scanStateFiles(fileNames []string) (garbageFiles []*filesI
 			continue
 		}
 
-		startTxNum, endTxNum := startStep*ap.aggregationStep, endStep*ap.aggregationStep
-		var newFile = newFilesItem(startTxNum, endTxNum, ap.aggregationStep)
+		stepSize, recorded := recordedStepSize(ap.apFilePath(startStep, endStep), ap.aggregationStep, ap.logger)
+		startTxNum, endTxNum := startStep*stepSize, endStep*stepSize
+		var newFile = newFilesItem(startTxNum, endTxNum, stepSize)
+		newFile.stepSizeUnknown = !recorded
 
 		if ap.integrityCheck != nil && !ap.integrityCheck(startStep, endStep) {
 			continue
@@ -194,7 +200,7 @@ func (ap *Appendable) reCalcVisibleFiles() {
 func (ap *Appendable) missedAccessors() (l []*filesItem) {
 	ap.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/ap.aggregationStep, item.endTxNum/ap.aggregationStep
+			fromStep, toStep := item.steps()
 			exists, err := dir.FileExist(ap.accessorFilePath(fromStep, toStep))
 			if err != nil {
 				panic(err)
@@ -247,8 +253,8 @@ func (ap *Appendable) BuildMissedAccessors(ctx context.Context, g *errgroup.Grou
 	for _, item := range ap.missedAccessors() {
 		item := item
 		g.Go(func() error {
-			fromStep, toStep := item.startTxNum/ap.aggregationStep, item.endTxNum/ap.aggregationStep
-			return ap.buildAccessor(ctx, fromStep, toStep, item.decompressor, ps)
+			fromStep, toStep := item.steps()
+			return indexBuildFailed(item, ap.buildAccessor(ctx, fromStep, toStep, item.decompressor, ps))
 		})
 	}
 }
@@ -259,7 +265,7 @@ func (ap *Appendable) openFiles() error {
 	ap.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			item := item
-			fromStep, toStep := item.startTxNum/ap.aggregationStep, item.endTxNum/ap.aggregationStep
+			fromStep, toStep := item.steps()
 			if item.decompressor == nil {
 				fPath := ap.apFilePath(fromStep, toStep)
 				exists, err := dir.FileExist(fPath)
@@ -369,6 +375,64 @@ func (tx *AppendableRoTx) Append(txnID kv.TxnId, v []byte, dbtx kv.RwTx) error {
 	return dbtx.Put(tx.ap.table, hexutility.EncodeTs(uint64(txnID)), v)
 }
 
+var ErrAppendableExists = errors.New("appendable: txnID already has value")
+
+// BulkAppend - writes values of txnIDs [firstTxnID, firstTxnID+len(values)). While txnIDs go after last txnID in table -
+// uses cursor's Append (fast path, no page splits), otherwise falls back to Put. Value of already present txnID is
+// ErrAppendableExists, unless `replace` is set. Returns amount of values written by fast path.
+func (tx *AppendableRoTx) BulkAppend(firstTxnID kv.TxnId, values [][]byte, replace bool, dbtx kv.RwTx) (fastPath int, err error) {
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if uint64(firstTxnID) > math.MaxUint64-uint64(len(values)-1) {
+		return 0, fmt.Errorf("BulkAppend %s: txnIDs overflow: first=%d, amount=%d", tx.ap.filenameBase, firstTxnID, len(values))
+	}
+	c, err := dbtx.RwCursor(tx.ap.table)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	lastK, _, err := c.Last()
+	if err != nil {
+		return 0, err
+	}
+	hasLast := len(lastK) > 0
+	var last uint64
+	if hasLast {
+		last = binary.BigEndian.Uint64(lastK)
+	}
+
+	for i, v := range values {
+		txnID := uint64(firstTxnID) + uint64(i)
+		k := hexutility.EncodeTs(txnID)
+		if !hasLast || txnID > last {
+			if err := c.Append(k, v); err != nil {
+				return fastPath, err
+			}
+			fastPath++
+			last, hasLast = txnID, true
+			continue
+		}
+
+		existing, _, err := c.SeekExact(k)
+		if err != nil {
+			return fastPath, err
+		}
+		if existing != nil {
+			if !replace {
+				return fastPath, fmt.Errorf("BulkAppend %s: %w: txnID=%d", tx.ap.filenameBase, ErrAppendableExists, txnID)
+			}
+			if err := c.DeleteCurrent(); err != nil { // in DupSort table Put would add 2nd value
+				return fastPath, err
+			}
+		}
+		if err := c.Put(k, v); err != nil {
+			return fastPath, err
+		}
+	}
+	return fastPath, nil
+}
+
 func (tx *AppendableRoTx) getFromFiles(ts uint64) (v []byte, ok bool) {
 	i, ok := tx.fileByTS(ts)
 	if !ok {
@@ -483,17 +547,19 @@ func (tx *AppendableRoTx) newWriter(tmpdir string, discard bool) *appendableBuff
 
 func (ap *Appendable) BeginFilesRo() *AppendableRoTx {
 	files := ap._visibleFiles
-	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
-	}
+	files.refAll()
 	return &AppendableRoTx{
 		ap:    ap,
 		files: files,
 	}
 }
 
+// clone - see AggregatorRoTx.Clone
+func (tx *AppendableRoTx) clone() *AppendableRoTx {
+	tx.files.refAll()
+	return &AppendableRoTx{ap: tx.ap, files: tx.files}
+}
+
 func (tx *AppendableRoTx) Close() {
 	if tx.files == nil { // invariant: it's safe to call Close multiple times
 		return
@@ -502,7 +568,7 @@ func (tx *AppendableRoTx) Close() {
 	tx.files = nil
 	for i := range files {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -570,6 +636,8 @@ type AppendablePruneStat struct {
 	PruneCountTx uint64
 }
 
+func (is *AppendablePruneStat) PrunedNothing() bool { return is.PruneCountTx == 0 }
+
 func (is *AppendablePruneStat) String() string {
 	if is.MinTxNum == math.MaxUint64 && is.PruneCountTx == 0 {
 		return ""
@@ -697,6 +765,7 @@ func (ap *Appendable) collate(ctx context.Context, step uint64, roTx kv.Tx) (App
 		if err != nil {
 			return coll, fmt.Errorf("collate %s: %w", ap.filenameBase, err)
 		}
+		coll.marker.add(k)
 		v, ok, err := ap.getFromDBByTs(k, roTx)
 		if err != nil {
 			return coll, fmt.Errorf("collate %s: %w", ap.filenameBase, err)
@@ -745,6 +814,7 @@ func (sf AppendableFiles) CleanupOnError() {
 type AppendableCollation struct {
 	iiPath string
 	writer ArchiveWriter
+	marker appendableMarker
 }
 
 func (collation AppendableCollation) Close() {
@@ -795,6 +865,12 @@ func (ap *Appendable) buildFiles(ctx context.Context, step uint64, coll Appendab
 	if decomp, err = seg.NewDecompressor(coll.iiPath); err != nil {
 		return AppendableFiles{}, fmt.Errorf("open %s decompressor: %w", ap.filenameBase, err)
 	}
+	if err = ap.writeMarker(coll.iiPath, coll.marker); err != nil {
+		return AppendableFiles{}, fmt.Errorf("write %s canonical marker: %w", ap.filenameBase, err)
+	}
+	if err = writeStepSize(coll.iiPath, ap.aggregationStep, ap.noFsync); err != nil {
+		return AppendableFiles{}, fmt.Errorf("write %s step size: %w", ap.filenameBase, err)
+	}
 
 	if err := ap.buildAccessor(ctx, step, step+1, decomp, ps); err != nil {
 		return AppendableFiles{}, fmt.Errorf("build %s api: %w", ap.filenameBase, err)
@@ -807,6 +883,102 @@ func (ap *Appendable) buildFiles(ctx context.Context, step uint64, coll Appendab
 	return AppendableFiles{decomp: decomp, index: index}, nil
 }
 
+// appendableMarker - canonical chain marker of .ap file: txnIds of canonical blocks which file was built from.
+// Unwind + re-execution gives new txnIds to same txNums, so marker of file built before unwind doesn't match current canonical chain.
+// Stored in `<file>.ap.canonical` sidecar.
+type appendableMarker struct {
+	firstTxnID, lastTxnID, count uint64
+}
+
+const appendableMarkerSuffix = ".canonical"
+
+var ErrAppendableUnwound = errors.New("appendable: file built before unwind, must be rebuilt")
+
+func (m *appendableMarker) add(txnID uint64) {
+	if m.count == 0 {
+		m.firstTxnID = txnID
+	}
+	m.lastTxnID = txnID
+	m.count++
+}
+
+// concat - marker of file which is concatenation of `m` and `next`
+func (m appendableMarker) concat(next appendableMarker) appendableMarker {
+	if m.count == 0 {
+		return next
+	}
+	if next.count == 0 {
+		return m
+	}
+	return appendableMarker{firstTxnID: m.firstTxnID, lastTxnID: next.lastTxnID, count: m.count + next.count}
+}
+
+func (m appendableMarker) String() string {
+	if m.count == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d(%d)", m.firstTxnID, m.lastTxnID, m.count)
+}
+
+func (ap *Appendable) writeMarker(apPath string, m appendableMarker) error {
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint64(buf, m.firstTxnID)
+	binary.BigEndian.PutUint64(buf[8:], m.lastTxnID)
+	binary.BigEndian.PutUint64(buf[16:], m.count)
+	if ap.noFsync {
+		return os.WriteFile(apPath+appendableMarkerSuffix, buf, 0644)
+	}
+	return dir.WriteFileWithFsync(apPath+appendableMarkerSuffix, buf, 0644)
+}
+
+// readMarker - ok=false for files built before markers were introduced
+func (ap *Appendable) readMarker(apPath string) (m appendableMarker, ok bool, err error) {
+	buf, err := os.ReadFile(apPath + appendableMarkerSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, false, nil
+		}
+		return m, false, err
+	}
+	if len(buf) != 24 {
+		return m, false, fmt.Errorf("%s: corrupted canonical marker, len=%d", path.Base(apPath), len(buf))
+	}
+	m = appendableMarker{firstTxnID: binary.BigEndian.Uint64(buf), lastTxnID: binary.BigEndian.Uint64(buf[8:]), count: binary.BigEndian.Uint64(buf[16:])}
+	return m, true, nil
+}
+
+// checkCanonicalLineage - merge input files must be built from same canonical chain: file built before unwind
+// has values of renumbered txnIds and merging it with newer files interleaves stale values.
+// Validated only by markers recorded at build time: bodies of merged steps may be already pruned from DB,
+// so canonical txnIds can't be re-read. Markers of consecutive files must go strictly forward.
+// Returns marker of merged file. ok=false if some input has no marker (then merged file has no marker too).
+func (tx *AppendableRoTx) checkCanonicalLineage(files []*filesItem) (merged appendableMarker, ok bool, err error) {
+	markers := make([]appendableMarker, len(files))
+	ok = true
+	for i, item := range files {
+		var has bool
+		if markers[i], has, err = tx.ap.readMarker(item.decompressor.FilePath()); err != nil {
+			return merged, false, err
+		}
+		ok = ok && has
+	}
+
+	prev := -1 // last file with non-empty marker
+	for i := range markers {
+		if markers[i].count == 0 {
+			continue
+		}
+		if prev >= 0 && markers[prev].lastTxnID >= markers[i].firstTxnID {
+			return merged, false, fmt.Errorf("%w: %s (canonical txnIds %s overlap with previous file %s %s)", ErrAppendableUnwound, files[i].decompressor.FileName(), markers[i], files[prev].decompressor.FileName(), markers[prev])
+		}
+		prev = i
+	}
+	for i := range markers {
+		merged = merged.concat(markers[i])
+	}
+	return merged, ok, nil
+}
+
 func (ap *Appendable) integrateDirtyFiles(sf AppendableFiles, txNumFrom, txNumTo uint64) {
 	fi := newFilesItem(txNumFrom, txNumTo, ap.aggregationStep)
 	fi.decompressor = sf.decomp
@@ -817,3 +989,48 @@ func (ap *Appendable) integrateDirtyFiles(sf AppendableFiles, txNumFrom, txNumTo
 func (tx *AppendableRoTx) Unwind(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, limit uint64, logEvery *time.Ticker, forced bool, fn func(key []byte, txnum []byte) error) error {
 	return nil //Appendable type is unwind-less. See docs of Appendable type.
 }
+
+// AppendableStep used for incremental processing of appendable, it isolates only one snapshot interval
+type AppendableStep struct {
+	item        *filesItem
+	compression FileCompression
+}
+
+// MakeSteps [0, toTxNum)
+func (ap *Appendable) MakeSteps(toTxNum uint64) []*AppendableStep {
+	var steps []*AppendableStep
+	ap.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
+				continue
+			}
+			steps = append(steps, &AppendableStep{item: item, compression: ap.compression})
+		}
+		return true
+	})
+	return steps
+}
+
+func (as *AppendableStep) Clone() *AppendableStep {
+	return &AppendableStep{item: as.item, compression: as.compression}
+}
+
+func (as *AppendableStep) iterateValues() *AppendableValuesIterator {
+	g := NewArchiveGetter(as.item.decompressor.MakeGetter(), as.compression)
+	g.Reset(0)
+	return &AppendableValuesIterator{g: g}
+}
+
+// AppendableValuesIterator - values of one appendable file in order of canonical txnIds
+type AppendableValuesIterator struct {
+	g   ArchiveGetter
+	buf []byte
+}
+
+func (it *AppendableValuesIterator) HasNext() bool { return it.g.HasNext() }
+
+// Next - value is valid until next call
+func (it *AppendableValuesIterator) Next() ([]byte, error) {
+	it.buf, _ = it.g.Next(it.buf[:0])
+	return it.buf, nil
+}
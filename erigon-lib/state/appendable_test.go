@@ -34,8 +34,10 @@ import (
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon-lib/seg"
@@ -179,6 +181,67 @@ func TestAppendableCollationBuild(t *testing.T) {
 
 }
 
+func TestAppendableMergeRefusesUnwoundFiles(t *testing.T) {
+	db, ii, _ := filledAppendableOfSize(t, 64, 16, log.New())
+	ctx, require := context.Background(), require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	iters := NewMockCanonicalsReader(ctrl)
+	iters.EXPECT().TxnIdsOfCanonicalBlocks(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(tx kv.Tx, txFrom, txTo int, by order.By, i3 int) (iter.U64, error) {
+			return iter.Array[uint64]([]uint64{uint64(txFrom) + 1, uint64(txFrom) + 2}), nil
+		}).
+		AnyTimes()
+	ii.cfg.iters = iters
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	for step := uint64(0); step < 2; step++ {
+		coll, err := ii.collate(ctx, step, tx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, step, coll, background.NewProgressSet())
+		require.NoError(err)
+		ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+	}
+	tx.Rollback()
+	ii.reCalcVisibleFiles()
+
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	outs := ic.staticFilesInRange(0, 2*ii.aggregationStep)
+	require.Len(outs, 2)
+
+	// file built after unwind and re-execution: same txNums got newer txnIds than next file, which was built before unwind
+	unwoundPath := outs[0].decompressor.FilePath()
+	good, ok, err := ii.readMarker(unwoundPath)
+	require.NoError(err)
+	require.True(ok)
+	require.NoError(ii.writeMarker(unwoundPath, appendableMarker{firstTxnID: 100, lastTxnID: 101, count: 2}))
+
+	// lineage is validated by markers only: canonical txnIds are not re-read (bodies of merged steps may be pruned)
+	ii.cfg.iters = nil
+	_, err = ic.mergeFiles(ctx, outs, 0, 2*ii.aggregationStep, background.NewProgressSet())
+	require.ErrorIs(err, ErrAppendableUnwound)
+	require.Contains(err.Error(), outs[0].decompressor.FileName())
+	require.Contains(err.Error(), outs[1].decompressor.FileName())
+	exists, err := dir.FileExist(ii.apFilePath(0, 2))
+	require.NoError(err)
+	require.False(exists)
+
+	// consistent files merge as before
+	require.NoError(ii.writeMarker(unwoundPath, good))
+	in, err := ic.mergeFiles(ctx, outs, 0, 2*ii.aggregationStep, background.NewProgressSet())
+	require.NoError(err)
+	defer in.closeFilesAndRemove()
+	require.Equal(4, in.decompressor.Count())
+	merged, ok, err := ii.readMarker(in.decompressor.FilePath())
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(appendableMarker{firstTxnID: 1, lastTxnID: 18, count: 4}, merged)
+}
+
 func filledAppendable(tb testing.TB, logger log.Logger) (kv.RwDB, *Appendable, uint64) {
 	tb.Helper()
 	return filledAppendableOfSize(tb, uint64(1000), 16, logger)
@@ -364,3 +427,81 @@ func TestAppendableCtxFiles(t *testing.T) {
 	require.Equal(t, 480, int(visibleFiles[2].startTxNum))
 	require.Equal(t, 512, int(visibleFiles[2].endTxNum))
 }
+
+func TestAppendableBulkAppend(t *testing.T) {
+	logger := log.New()
+	ctx, require := context.Background(), require.New(t)
+	const n = 10_000
+	values := make([][]byte, n)
+	for i := range values {
+		values[i] = hexutility.EncodeTs(uint64(i) * 3)
+	}
+	readAll := func(db kv.RwDB, table string) (res [][]byte) {
+		require.NoError(db.View(ctx, func(tx kv.Tx) error {
+			return tx.ForEach(table, nil, func(k, v []byte) error {
+				res = append(res, common.Append(k, v))
+				return nil
+			})
+		}))
+		return res
+	}
+
+	loopDB, loopAp := testDbAndAppendable(t, 16, logger)
+	start := time.Now()
+	require.NoError(loopDB.Update(ctx, func(tx kv.RwTx) error {
+		ic := loopAp.BeginFilesRo()
+		defer ic.Close()
+		for i, v := range values {
+			if err := ic.Append(kv.TxnId(i), v, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	loopTook := time.Since(start)
+
+	db, ap := testDbAndAppendable(t, 16, logger)
+	start = time.Now()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	ic := ap.BeginFilesRo()
+	defer ic.Close()
+	fastPath, err := ic.BulkAppend(0, values[:n/2], false, tx)
+	require.NoError(err)
+	require.Equal(n/2, fastPath)
+	fastPath, err = ic.BulkAppend(n/2, values[n/2:], false, tx)
+	require.NoError(err)
+	require.Equal(n/2, fastPath)
+	require.NoError(tx.Commit())
+	t.Logf("per-call: %s, bulk: %s", loopTook, time.Since(start))
+	require.Equal(readAll(loopDB, loopAp.table), readAll(db, ap.table))
+
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	// overlaps already present txnIDs
+	_, err = ic.BulkAppend(n-2, [][]byte{{1}, {2}, {3}}, false, tx)
+	require.ErrorIs(err, ErrAppendableExists)
+
+	// replace: 2 values by Put, then fast path again
+	fastPath, err = ic.BulkAppend(n-2, [][]byte{{1}, {2}, {3}}, true, tx)
+	require.NoError(err)
+	require.Equal(1, fastPath)
+	for txnID, expect := range map[kv.TxnId][]byte{n - 3: values[n-3], n - 2: {1}, n - 1: {2}, n: {3}} {
+		v, ok, err := ic.Get(txnID, tx)
+		require.NoError(err)
+		require.True(ok)
+		require.Equal(expect, v)
+	}
+
+	// gap in the middle is filled by Put
+	require.NoError(tx.Delete(ap.table, hexutility.EncodeTs(100)))
+	fastPath, err = ic.BulkAppend(100, [][]byte{{4}}, false, tx)
+	require.NoError(err)
+	require.Zero(fastPath)
+	v, ok, err := ic.Get(100, tx)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{4}, v)
+}
@@ -0,0 +1,265 @@
+// Package benchutil - helpers to benchmark reads from state files on real datadir (compare accessors, readahead modes, etc...)
+package benchutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+// KeySource - where to get keys for benchmark. If Keys is empty: Sample keys are reservoir-sampled from domain files.
+type KeySource struct {
+	Keys   [][]byte
+	Sample int
+	Seed   int64
+}
+
+func ExplicitKeys(keys [][]byte) KeySource { return KeySource{Keys: keys} }
+func SampleFromFiles(n int) KeySource      { return KeySource{Sample: n, Seed: 1} }
+
+type Config struct {
+	Domain    kv.Domain
+	Keys      KeySource
+	Workers   []int         // benchmark is run for each workers count
+	Duration  time.Duration // of 1 run
+	Warmup    time.Duration // reads before each run - not reported. default: Duration/10
+	AsOfTxNum uint64        // txNum for GetAsOf. 0 - don't benchmark GetAsOf
+	ReadAhead bool          // enable OS readahead of domain files
+}
+
+type OpReport struct {
+	Op            string
+	Workers       int
+	Ops           uint64
+	Throughput    float64 // ops/sec
+	P50, P95, P99 time.Duration
+}
+
+func (r OpReport) String() string {
+	return fmt.Sprintf("%s workers=%d ops=%d throughput=%.0f/s p50=%s p95=%s p99=%s", r.Op, r.Workers, r.Ops, r.Throughput, r.P50, r.P95, r.P99)
+}
+
+type BenchReport struct {
+	Domain  kv.Domain
+	Keys    int
+	Results []OpReport
+}
+
+func (r BenchReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "domain=%s keys=%d\n", r.Domain, r.Keys)
+	for _, res := range r.Results {
+		b.WriteString(res.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+const (
+	opGetLatest = "GetLatest"
+	opGetAsOf   = "GetAsOf"
+)
+
+// BenchmarkDomainReads - measures latency/throughput of domain reads. Every worker opens own `AggregatorRoTx` and `kv.Tx`:
+// both are not thread-safe.
+func BenchmarkDomainReads(ctx context.Context, db kv.RoDB, agg *state.Aggregator, cfg Config) (BenchReport, error) {
+	report := BenchReport{Domain: cfg.Domain}
+	if cfg.Duration <= 0 {
+		return report, errors.New("benchutil: duration must be positive")
+	}
+	if cfg.Warmup == 0 {
+		cfg.Warmup = cfg.Duration / 10
+	}
+	if len(cfg.Workers) == 0 {
+		cfg.Workers = []int{1}
+	}
+	for _, workers := range cfg.Workers {
+		if workers <= 0 {
+			return report, fmt.Errorf("benchutil: workers count must be positive, got %d", workers)
+		}
+	}
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	keys := cfg.Keys.Keys
+	if len(keys) == 0 {
+		var err error
+		if keys, err = ac.SampleDomainKeys(ctx, cfg.Domain, cfg.Keys.Sample, rand.New(rand.NewSource(cfg.Keys.Seed))); err != nil {
+			return report, err
+		}
+	}
+	if len(keys) == 0 {
+		return report, fmt.Errorf("benchutil: no keys for domain %s", cfg.Domain)
+	}
+	report.Keys = len(keys)
+
+	if cfg.ReadAhead {
+		defer ac.EnableDomainReadAhead(cfg.Domain)()
+	}
+
+	ops := []string{opGetLatest}
+	if cfg.AsOfTxNum > 0 {
+		ops = append(ops, opGetAsOf)
+	}
+	for _, op := range ops {
+		for _, workers := range cfg.Workers {
+			res, err := runOp(ctx, db, agg, cfg, op, workers, keys)
+			if err != nil {
+				return report, err
+			}
+			report.Results = append(report.Results, res)
+		}
+	}
+	return report, nil
+}
+
+func runOp(ctx context.Context, db kv.RoDB, agg *state.Aggregator, cfg Config, op string, workers int, keys [][]byte) (OpReport, error) {
+	hists := make([]latencyHist, workers)
+	var start sync.WaitGroup // all workers start measuring together: after own warmup
+	start.Add(workers)
+	var startedAt time.Time
+	var startOnce sync.Once
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < workers; i++ {
+		i := i
+		g.Go(func() error {
+			tx, err := db.BeginRo(ctx)
+			if err != nil {
+				start.Done()
+				return err
+			}
+			defer tx.Rollback()
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+
+			read := func(k []byte) error {
+				if op == opGetAsOf {
+					_, _, err := ac.DomainGetAsOf(tx, cfg.Domain, k, cfg.AsOfTxNum)
+					return err
+				}
+				_, _, _, err := ac.GetLatest(cfg.Domain, k, nil, tx)
+				return err
+			}
+
+			// each worker walks keys from own offset - to not read same keys at same time
+			j := i * len(keys) / workers
+			warmupUntil := time.Now().Add(cfg.Warmup)
+			for time.Now().Before(warmupUntil) {
+				if err := read(keys[j%len(keys)]); err != nil {
+					start.Done()
+					return err
+				}
+				j++
+			}
+			start.Done()
+			start.Wait()
+			startOnce.Do(func() { startedAt = time.Now() })
+
+			h := &hists[i]
+			deadline := time.Now().Add(cfg.Duration)
+			for n := 0; ; n++ {
+				if n%1024 == 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					default:
+					}
+				}
+				t := time.Now()
+				if !t.Before(deadline) {
+					return nil
+				}
+				if err := read(keys[j%len(keys)]); err != nil {
+					return err
+				}
+				h.add(time.Since(t))
+				j++
+			}
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return OpReport{}, err
+	}
+	elapsed := time.Since(startedAt)
+
+	var total latencyHist
+	for i := range hists {
+		total.merge(&hists[i])
+	}
+	return OpReport{
+		Op:         op,
+		Workers:    workers,
+		Ops:        total.count,
+		Throughput: float64(total.count) / elapsed.Seconds(),
+		P50:        total.quantile(0.50),
+		P95:        total.quantile(0.95),
+		P99:        total.quantile(0.99),
+	}, nil
+}
+
+// latencyHist - log-linear histogram of nanoseconds: 16 linear sub-buckets per power of 2 (~6% precision).
+// Fixed-size - no allocations on hot path.
+type latencyHist struct {
+	buckets [64 * 16]uint64
+	count   uint64
+}
+
+func bucketOf(ns uint64) int {
+	if ns < 16 {
+		return int(ns)
+	}
+	exp := bits.Len64(ns) - 5
+	return (exp+1)*16 + int((ns>>exp)&15)
+}
+
+func bucketValue(idx int) uint64 {
+	if idx < 16 {
+		return uint64(idx)
+	}
+	exp := idx/16 - 1
+	return uint64(16+idx%16) << exp
+}
+
+func (h *latencyHist) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.buckets[bucketOf(uint64(d))]++
+	h.count++
+}
+
+func (h *latencyHist) merge(o *latencyHist) {
+	for i := range h.buckets {
+		h.buckets[i] += o.buckets[i]
+	}
+	h.count += o.count
+}
+
+func (h *latencyHist) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+	var seen uint64
+	for i, c := range h.buckets {
+		seen += c
+		if seen > rank {
+			return time.Duration(bucketValue(i))
+		}
+	}
+	return time.Duration(bucketValue(len(h.buckets) - 1))
+}
@@ -0,0 +1,110 @@
+package benchutil
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/kv/temporal"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+func testAggWithFiles(t *testing.T, txs uint64) (kv.RwDB, *state.Aggregator) {
+	t.Helper()
+	ctx := context.Background()
+	dirs := datadir.New(t.TempDir())
+	logger := log.New()
+	db := memdb.NewTestDB(t)
+	agg, err := state.NewAggregator(ctx, dirs, 16, db, nil, state.DefaultCommitmentValuesTransform, logger)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	require.NoError(t, agg.OpenFolder())
+	agg.DisableFsync()
+	tdb, err := temporal.New(db, agg)
+	require.NoError(t, err)
+
+	require.NoError(t, tdb.Update(ctx, func(tx kv.RwTx) error {
+		domains, err := state.NewSharedDomains(tx, logger)
+		if err != nil {
+			return err
+		}
+		defer domains.Close()
+		var k, v [8]byte
+		for txNum := uint64(1); txNum <= txs; txNum++ {
+			domains.SetTxNum(txNum)
+			binary.BigEndian.PutUint64(k[:], txNum%32)
+			binary.BigEndian.PutUint64(v[:], txNum)
+			if err := domains.DomainPut(kv.AccountsDomain, k[:], nil, v[:], nil, 0); err != nil {
+				return err
+			}
+		}
+		return domains.Flush(ctx, tx)
+	}))
+	require.NoError(t, agg.BuildFiles(txs))
+	return tdb, agg
+}
+
+func TestBenchmarkDomainReads(t *testing.T) {
+	db, agg := testAggWithFiles(t, 160)
+
+	report, err := BenchmarkDomainReads(context.Background(), db, agg, Config{
+		Domain:    kv.AccountsDomain,
+		Keys:      SampleFromFiles(16),
+		Workers:   []int{1, 2},
+		Duration:  50 * time.Millisecond,
+		AsOfTxNum: 100,
+		ReadAhead: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 16, report.Keys)
+	require.Len(t, report.Results, 4)
+	for _, res := range report.Results {
+		require.Positive(t, res.Ops, res.String())
+		require.Positive(t, res.Throughput, res.String())
+		require.Positive(t, res.P50, res.String())
+		require.LessOrEqual(t, res.P50, res.P95, res.String())
+		require.LessOrEqual(t, res.P95, res.P99, res.String())
+	}
+
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	report, err = BenchmarkDomainReads(context.Background(), db, agg, Config{
+		Domain:   kv.AccountsDomain,
+		Keys:     ExplicitKeys([][]byte{k[:]}),
+		Duration: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Keys)
+	require.Len(t, report.Results, 1)
+
+	_, err = BenchmarkDomainReads(context.Background(), db, agg, Config{
+		Domain:   kv.AccountsDomain,
+		Keys:     ExplicitKeys([][]byte{k[:]}),
+		Workers:  []int{1, 0},
+		Duration: 10 * time.Millisecond,
+	})
+	require.ErrorContains(t, err, "workers count must be positive")
+}
+
+func TestLatencyHist(t *testing.T) {
+	var h latencyHist
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Microsecond)
+	}
+	require.Equal(t, uint64(1000), h.count)
+	require.InEpsilon(t, float64(500*time.Microsecond), float64(h.quantile(0.5)), 0.07)
+	require.InEpsilon(t, float64(990*time.Microsecond), float64(h.quantile(0.99)), 0.07)
+
+	for _, ns := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 1 << 40} {
+		v := bucketValue(bucketOf(ns))
+		require.LessOrEqual(t, v, ns)
+		require.GreaterOrEqual(t, float64(v), float64(ns)*0.93)
+	}
+}
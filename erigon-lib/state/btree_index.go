@@ -22,6 +22,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
@@ -720,7 +721,13 @@ func CreateBtreeIndexWithDecompressor(indexPath string, M uint64, decompressor *
 // OpenBtreeIndexAndDataFile opens btree index file and data file and returns it along with BtIndex instance
 // Mostly useful for testing
 func OpenBtreeIndexAndDataFile(indexPath, dataPath string, M uint64, compressed FileCompression, trace bool) (*seg.Decompressor, *BtIndex, error) {
-	kv, err := seg.NewDecompressor(dataPath)
+	return OpenBtreeIndexAndDataFileWithDictionary(indexPath, dataPath, nil, M, compressed)
+}
+
+// OpenBtreeIndexAndDataFileWithDictionary - same as OpenBtreeIndexAndDataFile, for data file built with external
+// compression dictionary (see Aggregator.SetCompressionDictionary)
+func OpenBtreeIndexAndDataFileWithDictionary(indexPath, dataPath string, dict *seg.Dictionary, M uint64, compressed FileCompression) (*seg.Decompressor, *BtIndex, error) {
+	kv, err := seg.NewDecompressorWithDictionary(dataPath, dict)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -810,12 +817,14 @@ func OpenBtreeIndexWithDecompressor(indexPath string, M uint64, kv *seg.Decompre
 	if err != nil {
 		return nil, err
 	}
+	dir.TrackOpenFile(indexPath)
 	if idx.size == 0 {
 		return idx, nil
 	}
 
 	idx.m, err = mmap.MapRegion(idx.file, int(idx.size), mmap.RDONLY, 0, 0)
 	if err != nil {
+		idx.Close()
 		return nil, err
 	}
 	idx.data = idx.m[:idx.size]
@@ -929,61 +938,94 @@ func (b *BtIndex) Close() {
 		if err := b.file.Close(); err != nil {
 			log.Log(dbg.FileCloseLogLevel, "close", "err", err, "file", b.FileName(), "stack", dbg.Stack())
 		}
+		dir.UntrackOpenFile(b.filePath)
 		b.file = nil
 	}
 }
 
 // Get - exact match of key. `k == nil` - means not found
 func (b *BtIndex) Get(lookup []byte, gr ArchiveGetter) (k, v []byte, found bool, err error) {
-	// TODO: optimize by "push-down" - instead of using seek+compare, alloc can have method Get which will return nil if key doesn't exists
-	// alternativaly: can allocate cursor on-stack
-	// 	it := Iter{} // allocation on stack
-	//  it.Initialize(file)
+	v, found, err = b.GetInto(lookup, nil, gr)
+	if err != nil || !found {
+		return nil, nil, false, err
+	}
+	return lookup, v, true, nil // index finds only exact match of key
+}
 
+// GetInto - like Get, but skips key and reads value into `valBuf`. Uncompressed values are returned as sub-slice of mmap.
+func (b *BtIndex) GetInto(lookup, valBuf []byte, gr ArchiveGetter) (v []byte, found bool, err error) {
 	if b.Empty() {
-		return k, v, false, nil
+		return nil, false, nil
 	}
 
 	var index uint64
-	// defer func() {
-	// 	fmt.Printf("[Bindex][%s] Get (%t) '%x' -> '%x' di=%d err %v\n", b.FileName(), found, lookup, v, index, err)
-	// }()
 	if UseBpsTree {
 		if b.bplus == nil {
-			panic(fmt.Errorf("Get: `b.bplus` is nil: %s", gr.FileName()))
+			panic(fmt.Errorf("GetInto: `b.bplus` is nil: %s", gr.FileName()))
 		}
-		// v is actual value, not offset.
-
-		// weak assumption that k will be ignored and used lookup instead.
-		// since fetching k and v from data file is required to use Getter.
-		// Why to do Getter.Reset twice when we can get kv right there.
-
-		k, found, index, err = b.bplus.Get(gr, lookup)
+		_, found, index, err = b.bplus.Get(gr, lookup)
 	} else {
 		if b.alloc == nil {
-			return k, v, false, err
+			return nil, false, nil
 		}
-		k, found, index, err = b.alloc.Get(gr, lookup)
+		_, found, index, err = b.alloc.Get(gr, lookup)
 	}
 	if err != nil || !found {
 		if errors.Is(err, ErrBtIndexLookupBounds) {
-			return k, v, false, nil
+			return nil, false, nil
 		}
-		return nil, nil, false, err
+		return nil, false, err
+	}
+	if index >= b.ef.Count() {
+		return nil, false, nil
 	}
 
-	// this comparation should be done by index get method, and in case of mismatch, key is not found
-	//if !bytes.Equal(k, lookup) {
-	//	return k, v, false, nil
-	//}
-	k, v, err = b.dataLookup(index, gr)
+	gr.Reset(b.ef.Get(index))
+	if !gr.HasNext() {
+		return nil, false, fmt.Errorf("pair %d/%d key not found, file: %s/%s", index, b.ef.Count(), b.FileName(), gr.FileName())
+	}
+	gr.Skip()
+	if !gr.HasNext() {
+		return nil, false, fmt.Errorf("pair %d/%d value not found, file: %s/%s", index, b.ef.Count(), b.FileName(), gr.FileName())
+	}
+	v, _ = gr.Next(valBuf[:0])
+	return v, true, nil
+}
+
+// BtRangeScan - streams key-value pairs of file in ascending order, starting from max(fromKey, prefix).
+// Stops at first key without `prefix` (nil - no bound), after `limit` pairs (-1 - no limit) or on error of `f`.
+// k, v are valid only inside `f`.
+func BtRangeScan(idx *BtIndex, getter ArchiveGetter, fromKey, prefix []byte, limit int, f func(k, v []byte) error) error {
+	if limit == 0 {
+		return nil
+	}
+	seek := fromKey
+	if bytes.Compare(seek, prefix) < 0 {
+		seek = prefix
+	}
+	cur, err := idx.Seek(getter, seek)
 	if err != nil {
-		if errors.Is(err, ErrBtIndexLookupBounds) {
-			return k, v, false, nil
+		return err
+	}
+	if cur == nil {
+		return nil
+	}
+	for {
+		if prefix != nil && !bytes.HasPrefix(cur.Key(), prefix) {
+			return nil
+		}
+		if err := f(cur.Key(), cur.Value()); err != nil {
+			return err
+		}
+		if limit > 0 {
+			if limit--; limit == 0 {
+				return nil
+			}
+		}
+		if !cur.Next() {
+			return nil
 		}
-		return k, v, false, err
 	}
-	return k, v, true, nil
 }
 
 // Seek moves cursor to position where key >= x.
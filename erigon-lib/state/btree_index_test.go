@@ -2,6 +2,8 @@ package state
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"path"
 	"path/filepath"
@@ -173,6 +175,86 @@ func Test_BtreeIndex_Build(t *testing.T) {
 	}
 }
 
+func TestBtRangeScan(t *testing.T) {
+	tmp := t.TempDir()
+	logger := log.New()
+	compressFlags := CompressKeys | CompressVals
+
+	// keys: 2-byte prefix 0x00..0x09 + 1 byte suffix 0..9
+	dataPath := filepath.Join(tmp, "scan.kv")
+	comp, err := seg.NewCompressor(context.Background(), "cmp", dataPath, tmp, seg.MinPatternScore, 1, log.LvlDebug, logger)
+	require.NoError(t, err)
+	comp.DisableFsync()
+	w := NewArchiveWriter(comp, compressFlags)
+	for p := byte(0); p < 10; p++ {
+		for i := byte(0); i < 10; i++ {
+			require.NoError(t, w.AddWord([]byte{0, p, i}))
+			require.NoError(t, w.AddWord([]byte{p, i, 0xff}))
+		}
+	}
+	require.NoError(t, w.Compress())
+	w.Close()
+	indexPath := filepath.Join(tmp, "scan.bt")
+	buildBtreeIndex(t, dataPath, indexPath, compressFlags, 1, logger, true)
+
+	kv, bt, err := OpenBtreeIndexAndDataFile(indexPath, dataPath, DefaultBtreeM, compressFlags, false)
+	require.NoError(t, err)
+	defer bt.Close()
+	defer kv.Close()
+	getter := NewArchiveGetter(kv.MakeGetter(), compressFlags)
+
+	scan := func(fromKey, prefix []byte, limit int) (keys [][]byte) {
+		t.Helper()
+		require.NoError(t, BtRangeScan(bt, getter, fromKey, prefix, limit, func(k, v []byte) error {
+			require.Equal(t, []byte{k[1], k[2], 0xff}, v)
+			keys = append(keys, common.Copy(k))
+			return nil
+		}))
+		return keys
+	}
+
+	require.Len(t, scan(nil, nil, -1), 100)
+	require.Empty(t, scan(nil, nil, 0))
+
+	keys := scan(nil, []byte{0, 3}, -1)
+	require.Len(t, keys, 10)
+	require.Equal(t, []byte{0, 3, 0}, keys[0])
+	require.Equal(t, []byte{0, 3, 9}, keys[9])
+
+	// last prefix: no keys after it
+	keys = scan(nil, []byte{0, 9}, -1)
+	require.Len(t, keys, 10)
+	require.Equal(t, []byte{0, 9, 9}, keys[9])
+
+	// prefix not in file
+	require.Empty(t, scan(nil, []byte{1}, -1))
+	require.Empty(t, scan(nil, []byte{0, 3, 10}, -1))
+
+	keys = scan(nil, []byte{0, 3}, 4)
+	require.Len(t, keys, 4)
+	require.Equal(t, []byte{0, 3, 3}, keys[3])
+
+	// fromKey inside prefix, before prefix and after prefix
+	keys = scan([]byte{0, 3, 7}, []byte{0, 3}, -1)
+	require.Equal(t, [][]byte{{0, 3, 7}, {0, 3, 8}, {0, 3, 9}}, keys)
+	require.Len(t, scan([]byte{0, 1}, []byte{0, 3}, -1), 10)
+	require.Empty(t, scan([]byte{0, 4}, []byte{0, 3}, -1))
+
+	// without prefix: till end or limit
+	keys = scan([]byte{0, 9, 8}, nil, -1)
+	require.Equal(t, [][]byte{{0, 9, 8}, {0, 9, 9}}, keys)
+	require.Len(t, scan([]byte{0, 5}, nil, 15), 15)
+
+	stop := errors.New("stop")
+	var cnt int
+	require.ErrorIs(t, BtRangeScan(bt, getter, nil, nil, -1, func(k, v []byte) error {
+		if cnt++; cnt == 3 {
+			return stop
+		}
+		return nil
+	}), stop)
+}
+
 // Opens .kv at dataPath and generates index over it to file 'indexPath'
 func buildBtreeIndex(tb testing.TB, dataPath, indexPath string, compressed FileCompression, seed uint32, logger log.Logger, noFsync bool) {
 	tb.Helper()
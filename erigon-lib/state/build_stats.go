@@ -0,0 +1,115 @@
+package state
+
+import (
+	"time"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/seg"
+)
+
+// DomainBuildStats - collate/build stats of 1 domain for 1 step. Gathered from Collation and StaticFiles - no extra pass over data.
+type DomainBuildStats struct {
+	Keys          int   // keys in .kv
+	HistoryKeys   int   // values in .v
+	CollatedBytes int64 // raw size of keys/values passed to compressors
+	OutputBytes   int64 // size of produced .kv, .v, .ef files
+	CollateTook   time.Duration
+	BuildTook     time.Duration
+}
+
+func (sf StaticFiles) outputBytes() (res int64) {
+	for _, d := range []*seg.Decompressor{sf.valuesDecomp, sf.historyDecomp, sf.efHistoryDecomp} {
+		if d != nil {
+			res += d.Size()
+		}
+	}
+	return res
+}
+
+// StepBuildStats - stats of 1 step files build. Durations use monotonic clock - not affected by wall-clock adjustments.
+type StepBuildStats struct {
+	Step            uint64
+	Domains         [kv.DomainLen]DomainBuildStats
+	Took            time.Duration
+	CollateWorkers  int
+	CompressWorkers int
+}
+
+func (s *StepBuildStats) Keys() (res int) {
+	for _, d := range s.Domains {
+		res += d.Keys
+	}
+	return res
+}
+
+func (s *StepBuildStats) OutputBytes() (res int64) {
+	for _, d := range s.Domains {
+		res += d.OutputBytes
+	}
+	return res
+}
+
+// CollateMBs - collate throughput of 1 worker: domains are collated in parallel
+func (s *StepBuildStats) CollateMBs() float64 {
+	var bytes int64
+	var took time.Duration
+	for _, d := range s.Domains {
+		bytes, took = bytes+d.CollatedBytes, took+d.CollateTook
+	}
+	return mbPerSec(bytes, took)
+}
+
+// BuildMBs - build (compress + index) throughput of 1 worker: domains are built in parallel
+func (s *StepBuildStats) BuildMBs() float64 {
+	var took time.Duration
+	for _, d := range s.Domains {
+		took += d.BuildTook
+	}
+	return mbPerSec(s.OutputBytes(), took)
+}
+
+func (s *StepBuildStats) logArgs() []interface{} {
+	return []interface{}{"step", s.Step, "took", s.Took, "keys", s.Keys(), "out", datasize.ByteSize(s.OutputBytes()).HR(),
+		"collate_mbs", s.CollateMBs(), "build_mbs", s.BuildMBs(), "collate_workers", s.CollateWorkers, "compress_workers", s.CompressWorkers}
+}
+
+func (s *StepBuildStats) observe() {
+	mxStepKeys.Observe(float64(s.Keys()))
+	mxStepOutputBytes.Observe(float64(s.OutputBytes()))
+	mxCollateThroughput.Observe(s.CollateMBs())
+	mxBuildThroughput.Observe(s.BuildMBs())
+}
+
+func mbPerSec(bytes int64, took time.Duration) float64 {
+	if took <= 0 {
+		return 0
+	}
+	return float64(bytes) / float64(datasize.MB) / took.Seconds()
+}
+
+// mergeSizes - total size of merge inputs and outputs
+func mergeSizes(files SelectedStaticFilesV3, mf MergedFilesV3) (in, out int64) {
+	sum := func(items ...*filesItem) (res int64) {
+		for _, item := range items {
+			if item != nil && item.decompressor != nil {
+				res += item.decompressor.Size()
+			}
+		}
+		return res
+	}
+	for id := range files.d {
+		in += sum(files.d[id]...) + sum(files.dIdx[id]...) + sum(files.dHist[id]...)
+		out += sum(mf.d[id], mf.dIdx[id], mf.dHist[id])
+	}
+	for id := range files.ii {
+		in += sum(files.ii[id]...)
+		out += sum(mf.iis[id])
+	}
+	for id := range files.appendable {
+		in += sum(files.appendable[id]...)
+		out += sum(mf.appendable[id])
+	}
+	return in, out
+}
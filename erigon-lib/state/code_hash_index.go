@@ -0,0 +1,292 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/seg"
+)
+
+// Code-hash index - optional accessor of CodeDomain .kv files: keccak(code) -> offset of key in .kv (.kvch, recsplit).
+// Allows to find code by hash without knowing address of contract. Values of steps which are not in files yet
+// are in kv.TblCodeHashes (maintained by domain writer while index is enabled).
+//
+// Same code of several addresses has 1 record: any of them. Recsplit has no negatives - value found by offset is
+// always verified by hash. Build and merge produce .kvch; .kv without it (built before index was enabled) is skipped -
+// if code is not found anywhere else, lookup fails with ErrCodeHashIndexNotBuilt. Existence filters (.kvei) are keyed
+// by address: not used here.
+
+// ErrCodeHashIndexDisabled - see Aggregator.SetCodeHashIndex
+var ErrCodeHashIndexDisabled = errors.New("code-hash index is disabled")
+
+// ErrCodeHashIndexNotBuilt - code not found, but some files have no .kvch: see Aggregator.BuildOptionalMissedIndices
+var ErrCodeHashIndexNotBuilt = errors.New("code-hash index is not built for all files")
+
+// SetCodeHashIndex - build code-hash index of CodeDomain files (adds time to files build) and keep kv.TblCodeHashes
+// for steps not in files yet. Must be called before OpenFolder and before first write. See AggregatorRoTx.CodeByHash
+func (a *Aggregator) SetCodeHashIndex(enabled bool) *Aggregator {
+	a.d[kv.CodeDomain].codeHashIndex = enabled
+	return a
+}
+
+// CodeByHash - code with keccak hash `hash`: from code-hash indices of CodeDomain files (newest first), then from DB.
+// Code is content-addressed: found code is correct for any block, but it's not a proof that some contract has it now
+// (after unwind DB may have code of unwound txs).
+func (ac *AggregatorRoTx) CodeByHash(hash common.Hash, tx kv.Tx) ([]byte, bool, error) {
+	return ac.d[kv.CodeDomain].codeByHash(hash[:], tx)
+}
+
+func (dt *DomainRoTx) codeByHash(hash []byte, tx kv.Tx) ([]byte, bool, error) {
+	if !dt.d.codeHashIndex {
+		return nil, false, fmt.Errorf("CodeByHash(%x): %w", hash, ErrCodeHashIndexDisabled)
+	}
+	var notIndexed []string
+	for i := len(dt.files) - 1; i >= 0; i-- {
+		if dt.files[i].src.codeHash == nil {
+			notIndexed = append(notIndexed, dt.files[i].src.decompressor.FileName())
+			continue
+		}
+		if v, ok := dt.codeByHashFromFile(i, hash); ok {
+			return v, true, nil
+		}
+	}
+	v, err := tx.GetOne(kv.TblCodeHashes, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(v) > 8 {
+		return common.Copy(v[8:]), true, nil
+	}
+	if len(notIndexed) > 0 {
+		return nil, false, fmt.Errorf("CodeByHash(%x): %w: %s", hash, ErrCodeHashIndexNotBuilt, strings.Join(notIndexed, ","))
+	}
+	return nil, false, nil
+}
+
+func (dt *DomainRoTx) codeByHashFromFile(i int, hash []byte) ([]byte, bool) {
+	g := dt.statelessGetter(i)
+	idx := dt.files[i].src.codeHash
+	if idx == nil || idx.Empty() {
+		return nil, false
+	}
+	reader := idx.GetReaderFromPool()
+	defer reader.Close()
+	offset, ok := reader.Lookup(hash)
+	if !ok || offset >= uint64(g.Size()) {
+		return nil, false
+	}
+	g.Reset(offset)
+	if !g.HasNext() {
+		return nil, false
+	}
+	g.Skip()
+	if !g.HasNext() {
+		return nil, false
+	}
+	v, _ := g.Next(nil)
+	if len(v) == 0 || !bytes.Equal(keccak(v), hash) { // hash is not in file: recsplit returned offset of other key
+		return nil, false
+	}
+	return v, true
+}
+
+func (d *Domain) kvCodeHashIdxFilePath(fromStep, toStep uint64) string {
+	return filepath.Join(d.dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kvch", d.filenameBase, fromStep, toStep))
+}
+
+// openCodeHashIdx - opens .kvch of `item` if it exists on disk. Errors are logged: file stays readable by scan
+func (d *Domain) openCodeHashIdx(item *filesItem, fromStep, toStep uint64) {
+	if item.codeHash != nil {
+		return
+	}
+	fPath := d.kvCodeHashIdxFilePath(fromStep, toStep)
+	exists, err := dir.FileExist(fPath)
+	if err != nil {
+		_, fName := filepath.Split(fPath)
+		d.logger.Warn("[agg] Domain.openFiles", "err", err, "f", fName)
+	}
+	if !exists {
+		return
+	}
+	if item.codeHash, err = recsplit.OpenIndex(fPath); err != nil {
+		_, fName := filepath.Split(fPath)
+		d.logger.Warn("[agg] Domain.openFiles", "err", err, "f", fName)
+	}
+}
+
+// buildCodeHashIdx - produces .kvch of `data`
+func (d *Domain) buildCodeHashIdx(ctx context.Context, fromStep, toStep uint64, data *seg.Decompressor, ps *background.ProgressSet) error {
+	idxPath := d.kvCodeHashIdxFilePath(fromStep, toStep)
+	_, fileName := filepath.Split(idxPath)
+	p := ps.AddNew(fileName, uint64(data.Count()/2))
+	defer ps.Delete(p)
+
+	defer data.EnableReadAhead().DisableReadAhead()
+
+	var rs *recsplit.RecSplit
+	for {
+		hashes, count, err := d.collectCodeHashes(ctx, data, p)
+		if err != nil {
+			return err
+		}
+		if rs == nil {
+			if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
+				KeyCount:   count,
+				Enums:      false,
+				BucketSize: 2000,
+				LeafSize:   8,
+				TmpDir:     d.dirs.Tmp,
+				IndexFile:  idxPath,
+				Salt:       d.salt,
+				NoFsync:    d.noFsync,
+			}, d.logger); err != nil {
+				hashes.Close()
+				return fmt.Errorf("create recsplit: %w", err)
+			}
+			defer rs.Close()
+			rs.LogLvl(log.LvlTrace)
+		}
+		if err = hashes.Load(nil, "", func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+			if err := rs.AddKey(k, binary.BigEndian.Uint64(v)); err != nil {
+				return fmt.Errorf("add idx key [%x]: %w", k, err)
+			}
+			return nil
+		}, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+			return err
+		}
+		if err = rs.Build(ctx); err != nil {
+			if rs.Collision() {
+				d.logger.Info("Building recsplit. Collision happened. It's ok. Restarting...")
+				rs.ResetNextSalt()
+				continue
+			}
+			return fmt.Errorf("build idx: %w", err)
+		}
+		return nil
+	}
+}
+
+// collectCodeHashes - sorted unique pairs keccak(code) -> offset of key in `data`. Empty values (deleted code) are skipped
+func (d *Domain) collectCodeHashes(ctx context.Context, data *seg.Decompressor, p *background.Progress) (unique *etl.Collector, count int, err error) {
+	all := etl.NewCollector("code hashes "+d.filenameBase, d.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize/8), d.logger).LogLvl(log.LvlTrace)
+	defer all.Close()
+
+	p.Processed.Store(0)
+	g := NewArchiveGetter(data.MakeGetter(), d.compression)
+	var keyPos, nextKeyPos uint64
+	var v []byte
+	var offset [8]byte
+	for g.HasNext() {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		g.Skip()
+		v, nextKeyPos = g.Next(v[:0])
+		if len(v) > 0 {
+			binary.BigEndian.PutUint64(offset[:], keyPos)
+			if err := all.Collect(keccak(v), offset[:]); err != nil {
+				return nil, 0, err
+			}
+		}
+		keyPos = nextKeyPos
+		p.Processed.Add(1)
+	}
+
+	unique = etl.NewCollector("code hashes unique "+d.filenameBase, d.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize/8), d.logger).LogLvl(log.LvlTrace)
+	var prev []byte
+	if err := all.Load(nil, "", func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		if bytes.Equal(k, prev) { // same code of several addresses
+			return nil
+		}
+		prev = append(prev[:0], k...)
+		count++
+		return unique.Collect(k, v)
+	}, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		unique.Close()
+		return nil, 0, err
+	}
+	return unique, count, nil
+}
+
+// missedCodeHashIdx - visible files without .kvch
+func (dt *DomainRoTx) missedCodeHashIdx() (l []ctxItem) {
+	for _, item := range dt.files {
+		fromStep, toStep := item.src.steps()
+		exists, err := dir.FileExist(dt.d.kvCodeHashIdxFilePath(fromStep, toStep))
+		if err != nil {
+			panic(err)
+		}
+		if !exists {
+			l = append(l, item)
+		}
+	}
+	return l
+}
+
+// buildMissedCodeHashIdx - .kvch of files produced by merge or built before index was enabled
+func (dt *DomainRoTx) buildMissedCodeHashIdx(ctx context.Context, ps *background.ProgressSet) error {
+	if !dt.d.codeHashIndex {
+		return nil
+	}
+	for _, item := range dt.missedCodeHashIdx() {
+		fromStep, toStep := item.src.steps()
+		if err := dt.d.buildCodeHashIdx(ctx, fromStep, toStep, item.src.decompressor, ps); err != nil {
+			return indexBuildFailed(item.src, fmt.Errorf("build %s code-hash index: %w", dt.d.filenameBase, err))
+		}
+	}
+	return nil
+}
+
+// openCodeHashIndices - opens .kvch of dirty files which don't have it open. Caller must hold lockDirtyFiles
+func (d *Domain) openCodeHashIndices() {
+	d.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor == nil {
+				continue
+			}
+			fromStep, toStep := item.steps()
+			d.openCodeHashIdx(item, fromStep, toStep)
+		}
+		return true
+	})
+}
+
+// codeHashLoadFunc - one flush may have same code written by several steps: record of newest step stays in
+// kv.TblCodeHashes, otherwise pruneCodeHash of older step would remove code which newer step still has
+func codeHashLoadFunc(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+	prev, err := table.Get(k)
+	if err != nil {
+		return err
+	}
+	if len(prev) >= 8 && ^binary.BigEndian.Uint64(prev[:8]) > ^binary.BigEndian.Uint64(v[:8]) {
+		return nil
+	}
+	return next(k, k, v)
+}
+
+// pruneCodeHash - removes `code` of pruned `step` from kv.TblCodeHashes, unless same code was written by newer step
+func pruneCodeHash(c kv.RwCursor, code []byte, step uint64) error {
+	if len(code) == 0 {
+		return nil
+	}
+	_, v, err := c.SeekExact(keccak(code))
+	if err != nil {
+		return err
+	}
+	if len(v) < 8 || ^binary.BigEndian.Uint64(v[:8]) > step {
+		return nil
+	}
+	return c.DeleteCurrent()
+}
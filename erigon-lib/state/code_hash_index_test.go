@@ -0,0 +1,217 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+func TestAggregatorV3_CodeByHash(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.SetCodeHashIndex(true)
+	ctx := context.Background()
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		a[0] = byte(i)
+		return a
+	}
+	code := func(name string) []byte { return []byte("code of " + name) }
+	hash := func(c []byte) (h common.Hash) { copy(h[:], keccak(c)); return h }
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	// step 0: a, b. step 1: same code `a` of other address, c. step 2 (stays in DB): d
+	puts := []struct {
+		txNum uint64
+		addr  int
+		name  string
+	}{{1, 1, "a"}, {5, 2, "b"}, {17, 3, "a"}, {20, 4, "c"}, {33, 5, "d"}}
+	for _, p := range puts {
+		domains.SetTxNum(p.txNum)
+		require.NoError(t, domains.DomainPut(kv.CodeDomain, addr(p.addr), nil, code(p.name), nil, 0))
+	}
+	domains.SetTxNum(47)
+	require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(100), nil, []byte{1}, nil, 0))
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+
+	// `a` of steps 0 and 1 in one flush: record of step 1 stays in DB after prune of step 0
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.TblCodeHashes, keccak(code("a")))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), ^binary.BigEndian.Uint64(v[:8]))
+		require.Equal(t, code("a"), v[8:])
+		return nil
+	}))
+	require.NoError(t, agg.buildFiles(ctx, 1))
+	for _, name := range []string{"v1-code.0-1.kvch", "v1-code.1-2.kvch"} {
+		require.FileExists(t, filepath.Join(agg.dirs.SnapDomain, name))
+	}
+
+	codeByHash := func(name string) (v []byte, ok bool) {
+		t.Helper()
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) (err error) {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			v, ok, err = ac.CodeByHash(hash(code(name)), tx)
+			return err
+		}))
+		return v, ok
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		for _, name := range []string{"a", "b", "c", "d"} {
+			v, ok := codeByHash(name)
+			require.True(t, ok, name)
+			require.Equal(t, code(name), v)
+		}
+		_, ok := codeByHash("unknown")
+		require.False(t, ok)
+	}
+
+	t.Run("files and db", check)
+
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		for name, inDB := range map[string]bool{"a": false, "b": false, "c": false, "d": true} {
+			v, err := tx.GetOne(kv.TblCodeHashes, keccak(code(name)))
+			require.NoError(t, err)
+			require.Equal(t, inDB, v != nil, name)
+		}
+		return nil
+	}))
+	t.Run("after prune", check)
+
+	require.NoError(t, agg.MergeLoop(ctx))
+	require.FileExists(t, filepath.Join(agg.dirs.SnapDomain, "v1-code.0-2.kvch"))
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	require.Len(t, ac.d[kv.CodeDomain].files, 1)
+	require.NotNil(t, ac.d[kv.CodeDomain].files[0].src.codeHash)
+	require.Equal(t, uint64(3), ac.d[kv.CodeDomain].files[0].src.codeHash.KeyCount(), "a, b, c: same code of 2 addresses is 1 key")
+	ac.Close()
+	t.Run("merged file", check)
+
+	agg.SetCodeHashIndex(false)
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, _, err := ac.CodeByHash(hash(code("a")), tx)
+		require.ErrorIs(t, err, ErrCodeHashIndexDisabled)
+		return nil
+	}))
+}
+
+func TestDomain_CodeHashIdxSameCode(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.SetCodeHashIndex(true)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+	for i := 0; i < 16; i++ {
+		domains.SetTxNum(uint64(i))
+		addr := make([]byte, length.Addr)
+		addr[0] = byte(i)
+		// 4 distinct codes, each of 4 addresses
+		require.NoError(t, domains.DomainPut(kv.CodeDomain, addr, nil, []byte(fmt.Sprintf("code %d", i%4)), nil, 0))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	require.NoError(t, agg.buildFiles(ctx, 0))
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	item := ac.d[kv.CodeDomain].files[0].src
+	require.Equal(t, uint64(4), item.codeHash.KeyCount())
+	for i := 0; i < 4; i++ {
+		v, ok := ac.d[kv.CodeDomain].codeByHashFromFile(0, keccak([]byte(fmt.Sprintf("code %d", i))))
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("code %d", i), string(v))
+	}
+}
+
+func TestAggregatorV3_CodeByHashIndexNotBuilt(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+	domains.SetTxNum(1)
+	require.NoError(t, domains.DomainPut(kv.CodeDomain, make([]byte, length.Addr), nil, []byte("code"), nil, 0))
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	require.NoError(t, agg.buildFiles(ctx, 0)) // before index was enabled: no .kvch
+
+	agg.SetCodeHashIndex(true)
+	codeByHash := func(code []byte) (v []byte, ok bool, err error) {
+		t.Helper()
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			var h common.Hash
+			copy(h[:], keccak(code))
+			v, ok, err = ac.CodeByHash(h, tx)
+			return nil
+		}))
+		return v, ok, err
+	}
+	_, _, err = codeByHash([]byte("code"))
+	require.ErrorIs(t, err, ErrCodeHashIndexNotBuilt)
+
+	require.NoError(t, agg.BuildOptionalMissedIndices(ctx, 1))
+	v, ok, err := codeByHash([]byte("code"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("code"), v)
+	_, ok, err = codeByHash([]byte("unknown"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
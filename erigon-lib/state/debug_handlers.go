@@ -0,0 +1,157 @@
+package state
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// RegisterDebugHandlers - read-only JSON views of Aggregator internals for incident response. Embedder mounts them on
+// existing pprof/metrics mux. Handlers don't open files views and don't touch DB - cheap enough to poll every few seconds.
+// nil `agg` - handlers respond with empty views
+//
+//	/debug/agg/files    - visible and dirty files of each domain, history and inverted index
+//	/debug/agg/activity - build/merge/prune activity, background progress, files generation
+//	/debug/agg/views    - open AggregatorRoTx with their ages
+func RegisterDebugHandlers(mux *http.ServeMux, agg *Aggregator) {
+	mux.HandleFunc("/debug/agg/files", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, agg.debugFiles())
+	})
+	mux.HandleFunc("/debug/agg/activity", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, agg.debugActivity())
+	})
+	mux.HandleFunc("/debug/agg/views", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, agg.debugViews())
+	})
+}
+
+func writeDebugJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type DebugFile struct {
+	Name      string `json:"name"` // empty if file is not open
+	FromStep  uint64 `json:"fromStep"`
+	ToStep    uint64 `json:"toStep"`
+	Frozen    bool   `json:"frozen"`
+	RefCount  int32  `json:"refCount"`
+	CanDelete bool   `json:"canDelete"`
+}
+
+type DebugFilesSet struct {
+	Name    string      `json:"name"` // filenameBase and kind: `accounts.kv`, `accounts.v`, `accounts.ef`
+	Visible []DebugFile `json:"visible"`
+	Dirty   []DebugFile `json:"dirty"`
+}
+
+func (a *Aggregator) debugFiles() []DebugFilesSet {
+	if a == nil {
+		return []DebugFilesSet{}
+	}
+	toDebugFile := func(item *filesItem) DebugFile {
+		f := DebugFile{
+			Frozen:    item.frozen,
+			RefCount:  item.refcount.Load(),
+			CanDelete: item.canDelete.Load(),
+		}
+		f.FromStep, f.ToStep = item.steps()
+		if item.decompressor != nil {
+			f.Name = item.decompressor.FileName()
+		}
+		return f
+	}
+	type component struct {
+		name    string
+		visible *[]ctxItem
+		dirty   interface {
+			Walk(func(items []*filesItem) bool)
+		}
+	}
+	var components []component
+	for _, d := range a.d {
+		components = append(components,
+			component{d.filenameBase + ".kv", &d._visibleFiles, d.dirtyFiles},
+			component{d.History.filenameBase + ".v", &d.History._visibleFiles, d.History.dirtyFiles},
+			component{d.History.InvertedIndex.filenameBase + ".ef", &d.History.InvertedIndex._visibleFiles, d.History.InvertedIndex.dirtyFiles})
+	}
+	for _, ii := range a.iis {
+		components = append(components, component{ii.filenameBase + ".ef", &ii._visibleFiles, ii.dirtyFiles})
+	}
+
+	res := make([]DebugFilesSet, len(components))
+	a.rlockVisibleFiles()
+	for i, c := range components {
+		res[i] = DebugFilesSet{Name: c.name, Visible: make([]DebugFile, 0, len(*c.visible)), Dirty: []DebugFile{}}
+		for _, item := range *c.visible {
+			res[i].Visible = append(res[i].Visible, toDebugFile(item.src))
+		}
+	}
+	a.runlockVisibleFiles()
+
+	a.lockDirtyFiles()
+	for i, c := range components {
+		c.dirty.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				res[i].Dirty = append(res[i].Dirty, toDebugFile(item))
+			}
+			return true
+		})
+	}
+	a.unlockDirtyFiles()
+	return res
+}
+
+type DebugActivity struct {
+	BuildingFiles           bool            `json:"buildingFiles"`
+	MergingFiles            bool            `json:"mergingFiles"`
+	BuildingOptionalIndices bool            `json:"buildingOptionalIndices"`
+	Pruning                 bool            `json:"pruning"`
+	Progress                map[string]int  `json:"progress"` // background job -> percent
+	MergeDiskInFlight       int64           `json:"mergeDiskInFlight"`
+	FilesGeneration         uint64          `json:"filesGeneration"`
+	EndTxNumMinimax         uint64          `json:"endTxNumMinimax"`
+	LastBuildStats          *StepBuildStats `json:"lastBuildStats"`
+}
+
+func (a *Aggregator) debugActivity() DebugActivity {
+	if a == nil {
+		return DebugActivity{Progress: map[string]int{}}
+	}
+	return DebugActivity{
+		BuildingFiles:           a.buildingFiles.Load(),
+		MergingFiles:            a.mergingFiles.Load(),
+		BuildingOptionalIndices: a.buildingOptionalIndices.Load(),
+		Pruning:                 a.pruning.Load(),
+		Progress:                a.ps.DiagnossticsData(),
+		MergeDiskInFlight:       a.mergeDiskInFlight.Load(),
+		FilesGeneration:         a.FilesGeneration(),
+		EndTxNumMinimax:         a.EndTxNumMinimax(),
+		LastBuildStats:          a.LastBuildStats(),
+	}
+}
+
+type DebugView struct {
+	ID         uint64  `json:"id"`         // AggregatorRoTx.ViewID
+	Generation uint64  `json:"generation"` // AggregatorRoTx.Generation
+	AgeSeconds float64 `json:"ageSeconds"`
+}
+
+func (a *Aggregator) debugViews() []DebugView {
+	if a == nil {
+		return []DebugView{}
+	}
+	now := time.Now()
+	a.views.lockAll()
+	res := make([]DebugView, 0, a.views.count.Load())
+	a.views.each(func(_ uint64, ac *AggregatorRoTx) {
+		res = append(res, DebugView{ID: ac.id, Generation: ac.generation, AgeSeconds: now.Sub(ac.openedAt).Seconds()})
+	})
+	a.views.unlockAll()
+	slices.SortFunc(res, func(x, y DebugView) int { return cmp.Compare(x.ID, y.ID) })
+	return res
+}
@@ -0,0 +1,71 @@
+package state
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDebugHandlers(t *testing.T) {
+	getJSON := func(t *testing.T, srv *httptest.Server, path string, v any) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	t.Run("aggregator", func(t *testing.T) {
+		_, agg := testDbAndAggregatorv3(t, 16)
+		mux := http.NewServeMux()
+		RegisterDebugHandlers(mux, agg)
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+
+		var files []map[string]json.RawMessage
+		getJSON(t, srv, "/debug/agg/files", &files)
+		require.Len(t, files, 3*len(agg.d)+len(agg.iis))
+		for _, f := range files {
+			require.Contains(t, f, "name")
+			require.Contains(t, f, "visible")
+			require.Contains(t, f, "dirty")
+		}
+
+		var activity map[string]json.RawMessage
+		getJSON(t, srv, "/debug/agg/activity", &activity)
+		for _, field := range []string{"buildingFiles", "mergingFiles", "pruning", "progress", "filesGeneration", "endTxNumMinimax"} {
+			require.Contains(t, activity, field)
+		}
+
+		var views []DebugView
+		getJSON(t, srv, "/debug/agg/views", &views)
+		require.Len(t, views, 1)
+		require.Equal(t, ac.ViewID(), views[0].ID)
+		require.Equal(t, ac.Generation(), views[0].Generation)
+	})
+
+	t.Run("nil aggregator", func(t *testing.T) {
+		mux := http.NewServeMux()
+		RegisterDebugHandlers(mux, nil)
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		var files []DebugFilesSet
+		getJSON(t, srv, "/debug/agg/files", &files)
+		require.Empty(t, files)
+		var activity DebugActivity
+		getJSON(t, srv, "/debug/agg/activity", &activity)
+		require.False(t, activity.BuildingFiles)
+		var views []DebugView
+		getJSON(t, srv, "/debug/agg/views", &views)
+		require.Empty(t, views)
+	})
+}
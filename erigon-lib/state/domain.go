@@ -24,8 +24,10 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -88,24 +90,41 @@ type Domain struct {
 
 	integrityCheck func(name kv.Domain, fromStep, toStep uint64) bool
 
-	// replaceKeysInValues allows to replace commitment branch values with shorter keys.
+	// valuesTransform - replacement of keys in commitment branch values by shorter references, see CommitmentValuesTransformMode.
 	// for commitment domain only
-	replaceKeysInValues bool
+	valuesTransform CommitmentValuesTransformMode
+	// kvFileFlags - .kv files store commitmentFile* flags in header, see setKvFileFlags. for commitment domain only
+	kvFileFlags bool
 	// restricts subset file deletions on open/close. Needed to hold files until commitment is merged
 	restrictSubsetFileDeletions bool
+	// latestOnly - only .kv files and their accessors are present (see Aggregator.MinimalFileSet): history files are
+	// not expected and history reads behind end of .kv files return ErrHistoryExpired
+	latestOnly bool
+	// codeHashIndex - .kvch accessors of files and kv.TblCodeHashes are maintained, see Aggregator.SetCodeHashIndex.
+	// for code domain only
+	codeHashIndex bool
+
+	mxExistence *existenceFilterCounters // nil if metrics disabled
+	noAccessor  *noAccessorReads
 
 	keysTable   string // key -> invertedStep , invertedStep = ^(txNum / aggregationStep), Needs to be table with DupSort
 	valsTable   string // key + invertedStep -> values
 	stats       DomainStats
 	compression FileCompression
 	indexList   idxList
+
+	compressDict *seg.Dictionary // external patterns for .kv files, see Aggregator.SetCompressionDictionary
+
+	// _visibleEmptySteps - copy of emptySteps taken together with _visibleFiles, see BeginFilesRo
+	_visibleEmptySteps []uint64
 }
 
 type domainCfg struct {
 	hist     histCfg
 	compress FileCompression
 
-	replaceKeysInValues         bool
+	valuesTransform             CommitmentValuesTransformMode
+	kvFileFlags                 bool
 	restrictSubsetFileDeletions bool
 }
 
@@ -121,7 +140,8 @@ func NewDomain(cfg domainCfg, aggregationStep uint64, filenameBase, keysTable, v
 		stats:       DomainStats{FilesQueries: &atomic.Uint64{}, TotalQueries: &atomic.Uint64{}},
 
 		indexList:                   withBTree | withExistence,
-		replaceKeysInValues:         cfg.replaceKeysInValues,         // for commitment domain only
+		valuesTransform:             cfg.valuesTransform, // for commitment domain only
+		kvFileFlags:                 cfg.kvFileFlags,
 		restrictSubsetFileDeletions: cfg.restrictSubsetFileDeletions, // to prevent not merged 'garbage' to delete on start
 		integrityCheck:              integrityCheck,
 	}
@@ -132,6 +152,9 @@ func NewDomain(cfg domainCfg, aggregationStep uint64, filenameBase, keysTable, v
 	if d.History, err = NewHistory(cfg.hist, aggregationStep, filenameBase, indexKeysTable, indexTable, historyValsTable, nil, logger); err != nil {
 		return nil, err
 	}
+	d.emptySteps = newEmptySteps(cfg.hist.iiCfg.dirs.SnapDomain, filenameBase)
+	d.mxExistence = newExistenceFilterCounters(filenameBase)
+	d.noAccessor = newNoAccessorReads(filenameBase)
 
 	return d, nil
 }
@@ -196,6 +219,9 @@ func (d *Domain) openList(names []string) error {
 //   - `kill -9` in the middle of `buildFiles()`, then `rm -f db` (restore from backup)
 //   - `kill -9` in the middle of `buildFiles()`, then `stage_exec --reset` (drop progress - as a hot-fix)
 func (d *Domain) protectFromHistoryFilesAheadOfDomainFiles() {
+	if d.latestOnly { // no history files to compare with
+		return
+	}
 	d.closeFilesAfterStep(d.dirtyFilesEndTxNumMinimax() / d.aggregationStep)
 }
 
@@ -204,6 +230,9 @@ func (d *Domain) OpenFolder() error {
 	if err != nil {
 		return fmt.Errorf("Domain(%s).OpenFolder: %w", d.filenameBase, err)
 	}
+	if err := d.emptySteps.load(); err != nil {
+		return fmt.Errorf("Domain(%s).OpenFolder: %w", d.filenameBase, err)
+	}
 	if err := d.OpenList(idx, histFiles, domainFiles); err != nil {
 		return err
 	}
@@ -309,9 +338,12 @@ func (d *Domain) scanStateFiles(fileNames []string) (garbageFiles []*filesItem)
 		//   0-1.kv: [0, 8)
 		//   0-2.kv: [0, 16)
 		//   1-2.kv: [8, 16)
-		startTxNum, endTxNum := startStep*d.aggregationStep, endStep*d.aggregationStep
+		// File produced with other step size is in steps of its own, see recordedStepSize
+		stepSize, recorded := recordedStepSize(d.kvFilePath(startStep, endStep), d.aggregationStep, d.logger)
+		startTxNum, endTxNum := startStep*stepSize, endStep*stepSize
 
-		var newFile = newFilesItem(startTxNum, endTxNum, d.aggregationStep)
+		var newFile = newFilesItem(startTxNum, endTxNum, stepSize)
+		newFile.stepSizeUnknown = !recorded
 		newFile.frozen = false
 
 		if _, has := d.dirtyFiles.Get(newFile); has {
@@ -325,9 +357,10 @@ func (d *Domain) scanStateFiles(fileNames []string) (garbageFiles []*filesItem)
 func (d *Domain) openFiles() (err error) {
 	invalidFileItems := make([]*filesItem, 0)
 	invalidFileItemsLock := sync.Mutex{}
+	var dictErr error
 	d.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			fromStep, toStep := item.steps()
 			if item.decompressor == nil {
 				fPath := d.kvFilePath(fromStep, toStep)
 				exists, err := dir.FileExist(fPath)
@@ -348,8 +381,13 @@ func (d *Domain) openFiles() (err error) {
 					continue
 				}
 
-				if item.decompressor, err = seg.NewDecompressor(fPath); err != nil {
+				if item.decompressor, err = seg.NewDecompressorWithDictionary(fPath, d.compressDict); err != nil {
 					_, fName := filepath.Split(fPath)
+					if errors.Is(err, &seg.ErrDictionaryMismatch{}) {
+						// not a broken file: it's config error. skipping file would silently hide its data
+						dictErr = err
+						return false
+					}
 					if errors.Is(err, &seg.ErrCompressedFileCorrupted{}) {
 						d.logger.Debug("[agg] Domain.openFiles", "err", err, "f", fName)
 					} else {
@@ -408,6 +446,7 @@ func (d *Domain) openFiles() (err error) {
 					}
 				}
 			}
+			d.openCodeHashIdx(item, fromStep, toStep)
 		}
 		return true
 	})
@@ -417,7 +456,7 @@ func (d *Domain) openFiles() (err error) {
 		d.dirtyFiles.Delete(item)
 	}
 
-	return nil
+	return dictErr
 }
 
 func (d *Domain) closeWhatNotInList(fNames []string) {
@@ -441,7 +480,9 @@ func (d *Domain) closeWhatNotInList(fNames []string) {
 }
 
 func (d *Domain) reCalcVisibleFiles() {
-	d._visibleFiles = calcVisibleFiles(d.dirtyFiles, d.indexList, false)
+	// .kv without accessors is visible: it's read by linear scan until BuildMissedIndices is done, see seekNoAccessor
+	d._visibleFiles = calcVisibleFiles(d.dirtyFiles, d.indexList&^(withBTree|withExistence), false)
+	d._visibleEmptySteps = d.emptySteps.list()
 	d.History.reCalcVisibleFiles()
 }
 
@@ -499,11 +540,16 @@ func (dt *DomainRoTx) newWriter(tmpdir string, discard bool) *domainBufferedWrit
 	}
 	w.keys.SortAndFlushInBackground(true)
 	w.values.SortAndFlushInBackground(true)
+	if dt.d.codeHashIndex && !discard {
+		w.codeHashes = etl.NewCollector("flush "+kv.TblCodeHashes, tmpdir, etl.NewSortableBuffer(WALCollectorRAM), dt.d.logger).LogLvl(log.LvlTrace)
+		w.codeHashes.SortAndFlushInBackground(true)
+	}
 	return w
 }
 
 type domainBufferedWriter struct {
 	keys, values *etl.Collector
+	codeHashes   *etl.Collector // keccak(code) -> step+code. nil if code-hash index is disabled
 
 	setTxNumOnce bool
 	discard      bool
@@ -528,6 +574,9 @@ func (w *domainBufferedWriter) close() {
 	if w.values != nil {
 		w.values.Close()
 	}
+	if w.codeHashes != nil {
+		w.codeHashes.Close()
+	}
 }
 
 // nolint
@@ -562,6 +611,11 @@ func (w *domainBufferedWriter) Flush(ctx context.Context, tx kv.RwTx) error {
 	if err := w.values.Load(tx, w.valsTable, loadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
 		return err
 	}
+	if w.codeHashes != nil {
+		if err := w.codeHashes.Load(tx, kv.TblCodeHashes, codeHashLoadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+			return err
+		}
+	}
 	w.close()
 	return nil
 }
@@ -591,6 +645,11 @@ func (w *domainBufferedWriter) addValue(key1, key2, value []byte) error {
 	if err := w.values.Collect(fullkey, value); err != nil {
 		return err
 	}
+	if w.codeHashes != nil && len(value) > 0 {
+		if err := w.codeHashes.Collect(keccak(value), append(w.stepBytes[:], value...)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -631,6 +690,9 @@ func (ch CursorHeap) Less(i, j int) bool {
 	if cmp == 0 {
 		// when keys match, the items with later blocks are preferred
 		if ch[i].reverse {
+			if ch[i].endTxNum == ch[j].endTxNum {
+				return ch[i].t > ch[j].t // RAM, then DB, then files, see filesItem.latestTxNum
+			}
 			return ch[i].endTxNum > ch[j].endTxNum
 		}
 		return ch[i].endTxNum < ch[j].endTxNum
@@ -655,11 +717,35 @@ func (ch *CursorHeap) Pop() interface{} {
 	return x
 }
 
+// ReadSource - debug switch of DomainRoTx: where GetLatest/GetAsOf/HistorySeek look for data. See AggregatorRoTx.SetReadSource
+type ReadSource uint8
+
+const (
+	ReadSourceAuto      ReadSource = iota // DB, then files
+	ReadSourceFilesOnly                   // DB is treated as empty
+	ReadSourceDbOnly                      // files are not probed
+)
+
+func (s ReadSource) String() string {
+	switch s {
+	case ReadSourceAuto:
+		return "auto"
+	case ReadSourceFilesOnly:
+		return "files-only"
+	case ReadSourceDbOnly:
+		return "db-only"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
 // DomainRoTx allows accesing the same domain from multiple go-routines
 type DomainRoTx struct {
 	ht         *HistoryRoTx
 	d          *Domain
 	files      visibleFiles
+	emptySteps []uint64 // steps covered without files, see emptySteps
+	readSource ReadSource
 	getters    []ArchiveGetter
 	readers    []*BtIndex
 	idxReaders []*recsplit.IndexReader
@@ -672,7 +758,8 @@ type DomainRoTx struct {
 	valsC kv.Cursor
 }
 
-func (dt *DomainRoTx) getFromFile(i int, filekey []byte) ([]byte, bool, error) {
+// getFromFile - compressed value is read into `valBuf`, uncompressed is sub-slice of mmap (valid until RoTx.Close)
+func (dt *DomainRoTx) getFromFile(i int, filekey, valBuf []byte) ([]byte, bool, error) {
 	g := dt.statelessGetter(i)
 	if !(UseBtree || UseBpsTree) {
 		reader := dt.statelessIdxReader(i)
@@ -689,11 +776,22 @@ func (dt *DomainRoTx) getFromFile(i int, filekey []byte) ([]byte, bool, error) {
 		if !bytes.Equal(filekey, k) {
 			return nil, false, nil
 		}
-		v, _ := g.Next(nil)
+		v, _ := g.Next(valBuf[:0])
 		return v, true, nil
 	}
 
-	_, v, ok, err := dt.statelessBtree(i).Get(filekey, g)
+	if dt.files[i].src.bindex == nil {
+		k, offset, err := dt.d.seekNoAccessor(dt.files[i].src, g, filekey)
+		if err != nil || !bytes.Equal(k, filekey) {
+			return nil, false, err
+		}
+		g.Reset(offset)
+		g.Skip()
+		v, _ := g.Next(valBuf[:0])
+		return v, true, nil
+	}
+
+	v, ok, err := dt.statelessBtree(i).GetInto(filekey, valBuf, g)
 	if err != nil || !ok {
 		return nil, false, err
 	}
@@ -703,7 +801,7 @@ func (dt *DomainRoTx) getFromFile(i int, filekey []byte) ([]byte, bool, error) {
 
 func (dt *DomainRoTx) DebugKVFilesWithKey(k []byte) (res []string, err error) {
 	for i := len(dt.files) - 1; i >= 0; i-- {
-		_, ok, err := dt.getFromFile(i, k)
+		_, ok, err := dt.getFromFile(i, k, nil)
 		if err != nil {
 			return res, err
 		}
@@ -713,6 +811,36 @@ func (dt *DomainRoTx) DebugKVFilesWithKey(k []byte) (res []string, err error) {
 	}
 	return res, nil
 }
+
+// sampleKeys - reservoir-sampling of `n` keys from visible files
+func (dt *DomainRoTx) sampleKeys(ctx context.Context, n int, rnd *rand.Rand) ([][]byte, error) {
+	res := make([][]byte, 0, n)
+	var seen int
+	var k []byte
+	for i := range dt.files {
+		g := dt.statelessGetter(i)
+		g.Reset(0)
+		for g.HasNext() {
+			k, _ = g.Next(k[:0])
+			g.Skip()
+			seen++
+			if len(res) < n {
+				res = append(res, common.Copy(k))
+			} else if j := rnd.Intn(seen); j < n {
+				res[j] = common.Copy(k)
+			}
+			if seen%100_000 == 0 {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				default:
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
 func (dt *DomainRoTx) DebugEFKey(k []byte) error {
 	dt.ht.iit.ii.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
@@ -721,7 +849,7 @@ func (dt *DomainRoTx) DebugEFKey(k []byte) error {
 			}
 			accessor := item.index
 			if accessor == nil {
-				fPath := dt.d.efAccessorFilePath(item.startTxNum/dt.d.aggregationStep, item.endTxNum/dt.d.aggregationStep)
+				fPath := dt.d.efAccessorFilePath(item.steps())
 				exists, err := dir.FileExist(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
@@ -787,7 +915,9 @@ func (d *Domain) collectFilesStats() (datsz, idxsz, files uint64) {
 			}
 			datsz += uint64(item.decompressor.Size())
 			idxsz += uint64(item.index.Size())
-			idxsz += uint64(item.bindex.Size())
+			if item.bindex != nil {
+				idxsz += uint64(item.bindex.Size())
+			}
 			files += 3
 		}
 		return true
@@ -802,24 +932,31 @@ func (d *Domain) collectFilesStats() (datsz, idxsz, files uint64) {
 
 func (d *Domain) BeginFilesRo() *DomainRoTx {
 	files := d._visibleFiles
-	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
+	files.refAll()
+	ht := d.History.BeginFilesRo()
+	if d.latestOnly {
+		ht.noHistoryBefore = visibleFiles(files).EndTxNum()
 	}
 	return &DomainRoTx{
-		d:     d,
-		ht:    d.History.BeginFilesRo(),
-		files: files,
+		d:          d,
+		ht:         ht,
+		files:      files,
+		emptySteps: d._visibleEmptySteps,
 	}
 }
 
+// endTxNum - like files.EndTxNum, but also covers empty steps which follow last file (see emptySteps): they don't need files
+func (dt *DomainRoTx) endTxNum() uint64 {
+	return coveredEndTxNum(dt.files.EndTxNum(), dt.emptySteps, dt.d.aggregationStep)
+}
+
 // Collation is the set of compressors created after aggregation
 type Collation struct {
 	HistoryCollation
 	valuesComp  *seg.Compressor
 	valuesPath  string
 	valuesCount int
+	valuesBytes int64
 }
 
 func (c Collation) Close() {
@@ -829,15 +966,18 @@ func (c Collation) Close() {
 	c.HistoryCollation.Close()
 }
 
+// isEmpty - no changes of domain in collated step: no values and no history
+func (c Collation) isEmpty() bool { return c.valuesCount == 0 && c.historyCount == 0 }
+
 // collate gathers domain changes over the specified step, using read-only transaction,
 // and returns compressors, elias fano, and bitmaps
 // [txFrom; txTo)
 func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv.Tx) (coll Collation, err error) {
-	{ //assert
-		if txFrom%d.aggregationStep != 0 {
+	{ //assert: history of block-aligned step may start and end before step (see SetBlockAlignedSteps), values are always per-step
+		if txFrom > step*d.aggregationStep {
 			panic(fmt.Errorf("assert: unexpected txFrom=%d", txFrom))
 		}
-		if txTo%d.aggregationStep != 0 {
+		if txTo < txFrom {
 			panic(fmt.Errorf("assert: unexpected txTo=%d", txTo))
 		}
 	}
@@ -864,11 +1004,30 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	if coll.valuesComp, err = seg.NewCompressor(ctx, "collate domain "+d.filenameBase, coll.valuesPath, d.dirs.Tmp, seg.MinPatternScore, d.compressWorkers, log.LvlTrace, d.logger); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
+	coll.valuesComp.SetDictionary(d.compressDict)
+	d.setKvFileFlags(coll.valuesComp, false)
 	comp := NewArchiveWriter(coll.valuesComp, d.compression)
 
+	if d.valuesBlockAligned(step, txFrom, txTo) {
+		if coll.valuesBytes, err = d.collateAlignedValues(comp, txFrom, txTo, roTx); err != nil {
+			return coll, err
+		}
+		setDataRange(coll.valuesComp, step, step+1, d.aggregationStep, txFrom, txTo)
+	} else if coll.valuesBytes, err = d.collateStepValues(comp, step, roTx); err != nil {
+		return coll, err
+	}
+
+	closeCollation = false
+	coll.valuesCount = coll.valuesComp.Count() / 2
+	mxCollationSize.SetUint64(uint64(coll.valuesCount))
+	return coll, nil
+}
+
+// collateStepValues - last values of keys changed in `step`: domain values are stored in DB per-step
+func (d *Domain) collateStepValues(comp ArchiveWriter, step uint64, roTx kv.Tx) (valuesBytes int64, err error) {
 	keysCursor, err := roTx.CursorDupSort(d.keysTable)
 	if err != nil {
-		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+		return 0, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
 	}
 	defer keysCursor.Close()
 
@@ -882,13 +1041,13 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	binary.BigEndian.PutUint64(stepBytes, ^step)
 	valsDup, err = roTx.CursorDupSort(d.valsTable)
 	if err != nil {
-		return Collation{}, fmt.Errorf("create %s values cursorDupsort: %w", d.filenameBase, err)
+		return 0, fmt.Errorf("create %s values cursorDupsort: %w", d.filenameBase, err)
 	}
 	defer valsDup.Close()
 
 	for k, stepInDB, err := keysCursor.First(); k != nil; k, stepInDB, err = keysCursor.Next() {
 		if err != nil {
-			return coll, err
+			return valuesBytes, err
 		}
 		if !bytes.Equal(stepBytes, stepInDB) { // [txFrom; txTo)
 			continue
@@ -899,21 +1058,19 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 
 		v, err = roTx.GetOne(d.valsTable, keySuffix[:len(k)+8])
 		if err != nil {
-			return coll, fmt.Errorf("find last %s value for aggregation step k=[%x]: %w", d.filenameBase, k, err)
+			return valuesBytes, fmt.Errorf("find last %s value for aggregation step k=[%x]: %w", d.filenameBase, k, err)
 		}
 
 		if err = comp.AddWord(k); err != nil {
-			return coll, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+			return valuesBytes, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
 		}
 		if err = comp.AddWord(v); err != nil {
-			return coll, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+			return valuesBytes, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v, err)
 		}
+		valuesBytes += int64(len(k) + len(v))
 	}
 
-	closeCollation = false
-	coll.valuesCount = coll.valuesComp.Count() / 2
-	mxCollationSize.SetUint64(uint64(coll.valuesCount))
-	return coll, nil
+	return valuesBytes, nil
 }
 
 type StaticFiles struct {
@@ -922,6 +1079,8 @@ type StaticFiles struct {
 	valuesIdx    *recsplit.Index
 	valuesBt     *BtIndex
 	bloom        *ExistenceFilter
+	codeHashIdx  *recsplit.Index
+	emptyStep    bool // step has no changes and files were not produced, see Aggregator.SetSkipEmptySteps
 }
 
 // CleanupOnError - call it on collation fail. It closing all files
@@ -938,6 +1097,9 @@ func (sf StaticFiles) CleanupOnError() {
 	if sf.bloom != nil {
 		sf.bloom.Close()
 	}
+	if sf.codeHashIdx != nil {
+		sf.codeHashIdx.Close()
+	}
 	sf.HistoryFiles.CleanupOnError()
 }
 
@@ -967,6 +1129,7 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 		valuesIdx    *recsplit.Index
 		bt           *BtIndex
 		bloom        *ExistenceFilter
+		codeHashIdx  *recsplit.Index
 	)
 	closeComp := true
 	defer func() {
@@ -987,6 +1150,9 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 			if bloom != nil {
 				bloom.Close()
 			}
+			if codeHashIdx != nil {
+				codeHashIdx.Close()
+			}
 		}
 	}()
 	if d.noFsync {
@@ -997,9 +1163,12 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 	}
 	valuesComp.Close()
 	valuesComp = nil
-	if valuesDecomp, err = seg.NewDecompressor(collation.valuesPath); err != nil {
+	if valuesDecomp, err = seg.NewDecompressorWithDictionary(collation.valuesPath, d.compressDict); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s values decompressor: %w", d.filenameBase, err)
 	}
+	if err = writeStepSize(collation.valuesPath, d.aggregationStep, d.noFsync); err != nil {
+		return StaticFiles{}, fmt.Errorf("write %s step size: %w", d.filenameBase, err)
+	}
 
 	if !UseBpsTree {
 		if err = d.buildAccessor(ctx, step, step+1, valuesDecomp, ps); err != nil {
@@ -1031,6 +1200,14 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 			}
 		}
 	}
+	if d.codeHashIndex {
+		if err = d.buildCodeHashIdx(ctx, step, step+1, valuesDecomp, ps); err != nil {
+			return StaticFiles{}, fmt.Errorf("build %s .kvch: %w", d.filenameBase, err)
+		}
+		if codeHashIdx, err = recsplit.OpenIndex(d.kvCodeHashIdxFilePath(step, step+1)); err != nil {
+			return StaticFiles{}, fmt.Errorf("build %s .kvch: %w", d.filenameBase, err)
+		}
+	}
 	closeComp = false
 	return StaticFiles{
 		HistoryFiles: hStaticFiles,
@@ -1038,6 +1215,7 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 		valuesIdx:    valuesIdx,
 		valuesBt:     bt,
 		bloom:        bloom,
+		codeHashIdx:  codeHashIdx,
 	}, nil
 }
 
@@ -1060,7 +1238,7 @@ func (d *Domain) buildAccessor(ctx context.Context, fromStep, toStep uint64, dat
 func (d *Domain) missedBtreeAccessors() (l []*filesItem) {
 	d.dirtyFiles.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			fromStep, toStep := item.steps()
 			fPath := d.kvBtFilePath(fromStep, toStep)
 			exists, err := dir.FileExist(fPath)
 			if err != nil {
@@ -1087,7 +1265,7 @@ func (d *Domain) missedBtreeAccessors() (l []*filesItem) {
 func (d *Domain) missedAccessors() (l []*filesItem) {
 	d.dirtyFiles.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			fromStep, toStep := item.steps()
 			fPath := d.kvAccessorFilePath(fromStep, toStep)
 			exists, err := dir.FileExist(fPath)
 			if err != nil {
@@ -1129,10 +1307,10 @@ func (d *Domain) BuildMissedAccessors(ctx context.Context, g *errgroup.Group, ps
 		item := item
 
 		g.Go(func() error {
-			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			fromStep, toStep := item.steps()
 			idxPath := d.kvBtFilePath(fromStep, toStep)
 			if err := BuildBtreeIndexWithDecompressor(idxPath, item.decompressor, CompressNone, ps, d.dirs.Tmp, *d.salt, d.logger, d.noFsync); err != nil {
-				return fmt.Errorf("failed to build btree index for %s:  %w", item.decompressor.FileName(), err)
+				return indexBuildFailed(item, fmt.Errorf("failed to build btree index for %s:  %w", item.decompressor.FileName(), err))
 			}
 			return nil
 		})
@@ -1150,10 +1328,10 @@ func (d *Domain) BuildMissedAccessors(ctx context.Context, g *errgroup.Group, ps
 				return nil
 			}
 
-			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			fromStep, toStep := item.steps()
 			err := d.buildAccessor(ctx, fromStep, toStep, item.decompressor, ps)
 			if err != nil {
-				return fmt.Errorf("build %s values recsplit index: %w", d.filenameBase, err)
+				return indexBuildFailed(item, fmt.Errorf("build %s values recsplit index: %w", d.filenameBase, err))
 			}
 			return nil
 		})
@@ -1220,6 +1398,13 @@ func buildAccessor(ctx context.Context, d *seg.Decompressor, compressed FileComp
 }
 
 func (d *Domain) integrateDirtyFiles(sf StaticFiles, txNumFrom, txNumTo uint64) {
+	if sf.emptyStep {
+		// if marker is lost - step is not covered and will be collated again after restart
+		if err := d.emptySteps.add(txNumFrom / d.aggregationStep); err != nil {
+			d.logger.Warn("[snapshots] can't save empty step", "domain", d.filenameBase, "step", txNumFrom/d.aggregationStep, "err", err)
+		}
+		return
+	}
 	d.History.integrateDirtyFiles(sf.HistoryFiles, txNumFrom, txNumTo)
 
 	fi := newFilesItem(txNumFrom, txNumTo, d.aggregationStep)
@@ -1228,6 +1413,7 @@ func (d *Domain) integrateDirtyFiles(sf StaticFiles, txNumFrom, txNumTo uint64)
 	fi.index = sf.valuesIdx
 	fi.bindex = sf.valuesBt
 	fi.existence = sf.bloom
+	fi.codeHash = sf.codeHashIdx
 	d.dirtyFiles.Set(fi)
 }
 
@@ -1310,7 +1496,7 @@ var (
 	UseBtree = true // if true, will use btree for all files
 )
 
-func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileStartTxNum uint64, fileEndTxNum uint64, err error) {
+func (dt *DomainRoTx) getFromFiles(filekey, valBuf []byte) (v []byte, found bool, fileStartTxNum uint64, fileEndTxNum uint64, err error) {
 	hi, _ := dt.ht.iit.hashKey(filekey)
 
 	for i := len(dt.files) - 1; i >= 0; i-- {
@@ -1319,7 +1505,7 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 			//	panic(dt.files[i].src.decompressor.FileName())
 			//}
 			if dt.files[i].src.existence != nil {
-				if !dt.files[i].src.existence.ContainsHash(hi) {
+				if !dt.files[i].src.existence.probe(hi, dt.d.mxExistence) {
 					if traceGetLatest == dt.d.filenameBase {
 						fmt.Printf("GetLatest(%s, %x) -> existence index %s -> false\n", dt.d.filenameBase, filekey, dt.files[i].src.existence.FileName)
 					}
@@ -1337,11 +1523,14 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 		}
 
 		//t := time.Now()
-		v, found, err = dt.getFromFile(i, filekey)
+		v, found, err = dt.getFromFile(i, filekey, valBuf)
 		if err != nil {
 			return nil, false, 0, 0, err
 		}
 		if !found {
+			if dt.d.indexList&withExistence != 0 && dt.files[i].src.existence != nil {
+				dt.files[i].src.existence.miss(dt.d.mxExistence)
+			}
 			if traceGetLatest == dt.d.filenameBase {
 				fmt.Printf("GetLatest(%s, %x) -> not found in file %s\n", dt.d.filenameBase, filekey, dt.files[i].src.decompressor.FileName())
 			}
@@ -1364,7 +1553,12 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 // GetAsOf does not always require usage of roTx. If it is possible to determine
 // historical value based only on static files, roTx will not be used.
 func (dt *DomainRoTx) GetAsOf(key []byte, txNum uint64, roTx kv.Tx) ([]byte, error) {
-	v, hOk, err := dt.ht.HistorySeek(key, txNum, roTx)
+	return dt.GetAsOfCtx(context.Background(), key, txNum, roTx)
+}
+
+// GetAsOfCtx - GetAsOf which checks `ctx` between file probes and returns ctx.Err() on cancellation
+func (dt *DomainRoTx) GetAsOfCtx(ctx context.Context, key []byte, txNum uint64, roTx kv.Tx) ([]byte, error) {
+	v, hOk, err := dt.ht.HistorySeekCtx(ctx, key, txNum, roTx)
 	if err != nil {
 		return nil, err
 	}
@@ -1382,6 +1576,9 @@ func (dt *DomainRoTx) GetAsOf(key []byte, txNum uint64, roTx kv.Tx) ([]byte, err
 		}
 		return v, nil
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	v, _, _, err = dt.GetLatest(key, nil, roTx)
 	if err != nil {
 		return nil, err
@@ -1389,6 +1586,101 @@ func (dt *DomainRoTx) GetAsOf(key []byte, txNum uint64, roTx kv.Tx) ([]byte, err
 	return v, nil
 }
 
+// GetAsOfMany - batch version of GetAsOf. Results are equal to calling GetAsOf for each key,
+// but keys are sorted and resolved file-by-file: one pass per visible file for all keys which could live there.
+// Returned slices are aligned with `keys`. roTx=nil - read only files.
+func (dt *DomainRoTx) GetAsOfMany(keys [][]byte, txNum uint64, roTx kv.Tx) (vals [][]byte, oks []bool, err error) {
+	vals, oks = make([][]byte, len(keys)), make([]bool, len(keys))
+	if dt.readSource != ReadSourceAuto { // debug mode: no reason to optimize
+		for i, k := range keys {
+			if vals[i], err = dt.GetAsOf(k, txNum, roTx); err != nil {
+				return nil, nil, err
+			}
+			oks[i] = vals[i] != nil
+		}
+		return vals, oks, nil
+	}
+	sorted := make([]int, len(keys))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.Slice(sorted, func(a, b int) bool { return bytes.Compare(keys[sorted[a]], keys[sorted[b]]) < 0 })
+
+	// 1. history: sorted keys touch same files/cursor positions sequentially
+	latest := make([]int, 0, len(keys)) // keys without history at txNum - need latest value
+	for _, i := range sorted {
+		v, hOk, err := dt.ht.HistorySeek(keys[i], txNum, roTx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hOk {
+			// if history returned marker of key creation - domain must return nil
+			if len(v) > 0 {
+				vals[i], oks[i] = v, true
+			}
+			continue
+		}
+		latest = append(latest, i)
+	}
+
+	// 2. latest from DB: forward-only cursor seeks
+	inFiles := latest[:0] // reuse: writes never overtake reads
+	for _, i := range latest {
+		if roTx == nil {
+			inFiles = append(inFiles, i)
+			continue
+		}
+		v, _, found, err := dt.getLatestFromDb(keys[i], roTx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("getLatestFromDb: %w", err)
+		}
+		if found {
+			vals[i], oks[i] = v, v != nil
+			continue
+		}
+		inFiles = append(inFiles, i)
+	}
+
+	// 3. latest from files: newest file first, each file visited once for all remaining keys
+	var hashes []uint64
+	if dt.d.indexList&withExistence != 0 && len(inFiles) > 0 {
+		hashes = make([]uint64, len(keys))
+		for _, i := range inFiles {
+			hashes[i], _ = dt.ht.iit.hashKey(keys[i])
+		}
+	}
+	for fi := len(dt.files) - 1; fi >= 0 && len(inFiles) > 0; fi-- {
+		rest := inFiles[:0]
+		for _, i := range inFiles {
+			existence := dt.files[fi].src.existence
+			if hashes != nil && existence != nil && !existence.probe(hashes[i], dt.d.mxExistence) {
+				rest = append(rest, i)
+				continue
+			}
+			v, found, err := dt.getFromFile(fi, keys[i], nil)
+			if err != nil {
+				return nil, nil, fmt.Errorf("getFromFiles: %w", err)
+			}
+			if !found {
+				if hashes != nil && existence != nil {
+					existence.miss(dt.d.mxExistence)
+				}
+				rest = append(rest, i)
+				continue
+			}
+			vals[i], oks[i] = v, v != nil
+		}
+		inFiles = rest
+	}
+	return vals, oks, nil
+}
+
+// clone - see AggregatorRoTx.Clone
+func (dt *DomainRoTx) clone() *DomainRoTx {
+	dt.files.refAll()
+	return &DomainRoTx{d: dt.d, ht: dt.ht.clone(), files: dt.files, emptySteps: dt.emptySteps, readSource: dt.readSource}
+}
+
 func (dt *DomainRoTx) Close() {
 	if dt.files == nil { // invariant: it's safe to call Close multiple times
 		return
@@ -1397,7 +1689,7 @@ func (dt *DomainRoTx) Close() {
 	dt.files = nil
 	for i := range files {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -1483,7 +1775,8 @@ func (dt *DomainRoTx) getLatestFromDb(key []byte, roTx kv.Tx) ([]byte, uint64, b
 
 	if foundInvStep != nil {
 		foundStep := ^binary.BigEndian.Uint64(foundInvStep)
-		if lastTxNumOfStep(foundStep, dt.d.aggregationStep) >= dt.files.EndTxNum() {
+		// db-only: not pruned steps covered by files are also good - files are not probed
+		if dt.readSource == ReadSourceDbOnly || lastTxNumOfStep(foundStep, dt.d.aggregationStep) >= dt.files.dataEndTxNum() {
 			valsC, err := dt.valsCursor(roTx)
 			if err != nil {
 				return nil, foundStep, false, err
@@ -1518,16 +1811,44 @@ func (dt *DomainRoTx) getLatestFromDb(key []byte, roTx kv.Tx) ([]byte, uint64, b
 // GetLatest returns value, step in which the value last changed, and bool value which is true if the value
 // is present, and false if it is not present (not set or deleted)
 func (dt *DomainRoTx) GetLatest(key1, key2 []byte, roTx kv.Tx) ([]byte, uint64, bool, error) {
+	v, foundStep, found, _, err := dt.getLatest(key1, key2, nil, roTx)
+	return v, foundStep, found, err
+}
+
+// GetLatestInto - like GetLatest, but value is appended to `buf[:0]` (returns possibly-grown slice) and stays valid after `roTx` end.
+// Reuse of `buf` across sequential calls avoids per-call allocations: previous returned value is overwritten.
+func (dt *DomainRoTx) GetLatestInto(key1, key2, buf []byte, roTx kv.Tx) ([]byte, uint64, bool, error) {
+	v, foundStep, found, fromFiles, err := dt.getLatest(key1, key2, buf, roTx)
+	if err != nil || !found {
+		return buf[:0], foundStep, found, err
+	}
+	if !fromFiles || dt.d.compression&CompressVals == 0 {
+		v = append(buf[:0], v...)
+	}
+	return v, foundStep, found, nil
+}
+
+// GetLatestIntoUnsafe - like GetLatestInto, but uncompressed value from file is returned as sub-slice of mmap (without copy).
+// Such value is valid only until DomainRoTx.Close and must not be modified.
+func (dt *DomainRoTx) GetLatestIntoUnsafe(key1, key2, buf []byte, roTx kv.Tx) ([]byte, uint64, bool, error) {
+	v, foundStep, found, fromFiles, err := dt.getLatest(key1, key2, buf, roTx)
+	if err != nil || !found {
+		return buf[:0], foundStep, found, err
+	}
+	if !fromFiles {
+		v = append(buf[:0], v...)
+	}
+	return v, foundStep, found, nil
+}
+
+// getLatest - compressed values of files are read into `valBuf`, other values are returned as is: db value is valid until `roTx` end,
+// uncompressed file value - until DomainRoTx.Close
+func (dt *DomainRoTx) getLatest(key1, key2, valBuf []byte, roTx kv.Tx) (v []byte, foundStep uint64, found, fromFiles bool, err error) {
 	key := key1
 	if len(key2) > 0 {
 		key = append(append(dt.keyBuf[:0], key1...), key2...)
 	}
 
-	var v []byte
-	var foundStep uint64
-	var found bool
-	var err error
-
 	if traceGetLatest == dt.d.filenameBase {
 		defer func() {
 			fmt.Printf("GetLatest(%s, '%x' -> '%x') (from db=%t; istep=%x stepInFiles=%d)\n",
@@ -1535,23 +1856,25 @@ func (dt *DomainRoTx) GetLatest(key1, key2 []byte, roTx kv.Tx) ([]byte, uint64,
 		}()
 	}
 
-	v, foundStep, found, err = dt.getLatestFromDb(key, roTx)
-	if err != nil {
-		return nil, 0, false, fmt.Errorf("getLatestFromDb: %w", err)
-	}
-	if found {
-		return v, foundStep, true, nil
+	if dt.readSource != ReadSourceFilesOnly {
+		v, foundStep, found, err = dt.getLatestFromDb(key, roTx)
+		if err != nil {
+			return nil, 0, false, false, fmt.Errorf("getLatestFromDb: %w", err)
+		}
+		if found || dt.readSource == ReadSourceDbOnly {
+			return v, foundStep, found, false, nil
+		}
 	}
 
-	v, foundInFile, _, endTxNum, err := dt.getFromFiles(key)
+	v, foundInFile, _, endTxNum, err := dt.getFromFiles(key, valBuf)
 	if err != nil {
-		return nil, 0, false, fmt.Errorf("getFromFiles: %w", err)
+		return nil, 0, false, false, fmt.Errorf("getFromFiles: %w", err)
 	}
-	return v, endTxNum / dt.d.aggregationStep, foundInFile, nil
+	return v, endTxNum / dt.d.aggregationStep, foundInFile, foundInFile, nil
 }
 
 func (dt *DomainRoTx) GetLatestFromFiles(key []byte) (v []byte, found bool, fileStartTxNum uint64, fileEndTxNum uint64, err error) {
-	return dt.getFromFiles(key)
+	return dt.getFromFiles(key, nil)
 }
 
 func (dt *DomainRoTx) DomainRange(tx kv.Tx, fromKey, toKey []byte, ts uint64, asc order.By, limit int) (it iter.KV, err error) {
@@ -1577,6 +1900,7 @@ func (dt *DomainRoTx) DomainRange(tx kv.Tx, fromKey, toKey []byte, ts uint64, as
 	return iter.UnionKV(histStateIt, lastestStateIt, limit), nil
 }
 
+// DomainRangeLatest - latest values of keys in [fromKey, toKey). roTx=nil - only files are read
 func (dt *DomainRoTx) DomainRangeLatest(roTx kv.Tx, fromKey, toKey []byte, limit int) (iter.KV, error) {
 	s := &DomainLatestIterFile{from: fromKey, to: toKey, limit: limit, dc: dt,
 		roTx:         roTx,
@@ -1606,8 +1930,10 @@ func (dt *DomainRoTx) canBuild(dbtx kv.Tx) bool { //nolint
 // everything that aggregated is prunable.
 // history.CanPrune should be called separately because it responsible for different tables
 func (dt *DomainRoTx) canPruneDomainTables(tx kv.Tx, untilTx uint64) (can bool, maxStepToPrune uint64) {
-	if m := dt.files.EndTxNum(); m > 0 {
-		maxStepToPrune = (m - 1) / dt.d.aggregationStep
+	// only complete steps: files of other step size or block-aligned files may end in the middle of step, see
+	// recordedStepSize and filesItem.dataRange
+	if m := dt.files.dataEndTxNum() / dt.d.aggregationStep; m > 0 {
+		maxStepToPrune = m - 1
 	}
 	var untilStep uint64
 	if untilTx > 0 {
@@ -1715,61 +2041,80 @@ func (dc *DomainPruneStat) Accumulate(other *DomainPruneStat) {
 }
 
 func (dt *DomainRoTx) Prune(ctx context.Context, rwTx kv.RwTx, step, txFrom, txTo, limit uint64, logEvery *time.Ticker) (stat *DomainPruneStat, err error) {
+	j := dt.pruneJob(rwTx, step, txFrom, txTo, limit)
+	defer j.close()
+	if err = j.collect(ctx, rwTx); err != nil {
+		return j.stat, err
+	}
+	if err = j.apply(ctx, rwTx, logEvery); err != nil {
+		return j.stat, err
+	}
+	return j.stat, nil
+}
+
+// domainPruneJob - DomainRoTx.Prune split in 2 phases, see pruneJob. History is pruned first, then domain tables:
+// collect: read-only walk of `keysTable` from prune progress (or from end) to older steps, pairs (key, ^step) are sorted by etl.
+// apply: deletes collected pairs from `keysTable` and `valsTable`, saves prune progress if `limit` reached.
+type domainPruneJob struct {
+	dt                 *DomainRoTx
+	history            *iiPruneJob // nil - nothing to prune in history
+	step, txFrom, txTo uint64
+	limit              uint64
+	skip               bool // canPruneDomainTables=false
+	prunedKey          []byte
+	prunedKeyErr       error
+	collector          *etl.Collector
+	progress           []byte // key to continue from by next Prune: `limit` reached. nil - all pruned
+	stat               *DomainPruneStat
+}
+
+// pruneJob - `tx` is used only for checks of what can be pruned and to read prune progress
+func (dt *DomainRoTx) pruneJob(tx kv.Tx, step, txFrom, txTo, limit uint64) *domainPruneJob {
 	if limit == 0 {
 		limit = math.MaxUint64
 	}
+	j := &domainPruneJob{dt: dt, txFrom: txFrom, txTo: txTo, limit: limit, stat: &DomainPruneStat{MinStep: math.MaxUint64}}
+	j.history = dt.ht.pruneJob(tx, txFrom, txTo, limit)
 
-	stat = &DomainPruneStat{MinStep: math.MaxUint64}
-	if stat.History, err = dt.ht.Prune(ctx, rwTx, txFrom, txTo, limit, false, logEvery); err != nil {
-		return nil, fmt.Errorf("prune history at step %d [%d, %d): %w", step, txFrom, txTo, err)
-	}
-	canPrune, maxPrunableStep := dt.canPruneDomainTables(rwTx, txTo)
+	canPrune, maxPrunableStep := dt.canPruneDomainTables(tx, txTo)
 	if !canPrune {
-		return stat, nil
+		j.skip = true
+		return j
 	}
-	if step > maxPrunableStep {
-		step = maxPrunableStep
-	}
-
-	st := time.Now()
-	mxPruneInProgress.Inc()
-	defer mxPruneInProgress.Dec()
+	j.step = min(step, maxPrunableStep)
+	j.prunedKey, j.prunedKeyErr = GetExecV3PruneProgress(tx, dt.d.keysTable)
+	return j
+}
 
-	keysCursorForDeletes, err := rwTx.RwCursorDupSort(dt.d.keysTable)
-	if err != nil {
-		return stat, fmt.Errorf("create %s domain cursor: %w", dt.d.filenameBase, err)
+func (j *domainPruneJob) collect(ctx context.Context, tx kv.Tx) error {
+	if j.history != nil {
+		if err := j.history.collect(ctx, tx); err != nil {
+			return fmt.Errorf("prune history at step %d [%d, %d): %w", j.step, j.txFrom, j.txTo, err)
+		}
 	}
-	defer keysCursorForDeletes.Close()
-	keysCursor, err := rwTx.RwCursorDupSort(dt.d.keysTable)
+	if j.skip {
+		return nil
+	}
+	d := j.dt.d
+	keysCursor, err := tx.CursorDupSort(d.keysTable)
 	if err != nil {
-		return stat, fmt.Errorf("create %s domain cursor: %w", dt.d.filenameBase, err)
+		return fmt.Errorf("create %s domain cursor: %w", d.filenameBase, err)
 	}
 	defer keysCursor.Close()
 
-	valsCursor, err := rwTx.RwCursor(dt.d.valsTable)
-	if err != nil {
-		return stat, fmt.Errorf("create %s domain values cursor: %w", dt.d.filenameBase, err)
-	}
-	defer valsCursor.Close()
+	j.collector = etl.NewCollector("prune domain "+d.filenameBase, d.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize/8), d.logger)
+	j.collector.LogLvl(log.LvlDebug)
+	j.collector.SortAndFlushInBackground(true)
 
-	//fmt.Printf("prune domain %s from %d to %d step %d limit %d\n", dt.d.filenameBase, txFrom, txTo, step, limit)
-	//defer func() {
-	//	dt.d.logger.Info("[snapshots] prune domain",
-	//		"name", dt.d.filenameBase,
-	//		"pruned keys", stat.Values,
-	//		"from", txFrom, "to", txTo, "step", step,
-	//		"keys until limit", limit)
-	//}()
-	prunedKey, err := GetExecV3PruneProgress(rwTx, dt.d.keysTable)
-	if err != nil {
-		dt.d.logger.Error("get domain pruning progress", "name", dt.d.filenameBase, "error", err)
+	if j.prunedKeyErr != nil {
+		d.logger.Error("get domain pruning progress", "name", d.filenameBase, "error", j.prunedKeyErr)
 	}
 
 	var k, v []byte
-	if prunedKey != nil {
-		_, _, err = keysCursor.Seek(prunedKey)
+	if j.prunedKey != nil {
+		_, _, err = keysCursor.Seek(j.prunedKey)
 		if err != nil {
-			return stat, err
+			return err
 		}
 		// could have some smaller steps to prune
 		k, v, err = keysCursor.NextNoDup()
@@ -1777,40 +2122,28 @@ func (dt *DomainRoTx) Prune(ctx context.Context, rwTx kv.RwTx, step, txFrom, txT
 		k, v, err = keysCursor.Last()
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	seek := make([]byte, 0, 256)
+	limit, stat := j.limit, j.stat
 	for k != nil {
 		if err != nil {
-			return stat, fmt.Errorf("iterate over %s domain keys: %w", dt.d.filenameBase, err)
+			return fmt.Errorf("iterate over %s domain keys: %w", d.filenameBase, err)
 		}
 
 		is := ^binary.BigEndian.Uint64(v)
-		if is > step {
+		if is > j.step {
 			k, v, err = keysCursor.PrevNoDup()
 			continue
 		}
 		if limit == 0 {
-			if err := SaveExecV3PruneProgress(rwTx, dt.d.keysTable, k); err != nil {
-				return stat, fmt.Errorf("save domain pruning progress: %s, %w", dt.d.filenameBase, err)
-			}
-			return stat, nil
+			j.progress = common.Copy(k)
+			return nil
 		}
 		limit--
 
-		seek = append(append(seek[:0], k...), v...)
-		err = valsCursor.Delete(seek)
-		if err != nil {
-			return stat, fmt.Errorf("prune domain value: %w", err)
-		}
-
-		// This DeleteCurrent needs to the last in the loop iteration, because it invalidates k and v
-		if _, _, err = keysCursorForDeletes.SeekBothExact(k, v); err != nil {
-			return stat, err
-		}
-		if err = keysCursorForDeletes.DeleteCurrent(); err != nil {
-			return stat, err
+		if err = j.collector.Collect(k, v); err != nil {
+			return err
 		}
 		stat.Values++
 		stat.MaxStep = max(stat.MaxStep, is)
@@ -1821,23 +2154,103 @@ func (dt *DomainRoTx) Prune(ctx context.Context, rwTx kv.RwTx, step, txFrom, txT
 		select {
 		case <-ctx.Done():
 			// consider ctx exiting as incorrect outcome, error is returned
-			return stat, ctx.Err()
+			return ctx.Err()
+		default:
+		}
+	}
+	return nil
+}
+
+func (j *domainPruneJob) apply(ctx context.Context, rwTx kv.RwTx, logEvery *time.Ticker) (err error) {
+	if j.history != nil {
+		if err = j.history.apply(ctx, rwTx, logEvery); err != nil {
+			return fmt.Errorf("prune history at step %d [%d, %d): %w", j.step, j.txFrom, j.txTo, err)
+		}
+		j.stat.History = j.history.stat
+	}
+	if j.skip {
+		return nil
+	}
+
+	d := j.dt.d
+	st := time.Now()
+	mxPruneInProgress.Inc()
+	defer mxPruneInProgress.Dec()
+
+	keysCursorForDeletes, err := rwTx.RwCursorDupSort(d.keysTable)
+	if err != nil {
+		return fmt.Errorf("create %s domain cursor: %w", d.filenameBase, err)
+	}
+	defer keysCursorForDeletes.Close()
+	valsCursor, err := rwTx.RwCursor(d.valsTable)
+	if err != nil {
+		return fmt.Errorf("create %s domain values cursor: %w", d.filenameBase, err)
+	}
+	defer valsCursor.Close()
+	var codeHashesCursor kv.RwCursor
+	if d.codeHashIndex {
+		if codeHashesCursor, err = rwTx.RwCursor(kv.TblCodeHashes); err != nil {
+			return fmt.Errorf("create %s domain code hashes cursor: %w", d.filenameBase, err)
+		}
+		defer codeHashesCursor.Close()
+	}
+
+	var pruned uint64
+	seek := make([]byte, 0, 256)
+	if err = j.collector.Load(nil, "", func(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		seek = append(append(seek[:0], k...), v...)
+		if codeHashesCursor != nil {
+			_, code, err := valsCursor.SeekExact(seek)
+			if err != nil {
+				return fmt.Errorf("prune domain value: %w", err)
+			}
+			if err := pruneCodeHash(codeHashesCursor, code, ^binary.BigEndian.Uint64(v)); err != nil {
+				return fmt.Errorf("prune domain code hash: %w", err)
+			}
+		}
+		if err := valsCursor.Delete(seek); err != nil {
+			return fmt.Errorf("prune domain value: %w", err)
+		}
+		if _, _, err := keysCursorForDeletes.SeekBothExact(k, v); err != nil {
+			return err
+		}
+		if err := keysCursorForDeletes.DeleteCurrent(); err != nil {
+			return err
+		}
+		pruned++
+
+		select {
 		case <-logEvery.C:
-			dt.d.logger.Info("[snapshots] prune domain", "name", dt.d.filenameBase,
-				"pruned keys", stat.Values,
-				"steps", fmt.Sprintf("%.2f-%.2f", float64(txFrom)/float64(dt.d.aggregationStep), float64(txTo)/float64(dt.d.aggregationStep)))
+			d.logger.Info("[snapshots] prune domain", "name", d.filenameBase,
+				"pruned keys", pruned,
+				"steps", fmt.Sprintf("%.2f-%.2f", float64(j.txFrom)/float64(d.aggregationStep), float64(j.txTo)/float64(d.aggregationStep)))
 		default:
 		}
+		return nil
+	}, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		return err
 	}
-	mxPruneSizeDomain.AddUint64(stat.Values)
+	mxPruneSizeDomain.AddUint64(pruned)
 
-	if err := SaveExecV3PruneProgress(rwTx, dt.d.keysTable, nil); err != nil {
-		return stat, fmt.Errorf("save domain pruning progress: %s, %w", dt.d.filenameBase, err)
+	if err := SaveExecV3PruneProgress(rwTx, d.keysTable, j.progress); err != nil {
+		return fmt.Errorf("save domain pruning progress: %s, %w", d.filenameBase, err)
 	}
 	mxPruneTookDomain.ObserveDuration(st)
-	return stat, nil
+	return nil
+}
+
+func (j *domainPruneJob) close() {
+	if j.history != nil {
+		j.history.close()
+	}
+	if j.collector != nil {
+		j.collector.Close()
+	}
 }
 
+// DomainLatestIterFile - k-way merge of latest values: DB is the newest layer, then files from newest to oldest.
+// Newer layer shadows older ones by key. Every file is positioned by btree once and then read sequentially by own
+// getter - memory is O(files)
 type DomainLatestIterFile struct {
 	dc *DomainRoTx
 
@@ -1859,7 +2272,7 @@ func (hi *DomainLatestIterFile) Close() {
 }
 func (hi *DomainLatestIterFile) init(dc *DomainRoTx) error {
 	// Implementation:
-	//     File endTxNum  = last txNum of file step
+	//     File endTxNum  = last txNum of file step, see filesItem.latestTxNum
 	//     DB endTxNum    = first txNum of step in db
 	//     RAM endTxNum   = current txnum
 	//  Example: stepSize=8, file=0-2.kv, db has key of step 2, current tx num is 17
@@ -1868,63 +2281,94 @@ func (hi *DomainLatestIterFile) init(dc *DomainRoTx) error {
 	//     RAM endTxNum   = 17, because current tcurrent txNum is 17
 
 	heap.Init(hi.h)
-	var k, v []byte
-	var err error
 
-	keysCursor, err := hi.roTx.CursorDupSort(dc.d.keysTable)
-	if err != nil {
-		return err
-	}
-	if k, v, err = keysCursor.Seek(hi.from); err != nil {
-		return err
-	}
-	if k != nil && (hi.to == nil || bytes.Compare(k, hi.to) < 0) {
-		step := ^binary.BigEndian.Uint64(v)
-		endTxNum := step * dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
-
-		keySuffix := make([]byte, len(k)+8)
-		copy(keySuffix, k)
-		copy(keySuffix[len(k):], v)
-		if v, err = hi.roTx.GetOne(dc.d.valsTable, keySuffix); err != nil {
+	if hi.roTx != nil { // nil - files only
+		keysCursor, err := hi.roTx.CursorDupSort(dc.d.keysTable)
+		if err != nil {
 			return err
 		}
-		heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(v), c: keysCursor, endTxNum: endTxNum, reverse: true})
-	}
-
-	for i, item := range dc.files {
-		// todo release btcursor when iter over/make it truly stateless
-		btCursor, err := dc.statelessBtree(i).Seek(dc.statelessGetter(i), hi.from)
+		k, v, err := keysCursor.Seek(hi.from)
 		if err != nil {
 			return err
 		}
-		if btCursor == nil {
-			continue
+		if k != nil && hi.inRange(k) {
+			step := ^binary.BigEndian.Uint64(v)
+			endTxNum := step * dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+
+			keySuffix := make([]byte, len(k)+8)
+			copy(keySuffix, k)
+			copy(keySuffix[len(k):], v)
+			if v, err = hi.roTx.GetOne(dc.d.valsTable, keySuffix); err != nil {
+				return err
+			}
+			heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(v), c: keysCursor, endTxNum: endTxNum, reverse: true})
 		}
+	}
 
-		key := btCursor.Key()
-		if key != nil && (hi.to == nil || bytes.Compare(key, hi.to) < 0) {
-			val := btCursor.Value()
-			txNum := item.endTxNum - 1 // !important: .kv files have semantic [from, t)
-			heap.Push(hi.h, &CursorItem{t: FILE_CURSOR, key: key, val: val, btCursor: btCursor, endTxNum: txNum, reverse: true})
+	var keyHash uint64
+	singleKey := isSingleKeyRange(hi.from, hi.to)
+	if singleKey {
+		keyHash, _ = dc.ht.iit.hashKey(hi.from)
+	}
+	for i, item := range dc.files {
+		if singleKey && item.src.existence != nil && !item.src.existence.probe(keyHash, dc.d.mxExistence) {
+			continue // file can't have the only key of range
+		}
+		var offset uint64
+		if item.src.bindex == nil {
+			k, kOffset, err := dc.d.seekNoAccessor(item.src, dc.statelessGetter(i), hi.from)
+			if err != nil {
+				return err
+			}
+			if k == nil || !hi.inRange(k) {
+				continue
+			}
+			offset = kOffset
+		} else {
+			// todo release btcursor when iter over/make it truly stateless
+			btCursor, err := dc.statelessBtree(i).Seek(dc.statelessGetter(i), hi.from)
+			if err != nil {
+				return err
+			}
+			if btCursor == nil || btCursor.Key() == nil || !hi.inRange(btCursor.Key()) {
+				continue
+			}
+			offset = btCursor.offsetInFile()
 		}
+		g := NewArchiveGetter(item.src.decompressor.MakeGetter(), dc.d.compression)
+		g.Reset(offset)
+		key, _ := g.Next(nil)
+		val, _ := g.Next(nil)
+		txNum := item.src.latestTxNum(dc.d.aggregationStep)
+		heap.Push(hi.h, &CursorItem{t: FILE_CURSOR, key: key, val: val, dg: g, endTxNum: txNum, reverse: true})
 	}
 	return hi.advanceInFiles()
 }
 
+func (hi *DomainLatestIterFile) inRange(k []byte) bool {
+	return hi.to == nil || bytes.Compare(k, hi.to) < 0
+}
+
+// isSingleKeyRange - [from, to) has only one key: `from`
+func isSingleKeyRange(from, to []byte) bool {
+	return len(to) == len(from)+1 && to[len(from)] == 0 && bytes.HasPrefix(to, from)
+}
+
 func (hi *DomainLatestIterFile) advanceInFiles() error {
 	for hi.h.Len() > 0 {
-		lastKey := (*hi.h)[0].key
-		lastVal := (*hi.h)[0].val
+		// copy: file items re-use their buffers on advance
+		hi.nextKey = append(hi.nextKey[:0], (*hi.h)[0].key...)
+		hi.nextVal = append(hi.nextVal[:0], (*hi.h)[0].val...)
 
 		// Advance all the items that have this key (including the top)
-		for hi.h.Len() > 0 && bytes.Equal((*hi.h)[0].key, lastKey) {
+		for hi.h.Len() > 0 && bytes.Equal((*hi.h)[0].key, hi.nextKey) {
 			ci1 := heap.Pop(hi.h).(*CursorItem)
 			switch ci1.t {
 			case FILE_CURSOR:
-				if ci1.btCursor.Next() {
-					ci1.key = ci1.btCursor.Key()
-					ci1.val = ci1.btCursor.Value()
-					if ci1.key != nil && (hi.to == nil || bytes.Compare(ci1.key, hi.to) < 0) {
+				if ci1.dg.HasNext() {
+					ci1.key, _ = ci1.dg.Next(ci1.key[:0])
+					ci1.val, _ = ci1.dg.Next(ci1.val[:0])
+					if hi.inRange(ci1.key) {
 						heap.Push(hi.h, ci1)
 					}
 				}
@@ -1933,7 +2377,7 @@ func (hi *DomainLatestIterFile) advanceInFiles() error {
 				if err != nil {
 					return err
 				}
-				if k != nil && (hi.to == nil || bytes.Compare(k, hi.to) < 0) {
+				if k != nil && hi.inRange(k) {
 					ci1.key = common.Copy(k)
 					step := ^binary.BigEndian.Uint64(v)
 					endTxNum := step * hi.dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
@@ -1950,9 +2394,8 @@ func (hi *DomainLatestIterFile) advanceInFiles() error {
 				}
 			}
 		}
-		if len(lastVal) > 0 {
-			hi.nextKey, hi.nextVal = lastKey, lastVal
-			return nil // founc
+		if len(hi.nextVal) > 0 {
+			return nil // found
 		}
 	}
 	hi.nextKey = nil
@@ -1975,14 +2418,6 @@ func (hi *DomainLatestIterFile) Next() ([]byte, []byte, error) {
 	return hi.kBackup, hi.vBackup, nil
 }
 
-func (d *Domain) stepsRangeInDBAsStr(tx kv.Tx) string {
-	a1, a2 := d.History.InvertedIndex.stepsRangeInDB(tx)
-	//ad1, ad2 := d.stepsRangeInDB(tx)
-	//if ad2-ad1 < 0 {
-	//	fmt.Printf("aaa: %f, %f\n", ad1, ad2)
-	//}
-	return fmt.Sprintf("%s:%.1f", d.filenameBase, a2-a1)
-}
 func (d *Domain) stepsRangeInDB(tx kv.Tx) (from, to float64) {
 	fst, _ := kv.FirstKey(tx, d.valsTable)
 	if len(fst) > 0 {
@@ -23,8 +23,11 @@ import (
 	"strings"
 
 	"github.com/ledgerwatch/erigon-lib/commitment"
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/seg"
 )
 
 type ValueMerger func(prev, current []byte) (merged []byte, err error)
@@ -129,6 +132,17 @@ func (dt *DomainRoTx) findShortenedKey(fullKey []byte, itemGetter ArchiveGetter,
 		}
 		return encodeShorterKey(nil, offset), true
 	}
+	if dt.d.indexList&withBTree != 0 && item.bindex == nil {
+		k, offset, err := dt.d.seekNoAccessor(item, itemGetter, fullKey)
+		if err != nil {
+			dt.d.logger.Warn("commitment branch key replacement seek failed",
+				"key", fmt.Sprintf("%x", fullKey), "idx", "scan", "err", err, "file", item.decompressor.FileName())
+		}
+		if !bytes.Equal(k, fullKey) {
+			return nil, false
+		}
+		return encodeShorterKey(nil, offset), true
+	}
 	if dt.d.indexList&withBTree != 0 {
 		cur, err := item.bindex.Seek(itemGetter, fullKey)
 		if err != nil {
@@ -218,6 +232,91 @@ func (dt *DomainRoTx) lookupByShortenedKey(shortKey []byte, getter ArchiveGetter
 	return fullKey, true
 }
 
+// commitmentFileKeysReplaced - flag of commitment .kv file (see seg.Compressor.SetFlags): values may have keys replaced by
+// references to records of accounts/storage files of same range
+const commitmentFileKeysReplaced uint64 = 1
+
+// setKvFileFlags - marks .kv file which is being produced by comp. keysReplaced - values are transformed by commitmentValTransformDomain
+func (d *Domain) setKvFileFlags(comp *seg.Compressor, keysReplaced bool) {
+	if !d.kvFileFlags {
+		return
+	}
+	var flags uint64
+	if keysReplaced {
+		flags |= commitmentFileKeysReplaced
+	}
+	comp.SetFlags(flags)
+}
+
+// valuesTransformed - values of commitment file may have keys replaced by references. Files without flags are produced by
+// older versions: there only merged files of even amount of steps (of app which produced file - see recordedStepSize)
+// are transformed (if transformation was enabled). Amount of steps of file without recorded step size is unknown - such
+// file is treated as not transformed
+func (d *Domain) valuesTransformed(item *filesItem) bool {
+	if flags, ok := item.decompressor.Flags(); ok {
+		return flags&commitmentFileKeysReplaced != 0
+	}
+	if d.valuesTransform == CommitmentValuesTransformOff || item.stepSizeUnknown {
+		return false
+	}
+	fromStep, toStep := item.steps()
+	return (toStep-fromStep)%2 == 0
+}
+
+// commitmentValExpandDomain - inverse of commitmentValTransformDomain: replaces references in values of transformed files
+// by plain keys. Used by merge with CommitmentValuesTransformAtRead
+func (dt *DomainRoTx) commitmentValExpandDomain(accounts, storage *DomainRoTx) valueTransformer {
+	var lastFrom, lastTo uint64
+	var lastTransformed bool
+	return func(valBuf []byte, keyFromTxNum, keyEndTxNum uint64) (transValBuf []byte, err error) {
+		if len(valBuf) == 0 {
+			return valBuf, nil
+		}
+		if keyFromTxNum != lastFrom || keyEndTxNum != lastTo {
+			item := dt.lookupFileByItsRange(keyFromTxNum, keyEndTxNum)
+			lastFrom, lastTo, lastTransformed = keyFromTxNum, keyEndTxNum, item != nil && dt.d.valuesTransformed(item)
+		}
+		if !lastTransformed {
+			return valBuf, nil
+		}
+		return dt.expandShortenedKeys(valBuf, keyFromTxNum, keyEndTxNum, accounts, storage)
+	}
+}
+
+// expandShortenedKeys - replaces references to records of accounts/storage files of range [fromTxNum, toTxNum) by plain keys
+func (dt *DomainRoTx) expandShortenedKeys(branch commitment.BranchData, fromTxNum, toTxNum uint64, accounts, storage *DomainRoTx) (commitment.BranchData, error) {
+	si := storage.lookupFileByItsRange(fromTxNum, toTxNum)
+	if si == nil {
+		return nil, fmt.Errorf("storage file not found for %d-%d", fromTxNum/dt.d.aggregationStep, toTxNum/dt.d.aggregationStep)
+	}
+	ai := accounts.lookupFileByItsRange(fromTxNum, toTxNum)
+	if ai == nil {
+		return nil, fmt.Errorf("account file not found for %d-%d", fromTxNum/dt.d.aggregationStep, toTxNum/dt.d.aggregationStep)
+	}
+	sig := NewArchiveGetter(si.decompressor.MakeGetter(), storage.d.compression)
+	aig := NewArchiveGetter(ai.decompressor.MakeGetter(), accounts.d.compression)
+	return branch.ReplacePlainKeys(nil, func(key []byte, isStorage bool) ([]byte, error) {
+		if isStorage {
+			if len(key) == length.Addr+length.Hash {
+				return nil, nil // plain key
+			}
+			fullKey, found := storage.lookupByShortenedKey(key, sig)
+			if !found {
+				return nil, fmt.Errorf("expand: lost storage full key %x in %s", key, sig.FileName())
+			}
+			return fullKey, nil
+		}
+		if len(key) == length.Addr {
+			return nil, nil // plain key
+		}
+		fullKey, found := accounts.lookupByShortenedKey(key, aig)
+		if !found {
+			return nil, fmt.Errorf("expand: lost account full key %x in %s", key, aig.FileName())
+		}
+		return fullKey, nil
+	})
+}
+
 // commitmentValTransform parses the value of the commitment record to extract references
 // to accounts and storage items, then looks them up in the new, merged files, and replaces them with
 // the updated references
@@ -231,8 +330,18 @@ func (dt *DomainRoTx) commitmentValTransformDomain(accounts, storage *DomainRoTx
 		stoMerged = fmt.Sprintf("%d-%d", mergedStorage.startTxNum/dt.d.aggregationStep, mergedStorage.endTxNum/dt.d.aggregationStep)
 	}
 
+	var lastFrom, lastTo uint64
+	var lastTransformed bool
 	return func(valBuf []byte, keyFromTxNum, keyEndTxNum uint64) (transValBuf []byte, err error) {
-		if !dt.d.replaceKeysInValues || len(valBuf) == 0 || ((keyEndTxNum-keyFromTxNum)/dt.d.aggregationStep)%2 != 0 {
+		if dt.d.valuesTransform != CommitmentValuesTransformAtMerge || len(valBuf) == 0 {
+			return valBuf, nil
+		}
+		// source file may be produced with other step size: its flags (or its own steps) tell if it's transformed
+		if keyFromTxNum != lastFrom || keyEndTxNum != lastTo {
+			item := dt.lookupFileByItsRange(keyFromTxNum, keyEndTxNum)
+			lastFrom, lastTo, lastTransformed = keyFromTxNum, keyEndTxNum, item != nil && dt.d.valuesTransformed(item)
+		}
+		if !lastTransformed {
 			return valBuf, nil
 		}
 		si := storage.lookupFileByItsRange(keyFromTxNum, keyEndTxNum)
@@ -322,3 +431,50 @@ func (dt *DomainRoTx) commitmentValTransformDomain(accounts, storage *DomainRoTx
 		return commitment.BranchData(valBuf).ReplacePlainKeys(dt.comBuf[:0], replacer)
 	}
 }
+
+// CommitmentFileRoot - commitment state stored in visible commitment file: state at the end of the last block
+// committed before file end
+type CommitmentFileRoot struct {
+	FileName             string
+	StartTxNum, EndTxNum uint64 // range of file
+	TxNum, BlockNum      uint64 // of stored state
+	Root                 []byte
+}
+
+// CommitmentFilesRoots - root hashes of commitment state stored in visible commitment files. Files without state
+// (commitment was not computed inside of file range) are skipped. State key is never replaced by shortened reference,
+// so squeezed files are read as is.
+func (ac *AggregatorRoTx) CommitmentFilesRoots() ([]CommitmentFileRoot, error) {
+	dt := ac.d[kv.CommitmentDomain]
+	trie := commitment.NewHexPatriciaHashed(length.Addr, nil, ac.a.tmpdir)
+	res := make([]CommitmentFileRoot, 0, len(dt.files))
+	for i, item := range dt.files {
+		v, ok, err := dt.getFromFile(i, keyCommitmentState, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item.src.decompressor.FileName(), err)
+		}
+		if !ok || len(v) < 16 {
+			continue
+		}
+		cs := new(commitmentState)
+		if err := cs.Decode(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", item.src.decompressor.FileName(), err)
+		}
+		if err := trie.SetState(cs.trieState); err != nil {
+			return nil, fmt.Errorf("%s: restore state: %w", item.src.decompressor.FileName(), err)
+		}
+		rh, err := trie.RootHash()
+		if err != nil {
+			return nil, fmt.Errorf("%s: root hash: %w", item.src.decompressor.FileName(), err)
+		}
+		res = append(res, CommitmentFileRoot{
+			FileName:   item.src.decompressor.FileName(),
+			StartTxNum: item.startTxNum,
+			EndTxNum:   item.endTxNum,
+			TxNum:      cs.txNum,
+			BlockNum:   cs.blockNum,
+			Root:       common.Copy(rh),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/metrics"
+)
+
+// .kv files are visible before their .bt accessors are built (fresh datadir: BuildMissedIndices is in progress).
+// Such files are read by linear scan - slow, but node stays usable.
+var (
+	// ErrAccessorMissing - file can't be read: accessor is not built yet. See ErrAccessorScanLimit
+	ErrAccessorMissing = errors.New("accessor missing")
+
+	// noAccessorScanLimit - max amount of keys scanned in file without accessor. 0 - unlimited
+	noAccessorScanLimit = dbg.EnvInt("AGG_NO_ACCESSOR_SCAN_LIMIT", 0)
+	noAccessorWarnEvery = time.Minute
+)
+
+// noAccessorReads - stats of reads of files without .bt accessor
+type noAccessorReads struct {
+	reads    metrics.Counter
+	lastWarn atomic.Int64 // unix nanoseconds
+}
+
+func newNoAccessorReads(filenameBase string) *noAccessorReads {
+	return &noAccessorReads{
+		reads: metrics.GetOrCreateCounter(fmt.Sprintf(`domain_accessor_missing_reads{domain="%s"}`, filenameBase)),
+	}
+}
+
+// ErrAccessorScanLimit - file has no accessor and key was not found in first `Limit` keys of file
+type ErrAccessorScanLimit struct {
+	File     string // data file
+	Accessor string // missing accessor
+	Limit    int
+}
+
+func (e *ErrAccessorScanLimit) Error() string {
+	return fmt.Sprintf("%s: %s is missing, scan of %s stopped after %d keys", ErrAccessorMissing, e.Accessor, e.File, e.Limit)
+}
+func (e *ErrAccessorScanLimit) Is(target error) bool { return target == ErrAccessorMissing }
+
+// seekNoAccessor - first key >= `seek` of `item`, which has no .bt accessor. `offset` - of found key in file.
+// nil key - all keys of file are < `seek`. `g` - getter of `item`
+func (d *Domain) seekNoAccessor(item *filesItem, g ArchiveGetter, seek []byte) (k []byte, offset uint64, err error) {
+	accessor := filepath.Base(d.kvBtFilePath(item.steps()))
+	d.noAccessor.reads.Inc()
+	if now, last := time.Now().UnixNano(), d.noAccessor.lastWarn.Load(); now-last >= int64(noAccessorWarnEvery) && d.noAccessor.lastWarn.CompareAndSwap(last, now) {
+		d.logger.Warn("[agg] accessor is missing, file is read by linear scan: wait for indexing to finish", "accessor", accessor, "file", item.decompressor.FileName())
+	}
+
+	g.Reset(0)
+	for scanned := 0; g.HasNext(); scanned++ {
+		if noAccessorScanLimit > 0 && scanned >= noAccessorScanLimit {
+			return nil, 0, &ErrAccessorScanLimit{File: item.decompressor.FileName(), Accessor: accessor, Limit: noAccessorScanLimit}
+		}
+		k, _ = g.Next(k[:0])
+		if bytes.Compare(k, seek) >= 0 { // keys in file are sorted
+			return k, offset, nil
+		}
+		offset, _ = g.Skip()
+	}
+	return nil, 0, nil
+}
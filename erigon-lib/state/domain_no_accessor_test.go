@@ -0,0 +1,72 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestDomain_GetLatestWithoutBtAccessor(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	putAccounts(t, db, agg, 2*agg.StepSize()-1) // steps 0-1
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(ctx, tx, 0, nil)
+		return err
+	}))
+
+	// fresh datadir: .kv is downloaded, but .bt is not built yet
+	agg.Close()
+	require.NoError(t, os.Remove(agg.d[kv.AccountsDomain].kvBtFilePath(0, 1)))
+	agg = testAggregatorv3(t, db, agg.dirs, 16, DefaultCommitmentValuesTransform)
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	require.Len(t, ac.d[kv.AccountsDomain].files, 1)
+	require.Nil(t, ac.d[kv.AccountsDomain].files[0].src.bindex)
+
+	addr := func(txNum uint64) []byte {
+		k := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(k, txNum)
+		return k
+	}
+	reads := agg.d[kv.AccountsDomain].noAccessor.reads
+	before := reads.GetValueUint64()
+	for txNum := uint64(1); txNum < 2*agg.StepSize(); txNum++ { // step 0 - in file, step 1 - in db
+		v, _, ok, err := ac.GetLatest(kv.AccountsDomain, addr(txNum), nil, tx)
+		require.NoError(t, err)
+		require.True(t, ok, txNum)
+		nonce, balance, _ := types.DecodeAccountBytesV3(v)
+		require.Equal(t, txNum, nonce)
+		require.Equal(t, txNum, balance.Uint64())
+	}
+	require.Equal(t, before+agg.StepSize()-1, reads.GetValueUint64())
+	require.NotZero(t, agg.d[kv.AccountsDomain].noAccessor.lastWarn.Load())
+
+	_, _, ok, err := ac.GetLatest(kv.AccountsDomain, addr(100), nil, tx)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	defer func(v int) { noAccessorScanLimit = v }(noAccessorScanLimit)
+	noAccessorScanLimit = 4
+	_, _, _, err = ac.GetLatest(kv.AccountsDomain, addr(3), nil, tx)
+	require.NoError(t, err)
+	_, _, _, err = ac.GetLatest(kv.AccountsDomain, addr(agg.StepSize()-1), nil, tx)
+	require.ErrorIs(t, err, ErrAccessorMissing)
+	var limitErr *ErrAccessorScanLimit
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, "v1-accounts.0-1.bt", limitErr.Accessor)
+}
@@ -5,6 +5,7 @@ import (
 	"container/heap"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"path/filepath"
@@ -81,7 +82,7 @@ type SharedDomains struct {
 
 	domainWriters    [kv.DomainLen]*domainBufferedWriter
 	iiWriters        [kv.StandaloneIdxLen]*invertedIndexBufferedWriter
-	appendableWriter [kv.AppendableLen]*appendableBufferedWriter
+	appendableWriter [kv.AppendableMax]*appendableBufferedWriter
 
 	currentChangesAccumulator *StateChangeSet
 	pastChangesAccumulator    map[string]*StateChangeSet
@@ -112,6 +113,9 @@ func NewSharedDomains(tx kv.Tx, logger log.Logger) (*SharedDomains, error) {
 	}
 
 	for id, a := range sd.aggTx.appendable {
+		if a == nil {
+			continue
+		}
 		sd.appendableWriter[id] = a.NewWriter()
 	}
 
@@ -193,6 +197,9 @@ func (sd *SharedDomains) Unwind(ctx context.Context, rwTx kv.RwTx, blockUnwindTo
 	}
 
 	for _, ap := range sd.aggTx.appendable {
+		if ap == nil {
+			continue
+		}
 		if err := ap.Unwind(ctx, rwTx, txUnwindTo, math.MaxUint64, math.MaxUint64, logEvery, true, nil); err != nil {
 			return err
 		}
@@ -236,6 +243,32 @@ func (sd *SharedDomains) rebuildCommitment(ctx context.Context, roTx kv.Tx, bloc
 	return sd.ComputeCommitment(ctx, true, blockNum, "rebuild commit")
 }
 
+// rebuildCommitmentOfStep - same as rebuildCommitment, but keys are taken from accounts and storage files of `step`
+// (history of step may be pruned). Commitment must be seeked to start of step, state is saved at end of step.
+func (sd *SharedDomains) rebuildCommitmentOfStep(ctx context.Context, step, blockNum uint64) ([]byte, error) {
+	fromTxNum, toTxNum := sd.aggTx.a.FirstTxNumOfStep(step), sd.aggTx.a.FirstTxNumOfStep(step+1)
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		dt := sd.aggTx.d[d]
+		for i, f := range dt.files {
+			if f.startTxNum != fromTxNum || f.endTxNum != toTxNum {
+				continue
+			}
+			g := dt.statelessGetter(i)
+			g.Reset(0)
+			for g.HasNext() {
+				k, _ := g.Next(nil)
+				g.Skip()
+				sd.sdCtx.TouchKey(d, string(k), nil)
+			}
+		}
+	}
+
+	sd.SetBlockNum(blockNum)
+	sd.SetTxNum(toTxNum - 1)
+	sd.sdCtx.Reset()
+	return sd.ComputeCommitment(ctx, true, blockNum, "rebuild commit of step")
+}
+
 // SeekCommitment lookups latest available commitment and sets it as current
 func (sd *SharedDomains) SeekCommitment(ctx context.Context, tx kv.Tx) (txsFromBlockBeginning uint64, err error) {
 	bn, txn, ok, err := sd.sdCtx.SeekCommitment(tx, sd.aggTx.d[kv.CommitmentDomain], 0, math.MaxUint64)
@@ -370,12 +403,12 @@ func (sd *SharedDomains) LatestCommitment(prefix []byte) ([]byte, uint64, error)
 
 	// GetfromFiles doesn't provide same semantics as getLatestFromDB - it returns start/end tx
 	// of file where the value is stored (not exact step when kv has been set)
-	v, _, startTx, endTx, err := sd.aggTx.d[kv.CommitmentDomain].getFromFiles(prefix)
+	v, _, startTx, endTx, err := sd.aggTx.d[kv.CommitmentDomain].getFromFiles(prefix, nil)
 	if err != nil {
 		return nil, 0, fmt.Errorf("commitment prefix %x read error: %w", prefix, err)
 	}
 
-	if !sd.aggTx.a.commitmentValuesTransform || bytes.Equal(prefix, keyCommitmentState) {
+	if sd.aggTx.a.commitmentValuesTransform == CommitmentValuesTransformOff || bytes.Equal(prefix, keyCommitmentState) {
 		return v, endTx / sd.aggTx.a.StepSize(), nil
 	}
 
@@ -389,14 +422,10 @@ func (sd *SharedDomains) LatestCommitment(prefix []byte) ([]byte, uint64, error)
 
 // replaceShortenedKeysInBranch replaces shortened keys in the branch with full keys
 func (sd *SharedDomains) replaceShortenedKeysInBranch(prefix []byte, branch commitment.BranchData, fStartTxNum uint64, fEndTxNum uint64) (commitment.BranchData, error) {
-	if !sd.aggTx.d[kv.CommitmentDomain].d.replaceKeysInValues && sd.aggTx.a.commitmentValuesTransform {
-		panic("domain.replaceKeysInValues is disabled, but agg.commitmentValuesTransform is enabled")
-	}
-
-	if !sd.aggTx.a.commitmentValuesTransform ||
+	if sd.aggTx.a.commitmentValuesTransform == CommitmentValuesTransformOff ||
 		len(branch) == 0 ||
-		sd.aggTx.minimaxTxNumInDomainFiles() == 0 ||
-		bytes.Equal(prefix, keyCommitmentState) || ((fEndTxNum-fStartTxNum)/sd.aggTx.a.StepSize())%2 != 0 {
+		sd.aggTx.MinimaxTxNum(true) == 0 ||
+		bytes.Equal(prefix, keyCommitmentState) {
 
 		return branch, nil // do not transform, return as is
 	}
@@ -404,8 +433,10 @@ func (sd *SharedDomains) replaceShortenedKeysInBranch(prefix []byte, branch comm
 	sto := sd.aggTx.d[kv.StorageDomain]
 	acc := sd.aggTx.d[kv.AccountsDomain]
 	com := sd.aggTx.d[kv.CommitmentDomain]
-	commItem := com.lookupFileByItsRange(fStartTxNum, fEndTxNum)
-	_ = commItem
+	// flag of file: with CommitmentValuesTransformAtRead only files produced in AtMerge mode are transformed
+	if commItem := com.lookupFileByItsRange(fStartTxNum, fEndTxNum); commItem == nil || !com.d.valuesTransformed(commItem) {
+		return branch, nil
+	}
 	storageItem := sto.lookupFileByItsRange(fStartTxNum, fEndTxNum)
 	if storageItem == nil {
 		sd.logger.Crit("storage file of steps %d-%d not found\n", fStartTxNum/sd.aggTx.a.aggregationStep, fEndTxNum/sd.aggTx.a.aggregationStep)
@@ -646,7 +677,7 @@ func (sd *SharedDomains) ComputeCommitment(ctx context.Context, saveStateAfter b
 // k and v lifetime is bounded by the lifetime of the iterator
 func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v []byte, step uint64) error) error {
 	// Implementation:
-	//     File endTxNum  = last txNum of file step
+	//     File endTxNum  = last txNum of file step, see filesItem.latestTxNum
 	//     DB endTxNum    = first txNum of step in db
 	//     RAM endTxNum   = current txnum
 	//  Example: stepSize=8, file=0-2.kv, db has key of step 2, current tx num is 17
@@ -700,6 +731,19 @@ func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v
 
 	sctx := sd.aggTx.d[kv.StorageDomain]
 	for i, item := range sctx.files {
+		if item.src.bindex == nil {
+			g := NewArchiveGetter(item.src.decompressor.MakeGetter(), sctx.d.compression)
+			key, _, err := sctx.d.seekNoAccessor(item.src, g, prefix)
+			if err != nil {
+				return err
+			}
+			if key != nil && bytes.HasPrefix(key, prefix) {
+				val, latestOffset := g.Next(nil)
+				txNum := item.src.latestTxNum(sd.StepSize())
+				heap.Push(cpPtr, &CursorItem{t: FILE_CURSOR, key: key, val: val, step: 0, dg: g, latestOffset: latestOffset, endTxNum: txNum, reverse: true})
+			}
+			continue
+		}
 		cursor, err := item.src.bindex.Seek(sctx.statelessGetter(i), prefix)
 		if err != nil {
 			return err
@@ -711,7 +755,7 @@ func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v
 		key := cursor.Key()
 		if key != nil && bytes.HasPrefix(key, prefix) {
 			val := cursor.Value()
-			txNum := item.endTxNum - 1 // !important: .kv files have semantic [from, t)
+			txNum := item.src.latestTxNum(sd.StepSize())
 			heap.Push(cpPtr, &CursorItem{t: FILE_CURSOR, key: key, val: val, step: 0, btCursor: cursor, endTxNum: txNum, reverse: true})
 		}
 	}
@@ -734,7 +778,7 @@ func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v
 					}
 				}
 			case FILE_CURSOR:
-				if UseBtree || UseBpsTree {
+				if ci1.btCursor != nil {
 					if ci1.btCursor.Next() {
 						ci1.key = ci1.btCursor.Key()
 						if ci1.key != nil && bytes.HasPrefix(ci1.key, prefix) {
@@ -844,9 +888,16 @@ func (sd *SharedDomains) Flush(ctx context.Context, tx kv.RwTx) error {
 			return err
 		}
 	}
+	for _, a := range sd.appendableWriter {
+		if a != nil {
+			if err := a.Flush(ctx, tx); err != nil {
+				return err
+			}
+		}
+	}
 	if dbg.PruneOnFlushTimeout != 0 {
 		_, err = sd.aggTx.PruneSmallBatches(ctx, dbg.PruneOnFlushTimeout, tx)
-		if err != nil {
+		if err != nil && !errors.Is(err, ErrPruneBusy) {
 			return err
 		}
 	}
@@ -900,7 +951,11 @@ func (sd *SharedDomains) DomainPut(domain kv.Domain, k1, k2 []byte, val, prevVal
 			return err
 		}
 	}
+	return sd.domainPut(domain, k1, k2, val, prevVal, prevStep)
+}
 
+// domainPut - DomainPut with resolved `prevVal` (nil - key has no value)
+func (sd *SharedDomains) domainPut(domain kv.Domain, k1, k2 []byte, val, prevVal []byte, prevStep uint64) error {
 	switch domain {
 	case kv.AccountsDomain:
 		return sd.updateAccountData(k1, val, prevVal, prevStep)
@@ -930,7 +985,11 @@ func (sd *SharedDomains) DomainDel(domain kv.Domain, k1, k2 []byte, prevVal []by
 			return err
 		}
 	}
+	return sd.domainDel(domain, k1, k2, prevVal, prevStep)
+}
 
+// domainDel - DomainDel with resolved `prevVal` (nil - key has no value)
+func (sd *SharedDomains) domainDel(domain kv.Domain, k1, k2 []byte, prevVal []byte, prevStep uint64) error {
 	switch domain {
 	case kv.AccountsDomain:
 		return sd.deleteAccount(k1, prevVal, prevStep)
@@ -988,6 +1047,9 @@ func (sd *SharedDomains) DomainDelPrefix(domain kv.Domain, prefix []byte) error
 func (sd *SharedDomains) Tx() kv.Tx { return sd.roTx }
 
 func (sd *SharedDomains) AppendablePut(name kv.Appendable, ts kv.TxnId, v []byte) error {
+	if name >= kv.AppendableMax || sd.appendableWriter[name] == nil {
+		return fmt.Errorf("%w: %s", ErrAppendableNotRegistered, name)
+	}
 	return sd.appendableWriter[name].Append(ts, v)
 }
 
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// DomainEntry - 1 write of SharedDomains.PutBatch
+type DomainEntry struct {
+	Domain kv.Domain
+	Key    []byte // full key: for StorageDomain - addr+loc
+	Value  []byte // nil - delete
+
+	// PrevKnown - PrevValue and PrevStep are known to caller (nil PrevValue - key has no value): lookup is skipped
+	PrevKnown bool
+	PrevValue []byte
+	PrevStep  uint64
+}
+
+type latestValue struct {
+	v    []byte
+	step uint64
+}
+
+// PutBatch - writes `entries` at `txNum`. Result is same as SetTxNum(txNum) and DomainPut (DomainDel for nil Value) of
+// entries one by one, but previous values are resolved before writes: entries with PrevKnown skip lookup, others are
+// read once per key, in order of keys grouped by domain (neighbouring lookups touch same DB and file pages). Then
+// values, history and inverted indices are written in 1 pass in order of `entries`.
+func (sd *SharedDomains) PutBatch(entries []DomainEntry, txNum uint64) error {
+	sd.SetTxNum(txNum)
+	resolved, err := sd.resolvePrevValues(entries)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		prevVal, prevStep := e.PrevValue, e.PrevStep
+		if !e.PrevKnown {
+			// written by previous entries of batch (or deleted with account) - as DomainGet of sequential write
+			if v, step, ok := sd.get(e.Domain, e.Key); ok {
+				prevVal, prevStep = v, step
+			} else if r, ok := resolved[e.Domain][string(e.Key)]; ok {
+				prevVal, prevStep = r.v, r.step
+			} else if prevVal, prevStep, err = sd.DomainGet(e.Domain, e.Key, nil); err != nil {
+				return err
+			}
+		}
+		if e.Value == nil {
+			err = sd.domainDel(e.Domain, e.Key, nil, prevVal, prevStep)
+		} else {
+			err = sd.domainPut(e.Domain, e.Key, nil, e.Value, prevVal, prevStep)
+		}
+		if err != nil {
+			return fmt.Errorf("PutBatch: %s %x: %w", e.Domain, e.Key, err)
+		}
+	}
+	return nil
+}
+
+// resolvePrevValues - latest values of keys of `entries` which have no known prev and are not written by SharedDomains yet.
+// CommitmentDomain has own read path: resolved by DomainGet at write
+func (sd *SharedDomains) resolvePrevValues(entries []DomainEntry) (resolved [kv.DomainLen]map[string]latestValue, err error) {
+	var keys [kv.DomainLen][][]byte
+	for i := range entries {
+		e := &entries[i]
+		if e.PrevKnown || e.Domain == kv.CommitmentDomain {
+			continue
+		}
+		if _, _, ok := sd.get(e.Domain, e.Key); ok {
+			continue
+		}
+		keys[e.Domain] = append(keys[e.Domain], e.Key)
+	}
+	for domain, l := range keys {
+		if len(l) == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return bytes.Compare(l[i], l[j]) < 0 })
+		resolved[domain] = make(map[string]latestValue, len(l))
+		for i, k := range l {
+			if i > 0 && bytes.Equal(k, l[i-1]) {
+				continue
+			}
+			v, step, _, err := sd.aggTx.GetLatest(kv.Domain(domain), k, nil, sd.roTx)
+			if err != nil {
+				return resolved, fmt.Errorf("%s %x read error: %w", kv.Domain(domain), k, err)
+			}
+			resolved[domain][string(k)] = latestValue{v: v, step: step}
+		}
+	}
+	return resolved, nil
+}
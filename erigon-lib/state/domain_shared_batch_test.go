@@ -0,0 +1,203 @@
+package state
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// putSequentially - same writes as PutBatch, by DomainPut and DomainDel
+func putSequentially(sd *SharedDomains, entries []DomainEntry, txNum uint64) error {
+	sd.SetTxNum(txNum)
+	for _, e := range entries {
+		var prevVal []byte
+		var prevStep uint64
+		if e.PrevKnown {
+			prevVal, prevStep = e.PrevValue, e.PrevStep
+		}
+		var err error
+		if e.Value == nil {
+			err = sd.DomainDel(e.Domain, e.Key, nil, prevVal, prevStep)
+		} else {
+			err = sd.DomainPut(e.Domain, e.Key, nil, e.Value, prevVal, prevStep)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateBatches - accounts, code and storage of few addresses: keys repeat within batch and between batches, some
+// writes are deletes (of storage, code and accounts with their storage), some carry known prev values
+func generateBatches(rnd *rand.Rand, batches, perBatch int, stepSize uint64) (res [][]DomainEntry) {
+	addr := func() []byte {
+		a := make([]byte, length.Addr)
+		a[0] = byte(rnd.Intn(4)) + 1
+		return a
+	}
+	type latest struct {
+		v    []byte
+		step uint64
+	}
+	known := map[string]latest{}
+	for b := 0; b < batches; b++ {
+		txNum := uint64(b)
+		var entries []DomainEntry
+		for i := 0; i < perBatch; i++ {
+			e := DomainEntry{Key: addr()}
+			switch r := rnd.Intn(100); {
+			case r < 15:
+				e.Domain = kv.AccountsDomain
+				e.Value = types.EncodeAccountBytesV3(uint64(rnd.Intn(100)), uint256.NewInt(uint64(rnd.Intn(1000))), nil, 0)
+				if r < 1 {
+					e.Value = nil
+				}
+			case r < 20:
+				e.Domain = kv.CodeDomain
+				e.Value = []byte{byte(rnd.Intn(3))}
+				if r < 17 {
+					e.Value = nil
+				}
+			default:
+				e.Domain = kv.StorageDomain
+				e.Key = append(e.Key, make([]byte, length.Hash)...)
+				e.Key[length.Addr] = byte(rnd.Intn(20))
+				e.Value = []byte{byte(rnd.Intn(256)), 1}
+				if r < 30 {
+					e.Value = nil
+				}
+			}
+			mapKey := string(e.Key) + e.Domain.String()
+			if prev, ok := known[mapKey]; ok && prev.v != nil && rnd.Intn(2) == 0 {
+				e.PrevKnown, e.PrevValue, e.PrevStep = true, prev.v, prev.step
+			}
+			known[mapKey] = latest{v: e.Value, step: txNum / stepSize}
+			entries = append(entries, e)
+		}
+		res = append(res, entries)
+	}
+	return res
+}
+
+// dumpTables - all rows of all tables
+func dumpTables(t *testing.T, db kv.RoDB) map[string][][2]string {
+	t.Helper()
+	res := map[string][][2]string{}
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		tables, err := tx.(kv.BucketMigratorRO).ListBuckets()
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if err := tx.ForEach(table, nil, func(k, v []byte) error {
+				res[table] = append(res[table], [2]string{string(k), string(v)})
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return res
+}
+
+func TestSharedDomains_PutBatch(t *testing.T) {
+	const stepSize = 16
+	ctx := context.Background()
+	batches := generateBatches(rand.New(rand.NewSource(1)), 5*stepSize, 40, stepSize)
+
+	write := func(t *testing.T, put func(sd *SharedDomains, entries []DomainEntry, txNum uint64) error) kv.RwDB {
+		t.Helper()
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		// 1 SharedDomains per step: prev values of previous steps are read from DB
+		for from := 0; from < len(batches); from += stepSize {
+			rwTx, err := db.BeginRw(ctx)
+			require.NoError(t, err)
+			ac := agg.BeginFilesRo()
+			domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+			require.NoError(t, err)
+			for txNum := from; txNum < from+stepSize && txNum < len(batches); txNum++ {
+				require.NoError(t, put(domains, batches[txNum], uint64(txNum)))
+			}
+			require.NoError(t, domains.Flush(ctx, rwTx))
+			domains.Close()
+			ac.Close()
+			require.NoError(t, rwTx.Commit())
+		}
+		return db
+	}
+
+	sequentialDB := write(t, putSequentially)
+	batchDB := write(t, func(sd *SharedDomains, entries []DomainEntry, txNum uint64) error {
+		return sd.PutBatch(entries, txNum)
+	})
+	sequential, batch := dumpTables(t, sequentialDB), dumpTables(t, batchDB)
+	require.NotEmpty(t, sequential[kv.TblStorageHistoryVals])
+	require.NotEmpty(t, sequential[kv.TblAccountVals])
+	require.Equal(t, len(sequential), len(batch))
+	for table, rows := range sequential {
+		require.Equal(t, rows, batch[table], table)
+	}
+}
+
+// BenchmarkSharedDomains_PutBatch - 10k storage writes per block to random slots, which are in DB; half of writes carry
+// known prev value
+func BenchmarkSharedDomains_PutBatch(b *testing.B) {
+	const slots, writes = 50_000, 10_000
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorBench(b, 1_000_000)
+	rnd := rand.New(rand.NewSource(1))
+	keys := make([][]byte, slots)
+	for i := range keys {
+		keys[i] = make([]byte, length.Addr+length.Hash)
+		rnd.Read(keys[i])
+	}
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(b, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(b, err)
+	domains.SetTxNum(1)
+	for _, k := range keys {
+		require.NoError(b, domains.DomainPut(kv.StorageDomain, k, nil, []byte{1}, nil, 0))
+	}
+	require.NoError(b, domains.Flush(ctx, rwTx))
+	domains.Close()
+
+	block := make([]DomainEntry, writes)
+	for i := range block {
+		block[i] = DomainEntry{Domain: kv.StorageDomain, Key: keys[rnd.Intn(slots)], Value: []byte{2}}
+		if i%2 == 0 {
+			block[i].PrevKnown, block[i].PrevValue, block[i].PrevStep = true, []byte{1}, 0
+		}
+	}
+
+	for _, bench := range []struct {
+		name string
+		put  func(sd *SharedDomains, entries []DomainEntry, txNum uint64) error
+	}{
+		{"sequential", putSequentially},
+		{"batch", func(sd *SharedDomains, entries []DomainEntry, txNum uint64) error { return sd.PutBatch(entries, txNum) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+				require.NoError(b, err)
+				require.NoError(b, bench.put(domains, block, 2))
+				domains.Close()
+			}
+		})
+	}
+}
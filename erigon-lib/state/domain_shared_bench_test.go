@@ -13,9 +13,11 @@ import (
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 )
 
-func Benchmark_SharedDomains_GetLatest(t *testing.B) {
+// filledAggregatorForGetLatestBench - accounts of `keys` are updated on every txNum, most steps are in files
+func filledAggregatorForGetLatestBench(t *testing.B) (db kv.RwDB, agg *Aggregator, keys [][]byte, maxTx uint64) {
+	t.Helper()
 	stepSize := uint64(100)
-	db, agg := testDbAndAggregatorBench(t, stepSize)
+	db, agg = testDbAndAggregatorBench(t, stepSize)
 
 	ctx := context.Background()
 	rwTx, err := db.BeginRw(ctx)
@@ -28,12 +30,12 @@ func Benchmark_SharedDomains_GetLatest(t *testing.B) {
 	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
 	require.NoError(t, err)
 	defer domains.Close()
-	maxTx := stepSize * 258
+	maxTx = stepSize * 258
 
 	seed := int64(4500)
 	rnd := rand.New(rand.NewSource(seed))
 
-	keys := make([][]byte, 8)
+	keys = make([][]byte, 8)
 	for i := 0; i < len(keys); i++ {
 		keys[i] = make([]byte, length.Addr)
 		rnd.Read(keys[i])
@@ -65,8 +67,15 @@ func Benchmark_SharedDomains_GetLatest(t *testing.B) {
 	require.NoError(t, err)
 	err = rwTx.Commit()
 	require.NoError(t, err)
+	return db, agg, keys, maxTx
+}
+
+func Benchmark_SharedDomains_GetLatest(t *testing.B) {
+	db, agg, keys, maxTx := filledAggregatorForGetLatestBench(t)
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(4500))
 
-	rwTx, err = db.BeginRw(ctx)
+	rwTx, err := db.BeginRw(ctx)
 	require.NoError(t, err)
 	defer rwTx.Rollback()
 
@@ -99,6 +108,53 @@ func Benchmark_SharedDomains_GetLatest(t *testing.B) {
 	}
 }
 
+func Benchmark_SharedDomains_GetLatestInto(b *testing.B) {
+	db, agg, keys, _ := filledAggregatorForGetLatestBench(b)
+	ctx := context.Background()
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(b, err)
+	defer roTx.Rollback()
+
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+
+	// account reads of execution: value is decoded and discarded
+	b.Run("GetLatest", func(b *testing.B) {
+		b.ReportAllocs()
+		for ik := 0; ik < b.N; ik++ {
+			v, _, ok, err := ac.GetLatest(kv.AccountsDomain, keys[ik%len(keys)], nil, roTx)
+			if err != nil || !ok {
+				b.Fatal(err, ok)
+			}
+			_ = binary.BigEndian.Uint64(v)
+		}
+	})
+	b.Run("GetLatestInto", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, 128)
+		for ik := 0; ik < b.N; ik++ {
+			v, _, ok, err := ac.GetLatestInto(kv.AccountsDomain, keys[ik%len(keys)], nil, buf, roTx)
+			if err != nil || !ok {
+				b.Fatal(err, ok)
+			}
+			_ = binary.BigEndian.Uint64(v)
+			buf = v
+		}
+	})
+	b.Run("GetLatestIntoUnsafe", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, 128)
+		for ik := 0; ik < b.N; ik++ {
+			v, _, ok, err := ac.GetLatestIntoUnsafe(kv.AccountsDomain, keys[ik%len(keys)], nil, buf, roTx)
+			if err != nil || !ok {
+				b.Fatal(err, ok)
+			}
+			_ = binary.BigEndian.Uint64(v)
+		}
+	})
+}
+
 func BenchmarkSharedDomains_ComputeCommitment(b *testing.B) {
 	b.StopTimer()
 
@@ -64,7 +64,7 @@ func TestSharedDomain_CommitmentKeyReplacement(t *testing.T) {
 	require.NoError(t, err)
 
 	t.Logf("expected hash: %x", expectedHash)
-	t.Logf("valueTransform enabled: %t", agg.commitmentValuesTransform)
+	t.Logf("valueTransform mode: %s", agg.commitmentValuesTransform)
 	err = agg.BuildFiles(stepSize * 16)
 	require.NoError(t, err)
 
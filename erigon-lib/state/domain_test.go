@@ -18,6 +18,7 @@ package state
 
 import (
 	"bytes"
+	"container/heap"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
@@ -48,6 +49,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/length"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/seg"
 )
 
 func testDbAndDomain(t *testing.T, logger log.Logger) (kv.RwDB, *Domain) {
@@ -55,7 +57,7 @@ func testDbAndDomain(t *testing.T, logger log.Logger) (kv.RwDB, *Domain) {
 	return testDbAndDomainOfStep(t, 16, logger)
 }
 
-func testDbAndDomainOfStep(t *testing.T, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain) {
+func testDbAndDomainOfStep(t testing.TB, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain) {
 	t.Helper()
 	dirs := datadir2.New(t.TempDir())
 	keysTable := "Keys"
@@ -522,7 +524,7 @@ func collateAndMerge(t *testing.T, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64
 	}
 }
 
-func collateAndMergeOnce(t *testing.T, d *Domain, tx kv.RwTx, step uint64, prune bool) {
+func collateAndMergeOnce(t testing.TB, d *Domain, tx kv.RwTx, step uint64, prune bool) {
 	t.Helper()
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
@@ -1401,6 +1403,99 @@ func TestDomain_GetAfterAggregation(t *testing.T) {
 	}
 }
 
+func TestDomain_GetLatestInto(t *testing.T) {
+	for _, compression := range []FileCompression{CompressNone, CompressKeys | CompressVals} {
+		compression := compression
+		t.Run(fmt.Sprintf("compression=%d", compression), func(t *testing.T) {
+			db, d := testDbAndDomainOfStep(t, 25, log.New())
+			ctx := context.Background()
+			tx, err := db.BeginRw(ctx)
+			require.NoError(t, err)
+			defer tx.Rollback()
+
+			d.historyLargeValues = false
+			d.History.compression = compression
+			d.compression = compression
+
+			dc := d.BeginFilesRo()
+			writer := dc.NewWriter()
+			defer writer.close()
+
+			totalTx := uint64(1000)
+			data := generateTestData(t, length.Addr, length.Addr+length.Hash, totalTx, 30, 100)
+			for key, updates := range data {
+				p := []byte{}
+				for i := 0; i < len(updates); i++ {
+					writer.SetTxNum(updates[i].txNum)
+					require.NoError(t, writer.PutWithPrev([]byte(key), nil, updates[i].value, p, 0))
+					p = common.Copy(updates[i].value)
+				}
+			}
+			writer.SetTxNum(totalTx)
+			require.NoError(t, writer.Flush(ctx, tx))
+			dc.Close()
+
+			// last 2 steps stay in db: values are read from both db and files
+			collateAndMerge(t, db, tx, d, totalTx)
+			require.NoError(t, tx.Commit())
+
+			roTx, err := db.BeginRo(ctx)
+			require.NoError(t, err)
+			defer roTx.Rollback()
+			dc = d.BeginFilesRo()
+			defer dc.Close()
+
+			var buf []byte
+			unsafeBuf := make([]byte, 0, 256) // returned value may be sub-slice of mmap - don't use it as next buffer
+			got := make(map[string][]byte, len(data))
+			for key, updates := range data {
+				if len(updates) == 0 {
+					continue
+				}
+				expect, expectStep, ok, err := dc.GetLatest([]byte(key), nil, roTx)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.EqualValues(t, updates[len(updates)-1].value, expect)
+
+				v, step, ok, err := dc.GetLatestInto([]byte(key), nil, buf, roTx)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, expectStep, step)
+				require.EqualValuesf(t, expect, v, "key %x", []byte(key))
+				if len(v) > 0 && cap(buf) >= len(v) {
+					require.True(t, &buf[:1][0] == &v[0], "buffer must be reused")
+				}
+				buf = v
+				got[key] = common.Copy(v)
+
+				v, step, ok, err = dc.GetLatestIntoUnsafe([]byte(key), nil, unsafeBuf, roTx)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, expectStep, step)
+				require.EqualValuesf(t, expect, v, "key %x", []byte(key))
+			}
+
+			// not found: buffer is truncated, previous value is not returned
+			v, _, ok, err := dc.GetLatestInto([]byte("not-existing-key"), nil, buf, roTx)
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.Empty(t, v)
+
+			// values are copies: valid after end of tx
+			var someKey string
+			for key := range got {
+				someKey = key
+				break
+			}
+			v, _, ok, err = dc.GetLatestInto([]byte(someKey), nil, nil, roTx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			roTx.Rollback()
+			require.Equal(t, got[someKey], v)
+		})
+	}
+}
+
 func TestDomain_CanPruneAfterAggregation(t *testing.T) {
 	aggStep := uint64(25)
 	db, d := testDbAndDomainOfStep(t, aggStep, log.New())
@@ -2245,7 +2340,7 @@ func TestDomainContext_findShortenedKey(t *testing.T) {
 	var ki int
 	for key, updates := range data {
 
-		v, found, st, en, err := dc.getFromFiles([]byte(key))
+		v, found, st, en, err := dc.getFromFiles([]byte(key), nil)
 		require.True(t, found)
 		require.NoError(t, err)
 		for i := len(updates) - 1; i >= 0; i-- {
@@ -2266,3 +2361,437 @@ func TestDomainContext_findShortenedKey(t *testing.T) {
 		ki++
 	}
 }
+
+func TestDomain_GetAsOfMany(t *testing.T) {
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	ctx := context.Background()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	// first half of steps - in files, second half - in DB
+	for step := uint64(0); step < txs/d.aggregationStep/2; step++ {
+		collateAndMergeOnce(t, d, tx, step, true)
+	}
+
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.NotEmpty(t, dc.files)
+
+	keys := make([][]byte, 0, 40)
+	for keyNum := uint64(40); keyNum > 0; keyNum-- { // 32..40 - never written
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		keys = append(keys, k[:])
+	}
+	keys = append(keys, keys[3]) // duplicates must work too
+
+	for _, txNum := range []uint64{0, 1, 17, txs / 4, txs / 2, txs/2 + 3, txs - 1, txs + 1, txs * 2} {
+		vals, oks, err := dc.GetAsOfMany(keys, txNum, tx)
+		require.NoError(t, err)
+		require.Len(t, vals, len(keys))
+		for i, k := range keys {
+			v, err := dc.GetAsOf(k, txNum, tx)
+			require.NoError(t, err)
+			require.Equal(t, v, vals[i], "key %x txNum=%d", k, txNum)
+			require.Equal(t, v != nil, oks[i], "key %x txNum=%d", k, txNum)
+		}
+	}
+}
+
+func TestDomain_ExistenceFilterStats(t *testing.T) {
+	db, d, txs := filledDomain(t, log.New())
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	for step := uint64(0); step < txs/d.aggregationStep; step++ {
+		collateAndMergeOnce(t, d, tx, step, true)
+	}
+
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.NotEmpty(t, dc.files)
+
+	key := func(keyNum uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		return k[:]
+	}
+	// filters built from wrong keys set: keys 32..40 were never written, but filter says "yes" for them
+	for _, f := range dc.files {
+		filter, err := NewExistenceFilter(40, filepath.Join(t.TempDir(), "fake.kvei"))
+		require.NoError(t, err)
+		for keyNum := uint64(1); keyNum <= 40; keyNum++ {
+			hi, _ := dc.ht.iit.hashKey(key(keyNum))
+			filter.AddHash(hi)
+		}
+		f.src.existence = filter
+	}
+
+	for keyNum := uint64(1); keyNum <= 40; keyNum++ {
+		_, _, found, err := dc.GetLatest(key(keyNum), nil, tx)
+		require.NoError(t, err)
+		require.Equal(t, keyNum <= 31, found, keyNum)
+	}
+	for keyNum := uint64(1000); keyNum < 1100; keyNum++ { // not in filters
+		_, _, found, err := dc.GetLatest(key(keyNum), nil, tx)
+		require.NoError(t, err)
+		require.False(t, found)
+	}
+
+	var total ExistenceFilterStats
+	for _, f := range dc.files {
+		st := f.src.existence.Stats()
+		total.Probes += st.Probes
+		total.Negatives += st.Negatives
+		total.FalsePositives += st.FalsePositives
+	}
+	require.Positive(t, total.Probes)
+	require.Positive(t, total.Negatives)
+	require.GreaterOrEqual(t, total.FalsePositives, uint64(9*len(dc.files))) // each never-written key is false-positive in each file
+	require.Positive(t, total.FalsePositiveRate())
+	require.LessOrEqual(t, total.FalsePositiveRate(), 1.0)
+}
+
+func BenchmarkDomain_GetAsOfMany(b *testing.B) {
+	db, d := testDbAndDomainOfStep(b, 16, log.New())
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(b, err)
+	defer tx.Rollback()
+
+	keys := make([][]byte, 10_000)
+	for i := range keys {
+		keys[i] = make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(keys[i], uint64(i))
+	}
+	rand.New(rand.NewSource(0)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	dc := d.BeginFilesRo()
+	writer := dc.NewWriter()
+	prev := make([][]byte, len(keys))
+	txs := d.aggregationStep * 4
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		writer.SetTxNum(txNum)
+		for i := int(txNum % 8); i < len(keys); i += 8 {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, txNum)
+			require.NoError(b, writer.PutWithPrev(keys[i], nil, v, prev[i], 0))
+			prev[i] = v
+		}
+	}
+	require.NoError(b, writer.Flush(ctx, tx))
+	writer.close()
+	dc.Close()
+	for step := uint64(0); step < 2; step++ {
+		collateAndMergeOnce(b, d, tx, step, true)
+	}
+
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+	txNum := d.aggregationStep*2 + d.aggregationStep/2
+
+	b.Run("naive", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				if _, err := dc.GetAsOf(k, txNum, tx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("many", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := dc.GetAsOfMany(keys, txNum, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// buildDomainStepFiles - collate, build and prune every step without merge: one visible file per step
+func buildDomainStepFiles(tb testing.TB, d *Domain, tx kv.RwTx, steps uint64) {
+	tb.Helper()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	for step := uint64(0); step < steps; step++ {
+		txFrom, txTo := step*d.aggregationStep, (step+1)*d.aggregationStep
+		c, err := d.collate(ctx, step, txFrom, txTo, tx)
+		require.NoError(tb, err)
+		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
+		require.NoError(tb, err)
+		d.integrateDirtyFiles(sf, txFrom, txTo)
+		d.reCalcVisibleFiles()
+
+		dc := d.BeginFilesRo()
+		_, err = dc.Prune(ctx, tx, step, txFrom, txTo, math.MaxUint64, logEvery)
+		dc.Close()
+		require.NoError(tb, err)
+	}
+}
+
+func TestDomain_RangeLatestShadowing(t *testing.T) {
+	db, d := testDbAndDomain(t, log.New())
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	const keysCount, steps = 200, 6
+	key := func(i int) []byte { return binary.BigEndian.AppendUint64(nil, uint64(i)) }
+
+	// model of latest values: empty - deleted
+	type latest struct {
+		val  []byte
+		step uint64
+	}
+	model := map[string]latest{}
+
+	dc := d.BeginFilesRo()
+	writer := dc.NewWriter()
+	for step := uint64(0); step <= steps; step++ { // last step stays in DB
+		txNum := step*d.aggregationStep + 1
+		writer.SetTxNum(txNum)
+		for i := 0; i < keysCount; i++ {
+			k := key(i)
+			prev := model[string(k)]
+			switch {
+			case (i+int(step))%7 == 0 && len(prev.val) > 0:
+				require.NoError(t, writer.DeleteWithPrev(k, nil, prev.val, prev.step))
+				model[string(k)] = latest{step: step}
+			case i%int(step+2) == 0: // small keys are shadowed by every step
+				v := []byte(fmt.Sprintf("%d.%d", i, step))
+				require.NoError(t, writer.PutWithPrev(k, nil, v, prev.val, prev.step))
+				model[string(k)] = latest{val: v, step: step}
+			}
+		}
+	}
+	require.NoError(t, writer.Flush(ctx, tx))
+	writer.close()
+	dc.Close()
+	buildDomainStepFiles(t, d, tx, steps)
+
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+	require.Len(t, dc.files, steps)
+
+	check := func(t *testing.T, from, to []byte, limit int) {
+		t.Helper()
+		var expectKeys []string
+		for k, l := range model {
+			if len(l.val) == 0 || (from != nil && k < string(from)) || (to != nil && k >= string(to)) {
+				continue
+			}
+			expectKeys = append(expectKeys, k)
+		}
+		sort.Strings(expectKeys)
+		if limit >= 0 && len(expectKeys) > limit {
+			expectKeys = expectKeys[:limit]
+		}
+
+		it, err := dc.DomainRangeLatest(tx, from, to, limit)
+		require.NoError(t, err)
+		var gotKeys []string
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(t, err)
+			require.Equal(t, string(model[string(k)].val), string(v), "key %x", k)
+			gotKeys = append(gotKeys, string(k))
+		}
+		require.Equal(t, expectKeys, gotKeys)
+	}
+
+	t.Run("full", func(t *testing.T) { check(t, nil, nil, -1) })
+	t.Run("limit", func(t *testing.T) { check(t, nil, nil, 13) })
+	t.Run("boundaries", func(t *testing.T) {
+		for _, r := range [][2]int{{0, 1}, {3, 60}, {60, 61}, {61, 62}, {7, 8}, {100, keysCount}, {150, 150}} {
+			check(t, key(r[0]), key(r[1]), -1)
+		}
+		check(t, key(42), nil, -1)
+		check(t, nil, key(42), -1)
+		check(t, []byte{0}, []byte{0, 0, 0, 0, 0, 0, 0, 60, 1}, -1) // bounds are not keys
+	})
+	t.Run("single key", func(t *testing.T) {
+		for _, i := range []int{0, 1, 6, 7, 14, 60, keysCount + 1} {
+			check(t, key(i), append(key(i), 0), -1)
+		}
+	})
+}
+
+// domainRangeLatestBtCursors - reference iteration over files: every key of every file is read by btree cursor
+// (previous implementation of DomainRangeLatest)
+func domainRangeLatestBtCursors(dc *DomainRoTx, fn func(k, v []byte)) error {
+	var h CursorHeap
+	heap.Init(&h)
+	for i, item := range dc.files {
+		c, err := dc.statelessBtree(i).Seek(dc.statelessGetter(i), nil)
+		if err != nil {
+			return err
+		}
+		if c != nil && c.Key() != nil {
+			heap.Push(&h, &CursorItem{t: FILE_CURSOR, key: c.Key(), val: c.Value(), btCursor: c, endTxNum: item.endTxNum - 1, reverse: true})
+		}
+	}
+	for h.Len() > 0 {
+		lastKey, lastVal := common.Copy(h[0].key), common.Copy(h[0].val)
+		for h.Len() > 0 && bytes.Equal(h[0].key, lastKey) {
+			ci := heap.Pop(&h).(*CursorItem)
+			if ci.btCursor.Next() {
+				ci.key, ci.val = ci.btCursor.Key(), ci.btCursor.Value()
+				heap.Push(&h, ci)
+			}
+		}
+		if len(lastVal) > 0 {
+			fn(lastKey, lastVal)
+		}
+	}
+	return nil
+}
+
+func BenchmarkDomain_RangeLatest(b *testing.B) {
+	db, d := testDbAndDomainOfStep(b, 16, log.New())
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(b, err)
+	defer tx.Rollback()
+
+	// 1M keys across 6 overlapping files: every file has half of keys
+	const keysCount, steps = 1_000_000, 6
+	prev := make([][]byte, keysCount)
+	prevStep := make([]uint64, keysCount)
+	dc := d.BeginFilesRo()
+	writer := dc.NewWriter()
+	for step := uint64(0); step < steps; step++ {
+		writer.SetTxNum(step * d.aggregationStep)
+		for i := int(step % 2); i < keysCount; i += 2 {
+			k := binary.BigEndian.AppendUint64(make([]byte, 0, length.Addr), uint64(i))
+			v := binary.BigEndian.AppendUint64(nil, step)
+			require.NoError(b, writer.PutWithPrev(k, nil, v, prev[i], prevStep[i]))
+			prev[i], prevStep[i] = v, step
+		}
+	}
+	require.NoError(b, writer.Flush(ctx, tx))
+	writer.close()
+	dc.Close()
+	buildDomainStepFiles(b, d, tx, steps)
+
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+
+	b.Run("btree cursors", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var cnt int
+			if err := domainRangeLatestBtCursors(dc, func(k, v []byte) { cnt++ }); err != nil {
+				b.Fatal(err)
+			}
+			require.Equal(b, keysCount, cnt)
+		}
+	})
+	b.Run("k-way merge", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			it, err := dc.DomainRangeLatest(tx, nil, nil, -1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			cnt, err := iter.CountKV(it)
+			if err != nil {
+				b.Fatal(err)
+			}
+			require.Equal(b, keysCount, cnt)
+		}
+	})
+}
+
+func TestDomain_CompressionDictionary(t *testing.T) {
+	// values are built from blobs, each blob is used too rarely in one file to be sampled as pattern
+	rnd := rand.New(rand.NewSource(0))
+	blobs := make([][]byte, 64)
+	for i := range blobs {
+		blobs[i] = make([]byte, 32)
+		rnd.Read(blobs[i])
+	}
+	dict, err := seg.NewDictionary(seg.EncodeDictionary(blobs))
+	require.NoError(t, err)
+
+	const totalTx = 128
+	keys := make([][]byte, totalTx)
+	for i := range keys {
+		keys[i] = make([]byte, length.Addr)
+		rnd.Read(keys[i])
+	}
+	value := func(i int) []byte { return append(common.Copy(blobs[i%len(blobs)]), byte(i)) }
+
+	build := func(t *testing.T, dict *seg.Dictionary) (kv.RwDB, *Domain) {
+		db, d := testDbAndDomainOfStep(t, 16, log.New())
+		d.compression = CompressKeys | CompressVals
+		d.compressDict = dict
+		ctx := context.Background()
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		dc := d.BeginFilesRo()
+		writer := dc.NewWriter()
+		for i := range keys {
+			writer.SetTxNum(uint64(i))
+			require.NoError(t, writer.PutWithPrev(keys[i], nil, value(i), nil, 0))
+		}
+		require.NoError(t, writer.Flush(ctx, tx))
+		writer.close()
+		dc.Close()
+		collateAndMerge(t, db, tx, d, totalTx)
+		require.NoError(t, tx.Commit())
+		return db, d
+	}
+	// reads values of keys which are in files
+	readFromFiles := func(t *testing.T, db kv.RwDB, d *Domain) (res [][]byte, filesSize int64) {
+		roTx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer roTx.Rollback()
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		for _, f := range dc.files {
+			filesSize += f.src.decompressor.Size()
+		}
+		for i := 0; i < int(dc.files.EndTxNum()); i++ {
+			v, _, ok, err := dc.GetLatest(keys[i], nil, roTx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			res = append(res, common.Copy(v))
+		}
+		return res, filesSize
+	}
+
+	plainDB, plain := build(t, nil)
+	dictDB, withDict := build(t, dict)
+	plainValues, plainSize := readFromFiles(t, plainDB, plain)
+	dictValues, dictSize := readFromFiles(t, dictDB, withDict)
+	require.NotEmpty(t, plainValues)
+	require.Equal(t, plainValues, dictValues)
+	for i, v := range dictValues {
+		require.Equal(t, value(i), v)
+	}
+	require.Less(t, dictSize, plainSize)
+
+	dc := withDict.BeginFilesRo()
+	kvFilePath := dc.files[0].src.decompressor.FilePath()
+	dc.Close()
+	withDict.Close()
+	withDict.compressDict = nil
+	err = withDict.OpenFolder()
+	require.ErrorIs(t, err, &seg.ErrDictionaryMismatch{}, "files built with dictionary must not be opened without it")
+	_, err = seg.NewDecompressor(kvFilePath)
+	require.ErrorIs(t, err, &seg.ErrDictionaryMismatch{})
+
+	withDict.Close()
+	withDict.compressDict = dict
+	require.NoError(t, withDict.OpenFolder())
+	reopenedValues, _ := readFromFiles(t, dictDB, withDict)
+	require.Equal(t, dictValues, reopenedValues)
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+)
+
+// emptySteps - steps in which domain had no changes: files are not produced for them (see Aggregator.SetSkipEmptySteps),
+// but steps are covered - visible files may have gap at them. There are no files to derive them from on restart, so they are
+// persisted in sidecar file `<domain>.empty-steps.txt` next to domain files. Markers are kept after merge of files around them:
+// they are few, and history and index files of same range may be merged later than values
+type emptySteps struct {
+	lock  sync.Mutex
+	path  string
+	steps []uint64 // sorted
+}
+
+func newEmptySteps(snapDomainDir, filenameBase string) *emptySteps {
+	return &emptySteps{path: filepath.Join(snapDomainDir, filenameBase+".empty-steps.txt")}
+}
+
+// load - reads sidecar file. Missing file - no empty steps
+func (e *emptySteps) load() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			e.steps = nil
+			return nil
+		}
+		return err
+	}
+	var steps []uint64
+	for _, line := range strings.Fields(string(data)) {
+		step, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", e.path, err)
+		}
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+	e.steps = steps
+	return nil
+}
+
+func (e *emptySteps) add(step uint64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	i := sort.Search(len(e.steps), func(i int) bool { return e.steps[i] >= step })
+	if i < len(e.steps) && e.steps[i] == step {
+		return nil
+	}
+	e.steps = append(e.steps[:i], append([]uint64{step}, e.steps[i:]...)...)
+	return e.saveLocked()
+}
+
+// list - copy of sorted steps. nil-safe: standalone inverted indices have no empty steps
+func (e *emptySteps) list() []uint64 {
+	if e == nil {
+		return nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]uint64{}, e.steps...)
+}
+
+func (e *emptySteps) saveLocked() error {
+	if len(e.steps) == 0 {
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, step := range e.steps {
+		buf.WriteString(strconv.FormatUint(step, 10))
+		buf.WriteByte('\n')
+	}
+	tmpPath := e.path + ".tmp"
+	if err := dir.WriteFileWithFsync(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, e.path)
+}
+
+// coveredEndTxNum - `endTxNum` of files extended by empty steps which follow it
+func coveredEndTxNum(endTxNum uint64, steps []uint64, aggregationStep uint64) uint64 {
+	i := sort.Search(len(steps), func(i int) bool { return steps[i] >= endTxNum/aggregationStep })
+	for ; i < len(steps) && steps[i] == endTxNum/aggregationStep; i++ {
+		endTxNum += aggregationStep
+	}
+	return endTxNum
+}
+
+// stepsAreEmpty - all steps in [fromTxNum, toTxNum) are empty steps
+func stepsAreEmpty(fromTxNum, toTxNum uint64, steps []uint64, aggregationStep uint64) bool {
+	return coveredEndTxNum(fromTxNum, steps, aggregationStep) >= toTxNum
+}
@@ -0,0 +1,170 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAggregatorV3_SkipEmptySteps(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.SetSkipEmptySteps(true)
+	ctx := context.Background()
+	const steps = 4
+
+	codeAddr := make([]byte, length.Addr)
+	codeAddr[0] = 0xff
+	codeTxNum0, codeTxNum3 := uint64(5), 3*agg.StepSize()+3 // code changes only in steps 0 and 3
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	for txNum := uint64(1); txNum < steps*agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), nil, 0))
+		switch txNum {
+		case codeTxNum0:
+			require.NoError(t, domains.DomainPut(kv.CodeDomain, codeAddr, nil, []byte("code0"), nil, 0))
+		case codeTxNum3:
+			require.NoError(t, domains.DomainPut(kv.CodeDomain, codeAddr, nil, []byte("code3"), []byte("code0"), 0))
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+
+	for step := uint64(0); step < steps; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	code := agg.d[kv.CodeDomain]
+	require.FileExists(t, code.kvFilePath(0, 1))
+	require.NoFileExists(t, code.kvFilePath(1, 2))
+	require.NoFileExists(t, code.kvFilePath(2, 3))
+	require.FileExists(t, code.kvFilePath(3, 4))
+	require.NoFileExists(t, code.vFilePath(1, 2))
+	require.NoFileExists(t, code.efFilePath(2, 3))
+	require.FileExists(t, agg.d[kv.AccountsDomain].kvFilePath(1, 2), "domains with changes are not affected")
+	require.Equal(t, []uint64{1, 2}, code.emptySteps.list())
+	require.FileExists(t, code.emptySteps.path)
+	require.Equal(t, steps*agg.StepSize(), agg.EndTxNumMinimax(), "empty steps are covered")
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	checkAsOf := func(agg *Aggregator) {
+		t.Helper()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		ac.SetReadSource(kv.CodeDomain, ReadSourceFilesOnly)
+		for _, tc := range []struct {
+			txNum uint64
+			want  string
+		}{
+			{codeTxNum0, ""},
+			{codeTxNum0 + 1, "code0"},
+			{agg.StepSize() + 1, "code0"},   // inside empty step: resolves to older file
+			{2*agg.StepSize() + 1, "code0"}, // inside empty step
+			{codeTxNum3, "code0"},
+			{codeTxNum3 + 1, "code3"},
+		} {
+			v, _, err := ac.DomainGetAsOf(tx, kv.CodeDomain, codeAddr, tc.txNum)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(v), tc.txNum)
+		}
+	}
+	checkAsOf(agg)
+
+	// markers survive restart
+	agg2 := testAggregatorv3(t, db, agg.dirs, 16, DefaultCommitmentValuesTransform)
+	require.Equal(t, []uint64{1, 2}, agg2.d[kv.CodeDomain].emptySteps.list())
+	require.Equal(t, steps*agg.StepSize(), agg2.EndTxNumMinimax())
+
+	// merge spans empty steps
+	for {
+		somethingMerged, err := agg.mergeLoopStep(ctx)
+		require.NoError(t, err)
+		if !somethingMerged {
+			break
+		}
+	}
+	ac = agg.BeginFilesRo()
+	require.Len(t, ac.d[kv.CodeDomain].files, 1)
+	require.Len(t, ac.d[kv.CodeDomain].ht.files, 1)
+	ac.Close()
+	require.FileExists(t, code.kvFilePath(0, 4))
+	require.FileExists(t, code.vFilePath(0, 4))
+	require.FileExists(t, code.efFilePath(0, 4))
+	require.Equal(t, steps*agg.StepSize(), agg.EndTxNumMinimax())
+	checkAsOf(agg)
+}
+
+func TestMergedDataRangeEmptySteps(t *testing.T) {
+	item := func(fromStep, toStep uint64) *filesItem { return newFilesItem(fromStep*16, toStep*16, 16) }
+	files := []*filesItem{item(1, 2), item(3, 4)}
+
+	from, to, err := mergedDataRange(files, 0, []uint64{0, 2}, 16)
+	require.NoError(t, err)
+	require.Equal(t, [2]uint64{0, 64}, [2]uint64{from, to})
+	from, _, err = mergedDataRange(files, 0, []uint64{2}, 16)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), from, "step 0 is not empty: range starts at first file")
+	require.True(t, stepsAreEmpty(16, 48, []uint64{1, 2}, 16))
+	require.False(t, stepsAreEmpty(16, 48, []uint64{2}, 16))
+	require.Equal(t, uint64(48), coveredEndTxNum(16, []uint64{1, 2, 5}, 16))
+	require.Equal(t, uint64(16), coveredEndTxNum(16, []uint64{2}, 16))
+}
+
+func TestAggregatorV3_CloneEmptySteps(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.SetSkipEmptySteps(true)
+	ctx := context.Background()
+	const steps = 3
+
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	for txNum := uint64(1); txNum < steps*agg.StepSize(); txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), nil, 0))
+		if txNum == 5 { // code changes only in step 0: steps 1, 2 are empty
+			require.NoError(t, domains.DomainPut(kv.CodeDomain, addr, nil, []byte("code"), nil, 0))
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	for step := uint64(0); step < steps; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+	require.Equal(t, []uint64{1, 2}, agg.d[kv.CodeDomain].emptySteps.list())
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	clone := ac.Clone()
+	defer clone.Close()
+	require.Equal(t, steps*agg.StepSize(), ac.MinimaxTxNum(false), "empty steps are covered")
+	require.Equal(t, ac.MinimaxTxNum(false), clone.MinimaxTxNum(false))
+	require.Equal(t, ac.MinimaxTxNum(true), clone.MinimaxTxNum(true))
+	require.Equal(t, ac.d[kv.CodeDomain].endTxNum(), clone.d[kv.CodeDomain].endTxNum())
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Classes of failures of files building. Check class by errors.Is, get details by errors.As:
+//
+//	var collErr *ErrCollationFailed
+//	if errors.As(err, &collErr) { ... collErr.Domain, collErr.Step ... }
+//
+// Cause is preserved: errors.Is(err, context.Canceled) works as before
+var (
+	ErrCollation  = errors.New("collation failed")
+	ErrBuild      = errors.New("files build failed")
+	ErrMerge      = errors.New("merge failed")
+	ErrIndexBuild = errors.New("index build failed")
+)
+
+// ErrCollationFailed - reading of step from DB failed
+type ErrCollationFailed struct {
+	Domain string // filenameBase of domain, inverted index or appendable
+	Step   uint64
+	Err    error
+}
+
+func (e *ErrCollationFailed) Error() string {
+	return fmt.Sprintf("collation %q step %d has failed: %v", e.Domain, e.Step, e.Err)
+}
+func (e *ErrCollationFailed) Unwrap() error        { return e.Err }
+func (e *ErrCollationFailed) Is(target error) bool { return target == ErrCollation }
+
+// ErrBuildFailed - building of files from collated step failed
+type ErrBuildFailed struct {
+	Domain string // filenameBase of domain, inverted index or appendable
+	Step   uint64
+	Err    error
+}
+
+func (e *ErrBuildFailed) Error() string {
+	return fmt.Sprintf("build %q step %d has failed: %v", e.Domain, e.Step, e.Err)
+}
+func (e *ErrBuildFailed) Unwrap() error        { return e.Err }
+func (e *ErrBuildFailed) Is(target error) bool { return target == ErrBuild }
+
+// ErrMergeFailed - merge of files failed
+type ErrMergeFailed struct {
+	Ranges string // see RangesV3.String
+	Err    error
+}
+
+func (e *ErrMergeFailed) Error() string {
+	return fmt.Sprintf("merge %s has failed: %v", e.Ranges, e.Err)
+}
+func (e *ErrMergeFailed) Unwrap() error        { return e.Err }
+func (e *ErrMergeFailed) Is(target error) bool { return target == ErrMerge }
+
+// ErrIndexBuildFailed - building of accessor (.kvi, .bt, .vi, .efi, .api) of file failed
+type ErrIndexBuildFailed struct {
+	File string // data file
+	Err  error
+}
+
+func (e *ErrIndexBuildFailed) Error() string {
+	return fmt.Sprintf("build index of %s has failed: %v", e.File, e.Err)
+}
+func (e *ErrIndexBuildFailed) Unwrap() error        { return e.Err }
+func (e *ErrIndexBuildFailed) Is(target error) bool { return target == ErrIndexBuild }
+
+// indexBuildFailed - wraps error of accessor build of `item`
+func indexBuildFailed(item *filesItem, err error) error {
+	if err == nil {
+		return nil
+	}
+	var file string
+	if item.decompressor != nil {
+		file = item.decompressor.FileName()
+	}
+	return &ErrIndexBuildFailed{File: file, Err: err}
+}
+
+// errLogArgs - `err` and fields of typed errors of files building, for logger
+func errLogArgs(err error) []interface{} {
+	args := []interface{}{"err", err}
+	var (
+		collErr  *ErrCollationFailed
+		buildErr *ErrBuildFailed
+		mergeErr *ErrMergeFailed
+		idxErr   *ErrIndexBuildFailed
+	)
+	switch {
+	case errors.As(err, &collErr):
+		args = append(args, "class", "collation", "domain", collErr.Domain, "step", collErr.Step)
+	case errors.As(err, &buildErr):
+		args = append(args, "class", "build", "domain", buildErr.Domain, "step", buildErr.Step)
+	case errors.As(err, &mergeErr):
+		args = append(args, "class", "merge", "ranges", mergeErr.Ranges)
+	case errors.As(err, &idxErr):
+		args = append(args, "class", "index", "file", idxErr.File)
+	}
+	return args
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// failures are real: produced file can't be renamed into place - directory with same name is there
+func TestFilesBuildErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("collation", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		writeRandomSteps(t, db, agg, 1)
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := agg.buildFiles(canceled, 0)
+		require.ErrorIs(t, err, ErrCollation)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotErrorIs(t, err, ErrBuild)
+		var collErr *ErrCollationFailed
+		require.ErrorAs(t, err, &collErr)
+		require.NotEmpty(t, collErr.Domain)
+		require.Equal(t, uint64(0), collErr.Step)
+		require.Equal(t, []interface{}{"err", err, "class", "collation", "domain", collErr.Domain, "step", uint64(0)}, errLogArgs(err))
+	})
+	t.Run("build", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		writeRandomSteps(t, db, agg, 1)
+		require.NoError(t, os.Mkdir(agg.d[kv.AccountsDomain].kvFilePath(0, 1), 0755))
+
+		err := agg.buildFiles(ctx, 0)
+		require.ErrorIs(t, err, ErrBuild)
+		require.NotErrorIs(t, err, ErrCollation)
+		var buildErr *ErrBuildFailed
+		require.ErrorAs(t, err, &buildErr)
+		require.Equal(t, agg.d[kv.AccountsDomain].filenameBase, buildErr.Domain)
+		require.Equal(t, uint64(0), buildErr.Step)
+	})
+	t.Run("merge", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		buildRandomSteps(t, db, agg, 2)
+		require.NoError(t, os.Mkdir(agg.d[kv.AccountsDomain].kvFilePath(0, 2), 0755))
+
+		err := agg.MergeLoop(ctx)
+		require.ErrorIs(t, err, ErrMerge)
+		require.NotErrorIs(t, err, ErrBuild)
+		var mergeErr *ErrMergeFailed
+		require.ErrorAs(t, err, &mergeErr)
+		require.NotEmpty(t, mergeErr.Ranges)
+		require.Equal(t, []interface{}{"err", err, "class", "merge", "ranges", mergeErr.Ranges}, errLogArgs(err))
+	})
+	t.Run("index", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		buildRandomSteps(t, db, agg, 1)
+		ii := agg.d[kv.AccountsDomain].History.InvertedIndex
+		efi := ii.efAccessorFilePath(0, 1)
+		require.NoError(t, os.Remove(efi))
+		require.NoError(t, os.Mkdir(efi, 0755))
+
+		err := agg.BuildMissedIndices(ctx, 1)
+		require.ErrorIs(t, err, ErrIndexBuild)
+		require.NotErrorIs(t, err, ErrMerge)
+		var idxErr *ErrIndexBuildFailed
+		require.ErrorAs(t, err, &idxErr)
+		require.Equal(t, filepath.Base(ii.efFilePath(0, 1)), idxErr.File)
+	})
+	t.Run("untyped", func(t *testing.T) {
+		cause := errors.New("disk full")
+		require.Equal(t, []interface{}{"err", cause}, errLogArgs(cause))
+	})
+}
@@ -5,11 +5,14 @@ import (
 	"hash"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	bloomfilter "github.com/holiman/bloomfilter/v2"
 
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/metrics"
 )
 
 type ExistenceFilter struct {
@@ -18,6 +21,71 @@ type ExistenceFilter struct {
 	FileName, FilePath string
 	f                  *os.File
 	noFsync            bool // fsync is enabled by default, but tests can manually disable
+
+	// usage stats of filter on read path. see ExistenceFilterStats
+	probes, negatives, falsePositives atomic.Uint64
+}
+
+// ExistenceFilterStats - usage of existence filter of 1 file since file open
+type ExistenceFilterStats struct {
+	FileName       string
+	Probes         uint64 // filter checks
+	Negatives      uint64 // filter said "no": file skipped - btree probe saved
+	FalsePositives uint64 // filter said "yes", but key was not found in file
+}
+
+func (s ExistenceFilterStats) FalsePositiveRate() float64 {
+	if s.Probes == s.Negatives {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.Probes-s.Negatives)
+}
+
+func (b *ExistenceFilter) Stats() ExistenceFilterStats {
+	return ExistenceFilterStats{FileName: b.FileName, Probes: b.probes.Load(), Negatives: b.negatives.Load(), FalsePositives: b.falsePositives.Load()}
+}
+
+// existenceFilterMetrics - prometheus counters of filters usage (per domain). Counting in files happens always,
+// but prometheus counters are registered only if env AGG_EXISTENCE_FILTER_METRICS=true
+var existenceFilterMetrics = dbg.EnvBool("AGG_EXISTENCE_FILTER_METRICS", false)
+
+type existenceFilterCounters struct {
+	probes, negatives, falsePositives metrics.Counter
+}
+
+func newExistenceFilterCounters(filenameBase string) *existenceFilterCounters {
+	if !existenceFilterMetrics {
+		return nil
+	}
+	return &existenceFilterCounters{
+		probes:         metrics.GetOrCreateCounter(fmt.Sprintf(`domain_existence_filter{domain="%s",result="probe"}`, filenameBase)),
+		negatives:      metrics.GetOrCreateCounter(fmt.Sprintf(`domain_existence_filter{domain="%s",result="negative"}`, filenameBase)),
+		falsePositives: metrics.GetOrCreateCounter(fmt.Sprintf(`domain_existence_filter{domain="%s",result="false_positive"}`, filenameBase)),
+	}
+}
+
+// probe - ContainsHash with stats
+func (b *ExistenceFilter) probe(hi uint64, mx *existenceFilterCounters) bool {
+	b.probes.Add(1)
+	if mx != nil {
+		mx.probes.Inc()
+	}
+	if b.ContainsHash(hi) {
+		return true
+	}
+	b.negatives.Add(1)
+	if mx != nil {
+		mx.negatives.Inc()
+	}
+	return false
+}
+
+// miss - must be called if `probe` returned true, but key was not found in file
+func (b *ExistenceFilter) miss(mx *existenceFilterCounters) {
+	b.falsePositives.Add(1)
+	if mx != nil {
+		mx.falsePositives.Inc()
+	}
 }
 
 func NewExistenceFilter(keysCount uint64, filePath string) (*ExistenceFilter, error) {
@@ -0,0 +1,226 @@
+package state
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileRetentionInfo - garbage file (dirty, but not visible: merged into bigger one, etc...) which is not deleted yet
+// because some AggregatorRoTx still hold it. See Aggregator.FilesRetention
+type FileRetentionInfo struct {
+	FileName  string
+	FilePath  string
+	RefCount  int32
+	CanDelete bool // file will be removed by Close of last view in `Views`
+	Views     []FileRetentionView
+}
+
+// FileRetentionView - live AggregatorRoTx which holds file
+type FileRetentionView struct {
+	ID   uint64 // AggregatorRoTx.ViewID
+	Open time.Duration
+}
+
+// openViews - registry of live AggregatorRoTx. Used by diagnostics (FilesRetention) and by Aggregator.Close - to not close files under readers:
+// views register in BeginFilesRo/Clone and unregister in Close - before releasing their files.
+// Registry is sharded by view id: BeginFilesRo/Close of concurrent readers don't serialize on one mutex. Rare readers of
+// whole registry take all shards, see lockAll. Locks of shards don't participate in lock order of lock_order.go:
+// they are never held together with other Aggregator locks.
+type openViews struct {
+	shards [openViewsShards]openViewsShard
+	count  atomic.Int64
+
+	emptyLock sync.Mutex
+	empty     chan struct{} // closed when last view unregisters. See waitEmpty
+}
+
+const openViewsShards = 16
+
+type openViewsShard struct {
+	lock  sync.Mutex
+	views map[uint64]*AggregatorRoTx
+}
+
+func (v *openViews) add(ac *AggregatorRoTx) {
+	ac.openedAt = time.Now()
+	v.count.Add(1)
+	s := &v.shards[ac.id%openViewsShards]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.views == nil {
+		s.views = map[uint64]*AggregatorRoTx{}
+	}
+	s.views[ac.id] = ac
+}
+
+func (v *openViews) del(ac *AggregatorRoTx) {
+	s := &v.shards[ac.id%openViewsShards]
+	s.lock.Lock()
+	delete(s.views, ac.id)
+	s.lock.Unlock()
+	if v.count.Add(-1) != 0 {
+		return
+	}
+	v.emptyLock.Lock()
+	defer v.emptyLock.Unlock()
+	if v.empty != nil && v.count.Load() == 0 {
+		close(v.empty)
+		v.empty = nil
+	}
+}
+
+// lockAll - locks all shards (in fixed order): views can't unregister (and release their files) until unlockAll
+func (v *openViews) lockAll() {
+	for i := range v.shards {
+		v.shards[i].lock.Lock()
+	}
+}
+
+func (v *openViews) unlockAll() {
+	for i := range v.shards {
+		v.shards[i].lock.Unlock()
+	}
+}
+
+// each - calls `f` for every registered view. Caller must hold lockAll
+func (v *openViews) each(f func(id uint64, ac *AggregatorRoTx)) {
+	for i := range v.shards {
+		for id, ac := range v.shards[i].views {
+			f(id, ac)
+		}
+	}
+}
+
+// waitEmpty - waits until all views are closed, but not longer than `timeout`. Returns views which are still open
+func (v *openViews) waitEmpty(timeout time.Duration) (stuck []*AggregatorRoTx) {
+	v.emptyLock.Lock()
+	if v.count.Load() == 0 {
+		v.emptyLock.Unlock()
+		return nil
+	}
+	if v.empty == nil {
+		v.empty = make(chan struct{})
+	}
+	empty := v.empty
+	v.emptyLock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-empty:
+		return nil
+	case <-timer.C:
+	}
+
+	v.lockAll()
+	defer v.unlockAll()
+	v.each(func(_ uint64, ac *AggregatorRoTx) { stuck = append(stuck, ac) })
+	slices.SortFunc(stuck, func(x, y *AggregatorRoTx) int { return cmp.Compare(x.id, y.id) })
+	return stuck
+}
+
+// holds - all files of view: `files` fields are immutable while view is registered
+func (ac *AggregatorRoTx) holds(item *filesItem) bool {
+	has := func(files visibleFiles) bool {
+		for i := range files {
+			if files[i].src == item {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range ac.d {
+		if has(d.files) || has(d.ht.files) || has(d.ht.iit.files) {
+			return true
+		}
+	}
+	for _, ii := range ac.iis {
+		if has(ii.files) {
+			return true
+		}
+	}
+	for _, ap := range ac.appendable {
+		if ap != nil && has(ap.files) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilesRetention - for debugging of "why old file is not deleted after merge": reports every dirty file
+// which is not visible (garbage awaiting deletion), its refcount and live views holding it.
+// Empty result means no garbage on disk.
+func (a *Aggregator) FilesRetention() []FileRetentionInfo {
+	visible := map[*filesItem]struct{}{}
+	addVisible := func(files []ctxItem) {
+		for _, f := range files {
+			visible[f.src] = struct{}{}
+		}
+	}
+	a.rlockVisibleFiles()
+	for _, d := range a.d {
+		addVisible(d._visibleFiles)
+		addVisible(d.History._visibleFiles)
+		addVisible(d.History.InvertedIndex._visibleFiles)
+	}
+	for _, ii := range a.iis {
+		addVisible(ii._visibleFiles)
+	}
+	for _, ap := range a.ap {
+		if ap != nil {
+			addVisible(ap._visibleFiles)
+		}
+	}
+	a.runlockVisibleFiles()
+
+	var garbage []*filesItem
+	addGarbage := func(items []*filesItem) bool {
+		for _, item := range items {
+			if _, ok := visible[item]; ok || item.decompressor == nil {
+				continue
+			}
+			garbage = append(garbage, item)
+		}
+		return true
+	}
+	a.lockDirtyFiles()
+	for _, d := range a.d {
+		d.dirtyFiles.Walk(addGarbage)
+		d.History.dirtyFiles.Walk(addGarbage)
+		d.History.InvertedIndex.dirtyFiles.Walk(addGarbage)
+	}
+	for _, ii := range a.iis {
+		ii.dirtyFiles.Walk(addGarbage)
+	}
+	for _, ap := range a.ap {
+		if ap != nil {
+			ap.dirtyFiles.Walk(addGarbage)
+		}
+	}
+	res := make([]FileRetentionInfo, 0, len(garbage))
+	for _, item := range garbage {
+		res = append(res, FileRetentionInfo{
+			FileName:  item.decompressor.FileName(),
+			FilePath:  item.decompressor.FilePath(),
+			RefCount:  item.refcount.Load(),
+			CanDelete: item.canDelete.Load(),
+		})
+	}
+	a.unlockDirtyFiles()
+
+	a.views.lockAll()
+	defer a.views.unlockAll()
+	now := time.Now()
+	for i, item := range garbage {
+		a.views.each(func(id uint64, ac *AggregatorRoTx) {
+			if ac.holds(item) {
+				res[i].Views = append(res[i].Views, FileRetentionView{ID: id, Open: now.Sub(ac.openedAt)})
+			}
+		})
+		slices.SortFunc(res[i].Views, func(x, y FileRetentionView) int { return cmp.Compare(x.ID, y.ID) })
+	}
+	return res
+}
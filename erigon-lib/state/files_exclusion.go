@@ -0,0 +1,126 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	btree2 "github.com/tidwall/btree"
+)
+
+var (
+	ErrFileNotFound  = errors.New("file is not open by aggregator")
+	ErrVisibilityGap = errors.New("excluded file would hide range below other visible files")
+)
+
+// ExcludeFileFromVisibility - new views don't read `path` (full path or file name of data file: .kv, .v, .ef, ...) while
+// it's investigated: reads of its range fall through to older files or DB (history of pruned range is not available).
+// File stays open and on disk, views which already hold it are not affected. Exclusion is not persisted: restart clears it.
+// Only newest visible file of domain/history/index can be excluded, see ForceExcludeFileFromVisibility. Build and merge
+// of files are paused while any file is excluded
+func (a *Aggregator) ExcludeFileFromVisibility(path string) error {
+	return a.excludeFile(path, false)
+}
+
+// ForceExcludeFileFromVisibility - same as ExcludeFileFromVisibility, but file may leave gap in visible files: reads of
+// its range fall through to older files, not to DB
+func (a *Aggregator) ForceExcludeFileFromVisibility(path string) error {
+	return a.excludeFile(path, true)
+}
+
+// IncludeFile - reverts ExcludeFileFromVisibility
+func (a *Aggregator) IncludeFile(path string) error {
+	a.lockDirtyFiles()
+	item, _ := a.findDirtyFile(path)
+	if item == nil || !item.excluded.Load() {
+		a.unlockDirtyFiles()
+		return fmt.Errorf("include %s: %w", path, ErrFileNotFound)
+	}
+	item.excluded.Store(false)
+	a.unlockDirtyFiles()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.logger.Info("[snapshots] file included back to visible files", "file", item.decompressor.FileName())
+	return nil
+}
+
+// ExcludedFiles - names of files excluded by ExcludeFileFromVisibility
+func (a *Aggregator) ExcludedFiles() (res []string) {
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
+	for _, tree := range a.dirtyFilesTrees() {
+		tree.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.excluded.Load() && item.decompressor != nil {
+					res = append(res, item.decompressor.FileName())
+				}
+			}
+			return true
+		})
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (a *Aggregator) excludeFile(path string, force bool) error {
+	a.lockDirtyFiles()
+	item, tree := a.findDirtyFile(path)
+	if item == nil {
+		a.unlockDirtyFiles()
+		return fmt.Errorf("exclude %s: %w", path, ErrFileNotFound)
+	}
+	if !force {
+		if above := fileAbove(tree, item); above != nil {
+			a.unlockDirtyFiles()
+			return fmt.Errorf("exclude %s: %w: %s", path, ErrVisibilityGap, above.decompressor.FileName())
+		}
+	}
+	item.excluded.Store(true)
+	a.unlockDirtyFiles()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.logger.Warn("[snapshots] file excluded from visible files", "file", item.decompressor.FileName(), "forced", force)
+	return nil
+}
+
+// findDirtyFile - item and its tree by full path or name of data file. Must be called under `dirtyFilesLock`
+func (a *Aggregator) findDirtyFile(path string) (found *filesItem, tree *btree2.BTreeG[*filesItem]) {
+	name := filepath.Base(path)
+	for _, t := range a.dirtyFilesTrees() {
+		t.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.decompressor == nil || item.decompressor.FileName() != name {
+					continue
+				}
+				if filepath.IsAbs(path) && item.decompressor.FilePath() != path {
+					continue
+				}
+				found, tree = item, t
+				return false
+			}
+			return true
+		})
+		if found != nil {
+			return found, tree
+		}
+	}
+	return nil, nil
+}
+
+// fileAbove - file which may be visible and starts at or after end of `item`: excluding `item` leaves gap below it
+func fileAbove(tree *btree2.BTreeG[*filesItem], item *filesItem) (above *filesItem) {
+	tree.Walk(func(items []*filesItem) bool {
+		for _, f := range items {
+			if f == item || f.decompressor == nil || f.canDelete.Load() || f.excluded.Load() {
+				continue
+			}
+			if f.startTxNum >= item.endTxNum {
+				above = f
+				return false
+			}
+		}
+		return true
+	})
+	return above
+}
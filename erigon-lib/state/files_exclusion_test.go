@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAggregatorV3_ExcludeFileFromVisibility(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	putAccounts(t, db, agg, 2*agg.StepSize()-1) // steps 0-1
+	require.NoError(t, agg.buildFiles(ctx, 0))
+	require.NoError(t, agg.buildFiles(ctx, 1)) // DB is not pruned
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	addr := make([]byte, length.Addr)
+	binary.BigEndian.PutUint64(addr, 20) // only in file of step 1
+	getLatest := func(ac *AggregatorRoTx) (fromFiles bool) {
+		t.Helper()
+		v, _, found, fromFiles, err := ac.d[kv.AccountsDomain].getLatest(addr, nil, nil, tx)
+		require.NoError(t, err)
+		require.True(t, found)
+		nonce, _, _ := types.DecodeAccountBytesV3(v)
+		require.Equal(t, uint64(20), nonce)
+		return fromFiles
+	}
+
+	held := agg.BeginFilesRo()
+	defer held.Close()
+	require.True(t, getLatest(held))
+
+	older := agg.d[kv.AccountsDomain].kvFilePath(0, 1)
+	require.ErrorIs(t, agg.ExcludeFileFromVisibility(older), ErrVisibilityGap)
+	require.ErrorIs(t, agg.ExcludeFileFromVisibility("v1-accounts.5-6.kv"), ErrFileNotFound)
+	require.Empty(t, agg.ExcludedFiles())
+
+	newest := agg.d[kv.AccountsDomain].kvFilePath(1, 2)
+	require.NoError(t, agg.ExcludeFileFromVisibility(newest))
+	require.Equal(t, []string{filepath.Base(newest)}, agg.ExcludedFiles())
+	excludedItem, _ := agg.findDirtyFile(newest)
+
+	// build must not re-create step of excluded file
+	putAccounts(t, db, agg, 3*agg.StepSize())
+	require.NoError(t, agg.BuildFiles(3*agg.StepSize()))
+	require.Equal(t, agg.StepSize(), agg.EndTxNumMinimax())
+	item, _ := agg.findDirtyFile(newest)
+	require.Same(t, excludedItem, item)
+
+	ac := agg.BeginFilesRo()
+	require.Equal(t, agg.StepSize(), ac.d[kv.AccountsDomain].files.EndTxNum())
+	require.Equal(t, 2*agg.StepSize(), ac.d[kv.StorageDomain].files.EndTxNum(), "other domains are not affected")
+	require.False(t, getLatest(ac), "value of excluded file is read from DB")
+	ac.Close()
+	require.True(t, getLatest(held), "views which hold file are not affected")
+	require.FileExists(t, newest)
+
+	require.NoError(t, agg.IncludeFile(filepath.Base(newest)))
+	require.Empty(t, agg.ExcludedFiles())
+	require.ErrorIs(t, agg.IncludeFile(newest), ErrFileNotFound)
+	ac = agg.BeginFilesRo()
+	require.Equal(t, 2*agg.StepSize(), ac.d[kv.AccountsDomain].files.EndTxNum())
+	require.True(t, getLatest(ac))
+	ac.Close()
+
+	require.NoError(t, agg.ForceExcludeFileFromVisibility(older))
+	require.Equal(t, []string{filepath.Base(older)}, agg.ExcludedFiles())
+}
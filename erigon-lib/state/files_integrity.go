@@ -0,0 +1,71 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// FileIntegrityPolicy - decides if domain file found on disk can be opened. Consulted on OpenFolder/OpenList.
+// See Aggregator.SetFileIntegrityPolicy
+type FileIntegrityPolicy interface {
+	// Check - ok=false means file will be ignored, `reason` is logged
+	Check(name kv.Domain, fromStep, toStep uint64) (ok bool, reason string)
+}
+
+// CommitmentSkewPolicy - default FileIntegrityPolicy:
+//
+//	case1: `kill -9` during building new .kv
+//	 - `accounts` domain may be at step X and `commitment` domain at step X-1
+//	 - not a problem because `commitment` domain still has step X in DB
+//	case2: `kill -9` during building new .kv and `rm -rf chaindata`
+//	 - `accounts` domain may be at step X and `commitment` domain at step X-1
+//	 - problem! `commitment` domain doesn't have step X in DB
+//	solution: ignore step X files in both cases
+//
+// Symmetric case (`commitment` at step X and `accounts` at step X-1) is handled same way.
+// Only recently built (1-step) files are checked: merged files are produced from already checked ones.
+type CommitmentSkewPolicy struct {
+	SnapDomain string // dir of .kv files
+}
+
+func (p CommitmentSkewPolicy) Check(name kv.Domain, fromStep, toStep uint64) (ok bool, reason string) {
+	if toStep-fromStep > 1 {
+		return true, ""
+	}
+	var pair kv.Domain
+	switch name {
+	case kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain:
+		pair = kv.CommitmentDomain
+	case kv.CommitmentDomain:
+		pair = kv.AccountsDomain
+	default:
+		return true, ""
+	}
+	exists, err := dir.FileExist(filepath.Join(p.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", pair, fromStep, toStep)))
+	if err != nil {
+		return false, fmt.Sprintf("can't check %s file of same steps: %s", pair, err)
+	}
+	if !exists {
+		return false, fmt.Sprintf("%s file of same steps doesn't exist (interrupted files build?)", pair)
+	}
+	return true, ""
+}
+
+// SetFileIntegrityPolicy - must be called before OpenFolder/OpenList. nil - disables checks: all files are opened
+// (for example, for custom configs without commitment). Default: CommitmentSkewPolicy.
+func (a *Aggregator) SetFileIntegrityPolicy(p FileIntegrityPolicy) { a.integrityPolicy = p }
+
+// integrityCheck - passed to domains, reads policy on every call: it may be changed after domains creation
+func (a *Aggregator) integrityCheck(name kv.Domain, fromStep, toStep uint64) bool {
+	if a.integrityPolicy == nil {
+		return true
+	}
+	ok, reason := a.integrityPolicy.Check(name, fromStep, toStep)
+	if !ok {
+		a.logger.Info("[snapshots] file ignored by integrity policy", "domain", name, "steps", fmt.Sprintf("%d-%d", fromStep, toStep), "reason", reason)
+	}
+	return ok
+}
@@ -0,0 +1,394 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+)
+
+// RecoveryStrategy - how RecoverStepMismatch makes files of one step consistent
+type RecoveryStrategy uint8
+
+const (
+	// RecoveryRecollate - DB still has data of missing files: they are collated and built as usual
+	RecoveryRecollate RecoveryStrategy = iota + 1
+	// RecoveryRebuildFromFiles - DB has no commitment of step: it's re-computed from keys of accounts and storage files
+	// of step (on top of commitment of previous step), then collated
+	RecoveryRebuildFromFiles
+	// RecoveryDeleteOrphans - last resort: nothing to build missing files from. Files of step are deleted
+	RecoveryDeleteOrphans
+)
+
+func (s RecoveryStrategy) String() string {
+	switch s {
+	case RecoveryRecollate:
+		return "recollate"
+	case RecoveryRebuildFromFiles:
+		return "rebuild_from_files"
+	case RecoveryDeleteOrphans:
+		return "delete_orphans"
+	default:
+		return "unknown"
+	}
+}
+
+// StepRecovery - skew of one step. See CommitmentSkewPolicy
+type StepRecovery struct {
+	FromStep, ToStep uint64
+	Present          []kv.Domain // domains with .kv file of step
+	Missing          []kv.Domain
+	Strategy         RecoveryStrategy
+	Deleted          []string // RecoveryDeleteOrphans: paths of removed files
+}
+
+func (s StepRecovery) String() string {
+	return fmt.Sprintf("steps=%d-%d, present=%v, missing=%v, strategy=%s", s.FromStep, s.ToStep, s.Present, s.Missing, s.Strategy)
+}
+
+// RecoveryReport - see Aggregator.RecoverStepMismatch. Empty - files are consistent
+type RecoveryReport struct {
+	Steps []StepRecovery
+}
+
+// Deletes - files of some step will be (or were) deleted
+func (r RecoveryReport) Deletes() bool {
+	for _, s := range r.Steps {
+		if s.Strategy == RecoveryDeleteOrphans {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RecoveryReport) String() string {
+	if len(r.Steps) == 0 {
+		return "no step mismatch"
+	}
+	res := make([]string, 0, len(r.Steps))
+	for _, s := range r.Steps {
+		res = append(res, s.String())
+	}
+	return strings.Join(res, "; ")
+}
+
+// recoveryDomains - domains checked by CommitmentSkewPolicy
+var recoveryDomains = []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain, kv.CommitmentDomain}
+
+// AnalyseStepMismatch - plan of RecoverStepMismatch, nothing is written
+func (a *Aggregator) AnalyseStepMismatch(ctx context.Context) (report RecoveryReport, err error) {
+	present := map[[2]uint64][]kv.Domain{}
+	var ranges [][2]uint64
+	for _, name := range recoveryDomains {
+		steps, err := a.d[name].stepsOnDisk()
+		if err != nil {
+			return report, err
+		}
+		for _, r := range steps {
+			if r[1]-r[0] != 1 { // see CommitmentSkewPolicy: merged files are produced from checked ones
+				continue
+			}
+			if _, ok := present[r]; !ok {
+				ranges = append(ranges, r)
+			}
+			present[r] = append(present[r], name)
+		}
+	}
+
+	for _, r := range ranges {
+		s := StepRecovery{FromStep: r[0], ToStep: r[1], Present: present[r]}
+		has := func(name kv.Domain) bool {
+			for _, p := range s.Present {
+				if p == name {
+					return true
+				}
+			}
+			return false
+		}
+		// policy checks storage and code only against commitment: their files are checked here.
+		// Steps without changes of domain have no files (see emptySteps)
+		for _, name := range recoveryDomains {
+			if !has(name) && !slices.Contains(a.d[name].emptySteps.list(), r[0]) {
+				s.Missing = append(s.Missing, name)
+			}
+		}
+		if len(s.Missing) == 0 {
+			continue
+		}
+		report.Steps = append(report.Steps, s)
+	}
+	if len(report.Steps) == 0 {
+		return report, nil
+	}
+
+	if err := a.db.View(ctx, func(tx kv.Tx) error {
+		for i := range report.Steps {
+			if report.Steps[i].Strategy, err = a.recoveryStrategy(tx, report.Steps[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (a *Aggregator) recoveryStrategy(tx kv.Tx, s StepRecovery) (RecoveryStrategy, error) {
+	// commitment is written on each block and accounts are touched by each block (coinbase): empty step of them
+	// in DB means DB has no data of step
+	evidence := kv.AccountsDomain
+	commitmentMissing := false
+	for _, name := range s.Missing {
+		if name == kv.CommitmentDomain {
+			evidence, commitmentMissing = kv.CommitmentDomain, true
+		}
+	}
+	inDB, err := a.d[evidence].hasStepInDB(tx, s.FromStep)
+	if err != nil {
+		return 0, err
+	}
+	if inDB {
+		return RecoveryRecollate, nil
+	}
+	if !commitmentMissing || len(s.Missing) != 1 {
+		return RecoveryDeleteOrphans, nil
+	}
+	// rebuild reads latest values of step: newer values in DB would produce commitment of wrong step
+	for _, name := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		if a.d[name].maxStepInDB(tx) > s.FromStep {
+			return RecoveryDeleteOrphans, nil
+		}
+	}
+	return RecoveryRebuildFromFiles, nil
+}
+
+// RecoverStepMismatch - explicit recovery of steps ignored by CommitmentSkewPolicy (`kill -9` during files build):
+// instead of ignoring valid files of one domain and re-collating them from DB (which may be already pruned),
+// missing files are produced (see RecoveryStrategy). Orphaned files are deleted only if nothing else is possible:
+// use AnalyseStepMismatch to check plan before. Must be called before any other use of aggregator: files are re-opened.
+func (a *Aggregator) RecoverStepMismatch(ctx context.Context) (report RecoveryReport, err error) {
+	if report, err = a.AnalyseStepMismatch(ctx); err != nil {
+		return report, err
+	}
+	if len(report.Steps) == 0 {
+		return report, nil
+	}
+
+	// orphans are deleted before policy is disabled. History of missing domains may be already built: files of step
+	// are deleted for all domains
+	build := false
+	for i := range report.Steps {
+		s := &report.Steps[i]
+		if s.Strategy != RecoveryDeleteOrphans {
+			build = true
+			continue
+		}
+		if s.Deleted, err = a.deleteStepFiles(s.FromStep, s.ToStep, recoveryDomains); err != nil {
+			return report, err
+		}
+		a.logger.Warn("[snapshots] step mismatch: orphaned files deleted", "step", s.String(), "files", s.Deleted)
+	}
+	if !build {
+		// deleted files may be opened: policy doesn't check step of missing storage or code
+		return report, a.OpenFolder()
+	}
+
+	// files of step are inputs of recovery: open them
+	policy := a.integrityPolicy
+	a.integrityPolicy = nil
+	defer func() {
+		a.integrityPolicy = policy
+		if openErr := a.OpenFolder(); openErr != nil && err == nil {
+			err = openErr
+		}
+	}()
+	if err := a.OpenFolder(); err != nil {
+		return report, err
+	}
+
+	for _, s := range report.Steps {
+		switch s.Strategy {
+		case RecoveryRecollate:
+			for _, name := range s.Missing {
+				if err := a.buildDomainStep(ctx, name, s.FromStep); err != nil {
+					return report, err
+				}
+			}
+		case RecoveryRebuildFromFiles:
+			if err := a.rebuildCommitmentStep(ctx, s.FromStep); err != nil {
+				return report, err
+			}
+			if err := a.buildDomainStep(ctx, kv.CommitmentDomain, s.FromStep); err != nil {
+				return report, err
+			}
+		default:
+			continue
+		}
+		a.logger.Info("[snapshots] step mismatch recovered", "step", s.String())
+	}
+	return report, nil
+}
+
+// buildDomainStep - collate and build files of one domain, files of other domains of step exist
+func (a *Aggregator) buildDomainStep(ctx context.Context, name kv.Domain, step uint64) error {
+	d := a.d[name]
+	txFrom, txTo := a.FirstTxNumOfStep(step), a.FirstTxNumOfStep(step+1)
+	before, err := a.stateFilesBefore()
+	if err != nil {
+		return err
+	}
+	var coll Collation
+	if err := a.db.View(ctx, func(tx kv.Tx) error {
+		dataFrom, dataTo, err := a.stepDataRange(tx, step)
+		if err != nil {
+			return err
+		}
+		coll, err = d.collate(ctx, step, dataFrom, dataTo, tx)
+		return err
+	}); err != nil {
+		return &ErrCollationFailed{Domain: d.filenameBase, Step: step, Err: err}
+	}
+	sf, err := d.buildFiles(ctx, step, coll, a.ps)
+	coll.Close()
+	if err != nil {
+		sf.CleanupOnError()
+		return &ErrBuildFailed{Domain: d.filenameBase, Step: step, Err: err}
+	}
+	if err := a.fsyncProduced(before); err != nil {
+		sf.CleanupOnError()
+		return err
+	}
+
+	a.lockDirtyFiles()
+	d.integrateDirtyFiles(sf, txFrom, txTo)
+	a.unlockDirtyFiles()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+	a.needSaveFilesListInDB.Store(true)
+	return nil
+}
+
+// rebuildCommitmentStep - writes to DB commitment of `step`, computed from accounts and storage files of step.
+// Commitment of previous steps must be available
+func (a *Aggregator) rebuildCommitmentStep(ctx context.Context, step uint64) error {
+	db, ok := a.db.(kv.RwDB)
+	if !ok {
+		return errors.New("rebuild commitment of step: read-write db required")
+	}
+	rwTx, err := db.BeginRw(ctx)
+	if err != nil {
+		return err
+	}
+	defer rwTx.Rollback()
+	ac := a.BeginFilesRo()
+	defer ac.Close()
+
+	sd, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), a.logger)
+	if err != nil {
+		return err
+	}
+	defer sd.Close()
+	if sd.TxNum() >= a.FirstTxNumOfStep(step) {
+		return fmt.Errorf("rebuild commitment of step %d: commitment found at txNum=%d", step, sd.TxNum())
+	}
+
+	lastTxNum := a.FirstTxNumOfStep(step+1) - 1
+	ok, blockNum, err := rawdbv3.TxNums.FindBlockNum(rwTx, lastTxNum)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		blockNum = sd.BlockNum()
+		a.logger.Warn("[snapshots] rebuild commitment of step: block of txNum not found, block of previous commitment used", "txNum", lastTxNum, "block", blockNum)
+	}
+	rh, err := sd.rebuildCommitmentOfStep(ctx, step, blockNum)
+	if err != nil {
+		return err
+	}
+	if err := sd.Flush(ctx, rwTx); err != nil {
+		return err
+	}
+	sd.Close()
+	ac.Close()
+	a.logger.Info("[snapshots] commitment of step rebuilt from files", "step", step, "block", blockNum, "root", fmt.Sprintf("%x", rh))
+	return rwTx.Commit()
+}
+
+// deleteStepFiles - .kv, .v, .ef files of `domains` of [fromStep, toStep) with their accessors and `.step` sidecars.
+// Removed paths are returned
+func (a *Aggregator) deleteStepFiles(fromStep, toStep uint64, domains []kv.Domain) (deleted []string, err error) {
+	for _, name := range domains {
+		d := a.d[name]
+		kvPath, vPath, efPath := d.kvFilePath(fromStep, toStep), d.History.vFilePath(fromStep, toStep), d.History.InvertedIndex.efFilePath(fromStep, toStep)
+		for _, path := range []string{
+			kvPath, kvPath + stepSizeSuffix, d.kvAccessorFilePath(fromStep, toStep), d.kvExistenceIdxFilePath(fromStep, toStep), d.kvBtFilePath(fromStep, toStep),
+			vPath, vPath + stepSizeSuffix, d.History.vAccessorFilePath(fromStep, toStep),
+			efPath, efPath + stepSizeSuffix, d.History.InvertedIndex.efAccessorFilePath(fromStep, toStep),
+		} {
+			if err := os.Remove(path); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return deleted, err
+			}
+			deleted = append(deleted, path)
+		}
+	}
+	return deleted, nil
+}
+
+// stepsOnDisk - [fromStep, toStep) of .kv files of domain, including ignored by integrity policy
+func (d *Domain) stepsOnDisk() (res [][2]uint64, err error) {
+	_, _, domainFiles, err := d.fileNamesOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	re := regexp.MustCompile("^v([0-9]+)-" + d.filenameBase + ".([0-9]+)-([0-9]+).kv$")
+	for _, name := range domainFiles {
+		subs := re.FindStringSubmatch(filepath.Base(name))
+		if len(subs) != 4 {
+			continue
+		}
+		from, err := strconv.ParseUint(subs[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		to, err := strconv.ParseUint(subs[3], 10, 64)
+		if err != nil || from >= to {
+			continue
+		}
+		res = append(res, [2]uint64{from, to})
+	}
+	return res, nil
+}
+
+// hasStepInDB - any value of `step` in DB. Full scan of keys table: for recovery only
+func (d *Domain) hasStepInDB(tx kv.Tx, step uint64) (bool, error) {
+	stepBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(stepBytes, ^step)
+	c, err := tx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(v, stepBytes) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
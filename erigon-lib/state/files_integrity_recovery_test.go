@@ -0,0 +1,208 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAggregatorV3_RecoverStepMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	// accounts, storage and code files of step 1 are built, commitment is not: `kill -9` during files build
+	setup := func(t *testing.T) (db kv.RwDB, agg *Aggregator, roots [][]byte) {
+		t.Helper()
+		db, agg = testDbAndAggregatorv3(t, 16)
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		for txNum := uint64(1); txNum < 2*agg.StepSize(); txNum++ {
+			domains.SetTxNum(txNum)
+			addr := make([]byte, length.Addr)
+			binary.BigEndian.PutUint64(addr, txNum%5) // keys are updated in both steps
+			buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+			prev, step, err := domains.DomainGet(kv.AccountsDomain, addr, nil)
+			require.NoError(t, err)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, prev, step))
+			if txNum%agg.StepSize() == agg.StepSize()-1 {
+				rh, err := domains.ComputeCommitment(ctx, true, txNum/4, "")
+				require.NoError(t, err)
+				roots = append(roots, rh)
+			}
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		domains.Close()
+		ac.Close()
+		require.NoError(t, rwTx.Commit())
+
+		require.NoError(t, agg.buildFiles(ctx, 0))
+		for _, name := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain} {
+			require.NoError(t, agg.buildDomainStep(ctx, name, 1))
+		}
+		return db, agg, roots
+	}
+	reopen := func(t *testing.T, db kv.RwDB, agg *Aggregator) *Aggregator {
+		t.Helper()
+		agg.Close()
+		return testAggregatorv3(t, db, agg.dirs, 16, DefaultCommitmentValuesTransform)
+	}
+	// all domains have files of steps 0-1, commitment of files is `root`
+	requireConsistent := func(t *testing.T, db kv.RwDB, agg *Aggregator, root []byte) {
+		t.Helper()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for _, name := range recoveryDomains {
+			files := ac.d[name].files
+			require.NotEmpty(t, files, name)
+			require.Equal(t, 2*agg.StepSize(), files[len(files)-1].endTxNum, name)
+		}
+		report, err := agg.AnalyseStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Empty(t, report.Steps)
+
+		tx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		require.Equal(t, 2*agg.StepSize()-1, domains.TxNum())
+		rh, err := domains.ComputeCommitment(ctx, false, domains.BlockNum(), "")
+		require.NoError(t, err)
+		require.Equal(t, root, rh)
+	}
+
+	t.Run("recollate", func(t *testing.T) {
+		db, agg, roots := setup(t)
+		agg = reopen(t, db, agg)
+		ac := agg.BeginFilesRo()
+		require.Equal(t, agg.StepSize(), ac.d[kv.AccountsDomain].files.EndTxNum(), "ignored by integrity policy")
+		ac.Close()
+
+		report, err := agg.RecoverStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Len(t, report.Steps, 1)
+		require.Equal(t, uint64(1), report.Steps[0].FromStep)
+		require.Equal(t, []kv.Domain{kv.CommitmentDomain}, report.Steps[0].Missing)
+		require.Equal(t, RecoveryRecollate, report.Steps[0].Strategy)
+		require.False(t, report.Deletes())
+
+		requireConsistent(t, db, agg, roots[1])
+		requireConsistent(t, db, reopen(t, db, agg), roots[1])
+	})
+
+	t.Run("rebuild from files", func(t *testing.T) {
+		db, agg, roots := setup(t)
+		// aggressive manual prune: commitment of step 1 is not in DB anymore
+		require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+			for _, table := range []string{kv.TblCommitmentKeys, kv.TblCommitmentVals} {
+				if err := tx.ClearBucket(table); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		agg = reopen(t, db, agg)
+
+		plan, err := agg.AnalyseStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Len(t, plan.Steps, 1)
+		require.Equal(t, RecoveryRebuildFromFiles, plan.Steps[0].Strategy)
+
+		report, err := agg.RecoverStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, plan, report)
+		require.Empty(t, report.Steps[0].Deleted)
+
+		requireConsistent(t, db, agg, roots[1])
+		requireConsistent(t, db, reopen(t, db, agg), roots[1])
+	})
+
+	// all files of step 1 are built except storage: policy checks it only against commitment
+	setupNoStorage := func(t *testing.T) (db kv.RwDB, agg *Aggregator, roots [][]byte) {
+		t.Helper()
+		db, agg, roots = setup(t)
+		require.NoError(t, agg.buildDomainStep(ctx, kv.CommitmentDomain, 1))
+		_, err := agg.deleteStepFiles(1, 2, []kv.Domain{kv.StorageDomain})
+		require.NoError(t, err)
+		return db, reopen(t, db, agg), roots
+	}
+
+	t.Run("recollate missing storage", func(t *testing.T) {
+		db, agg, roots := setupNoStorage(t)
+		report, err := agg.RecoverStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Len(t, report.Steps, 1)
+		require.Equal(t, []kv.Domain{kv.StorageDomain}, report.Steps[0].Missing)
+		require.Equal(t, RecoveryRecollate, report.Steps[0].Strategy)
+
+		requireConsistent(t, db, agg, roots[1])
+	})
+
+	t.Run("delete orphans", func(t *testing.T) {
+		db, agg, _ := setupNoStorage(t)
+		// DB has no data of step 1: storage can't be built
+		require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+			for _, table := range []string{kv.TblAccountKeys, kv.TblAccountVals} {
+				if err := tx.ClearBucket(table); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		report, err := agg.RecoverStepMismatch(ctx)
+		require.NoError(t, err)
+		require.Len(t, report.Steps, 1)
+		require.Equal(t, []kv.Domain{kv.StorageDomain}, report.Steps[0].Missing)
+		require.Equal(t, RecoveryDeleteOrphans, report.Steps[0].Strategy)
+		require.True(t, report.Deletes())
+
+		d := agg.d[kv.AccountsDomain]
+		require.Subset(t, report.Steps[0].Deleted, []string{
+			d.kvFilePath(1, 2), d.kvFilePath(1, 2) + stepSizeSuffix,
+			d.History.vFilePath(1, 2), d.History.vFilePath(1, 2) + stepSizeSuffix,
+			d.History.InvertedIndex.efFilePath(1, 2), d.History.InvertedIndex.efFilePath(1, 2) + stepSizeSuffix,
+			agg.d[kv.CommitmentDomain].kvFilePath(1, 2),
+		})
+		for _, path := range report.Steps[0].Deleted {
+			_, err := os.Stat(path)
+			require.True(t, os.IsNotExist(err), path)
+		}
+		for _, dir := range []string{agg.dirs.SnapDomain, agg.dirs.SnapHistory, agg.dirs.SnapIdx, agg.dirs.SnapAccessors} {
+			left, err := filepath.Glob(filepath.Join(dir, "*.1-2.*"))
+			require.NoError(t, err)
+			require.Empty(t, left, dir)
+		}
+
+		// deleted files are not visible: before and after restart
+		requireStep0 := func(t *testing.T, agg *Aggregator) {
+			t.Helper()
+			ac := agg.BeginFilesRo()
+			defer ac.Close()
+			for _, name := range recoveryDomains {
+				require.Equal(t, agg.StepSize(), ac.d[name].files.EndTxNum(), name)
+			}
+			report, err := agg.AnalyseStepMismatch(ctx)
+			require.NoError(t, err)
+			require.Empty(t, report.Steps)
+		}
+		requireStep0(t, agg)
+		requireStep0(t, reopen(t, db, agg))
+	})
+}
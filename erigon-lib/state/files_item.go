@@ -29,32 +29,63 @@ type filesItem struct {
 	bindex               *BtIndex
 	bm                   *bitmapdb.FixedSizeBitmaps
 	existence            *ExistenceFilter
-	startTxNum, endTxNum uint64 //[startTxNum, endTxNum)
+	codeHash             *recsplit.Index // optional, CodeDomain only. see Aggregator.SetCodeHashIndex
+	startTxNum, endTxNum uint64          //[startTxNum, endTxNum)
+
+	// stepSize - step of file name: recorded for data file by app which produced it (see recordedStepSize), or configured
+	// one. Files of other step size than configured keep their names - use `steps()` for paths of file and accessors
+	stepSize uint64
+	// stepSizeUnknown - file produced before step size was recorded: stepSize is configured one, app which produced file
+	// may had other
+	stepSizeUnknown bool
 
 	// Frozen: file of size StepsInColdFile. Completely immutable.
 	// Cold: file of size < StepsInColdFile. Immutable, but can be closed/removed after merge to bigger file.
 	// Hot: Stored in DB. Providing Snapshot-Isolation by CopyOnWrite.
 	frozen   bool         // immutable, don't need atomic
-	refcount atomic.Int32 // only for `frozen=false`
+	refcount atomic.Int32 // readers of file: frozen files also can be deleted (see History.deleteExpiredFiles)
 
 	// file can be deleted in 2 cases: 1. when `refcount == 0 && canDelete == true` 2. on app startup when `file.isSubsetOfFrozenFile()`
 	// other processes (which also reading files, may have same logic)
 	canDelete atomic.Bool
+
+	// excluded - hidden from views by operator, file stays open. Not persisted. See Aggregator.ExcludeFileFromVisibility
+	excluded atomic.Bool
 }
 
 func newFilesItem(startTxNum, endTxNum, stepSize uint64) *filesItem {
 	startStep := startTxNum / stepSize
 	endStep := endTxNum / stepSize
 	frozen := endStep-startStep == StepsInColdFile
-	return &filesItem{startTxNum: startTxNum, endTxNum: endTxNum, frozen: frozen}
+	return &filesItem{startTxNum: startTxNum, endTxNum: endTxNum, stepSize: stepSize, frozen: frozen}
 }
 
+// steps - range of file in steps of its name
+func (i *filesItem) steps() (from, to uint64) {
+	return i.startTxNum / i.stepSize, i.endTxNum / i.stepSize
+}
+
+// endsOnStep - file ends on boundary of step of `stepSize`. File of other step size may end in the middle of configured
+// step: it's readable, but merge range can't end on it - merge ranges are planned in configured steps
+func (i *filesItem) endsOnStep(stepSize uint64) bool { return i.endTxNum%stepSize == 0 }
+
 // isSubsetOf - when `j` covers `i` but not equal `i`
 func (i *filesItem) isSubsetOf(j *filesItem) bool {
 	return (j.startTxNum <= i.startTxNum && i.endTxNum <= j.endTxNum) && (j.startTxNum != i.startTxNum || i.endTxNum != j.endTxNum)
 }
 func (i *filesItem) isBefore(j *filesItem) bool { return i.endTxNum <= j.startTxNum }
 
+// dataRange - [from, to) of txNums which file has. Differs from [startTxNum, endTxNum) only for files of history and
+// inverted indices built with block-aligned steps (see SetBlockAlignedSteps): they may start and end before their name
+func (i *filesItem) dataRange() (from, to uint64) {
+	if i.decompressor != nil {
+		if from, to, ok := i.decompressor.TxNumRange(); ok {
+			return from, to
+		}
+	}
+	return i.startTxNum, i.endTxNum
+}
+
 func filesItemLess(i, j *filesItem) bool {
 	if i.endTxNum == j.endTxNum {
 		return i.startTxNum > j.startTxNum
@@ -62,6 +93,23 @@ func filesItemLess(i, j *filesItem) bool {
 	return i.endTxNum < j.endTxNum
 }
 
+// openFilesCount - amount of file descriptors held by item: data file and accessors (existence filter is read into memory)
+func (i *filesItem) openFilesCount() (cnt int) {
+	if i.decompressor.IsOpen() {
+		cnt++
+	}
+	if i.index.IsOpen() {
+		cnt++
+	}
+	if i.bindex != nil && i.bindex.file != nil {
+		cnt++
+	}
+	if i.codeHash.IsOpen() {
+		cnt++
+	}
+	return cnt
+}
+
 func (i *filesItem) closeFiles() {
 	if i.decompressor != nil {
 		i.decompressor.Close()
@@ -83,6 +131,10 @@ func (i *filesItem) closeFiles() {
 		i.existence.Close()
 		i.existence = nil
 	}
+	if i.codeHash != nil {
+		i.codeHash.Close()
+		i.codeHash = nil
+	}
 }
 
 func (i *filesItem) closeFilesAndRemove() {
@@ -96,6 +148,12 @@ func (i *filesItem) closeFilesAndRemove() {
 			if err := os.Remove(i.decompressor.FilePath() + ".torrent"); err != nil {
 				log.Trace("remove after close", "err", err, "file", i.decompressor.FileName()+".torrent")
 			}
+			if err := os.Remove(i.decompressor.FilePath() + appendableMarkerSuffix); err != nil && !os.IsNotExist(err) {
+				log.Trace("remove after close", "err", err, "file", i.decompressor.FileName()+appendableMarkerSuffix)
+			}
+			if err := os.Remove(i.decompressor.FilePath() + stepSizeSuffix); err != nil && !os.IsNotExist(err) {
+				log.Trace("remove after close", "err", err, "file", i.decompressor.FileName()+stepSizeSuffix)
+			}
 		}
 		i.decompressor = nil
 	}
@@ -130,6 +188,13 @@ func (i *filesItem) closeFilesAndRemove() {
 		}
 		i.existence = nil
 	}
+	if i.codeHash != nil {
+		i.codeHash.Close()
+		if err := os.Remove(i.codeHash.FilePath()); err != nil {
+			log.Trace("remove after close", "err", err, "file", i.codeHash.FileName())
+		}
+		i.codeHash = nil
+	}
 }
 
 func deleteMergeFile(dirtyFiles *btree2.BTreeG[*filesItem], outs []*filesItem, filenameBase string, logger log.Logger) {
@@ -185,6 +250,12 @@ func calcVisibleFiles(files *btree2.BTreeG[*filesItem], l idxList, trace bool) (
 				}
 				continue
 			}
+			if item.excluded.Load() {
+				if trace {
+					log.Warn("[dbg] calcVisibleFiles excluded", "from", item.startTxNum, "to", item.endTxNum)
+				}
+				continue
+			}
 
 			// TODO: need somehow handle this case, but indices do not open in tests TestFindMergeRangeCornerCases
 			if item.decompressor == nil {
@@ -242,6 +313,13 @@ func calcVisibleFiles(files *btree2.BTreeG[*filesItem], l idxList, trace bool) (
 // visibleFiles have no garbage (overlaps, unindexed, etc...)
 type visibleFiles []ctxItem
 
+// refAll - increment refcount of all files. Refcount is atomic: lock is needed only to read `_visibleFiles` field.
+func (files visibleFiles) refAll() {
+	for i := 0; i < len(files); i++ {
+		files[i].src.refcount.Add(1)
+	}
+}
+
 // EndTxNum return txNum which not included in file - it will be first txNum in future file
 func (files visibleFiles) EndTxNum() uint64 {
 	if len(files) == 0 {
@@ -249,3 +327,12 @@ func (files visibleFiles) EndTxNum() uint64 {
 	}
 	return files[len(files)-1].endTxNum
 }
+
+// dataEndTxNum - like EndTxNum, but txNums in [dataEndTxNum, EndTxNum) are not in files yet (see filesItem.dataRange)
+func (files visibleFiles) dataEndTxNum() uint64 {
+	if len(files) == 0 {
+		return 0
+	}
+	_, to := files[len(files)-1].src.dataRange()
+	return to
+}
@@ -0,0 +1,168 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	btree2 "github.com/tidwall/btree"
+)
+
+// Refresh - re-scans snapshots folders after files were added or deleted on disk while node is running (downloader
+// finished, operator removed files while node was paused). Files which vanished from disk become invisible for new
+// views right away and are closed when views which still hold them are closed. New files are opened.
+// Aggregator pointer doesn't change: wrappers which hold it (temporal DB) don't need re-creation.
+//
+// Waits for views holding vanished files not longer than ctx and SetCloseTimeout. Files which are still held after
+// that are closed by next Refresh or by Close.
+func (a *Aggregator) Refresh(ctx context.Context) (added, removed []string, err error) {
+	a.lockDirtyFiles()
+	before := a.dirtyFileNames()
+	vanished := a.vanishedFiles
+	a.vanishedFiles = nil
+	for _, tree := range a.dirtyFilesTrees() {
+		vanished = append(vanished, detachVanishedFiles(tree)...)
+	}
+	a.unlockDirtyFiles()
+	// must be called after `dirtyFilesLock` released - see lock_order.go
+	a.recalcVisibleFiles()
+
+	if err = a.OpenFolder(); err != nil {
+		return nil, nil, fmt.Errorf("Refresh: %w", err)
+	}
+
+	a.lockDirtyFiles()
+	after := a.dirtyFileNames()
+	a.unlockDirtyFiles()
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	if len(added) > 0 || len(removed) > 0 {
+		a.needSaveFilesListInDB.Store(true)
+	}
+
+	if err = a.closeVanishedFiles(ctx, vanished); err != nil {
+		return added, removed, fmt.Errorf("Refresh: %w", err)
+	}
+	return added, removed, nil
+}
+
+// dirtyFilesTrees - dirtyFiles of all domains, histories, inverted indices and appendables
+func (a *Aggregator) dirtyFilesTrees() (res []*btree2.BTreeG[*filesItem]) {
+	for _, d := range a.d {
+		res = append(res, d.dirtyFiles, d.History.dirtyFiles, d.History.InvertedIndex.dirtyFiles)
+	}
+	for _, ii := range a.iis {
+		res = append(res, ii.dirtyFiles)
+	}
+	for _, ap := range a.ap {
+		if ap != nil {
+			res = append(res, ap.dirtyFiles)
+		}
+	}
+	return res
+}
+
+// dirtyFileNames - names of open data files. Must be called under `dirtyFilesLock`
+func (a *Aggregator) dirtyFileNames() map[string]struct{} {
+	res := map[string]struct{}{}
+	for _, tree := range a.dirtyFilesTrees() {
+		tree.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.decompressor != nil {
+					res[item.decompressor.FileName()] = struct{}{}
+				}
+			}
+			return true
+		})
+	}
+	return res
+}
+
+// detachVanishedFiles - removes from `dirtyFiles` items whose data file doesn't exist on disk anymore.
+// Files of items stay open: views may still read them (unlinked file is readable until it's closed)
+func detachVanishedFiles(dirtyFiles *btree2.BTreeG[*filesItem]) (vanished []*filesItem) {
+	dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor == nil {
+				continue
+			}
+			if _, err := os.Stat(item.decompressor.FilePath()); errors.Is(err, os.ErrNotExist) {
+				vanished = append(vanished, item)
+			}
+		}
+		return true
+	})
+	for _, item := range vanished {
+		dirtyFiles.Delete(item)
+	}
+	return vanished
+}
+
+// closeVanishedFiles - closes files of detached items when no live view holds them (see FilesRetention)
+func (a *Aggregator) closeVanishedFiles(ctx context.Context, vanished []*filesItem) error {
+	timer := time.NewTimer(a.closeTimeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		vanished = a.closeNotHeldFiles(vanished)
+		if len(vanished) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			a.keepVanishedFiles(vanished)
+			return ctx.Err()
+		case <-timer.C:
+			a.keepVanishedFiles(vanished)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Aggregator) closeNotHeldFiles(items []*filesItem) (held []*filesItem) {
+	a.views.lockAll()
+	defer a.views.unlockAll()
+	for _, item := range items {
+		isHeld := false
+		a.views.each(func(_ uint64, ac *AggregatorRoTx) { isHeld = isHeld || ac.holds(item) })
+		if isHeld {
+			held = append(held, item)
+			continue
+		}
+		item.closeFiles()
+	}
+	return held
+}
+
+func (a *Aggregator) keepVanishedFiles(items []*filesItem) {
+	views := map[uint64]time.Duration{}
+	a.views.lockAll()
+	a.views.each(func(id uint64, ac *AggregatorRoTx) {
+		for _, item := range items {
+			if ac.holds(item) {
+				views[id] = time.Since(ac.openedAt)
+			}
+		}
+	})
+	a.views.unlockAll()
+	a.logger.Warn("[agg] Refresh: files deleted from disk are still held by open views, will close them later", "files", len(items), "views", fmt.Sprintf("%v", views))
+
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
+	a.vanishedFiles = append(a.vanishedFiles, items...)
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+// Step size of files:
+//   - step size (config3.HistoryV3AggregationStep) changed between releases: datadir may have files named in steps of
+//     other size than configured. Step size of data file name is recorded in `<data file>.step` sidecar (see
+//     writeStepSize): format of data files is unchanged, they stay readable by apps which don't know about it.
+//   - range of file is interpreted by recorded step size: [fromStep*recorded, toStep*recorded). Files without record
+//     (produced before it was recorded) are in configured steps. Files are never renamed: paths of data file and its
+//     accessors are built by steps of its name (see filesItem.steps).
+//   - new files and merge results are named in configured steps. Merge range can't end on file which ends in the middle
+//     of configured step (see filesItem.endsOnStep): such file is merged only as a part of range ending on later file.
+//   - DB is pruned only by complete configured steps of files (see AggregatorRoTx.pruneTxTo): step which is in files
+//     partially stays in DB until file of configured step is built from it. If DB was pruned by app which produced files -
+//     step can't be built (see ErrStepPartiallyInFiles): use step size of that app until files end on configured step.
+//   - domain keys in DB are stored with step of writer: step size must be changed on datadir whose DB is pruned.
+
+const stepSizeSuffix = ".step"
+
+// writeStepSize - records `stepSize` of name of produced data file `dataPath`
+func writeStepSize(dataPath string, stepSize uint64, noFsync bool) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, stepSize)
+	if noFsync {
+		return os.WriteFile(dataPath+stepSizeSuffix, buf, 0644)
+	}
+	return dir.WriteFileWithFsync(dataPath+stepSizeSuffix, buf, 0644)
+}
+
+// readStepSize - ok=false for files produced before step size was recorded
+func readStepSize(dataPath string) (stepSize uint64, ok bool, err error) {
+	buf, err := os.ReadFile(dataPath + stepSizeSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if len(buf) != 8 {
+		return 0, false, fmt.Errorf("%s: corrupted step size, len=%d", filepath.Base(dataPath), len(buf))
+	}
+	return binary.BigEndian.Uint64(buf), true, nil
+}
+
+// recordedStepSize - step size of data file `fPath`: recorded by app which produced it, or `configured` if file has
+// no record or it can't be read (recorded=false)
+func recordedStepSize(fPath string, configured uint64, logger log.Logger) (stepSize uint64, recorded bool) {
+	stepSize, ok, err := readStepSize(fPath)
+	if err != nil {
+		logger.Warn("[agg] step size of file", "err", err)
+	}
+	if err != nil || !ok || stepSize == 0 {
+		return configured, false
+	}
+	if stepSize != configured {
+		logger.Debug("[agg] file of other step size", "name", filepath.Base(fPath), "stepSize", stepSize, "configured", configured)
+	}
+	return stepSize, true
+}
+
+// ErrStepPartiallyInFiles - step is partially covered by files of other step size and its beginning is not in DB anymore
+// (pruned by app which produced these files): file of step can't be built without losing data
+var ErrStepPartiallyInFiles = errors.New("step is partially in files of other step size")
+
+// checkStepNotPartiallyInFiles - file of `step` replaces files which cover it partially (they become subset of it), so
+// all data of step must be in DB
+func (a *Aggregator) checkStepNotPartiallyInFiles(ctx context.Context, step uint64) error {
+	txFrom, txTo := a.FirstTxNumOfStep(step), a.FirstTxNumOfStep(step+1)
+	filesEnd := a.visibleFilesMinimaxTxNum.Load()
+	if filesEnd <= txFrom || filesEnd >= txTo {
+		return nil
+	}
+	return a.db.View(ctx, func(tx kv.Tx) error {
+		if inDB := a.d[kv.AccountsDomain].History.InvertedIndex.minTxNumInDB(tx); inDB > txFrom {
+			return fmt.Errorf("%w: step %d [%d, %d), files end at %d, DB starts at %d", ErrStepPartiallyInFiles, step, txFrom, txTo, filesEnd, inDB)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+// stepSizeTestData - key `txNum%5` is updated by every txNum, value is txNum
+type stepSizeTestData struct {
+	t  *testing.T
+	db kv.RwDB
+}
+
+func (d stepSizeTestData) key(i uint64) []byte {
+	k := make([]byte, length.Addr)
+	k[0] = byte(i%5) + 1
+	return k
+}
+
+func (d stepSizeTestData) write(agg *Aggregator, fromTxNum, toTxNum uint64) {
+	d.t.Helper()
+	ctx := context.Background()
+	rwTx, err := d.db.BeginRw(ctx)
+	require.NoError(d.t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(d.t, err)
+	defer domains.Close()
+	for txNum := fromTxNum; txNum < toTxNum; txNum++ {
+		domains.SetTxNum(txNum)
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, txNum)
+		require.NoError(d.t, domains.DomainPut(kv.AccountsDomain, d.key(txNum), nil, v, nil, 0))
+	}
+	require.NoError(d.t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(d.t, rwTx.Commit())
+}
+
+func (d stepSizeTestData) prune(agg *Aggregator) {
+	d.t.Helper()
+	require.NoError(d.t, d.db.Update(context.Background(), func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.Prune(context.Background(), tx, 0, nil)
+		return err
+	}))
+}
+
+// answers - latest values and values as of every txNum below `toTxNum`
+func (d stepSizeTestData) answers(agg *Aggregator, toTxNum uint64) (res map[[2]uint64]string) {
+	d.t.Helper()
+	res = map[[2]uint64]string{}
+	require.NoError(d.t, d.db.View(context.Background(), func(tx kv.Tx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for k := uint64(0); k < 5; k++ {
+			v, _, _, err := ac.GetLatest(kv.AccountsDomain, d.key(k), nil, tx)
+			require.NoError(d.t, err)
+			res[[2]uint64{k, toTxNum}] = string(v)
+			for ts := uint64(0); ts < toTxNum; ts++ {
+				v, _, err := ac.DomainGetAsOf(tx, kv.AccountsDomain, d.key(k), ts)
+				require.NoError(d.t, err)
+				res[[2]uint64{k, ts}] = string(v)
+			}
+		}
+		return nil
+	}))
+	return res
+}
+
+func TestAggregatorV3_StepSizeChange(t *testing.T) {
+	const stepSize = 16
+	ctx := context.Background()
+
+	t.Run("files end on step", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		data := stepSizeTestData{t: t, db: db}
+		data.write(agg, 0, 4*stepSize)
+		for step := uint64(0); step < 4; step++ {
+			require.NoError(t, agg.buildFiles(ctx, step))
+		}
+		data.prune(agg)
+		before := data.answers(agg, 4*stepSize)
+		agg.Close()
+
+		agg = testAggregatorv3(t, db, agg.dirs, 2*stepSize, agg.commitmentValuesTransform)
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		files := ac.d[kv.AccountsDomain].files
+		require.Len(t, files, 4)
+		for i, item := range files {
+			require.Equal(t, uint64(i*stepSize), item.startTxNum)
+			require.Equal(t, uint64((i+1)*stepSize), item.endTxNum)
+			fromStep, toStep := item.src.steps()
+			require.Equal(t, [2]uint64{uint64(i), uint64(i + 1)}, [2]uint64{fromStep, toStep})
+		}
+		require.Equal(t, before, data.answers(agg, 4*stepSize), "queries")
+
+		require.Equal(t, uint64(4*stepSize), ac.pruneTxTo())
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			_, maxStep := ac.d[kv.AccountsDomain].canPruneDomainTables(tx, 4*stepSize)
+			require.Equal(t, uint64(1), maxStep, "last step of 2*stepSize in files")
+			return nil
+		}))
+
+		r := ac.findMergeRange(agg.visibleFilesMinimaxTxNum.Load(), StepsInColdFile*agg.StepSize())
+		ar := r.domain[kv.AccountsDomain]
+		require.True(t, ar.values)
+		require.Equal(t, [2]uint64{0, 4 * stepSize}, [2]uint64{ar.valuesStartTxNum, ar.valuesEndTxNum})
+		ac.Close()
+
+		require.NoError(t, agg.MergeLoop(ctx))
+		ac = agg.BeginFilesRo()
+		defer ac.Close()
+		require.Len(t, ac.d[kv.AccountsDomain].files, 1)
+		merged := filepath.Join(agg.dirs.SnapDomain, "v1-accounts.0-2.kv")
+		require.Equal(t, merged, ac.d[kv.AccountsDomain].files[0].src.decompressor.FilePath())
+		recorded, ok, err := readStepSize(merged)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, uint64(2*stepSize), recorded)
+		ac.Close()
+		require.Equal(t, before, data.answers(agg, 4*stepSize), "queries after merge")
+
+		data.write(agg, 4*stepSize, 7*stepSize)
+		require.NoError(t, agg.buildFiles(ctx, 2))
+		require.FileExists(t, filepath.Join(agg.dirs.SnapDomain, "v1-accounts.2-3.kv"))
+		after := data.answers(agg, 6*stepSize)
+		for k, v := range before {
+			if k[1] < 4*stepSize {
+				require.Equal(t, v, after[k], "history of old files %v", k)
+			}
+		}
+	})
+
+	t.Run("files end in the middle of step", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		data := stepSizeTestData{t: t, db: db}
+		data.write(agg, 0, 3*stepSize)
+		for step := uint64(0); step < 3; step++ {
+			require.NoError(t, agg.buildFiles(ctx, step))
+		}
+		require.NoError(t, agg.MergeLoop(ctx)) // 0-2, 2-3
+		data.prune(agg)
+		before := data.answers(agg, 3*stepSize)
+		agg.Close()
+
+		agg = testAggregatorv3(t, db, agg.dirs, 2*stepSize, agg.commitmentValuesTransform)
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		files := ac.d[kv.AccountsDomain].files
+		require.Len(t, files, 2)
+		require.Equal(t, [2]uint64{0, 2 * stepSize}, [2]uint64{files[0].startTxNum, files[0].endTxNum})
+		require.Equal(t, [2]uint64{2 * stepSize, 3 * stepSize}, [2]uint64{files[1].startTxNum, files[1].endTxNum})
+		require.Equal(t, before, data.answers(agg, 3*stepSize), "queries")
+
+		// step [2*stepSize, 4*stepSize) is in files partially: it stays in DB
+		require.Equal(t, uint64(2*stepSize), ac.pruneTxTo())
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			_, maxStep := ac.d[kv.AccountsDomain].canPruneDomainTables(tx, 3*stepSize)
+			require.Zero(t, maxStep)
+			return nil
+		}))
+		require.False(t, ac.findMergeRange(agg.visibleFilesMinimaxTxNum.Load(), StepsInColdFile*agg.StepSize()).any())
+		ac.Close()
+
+		// beginning of step was pruned with old step size
+		data.write(agg, 3*stepSize, 5*stepSize)
+		require.ErrorIs(t, agg.buildFiles(ctx, 1), ErrStepPartiallyInFiles)
+		require.NoFileExists(t, filepath.Join(agg.dirs.SnapDomain, "v1-accounts.1-2.kv"))
+		after := data.answers(agg, 3*stepSize)
+		for k, v := range before {
+			if k[1] < 3*stepSize {
+				require.Equal(t, v, after[k], "history of old files %v", k)
+			}
+		}
+	})
+}
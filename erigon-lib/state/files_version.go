@@ -0,0 +1,108 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
+)
+
+// FileVersionRange - versions of state files which this Erigon can read: [Min, Max]
+type FileVersionRange struct{ Min, Max uint64 }
+
+func (r FileVersionRange) Has(v uint64) bool { return r.Min <= v && v <= r.Max }
+
+// SupportedFileVersions - by file extension. Files of higher version are produced by newer Erigon and can't be read:
+// format of file may be changed in incompatible way.
+var SupportedFileVersions = map[string]FileVersionRange{
+	// domain
+	"kv": {1, 1},
+	// history
+	"v": {1, 1},
+	// inverted index
+	"ef": {1, 1},
+	// accessors
+	"kvi":  {1, 1},
+	"kvei": {1, 1},
+	"kvch": {1, 1},
+	"bt":   {1, 1},
+	"vi":   {1, 1},
+	"efi":  {1, 1},
+}
+
+// escape hatch: comma-separated list of file names which must be ignored by version check. `*` - ignore all.
+var skipFilesVersionCheck = dbg.EnvString("AGG_SKIP_VERSION_CHECK", "")
+
+var stateFileNameRe = regexp.MustCompile(`^v([0-9]+)-([a-z]+)\.([0-9]+)-([0-9]+)\.([a-z]+)$`)
+
+type UnsupportedFile struct {
+	Name      string
+	Version   uint64
+	Supported FileVersionRange
+}
+
+// UnsupportedFileVersionError - datadir has state files produced by newer Erigon (for example after downgrade)
+type UnsupportedFileVersionError struct {
+	Files []UnsupportedFile
+}
+
+func (e *UnsupportedFileVersionError) Error() string {
+	names := make([]string, 0, len(e.Files))
+	for _, f := range e.Files {
+		names = append(names, fmt.Sprintf("%s (v%d, supported v%d-v%d)", f.Name, f.Version, f.Supported.Min, f.Supported.Max))
+	}
+	return fmt.Sprintf("state files were produced by newer Erigon version - please upgrade Erigon to version which supports them, "+
+		"or remove them, or skip them by env AGG_SKIP_VERSION_CHECK=<comma-separated names>: %s", strings.Join(names, ", "))
+}
+
+// SkipFilesVersionCheck - files to ignore by version check on OpenFolder/OpenList. `*` - ignore all.
+// Ignored files are not opened: only files of supported version are opened.
+func (a *Aggregator) SkipFilesVersionCheck(names ...string) {
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			a.skipVersionCheck[name] = struct{}{}
+		}
+	}
+}
+
+// checkFilesVersions - must be called before open of files
+func (a *Aggregator) checkFilesVersions() error {
+	if _, ok := a.skipVersionCheck["*"]; ok {
+		return nil
+	}
+	var unsupported []UnsupportedFile
+	for _, dir := range []string{a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx, a.dirs.SnapAccessors} {
+		fileNames, err := filesFromDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range fileNames {
+			subs := stateFileNameRe.FindStringSubmatch(name)
+			if len(subs) != 6 {
+				continue
+			}
+			supported, ok := SupportedFileVersions[subs[5]]
+			if !ok {
+				continue
+			}
+			version, err := strconv.ParseUint(subs[1], 10, 64)
+			if err != nil || supported.Has(version) {
+				continue
+			}
+			if _, ok := a.skipVersionCheck[name]; ok {
+				a.logger.Warn("[snapshots] skip file of unsupported version", "file", name)
+				continue
+			}
+			unsupported = append(unsupported, UnsupportedFile{Name: filepath.Base(name), Version: version, Supported: supported})
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	sort.Slice(unsupported, func(i, j int) bool { return unsupported[i].Name < unsupported[j].Name })
+	return &UnsupportedFileVersionError{Files: unsupported}
+}
@@ -26,8 +26,10 @@ import (
 	"math"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	btree2 "github.com/tidwall/btree"
@@ -89,6 +91,63 @@ type History struct {
 	snapshotsDisabled bool   // don't produce .v and .ef files, keep in db table. old data will be pruned anyway.
 	historyDisabled   bool   // skip all write operations to this History (even in DB)
 	keepRecentTxnInDB uint64 // When dontProduceHistoryFiles=true, keepRecentTxInDB is used to keep this amount of tx in db before pruning
+	// retentionProvider - if set, replaces keepRecentTxnInDB: txNums >= minKeepTxNum are kept in db. see Aggregator.SetHistoryRetentionProvider
+	retentionProvider HistoryRetentionProvider
+	// retentionErrLoggedAt - unixnano of last Warn about retentionProvider error: prune is frequent, warn once per minute
+	retentionErrLoggedAt atomic.Int64
+
+	// expiryKeepSteps - history expiry mode: if >0, files older than this amount of steps are deleted. see Aggregator.SetHistoryExpiry
+	expiryKeepSteps uint64
+}
+
+// ErrHistoryExpired - requested txNum is behind history expiry horizon: files were deleted. see Aggregator.SetHistoryExpiry
+var ErrHistoryExpired = errors.New("history expired")
+
+// ErrPrunedHistory - requested txNum is below pruned boundary of DB (see kv.TblPrunedUpTo) and not covered by files:
+// history existed, but is not available anymore. Unlike "not found" - which means key had no changes.
+var ErrPrunedHistory = errors.New("history pruned")
+
+// deleteExpiredFiles - removes .v/.ef files which are fully behind expiry horizon. Must be called under `dirtyFilesLock`.
+// Returns true if dirtyFiles changed (visibleFiles must be re-calculated).
+func (h *History) deleteExpiredFiles() bool {
+	if h.expiryKeepSteps == 0 || h.snapshotsDisabled {
+		return false
+	}
+	lastFile, ok := h.dirtyFiles.Max()
+	if !ok || lastFile.endTxNum <= h.expiryKeepSteps*h.aggregationStep {
+		return false
+	}
+	horizon := lastFile.endTxNum - h.expiryKeepSteps*h.aggregationStep
+
+	var expired, expiredIdx []*filesItem
+	h.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum <= horizon {
+				expired = append(expired, item)
+			}
+		}
+		return true
+	})
+	h.InvertedIndex.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum <= horizon {
+				expiredIdx = append(expiredIdx, item)
+			}
+		}
+		return true
+	})
+	if len(expired) == 0 && len(expiredIdx) == 0 {
+		return false
+	}
+	// expired files are removed even if frozen: with data file also goes its .step sidecar (see closeFilesAndRemove).
+	// files of alive readers are removed by last of them - see HistoryRoTx.Close
+	for _, item := range append(expired, expiredIdx...) {
+		item.frozen = false
+	}
+	deleteMergeFile(h.dirtyFiles, expired, h.filenameBase, h.logger)
+	deleteMergeFile(h.InvertedIndex.dirtyFiles, expiredIdx, h.filenameBase, h.logger)
+	h.logger.Debug("[agg] history expired", "name", h.filenameBase, "horizon", horizon, "files", len(expired)+len(expiredIdx))
+	return true
 }
 
 type histCfg struct {
@@ -198,8 +257,10 @@ func (h *History) scanStateFiles(fNames []string) (garbageFiles []*filesItem) {
 			continue
 		}
 
-		startTxNum, endTxNum := startStep*h.aggregationStep, endStep*h.aggregationStep
-		var newFile = newFilesItem(startTxNum, endTxNum, h.aggregationStep)
+		stepSize, recorded := recordedStepSize(h.vFilePath(startStep, endStep), h.aggregationStep, h.logger)
+		startTxNum, endTxNum := startStep*stepSize, endStep*stepSize
+		var newFile = newFilesItem(startTxNum, endTxNum, stepSize)
+		newFile.stepSizeUnknown = !recorded
 
 		if h.integrityCheck != nil && !h.integrityCheck(startStep, endStep) {
 			continue
@@ -218,7 +279,7 @@ func (h *History) openFiles() error {
 	invalidFileItems := make([]*filesItem, 0)
 	h.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+			fromStep, toStep := item.steps()
 			if item.decompressor == nil {
 				fPath := h.vFilePath(fromStep, toStep)
 				exists, err := dir.FileExist(fPath)
@@ -329,7 +390,7 @@ func (ht *HistoryRoTx) Files() (res []string) {
 func (h *History) missedAccessors() (l []*filesItem) {
 	h.dirtyFiles.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+			fromStep, toStep := item.steps()
 			exists, err := dir.FileExist(h.vAccessorFilePath(fromStep, toStep))
 			if err != nil {
 				_, fName := filepath.Split(h.vAccessorFilePath(fromStep, toStep))
@@ -358,7 +419,7 @@ func (h *History) buildVi(ctx context.Context, item *filesItem, ps *background.P
 	if iiItem.decompressor == nil {
 		return fmt.Errorf("buildVI: got iiItem with nil decompressor %s %d-%d", h.filenameBase, item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep)
 	}
-	fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+	fromStep, toStep := item.steps()
 	idxPath := h.vAccessorFilePath(fromStep, toStep)
 
 	_, err = h.buildVI(ctx, idxPath, item.decompressor, iiItem.decompressor, ps)
@@ -454,7 +515,7 @@ func (h *History) BuildMissedAccessors(ctx context.Context, g *errgroup.Group, p
 	for _, item := range missedFiles {
 		item := item
 		g.Go(func() error {
-			return h.buildVi(ctx, item, ps)
+			return indexBuildFailed(item, h.buildVi(ctx, item, ps))
 		})
 	}
 }
@@ -582,6 +643,7 @@ type HistoryCollation struct {
 	historyPath   string
 	efHistoryPath string
 	historyCount  int // same as historyComp.Count()
+	historyBytes  int64
 }
 
 func (c HistoryCollation) Close() {
@@ -626,6 +688,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
 	}
+	setDataRange(comp, step, step+1, h.aggregationStep, txFrom, txTo)
 	historyComp = NewArchiveWriter(comp, h.compression)
 
 	keysCursor, err := roTx.CursorDupSort(h.indexKeysTable)
@@ -681,14 +744,16 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 	if h.noFsync {
 		efComp.DisableFsync()
 	}
+	setDataRange(efComp, step, step+1, h.aggregationStep, txFrom, txTo)
 
 	var (
-		keyBuf      = make([]byte, 0, 256)
-		numBuf      = make([]byte, 8)
-		bitmap      = bitmapdb.NewBitmap64()
-		prevEf      []byte
-		prevKey     []byte
-		initialized bool
+		keyBuf       = make([]byte, 0, 256)
+		numBuf       = make([]byte, 8)
+		bitmap       = bitmapdb.NewBitmap64()
+		prevEf       []byte
+		prevKey      []byte
+		initialized  bool
+		historyBytes int64
 	)
 	efHistoryComp = NewArchiveWriter(efComp, CompressNone)
 	collector.SortAndFlushInBackground(true)
@@ -725,6 +790,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 				if err = historyComp.AddWord(val); err != nil {
 					return fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, key, val, err)
 				}
+				historyBytes += int64(len(val))
 			} else {
 				val, err := cd.SeekBothRange(prevKey, numBuf)
 				if err != nil {
@@ -738,6 +804,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 				if err = historyComp.AddWord(val); err != nil {
 					return fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, prevKey, val, err)
 				}
+				historyBytes += int64(len(val))
 			}
 
 			ef.AddOffset(vTxNum)
@@ -753,6 +820,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		if err = efHistoryComp.AddWord(prevEf); err != nil {
 			return fmt.Errorf("add %s ef history val: %w", h.filenameBase, err)
 		}
+		historyBytes += int64(len(prevKey) + len(prevEf))
 
 		prevKey = append(prevKey[:0], k...)
 		txNum = binary.BigEndian.Uint64(v)
@@ -780,6 +848,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		historyPath:   historyPath,
 		historyComp:   historyComp,
 		historyCount:  historyComp.Count(),
+		historyBytes:  historyBytes,
 	}, nil
 }
 
@@ -881,6 +950,9 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 	if err != nil {
 		return HistoryFiles{}, fmt.Errorf("open %s .ef history decompressor: %w", h.filenameBase, err)
 	}
+	if err = writeStepSize(collation.efHistoryPath, h.aggregationStep, h.noFsync); err != nil {
+		return HistoryFiles{}, fmt.Errorf("write %s .ef step size: %w", h.filenameBase, err)
+	}
 	{
 		if err := h.InvertedIndex.buildMapAccessor(ctx, step, step+1, efHistoryDecomp, ps); err != nil {
 			return HistoryFiles{}, fmt.Errorf("build %s .ef history idx: %w", h.filenameBase, err)
@@ -894,6 +966,9 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 	if err != nil {
 		return HistoryFiles{}, fmt.Errorf("open %s v history decompressor: %w", h.filenameBase, err)
 	}
+	if err = writeStepSize(collation.historyPath, h.aggregationStep, h.noFsync); err != nil {
+		return HistoryFiles{}, fmt.Errorf("write %s .v step size: %w", h.filenameBase, err)
+	}
 
 	historyIdxPath := h.vAccessorFilePath(step, step+1)
 	historyIdxPath, err = h.buildVI(ctx, historyIdxPath, historyDecomp, efHistoryDecomp, ps)
@@ -967,6 +1042,9 @@ type HistoryRoTx struct {
 	getters []ArchiveGetter
 	readers []*recsplit.IndexReader
 
+	noHistoryBefore uint64 // latest-state-only domain: end of .kv files, history behind it is not available
+	readSource      ReadSource
+
 	trace bool
 
 	valsC    kv.Cursor
@@ -977,12 +1055,7 @@ type HistoryRoTx struct {
 
 func (h *History) BeginFilesRo() *HistoryRoTx {
 	files := h._visibleFiles
-	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
-	}
-
+	files.refAll()
 	return &HistoryRoTx{
 		h:     h,
 		iit:   h.InvertedIndex.BeginFilesRo(),
@@ -1023,6 +1096,27 @@ func (ht *HistoryRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
 	return r
 }
 
+// minKeepTxNumInDB - prune boundary of history with disabled snapshots. ok=false - nothing can be pruned
+func (h *History) minKeepTxNumInDB(tx kv.Tx, maxIdxTx uint64) (minKeepTxNum uint64, ok bool) {
+	if h.retentionProvider != nil {
+		minKeepTxNum, err := h.retentionProvider(tx)
+		if err != nil {
+			now, last := time.Now().UnixNano(), h.retentionErrLoggedAt.Load()
+			if now-last >= int64(time.Minute) && h.retentionErrLoggedAt.CompareAndSwap(last, now) {
+				h.logger.Warn("[agg] history retention provider failed, skip prune", "name", h.filenameBase, "err", err)
+			} else {
+				h.logger.Trace("[agg] history retention provider failed, skip prune", "name", h.filenameBase, "err", err)
+			}
+			return 0, false
+		}
+		return minKeepTxNum, true
+	}
+	if h.keepRecentTxnInDB >= maxIdxTx {
+		return 0, false
+	}
+	return maxIdxTx - h.keepRecentTxnInDB, true
+}
+
 func (ht *HistoryRoTx) canPruneUntil(tx kv.Tx, untilTx uint64) (can bool, txTo uint64) {
 	minIdxTx, maxIdxTx := ht.iit.ii.minTxNumInDB(tx), ht.iit.ii.maxTxNumInDB(tx)
 	//defer func() {
@@ -1031,16 +1125,17 @@ func (ht *HistoryRoTx) canPruneUntil(tx kv.Tx, untilTx uint64) (can bool, txTo u
 	//}()
 
 	if ht.h.snapshotsDisabled {
-		if ht.h.keepRecentTxnInDB >= maxIdxTx {
+		minKeepTxNum, ok := ht.h.minKeepTxNumInDB(tx, maxIdxTx)
+		if !ok {
 			return false, 0
 		}
-		txTo = min(maxIdxTx-ht.h.keepRecentTxnInDB, untilTx) // bound pruning
+		txTo = min(minKeepTxNum, untilTx) // bound pruning. boundary below already pruned - is no-op: minIdxTx >= txTo
 	} else {
 		canPruneIdx := ht.iit.CanPrune(tx)
 		if !canPruneIdx {
 			return false, 0
 		}
-		txTo = min(ht.files.EndTxNum(), ht.iit.files.EndTxNum(), untilTx)
+		txTo = min(ht.files.dataEndTxNum(), ht.iit.files.dataEndTxNum(), untilTx)
 	}
 
 	switch ht.h.filenameBase {
@@ -1063,38 +1158,69 @@ func (ht *HistoryRoTx) canPruneUntil(tx kv.Tx, untilTx uint64) (can bool, txTo u
 //     and will wrongly update progress of steps cleaning and could end up with inconsistent history.
 func (ht *HistoryRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, limit uint64, forced bool, logEvery *time.Ticker) (*InvertedIndexPruneStat, error) {
 	//fmt.Printf(" pruneH[%s] %t, %d-%d\n", ht.h.filenameBase, ht.CanPruneUntil(rwTx), txFrom, txTo)
+	txTo, forced, can := ht.pruneBounds(rwTx, txTo, forced)
+	if !can {
+		return nil, nil
+	}
+	defer func(t time.Time) { mxPruneTookHistory.ObserveDuration(t) }(time.Now())
+
+	pruneValue, closeFn, err := ht.valuesPruner(rwTx, txFrom, txTo)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+	return ht.iit.Prune(ctx, rwTx, txFrom, txTo, limit, logEvery, forced, pruneValue)
+}
+
+// pruneBounds - returns `txTo` bounded by files and `forced` flag for InvertedIndexRoTx.Prune. can=false - nothing to prune
+func (ht *HistoryRoTx) pruneBounds(tx kv.Tx, txTo uint64, forced bool) (newTxTo uint64, iiForced, can bool) {
 	if !forced {
-		var can bool
-		can, txTo = ht.canPruneUntil(rwTx, txTo)
-		if !can {
-			return nil, nil
+		if can, txTo = ht.canPruneUntil(tx, txTo); !can {
+			return 0, false, false
 		}
 	}
-	defer func(t time.Time) { mxPruneTookHistory.ObserveDuration(t) }(time.Now())
+	if !forced && ht.h.snapshotsDisabled {
+		forced = true // or index.CanPrune will return false cuz no snapshots made
+	}
+	return txTo, forced, true
+}
+
+// pruneJob - see pruneJob. nil - nothing to prune
+func (ht *HistoryRoTx) pruneJob(tx kv.Tx, txFrom, txTo, limit uint64) *iiPruneJob {
+	txTo, forced, can := ht.pruneBounds(tx, txTo, false)
+	if !can {
+		return nil
+	}
+	j := ht.iit.newPruneJob(txFrom, txTo, limit)
+	if !forced {
+		j.skip = !ht.iit.CanPrune(tx)
+	}
+	j.history = ht
+	return j
+}
 
+// valuesPruner - returns func which deletes value of history by `key` and `txnm` (pair of index table)
+func (ht *HistoryRoTx) valuesPruner(rwTx kv.RwTx, txFrom, txTo uint64) (pruneValue func(k, txnm []byte) error, closeFn func(), err error) {
 	var (
 		seek     = make([]byte, 8, 256)
 		valsCDup kv.RwCursorDupSort
 		valsC    kv.RwCursor
-		err      error
 	)
 
 	if !ht.h.historyLargeValues {
 		valsCDup, err = rwTx.RwCursorDupSort(ht.h.historyValsTable)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		defer valsCDup.Close()
 	} else {
 		valsC, err = rwTx.RwCursor(ht.h.historyValsTable)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		defer valsC.Close()
 	}
 
 	var pruned int
-	pruneValue := func(k, txnm []byte) error {
+	pruneValue = func(k, txnm []byte) error {
 		txNum := binary.BigEndian.Uint64(txnm)
 		if txNum >= txTo || txNum < txFrom { //[txFrom; txTo), but in this case idx record
 			return fmt.Errorf("history pruneValue: txNum %d not in pruning range [%d,%d)", txNum, txFrom, txTo)
@@ -1121,13 +1247,22 @@ func (ht *HistoryRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, li
 		pruned++
 		return nil
 	}
-	mxPruneSizeHistory.AddInt(pruned)
-
-	if !forced && ht.h.snapshotsDisabled {
-		forced = true // or index.CanPrune will return false cuz no snapshots made
+	closeFn = func() {
+		mxPruneSizeHistory.AddInt(pruned)
+		if valsCDup != nil {
+			valsCDup.Close()
+		}
+		if valsC != nil {
+			valsC.Close()
+		}
 	}
+	return pruneValue, closeFn, nil
+}
 
-	return ht.iit.Prune(ctx, rwTx, txFrom, txTo, limit, logEvery, forced, pruneValue)
+// clone - see AggregatorRoTx.Clone
+func (ht *HistoryRoTx) clone() *HistoryRoTx {
+	ht.files.refAll()
+	return &HistoryRoTx{h: ht.h, iit: ht.iit.clone(), files: ht.files, noHistoryBefore: ht.noHistoryBefore, readSource: ht.readSource}
 }
 
 func (ht *HistoryRoTx) Close() {
@@ -1138,7 +1273,7 @@ func (ht *HistoryRoTx) Close() {
 	ht.files = nil
 	for i := 0; i < len(files); i++ {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -1165,9 +1300,11 @@ func (ht *HistoryRoTx) getFileDeprecated(from, to uint64) (it ctxItem, ok bool)
 	}
 	return it, false
 }
+
+// getFile - file which has `txNum`. By data range: with block-aligned steps it can differ from range of file name
 func (ht *HistoryRoTx) getFile(txNum uint64) (it ctxItem, ok bool) {
 	for i := 0; i < len(ht.files); i++ {
-		if ht.files[i].startTxNum <= txNum && ht.files[i].endTxNum > txNum {
+		if from, to := ht.files[i].src.dataRange(); from <= txNum && to > txNum {
 			return ht.files[i], true
 		}
 	}
@@ -1175,12 +1312,24 @@ func (ht *HistoryRoTx) getFile(txNum uint64) (it ctxItem, ok bool) {
 }
 
 func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, bool, error) {
+	return ht.historySeekInFilesCtx(context.Background(), key, txNum)
+}
+
+func (ht *HistoryRoTx) historySeekInFilesCtx(ctx context.Context, key []byte, txNum uint64) ([]byte, bool, error) {
 	// Files list of II and History is different
 	// it means II can't return index of file, but can return TxNum which History will use to find own file
-	ok, histTxNum := ht.iit.seekInFiles(key, txNum)
+	ok, histTxNum, err := ht.iit.seekInFilesCtx(ctx, key, txNum)
+	if err != nil {
+		return nil, false, err
+	}
 	if !ok {
 		return nil, false, nil
 	}
+	return ht.historyValueInFiles(key, txNum, histTxNum)
+}
+
+// historyValueInFiles - value of `key` written at `histTxNum` (found by inverted index). !ok - value is not in files
+func (ht *HistoryRoTx) historyValueInFiles(key []byte, txNum, histTxNum uint64) ([]byte, bool, error) {
 	historyItem, ok := ht.getFile(histTxNum)
 	if !ok {
 		return nil, false, fmt.Errorf("hist file not found: key=%x, %s.%d-%d", key, ht.h.filenameBase, histTxNum/ht.h.aggregationStep, histTxNum/ht.h.aggregationStep)
@@ -1272,17 +1421,171 @@ func (ht *HistoryRoTx) encodeTs(txNum uint64) []byte {
 // HistorySeek searches history for a value of specified key before txNum
 // second return value is true if the value is found in the history (even if it is nil)
 func (ht *HistoryRoTx) HistorySeek(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
-	v, ok, err := ht.historySeekInFiles(key, txNum)
+	return ht.HistorySeekCtx(context.Background(), key, txNum, roTx)
+}
+
+// HistorySeekCtx - HistorySeek which checks `ctx` between file probes and returns ctx.Err() on cancellation
+func (ht *HistoryRoTx) HistorySeekCtx(ctx context.Context, key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
+	if txNum < ht.expiryHorizon() {
+		return nil, false, fmt.Errorf("%w: %s, txNum=%d, horizon=%d", ErrHistoryExpired, ht.h.filenameBase, txNum, ht.expiryHorizon())
+	}
+	if err := ht.checkPruned(txNum, roTx); err != nil {
+		return nil, false, err
+	}
+	if ht.readSource == ReadSourceDbOnly {
+		return ht.historySeekInDB(key, txNum, roTx)
+	}
+	v, ok, err := ht.historySeekInFilesCtx(ctx, key, txNum)
 	if err != nil {
 		return nil, ok, err
 	}
-	if ok {
-		return v, true, nil
+	if ok || ht.readSource == ReadSourceFilesOnly || roTx == nil { // nil - files only
+		return v, ok, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
 	}
 
 	return ht.historySeekInDB(key, txNum, roTx)
 }
 
+// checkPruned - ErrPrunedHistory if `txNum` is below files and below pruned boundary of DB.
+// Files usually start from txNum=0 - then it's just 1 comparison.
+func (ht *HistoryRoTx) checkPruned(txNum uint64, roTx kv.Tx) error {
+	if len(ht.files) > 0 && txNum >= ht.files[0].startTxNum {
+		return nil
+	}
+	if roTx == nil { // files only
+		return nil
+	}
+	prunedUpTo, err := readPrunedUpTo(roTx, ht.h.InvertedIndex.filenameBase)
+	if err != nil {
+		return err
+	}
+	if txNum < prunedUpTo {
+		return fmt.Errorf("%w: %s, txNum=%d, prunedUpTo=%d", ErrPrunedHistory, ht.h.filenameBase, txNum, prunedUpTo)
+	}
+	return nil
+}
+
+// HistoryQuery - see HistorySeekMany
+type HistoryQuery struct {
+	Key   []byte
+	TxNum uint64
+}
+
+// HistoryAnswer - same as results of HistorySeek: Found=true even if Value is empty (key was created at TxNum)
+type HistoryAnswer struct {
+	Value []byte
+	Found bool
+}
+
+// HistorySeekMany - batch version of HistorySeek. Answers are equal to calling HistorySeek for each query and aligned with `queries`.
+// Queries are sorted by (key, txNum) and each file is visited once for all queries which could live there:
+// queries of same key share 1 index lookup per file. Remaining queries are resolved by forward-only DB cursor seeks.
+func (ht *HistoryRoTx) HistorySeekMany(queries []HistoryQuery, roTx kv.Tx) ([]HistoryAnswer, error) {
+	horizon := ht.expiryHorizon()
+	for _, q := range queries {
+		if q.TxNum < horizon {
+			return nil, fmt.Errorf("%w: %s, txNum=%d, horizon=%d", ErrHistoryExpired, ht.h.filenameBase, q.TxNum, horizon)
+		}
+		if err := ht.checkPruned(q.TxNum, roTx); err != nil {
+			return nil, err
+		}
+	}
+	if ht.readSource != ReadSourceAuto { // debug mode: no reason to optimize
+		answers := make([]HistoryAnswer, len(queries))
+		for i, q := range queries {
+			v, ok, err := ht.HistorySeek(q.Key, q.TxNum, roTx)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = HistoryAnswer{Value: v, Found: ok}
+		}
+		return answers, nil
+	}
+	answers := make([]HistoryAnswer, len(queries))
+	sorted := make([]int, len(queries))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		qa, qb := &queries[sorted[a]], &queries[sorted[b]]
+		if c := bytes.Compare(qa.Key, qb.Key); c != 0 {
+			return c < 0
+		}
+		return qa.TxNum < qb.TxNum
+	})
+
+	// 1. files: oldest file first - same as seekInFiles. Query leaves `pending` in first file where index has txNum >= query.TxNum
+	inDB := make([]bool, len(queries))
+	pending := append(make([]int, 0, len(sorted)), sorted...)
+	for fi := 0; fi < len(ht.iit.files) && len(pending) > 0; fi++ {
+		endTxNum := ht.iit.files[fi].endTxNum
+		rest := pending[:0] // reuse: writes never overtake reads
+		var prevKey, eliasVal []byte
+		var keyInFile, looked bool
+		for _, qi := range pending {
+			q := &queries[qi]
+			if endTxNum <= q.TxNum {
+				rest = append(rest, qi)
+				continue
+			}
+			if !looked || !bytes.Equal(q.Key, prevKey) {
+				hi, lo := ht.iit.hashKey(q.Key)
+				eliasVal, keyInFile = ht.iit.efInFile(fi, q.Key, hi, lo)
+				prevKey, looked = q.Key, true
+			}
+			if !keyInFile {
+				rest = append(rest, qi)
+				continue
+			}
+			histTxNum, found := eliasfano32.Seek(eliasVal, q.TxNum)
+			if !found {
+				rest = append(rest, qi)
+				continue
+			}
+			v, ok, err := ht.historyValueInFiles(q.Key, q.TxNum, histTxNum)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				answers[qi] = HistoryAnswer{Value: v, Found: true}
+				continue
+			}
+			inDB[qi] = true
+		}
+		pending = rest
+	}
+	for _, qi := range pending {
+		inDB[qi] = true
+	}
+
+	// 2. db: in (key, txNum) order
+	for _, qi := range sorted {
+		if !inDB[qi] {
+			continue
+		}
+		v, ok, err := ht.historySeekInDB(queries[qi].Key, queries[qi].TxNum, roTx)
+		if err != nil {
+			return nil, err
+		}
+		answers[qi] = HistoryAnswer{Value: v, Found: ok}
+	}
+	return answers, nil
+}
+
+// expiryHorizon - history below this txNum was deleted by expiry. 0 - nothing expired
+func (ht *HistoryRoTx) expiryHorizon() uint64 {
+	if ht.noHistoryBefore > 0 {
+		return ht.noHistoryBefore
+	}
+	if ht.h.expiryKeepSteps == 0 || len(ht.files) == 0 {
+		return 0
+	}
+	return ht.files[0].startTxNum
+}
+
 func (ht *HistoryRoTx) valsCursor(tx kv.Tx) (c kv.Cursor, err error) {
 	if ht.valsC != nil {
 		return ht.valsC, nil
@@ -1617,7 +1920,7 @@ func (ht *HistoryRoTx) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By
 		return iter.EmptyKV, nil
 	}
 
-	if fromTxNum >= 0 && ht.iit.files.EndTxNum() <= uint64(fromTxNum) {
+	if fromTxNum >= 0 && ht.iit.files.dataEndTxNum() <= uint64(fromTxNum) {
 		return iter.EmptyKV, nil
 	}
 
@@ -1634,7 +1937,7 @@ func (ht *HistoryRoTx) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By
 		if fromTxNum >= 0 && item.endTxNum <= uint64(fromTxNum) {
 			continue
 		}
-		if toTxNum >= 0 && item.startTxNum >= uint64(toTxNum) {
+		if dataFrom, _ := item.src.dataRange(); toTxNum >= 0 && dataFrom >= uint64(toTxNum) {
 			break
 		}
 		g := NewArchiveGetter(item.src.decompressor.MakeGetter(), ht.h.compression)
@@ -1655,7 +1958,7 @@ func (ht *HistoryRoTx) iterateChangedRecent(fromTxNum, toTxNum int, asc order.By
 	if asc == order.Desc {
 		panic("not supported yet")
 	}
-	rangeIsInFiles := toTxNum >= 0 && len(ht.iit.files) > 0 && ht.iit.files.EndTxNum() >= uint64(toTxNum)
+	rangeIsInFiles := toTxNum >= 0 && len(ht.iit.files) > 0 && ht.iit.files.dataEndTxNum() >= uint64(toTxNum)
 	if rangeIsInFiles {
 		return iter.EmptyKVS, nil
 	}
@@ -1694,19 +1997,28 @@ func (ht *HistoryRoTx) HistoryRange(fromTxNum, toTxNum int, asc order.By, limit
 func (ht *HistoryRoTx) idxRangeRecent(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
 	var dbIt iter.U64
 	if ht.h.historyLargeValues {
-		from := make([]byte, len(key)+8)
-		copy(from, key)
-		var fromTxNum uint64
+		// keys are key+txNum: unbounded side is the first/last txNum of `key` in order of iteration
+		fromTxNum := uint64(0)
+		if !asc {
+			fromTxNum = math.MaxUint64
+		}
 		if startTxNum >= 0 {
 			fromTxNum = uint64(startTxNum)
 		}
+		from := make([]byte, len(key)+8)
+		copy(from, key)
 		binary.BigEndian.PutUint64(from[len(key):], fromTxNum)
-		to := common.Copy(from)
-		toTxNum := uint64(math.MaxUint64)
-		if endTxNum >= 0 {
-			toTxNum = uint64(endTxNum)
+		var to []byte
+		if endTxNum >= 0 || asc {
+			toTxNum := uint64(math.MaxUint64)
+			if endTxNum >= 0 {
+				toTxNum = uint64(endTxNum)
+			}
+			to = common.Copy(from)
+			binary.BigEndian.PutUint64(to[len(key):], toTxNum)
+		} else {
+			to = common.Copy(key) // lower than key+txNum of any txNum
 		}
-		binary.BigEndian.PutUint64(to[len(key):], toTxNum)
 		var it iter.KV
 		var err error
 		if asc {
@@ -1730,8 +2042,13 @@ func (ht *HistoryRoTx) idxRangeRecent(key []byte, startTxNum, endTxNum int, asc
 			binary.BigEndian.PutUint64(from, uint64(startTxNum))
 		}
 		if endTxNum >= 0 {
+			// values are txNum+val: they are bigger than `to` of same txNum - in Desc it must be txNum+1 to exclude endTxNum
+			toTxNum := uint64(endTxNum)
+			if !asc {
+				toTxNum++
+			}
 			to = make([]byte, 8)
-			binary.BigEndian.PutUint64(to, uint64(endTxNum))
+			binary.BigEndian.PutUint64(to, toTxNum)
 		}
 		it, err := roTx.RangeDupSort(ht.h.historyValsTable, key, from, to, asc, limit)
 		if err != nil {
@@ -1747,7 +2064,38 @@ func (ht *HistoryRoTx) idxRangeRecent(key []byte, startTxNum, endTxNum int, asc
 
 	return dbIt, nil
 }
+
+// IdxRange - txNums of changes of `key`. Bounds and limit semantic are same as of InvertedIndexRoTx.IdxRange
 func (ht *HistoryRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
+	empty, err := checkIdxRange(startTxNum, endTxNum, asc)
+	if err != nil {
+		return nil, err
+	}
+	if empty || limit == 0 {
+		return iter.EmptyU64, nil
+	}
+	if horizon := int(ht.expiryHorizon()); horizon > 0 {
+		// unbounded range starts at horizon, bounded one must not reach behind it
+		if asc {
+			if startTxNum < 0 {
+				startTxNum = horizon
+			} else if startTxNum < horizon {
+				return nil, fmt.Errorf("%w: %s, txNum=%d, horizon=%d", ErrHistoryExpired, ht.h.filenameBase, startTxNum, horizon)
+			}
+			if endTxNum >= 0 && endTxNum <= startTxNum {
+				return iter.EmptyU64, nil
+			}
+		} else {
+			if endTxNum < 0 { // desc lower bound is exclusive: (endTxNum, startTxNum]
+				endTxNum = horizon - 1
+			} else if endTxNum < horizon-1 {
+				return nil, fmt.Errorf("%w: %s, txNum=%d, horizon=%d", ErrHistoryExpired, ht.h.filenameBase, endTxNum+1, horizon)
+			}
+			if startTxNum >= 0 && startTxNum <= endTxNum {
+				return iter.EmptyU64, nil
+			}
+		}
+	}
 	frozenIt, err := ht.iit.iterateRangeFrozen(key, startTxNum, endTxNum, asc, limit)
 	if err != nil {
 		return nil, err
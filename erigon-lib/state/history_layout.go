@@ -0,0 +1,173 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/erigon-lib/seg"
+)
+
+// ConvertHistoryLayout - converts history of `domain` written with other `historyLargeValues` layout into layout of Aggregator's config:
+//
+//	largeValues=true:  historyValsTable: key+txNum -> value
+//	largeValues=false: historyValsTable: key -> txNum+value (DupSort)
+//
+// Layout affects only DB: .v/.ef files and their accessors are same in both layouts - so files are not rewritten, only
+// pairing of .v/.ef files is validated (file by file, with progress logs). Rows of unbuilt steps are migrated inside `rwTx`:
+// conversion is atomic with commit of `rwTx`. Rows already in target layout are skipped - interrupted or repeated run is safe.
+func (a *Aggregator) ConvertHistoryLayout(ctx context.Context, rwTx kv.RwTx, domain kv.Domain, tmpDir string) error {
+	if domain >= kv.DomainLen {
+		return fmt.Errorf("ConvertHistoryLayout: unknown domain %d", domain)
+	}
+	h := a.d[domain].History
+	if err := h.checkFilesPairing(ctx); err != nil {
+		return fmt.Errorf("ConvertHistoryLayout: %w", err)
+	}
+	if err := h.convertLayoutInDB(ctx, rwTx, tmpDir); err != nil {
+		return fmt.Errorf("ConvertHistoryLayout: %w", err)
+	}
+	return nil
+}
+
+// checkFilesPairing - amount of values in each .v file must be equal to amount of txNums in .ef file of same range
+func (h *History) checkFilesPairing(ctx context.Context) error {
+	var items []*filesItem
+	h.dirtyFiles.Walk(func(l []*filesItem) bool { // don't run slow logic while iterating on btree
+		items = append(items, l...)
+		return true
+	})
+	for i, item := range items {
+		if item.decompressor == nil {
+			continue
+		}
+		iiItem, ok := h.InvertedIndex.dirtyFiles.Get(&filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum})
+		if !ok || iiItem.decompressor == nil {
+			return fmt.Errorf("%s: no .ef file paired with %s", h.filenameBase, item.decompressor.FileName())
+		}
+		txNums, err := efTxNumsCount(ctx, iiItem.decompressor)
+		if err != nil {
+			return err
+		}
+		if uint64(item.decompressor.Count()) != txNums {
+			return fmt.Errorf("%s: %s has %d values, but %s has %d txNums", h.filenameBase, item.decompressor.FileName(), item.decompressor.Count(), iiItem.decompressor.FileName(), txNums)
+		}
+		h.logger.Info("[agg] history layout: file checked", "file", item.decompressor.FileName(), "values", txNums, "progress", fmt.Sprintf("%d/%d", i+1, len(items)))
+	}
+	return nil
+}
+
+func efTxNumsCount(ctx context.Context, efHist *seg.Decompressor) (txNums uint64, err error) {
+	defer efHist.EnableReadAhead().DisableReadAhead()
+	g := NewArchiveGetter(efHist.MakeGetter(), CompressNone)
+	var valBuf []byte
+	for g.HasNext() {
+		g.Skip() // key
+		valBuf, _ = g.Next(valBuf[:0])
+		ef, _ := eliasfano32.ReadEliasFano(valBuf)
+		txNums += ef.Count()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+	}
+	return txNums, nil
+}
+
+// convertLayoutInDB - rewrites rows of historyValsTable which are in other layout. Row is in other layout if it's
+// (key, txNum) pair exists in indexTable
+func (h *History) convertLayoutInDB(ctx context.Context, rwTx kv.RwTx, tmpDir string) error {
+	valsC, err := rwTx.Cursor(h.historyValsTable)
+	if err != nil {
+		return err
+	}
+	defer valsC.Close()
+	idxC, err := rwTx.CursorDupSort(h.indexTable)
+	if err != nil {
+		return err
+	}
+	defer idxC.Close()
+
+	drop := etl.NewCollector("convert layout drop "+h.historyValsTable, tmpDir, etl.NewSortableBuffer(WALCollectorRAM), h.logger).LogLvl(log.LvlTrace)
+	defer drop.Close()
+	converted := etl.NewCollector("convert layout "+h.historyValsTable, tmpDir, etl.NewSortableBuffer(WALCollectorRAM), h.logger).LogLvl(log.LvlTrace)
+	defer converted.Close()
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	var scanned, convertedRows uint64
+	var buf []byte
+	for k, v, err := valsC.First(); k != nil; k, v, err = valsC.Next() {
+		if err != nil {
+			return err
+		}
+		scanned++
+		var key, txNum, val []byte
+		if h.historyLargeValues { // other layout: key -> txNum+value
+			if len(v) < 8 {
+				continue
+			}
+			key, txNum, val = k, v[:8], v[8:]
+		} else { // other layout: key+txNum -> value
+			if len(k) <= 8 {
+				continue
+			}
+			key, txNum, val = k[:len(k)-8], k[len(k)-8:], v
+		}
+		found, _, err := idxC.SeekBothExact(key, txNum)
+		if err != nil {
+			return err
+		}
+		if found == nil { // already in target layout
+			continue
+		}
+
+		// deleting key removes all it's dups: all of them are in other layout
+		if err := drop.Collect(k, nil); err != nil {
+			return err
+		}
+		if h.historyLargeValues {
+			buf = append(append(buf[:0], key...), txNum...)
+			err = converted.Collect(buf, val)
+		} else {
+			buf = append(append(buf[:0], txNum...), val...)
+			err = converted.Collect(key, buf)
+		}
+		if err != nil {
+			return err
+		}
+		convertedRows++
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			h.logger.Info("[agg] history layout: converting", "table", h.historyValsTable, "scanned", scanned, "converted", convertedRows)
+		default:
+		}
+	}
+
+	if err := drop.Load(rwTx, h.historyValsTable, etl.IdentityLoadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		return err
+	}
+	var loaded uint64
+	countingLoadFunc := func(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		loaded++
+		return loadFunc(k, v, table, next)
+	}
+	if err := converted.Load(rwTx, h.historyValsTable, countingLoadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		return err
+	}
+	if loaded != convertedRows {
+		return fmt.Errorf("%s: converted %d rows, but loaded %d", h.historyValsTable, convertedRows, loaded)
+	}
+	h.logger.Info("[agg] history layout: converted", "table", h.historyValsTable, "largeValues", h.historyLargeValues, "scanned", scanned, "converted", convertedRows)
+	return nil
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+func TestHistoryConvertLayout(t *testing.T) {
+	historyState := func(t *testing.T, db kv.RwDB, h *History, txs uint64) (res []string) {
+		t.Helper()
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(t, err)
+		defer tx.Rollback()
+		hc := h.BeginFilesRo()
+		defer hc.Close()
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			k[0] = 1
+			for txNum := uint64(0); txNum <= txs; txNum += 7 {
+				v, ok, err := hc.HistorySeek(k[:], txNum, tx)
+				require.NoError(t, err)
+				res = append(res, fmt.Sprintf("seek %x %d: %x %t", k, txNum, v, ok))
+			}
+			it, err := hc.IdxRange(k[:], -1, -1, order.Asc, -1, tx)
+			require.NoError(t, err)
+			txNums, err := iter.ToArrayU64(it)
+			require.NoError(t, err)
+			res = append(res, fmt.Sprintf("idx %x: %v", k, txNums))
+		}
+		return res
+	}
+	convert := func(t *testing.T, db kv.RwDB, h *History) {
+		t.Helper()
+		rwTx, err := db.BeginRw(context.Background())
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		require.NoError(t, h.convertLayoutInDB(context.Background(), rwTx, t.TempDir()))
+		require.NoError(t, rwTx.Commit())
+	}
+	runTest := func(t *testing.T, fromLargeValues bool) {
+		db, h, txs := filledHistory(t, fromLargeValues, log.New())
+		before := historyState(t, db, h, txs)
+
+		h.historyLargeValues = !fromLargeValues
+		convert(t, db, h)
+		require.Equal(t, before, historyState(t, db, h, txs))
+
+		convert(t, db, h) // already converted rows are skipped
+		require.Equal(t, before, historyState(t, db, h, txs))
+
+		// files built from converted rows are same as built from original layout
+		collateAndMergeHistory(t, db, h, txs, false)
+		require.NoError(t, h.checkFilesPairing(context.Background()))
+		checkHistoryHistory(t, h, txs)
+	}
+	t.Run("largeValues=true to false", func(t *testing.T) {
+		runTest(t, true)
+	})
+	t.Run("largeValues=false to true", func(t *testing.T) {
+		runTest(t, false)
+	})
+}
+
+func TestAggregatorConvertHistoryLayout_UnknownDomain(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	rwTx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	require.Error(t, agg.ConvertHistoryLayout(context.Background(), rwTx, kv.DomainLen, t.TempDir()))
+	require.NoError(t, agg.ConvertHistoryLayout(context.Background(), rwTx, kv.AccountsDomain, t.TempDir()))
+}
@@ -20,8 +20,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"os"
 	"sort"
 	"strings"
@@ -496,6 +498,65 @@ func TestHistoryCanPrune(t *testing.T) {
 	})
 }
 
+func TestHistoryRetentionProvider(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+
+	db, h := testDbAndHistory(t, false, logger)
+	h.snapshotsDisabled = true
+	h.keepRecentTxnInDB = 0
+
+	var boundary uint64
+	var providerErr error
+	h.retentionProvider = func(tx kv.Tx) (uint64, error) { return boundary, providerErr }
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+
+	hc := h.BeginFilesRo()
+	defer hc.Close()
+	writer := hc.NewWriter()
+	defer writer.close()
+	addr := common.FromHex("ed7229d50cde8de174cc64a882a0833ca5f11669")
+	for txNum := uint64(0); txNum < 4*h.aggregationStep; txNum++ {
+		writer.SetTxNum(txNum)
+		require.NoError(t, writer.AddPrevValue(addr, nil, hexutility.EncodeTs(txNum), 0))
+	}
+	require.NoError(t, writer.Flush(ctx, rwTx))
+
+	prune := func(expectMinTxNum uint64) {
+		t.Helper()
+		_, err := hc.Prune(ctx, rwTx, 0, math.MaxUint64, math.MaxUint64, false, logEvery)
+		require.NoError(t, err)
+		require.Equal(t, expectMinTxNum, h.minTxNumInDB(rwTx))
+	}
+
+	boundary = 20
+	prune(20)
+
+	boundary = 40 // provider moves boundary forward
+	prune(40)
+
+	boundary = 10 // lower than already pruned: no-op
+	can, _ := hc.canPruneUntil(rwTx, math.MaxUint64)
+	require.False(t, can)
+	prune(40)
+
+	providerErr = errors.New("no finalized block")
+	boundary = 50
+	prune(40)
+	warnedAt := h.retentionErrLoggedAt.Load()
+	require.NotZero(t, warnedAt)
+	prune(40) // failing provider warns once per minute, not on every prune
+	require.Equal(t, warnedAt, h.retentionErrLoggedAt.Load())
+
+	providerErr = nil
+	prune(50)
+}
+
 func TestHistoryPruneCorrectnessWithFiles(t *testing.T) {
 	values := generateTestData(t, length.Addr, length.Addr, 1000, 1000, 1)
 	db, h := filledHistoryValues(t, true, values, log.New())
@@ -959,6 +1020,91 @@ func TestHistoryMergeFiles(t *testing.T) {
 	})
 }
 
+func randomHistoryQueries(rnd *rand.Rand, n int, txs uint64) []HistoryQuery {
+	queries := make([]HistoryQuery, n)
+	for i := range queries {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], uint64(rnd.Intn(40)+1)) // keys 32..40 don't exist
+		k[0] = 1
+		queries[i] = HistoryQuery{Key: k[:], TxNum: uint64(rnd.Int63n(int64(txs + 10)))}
+	}
+	return queries
+}
+
+func TestHistorySeekMany(t *testing.T) {
+	logger := log.New()
+	test := func(t *testing.T, h *History, db kv.RwDB, txs uint64) {
+		t.Helper()
+		require := require.New(t)
+		collateAndMergeHistory(t, db, h, txs, true)
+
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(err)
+		defer tx.Rollback()
+		hc := h.BeginFilesRo()
+		defer hc.Close()
+
+		rnd := rand.New(rand.NewSource(0))
+		for _, n := range []int{0, 1, 100, 2000} {
+			queries := randomHistoryQueries(rnd, n, txs)
+			answers, err := hc.HistorySeekMany(queries, tx)
+			require.NoError(err)
+			require.Len(answers, len(queries))
+			for i, q := range queries {
+				v, ok, err := hc.HistorySeek(q.Key, q.TxNum, tx)
+				require.NoError(err)
+				label := fmt.Sprintf("key=%x, txNum=%d", q.Key, q.TxNum)
+				require.Equal(ok, answers[i].Found, label)
+				require.Equal(v, answers[i].Value, label)
+			}
+		}
+	}
+	t.Run("large_values", func(t *testing.T) {
+		db, h, txs := filledHistory(t, true, logger)
+		test(t, h, db, txs)
+	})
+	t.Run("small_values", func(t *testing.T) {
+		db, h, txs := filledHistory(t, false, logger)
+		test(t, h, db, txs)
+	})
+}
+
+func BenchmarkHistorySeekMany(b *testing.B) {
+	db, h, txs := filledHistory(b, true, log.New())
+	collateAndMergeHistory(b, db, h, txs, true)
+	tx, err := db.BeginRo(context.Background())
+	require.NoError(b, err)
+	defer tx.Rollback()
+	queries := randomHistoryQueries(rand.New(rand.NewSource(0)), 5_000, txs)
+
+	b.Run("single", func(b *testing.B) {
+		hc := h.BeginFilesRo()
+		defer hc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, q := range queries {
+				if _, _, err := hc.HistorySeek(q.Key, q.TxNum, tx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(queries)), "ns/query")
+	})
+	b.Run("many", func(b *testing.B) {
+		hc := h.BeginFilesRo()
+		defer hc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := hc.HistorySeekMany(queries, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(queries)), "ns/query")
+	})
+}
+
 func TestHistoryScanFiles(t *testing.T) {
 	logger := log.New()
 	logEvery := time.NewTicker(30 * time.Second)
@@ -988,6 +1134,89 @@ func TestHistoryScanFiles(t *testing.T) {
 	})
 }
 
+func TestHistoryExpiry(t *testing.T) {
+	logger := log.New()
+	test := func(t *testing.T, h *History, db kv.RwDB, txs, keepSteps uint64) {
+		t.Helper()
+		require := require.New(t)
+
+		collateAndMergeHistory(t, db, h, txs, true)
+		hc := h.BeginFilesRo()
+		firstFile := hc.files[0]
+		lastFile := hc.files[len(hc.files)-1]
+		fromStep, toStep := firstFile.src.steps()
+		firstFile.src.frozen = true // expired frozen files are removed too
+		expiredFiles := []string{
+			h.vFilePath(fromStep, toStep), h.vFilePath(fromStep, toStep) + stepSizeSuffix,
+			h.efFilePath(fromStep, toStep), h.efFilePath(fromStep, toStep) + stepSizeSuffix,
+		}
+
+		// reader which is older than expiry holds files: they are removed when it's closed
+		h.expiryKeepSteps = keepSteps
+		require.True(h.deleteExpiredFiles())
+		h.reCalcVisibleFiles()
+		for _, f := range expiredFiles {
+			require.FileExists(f)
+		}
+		hc.Close()
+		for _, f := range expiredFiles {
+			require.NoFileExists(f)
+		}
+
+		horizon := lastFile.endTxNum - h.expiryKeepSteps*h.aggregationStep
+		hc = h.BeginFilesRo()
+		defer hc.Close()
+		require.LessOrEqual(hc.files[0].startTxNum, horizon)
+		require.Greater(hc.files[0].startTxNum, firstFile.startTxNum)
+
+		tx, err := db.BeginRo(context.Background())
+		require.NoError(err)
+		defer tx.Rollback()
+
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], 1)
+		k[0] = 0x01
+		_, _, err = hc.HistorySeek(k[:], firstFile.startTxNum+1, tx)
+		require.ErrorIs(err, ErrHistoryExpired)
+		_, err = hc.IdxRange(k[:], int(firstFile.startTxNum), -1, order.Asc, -1, tx)
+		require.ErrorIs(err, ErrHistoryExpired)
+		_, err = hc.IdxRange(k[:], -1, int(firstFile.startTxNum), order.Desc, -1, tx)
+		require.ErrorIs(err, ErrHistoryExpired)
+
+		// unbounded ranges are clamped to horizon
+		retained := hc.files[0].startTxNum
+		for _, asc := range []order.By{order.Asc, order.Desc} {
+			it, err := hc.IdxRange(k[:], -1, -1, asc, -1, tx)
+			require.NoError(err)
+			txNums, err := iter.ToArrayU64(it)
+			require.NoError(err)
+			for _, txNum := range txNums {
+				require.GreaterOrEqual(txNum, retained)
+			}
+		}
+
+		// history after horizon still readable
+		v, ok, err := hc.HistorySeek(k[:], lastFile.endTxNum-1, tx)
+		require.NoError(err)
+		require.True(ok)
+		require.NotNil(v)
+
+		// nothing left to expire
+		require.False(h.deleteExpiredFiles())
+	}
+
+	for _, keepSteps := range []uint64{8, 1} {
+		t.Run(fmt.Sprintf("large_values keep %d", keepSteps), func(t *testing.T) {
+			db, h, txs := filledHistory(t, true, logger)
+			test(t, h, db, txs, keepSteps)
+		})
+		t.Run(fmt.Sprintf("small_values keep %d", keepSteps), func(t *testing.T) {
+			db, h, txs := filledHistory(t, false, logger)
+			test(t, h, db, txs, keepSteps)
+		})
+	}
+}
+
 func TestIterateChanged(t *testing.T) {
 	logger := log.New()
 	logEvery := time.NewTicker(30 * time.Second)
@@ -45,6 +45,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
 	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
@@ -90,6 +91,13 @@ type InvertedIndex struct {
 	compression     FileCompression
 	compressWorkers int
 	indexList       idxList
+
+	// emptySteps - steps without files of Domain which owns this index, see emptySteps. nil for standalone indices
+	emptySteps *emptySteps
+
+	// onMergeTmpSize - size changes of temporary files of merge (also of History and Domain which own this index), see
+	// Aggregator.addMergeDiskInFlight
+	onMergeTmpSize func(delta int64)
 }
 
 type iiCfg struct {
@@ -200,8 +208,10 @@ func (ii *InvertedIndex) scanStateFiles(fileNames []string) (garbageFiles []*fil
 			continue
 		}
 
-		startTxNum, endTxNum := startStep*ii.aggregationStep, endStep*ii.aggregationStep
-		var newFile = newFilesItem(startTxNum, endTxNum, ii.aggregationStep)
+		stepSize, recorded := recordedStepSize(ii.efFilePath(startStep, endStep), ii.aggregationStep, ii.logger)
+		startTxNum, endTxNum := startStep*stepSize, endStep*stepSize
+		var newFile = newFilesItem(startTxNum, endTxNum, stepSize)
+		newFile.stepSizeUnknown = !recorded
 
 		if ii.integrityCheck != nil && !ii.integrityCheck(startStep, endStep) {
 			ii.logger.Debug("[agg] skip garbage file", "name", name)
@@ -232,7 +242,7 @@ func (ii *InvertedIndex) reCalcVisibleFiles() {
 func (ii *InvertedIndex) missedAccessors() (l []*filesItem) {
 	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
+			fromStep, toStep := item.steps()
 			exists, err := dir.FileExist(ii.efAccessorFilePath(fromStep, toStep))
 			if err != nil {
 				_, fName := filepath.Split(ii.efAccessorFilePath(fromStep, toStep))
@@ -251,7 +261,7 @@ func (ii *InvertedIndex) buildEfAccessor(ctx context.Context, item *filesItem, p
 	if item.decompressor == nil {
 		return fmt.Errorf("buildEfAccessor: passed item with nil decompressor %s %d-%d", ii.filenameBase, item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep)
 	}
-	fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
+	fromStep, toStep := item.steps()
 	return ii.buildMapAccessor(ctx, fromStep, toStep, item.decompressor, ps)
 }
 
@@ -260,7 +270,7 @@ func (ii *InvertedIndex) BuildMissedAccessors(ctx context.Context, g *errgroup.G
 	for _, item := range ii.missedAccessors() {
 		item := item
 		g.Go(func() error {
-			return ii.buildEfAccessor(ctx, item, ps)
+			return indexBuildFailed(item, ii.buildEfAccessor(ctx, item, ps))
 		})
 	}
 
@@ -272,7 +282,7 @@ func (ii *InvertedIndex) openFiles() error {
 	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			item := item
-			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
+			fromStep, toStep := item.steps()
 			if item.decompressor == nil {
 				fPath := ii.efFilePath(fromStep, toStep)
 				exists, err := dir.FileExist(fPath)
@@ -435,6 +445,10 @@ func (w *invertedIndexBufferedWriter) close() {
 var WALCollectorRAM = dbg.EnvDataSize("AGG_WAL_RAM", etl.BufferOptimalSize/8)
 var CollateETLRAM = dbg.EnvDataSize("AGG_COLLATE_RAM", etl.BufferOptimalSize/4)
 
+// CollateIIETLRAM - of inverted index collation. Separated from CollateETLRAM (history collation): key cardinality is very
+// different - millions of distinct log topics/addresses with few txNums each per step. 1/4 of it is used by iiCollateBatch
+var CollateIIETLRAM = dbg.EnvDataSize("AGG_COLLATE_II_RAM", etl.BufferOptimalSize/4)
+
 func (iit *InvertedIndexRoTx) newWriter(tmpdir string, discard bool) *invertedIndexBufferedWriter {
 	w := &invertedIndexBufferedWriter{
 		discard:         discard,
@@ -468,16 +482,19 @@ func (w *invertedIndexBufferedWriter) add(key, indexKey []byte) error {
 
 func (ii *InvertedIndex) BeginFilesRo() *InvertedIndexRoTx {
 	files := ii._visibleFiles
-	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
-	}
+	files.refAll()
 	return &InvertedIndexRoTx{
 		ii:    ii,
 		files: files,
 	}
 }
+
+// clone - see AggregatorRoTx.Clone
+func (iit *InvertedIndexRoTx) clone() *InvertedIndexRoTx {
+	iit.files.refAll()
+	return &InvertedIndexRoTx{ii: iit.ii, files: iit.files}
+}
+
 func (iit *InvertedIndexRoTx) Close() {
 	if iit.files == nil { // invariant: it's safe to call Close multiple times
 		return
@@ -486,7 +503,7 @@ func (iit *InvertedIndexRoTx) Close() {
 	iit.files = nil
 	for i := 0; i < len(files); i++ {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -561,40 +578,70 @@ func (iit *InvertedIndexRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
 }
 
 func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool, equalOrHigherTxNum uint64) {
+	found, equalOrHigherTxNum, _ = iit.seekInFilesCtx(context.Background(), key, txNum)
+	return found, equalOrHigherTxNum
+}
+
+// seekInFilesCtx - seekInFiles which checks `ctx` before each file probe
+func (iit *InvertedIndexRoTx) seekInFilesCtx(ctx context.Context, key []byte, txNum uint64) (found bool, equalOrHigherTxNum uint64, err error) {
 	hi, lo := iit.hashKey(key)
 
 	for i := 0; i < len(iit.files); i++ {
 		if iit.files[i].endTxNum <= txNum {
 			continue
 		}
-		offset, ok := iit.statelessIdxReader(i).TwoLayerLookupByHash(hi, lo)
-		if !ok {
-			continue
+		if err := ctx.Err(); err != nil {
+			return false, 0, err
 		}
-
-		g := iit.statelessGetter(i)
-		g.Reset(offset)
-		k, _ := g.Next(nil)
-		if !bytes.Equal(k, key) {
+		eliasVal, ok := iit.efInFile(i, key, hi, lo)
+		if !ok {
 			continue
 		}
-		eliasVal, _ := g.Next(nil)
 		equalOrHigherTxNum, found = eliasfano32.Seek(eliasVal, txNum)
 
 		if found {
-			return true, equalOrHigherTxNum
+			return true, equalOrHigherTxNum, nil
 		}
 	}
-	return false, 0
+	return false, 0, nil
+}
+
+// efInFile - elias-fano list of txNums of `key` in i-th file. hi, lo - see hashKey
+func (iit *InvertedIndexRoTx) efInFile(i int, key []byte, hi, lo uint64) (eliasVal []byte, ok bool) {
+	offset, ok := iit.statelessIdxReader(i).TwoLayerLookupByHash(hi, lo)
+	if !ok {
+		return nil, false
+	}
+	g := iit.statelessGetter(i)
+	g.Reset(offset)
+	k, _ := g.Next(nil)
+	if !bytes.Equal(k, key) {
+		return nil, false
+	}
+	eliasVal, _ = g.Next(nil)
+	return eliasVal, true
 }
 
 // IdxRange - return range of txNums for given `key`
 // is to be used in public API, therefore it relies on read-only transaction
 // so that iteration can be done even when the inverted index is being updated.
-// [startTxNum; endNumTx)
-
+//
+// Bounds are same for files and DB: `startTxNum` is inclusive, `endTxNum` is exclusive - in order of iteration:
+//   - Asc:  [startTxNum, endTxNum) AND startTxNum <= endTxNum
+//   - Desc: (endTxNum, startTxNum] AND startTxNum >= endTxNum
+//
+// -1 means unbounded (StartOfTable/EndOfTable in order of iteration). `limit` is applied to merged stream of files
+// and DB (each source is limited too: merged stream can't take more than `limit` from one of them). Limit -1 means Unlimited
+//
 // todo IdxRange operates over ii.indexTable . Passing `nil` as a key will not return all keys
 func (iit *InvertedIndexRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
+	empty, err := checkIdxRange(startTxNum, endTxNum, asc)
+	if err != nil {
+		return nil, err
+	}
+	if empty || limit == 0 {
+		return iter.EmptyU64, nil
+	}
 	frozenIt, err := iit.iterateRangeFrozen(key, startTxNum, endTxNum, asc, limit)
 	if err != nil {
 		return nil, err
@@ -609,12 +656,13 @@ func (iit *InvertedIndexRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc
 func (iit *InvertedIndexRoTx) recentIterateRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.U64, error) {
 	//optimization: return empty pre-allocated iterator if range is frozen
 	if asc {
-		isFrozenRange := len(iit.files) > 0 && endTxNum >= 0 && iit.files.EndTxNum() >= uint64(endTxNum)
+		isFrozenRange := len(iit.files) > 0 && endTxNum >= 0 && iit.files.dataEndTxNum() >= uint64(endTxNum)
 		if isFrozenRange {
 			return iter.EmptyU64, nil
 		}
 	} else {
-		isFrozenRange := len(iit.files) > 0 && startTxNum >= 0 && iit.files.EndTxNum() >= uint64(startTxNum)
+		// startTxNum is inclusive: it's in files only if files end after it
+		isFrozenRange := len(iit.files) > 0 && startTxNum >= 0 && iit.files.dataEndTxNum() > uint64(startTxNum)
 		if isFrozenRange {
 			return iter.EmptyU64, nil
 		}
@@ -640,17 +688,22 @@ func (iit *InvertedIndexRoTx) recentIterateRange(key []byte, startTxNum, endTxNu
 	}), nil
 }
 
-// IdxRange is to be used in public API, therefore it relies on read-only transaction
-// so that iteration can be done even when the inverted index is being updated.
-// [startTxNum; endNumTx)
-func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNum int, asc order.By, limit int) (*FrozenInvertedIdxIter, error) {
-	if asc && (startTxNum >= 0 && endTxNum >= 0) && startTxNum > endTxNum {
-		return nil, fmt.Errorf("startTxNum=%d epected to be lower than endTxNum=%d", startTxNum, endTxNum)
+// checkIdxRange - validates order of IdxRange bounds. empty=true for range without txNums: [n, n)
+func checkIdxRange(startTxNum, endTxNum int, asc order.By) (empty bool, err error) {
+	if startTxNum < 0 || endTxNum < 0 {
+		return false, nil
 	}
-	if !asc && (startTxNum >= 0 && endTxNum >= 0) && startTxNum < endTxNum {
-		return nil, fmt.Errorf("startTxNum=%d epected to be bigger than endTxNum=%d", startTxNum, endTxNum)
+	if asc && startTxNum > endTxNum {
+		return false, fmt.Errorf("startTxNum=%d expected to be lower than endTxNum=%d", startTxNum, endTxNum)
 	}
+	if !asc && startTxNum < endTxNum {
+		return false, fmt.Errorf("startTxNum=%d expected to be bigger than endTxNum=%d", startTxNum, endTxNum)
+	}
+	return startTxNum == endTxNum, nil
+}
 
+// iterateRangeFrozen - files part of IdxRange, bounds must be checked by checkIdxRange
+func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNum int, asc order.By, limit int) (*FrozenInvertedIdxIter, error) {
 	it := &FrozenInvertedIdxIter{
 		key:         key,
 		startTxNum:  startTxNum,
@@ -663,7 +716,7 @@ func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNu
 	if asc {
 		for i := len(iit.files) - 1; i >= 0; i-- {
 			// [from,to) && from < to
-			if endTxNum >= 0 && int(iit.files[i].startTxNum) >= endTxNum {
+			if dataFrom, _ := iit.files[i].src.dataRange(); endTxNum >= 0 && int(dataFrom) >= endTxNum {
 				continue
 			}
 			if startTxNum >= 0 && iit.files[i].endTxNum <= uint64(startTxNum) {
@@ -683,7 +736,7 @@ func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNu
 			if endTxNum >= 0 && int(iit.files[i].endTxNum) <= endTxNum {
 				continue
 			}
-			if startTxNum >= 0 && iit.files[i].startTxNum > uint64(startTxNum) {
+			if dataFrom, _ := iit.files[i].src.dataRange(); startTxNum >= 0 && dataFrom > uint64(startTxNum) {
 				break
 			}
 			if iit.files[i].src.index == nil { // assert
@@ -722,7 +775,7 @@ func (ii *InvertedIndex) maxTxNumInDB(tx kv.Tx) uint64 {
 }
 
 func (iit *InvertedIndexRoTx) CanPrune(tx kv.Tx) bool {
-	return iit.ii.minTxNumInDB(tx) < iit.files.EndTxNum()
+	return iit.ii.minTxNumInDB(tx) < iit.files.dataEndTxNum()
 }
 
 func (iit *InvertedIndexRoTx) canBuild(dbtx kv.Tx) bool { //nolint
@@ -779,78 +832,142 @@ func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, t
 	if !forced && !iit.CanPrune(rwTx) {
 		return stat, nil
 	}
+	if !forced {
+		txTo = min(txTo, iit.files.dataEndTxNum())
+	}
 
 	mxPruneInProgress.Inc()
 	defer mxPruneInProgress.Dec()
 	defer func(t time.Time) { mxPruneTookIndex.ObserveDuration(t) }(time.Now())
 
+	j := iit.newPruneJob(txFrom, txTo, limit)
+	defer j.close()
+	if err = j.collect(ctx, rwTx); err != nil {
+		return nil, err
+	}
+	if err = j.applyFn(ctx, rwTx, logEvery, fn); err != nil {
+		return nil, err
+	}
+	return j.stat, nil
+}
+
+// iiPruneJob - InvertedIndexRoTx.Prune split in 2 phases, see pruneJob.
+// collect: read-only walk of `indexKeysTable`, index entries to delete are sorted by etl.
+// apply: deletes collected entries from `indexTable` (calling `history` for each of them) and their txNums from `indexKeysTable`.
+type iiPruneJob struct {
+	iit                 *InvertedIndexRoTx
+	history             *HistoryRoTx // not nil: prune also values of history - see HistoryRoTx.valuesPruner
+	txFrom, txTo, limit uint64
+	skip                bool // CanPrune=false
+
+	collector  *etl.Collector
+	stat       *InvertedIndexPruneStat
+	prunedUpTo uint64 // all txNums < prunedUpTo are pruned after apply. See savePrunedUpTo
+}
+
+func (iit *InvertedIndexRoTx) newPruneJob(txFrom, txTo, limit uint64) *iiPruneJob {
 	if limit == 0 { // limits amount of Tx to be pruned
 		limit = math.MaxUint64
 	}
+	return &iiPruneJob{iit: iit, txFrom: txFrom, txTo: txTo, limit: limit, stat: &InvertedIndexPruneStat{MinTxNum: math.MaxUint64}}
+}
 
-	ii := iit.ii
-	//defer func() {
-	//	ii.logger.Error("[snapshots] prune index",
-	//		"name", ii.filenameBase,
-	//		"forced", forced,
-	//		"pruned tx", fmt.Sprintf("%.2f-%.2f", float64(minTxnum)/float64(iit.ii.aggregationStep), float64(maxTxnum)/float64(iit.ii.aggregationStep)),
-	//		"pruned values", pruneCount,
-	//		"tx until limit", limit)
-	//}()
+// pruneJob - job of Prune with forced=false. `tx` is used only for CanPrune check
+func (iit *InvertedIndexRoTx) pruneJob(tx kv.Tx, txFrom, txTo, limit uint64) *iiPruneJob {
+	j := iit.newPruneJob(txFrom, min(txTo, iit.files.dataEndTxNum()), limit)
+	j.skip = !iit.CanPrune(tx)
+	return j
+}
 
-	keysCursor, err := rwTx.CursorDupSort(ii.indexKeysTable)
-	if err != nil {
-		return stat, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
+func (j *iiPruneJob) collect(ctx context.Context, tx kv.Tx) error {
+	if j.skip {
+		return nil
 	}
-	defer keysCursor.Close()
-	idxDelCursor, err := rwTx.RwCursorDupSort(ii.indexTable)
+	ii := j.iit.ii
+	keysCursor, err := tx.CursorDupSort(ii.indexKeysTable)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
-	defer idxDelCursor.Close()
+	defer keysCursor.Close()
 
-	collector := etl.NewCollector("prune idx "+ii.filenameBase, ii.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize/8), ii.logger)
-	defer collector.Close()
-	collector.LogLvl(log.LvlDebug)
-	collector.SortAndFlushInBackground(true)
+	j.collector = etl.NewCollector("prune idx "+ii.filenameBase, ii.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize/8), ii.logger)
+	j.collector.LogLvl(log.LvlDebug)
+	j.collector.SortAndFlushInBackground(true)
 
 	var txKey [8]byte
-	binary.BigEndian.PutUint64(txKey[:], txFrom)
+	binary.BigEndian.PutUint64(txKey[:], j.txFrom)
 
 	// Invariant: if some `txNum=N` pruned - it's pruned Fully
 	// Means: can use DeleteCurrentDuplicates all values of given `txNum`
+	limit := j.limit
+	j.prunedUpTo = j.txTo
 	for k, v, err := keysCursor.Seek(txKey[:]); k != nil; k, v, err = keysCursor.NextNoDup() {
 		if err != nil {
-			return nil, fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
+			return fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
 		}
 
 		txNum := binary.BigEndian.Uint64(k)
-		if txNum >= txTo || limit == 0 {
+		if txNum >= j.txTo {
+			break
+		}
+		if limit == 0 {
+			j.prunedUpTo = txNum
 			break
 		}
-		if asserts && txNum < txFrom {
-			panic(fmt.Errorf("assert: index pruning txn=%d [%d-%d)", txNum, txFrom, txTo))
+		if asserts && txNum < j.txFrom {
+			panic(fmt.Errorf("assert: index pruning txn=%d [%d-%d)", txNum, j.txFrom, j.txTo))
 		}
 
 		limit--
-		stat.MinTxNum = min(stat.MinTxNum, txNum)
-		stat.MaxTxNum = max(stat.MaxTxNum, txNum)
+		j.stat.MinTxNum = min(j.stat.MinTxNum, txNum)
+		j.stat.MaxTxNum = max(j.stat.MaxTxNum, txNum)
 
 		for ; v != nil; _, v, err = keysCursor.NextDup() {
 			if err != nil {
-				return nil, fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
+				return fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
 			}
-			if err := collector.Collect(v, k); err != nil {
-				return nil, err
+			if err := j.collector.Collect(v, k); err != nil {
+				return err
 			}
 		}
 
 		if ctx.Err() != nil {
-			return nil, ctx.Err()
+			return ctx.Err()
 		}
 	}
+	return nil
+}
 
-	err = collector.Load(nil, "", func(key, txnm []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+func (j *iiPruneJob) apply(ctx context.Context, rwTx kv.RwTx, logEvery *time.Ticker) error {
+	if j.skip {
+		return nil
+	}
+	mxPruneInProgress.Inc()
+	defer mxPruneInProgress.Dec()
+	defer func(t time.Time) { mxPruneTookIndex.ObserveDuration(t) }(time.Now())
+
+	var fn func(key []byte, txnum []byte) error
+	if j.history != nil {
+		defer func(t time.Time) { mxPruneTookHistory.ObserveDuration(t) }(time.Now())
+		var closeFn func()
+		var err error
+		if fn, closeFn, err = j.history.valuesPruner(rwTx, j.txFrom, j.txTo); err != nil {
+			return err
+		}
+		defer closeFn()
+	}
+	return j.applyFn(ctx, rwTx, logEvery, fn)
+}
+
+func (j *iiPruneJob) applyFn(ctx context.Context, rwTx kv.RwTx, logEvery *time.Ticker, fn func(key []byte, txnum []byte) error) error {
+	ii, stat := j.iit.ii, j.stat
+	idxDelCursor, err := rwTx.RwCursorDupSort(ii.indexTable)
+	if err != nil {
+		return err
+	}
+	defer idxDelCursor.Close()
+
+	err = j.collector.Load(nil, "", func(key, txnm []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
 		if fn != nil {
 			if err = fn(key, txnm); err != nil {
 				return fmt.Errorf("fn error: %w", err)
@@ -867,30 +984,69 @@ func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, t
 			txNum := binary.BigEndian.Uint64(txnm)
 			ii.logger.Info("[snapshots] prune index", "name", ii.filenameBase, "pruned tx", stat.PruneCountTx,
 				"pruned values", stat.PruneCountValues,
-				"steps", fmt.Sprintf("%.2f-%.2f", float64(txFrom)/float64(ii.aggregationStep), float64(txNum)/float64(ii.aggregationStep)))
+				"steps", fmt.Sprintf("%.2f-%.2f", float64(j.txFrom)/float64(ii.aggregationStep), float64(txNum)/float64(ii.aggregationStep)))
 		default:
 		}
 		return nil
 	}, etl.TransformArgs{Quit: ctx.Done()})
 
 	if stat.MinTxNum != math.MaxUint64 {
+		keysCursor, err := rwTx.CursorDupSort(ii.indexKeysTable)
+		if err != nil {
+			return fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
+		}
+		defer keysCursor.Close()
+		var txKey [8]byte
 		binary.BigEndian.PutUint64(txKey[:], stat.MinTxNum)
 		// This deletion iterator goes last to preserve invariant: if some `txNum=N` pruned - it's pruned Fully
 		for txnb, _, err := keysCursor.Seek(txKey[:]); txnb != nil; txnb, _, err = keysCursor.NextNoDup() {
 			if err != nil {
-				return nil, fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
+				return fmt.Errorf("iterate over %s index keys: %w", ii.filenameBase, err)
 			}
 			if binary.BigEndian.Uint64(txnb) > stat.MaxTxNum {
 				break
 			}
 			stat.PruneCountTx++
 			if err = rwTx.Delete(ii.indexKeysTable, txnb); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
+	if err != nil {
+		return err
+	}
+	return j.savePrunedUpTo(rwTx)
+}
 
-	return stat, err
+// savePrunedUpTo - moves pruned boundary forward. Only prune which started below boundary can move it:
+// forced prune of unwind deletes recent txNums - and older data is still in DB.
+func (j *iiPruneJob) savePrunedUpTo(rwTx kv.RwTx) error {
+	prunedUpTo, err := readPrunedUpTo(rwTx, j.iit.ii.filenameBase)
+	if err != nil {
+		return err
+	}
+	if j.txFrom > prunedUpTo || j.prunedUpTo <= prunedUpTo {
+		return nil
+	}
+	return rwTx.Put(kv.TblPrunedUpTo, []byte(j.iit.ii.filenameBase), hexutility.EncodeTs(j.prunedUpTo))
+}
+
+// readPrunedUpTo - all data of txNum < prunedUpTo is pruned from DB. 0 - nothing pruned yet
+func readPrunedUpTo(tx kv.Getter, filenameBase string) (prunedUpTo uint64, err error) {
+	v, err := tx.GetOne(kv.TblPrunedUpTo, []byte(filenameBase))
+	if err != nil {
+		return 0, err
+	}
+	if len(v) < 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func (j *iiPruneJob) close() {
+	if j.collector != nil {
+		j.collector.Close()
+	}
 }
 
 func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, failFast bool, fromStep uint64) error {
@@ -901,6 +1057,7 @@ func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, fa
 		g := item.src.decompressor.MakeGetter()
 		g.Reset(0)
 		defer item.src.decompressor.EnableReadAhead().DisableReadAhead()
+		dataFrom, dataTo := item.src.dataRange()
 
 		for g.HasNext() {
 			k, _ := g.NextUncompressed()
@@ -910,16 +1067,16 @@ func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, fa
 			if ef.Count() == 0 {
 				continue
 			}
-			if item.startTxNum > ef.Min() {
-				err := fmt.Errorf("[integrity] .ef file has foreign txNum: %d > %d, %s, %x", item.startTxNum, ef.Min(), g.FileName(), common.Shorten(k, 8))
+			if dataFrom > ef.Min() {
+				err := fmt.Errorf("[integrity] .ef file has foreign txNum: %d > %d, %s, %x", dataFrom, ef.Min(), g.FileName(), common.Shorten(k, 8))
 				if failFast {
 					return err
 				} else {
 					log.Warn(err.Error())
 				}
 			}
-			if item.endTxNum < ef.Max() {
-				err := fmt.Errorf("[integrity] .ef file has foreign txNum: %d < %d, %s, %x", item.endTxNum, ef.Max(), g.FileName(), common.Shorten(k, 8))
+			if dataTo < ef.Max() {
+				err := fmt.Errorf("[integrity] .ef file has foreign txNum: %d < %d, %s, %x", dataTo, ef.Max(), g.FileName(), common.Shorten(k, 8))
 				if failFast {
 					return err
 				} else {
@@ -1382,8 +1539,12 @@ func (iit *InvertedIndexRoTx) IterateChangedKeys(startTxNum, endTxNum uint64, ro
 
 // collate [stepFrom, stepTo)
 func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (InvertedIndexCollation, error) {
+	return ii.collateRange(ctx, step, step*ii.aggregationStep, (step+1)*ii.aggregationStep, roTx)
+}
+
+// collateRange - collate of `step` which has txNums [txFrom; txTo). See Aggregator.SetBlockAlignedSteps
+func (ii *InvertedIndex) collateRange(ctx context.Context, step, txFrom, txTo uint64, roTx kv.Tx) (InvertedIndexCollation, error) {
 	stepTo := step + 1
-	txFrom, txTo := step*ii.aggregationStep, stepTo*ii.aggregationStep
 	start := time.Now()
 	defer mxCollateTookIndex.ObserveDuration(start)
 
@@ -1393,10 +1554,11 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 	}
 	defer keysCursor.Close()
 
-	collector := etl.NewCollector("collate idx "+ii.filenameBase, ii.iiCfg.dirs.Tmp, etl.NewSortableBuffer(CollateETLRAM), ii.logger)
+	collector := etl.NewCollector("collate idx "+ii.filenameBase, ii.iiCfg.dirs.Tmp, etl.NewSortableBuffer(CollateIIETLRAM), ii.logger)
 	defer collector.Close()
 	collector.LogLvl(log.LvlTrace)
 
+	batch := newIICollateBatch(int(CollateIIETLRAM.Bytes() / 4))
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 
@@ -1408,8 +1570,11 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		if txNum >= txTo { // [txFrom; txTo)
 			break
 		}
-		if err := collector.Collect(v, k); err != nil {
-			return InvertedIndexCollation{}, fmt.Errorf("collect %s history key [%x]=>txn %d [%x]: %w", ii.filenameBase, k, txNum, k, err)
+		batch.add(v, txNum)
+		if batch.full() {
+			if err := batch.flush(collector); err != nil {
+				return InvertedIndexCollation{}, fmt.Errorf("collect %s keys of txn %d: %w", ii.filenameBase, txNum, err)
+			}
 		}
 		select {
 		case <-ctx.Done():
@@ -1417,6 +1582,9 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		default:
 		}
 	}
+	if err := batch.flush(collector); err != nil {
+		return InvertedIndexCollation{}, fmt.Errorf("collect %s keys: %w", ii.filenameBase, err)
+	}
 
 	var (
 		coll = InvertedIndexCollation{
@@ -1434,6 +1602,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 	if err != nil {
 		return InvertedIndexCollation{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
 	}
+	setDataRange(comp, step, stepTo, ii.aggregationStep, txFrom, txTo)
 	coll.writer = NewArchiveWriter(comp, ii.compression)
 
 	var (
@@ -1444,19 +1613,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 	)
 	defer bitmapdb.ReturnToPool64(bitmap)
 
-	loadBitmapsFunc := func(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
-		txNum := binary.BigEndian.Uint64(v)
-		if !initialized {
-			prevKey = append(prevKey[:0], k...)
-			initialized = true
-		}
-
-		if bytes.Equal(prevKey, k) {
-			bitmap.Add(txNum)
-			prevKey = append(prevKey[:0], k...)
-			return nil
-		}
-
+	writeEf := func() error {
 		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
 		it := bitmap.Iterator()
 		for it.HasNext() {
@@ -1473,11 +1630,24 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		if err = coll.writer.AddWord(prevEf); err != nil {
 			return fmt.Errorf("add %s efi index val: %w", ii.filenameBase, err)
 		}
+		return nil
+	}
 
-		prevKey = append(prevKey[:0], k...)
-		txNum = binary.BigEndian.Uint64(v)
-		bitmap.Add(txNum)
-
+	// v - txNums of key `k` from one batch, big-endian. Same key can come from several batches
+	loadBitmapsFunc := func(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		if !initialized {
+			prevKey = append(prevKey[:0], k...)
+			initialized = true
+		}
+		if !bytes.Equal(prevKey, k) {
+			if err := writeEf(); err != nil {
+				return err
+			}
+			prevKey = append(prevKey[:0], k...)
+		}
+		for ; len(v) >= 8; v = v[8:] {
+			bitmap.Add(binary.BigEndian.Uint64(v))
+		}
 		return nil
 	}
 
@@ -1486,7 +1656,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		return InvertedIndexCollation{}, err
 	}
 	if !bitmap.IsEmpty() {
-		if err = loadBitmapsFunc(nil, make([]byte, 8), nil, nil); err != nil {
+		if err = writeEf(); err != nil {
 			return InvertedIndexCollation{}, err
 		}
 	}
@@ -1495,6 +1665,58 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 	return coll, nil
 }
 
+// iiCollateBatch - groups txNums of same key before etl: 1 Collect per key per batch instead of 1 per (key, txNum).
+// Keys are interned in `slots` until flush; key and txNums buffers of slots are reused by next batches of step
+type iiCollateBatch struct {
+	slots  map[string]int // key -> index in keys/txNums
+	keys   [][]byte
+	txNums [][]uint64 // txNums[i] - of keys[i], ascending
+	used   int        // slots in use, len(keys) - allocated
+	size   int        // approximate RAM of used slots
+	limit  int
+	val    []byte
+}
+
+func newIICollateBatch(limit int) *iiCollateBatch {
+	return &iiCollateBatch{slots: map[string]int{}, limit: limit}
+}
+
+func (b *iiCollateBatch) add(k []byte, txNum uint64) {
+	i, ok := b.slots[string(k)]
+	if !ok {
+		i = b.used
+		b.used++
+		b.slots[string(k)] = i
+		if i == len(b.keys) {
+			b.keys = append(b.keys, nil)
+			b.txNums = append(b.txNums, nil)
+		}
+		b.keys[i] = append(b.keys[i][:0], k...)
+		b.size += 2*len(k) + 64 // interned key, key buffer, map entry and slot headers
+	}
+	b.txNums[i] = append(b.txNums[i], txNum)
+	b.size += 8
+}
+
+func (b *iiCollateBatch) full() bool { return b.size >= b.limit }
+
+// flush - 1 etl entry per key: key => its txNums, big-endian
+func (b *iiCollateBatch) flush(collector *etl.Collector) error {
+	for i := 0; i < b.used; i++ {
+		b.val = b.val[:0]
+		for _, txNum := range b.txNums[i] {
+			b.val = binary.BigEndian.AppendUint64(b.val, txNum)
+		}
+		if err := collector.Collect(b.keys[i], b.val); err != nil {
+			return err
+		}
+		b.txNums[i] = b.txNums[i][:0]
+	}
+	clear(b.slots)
+	b.used, b.size = 0, 0
+	return nil
+}
+
 type InvertedFiles struct {
 	decomp    *seg.Decompressor
 	index     *recsplit.Index
@@ -1566,6 +1788,9 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, coll Inver
 	if decomp, err = seg.NewDecompressor(coll.iiPath); err != nil {
 		return InvertedFiles{}, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
 	}
+	if err = writeStepSize(coll.iiPath, ii.aggregationStep, ii.noFsync); err != nil {
+		return InvertedFiles{}, fmt.Errorf("write %s step size: %w", ii.filenameBase, err)
+	}
 
 	if err := ii.buildMapAccessor(ctx, step, step+1, decomp, ps); err != nil {
 		return InvertedFiles{}, fmt.Errorf("build %s efi: %w", ii.filenameBase, err)
@@ -1621,10 +1846,6 @@ func (ii *InvertedIndex) collectFilesStat() (filesCount, filesSize, idxSize uint
 	return filesCount, filesSize, idxSize
 }
 
-func (ii *InvertedIndex) stepsRangeInDBAsStr(tx kv.Tx) string {
-	a1, a2 := ii.stepsRangeInDB(tx)
-	return fmt.Sprintf("%s: %.1f", ii.filenameBase, a2-a1)
-}
 func (ii *InvertedIndex) stepsRangeInDB(tx kv.Tx) (from, to float64) {
 	fst, _ := kv.FirstKey(tx, ii.indexKeysTable)
 	if len(fst) > 0 {
@@ -1639,3 +1860,44 @@ func (ii *InvertedIndex) stepsRangeInDB(tx kv.Tx) (from, to float64) {
 	}
 	return from, to
 }
+
+// InvertedIndexStep used for incremental processing of standalone inverted index, it isolates only one snapshot interval
+type InvertedIndexStep struct {
+	indexItem *filesItem
+	indexFile ctxItem
+}
+
+// MakeSteps [0, toTxNum)
+func (ii *InvertedIndex) MakeSteps(toTxNum uint64) []*InvertedIndexStep {
+	var steps []*InvertedIndexStep
+	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
+				continue
+			}
+			steps = append(steps, &InvertedIndexStep{
+				indexItem: item,
+				indexFile: ctxItem{
+					startTxNum: item.startTxNum,
+					endTxNum:   item.endTxNum,
+					getter:     item.decompressor.MakeGetter(),
+					reader:     recsplit.NewIndexReader(item.index),
+				},
+			})
+		}
+		return true
+	})
+	return steps
+}
+
+func (is *InvertedIndexStep) Clone() *InvertedIndexStep {
+	return &InvertedIndexStep{
+		indexItem: is.indexItem,
+		indexFile: ctxItem{
+			startTxNum: is.indexFile.startTxNum,
+			endTxNum:   is.indexFile.endTxNum,
+			getter:     is.indexItem.decompressor.MakeGetter(),
+			reader:     recsplit.NewIndexReader(is.indexItem.index),
+		},
+	}
+}
@@ -23,15 +23,19 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/etl"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
 	"github.com/ledgerwatch/erigon-lib/kv/iter"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon-lib/kv/order"
@@ -728,3 +732,305 @@ func TestInvIndex_OpenFolder(t *testing.T) {
 	require.NoError(t, err)
 	ii.Close()
 }
+
+func TestIdxRangeFilesAndDB(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	key := []byte("key1")
+	txNums := []uint64{2, 6, 10, 15, 16, 20, 31} // step 0 - in files, step 1 - in DB
+
+	type idxRangeFunc func(from, to int, asc order.By, limit int, tx kv.Tx) (iter.U64, error)
+	tests := []struct {
+		from, to int
+		asc      order.By
+		limit    int
+		expected []uint64
+	}{
+		{-1, -1, order.Asc, -1, txNums},
+		{-1, -1, order.Desc, -1, []uint64{31, 20, 16, 15, 10, 6, 2}},
+		{-1, -1, order.Asc, 4, []uint64{2, 6, 10, 15}},
+		{-1, -1, order.Asc, 5, []uint64{2, 6, 10, 15, 16}},
+		{-1, -1, order.Desc, 3, []uint64{31, 20, 16}},
+		{-1, -1, order.Desc, 4, []uint64{31, 20, 16, 15}},
+		{6, 20, order.Asc, -1, []uint64{6, 10, 15, 16}},
+		{15, 16, order.Asc, -1, []uint64{15}},
+		{16, 31, order.Asc, -1, []uint64{16, 20}},
+		{16, -1, order.Asc, 2, []uint64{16, 20}},
+		{16, 6, order.Desc, -1, []uint64{16, 15, 10}},
+		{16, 15, order.Desc, -1, []uint64{16}},
+		{16, -1, order.Desc, 1, []uint64{16}},
+		{15, -1, order.Desc, -1, []uint64{15, 10, 6, 2}},
+		{-1, 15, order.Desc, -1, []uint64{31, 20, 16}},
+		{31, 20, order.Desc, -1, []uint64{31}},
+		{10, 10, order.Asc, -1, nil},
+		{10, 10, order.Desc, -1, nil},
+		{-1, -1, order.Asc, 0, nil},
+	}
+	check := func(t *testing.T, db kv.RwDB, idxRange idxRangeFunc) {
+		t.Helper()
+		tx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		for _, tc := range tests {
+			name := fmt.Sprintf("from=%d to=%d asc=%t limit=%d", tc.from, tc.to, tc.asc, tc.limit)
+			it, err := idxRange(tc.from, tc.to, tc.asc, tc.limit, tx)
+			require.NoError(t, err, name)
+			got, err := iter.ToArrayU64(it)
+			require.NoError(t, err, name)
+			if len(tc.expected) == 0 {
+				require.Empty(t, got, name)
+				continue
+			}
+			require.Equal(t, tc.expected, got, name)
+		}
+		_, err = idxRange(10, 5, order.Asc, -1, tx)
+		require.Error(t, err)
+		_, err = idxRange(5, 10, order.Desc, -1, tx)
+		require.Error(t, err)
+	}
+
+	t.Run("inverted index", func(t *testing.T) {
+		db, ii := testDbAndInvertedIndex(t, 16, logger)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		ic := ii.BeginFilesRo()
+		writer := ic.NewWriter()
+		for _, txNum := range txNums {
+			writer.SetTxNum(txNum)
+			require.NoError(t, writer.Add(key))
+		}
+		require.NoError(t, writer.Flush(ctx, tx))
+		writer.close()
+		ic.Close()
+
+		bs, err := ii.collate(ctx, 0, tx)
+		require.NoError(t, err)
+		sf, err := ii.buildFiles(ctx, 0, bs, background.NewProgressSet())
+		require.NoError(t, err)
+		ii.integrateDirtyFiles(sf, 0, 16)
+		ii.reCalcVisibleFiles()
+		ic = ii.BeginFilesRo()
+		_, err = ic.Prune(ctx, tx, 0, 16, math.MaxUint64, logEvery, false, nil)
+		require.NoError(t, err)
+		ic.Close()
+		require.NoError(t, tx.Commit())
+
+		ic = ii.BeginFilesRo()
+		defer ic.Close()
+		check(t, db, func(from, to int, asc order.By, limit int, tx kv.Tx) (iter.U64, error) {
+			return ic.IdxRange(key, from, to, asc, limit, tx)
+		})
+	})
+
+	for _, largeValues := range []bool{true, false} {
+		t.Run(fmt.Sprintf("history largeValues=%t", largeValues), func(t *testing.T) {
+			db, h := testDbAndHistory(t, largeValues, logger)
+			tx, err := db.BeginRw(ctx)
+			require.NoError(t, err)
+			defer tx.Rollback()
+
+			hc := h.BeginFilesRo()
+			writer := hc.NewWriter()
+			for i, txNum := range txNums {
+				writer.SetTxNum(txNum)
+				require.NoError(t, writer.AddPrevValue(key, nil, []byte{byte(i + 1)}, txNum/h.aggregationStep))
+			}
+			require.NoError(t, writer.Flush(ctx, tx))
+			writer.close()
+			hc.Close()
+
+			c, err := h.collate(ctx, 0, 0, 16, tx)
+			require.NoError(t, err)
+			sf, err := h.buildFiles(ctx, 0, c, background.NewProgressSet())
+			require.NoError(t, err)
+			h.integrateDirtyFiles(sf, 0, 16)
+			h.reCalcVisibleFiles()
+			hc = h.BeginFilesRo()
+			_, err = hc.Prune(ctx, tx, 0, 16, math.MaxUint64, false, logEvery)
+			require.NoError(t, err)
+			hc.Close()
+			require.NoError(t, tx.Commit())
+
+			hc = h.BeginFilesRo()
+			defer hc.Close()
+			check(t, db, func(from, to int, asc order.By, limit int, tx kv.Tx) (iter.U64, error) {
+				return hc.IdxRange(key, from, to, asc, limit, tx)
+			})
+		})
+	}
+}
+
+// collateReference - collation of `step` before iiCollateBatch: 1 etl entry per (key, txNum). To `iiPath`
+func collateReference(ctx context.Context, ii *InvertedIndex, step uint64, iiPath string, roTx kv.Tx) (InvertedIndexCollation, error) {
+	txFrom, txTo := step*ii.aggregationStep, (step+1)*ii.aggregationStep
+	keysCursor, err := roTx.CursorDupSort(ii.indexKeysTable)
+	if err != nil {
+		return InvertedIndexCollation{}, err
+	}
+	defer keysCursor.Close()
+
+	collector := etl.NewCollector("collate idx "+ii.filenameBase, ii.iiCfg.dirs.Tmp, etl.NewSortableBuffer(CollateIIETLRAM), ii.logger)
+	defer collector.Close()
+	collector.LogLvl(log.LvlTrace)
+
+	var txKey [8]byte
+	binary.BigEndian.PutUint64(txKey[:], txFrom)
+	for k, v, err := keysCursor.Seek(txKey[:]); k != nil; k, v, err = keysCursor.Next() {
+		if err != nil {
+			return InvertedIndexCollation{}, err
+		}
+		if binary.BigEndian.Uint64(k) >= txTo {
+			break
+		}
+		if err := collector.Collect(v, k); err != nil {
+			return InvertedIndexCollation{}, err
+		}
+	}
+
+	comp, err := seg.NewCompressor(ctx, "collate idx "+ii.filenameBase, iiPath, ii.dirs.Tmp, seg.MinPatternScore, ii.compressWorkers, log.LvlTrace, ii.logger)
+	if err != nil {
+		return InvertedIndexCollation{}, err
+	}
+	setDataRange(comp, step, step+1, ii.aggregationStep, txFrom, txTo)
+	coll := InvertedIndexCollation{iiPath: iiPath, writer: NewArchiveWriter(comp, ii.compression)}
+
+	var (
+		prevEf      []byte
+		prevKey     []byte
+		initialized bool
+		bitmap      = bitmapdb.NewBitmap64()
+	)
+	defer bitmapdb.ReturnToPool64(bitmap)
+	loadBitmapsFunc := func(k, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		txNum := binary.BigEndian.Uint64(v)
+		if !initialized {
+			prevKey = append(prevKey[:0], k...)
+			initialized = true
+		}
+		if bytes.Equal(prevKey, k) {
+			bitmap.Add(txNum)
+			return nil
+		}
+		ef := eliasfano32.NewEliasFano(bitmap.GetCardinality(), bitmap.Maximum())
+		it := bitmap.Iterator()
+		for it.HasNext() {
+			ef.AddOffset(it.Next())
+		}
+		bitmap.Clear()
+		ef.Build()
+		prevEf = ef.AppendBytes(prevEf[:0])
+		if err := coll.writer.AddWord(prevKey); err != nil {
+			return err
+		}
+		if err := coll.writer.AddWord(prevEf); err != nil {
+			return err
+		}
+		prevKey = append(prevKey[:0], k...)
+		bitmap.Add(txNum)
+		return nil
+	}
+	if err := collector.Load(nil, "", loadBitmapsFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+		coll.Close()
+		return InvertedIndexCollation{}, err
+	}
+	if !bitmap.IsEmpty() {
+		if err := loadBitmapsFunc(nil, make([]byte, 8), nil, nil); err != nil {
+			coll.Close()
+			return InvertedIndexCollation{}, err
+		}
+	}
+	return coll, nil
+}
+
+// fillTopicsStep - `keys` distinct keys in step 0, each key in `perKey` txs. Like LogTopicIdx: few txNums per key
+func fillTopicsStep(tb testing.TB, db kv.RwDB, ii *InvertedIndex, keys, perKey int) {
+	tb.Helper()
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(tb, err)
+	defer tx.Rollback()
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	writer := ic.NewWriter()
+	defer writer.close()
+
+	keysPerTx := (keys*perKey + int(ii.aggregationStep) - 1) / int(ii.aggregationStep)
+	var key [32]byte
+	for i := 0; i < keys*perKey; i++ {
+		writer.SetTxNum(uint64(i / keysPerTx))
+		binary.BigEndian.PutUint64(key[:], uint64((i*7919)%keys)) // same key in different txs
+		require.NoError(tb, writer.Add(key[:]))
+	}
+	require.NoError(tb, writer.Flush(ctx, tx))
+	require.NoError(tb, tx.Commit())
+}
+
+func TestInvIndexCollateSameAsReference(t *testing.T) {
+	defer func(ram datasize.ByteSize) { CollateIIETLRAM = ram }(CollateIIETLRAM)
+	for _, ram := range []datasize.ByteSize{1 * datasize.KB, 64 * datasize.KB, CollateIIETLRAM} { // many batches and etl files, few, one
+		t.Run(ram.String(), func(t *testing.T) {
+			CollateIIETLRAM = ram
+			db, ii := testDbAndInvertedIndex(t, 1024, log.New())
+			fillTopicsStep(t, db, ii, 3_000, 3)
+			ctx := context.Background()
+			tx, err := db.BeginRo(ctx)
+			require.NoError(t, err)
+			defer tx.Rollback()
+
+			coll, err := ii.collate(ctx, 0, tx)
+			require.NoError(t, err)
+			sf, err := ii.buildFiles(ctx, 0, coll, background.NewProgressSet())
+			require.NoError(t, err)
+			defer sf.CleanupOnError()
+
+			refColl, err := collateReference(ctx, ii, 0, filepath.Join(t.TempDir(), "reference.ef"), tx)
+			require.NoError(t, err)
+			defer refColl.Close()
+			require.NoError(t, refColl.writer.Compress())
+			ref, err := seg.NewDecompressor(refColl.iiPath)
+			require.NoError(t, err)
+			defer ref.Close()
+
+			require.Equal(t, ref.Count(), sf.decomp.Count())
+			g, refG := sf.decomp.MakeGetter(), ref.MakeGetter()
+			var w, refW []byte
+			for refG.HasNext() {
+				require.True(t, g.HasNext())
+				refW, _ = refG.Next(refW[:0])
+				w, _ = g.Next(w[:0])
+				require.Equal(t, refW, w)
+			}
+			require.False(t, g.HasNext())
+		})
+	}
+}
+
+func BenchmarkInvIndexCollate(b *testing.B) {
+	db, ii := testDbAndInvertedIndex(b, 100_000, log.New())
+	fillTopicsStep(b, db, ii, 1_000_000, 2)
+	ctx := context.Background()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(b, err)
+	defer tx.Rollback()
+
+	b.Run("reference", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			coll, err := collateReference(ctx, ii, 0, filepath.Join(b.TempDir(), "reference.ef"), tx)
+			require.NoError(b, err)
+			coll.Close()
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			coll, err := ii.collate(ctx, 0, tx)
+			require.NoError(b, err)
+			coll.Close()
+		}
+	})
+}
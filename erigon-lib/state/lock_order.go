@@ -0,0 +1,105 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Lock order of Aggregator:
+//   - `dirtyFilesLock` and `visibleFilesLock` must never be held by the same goroutine at the same time.
+//   - mutate dirty files under `dirtyFilesLock`, release it, and only then call `recalcVisibleFiles` (it takes `visibleFilesLock`).
+//   - `BeginFilesRo` takes `visibleFilesLock` - don't call anything which takes `dirtyFilesLock` from inside it.
+//
+// lockOrderChecker - debug-only validator of this rule. Enable by env: AGG_LOCK_ORDER_CHECK=true
+type lockOrderChecker struct {
+	enabled bool
+
+	mu      sync.Mutex
+	dirty   map[uint64][]byte // goroutine id -> stack at `dirtyFilesLock` acquisition
+	visible map[uint64][]byte // goroutine id -> stack at `visibleFilesLock` acquisition
+}
+
+func newLockOrderChecker(enabled bool) *lockOrderChecker {
+	return &lockOrderChecker{enabled: enabled, dirty: map[uint64][]byte{}, visible: map[uint64][]byte{}}
+}
+
+const (
+	dirtyFilesLockName   = "dirtyFilesLock"
+	visibleFilesLockName = "visibleFilesLock"
+)
+
+func (c *lockOrderChecker) acquire(name string) {
+	if c == nil || !c.enabled {
+		return
+	}
+	mine, other, otherName := c.dirty, c.visible, visibleFilesLockName
+	if name == visibleFilesLockName {
+		mine, other, otherName = c.visible, c.dirty, dirtyFilesLockName
+	}
+	stack := goroutineStack()
+	id := goroutineID(stack)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if otherStack, ok := other[id]; ok {
+		panic(fmt.Sprintf("[agg] lock order violation: acquiring %s while holding %s\n--- %s acquired at:\n%s\n--- %s acquiring at:\n%s",
+			name, otherName, otherName, otherStack, name, stack))
+	}
+	mine[id] = stack
+}
+
+func (c *lockOrderChecker) release(name string) {
+	if c == nil || !c.enabled {
+		return
+	}
+	mine := c.dirty
+	if name == visibleFilesLockName {
+		mine = c.visible
+	}
+	id := goroutineID(goroutineStack())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(mine, id)
+}
+
+func goroutineStack() []byte {
+	buf := make([]byte, 16*1024)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// goroutineID - parse "goroutine 123 [running]:" header of runtime.Stack output
+func goroutineID(stack []byte) uint64 {
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		stack = stack[:i]
+	}
+	id, _ := strconv.ParseUint(string(stack), 10, 64)
+	return id
+}
+
+func (a *Aggregator) lockDirtyFiles() {
+	a.lockOrder.acquire(dirtyFilesLockName)
+	a.dirtyFilesLock.Lock()
+}
+func (a *Aggregator) unlockDirtyFiles() {
+	a.dirtyFilesLock.Unlock()
+	a.lockOrder.release(dirtyFilesLockName)
+}
+func (a *Aggregator) lockVisibleFiles() {
+	a.lockOrder.acquire(visibleFilesLockName)
+	a.visibleFilesLock.Lock()
+}
+func (a *Aggregator) unlockVisibleFiles() {
+	a.visibleFilesLock.Unlock()
+	a.lockOrder.release(visibleFilesLockName)
+}
+func (a *Aggregator) rlockVisibleFiles() {
+	a.lockOrder.acquire(visibleFilesLockName)
+	a.visibleFilesLock.RLock()
+}
+func (a *Aggregator) runlockVisibleFiles() {
+	a.visibleFilesLock.RUnlock()
+	a.lockOrder.release(visibleFilesLockName)
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatorLockOrder_Stress(t *testing.T) {
+	iterations := 5_000
+	if testing.Short() {
+		iterations = 500
+	}
+
+	_, agg := testDbAndAggregatorv3(t, 16)
+	agg.lockOrder = newLockOrderChecker(true)
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			step := uint64(i % 8)
+			agg.integrateDirtyFiles(AggV3StaticFiles{}, step*agg.aggregationStep, (step+1)*agg.aggregationStep)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			ac := agg.BeginFilesRo()
+			_ = ac.MinimaxTxNum(true)
+			ac.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			agg.closeDirtyFiles()
+			agg.recalcVisibleFiles()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		agg.Close()
+	}()
+	wg.Wait()
+}
+
+func TestAggregatorLockOrder_Violation(t *testing.T) {
+	_, agg := testDbAndAggregatorv3(t, 16)
+	agg.lockOrder = newLockOrderChecker(true)
+
+	agg.lockDirtyFiles()
+	defer agg.unlockDirtyFiles()
+	require.Panics(t, func() { agg.recalcVisibleFiles() })
+}
@@ -47,7 +47,7 @@ func (d *Domain) dirtyFilesEndTxNumMinimax() uint64 {
 			minimax = endTxNum
 		}
 	}
-	return minimax
+	return coveredEndTxNum(minimax, d.emptySteps.list(), d.aggregationStep)
 }
 
 func (ii *InvertedIndex) dirtyFilesEndTxNumMinimax() uint64 {
@@ -138,6 +138,9 @@ func (dt *DomainRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) DomainRanges {
 		if item.endTxNum > maxEndTxNum {
 			break
 		}
+		if !item.src.endsOnStep(dt.d.aggregationStep) { // file of other step size, see recordedStepSize
+			continue
+		}
 		endStep := item.endTxNum / dt.d.aggregationStep
 		spanStep := endStep & -endStep // Extract rightmost bit in the binary representation of endStep, this corresponds to size of maximally possible merge ending at endStep
 		span := spanStep * dt.d.aggregationStep
@@ -153,12 +156,30 @@ func (dt *DomainRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) DomainRanges {
 	return r
 }
 
+// canMergeRange - visible files have boundaries exactly at `from` and `to`, and there are >1 files between them
+func (dt *DomainRoTx) canMergeRange(from, to uint64) bool {
+	var hasStart, hasEnd bool
+	var inRange int
+	for _, item := range dt.files {
+		if item.startTxNum == from {
+			hasStart = true
+		}
+		if item.endTxNum == to {
+			hasEnd = true
+		}
+		if item.startTxNum >= from && item.endTxNum <= to {
+			inRange++
+		}
+	}
+	return hasStart && hasEnd && inRange > 1
+}
+
 func (ht *HistoryRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) HistoryRanges {
 	var r HistoryRanges
 	mr := ht.iit.findMergeRange(maxEndTxNum, maxSpan)
 	r.index, r.indexStartTxNum, r.indexEndTxNum = mr.needMerge, mr.from, mr.to
 	for _, item := range ht.files {
-		if item.endTxNum > maxEndTxNum {
+		if item.endTxNum > maxEndTxNum || !item.src.endsOnStep(ht.h.aggregationStep) {
 			continue
 		}
 		endStep := item.endTxNum / ht.h.aggregationStep
@@ -207,7 +228,7 @@ func (iit *InvertedIndexRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) *Merge
 	var minFound bool
 	var startTxNum, endTxNum uint64
 	for _, item := range iit.files {
-		if item.endTxNum > maxEndTxNum {
+		if item.endTxNum > maxEndTxNum || !item.src.endsOnStep(iit.ii.aggregationStep) {
 			continue
 		}
 		endStep := item.endTxNum / iit.ii.aggregationStep
@@ -234,7 +255,7 @@ func (tx *AppendableRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) *MergeRang
 	var minFound bool
 	var startTxNum, endTxNum uint64
 	for _, item := range tx.files {
-		if item.endTxNum > maxEndTxNum {
+		if item.endTxNum > maxEndTxNum || !item.src.endsOnStep(tx.ap.aggregationStep) {
 			continue
 		}
 		endStep := item.endTxNum / tx.ap.aggregationStep
@@ -284,6 +305,9 @@ func (dt *DomainRoTx) BuildOptionalMissedIndices(ctx context.Context, ps *backgr
 	if err := dt.ht.iit.BuildOptionalMissedIndices(ctx, ps); err != nil {
 		return err
 	}
+	if err := dt.buildMissedCodeHashIdx(ctx, ps); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -496,11 +520,19 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("merge %s compressor: %w", dt.d.filenameBase, err)
 	}
+	kvFile.SetDictionary(dt.d.compressDict)
+	kvFile.SetOnTmpSize(dt.d.onMergeTmpSize)
+	dt.d.setKvFileFlags(kvFile, vt != nil && dt.d.valuesTransform == CommitmentValuesTransformAtMerge)
 
 	kvWriter = NewArchiveWriter(kvFile, dt.d.compression)
 	if dt.d.noFsync {
 		kvWriter.DisableFsync()
 	}
+	dataFrom, dataTo, err := mergedDataRange(domainFiles, r.valuesStartTxNum, dt.emptySteps, dt.d.aggregationStep)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	setDataRange(kvFile, fromStep, toStep, dt.d.aggregationStep, dataFrom, dataTo)
 	p := ps.AddNew("merge "+path.Base(kvFilePath), 1)
 	defer ps.Delete(p)
 
@@ -593,9 +625,12 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 
 	valuesIn = newFilesItem(r.valuesStartTxNum, r.valuesEndTxNum, dt.d.aggregationStep)
 	valuesIn.frozen = false
-	if valuesIn.decompressor, err = seg.NewDecompressor(kvFilePath); err != nil {
+	if valuesIn.decompressor, err = seg.NewDecompressorWithDictionary(kvFilePath, dt.d.compressDict); err != nil {
 		return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", dt.d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 	}
+	if err = writeStepSize(kvFilePath, dt.d.aggregationStep, dt.d.noFsync); err != nil {
+		return nil, nil, nil, fmt.Errorf("merge %s step size [%d-%d]: %w", dt.d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+	}
 
 	if UseBpsTree {
 		btPath := dt.d.kvBtFilePath(fromStep, toStep)
@@ -625,6 +660,14 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 			}
 		}
 	}
+	if dt.d.codeHashIndex {
+		if err = dt.d.buildCodeHashIdx(ctx, fromStep, toStep, valuesIn.decompressor, ps); err != nil {
+			return nil, nil, nil, fmt.Errorf("merge %s .kvch [%d-%d]: %w", dt.d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+		}
+		if valuesIn.codeHash, err = recsplit.OpenIndex(dt.d.kvCodeHashIdxFilePath(fromStep, toStep)); err != nil {
+			return nil, nil, nil, fmt.Errorf("merge %s .kvch [%d-%d]: %w", dt.d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+		}
+	}
 
 	closeItem = false
 	dt.d.stats.MergesCount++
@@ -666,6 +709,12 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 	if iit.ii.noFsync {
 		comp.DisableFsync()
 	}
+	comp.SetOnTmpSize(iit.ii.onMergeTmpSize)
+	dataFrom, dataTo, err := mergedDataRange(files, startTxNum, iit.ii.emptySteps.list(), iit.ii.aggregationStep)
+	if err != nil {
+		return nil, err
+	}
+	setDataRange(comp, fromStep, toStep, iit.ii.aggregationStep, dataFrom, dataTo)
 	write := NewArchiveWriter(comp, iit.ii.compression)
 	p := ps.AddNew(path.Base(datPath), 1)
 	defer ps.Delete(p)
@@ -754,6 +803,9 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 	if outItem.decompressor, err = seg.NewDecompressor(datPath); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", iit.ii.filenameBase, startTxNum, endTxNum, err)
 	}
+	if err = writeStepSize(datPath, iit.ii.aggregationStep, iit.ii.noFsync); err != nil {
+		return nil, fmt.Errorf("merge %s step size [%d-%d]: %w", iit.ii.filenameBase, startTxNum, endTxNum, err)
+	}
 	ps.Delete(p)
 
 	if err := iit.ii.buildMapAccessor(ctx, fromStep, toStep, outItem.decompressor, ps); err != nil {
@@ -820,6 +872,12 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 		if comp, err = seg.NewCompressor(ctx, "merge hist "+ht.h.filenameBase, datPath, ht.h.dirs.Tmp, seg.MinPatternScore, ht.h.compressWorkers, log.LvlTrace, ht.h.logger); err != nil {
 			return nil, nil, fmt.Errorf("merge %s history compressor: %w", ht.h.filenameBase, err)
 		}
+		comp.SetOnTmpSize(ht.h.onMergeTmpSize)
+		var dataFrom, dataTo uint64
+		if dataFrom, dataTo, err = mergedDataRange(historyFiles, r.historyStartTxNum, ht.h.emptySteps.list(), ht.h.aggregationStep); err != nil {
+			return nil, nil, err
+		}
+		setDataRange(comp, fromStep, toStep, ht.h.aggregationStep, dataFrom, dataTo)
 		compr := NewArchiveWriter(comp, ht.h.compression)
 		if ht.h.noFsync {
 			compr.DisableFsync()
@@ -896,6 +954,9 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 		if decomp, err = seg.NewDecompressor(datPath); err != nil {
 			return nil, nil, err
 		}
+		if err = writeStepSize(datPath, ht.h.aggregationStep, ht.h.noFsync); err != nil {
+			return nil, nil, err
+		}
 		ps.Delete(p)
 
 		p = ps.AddNew(path.Base(idxPath), uint64(decomp.Count()/2))
@@ -1033,6 +1094,11 @@ func (tx *AppendableRoTx) mergeFiles(ctx context.Context, files []*filesItem, st
 	}
 	fromStep, toStep := startTxNum/tx.ap.aggregationStep, endTxNum/tx.ap.aggregationStep
 
+	marker, hasMarker, err := tx.checkCanonicalLineage(files)
+	if err != nil {
+		return nil, fmt.Errorf("merge %s [%d-%d]: %w", tx.ap.filenameBase, startTxNum, endTxNum, err)
+	}
+
 	datPath := tx.ap.apFilePath(fromStep, toStep)
 	if comp, err = seg.NewCompressor(ctx, "merge fk "+tx.ap.filenameBase, datPath, tx.ap.cfg.Dirs.Tmp, seg.MinPatternScore, tx.ap.compressWorkers, log.LvlTrace, tx.ap.logger); err != nil {
 		return nil, fmt.Errorf("merge %s inverted index compressor: %w", tx.ap.filenameBase, err)
@@ -1041,6 +1107,7 @@ func (tx *AppendableRoTx) mergeFiles(ctx context.Context, files []*filesItem, st
 	if tx.ap.noFsync {
 		comp.DisableFsync()
 	}
+	comp.SetOnTmpSize(tx.ap.onMergeTmpSize)
 	write := NewArchiveWriter(comp, tx.ap.compression)
 	defer write.Close()
 	p := ps.AddNew(path.Base(datPath), 1)
@@ -1066,7 +1133,15 @@ func (tx *AppendableRoTx) mergeFiles(ctx context.Context, files []*filesItem, st
 	if outItem.decompressor, err = seg.NewDecompressor(datPath); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", tx.ap.filenameBase, startTxNum, endTxNum, err)
 	}
+	if err = writeStepSize(datPath, tx.ap.aggregationStep, tx.ap.noFsync); err != nil {
+		return nil, fmt.Errorf("merge %s step size [%d-%d]: %w", tx.ap.filenameBase, startTxNum, endTxNum, err)
+	}
 	ps.Delete(p)
+	if hasMarker {
+		if err = tx.ap.writeMarker(datPath, marker); err != nil {
+			return nil, fmt.Errorf("merge %s canonical marker [%d-%d]: %w", tx.ap.filenameBase, startTxNum, endTxNum, err)
+		}
+	}
 
 	if err := tx.ap.buildAccessor(ctx, fromStep, toStep, outItem.decompressor, ps); err != nil {
 		return nil, fmt.Errorf("merge %s buildIndex [%d-%d]: %w", tx.ap.filenameBase, startTxNum, endTxNum, err)
@@ -0,0 +1,245 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// MergePlanInput - existing file which will be merged
+type MergePlanInput struct {
+	Name string
+	Size int64
+}
+
+// MergePlanItem - file which merge will produce
+type MergePlanItem struct {
+	Name             string // domain/index name: accounts, logaddrs, ...
+	Path             string // path of output file
+	FromStep, ToStep uint64
+	Inputs           []MergePlanInput
+	InputSize        int64
+	EstimatedSize    int64 // InputSize adjusted by compression ratio observed on previous merges of same files type
+}
+
+// MergePlan - result of merge dry-run. See AggregatorRoTx.PlanMerge
+type MergePlan struct {
+	Items []MergePlanItem
+
+	// CommitmentValuesTransform - commitment values will be re-written to reference accounts/storage files (slower merge)
+	CommitmentValuesTransform bool
+
+	InputSize     int64
+	EstimatedSize int64 // disk space required to produce all Items (inputs are removed only after merge)
+}
+
+func (p MergePlan) Empty() bool { return len(p.Items) == 0 }
+
+func (p MergePlan) String() string {
+	if p.Empty() {
+		return "nothing to merge"
+	}
+	var b strings.Builder
+	for _, it := range p.Items {
+		inputs := make([]string, 0, len(it.Inputs))
+		for _, in := range it.Inputs {
+			inputs = append(inputs, in.Name)
+		}
+		fmt.Fprintf(&b, "%s: inputs=%d (%s), estimated=%s, from=[%s]\n", filepath.Base(it.Path), len(it.Inputs),
+			datasize.ByteSize(it.InputSize).HR(), datasize.ByteSize(it.EstimatedSize).HR(), strings.Join(inputs, ","))
+	}
+	fmt.Fprintf(&b, "total: files=%d, inputs=%s, estimated=%s, commitment_values_transform=%t", len(p.Items),
+		datasize.ByteSize(p.InputSize).HR(), datasize.ByteSize(p.EstimatedSize).HR(), p.CommitmentValuesTransform)
+	return b.String()
+}
+
+func (p *MergePlan) add(name, path string, aggStep, fromTxNum, toTxNum uint64, inputs []*filesItem, ratios *mergeRatios) {
+	it := MergePlanItem{Name: name, Path: path, FromStep: fromTxNum / aggStep, ToStep: toTxNum / aggStep}
+	for _, f := range inputs {
+		if f == nil || f.decompressor == nil {
+			continue
+		}
+		it.Inputs = append(it.Inputs, MergePlanInput{Name: f.decompressor.FileName(), Size: f.decompressor.Size()})
+		it.InputSize += f.decompressor.Size()
+	}
+	it.EstimatedSize = int64(float64(it.InputSize) * ratios.get(mergeRatioKey(path)))
+	p.Items = append(p.Items, it)
+	p.InputSize += it.InputSize
+	p.EstimatedSize += it.EstimatedSize
+}
+
+// PlanMerge - dry-run of merge: runs same files selection as merge does, but doesn't produce any files.
+// Plans only 1 step of MergeLoop: files produced by it may be merged again by next step.
+func (ac *AggregatorRoTx) PlanMerge(maxSpan uint64) MergePlan {
+	var p MergePlan
+	r := ac.findMergeRange(ac.a.visibleFilesMinimaxTxNum.Load(), maxSpan)
+	if !r.any() {
+		return p
+	}
+	ratios := &ac.a.mergeRatios
+	aggStep := ac.a.StepSize()
+	for id, dt := range ac.d {
+		dr := r.domain[id]
+		if !dr.any() {
+			continue
+		}
+		valuesFiles, indexFiles, historyFiles := dt.staticFilesInRange(dr)
+		name := dt.d.filenameBase
+		if dr.values {
+			p.add(name, dt.d.kvFilePath(dr.valuesStartTxNum/aggStep, dr.valuesEndTxNum/aggStep), aggStep, dr.valuesStartTxNum, dr.valuesEndTxNum, valuesFiles, ratios)
+		}
+		if dr.index {
+			p.add(name, dt.d.History.InvertedIndex.efFilePath(dr.indexStartTxNum/aggStep, dr.indexEndTxNum/aggStep), aggStep, dr.indexStartTxNum, dr.indexEndTxNum, indexFiles, ratios)
+		}
+		if dr.history {
+			p.add(name, dt.d.History.vFilePath(dr.historyStartTxNum/aggStep, dr.historyEndTxNum/aggStep), aggStep, dr.historyStartTxNum, dr.historyEndTxNum, historyFiles, ratios)
+		}
+	}
+	for id, rng := range r.invertedIndex {
+		if rng == nil || !rng.needMerge {
+			continue
+		}
+		iit := ac.iis[id]
+		p.add(iit.ii.filenameBase, iit.ii.efFilePath(rng.from/aggStep, rng.to/aggStep), aggStep, rng.from, rng.to, iit.staticFilesInRange(rng.from, rng.to), ratios)
+	}
+	for id, rng := range r.appendable {
+		if rng == nil || !rng.needMerge {
+			continue
+		}
+		apt := ac.appendable[id]
+		p.add(apt.ap.filenameBase, apt.ap.apFilePath(rng.from/aggStep, rng.to/aggStep), aggStep, rng.from, rng.to, apt.staticFilesInRange(rng.from, rng.to), ratios)
+	}
+	p.CommitmentValuesTransform = ac.a.commitmentValuesTransform == CommitmentValuesTransformAtMerge && r.domain[kv.CommitmentDomain].values
+	return p
+}
+
+// mergeRatios - output/input size ratio of previous merges. Used to estimate size of future merges. Persisted in sidecar
+// file `merge-ratios.txt` in snapshots dir (line per files type: `accounts.kv 0.87`): dry-run of CLI runs without merges
+type mergeRatios struct {
+	mu    sync.Mutex
+	path  string             // "" - not persisted
+	ratio map[string]float64 // key: filenameBase + ext (accounts.kv)
+}
+
+func mergeRatiosPath(snapDir string) string { return filepath.Join(snapDir, "merge-ratios.txt") }
+
+// load - reads sidecar file. Missing file - no ratios known
+func (m *mergeRatios) load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	ratio := map[string]float64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("parse %s: unexpected line %q", m.path, line)
+		}
+		r, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", m.path, err)
+		}
+		ratio[fields[0]] = r
+	}
+	m.ratio = ratio
+	return nil
+}
+
+func (m *mergeRatios) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(m.ratio))
+	for k := range m.ratio {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", k, strconv.FormatFloat(m.ratio[k], 'f', 4, 64))
+	}
+	tmpPath := m.path + ".tmp"
+	if err := dir.WriteFileWithFsync(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
+
+func mergeRatioKey(path string) string {
+	// v1-accounts.0-16.kv -> accounts.kv
+	fName := filepath.Base(path)
+	parts := strings.Split(fName, ".")
+	if len(parts) < 3 {
+		return fName
+	}
+	return strings.TrimPrefix(parts[0], "v1-") + "." + parts[len(parts)-1]
+}
+
+func (m *mergeRatios) get(key string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.ratio[key]; ok {
+		return r
+	}
+	return 1
+}
+
+func (m *mergeRatios) record(in []*filesItem, out *filesItem) {
+	if out == nil || out.decompressor == nil {
+		return
+	}
+	var inSize int64
+	for _, f := range in {
+		if f != nil && f.decompressor != nil {
+			inSize += f.decompressor.Size()
+		}
+	}
+	if inSize == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ratio == nil {
+		m.ratio = map[string]float64{}
+	}
+	m.ratio[mergeRatioKey(out.decompressor.FileName())] = float64(out.decompressor.Size()) / float64(inSize)
+}
+
+// recordMergeRatios - must be called before `outs` are closed/removed
+func (a *Aggregator) recordMergeRatios(outs SelectedStaticFilesV3, in MergedFilesV3) {
+	for id := range a.d {
+		a.mergeRatios.record(outs.d[id], in.d[id])
+		a.mergeRatios.record(outs.dIdx[id], in.dIdx[id])
+		a.mergeRatios.record(outs.dHist[id], in.dHist[id])
+	}
+	for id := range a.iis {
+		a.mergeRatios.record(outs.ii[id], in.iis[id])
+	}
+	for id := range a.ap {
+		a.mergeRatios.record(outs.appendable[id], in.appendable[id])
+	}
+	if err := a.mergeRatios.save(); err != nil {
+		a.logger.Warn("[snapshots] save merge ratios", "err", err)
+	}
+}
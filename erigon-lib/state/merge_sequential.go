@@ -0,0 +1,184 @@
+package state
+
+import (
+	"context"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/shirou/gopsutil/v3/disk"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// MergeMode - how MergeLoop merges files of one range. See SetMergeMode
+type MergeMode uint8
+
+const (
+	// MergeModeAuto - MergeModeSequential if free space of snapshots dir is below mergeSequentialFreeSpace, otherwise MergeModeConcurrent
+	MergeModeAuto MergeMode = iota
+	// MergeModeConcurrent - all domains of range are merged at once (up to mergeWorkers): outputs of all of them are
+	// on disk before any input is deleted
+	MergeModeConcurrent
+	// MergeModeSequential - domain by domain: inputs of domain are deleted before merge of next domain starts
+	MergeModeSequential
+)
+
+func (m MergeMode) String() string {
+	switch m {
+	case MergeModeAuto:
+		return "auto"
+	case MergeModeConcurrent:
+		return "concurrent"
+	case MergeModeSequential:
+		return "sequential"
+	default:
+		return "unknown"
+	}
+}
+
+// mergeSequentialFreeSpace - MergeModeAuto switches to sequential merge below it. 32 steps range of mainnet needs >200GB
+var mergeSequentialFreeSpace = 256 * datasize.GB
+
+func (a *Aggregator) SetMergeMode(m MergeMode) { a.mergeMode = m }
+
+func (a *Aggregator) mergeSequential() bool {
+	switch a.mergeMode {
+	case MergeModeSequential:
+		return true
+	case MergeModeConcurrent:
+		return false
+	}
+	usage, err := disk.Usage(a.dirs.SnapDomain)
+	if err != nil {
+		a.logger.Debug("[snapshots] merge: can't get free disk space", "err", err)
+		return false
+	}
+	return usage.Free < uint64(mergeSequentialFreeSpace)
+}
+
+// addMergeDiskInFlight - bytes of merged files whose inputs are not deleted yet, and of temporary files of writers of
+// merges in progress (see seg.Compressor.SetOnTmpSize): extra disk space used by merge
+func (a *Aggregator) addMergeDiskInFlight(delta int64) {
+	v := a.mergeDiskInFlight.Add(delta)
+	mxMergeDiskInFlight.Set(float64(v))
+	if a.onMergeDiskInFlight != nil {
+		a.onMergeDiskInFlight(v)
+	}
+}
+
+// mergeParts - parts of `r` which are merged one after another in sequential mode: values or history of 1 domain,
+// inverted index or appendable per part. Commitment references records of accounts and storage .kv files of same range
+// (see commitmentValTransformDomain, commitmentValExpandDomain): their inputs can be deleted only after commitment is
+// merged - so values of accounts, storage and commitment are in one part. Their histories are not referenced: own parts
+func (r RangesV3) mergeParts() (parts []RangesV3) {
+	empty := func() (p RangesV3) {
+		p.domain[kv.AccountsDomain].aggStep = r.domain[kv.AccountsDomain].aggStep // see RangesV3.String
+		for id := range p.invertedIndex {
+			p.invertedIndex[id] = &MergeRange{}
+		}
+		return p
+	}
+
+	commitmentPart, commitmentPartUsed := empty(), false
+	for id := range r.domain {
+		if !r.domain[id].any() {
+			continue
+		}
+		switch kv.Domain(id) {
+		case kv.AccountsDomain, kv.StorageDomain, kv.CommitmentDomain:
+			values, history := r.domain[id], r.domain[id]
+			values.history, values.index = false, false
+			history.values = false
+			if values.any() {
+				commitmentPart.domain[id], commitmentPartUsed = values, true
+			}
+			if history.any() {
+				p := empty()
+				p.domain[id] = history
+				parts = append(parts, p)
+			}
+			continue
+		}
+		p := empty()
+		p.domain[id] = r.domain[id]
+		parts = append(parts, p)
+	}
+	if commitmentPartUsed {
+		parts = append([]RangesV3{commitmentPart}, parts...)
+	}
+	for id, rng := range r.invertedIndex {
+		if rng == nil || !rng.needMerge {
+			continue
+		}
+		p := empty()
+		p.invertedIndex[id] = rng
+		parts = append(parts, p)
+	}
+	for id, rng := range r.appendable {
+		if rng == nil || !rng.needMerge {
+			continue
+		}
+		p := empty()
+		p.appendable[id] = rng
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// mergeSequentially - merges parts of `r` (see mergeParts) one by one. Peak of extra disk space is output of biggest
+// part instead of output of whole range
+func (a *Aggregator) mergeSequentially(ctx context.Context, r RangesV3) error {
+	a.logger.Info("[snapshots] merge state sequentially", "ranges", r.String(), "mode", a.mergeMode)
+	for _, part := range r.mergeParts() {
+		outSize, err := a.mergePart(ctx, part)
+		a.addMergeDiskInFlight(-outSize) // inputs are deleted
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergePart - merge, integrate and clean of `r`. Inputs are deleted when last view which references them is closed:
+// view of merge is closed on return. outSize - of merged files
+func (a *Aggregator) mergePart(ctx context.Context, r RangesV3) (outSize int64, err error) {
+	aggTx := a.BeginFilesRo()
+	defer aggTx.Close()
+
+	closeAll := true
+	outs, err := aggTx.staticFilesInRange(r)
+	defer func() {
+		if closeAll {
+			outs.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+	before, err := a.stateFilesBefore()
+	if err != nil {
+		return 0, err
+	}
+
+	in, err := aggTx.mergeFilesWithWorkers(ctx, outs, r, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeAll {
+			in.Close()
+		}
+	}()
+	_, outSize = mergeSizes(outs, in)
+	a.addMergeDiskInFlight(outSize)
+	if err := a.fsyncProduced(before); err != nil {
+		return outSize, err
+	}
+
+	a.recordMergeRatios(outs, in)
+	a.integrateMergedDirtyFiles(outs, in)
+	a.scheduleWarmup(in)
+	a.cleanAfterMerge(in)
+	a.onFreeze(in.FrozenList())
+	closeAll = false
+	return outSize, nil
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+func TestAggregatorV3_MergeSequential(t *testing.T) {
+	ctx := context.Background()
+	merge := func(mode MergeMode) (agg *Aggregator, peak int64) {
+		t.Helper()
+		db, agg := testDbAndAggregatorv3(t, 16)
+		buildRandomSteps(t, db, agg, 4)
+		agg.SetMergeWorkers(4)
+		agg.SetMergeMode(mode)
+		var mu sync.Mutex // merge workers report temporary files concurrently
+		agg.onMergeDiskInFlight = func(bytes int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			peak = max(peak, bytes)
+		}
+		require.NoError(t, agg.MergeLoop(ctx))
+		require.Zero(t, agg.mergeDiskInFlight.Load())
+		return agg, peak
+	}
+	// name -> words of visible files
+	visibleFiles := func(agg *Aggregator) map[string][][]byte {
+		res := map[string][][]byte{}
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		add := func(files visibleFiles) {
+			for _, f := range files {
+				var words [][]byte
+				for g := f.src.decompressor.MakeGetter(); g.HasNext(); {
+					word, _ := g.Next(nil)
+					words = append(words, word)
+				}
+				res[f.src.decompressor.FileName()] = words
+			}
+		}
+		for _, d := range ac.d {
+			add(d.files)
+			add(d.ht.files)
+			add(d.ht.iit.files)
+		}
+		for _, ii := range ac.iis {
+			add(ii.files)
+		}
+		return res
+	}
+
+	concurrentAgg, concurrentPeak := merge(MergeModeConcurrent)
+	sequentialAgg, sequentialPeak := merge(MergeModeSequential)
+	require.Equal(t, visibleFiles(concurrentAgg), visibleFiles(sequentialAgg))
+
+	require.Positive(t, sequentialPeak)
+	require.Less(t, sequentialPeak, concurrentPeak)
+
+	// merged-away files are deleted
+	for _, agg := range []*Aggregator{concurrentAgg, sequentialAgg} {
+		kvs, err := filepath.Glob(filepath.Join(agg.dirs.SnapDomain, "*-accounts.*.kv"))
+		require.NoError(t, err)
+		require.Equal(t, []string{agg.d[kv.AccountsDomain].kvFilePath(0, 4)}, kvs)
+	}
+}
+
+func TestRangesV3_MergeParts(t *testing.T) {
+	var r RangesV3
+	for id := range r.domain {
+		r.domain[id] = DomainRanges{name: kv.Domain(id), values: true, valuesEndTxNum: 32, aggStep: 16}
+	}
+	for id := range r.invertedIndex {
+		r.invertedIndex[id] = &MergeRange{needMerge: id == int(kv.LogAddrIdxPos), to: 32}
+	}
+
+	parts := r.mergeParts()
+	require.Len(t, parts, 3) // accounts+storage+commitment values, code, logaddrs
+	require.True(t, parts[0].domain[kv.AccountsDomain].any())
+	require.True(t, parts[0].domain[kv.StorageDomain].any())
+	require.True(t, parts[0].domain[kv.CommitmentDomain].any())
+	require.False(t, parts[0].domain[kv.CodeDomain].any())
+	require.True(t, parts[1].domain[kv.CodeDomain].any())
+	require.False(t, parts[1].domain[kv.AccountsDomain].any())
+	require.True(t, parts[2].invertedIndex[kv.LogAddrIdxPos].needMerge)
+
+	// histories of accounts, storage and commitment are not referenced by commitment: merged in own parts
+	for id := range r.domain {
+		r.domain[id].history, r.domain[id].historyEndTxNum = true, 32
+	}
+	parts = r.mergeParts()
+	require.Len(t, parts, 6) // accounts+storage+commitment values, accounts history, storage history, code, commitment history, logaddrs
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CommitmentDomain} {
+		require.True(t, parts[0].domain[d].values)
+		require.False(t, parts[0].domain[d].history)
+	}
+	for _, p := range parts[1:5] {
+		for id := range p.domain {
+			require.False(t, p.domain[id].values && kv.Domain(id) != kv.CodeDomain)
+		}
+	}
+	for _, p := range parts {
+		require.True(t, p.any())
+		require.NotEmpty(t, p.String())
+	}
+}
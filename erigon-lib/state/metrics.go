@@ -16,7 +16,12 @@
 
 package state
 
-import "github.com/ledgerwatch/erigon-lib/metrics"
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/metrics"
+)
 
 var (
 	//LatestStateReadWarm          = metrics.GetOrCreateSummary(`latest_state_read{type="warm",found="yes"}`)  //nolint
@@ -53,7 +58,26 @@ var (
 	mxPruneSizeIndex       = metrics.GetOrCreateCounter(`domain_prune_size{type="index"}`)
 	mxBuildTook            = metrics.GetOrCreateSummary("domain_build_files_took")
 	mxStepTook             = metrics.GetOrCreateSummary("domain_step_took")
+	mxStepKeys             = metrics.GetOrCreateHistogram("domain_step_keys")
+	mxStepOutputBytes      = metrics.GetOrCreateHistogram("domain_step_output_bytes")
+	mxCollateThroughput    = metrics.GetOrCreateHistogram(`domain_throughput_mbs{phase="collate"}`)
+	mxBuildThroughput      = metrics.GetOrCreateHistogram(`domain_throughput_mbs{phase="build"}`)
+	mxMergeThroughput      = metrics.GetOrCreateHistogram(`domain_throughput_mbs{phase="merge"}`)
+	mxMergeDiskInFlight    = metrics.GetOrCreateGauge("domain_merge_disk_in_flight")
 	mxFlushTook            = metrics.GetOrCreateSummary("domain_flush_took")
 	mxCommitmentRunning    = metrics.GetOrCreateGauge("domain_running_commitment")
 	mxCommitmentTook       = metrics.GetOrCreateSummary("domain_commitment_took")
 )
+
+// mxTableWatermarks - tables whose Aggregator.TableWatermarks are exported to metrics
+var mxTableWatermarks = map[string]struct{ min, max, rows metrics.Gauge }{}
+
+func init() {
+	for _, table := range []string{kv.TblAccountHistoryKeys, kv.TblStorageHistoryKeys, kv.TblCodeHistoryKeys, kv.TblCommitmentHistoryKeys, kv.TblLogAddressKeys, kv.TblTracesFromKeys} {
+		mxTableWatermarks[table] = struct{ min, max, rows metrics.Gauge }{
+			min:  metrics.GetOrCreateGauge(fmt.Sprintf(`domain_table_watermark{table="%s",bound="min"}`, table)),
+			max:  metrics.GetOrCreateGauge(fmt.Sprintf(`domain_table_watermark{table="%s",bound="max"}`, table)),
+			rows: metrics.GetOrCreateGauge(fmt.Sprintf(`domain_table_rows{table="%s"}`, table)),
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+)
+
+// MinimalFileSet - files enough for GetLatest of all domains up to `maxTxNum`: chain of visible .kv files of each domain
+// and their accessors (.bt, .kvei, .kvi) and .step sidecars. No history and inverted indices. Also includes salt file - accessors are built with it,
+// and empty steps of domains (see emptySteps). Aggregator with SetLatestStateOnly(true) opens such set. Returns absolute paths.
+func (a *Aggregator) MinimalFileSet(maxTxNum uint64) ([]string, error) {
+	ac := a.BeginFilesRo()
+	defer ac.Close()
+
+	res := []string{filepath.Join(a.dirs.Snap, "salt-state.txt")}
+	for _, dt := range ac.d {
+		var end uint64
+		for _, item := range dt.files {
+			if item.endTxNum > maxTxNum {
+				break
+			}
+			if item.startTxNum != end && !(item.startTxNum > end && stepsAreEmpty(end, item.startTxNum, dt.emptySteps, a.StepSize())) {
+				return nil, fmt.Errorf("MinimalFileSet: %s has gap in files: %d-%d", dt.d.filenameBase, end, item.startTxNum)
+			}
+			end = item.endTxNum
+			dataPath := item.src.decompressor.FilePath()
+			res = append(res, dataPath)
+
+			// file of other step size keeps its name, see recordedStepSize
+			fromStep, toStep := item.src.steps()
+			for _, fPath := range []string{dataPath + stepSizeSuffix, dt.d.kvBtFilePath(fromStep, toStep), dt.d.kvExistenceIdxFilePath(fromStep, toStep), dt.d.kvAccessorFilePath(fromStep, toStep)} {
+				exists, err := dir.FileExist(fPath)
+				if err != nil {
+					return nil, err
+				}
+				if exists {
+					res = append(res, fPath)
+				}
+			}
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("MinimalFileSet: no %s files up to txNum=%d", dt.d.filenameBase, maxTxNum)
+		}
+		if len(dt.emptySteps) > 0 { // gaps of empty steps must stay covered
+			res = append(res, dt.d.emptySteps.path)
+		}
+	}
+	return res, nil
+}
+
+// SetLatestStateOnly - for Aggregator opened on MinimalFileSet: history files of domains are not expected.
+// Must be called before OpenFolder. History reads behind end of domain files return ErrHistoryExpired instead of
+// falling through to DB.
+func (a *Aggregator) SetLatestStateOnly(v bool) *Aggregator {
+	for _, d := range a.d {
+		d.latestOnly = v
+	}
+	return a
+}
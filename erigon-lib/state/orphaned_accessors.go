@@ -0,0 +1,130 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+)
+
+// accessorOwner - data file type which owns accessor files of 1 type (for example: accounts.kv owns accounts.bt).
+// Sidecar of data file (.step) is owned same way
+type accessorOwner struct {
+	accessorPath, dataPath func(fromStep, toStep uint64) string
+	dirtyFiles             *btree2.BTreeG[*filesItem]
+}
+
+// hasDirtyFile - by steps of file name: files of other step size than configured keep their names
+func (o accessorOwner) hasDirtyFile(fromStep, toStep uint64) (has bool) {
+	o.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if from, to := item.steps(); from == fromStep && to == toStep {
+				has = true
+				return false
+			}
+		}
+		return true
+	})
+	return has
+}
+
+// accessorOwners - key: filenameBase + "." + accessor extension
+func (a *Aggregator) accessorOwners() map[string]accessorOwner {
+	res := map[string]accessorOwner{}
+	add := func(filenameBase, ext string, dirtyFiles *btree2.BTreeG[*filesItem], accessorPath, dataPath func(fromStep, toStep uint64) string) {
+		res[filenameBase+"."+ext] = accessorOwner{accessorPath: accessorPath, dataPath: dataPath, dirtyFiles: dirtyFiles}
+	}
+	addData := func(filenameBase, ext string, dirtyFiles *btree2.BTreeG[*filesItem], dataPath func(fromStep, toStep uint64) string) {
+		add(filenameBase, ext+stepSizeSuffix, dirtyFiles, func(fromStep, toStep uint64) string { return dataPath(fromStep, toStep) + stepSizeSuffix }, dataPath)
+	}
+	for _, d := range a.d {
+		add(d.filenameBase, "bt", d.dirtyFiles, d.kvBtFilePath, d.kvFilePath)
+		add(d.filenameBase, "kvi", d.dirtyFiles, d.kvAccessorFilePath, d.kvFilePath)
+		add(d.filenameBase, "kvei", d.dirtyFiles, d.kvExistenceIdxFilePath, d.kvFilePath)
+		add(d.filenameBase, "kvch", d.dirtyFiles, d.kvCodeHashIdxFilePath, d.kvFilePath)
+		addData(d.filenameBase, "kv", d.dirtyFiles, d.kvFilePath)
+		add(d.History.filenameBase, "vi", d.History.dirtyFiles, d.History.vAccessorFilePath, d.History.vFilePath)
+		addData(d.History.filenameBase, "v", d.History.dirtyFiles, d.History.vFilePath)
+		ii := d.History.InvertedIndex
+		add(ii.filenameBase, "efi", ii.dirtyFiles, ii.efAccessorFilePath, ii.efFilePath)
+		addData(ii.filenameBase, "ef", ii.dirtyFiles, ii.efFilePath)
+	}
+	for _, ii := range a.iis {
+		add(ii.filenameBase, "efi", ii.dirtyFiles, ii.efAccessorFilePath, ii.efFilePath)
+		addData(ii.filenameBase, "ef", ii.dirtyFiles, ii.efFilePath)
+	}
+	for _, ap := range a.ap {
+		if ap == nil {
+			continue
+		}
+		add(ap.filenameBase, "api", ap.dirtyFiles, ap.accessorFilePath, ap.apFilePath)
+		addData(ap.filenameBase, "ap", ap.dirtyFiles, ap.apFilePath)
+	}
+	return res
+}
+
+// CleanupOrphanedAccessors - removes accessor files (.bt, .kvi, .kvei, .kvch, .vi, .efi, .api) and .step sidecars whose data file doesn't exist
+// (after manual deletion of files, failed squeeze, partial download, ...). Accessors of open files are never touched.
+// dryRun - only return list of orphans.
+func (a *Aggregator) CleanupOrphanedAccessors(ctx context.Context, dryRun bool) (removed []string, err error) {
+	owners := a.accessorOwners()
+
+	a.lockDirtyFiles()
+	defer a.unlockDirtyFiles()
+	for _, snapDir := range []string{a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx, a.dirs.SnapAccessors} {
+		fileNames, err := filesFromDir(snapDir)
+		if err != nil {
+			return removed, err
+		}
+		for _, name := range fileNames {
+			select {
+			case <-ctx.Done():
+				return removed, ctx.Err()
+			default:
+			}
+			sidecar := ""
+			if strings.HasSuffix(name, stepSizeSuffix) {
+				sidecar = stepSizeSuffix
+			}
+			subs := stateFileNameRe.FindStringSubmatch(strings.TrimSuffix(name, sidecar))
+			if len(subs) != 6 {
+				continue
+			}
+			o, ok := owners[subs[2]+"."+subs[5]+sidecar]
+			if !ok {
+				continue
+			}
+			fromStep, err1 := strconv.ParseUint(subs[3], 10, 64)
+			toStep, err2 := strconv.ParseUint(subs[4], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			path := filepath.Join(snapDir, name)
+			if o.accessorPath(fromStep, toStep) != path { // other version or dir: not produced by this Erigon
+				continue
+			}
+			exists, err := dir.FileExist(o.dataPath(fromStep, toStep))
+			if err != nil {
+				return removed, err
+			}
+			if exists || o.hasDirtyFile(fromStep, toStep) {
+				continue
+			}
+			removed = append(removed, path)
+			if dryRun {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return removed, fmt.Errorf("CleanupOrphanedAccessors: %w", err)
+			}
+			a.logger.Info("[snapshots] removed orphaned accessor", "file", name)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,312 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+// Salt files in datadir.Dirs.Snap. Hash functions of accessors (recsplit indices, existence filters) are seeded by them:
+// accessor built with one salt is useless with another.
+const (
+	SaltFileLegacy = "salt.txt"        // shared by state and blocks before split. Renamed to SaltFileState on Aggregator start
+	SaltFileState  = "salt-state.txt"  // state accessors: .kvi, .kvei, .kvch, .vi, .efi
+	SaltFileBlocks = "salt-blocks.txt" // block snapshots accessors: .idx
+)
+
+// SaltFamily - group of accessors which share salt file
+type SaltFamily string
+
+const (
+	SaltFamilyState  SaltFamily = "state"
+	SaltFamilyBlocks SaltFamily = "blocks"
+)
+
+// SaltProbe - salt recorded in one accessor of `Kind` (`accounts.kvi`, `headers.idx`)
+type SaltProbe struct {
+	Family SaltFamily
+	Kind   string
+	File   string
+	Salt   uint32
+}
+
+// SaltReport - result of VerifySalts. Salts of files: nil - file doesn't exist
+type SaltReport struct {
+	Legacy, State, Blocks *uint32
+	Probes                []SaltProbe // one accessor of every kind
+}
+
+// FamilySalt - salt which accessors of family must use: salt-state.txt (or legacy salt.txt) for state, salt-blocks.txt for blocks
+func (r SaltReport) FamilySalt(family SaltFamily) *uint32 {
+	if family == SaltFamilyBlocks {
+		return r.Blocks
+	}
+	if r.State != nil {
+		return r.State
+	}
+	return r.Legacy
+}
+
+// Mismatches - probes whose salt differs from salt file of their family. Such accessors produce
+// "index built with different salt" errors
+func (r SaltReport) Mismatches() (res []SaltProbe) {
+	for _, p := range r.Probes {
+		if s := r.FamilySalt(p.Family); s != nil && *s != p.Salt {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Diverged - state and blocks have different salts. It's valid state (see SaltRepairSplit), but datadirs migrated
+// from single salt.txt must not have it
+func (r SaltReport) Diverged() bool {
+	state, blocks := r.FamilySalt(SaltFamilyState), r.FamilySalt(SaltFamilyBlocks)
+	return state != nil && blocks != nil && *state != *blocks
+}
+
+func (r SaltReport) String() string {
+	salt := func(s *uint32) string {
+		if s == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%d", *s)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "salt files: legacy=%s, state=%s, blocks=%s", salt(r.Legacy), salt(r.State), salt(r.Blocks))
+	for _, p := range r.Mismatches() {
+		fmt.Fprintf(&sb, "; %s accessor %s uses salt %d (%s)", p.Family, p.Kind, p.Salt, p.File)
+	}
+	return sb.String()
+}
+
+// VerifySalts - reads salt files and probes one accessor of every kind for salt it was built with. Doesn't modify datadir
+func VerifySalts(dirs datadir.Dirs) (report SaltReport, err error) {
+	if report.Legacy, err = readSaltFile(filepath.Join(dirs.Snap, SaltFileLegacy)); err != nil {
+		return report, err
+	}
+	if report.State, err = readSaltFile(filepath.Join(dirs.Snap, SaltFileState)); err != nil {
+		return report, err
+	}
+	if report.Blocks, err = readSaltFile(filepath.Join(dirs.Snap, SaltFileBlocks)); err != nil {
+		return report, err
+	}
+	accessors, err := saltedAccessors(dirs)
+	if err != nil {
+		return report, err
+	}
+	probed := map[string]struct{}{}
+	for _, a := range accessors {
+		if _, ok := probed[a.kind]; ok || a.ext == ".kvei" { // existence filter doesn't record salt
+			continue
+		}
+		salt, err := indexSalt(a.path)
+		if err != nil {
+			return report, err
+		}
+		probed[a.kind] = struct{}{}
+		report.Probes = append(report.Probes, SaltProbe{Family: a.family, Kind: a.kind, File: filepath.Base(a.path), Salt: salt})
+	}
+	return report, nil
+}
+
+// SaltRepairStrategy - see RepairSalts
+type SaltRepairStrategy uint8
+
+const (
+	// SaltRepairUnify - state and blocks use one salt: salt of family with more accessors. Accessors built with
+	// other salt are deleted and will be re-built
+	SaltRepairUnify SaltRepairStrategy = iota
+	// SaltRepairSplit - every family has own salt: salt used by most of its accessors is written to its salt file.
+	// Accessors of family built with other salt are deleted and will be re-built
+	SaltRepairSplit
+)
+
+// RepairSalts - makes salt files and accessors consistent by `strategy`. Returns deleted accessors.
+// Must not be called while node is running.
+func RepairSalts(dirs datadir.Dirs, strategy SaltRepairStrategy) (removed []string, err error) {
+	report, err := VerifySalts(dirs)
+	if err != nil {
+		return nil, err
+	}
+	accessors, err := saltedAccessors(dirs)
+	if err != nil {
+		return nil, err
+	}
+	salts := map[string]uint32{} // path -> salt. existence filters have no salt
+	votes := map[SaltFamily]map[uint32]int{SaltFamilyState: {}, SaltFamilyBlocks: {}}
+	for _, a := range accessors {
+		if a.ext == ".kvei" {
+			continue
+		}
+		if salts[a.path], err = indexSalt(a.path); err != nil {
+			return nil, err
+		}
+		votes[a.family][salts[a.path]]++
+	}
+
+	target := map[SaltFamily]*uint32{}
+	for _, family := range []SaltFamily{SaltFamilyState, SaltFamilyBlocks} {
+		target[family] = majoritySalt(votes[family], report.FamilySalt(family))
+	}
+	if strategy == SaltRepairUnify {
+		all := map[uint32]int{}
+		for _, family := range []SaltFamily{SaltFamilyState, SaltFamilyBlocks} {
+			for salt, cnt := range votes[family] {
+				all[salt] += cnt
+			}
+		}
+		fallback := target[SaltFamilyState]
+		if fallback == nil {
+			fallback = target[SaltFamilyBlocks]
+		}
+		unified := majoritySalt(all, fallback)
+		target[SaltFamilyState], target[SaltFamilyBlocks] = unified, unified
+	}
+
+	for _, a := range accessors {
+		salt := target[a.family]
+		if salt == nil {
+			continue
+		}
+		if a.ext == ".kvei" {
+			// existence filters are built with state salt, but don't record it
+			if state := report.FamilySalt(SaltFamilyState); state != nil && *state == *salt {
+				continue
+			}
+		} else if salts[a.path] == *salt {
+			continue
+		}
+		if err := os.Remove(a.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, a.path)
+	}
+
+	for family, name := range map[SaltFamily]string{SaltFamilyState: SaltFileState, SaltFamilyBlocks: SaltFileBlocks} {
+		if target[family] == nil {
+			continue
+		}
+		if err := writeSaltFile(filepath.Join(dirs.Snap, name), *target[family]); err != nil {
+			return removed, err
+		}
+	}
+	if report.Legacy != nil && target[SaltFamilyState] != nil {
+		// salt-state.txt is written: legacy file is not needed anymore
+		if err := os.Remove(filepath.Join(dirs.Snap, SaltFileLegacy)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+	if err := dir.FsyncDir(dirs.Snap); err != nil {
+		return removed, err
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// majoritySalt - salt used by most of accessors. Ties: `fallback` (salt file) wins, then smaller salt.
+// No accessors - `fallback`
+func majoritySalt(votes map[uint32]int, fallback *uint32) *uint32 {
+	salts := make([]uint32, 0, len(votes))
+	for salt := range votes {
+		salts = append(salts, salt)
+	}
+	slices.Sort(salts)
+	best := fallback
+	for _, salt := range salts {
+		salt := salt
+		if best == nil || votes[salt] > votes[*best] {
+			best = &salt
+		}
+	}
+	return best
+}
+
+type saltedAccessor struct {
+	family SaltFamily
+	kind   string // `accounts.kvi`, `headers.idx`
+	ext    string
+	path   string
+}
+
+// saltedAccessors - accessors which depend on salt, sorted by path
+func saltedAccessors(dirs datadir.Dirs) (res []saltedAccessor, err error) {
+	scan := func(family SaltFamily, dirPath string, exts ...string) error {
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.IsDir() || !slices.Contains(exts, ext) {
+				continue
+			}
+			res = append(res, saltedAccessor{family: family, kind: accessorKind(family, e.Name()), ext: ext, path: filepath.Join(dirPath, e.Name())})
+		}
+		return nil
+	}
+	if err := scan(SaltFamilyBlocks, dirs.Snap, ".idx"); err != nil {
+		return nil, err
+	}
+	if err := scan(SaltFamilyState, dirs.SnapDomain, ".kvi", ".kvei", ".kvch"); err != nil {
+		return nil, err
+	}
+	if err := scan(SaltFamilyState, dirs.SnapAccessors, ".vi", ".efi"); err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].path < res[j].path })
+	return res, nil
+}
+
+// accessorKind - `v1-000000-000500-headers.idx` -> `headers.idx`, `v1-accounts.0-32.kvi` -> `accounts.kvi`
+func accessorKind(family SaltFamily, name string) string {
+	if family == SaltFamilyBlocks {
+		parts := strings.SplitN(name, "-", 4)
+		return parts[len(parts)-1]
+	}
+	_, base, _ := strings.Cut(name, "-")
+	base, _, _ = strings.Cut(base, ".")
+	return base + filepath.Ext(name)
+}
+
+func indexSalt(path string) (uint32, error) {
+	idx, err := recsplit.OpenIndex(path)
+	if err != nil {
+		return 0, fmt.Errorf("probe salt of %s: %w", filepath.Base(path), err)
+	}
+	defer idx.Close()
+	return idx.Salt(), nil
+}
+
+func readSaltFile(path string) (*uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("salt file %s: expected 4 bytes, got %d", filepath.Base(path), len(data))
+	}
+	salt := binary.BigEndian.Uint32(data)
+	return &salt, nil
+}
+
+func writeSaltFile(path string, salt uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, salt)
+	return dir.WriteFileWithFsync(path, data, os.ModePerm)
+}
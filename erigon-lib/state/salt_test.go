@@ -0,0 +1,137 @@
+package state
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+func TestSalts(t *testing.T) {
+	buildIndex := func(t *testing.T, path string, salt uint32) {
+		t.Helper()
+		rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+			KeyCount: 2, BucketSize: 10, LeafSize: 8, Salt: &salt, TmpDir: t.TempDir(), IndexFile: path,
+		}, log.New())
+		require.NoError(t, err)
+		defer rs.Close()
+		require.NoError(t, rs.AddKey([]byte("a"), 0))
+		require.NoError(t, rs.AddKey([]byte("b"), 1))
+		require.NoError(t, rs.Build(context.Background()))
+	}
+	// partially migrated datadir: state uses salt 1, blocks - 2. One accessor of each family built with other salt
+	fixture := func(t *testing.T) datadir.Dirs {
+		dirs := datadir.New(t.TempDir())
+		require.NoError(t, writeSaltFile(filepath.Join(dirs.Snap, SaltFileState), 1))
+		require.NoError(t, writeSaltFile(filepath.Join(dirs.Snap, SaltFileBlocks), 2))
+		buildIndex(t, filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvi"), 1)
+		buildIndex(t, filepath.Join(dirs.SnapDomain, "v1-storage.0-32.kvi"), 1)
+		buildIndex(t, filepath.Join(dirs.SnapAccessors, "v1-accounts.0-32.efi"), 2)
+		buildIndex(t, filepath.Join(dirs.Snap, "v1-000000-000500-headers.idx"), 2)
+		buildIndex(t, filepath.Join(dirs.Snap, "v1-000000-000500-bodies.idx"), 2)
+		buildIndex(t, filepath.Join(dirs.Snap, "v1-000000-000500-transactions.idx"), 1)
+		require.NoError(t, os.WriteFile(filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvei"), []byte{1}, 0644))
+		return dirs
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	readSalt := func(t *testing.T, path string) uint32 {
+		t.Helper()
+		salt, err := readSaltFile(path)
+		require.NoError(t, err)
+		require.NotNil(t, salt)
+		return *salt
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		dirs := fixture(t)
+		report, err := VerifySalts(dirs)
+		require.NoError(t, err)
+		require.Nil(t, report.Legacy)
+		require.Equal(t, uint32(1), *report.State)
+		require.Equal(t, uint32(2), *report.Blocks)
+		require.True(t, report.Diverged())
+		require.Len(t, report.Probes, 6) // one per kind, existence filter has no salt
+		require.Equal(t, []SaltProbe{
+			{Family: SaltFamilyState, Kind: "accounts.efi", File: "v1-accounts.0-32.efi", Salt: 2},
+			{Family: SaltFamilyBlocks, Kind: "transactions.idx", File: "v1-000000-000500-transactions.idx", Salt: 1},
+		}, report.Mismatches())
+	})
+
+	t.Run("split", func(t *testing.T) {
+		dirs := fixture(t)
+		removed, err := RepairSalts(dirs, SaltRepairSplit)
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			filepath.Join(dirs.SnapAccessors, "v1-accounts.0-32.efi"),
+			filepath.Join(dirs.Snap, "v1-000000-000500-transactions.idx"),
+		}, removed)
+		require.True(t, exists(filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvei")))
+		require.Equal(t, uint32(1), readSalt(t, filepath.Join(dirs.Snap, SaltFileState)))
+		require.Equal(t, uint32(2), readSalt(t, filepath.Join(dirs.Snap, SaltFileBlocks)))
+
+		report, err := VerifySalts(dirs)
+		require.NoError(t, err)
+		require.Empty(t, report.Mismatches())
+	})
+
+	t.Run("unify", func(t *testing.T) {
+		dirs := fixture(t)
+		removed, err := RepairSalts(dirs, SaltRepairUnify)
+		require.NoError(t, err)
+		// 3 accessors per salt: salt of state file wins the tie
+		require.Equal(t, []string{
+			filepath.Join(dirs.SnapAccessors, "v1-accounts.0-32.efi"),
+			filepath.Join(dirs.Snap, "v1-000000-000500-bodies.idx"),
+			filepath.Join(dirs.Snap, "v1-000000-000500-headers.idx"),
+		}, removed)
+		require.True(t, exists(filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvei")))
+		require.Equal(t, uint32(1), readSalt(t, filepath.Join(dirs.Snap, SaltFileState)))
+		require.Equal(t, uint32(1), readSalt(t, filepath.Join(dirs.Snap, SaltFileBlocks)))
+
+		report, err := VerifySalts(dirs)
+		require.NoError(t, err)
+		require.Empty(t, report.Mismatches())
+		require.False(t, report.Diverged())
+	})
+
+	t.Run("unify to blocks salt", func(t *testing.T) {
+		dirs := fixture(t)
+		buildIndex(t, filepath.Join(dirs.Snap, "v1-000500-001000-headers.idx"), 2)
+		removed, err := RepairSalts(dirs, SaltRepairUnify)
+		require.NoError(t, err)
+		// state salt changed: existence filters are re-built too
+		require.Equal(t, []string{
+			filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvei"),
+			filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvi"),
+			filepath.Join(dirs.SnapDomain, "v1-storage.0-32.kvi"),
+			filepath.Join(dirs.Snap, "v1-000000-000500-transactions.idx"),
+		}, removed)
+		require.Equal(t, uint32(2), readSalt(t, filepath.Join(dirs.Snap, SaltFileState)))
+		require.Equal(t, uint32(2), readSalt(t, filepath.Join(dirs.Snap, SaltFileBlocks)))
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		dirs := datadir.New(t.TempDir())
+		require.NoError(t, writeSaltFile(filepath.Join(dirs.Snap, SaltFileLegacy), 5))
+		buildIndex(t, filepath.Join(dirs.SnapDomain, "v1-accounts.0-32.kvi"), 5)
+		report, err := VerifySalts(dirs)
+		require.NoError(t, err)
+		require.Equal(t, uint32(5), *report.FamilySalt(SaltFamilyState))
+		require.Empty(t, report.Mismatches())
+
+		removed, err := RepairSalts(dirs, SaltRepairSplit)
+		require.NoError(t, err)
+		require.Empty(t, removed)
+		require.Equal(t, uint32(5), readSalt(t, filepath.Join(dirs.Snap, SaltFileState)))
+		require.False(t, exists(filepath.Join(dirs.Snap, SaltFileLegacy)))
+	})
+}
@@ -0,0 +1,288 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// ExportFormat - format of records produced by AggregatorRoTx.ExportLatestState. One record per account, records are
+// sorted by address, storage of account - by slot.
+type ExportFormat uint8
+
+const (
+	// ExportJSONLines - one JSON object per line:
+	//   {"address":"0x..","nonce":1,"balance":"0x..","codeHash":"0x..","code":"0x..","storage":{"0x<slot>":"0x<value>"}}
+	// codeHash, code and storage are omitted when empty
+	ExportJSONLines ExportFormat = iota
+	// ExportBinary - per account:
+	//   address(20) | nonce(uvarint) | balance | codeHash | code | (slot | value)* | 0(uvarint)
+	// balance, codeHash, code, slot and value are uvarint length-prefixed bytes; 0 terminates storage of account
+	ExportBinary
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportJSONLines:
+		return "jsonl"
+	case ExportBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(f))
+	}
+}
+
+// exportProgressEvery - accounts between flushes of output and calls of progress
+var exportProgressEvery uint64 = 10_000
+
+// ExportLatestState - streams latest state of files: accounts with their storage and code, sorted by address. Same files
+// produce identical bytes. DB is not read: state is as of end of visible files.
+//
+// progress is called after output of all preceding accounts is written to `w`: `lastKey` is address of last written
+// account. Export interrupted after progress(_, lastKey) call and restarted with resumeFrom=lastKey appends
+// exactly the rest of records - concatenation is identical to uninterrupted export. Output written after last progress
+// call must be truncated by caller. resumeFrom=nil - from the beginning.
+func (ac *AggregatorRoTx) ExportLatestState(ctx context.Context, w io.Writer, format ExportFormat, resumeFrom []byte, progress func(keysDone uint64, lastKey []byte)) error {
+	if format != ExportJSONLines && format != ExportBinary {
+		return fmt.Errorf("ExportLatestState: unsupported format %s", format)
+	}
+	var from []byte
+	if resumeFrom != nil {
+		from = append(common.Copy(resumeFrom), 0) // first key after resumeFrom
+	}
+
+	accounts, err := ac.DomainRangeLatest(nil, kv.AccountsDomain, from, nil, -1)
+	if err != nil {
+		return fmt.Errorf("ExportLatestState: %w", err)
+	}
+	defer accounts.Close()
+	storage, err := newPeekKV(ac.DomainRangeLatest(nil, kv.StorageDomain, from, nil, -1))
+	if err != nil {
+		return fmt.Errorf("ExportLatestState: %w", err)
+	}
+	defer storage.Close()
+	code, err := newPeekKV(ac.DomainRangeLatest(nil, kv.CodeDomain, from, nil, -1))
+	if err != nil {
+		return fmt.Errorf("ExportLatestState: %w", err)
+	}
+	defer code.Close()
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+	e := &stateExporter{w: bw, format: format}
+	var keysDone uint64
+	var lastKey []byte
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if progress != nil && lastKey != nil {
+			progress(keysDone, lastKey)
+		}
+		return nil
+	}
+
+	for accounts.HasNext() {
+		addr, accVal, err := accounts.Next()
+		if err != nil {
+			return fmt.Errorf("ExportLatestState: %w", err)
+		}
+		// storage and code of deleted accounts are deleted too, but skip leftovers (if any) to keep records sorted
+		if err := code.skipUntil(addr); err != nil {
+			return fmt.Errorf("ExportLatestState: %w", err)
+		}
+		var codeVal []byte
+		if code.has && bytes.Equal(code.k, addr) {
+			codeVal = code.v
+		}
+		if err := storage.skipUntil(addr); err != nil {
+			return fmt.Errorf("ExportLatestState: %w", err)
+		}
+
+		if err := e.account(addr, accVal, codeVal); err != nil {
+			return fmt.Errorf("ExportLatestState: %w", err)
+		}
+		for storage.has && bytes.HasPrefix(storage.k, addr) {
+			if err := e.slot(storage.k[length.Addr:], storage.v); err != nil {
+				return fmt.Errorf("ExportLatestState: %w", err)
+			}
+			if err := storage.advance(); err != nil {
+				return fmt.Errorf("ExportLatestState: %w", err)
+			}
+		}
+		if err := e.end(); err != nil {
+			return fmt.Errorf("ExportLatestState: %w", err)
+		}
+
+		keysDone++
+		lastKey = append(lastKey[:0], addr...)
+		if keysDone%exportProgressEvery == 0 {
+			if err := flush(); err != nil {
+				return fmt.Errorf("ExportLatestState: %w", err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("ExportLatestState: %w", err)
+	}
+	return nil
+}
+
+// peekKV - iter.KV with copy of current pair
+type peekKV struct {
+	it   iter.KV
+	has  bool
+	k, v []byte
+}
+
+func newPeekKV(it iter.KV, err error) (*peekKV, error) {
+	if err != nil {
+		return nil, err
+	}
+	p := &peekKV{it: it}
+	if err := p.advance(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *peekKV) advance() error {
+	if !p.it.HasNext() {
+		p.has = false
+		return nil
+	}
+	k, v, err := p.it.Next()
+	if err != nil {
+		return err
+	}
+	p.has, p.k, p.v = true, append(p.k[:0], k...), append(p.v[:0], v...)
+	return nil
+}
+
+// skipUntil - advances to first key >= prefix
+func (p *peekKV) skipUntil(prefix []byte) error {
+	for p.has && bytes.Compare(p.k, prefix) < 0 {
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *peekKV) Close() { p.it.Close() }
+
+type stateExporter struct {
+	w      *bufio.Writer
+	format ExportFormat
+	slots  int // of current account
+	buf    []byte
+}
+
+func (e *stateExporter) account(addr, accVal, code []byte) error {
+	nonce, balance, codeHash := types.DecodeAccountBytesV3(accVal)
+	e.slots = 0
+	if e.format == ExportBinary {
+		e.buf = append(e.buf[:0], addr...)
+		e.buf = binary.AppendUvarint(e.buf, nonce)
+		var balanceBytes []byte
+		if balance != nil && !balance.IsZero() {
+			balanceBytes = balance.Bytes()
+		}
+		e.buf = appendLenPrefixed(e.buf, balanceBytes)
+		e.buf = appendLenPrefixed(e.buf, codeHash)
+		e.buf = appendLenPrefixed(e.buf, code)
+		_, err := e.w.Write(e.buf)
+		return err
+	}
+
+	e.buf = append(e.buf[:0], `{"address":"0x`...)
+	e.buf = appendHex(e.buf, addr)
+	e.buf = append(e.buf, `","nonce":`...)
+	e.buf = strconv.AppendUint(e.buf, nonce, 10)
+	e.buf = append(e.buf, `,"balance":"`...)
+	if balance == nil || balance.IsZero() {
+		e.buf = append(e.buf, "0x0"...)
+	} else {
+		e.buf = append(e.buf, balance.Hex()...)
+	}
+	e.buf = append(e.buf, '"')
+	if len(codeHash) > 0 {
+		e.buf = append(e.buf, `,"codeHash":"0x`...)
+		e.buf = appendHex(e.buf, codeHash)
+		e.buf = append(e.buf, '"')
+	}
+	if len(code) > 0 {
+		e.buf = append(e.buf, `,"code":"0x`...)
+		e.buf = appendHex(e.buf, code)
+		e.buf = append(e.buf, '"')
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *stateExporter) slot(loc, val []byte) error {
+	if e.format == ExportBinary {
+		e.buf = appendLenPrefixed(e.buf[:0], loc)
+		e.buf = appendLenPrefixed(e.buf, val)
+		_, err := e.w.Write(e.buf)
+		return err
+	}
+
+	e.buf = e.buf[:0]
+	if e.slots == 0 {
+		e.buf = append(e.buf, `,"storage":{`...)
+	} else {
+		e.buf = append(e.buf, ',')
+	}
+	e.buf = append(e.buf, `"0x`...)
+	e.buf = appendHex(e.buf, loc)
+	e.buf = append(e.buf, `":"0x`...)
+	e.buf = appendHex(e.buf, val)
+	e.buf = append(e.buf, '"')
+	e.slots++
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *stateExporter) end() error {
+	if e.format == ExportBinary {
+		e.buf = binary.AppendUvarint(e.buf[:0], 0)
+		_, err := e.w.Write(e.buf)
+		return err
+	}
+	e.buf = e.buf[:0]
+	if e.slots > 0 {
+		e.buf = append(e.buf, '}')
+	}
+	e.buf = append(e.buf, "}\n"...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func appendLenPrefixed(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendHex(buf, b []byte) []byte {
+	const hextable = "0123456789abcdef"
+	for _, c := range b {
+		buf = append(buf, hextable[c>>4], hextable[c&0x0f])
+	}
+	return buf
+}
@@ -0,0 +1,166 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+func TestAggregatorV3_ExportLatestState(t *testing.T) {
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+	rwTx, err := db.BeginRwNosync(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if rwTx != nil {
+			rwTx.Rollback()
+		}
+	}()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	// every 3rd account has code, every 2nd - storage. Some accounts are updated in later steps
+	const accounts = 100
+	addrs := make([][]byte, accounts)
+	rnd := rand.New(rand.NewSource(0))
+	txNum := uint64(0)
+	for i := range addrs {
+		domains.SetTxNum(txNum)
+		addrs[i] = make([]byte, length.Addr)
+		rnd.Read(addrs[i])
+		var codeHash []byte
+		if i%3 == 0 {
+			code := []byte{0x60, byte(i)}
+			codeHash = make([]byte, length.Hash)
+			rnd.Read(codeHash)
+			require.NoError(t, domains.DomainPut(kv.CodeDomain, addrs[i], nil, code, nil, 0))
+		}
+		acc := types.EncodeAccountBytesV3(uint64(i), uint256.NewInt(uint64(i)*1e6), codeHash, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addrs[i], nil, acc, nil, 0))
+		if i%2 == 0 {
+			for j := 0; j < 3; j++ {
+				loc := make([]byte, length.Hash)
+				rnd.Read(loc)
+				require.NoError(t, domains.DomainPut(kv.StorageDomain, addrs[i], loc, []byte{byte(i), byte(j)}, nil, 0))
+			}
+		}
+		txNum++
+	}
+	for i := 0; i < accounts; i += 7 {
+		if i%3 == 0 {
+			continue // keep codeHash of accounts with code
+		}
+		domains.SetTxNum(txNum)
+		acc := types.EncodeAccountBytesV3(uint64(i)+1000, uint256.NewInt(1), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addrs[i], nil, acc, nil, 0))
+		txNum++
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	rwTx = nil
+
+	for step := uint64(0); step <= txNum/agg.StepSize(); step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+
+	export := func(format ExportFormat, resumeFrom []byte, progress func(uint64, []byte)) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		require.NoError(t, ac.ExportLatestState(ctx, &buf, format, resumeFrom, progress))
+		return buf.Bytes()
+	}
+
+	full := export(ExportJSONLines, nil, nil)
+	require.Equal(t, full, export(ExportJSONLines, nil, nil), "same files - same bytes")
+
+	type record struct {
+		Address  string
+		Nonce    uint64
+		Code     string
+		CodeHash string
+		Storage  map[string]string
+	}
+	var records []record
+	sc := bufio.NewScanner(bytes.NewReader(full))
+	for sc.Scan() {
+		var r record
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, sc.Err())
+	require.Len(t, records, accounts)
+	require.True(t, sort.SliceIsSorted(records, func(i, j int) bool { return records[i].Address < records[j].Address }))
+	var withCode, withStorage int
+	for _, r := range records {
+		if r.Code != "" {
+			withCode++
+			require.NotEmpty(t, r.CodeHash, r.Address)
+		}
+		if len(r.Storage) > 0 {
+			withStorage++
+			require.Len(t, r.Storage, 3, r.Address)
+		}
+		if r.Nonce >= 1000 {
+			require.Zero(t, (r.Nonce-1000)%7, "latest value of account %s", r.Address)
+		}
+	}
+	require.Equal(t, (accounts+2)/3, withCode)
+	require.Equal(t, accounts/2, withStorage)
+
+	maxAddr := addrs[0]
+	for _, addr := range addrs {
+		if bytes.Compare(addr, maxAddr) > 0 {
+			maxAddr = addr
+		}
+	}
+	for _, format := range []ExportFormat{ExportJSONLines, ExportBinary} {
+		full := export(format, nil, nil)
+		require.Equal(t, full, export(format, nil, nil), "same files - same bytes")
+
+		t.Run(format.String()+" resume", func(t *testing.T) {
+			defer func(v uint64) { exportProgressEvery = v }(exportProgressEvery)
+			exportProgressEvery = 9
+
+			// interrupt after some progress: output after last progress call is discarded
+			var calls []uint64
+			var written int
+			var lastKey []byte
+			var buf bytes.Buffer
+			err := ac.ExportLatestState(ctx, &buf, format, nil, func(keysDone uint64, k []byte) {
+				calls = append(calls, keysDone)
+				if len(calls) == 4 {
+					written, lastKey = buf.Len(), append([]byte{}, k...)
+				}
+			})
+			require.NoError(t, err)
+			require.Equal(t, full, buf.Bytes())
+			require.Equal(t, []uint64{9, 18, 27, 36, 45, 54, 63, 72, 81, 90, 99, 100}, calls)
+
+			rest := export(format, lastKey, nil)
+			require.Equal(t, full, append(append([]byte{}, full[:written]...), rest...))
+
+			// resume from last account - nothing left
+			require.Empty(t, export(format, maxAddr, nil))
+		})
+	}
+}
@@ -127,8 +127,16 @@ func (sii *ScanIteratorInc) Next() (uint64, error) {
 }
 
 func (hs *HistoryStep) iterateTxs() *ScanIteratorInc {
+	return newScanIteratorInc(hs.indexFile.getter)
+}
+
+func (is *InvertedIndexStep) iterateTxs() *ScanIteratorInc {
+	return newScanIteratorInc(is.indexFile.getter)
+}
+
+func newScanIteratorInc(g *seg.Getter) *ScanIteratorInc {
 	var sii ScanIteratorInc
-	sii.g = hs.indexFile.getter
+	sii.g = g
 	sii.g.Reset(0)
 	if sii.g.HasNext() {
 		sii.key, _ = sii.g.NextUncompressed()
@@ -0,0 +1,178 @@
+// Package statetest - helpers for tests of anything on top of state.Aggregator:
+// in-memory Aggregator and deterministic generator of state data (with built files).
+package statetest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/kv/temporal"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/state"
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// NewTestAggregator - opened Aggregator over in-memory DB, files are in tb.TempDir(). Everything is closed at test end.
+// Returned DB is temporal (its txs have AggTx): can be passed to state.NewSharedDomains.
+func NewTestAggregator(tb testing.TB, stepSize uint64) (*state.Aggregator, kv.RwDB, datadir.Dirs) {
+	tb.Helper()
+	dirs := datadir.New(tb.TempDir())
+	db := memdb.NewTestDB(tb)
+	agg, err := state.NewAggregator(context.Background(), dirs, stepSize, db, nil, state.DefaultCommitmentValuesTransform, log.New())
+	require.NoError(tb, err)
+	tb.Cleanup(agg.Close)
+	require.NoError(tb, agg.OpenFolder())
+	agg.DisableFsync()
+
+	tdb, err := temporal.New(db, agg)
+	require.NoError(tb, err)
+	return agg, tdb, dirs
+}
+
+// GenSpec - what GenerateState produces. Same spec (including Seed) - same data and same files.
+type GenSpec struct {
+	Seed         int64
+	Steps        uint64 // txNums [1, Steps*stepSize] are written, files are built for first `Steps` steps
+	Accounts     int    // every txNum updates 1 account of this pool
+	StorageSlots int    // every txNum updates 1 slot (of this pool) of same account
+	CodeEvery    uint64 // every CodeEvery-th txNum also updates code of same account. 0 - no code
+	TxsPerBlock  uint64 // commitment is computed at end of every block
+}
+
+func DefaultGenSpec(steps uint64) GenSpec {
+	return GenSpec{Seed: 1, Steps: steps, Accounts: 32, StorageSlots: 8, CodeEvery: 5, TxsPerBlock: 4}
+}
+
+// Validate - spec which GenerateState can produce: pools of accounts and slots and blocks must be not empty
+func (s GenSpec) Validate() error {
+	if s.Accounts <= 0 || s.StorageSlots <= 0 {
+		return fmt.Errorf("statetest: Accounts=%d and StorageSlots=%d must be positive", s.Accounts, s.StorageSlots)
+	}
+	if s.TxsPerBlock == 0 {
+		return fmt.Errorf("statetest: TxsPerBlock must be positive")
+	}
+	return nil
+}
+
+// Write - value of key written at TxNum
+type Write struct {
+	TxNum uint64
+	Value []byte
+}
+
+// GenResult - expected content of Aggregator after GenerateState. Keys are k1+k2 (address+location for storage).
+// Commitment values are not tracked: use Roots.
+type GenResult struct {
+	Writes   [kv.DomainLen]map[string][]Write         // key -> all writes, ascending by TxNum
+	Indices  [kv.StandaloneIdxLen]map[string][]uint64 // key -> ascending txNums
+	Roots    map[uint64][]byte                        // blockNum -> state root
+	MaxTxNum uint64
+}
+
+// Latest - value of key after last write
+func (r *GenResult) Latest(domain kv.Domain, key []byte) (v []byte, ok bool) {
+	writes := r.Writes[domain][string(key)]
+	if len(writes) == 0 {
+		return nil, false
+	}
+	return writes[len(writes)-1].Value, true
+}
+
+// AsOf - value of key before txNum (same semantic as AggregatorRoTx.DomainGetAsOf)
+func (r *GenResult) AsOf(domain kv.Domain, key []byte, txNum uint64) (v []byte, ok bool) {
+	writes := r.Writes[domain][string(key)]
+	i := sort.Search(len(writes), func(i int) bool { return writes[i].TxNum >= txNum })
+	if i == 0 {
+		return nil, false
+	}
+	return writes[i-1].Value, true
+}
+
+// GenerateState - deterministically writes accounts, storage, code (and commitment) and all standalone indices
+// through state.SharedDomains, builds (and merges) files. `db` must be temporal - see NewTestAggregator.
+func GenerateState(tb testing.TB, db kv.RwDB, agg *state.Aggregator, spec GenSpec) *GenResult {
+	tb.Helper()
+	require.NoError(tb, spec.Validate())
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(spec.Seed))
+	res := &GenResult{Roots: map[uint64][]byte{}, MaxTxNum: spec.Steps * agg.StepSize()}
+	for id := range res.Writes {
+		res.Writes[id] = map[string][]Write{}
+	}
+	for id := range res.Indices {
+		res.Indices[id] = map[string][]uint64{}
+	}
+	addrs, locs := make([][]byte, spec.Accounts), make([][]byte, spec.StorageSlots)
+	for i := range addrs {
+		addrs[i] = make([]byte, length.Addr)
+		rnd.Read(addrs[i])
+	}
+	for i := range locs {
+		locs[i] = make([]byte, length.Hash)
+		rnd.Read(locs[i])
+	}
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(tb, err)
+	defer tx.Rollback()
+	domains, err := state.NewSharedDomains(tx, log.New())
+	require.NoError(tb, err)
+
+	put := func(domain kv.Domain, k1, k2, v []byte, txNum uint64) {
+		require.NoError(tb, domains.DomainPut(domain, k1, k2, v, nil, 0))
+		key := string(append(append([]byte{}, k1...), k2...))
+		res.Writes[domain][key] = append(res.Writes[domain][key], Write{TxNum: txNum, Value: v})
+	}
+	index := func(pos kv.InvertedIdxPos, table kv.InvertedIdx, key []byte, txNum uint64) {
+		require.NoError(tb, domains.IndexAdd(table, key))
+		txNums := res.Indices[pos][string(key)]
+		if len(txNums) == 0 || txNums[len(txNums)-1] != txNum {
+			res.Indices[pos][string(key)] = append(txNums, txNum)
+		}
+	}
+	nonces := make([]uint64, spec.Accounts)
+	for txNum := uint64(1); txNum <= res.MaxTxNum; txNum++ {
+		blockNum := txNum / spec.TxsPerBlock
+		domains.SetBlockNum(blockNum)
+		domains.SetTxNum(txNum)
+
+		acc, to, slot := rnd.Intn(spec.Accounts), rnd.Intn(spec.Accounts), rnd.Intn(spec.StorageSlots)
+		addr := addrs[acc]
+		nonces[acc]++
+		put(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(nonces[acc], uint256.NewInt(txNum), nil, 0), txNum)
+		put(kv.StorageDomain, addr, locs[slot], binary.BigEndian.AppendUint64(nil, txNum), txNum)
+		if spec.CodeEvery > 0 && txNum%spec.CodeEvery == 0 {
+			code := make([]byte, 1+rnd.Intn(64))
+			rnd.Read(code)
+			put(kv.CodeDomain, addr, nil, code, txNum)
+		}
+
+		index(kv.LogAddrIdxPos, kv.LogAddrIdx, addr, txNum)
+		index(kv.LogTopicIdxPos, kv.LogTopicIdx, locs[slot], txNum)
+		index(kv.TracesFromIdxPos, kv.TblTracesFromIdx, addr, txNum)
+		index(kv.TracesToIdxPos, kv.TblTracesToIdx, addrs[to], txNum)
+
+		if (txNum+1)%spec.TxsPerBlock == 0 { // last txNum of block
+			root, err := domains.ComputeCommitment(ctx, true, blockNum, "")
+			require.NoError(tb, err)
+			res.Roots[blockNum] = root
+		}
+	}
+	require.NoError(tb, domains.Flush(ctx, tx))
+	domains.Close()
+	require.NoError(tb, tx.Commit())
+
+	require.NoError(tb, agg.BuildFiles(res.MaxTxNum))
+	return res
+}
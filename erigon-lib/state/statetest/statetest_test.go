@@ -0,0 +1,128 @@
+package statetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// fileHashes - hashes of data files. Accessors are excluded: they depend on random salt.
+func fileHashes(t *testing.T, dirs datadir.Dirs) map[string][32]byte {
+	t.Helper()
+	res := map[string][32]byte{}
+	for _, dir := range []string{dirs.SnapDomain, dirs.SnapHistory, dirs.SnapIdx} {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.IsDir() || (ext != ".kv" && ext != ".v" && ext != ".ef") || strings.HasSuffix(e.Name(), ".tmp") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			require.NoError(t, err)
+			res[e.Name()] = sha256.Sum256(data)
+		}
+	}
+	return res
+}
+
+func TestGenSpec_Validate(t *testing.T) {
+	require.NoError(t, DefaultGenSpec(1).Validate())
+	for name, modify := range map[string]func(*GenSpec){
+		"no txs per block": func(s *GenSpec) { s.TxsPerBlock = 0 },
+		"no accounts":      func(s *GenSpec) { s.Accounts = 0 },
+		"no storage slots": func(s *GenSpec) { s.StorageSlots = -1 },
+	} {
+		spec := DefaultGenSpec(1)
+		modify(&spec)
+		require.Error(t, spec.Validate(), name)
+	}
+}
+
+func TestGenerateState_Deterministic(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	spec := DefaultGenSpec(4)
+
+	agg1, db1, dirs1 := NewTestAggregator(t, 16)
+	res1 := GenerateState(t, db1, agg1, spec)
+	agg2, db2, dirs2 := NewTestAggregator(t, 16)
+	res2 := GenerateState(t, db2, agg2, spec)
+
+	require.Equal(t, res1.Roots, res2.Roots)
+	require.NotEmpty(t, res1.Roots)
+	h1, h2 := fileHashes(t, dirs1), fileHashes(t, dirs2)
+	require.NotEmpty(t, h1)
+	require.Equal(t, h1, h2)
+
+	spec.Seed++
+	agg3, db3, _ := NewTestAggregator(t, 16)
+	res3 := GenerateState(t, db3, agg3, spec)
+	require.NotEqual(t, res1.Roots, res3.Roots)
+}
+
+func TestGenerateState_ReadBack(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	agg, db, _ := NewTestAggregator(t, 16)
+	res := GenerateState(t, db, agg, DefaultGenSpec(4))
+	require.Equal(t, uint64(4*16), agg.EndTxNumMinimax())
+
+	ctx := context.Background()
+	tx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+
+	for _, domain := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain} {
+		require.NotEmpty(t, res.Writes[domain], domain)
+		for key, writes := range res.Writes[domain] {
+			k := []byte(key)
+			var k1, k2 []byte = k, nil
+			if domain == kv.StorageDomain {
+				k1, k2 = k[:length.Addr], k[length.Addr:]
+			}
+			want, _ := res.Latest(domain, k)
+			v, _, ok, err := ac.GetLatest(domain, k1, k2, tx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, want, v, "%s %x", domain, k)
+
+			for _, w := range writes {
+				want, ok := res.AsOf(domain, k, w.TxNum)
+				if !ok {
+					continue
+				}
+				v, ok, err := ac.DomainGetAsOf(tx, domain, k, w.TxNum)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, want, v, "%s %x asOf %d", domain, k, w.TxNum)
+			}
+		}
+	}
+
+	for pos, table := range []kv.InvertedIdx{kv.LogAddrIdx, kv.LogTopicIdx, kv.TblTracesFromIdx, kv.TblTracesToIdx} {
+		require.NotEmpty(t, res.Indices[pos], table)
+		for key, want := range res.Indices[pos] {
+			it, err := ac.IndexRange(table, []byte(key), -1, -1, order.Asc, -1, tx)
+			require.NoError(t, err)
+			got, err := iter.ToArrayU64(it)
+			require.NoError(t, err)
+			require.Equal(t, want, got, "%s %x", table, key)
+		}
+	}
+}
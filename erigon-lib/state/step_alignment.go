@@ -0,0 +1,218 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/seg"
+)
+
+// Block-aligned steps:
+//   - steps are defined in txNums, so step boundary can fall into the middle of block. Then content of files depends on
+//     how far node executed the block which straddles the boundary - and files of different nodes are not byte-identical.
+//   - in this mode step S of history and inverted indices is collated up to the last txNum of the largest block which
+//     is fully inside of S. Rest of S goes to the next file: file of step S+1 starts exactly where S ended.
+//   - file names stay step-based. Actual [from, to) is recorded in file header (see seg.Compressor.SetTxNumRange) only
+//     if it differs from range of name. Merged file covers [from of first, to of last] of its sources.
+//   - domain values are stored in DB per-step. .kv file of step S has last values as of end of its range: keys are found
+//     by inverted index, values of keys changed after the range are taken from history. Domains without history (and
+//     without history files) keep per-step .kv files.
+//   - DB values of step S are not pruned until files cover S entirely, see visibleFiles.dataEndTxNum. On ties of latest
+//     values of DB and file which ends in the middle of the same step, DB wins: see filesItem.latestTxNum.
+
+// BlockLastTxNumFunc - tx2block mapping used by block-aligned steps: last txNum of the largest block whose
+// last txNum < txNum. ok=false - there is no such block
+type BlockLastTxNumFunc func(tx kv.Tx, txNum uint64) (lastTxNum uint64, ok bool, err error)
+
+// BlockLastTxNumByTxNums - BlockLastTxNumFunc by kv.MaxTxNum table, see rawdbv3.TxNums
+func BlockLastTxNumByTxNums(tx kv.Tx, txNum uint64) (lastTxNum uint64, ok bool, err error) {
+	found, blockNum, err := rawdbv3.TxNums.FindBlockNum(tx, txNum)
+	if err != nil {
+		return 0, false, err
+	}
+	if !found { // all blocks end before txNum
+		_, lastTxNum, err = rawdbv3.TxNums.Last(tx)
+		if err != nil {
+			return 0, false, err
+		}
+		return lastTxNum, lastTxNum < txNum, nil
+	}
+	if blockNum == 0 {
+		return 0, false, nil
+	}
+	lastTxNum, err = rawdbv3.TxNums.Max(tx, blockNum-1)
+	if err != nil {
+		return 0, false, err
+	}
+	return lastTxNum, true, nil
+}
+
+// SetBlockAlignedSteps - nil: steps are split by txNums only (default)
+func (a *Aggregator) SetBlockAlignedSteps(blockLastTxNum BlockLastTxNumFunc) {
+	a.blockLastTxNum = blockLastTxNum
+}
+
+// stepDataRange - [from, to) of txNums which history and inverted indices collate for `step`
+func (a *Aggregator) stepDataRange(tx kv.Tx, step uint64) (from, to uint64, err error) {
+	from, to = a.FirstTxNumOfStep(step), a.FirstTxNumOfStep(step+1)
+	if a.blockLastTxNum == nil {
+		return from, to, nil
+	}
+	if step > 0 {
+		ac := a.BeginFilesRo()
+		recorded, ok := ac.dataEndOfFilesEndingAt(from)
+		ac.Close()
+		if ok {
+			from = recorded
+		} else if from, err = a.blockAlignedEnd(tx, from); err != nil {
+			return 0, 0, err
+		}
+	}
+	if to, err = a.blockAlignedEnd(tx, to); err != nil {
+		return 0, 0, err
+	}
+	return from, max(from, to), nil
+}
+
+// blockAlignedEnd - first txNum after the largest block which ends before `txNum`
+func (a *Aggregator) blockAlignedEnd(tx kv.Tx, txNum uint64) (uint64, error) {
+	lastTxNum, ok, err := a.blockLastTxNum(tx, txNum)
+	if err != nil {
+		return 0, fmt.Errorf("block-aligned end of %d: %w", txNum, err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	return lastTxNum + 1, nil
+}
+
+// dataEndOfFilesEndingAt - where data of files whose name ends at `txNum` actually ends. ok=false - no such files
+func (ac *AggregatorRoTx) dataEndOfFilesEndingAt(txNum uint64) (dataEnd uint64, ok bool) {
+	iits := make([]*InvertedIndexRoTx, 0, len(ac.d)+len(ac.iis))
+	for _, d := range ac.d {
+		if d.d.snapshotsDisabled {
+			continue
+		}
+		iits = append(iits, d.ht.iit)
+	}
+	iits = append(iits, ac.iis[:]...)
+	for _, iit := range iits {
+		if len(iit.files) == 0 || iit.files[len(iit.files)-1].endTxNum != txNum {
+			continue
+		}
+		_, dataEnd = iit.files[len(iit.files)-1].src.dataRange()
+		return dataEnd, true
+	}
+	return 0, false
+}
+
+// setDataRange - records [txFrom, txTo) in header of file which is produced by `comp`, if it differs from range of steps
+// in file name
+func setDataRange(comp *seg.Compressor, fromStep, toStep, stepSize, txFrom, txTo uint64) {
+	if txFrom == fromStep*stepSize && txTo == toStep*stepSize {
+		return
+	}
+	comp.SetTxNumRange(txFrom, txTo)
+}
+
+// mergedDataRange - [from, to) of merge result of `files` which starts at `startTxNum`. Files must follow each other without
+// gaps and overlaps. Only gaps of `emptySteps` are allowed (see emptySteps): merge result covers them
+func mergedDataRange(files []*filesItem, startTxNum uint64, emptySteps []uint64, aggregationStep uint64) (from, to uint64, err error) {
+	for i, item := range files {
+		itemFrom, itemTo := item.dataRange()
+		if i == 0 {
+			from, to = itemFrom, itemTo
+			if startTxNum < from && stepsAreEmpty(startTxNum, from, emptySteps, aggregationStep) {
+				from = startTxNum
+			}
+			continue
+		}
+		if itemFrom != to && !(itemFrom > to && stepsAreEmpty(to, itemFrom, emptySteps, aggregationStep)) {
+			return 0, 0, fmt.Errorf("merge: data of %s starts at %d, previous file ends at %d", item.decompressor.FileName(), itemFrom, to)
+		}
+		to = itemTo
+	}
+	return from, to, nil
+}
+
+// valuesBlockAligned - .kv file of `step` has values of [txFrom, txTo) instead of values of step. Needs history in DB
+// to find values as of txTo
+func (d *Domain) valuesBlockAligned(step, txFrom, txTo uint64) bool {
+	if d.historyDisabled || d.snapshotsDisabled {
+		return false
+	}
+	return txFrom != step*d.aggregationStep || txTo != (step+1)*d.aggregationStep
+}
+
+// collateAlignedValues - keys changed in [txFrom, txTo) with their values as of txTo-1, see valuesBlockAligned
+func (d *Domain) collateAlignedValues(comp ArchiveWriter, txFrom, txTo uint64, roTx kv.Tx) (valuesBytes int64, err error) {
+	keysCursor, err := roTx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return 0, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+	}
+	defer keysCursor.Close()
+	idxCursor, err := roTx.CursorDupSort(d.History.InvertedIndex.indexTable)
+	if err != nil {
+		return 0, fmt.Errorf("create %s index cursor: %w", d.filenameBase, err)
+	}
+	defer idxCursor.Close()
+	ht := d.History.BeginFilesRo()
+	defer ht.Close()
+
+	fromStep := txFrom / d.aggregationStep
+	txFromBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(txFromBytes, txFrom)
+	keySuffix := make([]byte, 256+8)
+	for k, stepInDB, err := keysCursor.First(); k != nil; k, stepInDB, err = keysCursor.NextNoDup() {
+		if err != nil {
+			return valuesBytes, err
+		}
+		if ^binary.BigEndian.Uint64(stepInDB) < fromStep { // first dup is the last step of key
+			continue
+		}
+		changedAt, err := idxCursor.SeekBothRange(k, txFromBytes)
+		if err != nil {
+			return valuesBytes, fmt.Errorf("find %s change of k=[%x] since %d: %w", d.filenameBase, k, txFrom, err)
+		}
+		if changedAt == nil || binary.BigEndian.Uint64(changedAt) >= txTo {
+			continue
+		}
+
+		// history has value which key had before its first change at txTo or later. no such changes - last value in DB
+		v, ok, err := ht.historySeekInDB(k, txTo, roTx)
+		if err != nil {
+			return valuesBytes, fmt.Errorf("find %s value of k=[%x] as of %d: %w", d.filenameBase, k, txTo, err)
+		}
+		if !ok {
+			copy(keySuffix, k)
+			copy(keySuffix[len(k):], stepInDB)
+			if v, err = roTx.GetOne(d.valsTable, keySuffix[:len(k)+8]); err != nil {
+				return valuesBytes, fmt.Errorf("find last %s value k=[%x]: %w", d.filenameBase, k, err)
+			}
+		}
+
+		if err = comp.AddWord(k); err != nil {
+			return valuesBytes, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+		}
+		if err = comp.AddWord(v); err != nil {
+			return valuesBytes, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+		}
+		valuesBytes += int64(len(k) + len(v))
+	}
+	return valuesBytes, nil
+}
+
+// latestTxNum - txNum of values of .kv file for CursorHeap of latest values. File which data ends in the middle of
+// step gets first txNum of this step - same as DB values of this step, which are newer and win (see CursorHeap.Less)
+func (i *filesItem) latestTxNum(stepSize uint64) uint64 {
+	_, dataTo := i.dataRange()
+	if dataTo >= i.endTxNum {
+		return i.endTxNum - 1 // !important: .kv files have semantic [from, t)
+	}
+	if dataTo%stepSize == 0 && dataTo > 0 {
+		return dataTo - 1
+	}
+	return dataTo - dataTo%stepSize
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/mmap"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+)
+
+// Warm-up after merge - first queries touching file produced by big merge page-fault through gigabytes of cold data.
+// After merged files become visible, 1 background goroutine advises OS to read them into page cache (madvise WILLNEED
+// on mapped regions): accessors only, or accessors and data files. Files are advised one by one through AggregatorRoTx
+// (can't be closed during warm-up), up to WarmupAfterMergeBudget bytes per pass. Pass stops on Close and when Go runtime
+// holds big part of available memory (see underMemoryPressure): page cache filled by warm-up would evict hot pages.
+
+type WarmupMode uint8
+
+const (
+	WarmupOff WarmupMode = iota
+	// WarmupIndices - accessors of merged files: .kvi, .bt, .kvch, .efi, .vi, ...
+	WarmupIndices
+	// WarmupFull - accessors and data files
+	WarmupFull
+)
+
+func (m WarmupMode) String() string {
+	switch m {
+	case WarmupOff:
+		return "off"
+	case WarmupIndices:
+		return "indices"
+	case WarmupFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// WarmupAfterMergeBudget - max bytes advised by 1 pass of warm-up. Files which don't fit are skipped
+var WarmupAfterMergeBudget = dbg.EnvDataSize("AGG_WARMUP_AFTER_MERGE_BUDGET", 8*datasize.GB)
+
+// underMemoryPressure - Go runtime holds more than half of available memory. Tests can replace
+var underMemoryPressure = func() bool {
+	var m runtime.MemStats
+	dbg.ReadMemStats(&m)
+	total := mmap.TotalMemory()
+	return total > 0 && m.Sys > total/2
+}
+
+type warmupAfterMerge struct {
+	mode    atomic.Uint32 // WarmupMode
+	lock    sync.Mutex
+	queue   []*filesItem // merged files waiting for warm-up
+	running bool         // only 1 goroutine
+	wg      sync.WaitGroup
+
+	onWarmup func(fileName string) // tests
+}
+
+// SetWarmupAfterMerge - warm-up of files produced by merge. WarmupOff by default
+func (a *Aggregator) SetWarmupAfterMerge(mode WarmupMode) { a.warmup.mode.Store(uint32(mode)) }
+
+// scheduleWarmup - called after merged files `in` are integrated (visible)
+func (a *Aggregator) scheduleWarmup(in MergedFilesV3) {
+	if WarmupMode(a.warmup.mode.Load()) == WarmupOff || a.closing.Load() {
+		return
+	}
+	var items []*filesItem
+	for id := range in.d {
+		for _, item := range []*filesItem{in.d[id], in.dIdx[id], in.dHist[id]} {
+			if item != nil {
+				items = append(items, item)
+			}
+		}
+	}
+	for _, item := range in.iis {
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+	for _, item := range in.appendable {
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	w := &a.warmup
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.queue = append(w.queue, items...)
+	if w.running {
+		return
+	}
+	w.running = true
+	w.wg.Add(1)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer w.wg.Done()
+		for {
+			w.lock.Lock()
+			queue := w.queue
+			w.queue = nil
+			if len(queue) == 0 || a.ctx.Err() != nil {
+				w.running = false
+				w.lock.Unlock()
+				return
+			}
+			w.lock.Unlock()
+			a.warmupFiles(a.ctx, queue)
+		}
+	}()
+}
+
+// warmupFiles - 1 pass over `items` which are still visible
+func (a *Aggregator) warmupFiles(ctx context.Context, items []*filesItem) {
+	mode := WarmupMode(a.warmup.mode.Load())
+	if mode == WarmupOff {
+		return
+	}
+	if underMemoryPressure() {
+		a.logger.Debug("[agg] warmup after merge skipped: memory pressure", "files", len(items))
+		return
+	}
+	wanted := make(map[*filesItem]struct{}, len(items))
+	for _, item := range items {
+		wanted[item] = struct{}{}
+	}
+
+	ac := a.BeginFilesRo()
+	defer ac.Close()
+	var visible []visibleFiles
+	for _, dt := range ac.d {
+		visible = append(visible, dt.files, dt.ht.files, dt.ht.iit.files)
+	}
+	for _, iit := range ac.iis {
+		visible = append(visible, iit.files)
+	}
+	for _, apt := range ac.appendable {
+		if apt != nil {
+			visible = append(visible, apt.files)
+		}
+	}
+
+	budget := int64(WarmupAfterMergeBudget.Bytes())
+	var warmed int
+	var warmedSize int64
+	for _, files := range visible {
+		for _, f := range files {
+			if _, ok := wanted[f.src]; !ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if underMemoryPressure() {
+				a.logger.Debug("[agg] warmup after merge stopped: memory pressure", "warmed", warmed, "size", datasize.ByteSize(warmedSize).HR())
+				return
+			}
+			n, size := a.warmupFile(ctx, f.src, mode, budget)
+			budget -= size
+			warmed += n
+			warmedSize += size
+		}
+	}
+	a.logger.Debug("[agg] warmup after merge", "mode", mode, "files", warmed, "size", datasize.ByteSize(warmedSize).HR())
+}
+
+// warmupFile - advises accessors of `item` (and data file if WarmupFull) which fit into `budget`
+func (a *Aggregator) warmupFile(ctx context.Context, item *filesItem, mode WarmupMode, budget int64) (files int, size int64) {
+	advise := func(fileName string, fileSize int64, madvise func()) {
+		if ctx.Err() != nil || fileSize > budget-size {
+			return
+		}
+		madvise()
+		files++
+		size += fileSize
+		if a.warmup.onWarmup != nil {
+			a.warmup.onWarmup(fileName)
+		}
+	}
+	for _, idx := range []*recsplit.Index{item.index, item.codeHash} {
+		if idx == nil || idx.Empty() {
+			continue
+		}
+		advise(idx.FileName(), idx.Size(), func() { idx.EnableWillNeed().DisableReadAhead() })
+	}
+	if b := item.bindex; b != nil && b.m != nil {
+		advise(b.FileName(), b.Size(), func() { _ = mmap.MadviseWillNeed(b.m) })
+	}
+	if d := item.decompressor; mode == WarmupFull && d != nil {
+		advise(d.FileName(), d.Size(), func() { d.EnableMadvWillNeed().DisableReadAhead() })
+	}
+	return files, size
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatorV3_WarmupAfterMerge(t *testing.T) {
+	const stepSize = 16
+	ctx := context.Background()
+	pressure := false
+	defer func(f func() bool) { underMemoryPressure = f }(underMemoryPressure)
+	underMemoryPressure = func() bool { return pressure }
+
+	// merge - 2 steps of files merged into 0-2. Returns names of warmed files
+	merge := func(t *testing.T, mode WarmupMode) []string {
+		t.Helper()
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		agg.SetWarmupAfterMerge(mode)
+		var lock sync.Mutex
+		var warmed []string
+		agg.warmup.onWarmup = func(fileName string) {
+			lock.Lock()
+			defer lock.Unlock()
+			warmed = append(warmed, fileName)
+		}
+		stepSizeTestData{t: t, db: db}.write(agg, 0, 2*stepSize)
+		for step := uint64(0); step < 2; step++ {
+			require.NoError(t, agg.buildFiles(ctx, step))
+		}
+		require.NoError(t, agg.MergeLoop(ctx))
+		agg.warmup.wg.Wait()
+		lock.Lock()
+		defer lock.Unlock()
+		return warmed
+	}
+	exts := func(names []string) map[string]bool {
+		res := map[string]bool{}
+		for _, name := range names {
+			require.Contains(t, name, ".0-2.", "only merged files")
+			res[filepath.Ext(name)] = true
+		}
+		return res
+	}
+
+	t.Run("off", func(t *testing.T) {
+		require.Empty(t, merge(t, WarmupOff))
+	})
+	t.Run("indices", func(t *testing.T) {
+		warmed := exts(merge(t, WarmupIndices))
+		require.True(t, warmed[".efi"])
+		require.True(t, warmed[".vi"])
+		require.True(t, warmed[".kvi"] || warmed[".bt"])
+		for _, data := range []string{".kv", ".v", ".ef"} {
+			require.False(t, warmed[data], data)
+		}
+	})
+	t.Run("full", func(t *testing.T) {
+		warmed := exts(merge(t, WarmupFull))
+		for _, ext := range []string{".kv", ".v", ".ef", ".efi", ".vi"} {
+			require.True(t, warmed[ext], ext)
+		}
+	})
+	t.Run("memory pressure", func(t *testing.T) {
+		pressure = true
+		defer func() { pressure = false }()
+		require.Empty(t, merge(t, WarmupFull))
+	})
+
+	t.Run("cancel on close", func(t *testing.T) {
+		db, agg := testDbAndAggregatorv3(t, stepSize)
+		agg.SetWarmupAfterMerge(WarmupFull)
+		started, closed := make(chan struct{}), make(chan struct{})
+		var warmed int
+		agg.warmup.onWarmup = func(fileName string) {
+			warmed++
+			if warmed == 1 {
+				close(started)
+				<-agg.ctx.Done() // Close is called while file is warmed
+			}
+		}
+		stepSizeTestData{t: t, db: db}.write(agg, 0, 2*stepSize)
+		for step := uint64(0); step < 2; step++ {
+			require.NoError(t, agg.buildFiles(ctx, step))
+		}
+		require.NoError(t, agg.MergeLoop(ctx))
+		<-started
+		go func() {
+			defer close(closed)
+			agg.Close()
+		}()
+		<-closed
+		require.Equal(t, 1, warmed)
+	})
+}
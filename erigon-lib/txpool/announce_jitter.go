@@ -0,0 +1,105 @@
+package txpool
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/types"
+)
+
+// announceJitter - queue of announcements of local txs, see txpoolcfg.Config.AnnounceDelayJitter: each batch waits
+// uniform random delay in [0, jitter), batches due at same time are coalesced and shuffled. Owned by TxPool and driven by
+// timer: pool doesn't start goroutines. On shutdown waiting announcements are sent immediately, see TxPool.closeAnnounceJitter
+type announceJitter struct {
+	lock   sync.Mutex
+	jitter time.Duration
+	rand   *rand.Rand // crypto/rand-seeded. Tests inject deterministic source
+	queue  []delayedAnnouncements
+	timer  *time.Timer
+	closed bool
+	send   func(types.Announcements)
+}
+
+type delayedAnnouncements struct {
+	due           time.Time
+	announcements types.Announcements
+}
+
+func newAnnounceJitter(jitter time.Duration, send func(types.Announcements)) *announceJitter {
+	var seed [8]byte
+	_, _ = crand.Read(seed[:])
+	return &announceJitter{jitter: jitter, rand: rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))), send: send}
+}
+
+// add - schedules `announcements`. Returns false if queue is closed: caller must send them immediately
+func (j *announceJitter) add(announcements types.Announcements) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.closed {
+		return false
+	}
+	due := time.Now().Add(time.Duration(j.rand.Int63n(int64(j.jitter))))
+	i := sort.Search(len(j.queue), func(i int) bool { return j.queue[i].due.After(due) })
+	j.queue = slices.Insert(j.queue, i, delayedAnnouncements{due: due, announcements: announcements})
+	j.resetTimerLocked()
+	return true
+}
+
+func (j *announceJitter) resetTimerLocked() {
+	if len(j.queue) == 0 {
+		return
+	}
+	d := time.Until(j.queue[0].due)
+	if j.timer == nil {
+		j.timer = time.AfterFunc(d, j.fire)
+		return
+	}
+	j.timer.Reset(d)
+}
+
+// fire - sends batches which are due. Timer may fire early (after Reset): then it's only re-armed
+func (j *announceJitter) fire() {
+	j.lock.Lock()
+	if j.closed {
+		j.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	n := 0
+	for n < len(j.queue) && !j.queue[n].due.After(now) {
+		n++
+	}
+	batch := j.takeLocked(n)
+	j.resetTimerLocked()
+	j.lock.Unlock()
+
+	if batch.Len() > 0 {
+		j.send(batch)
+	}
+}
+
+// takeLocked - first `n` batches of queue as one shuffled batch
+func (j *announceJitter) takeLocked(n int) (batch types.Announcements) {
+	for _, delayed := range j.queue[:n] {
+		batch.AppendOther(delayed.announcements)
+	}
+	j.queue = slices.Delete(j.queue, 0, n)
+	j.rand.Shuffle(batch.Len(), batch.Swap)
+	return batch
+}
+
+// close - stops timer and returns all waiting announcements: they are not lost on shutdown. Later `add` calls return false
+func (j *announceJitter) close() types.Announcements {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.closed = true
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	return j.takeLocked(len(j.queue))
+}
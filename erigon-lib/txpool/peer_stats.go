@@ -0,0 +1,158 @@
+/*
+   Copyright 2024 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package txpool
+
+import (
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/txpool/txpoolcfg"
+)
+
+const (
+	peerStatsWindow  = 10 * time.Minute // PeerStats shows only txs received during this window
+	peerStatsBuckets = 10
+)
+
+// PeerTxStats - results of processing remote txs received from 1 peer during last `peerStatsWindow`
+type PeerTxStats struct {
+	Accepted uint64
+	Rejected map[txpoolcfg.DiscardReason]uint64
+}
+
+func (s PeerTxStats) RejectedTotal() (res uint64) {
+	for _, n := range s.Rejected {
+		res += n
+	}
+	return res
+}
+
+type peerStatsBucket struct {
+	slot     int64 // number of bucket-sized interval since epoch
+	accepted uint64
+	rejected map[txpoolcfg.DiscardReason]uint64
+}
+
+// peersTxStats - sliding window of counters: ring of buckets per peer. Not thread-safe: guarded by TxPool.lock
+type peersTxStats struct {
+	peers map[[64]byte]*[peerStatsBuckets]peerStatsBucket
+}
+
+func newPeersTxStats() *peersTxStats {
+	return &peersTxStats{peers: map[[64]byte]*[peerStatsBuckets]peerStatsBucket{}}
+}
+
+func peerStatsSlot(now time.Time) int64 {
+	return now.UnixNano() / int64(peerStatsWindow/peerStatsBuckets)
+}
+
+func (s *peersTxStats) add(peer [64]byte, now time.Time, reason txpoolcfg.DiscardReason) {
+	buckets, ok := s.peers[peer]
+	if !ok {
+		buckets = &[peerStatsBuckets]peerStatsBucket{}
+		s.peers[peer] = buckets
+	}
+	slot := peerStatsSlot(now)
+	b := &buckets[slot%peerStatsBuckets]
+	if b.slot != slot {
+		*b = peerStatsBucket{slot: slot}
+	}
+	if reason == txpoolcfg.NotSet || reason == txpoolcfg.Success {
+		b.accepted++
+		return
+	}
+	if b.rejected == nil {
+		b.rejected = map[txpoolcfg.DiscardReason]uint64{}
+	}
+	b.rejected[reason]++
+}
+
+func peerStatsBucketInWindow(b *peerStatsBucket, slot int64) bool {
+	return b.slot > slot-peerStatsBuckets && b.slot <= slot
+}
+
+// stats - also forgets peers which sent nothing during window
+func (s *peersTxStats) stats(now time.Time) map[[64]byte]PeerTxStats {
+	s.prune(now)
+	slot := peerStatsSlot(now)
+	res := make(map[[64]byte]PeerTxStats, len(s.peers))
+	for peer, buckets := range s.peers {
+		st := PeerTxStats{Rejected: map[txpoolcfg.DiscardReason]uint64{}}
+		for i := range buckets {
+			b := &buckets[i]
+			if !peerStatsBucketInWindow(b, slot) {
+				continue
+			}
+			st.Accepted += b.accepted
+			for reason, n := range b.rejected {
+				st.Rejected[reason] += n
+			}
+		}
+		res[peer] = st
+	}
+	return res
+}
+
+// prune - forgets peers which sent nothing during window: disconnected peers don't stay in memory forever
+func (s *peersTxStats) prune(now time.Time) {
+	slot := peerStatsSlot(now)
+	for peer, buckets := range s.peers {
+		var seen bool
+		for i := range buckets {
+			if peerStatsBucketInWindow(&buckets[i], slot) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			delete(s.peers, peer)
+		}
+	}
+}
+
+// PeerStats - per-peer results of remote txs processing during last 10 minutes. Key - peer id.
+// Only txs added by AddRemoteTxsFromPeer are accounted.
+func (p *TxPool) PeerStats() map[[64]byte]PeerTxStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.peerStats.stats(p.now())
+}
+
+// prunePeerStats - called periodically by MainLoop: PeerStats may be never called
+func (p *TxPool) prunePeerStats() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.peerStats.prune(p.now())
+}
+
+// accountRemoteTxsLocked - `reasons` are aligned with unprocessedRemoteTxs, `addReasons` - with txs which passed validation
+func (p *TxPool) accountRemoteTxsLocked(reasons, addReasons []txpoolcfg.DiscardReason) {
+	now := p.now()
+	j := 0
+	for i, peer := range p.unprocessedRemotePeers {
+		reason := reasons[i]
+		if reason == txpoolcfg.NotSet {
+			if j < len(addReasons) {
+				reason = addReasons[j]
+			}
+			j++
+		}
+		if peer == ([64]byte{}) { // unknown source
+			continue
+		}
+		p.peerStats.add(peer, now, reason)
+	}
+}
@@ -56,6 +56,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 	"github.com/ledgerwatch/erigon-lib/metrics"
+	"github.com/ledgerwatch/erigon-lib/rlp"
 	"github.com/ledgerwatch/erigon-lib/txpool/txpoolcfg"
 	"github.com/ledgerwatch/erigon-lib/types"
 )
@@ -73,10 +74,20 @@ var (
 	pendingSubCounter       = metrics.GetOrCreateGauge(`txpool_pending`)
 	queuedSubCounter        = metrics.GetOrCreateGauge(`txpool_queued`)
 	basefeeSubCounter       = metrics.GetOrCreateGauge(`txpool_basefee`)
+	queuedExpiredCounter    = metrics.GetOrCreateCounter(`txpool_queued_expired`)
+	txTooLargeCounter       = metrics.GetOrCreateCounter(`txpool_tx_too_large`)
+	gasLimitDemotedGauge    = metrics.GetOrCreateGauge(`txpool_gas_limit_demoted`)
+	gasLimitPromotedGauge   = metrics.GetOrCreateGauge(`txpool_gas_limit_promoted`)
+	stateRegressionsCounter = metrics.GetOrCreateCounter(`txpool_state_version_regressions`)
+	// announcements dropped because channel of new pending txs was full, see announceLocked
+	announcementsDroppedCounter = metrics.GetOrCreateCounter(`txpool_announcements_dropped`)
 )
 
 var TraceAll = false
 
+// announceFlushTimeout - how long shutdown waits for reader of new pending txs to take delayed announcements, see closeAnnounceJitter
+var announceFlushTimeout = 5 * time.Second
+
 // Pool is interface for the transaction pool
 // This interface exists for the convenience of testing, and not yet because
 // there are multiple implementations
@@ -127,10 +138,12 @@ type metaTx struct {
 	minTip                    uint64
 	bestIndex                 int
 	worstIndex                int
-	timestamp                 uint64 // when it was added to pool
+	timestamp                 uint64    // when it was added to pool
+	addedAt                   time.Time // wall-clock time of admission - used for queued txs expiry. Not persisted: txs loaded by fromDB are admitted at restart
 	subPool                   SubPoolMarker
 	currentSubPool            SubPoolType
 	minedBlockNum             uint64
+	addedInRound              uint64 // TxPool.promoteRounds at admission - to tell txs waited in queued from just added
 }
 
 func newMetaTx(slot *types.TxSlot, isLocal bool, timestamp uint64) *metaTx {
@@ -199,6 +212,8 @@ type TxPool struct {
 	//   - and as a result reducing lock contention
 	unprocessedRemoteTxs    *types.TxSlots
 	unprocessedRemoteByHash map[string]int                                  // to reject duplicates
+	unprocessedRemotePeers  [][64]byte                                      // source peer of unprocessedRemoteTxs, zero - unknown
+	peerStats               *peersTxStats                                   // see PeerStats
 	byHash                  map[string]*metaTx                              // tx_hash => txn : only those records not committed to db yet
 	discardReasonsLRU       *simplelru.LRU[string, txpoolcfg.DiscardReason] // tx_hash => discard_reason : non-persisted
 	pending                 *PendingPool
@@ -211,9 +226,12 @@ type TxPool struct {
 	all                     *BySenderAndNonce                // senderID => (sorted map of txn nonce => *metaTx)
 	deletedTxs              []*metaTx                        // list of discarded txs since last db commit
 	promoted                types.Announcements
+	announceJitter          *announceJitter // delays announcements of local txs. nil if txpoolcfg.Config.AnnounceDelayJitter is 0
+	promoteRounds           uint64          // amount of finished `promote` calls, see metaTx.addedInRound
 	cfg                     txpoolcfg.Config
 	chainID                 uint256.Int
 	lastSeenBlock           atomic.Uint64
+	lastStateVersionID      atomic.Uint64 // StateVersionId of last OnNewBlock - to detect regressions
 	lastSeenCond            *sync.Cond
 	lastFinalizedBlock      atomic.Uint64
 	started                 atomic.Bool
@@ -227,17 +245,36 @@ type TxPool struct {
 	isPostAgra              atomic.Bool
 	cancunTime              *uint64
 	isPostCancun            atomic.Bool
+	pragueTime              *uint64
+	isPostPrague            atomic.Bool
 	maxBlobsPerBlock        uint64
 	feeCalculator           FeeCalculator
+	gasLimitStats           GasLimitStats       // effect of last block gas limit change, see GasLimitStats
+	onGasLimitChange        func(GasLimitStats) // optional, see SetOnGasLimitChange
+	now                     func() time.Time    // clock - injectable for tests
 	logger                  log.Logger
 }
 
+// GasLimitStats - how the last block gas limit change affected the pool.
+// Demoted/Promoted - amount of txs which lost/got NotTooMuchGas bit because of the change,
+// Pending/BaseFee/Queued - sub-pools sizes after the block was applied.
+type GasLimitStats struct {
+	Block       uint64
+	OldGasLimit uint64
+	NewGasLimit uint64
+	Demoted     int
+	Promoted    int
+	Pending     int
+	BaseFee     int
+	Queued      int
+}
+
 type FeeCalculator interface {
 	CurrentFees(chainConfig *chain.Config, db kv.Getter) (baseFee uint64, blobFee uint64, minBlobGasPrice, blockGasLimit uint64, err error)
 }
 
 func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg txpoolcfg.Config, cache kvcache.Cache,
-	chainID uint256.Int, shanghaiTime, agraBlock, cancunTime *big.Int, maxBlobsPerBlock uint64,
+	chainID uint256.Int, shanghaiTime, agraBlock, cancunTime, pragueTime *big.Int, maxBlobsPerBlock uint64,
 	feeCalculator FeeCalculator, logger log.Logger,
 ) (*TxPool, error) {
 	localsHistory, err := simplelru.NewLRU[string, struct{}](10_000, nil)
@@ -254,6 +291,7 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg txpoolcfg.Config,
 		search:            &metaTx{Tx: &types.TxSlot{}},
 		senderIDTxnCount:  map[uint64]int{},
 		senderIDBlobCount: map[uint64]uint64{},
+		authorityTxnCount: map[common.Address]int{},
 	}
 	tracedSenders := make(map[common.Address]struct{})
 	for _, sender := range cfg.TracedSenders {
@@ -281,10 +319,12 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg txpoolcfg.Config,
 		chainID:                 chainID,
 		unprocessedRemoteTxs:    &types.TxSlots{},
 		unprocessedRemoteByHash: map[string]int{},
+		peerStats:               newPeersTxStats(),
 		minedBlobTxsByBlock:     map[uint64][]*metaTx{},
 		minedBlobTxsByHash:      map[string]*metaTx{},
 		maxBlobsPerBlock:        maxBlobsPerBlock,
 		feeCalculator:           feeCalculator,
+		now:                     time.Now,
 		logger:                  logger,
 	}
 
@@ -309,6 +349,16 @@ func New(newTxs chan types.Announcements, coreDB kv.RoDB, cfg txpoolcfg.Config,
 		cancunTimeU64 := cancunTime.Uint64()
 		res.cancunTime = &cancunTimeU64
 	}
+	if pragueTime != nil {
+		if !pragueTime.IsUint64() {
+			return nil, errors.New("pragueTime overflow")
+		}
+		pragueTimeU64 := pragueTime.Uint64()
+		res.pragueTime = &pragueTimeU64
+	}
+	if cfg.AnnounceDelayJitter > 0 {
+		res.announceJitter = newAnnounceJitter(cfg.AnnounceDelayJitter, res.sendAnnouncements)
+	}
 
 	return res, nil
 }
@@ -344,6 +394,14 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 	defer newBlockTimer.ObserveDuration(time.Now())
 	//t := time.Now()
 
+	// StateVersionId must grow. If it went backwards (for example: restart of node) - cached senders state can't be
+	// trusted: kvcache drops its views, pool re-reads state of senders of pool txs
+	prevStateVersionID := p.lastStateVersionID.Swap(stateChanges.StateVersionId)
+	stateRegressed := stateChanges.StateVersionId < prevStateVersionID
+	if stateRegressed {
+		stateRegressionsCounter.Inc()
+	}
+
 	coreDB, cache := p.coreDBWithCache()
 	cache.OnNewBlock(stateChanges)
 	coreTx, err := coreDB.BeginRo(ctx)
@@ -372,6 +430,13 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 		return err
 	}
 
+	var gasLimitChanged bool
+	defer func() { // runs after unlock below
+		if err == nil && gasLimitChanged && p.onGasLimitChange != nil {
+			p.onGasLimitChange(p.GasLimitStats())
+		}
+	}()
+
 	p.lock.Lock()
 	defer func() {
 		if err == nil {
@@ -402,16 +467,23 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 	pendingBlobFee := stateChanges.PendingBlobFeePerGas
 	p.setBlobFee(pendingBlobFee)
 
+	var demoted, promoted int
 	oldGasLimit := p.blockGasLimit.Swap(stateChanges.BlockGasLimit)
 	if oldGasLimit != stateChanges.BlockGasLimit {
 		p.all.ascendAll(func(mt *metaTx) bool {
-			var updated bool
+			var updated bool // NotTooMuchGas bit is flipped by new limit: tx changes position in its sub-pool
 			if mt.Tx.Gas < stateChanges.BlockGasLimit {
-				updated = (mt.subPool & NotTooMuchGas) > 0
+				updated = (mt.subPool & NotTooMuchGas) == 0
 				mt.subPool |= NotTooMuchGas
+				if updated {
+					promoted++
+				}
 			} else {
-				updated = (mt.subPool & NotTooMuchGas) == 0
+				updated = (mt.subPool & NotTooMuchGas) > 0
 				mt.subPool &^= NotTooMuchGas
+				if updated {
+					demoted++
+				}
 			}
 
 			if mt.Tx.Traced {
@@ -485,24 +557,59 @@ func (p *TxPool) OnNewBlock(ctx context.Context, stateChanges *remote.StateChang
 		return err
 	}
 
+	if stateRegressed {
+		revalidated, total, err := p.revalidateSendersLocked(cacheView, stateChanges.BlockGasLimit)
+		if err != nil {
+			return err
+		}
+		p.logger.Warn("[txpool] State version went backwards, senders state re-read", "block", block,
+			"prevStateVersion", prevStateVersionID, "stateVersion", stateChanges.StateVersionId, "senders", revalidated, "sendersTotal", total)
+	}
+
 	p.pending.EnforceWorstInvariants()
 	p.baseFee.EnforceInvariants()
 	p.queued.EnforceInvariants()
+	p.expireQueuedLocked()
 	p.promote(pendingBaseFee, pendingBlobFee, &announcements, p.logger)
 	p.pending.EnforceBestInvariants()
 	p.promoted.Reset()
 	p.promoted.AppendOther(announcements)
+	p.announceLocked()
 
-	if p.promoted.Len() > 0 {
-		select {
-		case p.newPendingTxs <- p.promoted.Copy():
-		default:
+	gasLimitDemotedGauge.SetInt(demoted)
+	gasLimitPromotedGauge.SetInt(promoted)
+	pendingSubCounter.SetInt(p.pending.Len())
+	basefeeSubCounter.SetInt(p.baseFee.Len())
+	queuedSubCounter.SetInt(p.queued.Len())
+	// oldGasLimit=0 means it's first block seen by pool - nothing to compare with
+	if oldGasLimit != stateChanges.BlockGasLimit && oldGasLimit != 0 {
+		p.gasLimitStats = GasLimitStats{
+			Block:       block,
+			OldGasLimit: oldGasLimit,
+			NewGasLimit: stateChanges.BlockGasLimit,
+			Demoted:     demoted,
+			Promoted:    promoted,
+			Pending:     p.pending.Len(),
+			BaseFee:     p.baseFee.Len(),
+			Queued:      p.queued.Len(),
 		}
+		gasLimitChanged = true
 	}
 
 	return nil
 }
 
+// GasLimitStats - effect of the last block gas limit change on the pool. Zero value if gas limit didn't change yet.
+func (p *TxPool) GasLimitStats() GasLimitStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.gasLimitStats
+}
+
+// SetOnGasLimitChange - f is called (outside of pool lock) after every block which changed block gas limit.
+// Must be called before pool start.
+func (p *TxPool) SetOnGasLimitChange(f func(GasLimitStats)) { p.onGasLimitChange = f }
+
 func (p *TxPool) processRemoteTxs(ctx context.Context) error {
 	if !p.Started() {
 		return fmt.Errorf("txpool not started yet")
@@ -534,30 +641,24 @@ func (p *TxPool) processRemoteTxs(ctx context.Context) error {
 		return err
 	}
 
-	_, newTxs, err := p.validateTxs(p.unprocessedRemoteTxs, cacheView)
+	reasons, newTxs, err := p.validateTxs(p.unprocessedRemoteTxs, cacheView)
 	if err != nil {
 		return err
 	}
 
-	announcements, _, err := p.addTxs(p.lastSeenBlock.Load(), cacheView, p.senders, newTxs,
+	announcements, addReasons, err := p.addTxs(p.lastSeenBlock.Load(), cacheView, p.senders, newTxs,
 		p.pendingBaseFee.Load(), p.pendingBlobFee.Load(), p.blockGasLimit.Load(), true, p.logger)
 	if err != nil {
 		return err
 	}
+	p.accountRemoteTxsLocked(reasons, addReasons)
 	p.promoted.Reset()
 	p.promoted.AppendOther(announcements)
-
-	if p.promoted.Len() > 0 {
-		select {
-		case <-ctx.Done():
-			return nil
-		case p.newPendingTxs <- p.promoted.Copy():
-		default:
-		}
-	}
+	p.announceLocked()
 
 	p.unprocessedRemoteTxs.Resize(0)
 	p.unprocessedRemoteByHash = map[string]int{}
+	p.unprocessedRemotePeers = p.unprocessedRemotePeers[:0]
 
 	//p.logger.Info("[txpool] on new txs", "amount", len(newPendingTxs.txs), "in", time.Since(t))
 	return nil
@@ -762,6 +863,7 @@ func (p *TxPool) best(n uint16, txs *types.TxsRlp, tx kv.Tx, onTopOf, availableG
 		// not an exact science using intrinsic gas but as close as we could hope for at
 		// this stage
 		intrinsicGas, _ := txpoolcfg.CalcIntrinsicGas(uint64(mt.Tx.DataLen), uint64(mt.Tx.DataNonZeroLen), nil, mt.Tx.Creation, true, true, isShanghai)
+		intrinsicGas += uint64(len(mt.Tx.Authorizations)) * fixedgas.PerEmptyAccountCost // count is limited by validateTx
 		if intrinsicGas > availableGas {
 			// we might find another txn with a low enough intrinsic gas to include so carry on
 			continue
@@ -800,6 +902,19 @@ func (p *TxPool) CountContent() (int, int, int) {
 	return p.pending.Len(), p.baseFee.Len(), p.queued.Len()
 }
 func (p *TxPool) AddRemoteTxs(_ context.Context, newTxs types.TxSlots) {
+	p.addRemoteTxs(newTxs, [64]byte{})
+}
+
+// AddRemoteTxsFromPeer - same as AddRemoteTxs, but results of txs processing are accounted in PeerStats of `peerID`
+func (p *TxPool) AddRemoteTxsFromPeer(_ context.Context, newTxs types.TxSlots, peerID types.PeerID) {
+	var peer [64]byte
+	if peerID != nil {
+		peer = gointerfaces.ConvertH512ToHash(peerID)
+	}
+	p.addRemoteTxs(newTxs, peer)
+}
+
+func (p *TxPool) addRemoteTxs(newTxs types.TxSlots, peer [64]byte) {
 	if p.cfg.NoGossip {
 		// if no gossip, then
 		// disable adding remote transactions
@@ -818,6 +933,7 @@ func (p *TxPool) AddRemoteTxs(_ context.Context, newTxs types.TxSlots) {
 		}
 		p.unprocessedRemoteByHash[hashS] = len(p.unprocessedRemoteTxs.Txs)
 		p.unprocessedRemoteTxs.Append(txn, newTxs.Senders.At(i), false)
+		p.unprocessedRemotePeers = append(p.unprocessedRemotePeers, peer)
 	}
 }
 
@@ -831,7 +947,50 @@ func toBlobs(_blobs [][]byte) []gokzg4844.Blob {
 	return blobs
 }
 
+// txSizeForLimit - blobs, commitments and proofs have own limits (blobs per txn/account/pool): blob txs are measured without
+// them, including RLP headers of their lists and of the wrapper list - as txn body (type byte and body list) only
+func txSizeForLimit(txn *types.TxSlot) uint64 {
+	size := uint64(txn.Size)
+	if txn.Type != types.BlobTxType || len(txn.Blobs)+len(txn.Commitments)+len(txn.Proofs) == 0 {
+		return size
+	}
+	var blobsLen, commitmentsLen, proofsLen int
+	for _, blob := range txn.Blobs {
+		blobsLen += rlp.StringLen(blob)
+	}
+	for _, commitment := range txn.Commitments {
+		commitmentsLen += rlp.StringLen(commitment[:])
+	}
+	for _, proof := range txn.Proofs {
+		proofsLen += rlp.StringLen(proof[:])
+	}
+	sidecar := uint64(rlp.ListPrefixLen(blobsLen) + blobsLen + rlp.ListPrefixLen(commitmentsLen) + commitmentsLen +
+		rlp.ListPrefixLen(proofsLen) + proofsLen)
+	if sidecar+1 >= size {
+		return 0
+	}
+	// size = type byte + wrapper list prefix + body list + sidecar
+	wrapperLen := size - 1
+	for prefixLen := uint64(1); prefixLen <= 9 && prefixLen+sidecar < wrapperLen; prefixLen++ {
+		if uint64(rlp.ListPrefixLen(int(wrapperLen-prefixLen))) == prefixLen {
+			return size - prefixLen - sidecar
+		}
+	}
+	return 0
+}
+
 func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.CacheView) txpoolcfg.DiscardReason {
+	maxTxSize := p.cfg.MaxTxSize
+	if isLocal {
+		maxTxSize = p.cfg.MaxLocalTxSize
+	}
+	if maxTxSize > 0 && txSizeForLimit(txn) > uint64(maxTxSize) {
+		if txn.Traced {
+			p.logger.Info(fmt.Sprintf("TX TRACING: validateTx too large idHash=%x local=%t, size=%d, limit=%d", txn.IDHash, isLocal, txSizeForLimit(txn), maxTxSize))
+		}
+		txTooLargeCounter.Inc()
+		return txpoolcfg.TxTooLarge
+	}
 	isShanghai := p.isShanghai() || p.isAgra()
 	if isShanghai && txn.Creation && txn.DataLen > fixedgas.MaxInitCodeSize {
 		return txpoolcfg.InitCodeTooLarge // EIP-3860
@@ -884,6 +1043,27 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 			return txpoolcfg.BlobPoolOverflow
 		}
 	}
+	if txn.Type == types.SetCodeTxType {
+		if !p.isPrague() {
+			return txpoolcfg.TypeNotActivated
+		}
+		if txn.Creation {
+			return txpoolcfg.CreateSetCodeTxn
+		}
+		authCount := uint64(len(txn.Authorizations))
+		if authCount == 0 || (p.cfg.MaxAuthorizationsPerTx > 0 && authCount > p.cfg.MaxAuthorizationsPerTx) {
+			if txn.Traced {
+				p.logger.Info(fmt.Sprintf("TX TRACING: validateTx invalid authorizations count idHash=%x count=%d, limit=%d", txn.IDHash, authCount, p.cfg.MaxAuthorizationsPerTx))
+			}
+			return txpoolcfg.InvalidAuthCount
+		}
+		if reason := p.validateAuthorities(txn); reason != txpoolcfg.Success {
+			return reason
+		}
+	}
+	if reason := p.validateDelegatedSender(txn); reason != txpoolcfg.Success {
+		return reason
+	}
 
 	// Drop non-local transactions under our own minimal accepted gas price or tip
 	if !isLocal && uint256.NewInt(p.cfg.MinFeeCap).Cmp(&txn.FeeCap) == 1 {
@@ -893,6 +1073,9 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 		return txpoolcfg.UnderPriced
 	}
 	gas, reason := txpoolcfg.CalcIntrinsicGas(uint64(txn.DataLen), uint64(txn.DataNonZeroLen), nil, txn.Creation, true, true, isShanghai)
+	if reason == txpoolcfg.Success && len(txn.Authorizations) > 0 {
+		gas, reason = txpoolcfg.AddAuthorizationsGas(gas, uint64(len(txn.Authorizations)))
+	}
 	if txn.Traced {
 		p.logger.Info(fmt.Sprintf("TX TRACING: validateTx intrinsic gas idHash=%x gas=%d", txn.IDHash, gas))
 	}
@@ -934,6 +1117,47 @@ func (p *TxPool) validateTx(txn *types.TxSlot, isLocal bool, stateCache kvcache.
 	return txpoolcfg.Success
 }
 
+// Pool tracks nonces of senders by their own txs only, but authorization of set-code txn increments nonce of
+// authority and delegates its code - then its balance can be spent by txs of other senders. Conservative rules to keep
+// nonce/balance assumptions of pooled txs:
+//   - validateAuthorities: authority must not have own txs in pool (unless it's sender of the set-code txn itself)
+//   - validateDelegatedSender: authority of pooled set-code txn can have only 1 txn in flight (or replace it)
+//
+// Accounts delegated by already mined authorizations are handled as any sender whose nonce/balance changed by block:
+// by re-reading their state in onSenderStateChange.
+func (p *TxPool) validateAuthorities(txn *types.TxSlot) txpoolcfg.DiscardReason {
+	sender, ok := p.senders.senderID2Addr[txn.SenderID]
+	for _, auth := range txn.Authorizations {
+		if auth.Authority == nil { // skipped at execution: doesn't touch any account
+			continue
+		}
+		if ok && *auth.Authority == sender {
+			continue
+		}
+		if authorityID, ok := p.senders.getID(*auth.Authority); ok && p.all.count(authorityID) > 0 {
+			if txn.Traced {
+				p.logger.Info(fmt.Sprintf("TX TRACING: validateTx authority reserved idHash=%x authority=%x, its txs in pool=%d", txn.IDHash, *auth.Authority, p.all.count(authorityID)))
+			}
+			return txpoolcfg.AuthorityReserved
+		}
+	}
+	return txpoolcfg.Success
+}
+
+func (p *TxPool) validateDelegatedSender(txn *types.TxSlot) txpoolcfg.DiscardReason {
+	sender, ok := p.senders.senderID2Addr[txn.SenderID]
+	if !ok || p.all.authorityCount(sender) == 0 {
+		return txpoolcfg.Success
+	}
+	if p.all.count(txn.SenderID) == 0 || p.all.get(txn.SenderID, txn.Nonce) != nil {
+		return txpoolcfg.Success
+	}
+	if txn.Traced {
+		p.logger.Info(fmt.Sprintf("TX TRACING: validateTx in-flight limit of authority idHash=%x sender=%x, its txs in pool=%d", txn.IDHash, sender, p.all.count(txn.SenderID)))
+	}
+	return txpoolcfg.InflightTxnLimit
+}
+
 var maxUint256 = new(uint256.Int).SetAllOne()
 
 // Sender should have enough balance for: gasLimit x feeCap + blobGas x blobFeeCap + transferred_value
@@ -1053,6 +1277,31 @@ func (p *TxPool) isCancun() bool {
 	return activated
 }
 
+func (p *TxPool) isPrague() bool {
+	// once this flag has been set for the first time we no longer need to check the timestamp
+	set := p.isPostPrague.Load()
+	if set {
+		return true
+	}
+	if p.pragueTime == nil {
+		return false
+	}
+	pragueTime := *p.pragueTime
+
+	// a zero here means Prague is always active
+	if pragueTime == 0 {
+		p.isPostPrague.Swap(true)
+		return true
+	}
+
+	now := time.Now().Unix()
+	activated := uint64(now) >= pragueTime
+	if activated {
+		p.isPostPrague.Swap(true)
+	}
+	return activated
+}
+
 // Check that the serialized txn should not exceed a certain max size
 func (p *TxPool) ValidateSerializedTxn(serializedTxn []byte) error {
 	const (
@@ -1214,13 +1463,66 @@ func (p *TxPool) AddLocalTxs(ctx context.Context, newTransactions types.TxSlots,
 			p.promoted.Append(txn.Type, txn.Size, txn.IDHash[:])
 		}
 	}
-	if p.promoted.Len() > 0 {
-		select {
-		case p.newPendingTxs <- p.promoted.Copy():
-		default:
+	p.announceLocked()
+	return reasons, nil
+}
+
+// announceLocked - sends `p.promoted` (all announcements of one OnNewBlock, AddLocalTxs or processRemoteTxs: promotions,
+// pokes, new txs) as one message, de-duplicated by hash: each message is a separate gossip round. Announcements of local
+// txs are delayed if txpoolcfg.Config.AnnounceDelayJitter is set, see announceJitter
+func (p *TxPool) announceLocked() {
+	if p.promoted.Len() == 0 {
+		return
+	}
+	announcements := p.promoted.Dedup()
+	if p.announceJitter != nil {
+		var remote, local types.Announcements
+		for i := 0; i < announcements.Len(); i++ {
+			t, size, hash := announcements.At(i)
+			if p.isLocalLRU.Contains(string(hash)) {
+				local.AppendKind(announcements.KindAt(i), t, size, hash)
+			} else {
+				remote.AppendKind(announcements.KindAt(i), t, size, hash)
+			}
+		}
+		announcements = remote
+		if local.Len() > 0 && !p.announceJitter.add(local) {
+			announcements.AppendOther(local)
 		}
 	}
-	return reasons, nil
+	p.sendAnnouncements(announcements)
+}
+
+// sendAnnouncements - never blocks (pool lock may be held): if channel is full, announcements are dropped and counted
+func (p *TxPool) sendAnnouncements(announcements types.Announcements) {
+	if announcements.Len() == 0 {
+		return
+	}
+	select {
+	case p.newPendingTxs <- announcements:
+	default:
+		announcementsDroppedCounter.AddInt(announcements.Len())
+	}
+}
+
+// closeAnnounceJitter - sends delayed announcements of local txs immediately: they are not lost on shutdown. Unlike
+// sendAnnouncements blocks (pool lock is not held) until channel has space, at most announceFlushTimeout
+func (p *TxPool) closeAnnounceJitter() {
+	if p.announceJitter == nil {
+		return
+	}
+	announcements := p.announceJitter.close()
+	if announcements.Len() == 0 {
+		return
+	}
+	timer := time.NewTimer(announceFlushTimeout)
+	defer timer.Stop()
+	select {
+	case p.newPendingTxs <- announcements:
+	case <-timer.C:
+		announcementsDroppedCounter.AddInt(announcements.Len())
+		p.logger.Warn("[txpool] delayed announcements dropped on shutdown", "amount", announcements.Len(), "timeout", announceFlushTimeout)
+	}
 }
 func (p *TxPool) coreDBWithCache() (kv.RoDB, kvcache.Cache) {
 	p.lock.Lock()
@@ -1255,11 +1557,12 @@ func (p *TxPool) addTxs(blockNum uint64, cacheView kvcache.CacheView, senders *s
 			discardReasons[i] = txpoolcfg.DuplicateHash
 			// In case if the transition is stuck, "poke" it to rebroadcast
 			if collect && newTxs.IsLocal[i] && (found.currentSubPool == PendingSubPool || found.currentSubPool == BaseFeeSubPool) {
-				announcements.Append(found.Tx.Type, found.Tx.Size, found.Tx.IDHash[:])
+				announcements.AppendKind(types.AnnounceRepoked, found.Tx.Type, found.Tx.Size, found.Tx.IDHash[:])
 			}
 			continue
 		}
 		mt := newMetaTx(txn, newTxs.IsLocal[i], blockNum)
+		mt.addedAt = p.now()
 		if reason := p.addLocked(mt, &announcements); reason != txpoolcfg.NotSet {
 			discardReasons[i] = reason
 			continue
@@ -1311,6 +1614,7 @@ func (p *TxPool) addTxsOnNewBlock(blockNum uint64, cacheView kvcache.CacheView,
 			continue
 		}
 		mt := newMetaTx(txn, newTxs.IsLocal[i], blockNum)
+		mt.addedAt = p.now()
 		if reason := p.addLocked(mt, &announcements); reason != txpoolcfg.NotSet {
 			p.discardLocked(mt, reason)
 			continue
@@ -1346,6 +1650,38 @@ func (p *TxPool) addTxsOnNewBlock(blockNum uint64, cacheView kvcache.CacheView,
 	return announcements, nil
 }
 
+// revalidateSendersLocked - re-reads nonce/balance of senders of pool txs from `cacheView`. Re-reads at most
+// cfg.RevalidateSendersOnRegression senders: senders of pending sub-pool first, then of baseFee and queued
+func (p *TxPool) revalidateSendersLocked(cacheView kvcache.CacheView, blockGasLimit uint64) (revalidated, total int, err error) {
+	limit := p.cfg.RevalidateSendersOnRegression
+	seen := map[uint64]struct{}{}
+	var senderIDs []uint64
+	for _, subPool := range []SubPoolType{PendingSubPool, BaseFeeSubPool, QueuedSubPool} {
+		p.all.ascendAll(func(mt *metaTx) bool {
+			if mt.currentSubPool != subPool {
+				return true
+			}
+			if _, ok := seen[mt.Tx.SenderID]; ok {
+				return true
+			}
+			seen[mt.Tx.SenderID] = struct{}{}
+			if len(senderIDs) < limit {
+				senderIDs = append(senderIDs, mt.Tx.SenderID)
+			}
+			return true
+		})
+	}
+
+	for _, senderID := range senderIDs {
+		nonce, balance, err := p.senders.info(cacheView, senderID)
+		if err != nil {
+			return 0, len(seen), err
+		}
+		p.onSenderStateChange(senderID, nonce, balance, blockGasLimit, p.logger)
+	}
+	return len(senderIDs), len(seen), nil
+}
+
 func (p *TxPool) setBaseFee(baseFee uint64) (uint64, bool) {
 	changed := false
 	if baseFee > 0 {
@@ -1397,7 +1733,7 @@ func (p *TxPool) addLocked(mt *metaTx, announcements *types.Announcements) txpoo
 			// Both tip and feecap need to be larger than previously to replace the transaction
 			// In case if the transition is stuck, "poke" it to rebroadcast
 			if mt.subPool&IsLocal != 0 && (found.currentSubPool == PendingSubPool || found.currentSubPool == BaseFeeSubPool) {
-				announcements.Append(found.Tx.Type, found.Tx.Size, found.Tx.IDHash[:])
+				announcements.AppendKind(types.AnnounceRepoked, found.Tx.Type, found.Tx.Size, found.Tx.IDHash[:])
 			}
 			if bytes.Equal(found.Tx.IDHash[:], mt.Tx.IDHash[:]) {
 				return txpoolcfg.NotSet
@@ -1426,6 +1762,7 @@ func (p *TxPool) addLocked(mt *metaTx, announcements *types.Announcements) txpoo
 
 	hashStr := string(mt.Tx.IDHash[:])
 	p.byHash[hashStr] = mt
+	mt.addedInRound = p.promoteRounds
 
 	if replaced := p.all.replaceOrInsert(mt, p.logger); replaced != nil {
 		if assert.Enable {
@@ -1462,6 +1799,34 @@ func (p *TxPool) discardLocked(mt *metaTx, reason txpoolcfg.DiscardReason) {
 	}
 }
 
+// expireQueuedLocked - drops queued txs which stay in pool longer than cfg.QueuedLifetime (cfg.LocalQueuedLifetime for local txs).
+// Lifetime is counted from admission to this process: restart resets it for all txs loaded from DB
+func (p *TxPool) expireQueuedLocked() {
+	if p.cfg.QueuedLifetime == 0 && p.cfg.LocalQueuedLifetime == 0 {
+		return
+	}
+	now := p.now()
+	var expired []*metaTx
+	for _, mt := range p.queued.best.ms {
+		lifetime := p.cfg.QueuedLifetime
+		if mt.subPool&IsLocal != 0 {
+			lifetime = p.cfg.LocalQueuedLifetime
+		}
+		if lifetime == 0 || now.Sub(mt.addedAt) < lifetime {
+			continue
+		}
+		expired = append(expired, mt)
+	}
+	for _, mt := range expired {
+		if mt.Tx.Traced {
+			p.logger.Info("TX TRACING: queued txn expired", "idHash", fmt.Sprintf("%x", mt.Tx.IDHash), "senderId", mt.Tx.SenderID, "nonce", mt.Tx.Nonce, "addedAt", mt.addedAt)
+		}
+		p.queued.Remove(mt, "expired", p.logger)
+		p.discardLocked(mt, txpoolcfg.Expired)
+	}
+	queuedExpiredCounter.AddInt(len(expired))
+}
+
 // Cache recently mined blobs in anticipation of reorg, delete finalized ones
 func (p *TxPool) processMinedFinalizedBlobs(coreTx kv.Tx, minedTxs []*types.TxSlot, finalizedBlock uint64) error {
 	p.lastFinalizedBlock.Store(finalizedBlock)
@@ -1515,6 +1880,42 @@ func (p *TxPool) NonceFromAddress(addr [20]byte) (nonce uint64, inPool bool) {
 	return p.all.nonce(senderID)
 }
 
+// PendingAccountView - nonce and balance of `addr` in "pending" block: for wallet RPCs (eth_getTransactionCount "pending").
+// Starting from `stateNonce`, walks contiguous pooled txs of sender: pendingNonce is next nonce after them (stops at
+// nonce gap), availableBalance is `stateBalance` minus max cost of them - requiredBalance, as validateTx does. Floors at 0.
+//
+// Computed under pool lock - consistent with pool contents, unlike NonceFromAddress + separate state read.
+// Caller must supply `stateNonce` and `stateBalance` from consistent state snapshot (for example same read-only tx).
+func (p *TxPool) PendingAccountView(addr [20]byte, stateNonce uint64, stateBalance *uint256.Int) (pendingNonce uint64, availableBalance *uint256.Int) {
+	pendingNonce, availableBalance = stateNonce, new(uint256.Int)
+	if stateBalance != nil {
+		availableBalance.Set(stateBalance)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	senderID, found := p.senders.getID(addr)
+	if !found {
+		return pendingNonce, availableBalance
+	}
+	p.all.ascend(senderID, func(mt *metaTx) bool {
+		if mt.Tx.Nonce < pendingNonce { // mined in provided state, but pool didn't see this block yet
+			return true
+		}
+		if mt.Tx.Nonce != pendingNonce { // nonce gap
+			return false
+		}
+		if needBalance := requiredBalance(mt.Tx); availableBalance.Lt(needBalance) {
+			availableBalance.Clear()
+		} else {
+			availableBalance.Sub(availableBalance, needBalance)
+		}
+		pendingNonce++
+		return true
+	})
+	return pendingNonce, availableBalance
+}
+
 // removeMined - apply new highest block (or batch of blocks)
 //
 // 1. New best block arrives, which potentially changes the balance and the nonce of some senders.
@@ -1724,7 +2125,11 @@ func (p *TxPool) promote(pendingBaseFee uint64, pendingBlobFee uint64, announcem
 	for best := p.queued.Best(); p.queued.Len() > 0 && best.subPool >= BaseFeePoolBits; best = p.queued.Best() {
 		if best.minFeeCap.Cmp(uint256.NewInt(pendingBaseFee)) >= 0 {
 			tx := p.queued.PopBest()
-			announcements.Append(tx.Tx.Type, tx.Tx.Size, tx.Tx.IDHash[:])
+			kind := types.AnnounceNewPending
+			if tx.addedInRound < p.promoteRounds { // all txs are added to queued first: only ones from previous rounds did wait there
+				kind = types.AnnouncePromotedFromQueued
+			}
+			announcements.AppendKind(kind, tx.Tx.Type, tx.Tx.Size, tx.Tx.IDHash[:])
 			p.pending.Add(tx, logger)
 		} else {
 			p.baseFee.Add(p.queued.PopBest(), "promote-queued", logger)
@@ -1748,6 +2153,7 @@ func (p *TxPool) promote(pendingBaseFee uint64, pendingBlobFee uint64, announcem
 	for _ = p.queued.Worst(); p.queued.Len() > p.queued.limit; _ = p.queued.Worst() {
 		p.discardLocked(p.queued.PopWorst(), txpoolcfg.QueuedPoolOverflow)
 	}
+	p.promoteRounds++
 }
 
 // txMaxBroadcastSize is the max size of a transaction that will be broadcasted.
@@ -1783,10 +2189,12 @@ func MainLoop(ctx context.Context, db kv.RwDB, p *TxPool, newTxs chan types.Anno
 	for {
 		select {
 		case <-ctx.Done():
+			p.closeAnnounceJitter()
 			_, _ = p.flush(ctx, db)
 			return
 		case <-logEvery.C:
 			p.logStats()
+			p.prunePeerStats()
 		case <-processRemoteTxsEvery.C:
 			if !p.Started() {
 				continue
@@ -2456,8 +2864,9 @@ func (sc *sendersBatch) onNewBlock(stateChanges *remote.StateChangeBatch, unwind
 type BySenderAndNonce struct {
 	tree              *btree.BTreeG[*metaTx]
 	search            *metaTx
-	senderIDTxnCount  map[uint64]int    // count of sender's txns in the pool - may differ from nonce
-	senderIDBlobCount map[uint64]uint64 // count of sender's total number of blobs in the pool
+	senderIDTxnCount  map[uint64]int         // count of sender's txns in the pool - may differ from nonce
+	senderIDBlobCount map[uint64]uint64      // count of sender's total number of blobs in the pool
+	authorityTxnCount map[common.Address]int // count of set-code txns in the pool with authorization signed by address
 }
 
 func (b *BySenderAndNonce) nonce(senderID uint64) (nonce uint64, ok bool) {
@@ -2513,6 +2922,23 @@ func (b *BySenderAndNonce) blobCount(senderID uint64) uint64 {
 	return b.senderIDBlobCount[senderID]
 }
 
+func (b *BySenderAndNonce) authorityCount(addr common.Address) int {
+	return b.authorityTxnCount[addr]
+}
+
+func (b *BySenderAndNonce) addAuthorities(txn *types.TxSlot, delta int) {
+	for _, auth := range txn.Authorizations {
+		if auth.Authority == nil {
+			continue
+		}
+		if count := b.authorityTxnCount[*auth.Authority] + delta; count > 0 {
+			b.authorityTxnCount[*auth.Authority] = count
+		} else {
+			delete(b.authorityTxnCount, *auth.Authority)
+		}
+	}
+}
+
 func (b *BySenderAndNonce) hasTxs(senderID uint64) bool {
 	has := false
 	b.ascend(senderID, func(*metaTx) bool {
@@ -2560,6 +2986,7 @@ func (b *BySenderAndNonce) delete(mt *metaTx, reason txpoolcfg.DiscardReason, lo
 				delete(b.senderIDBlobCount, senderID)
 			}
 		}
+		b.addAuthorities(mt.Tx, -1)
 	}
 }
 
@@ -2570,6 +2997,8 @@ func (b *BySenderAndNonce) replaceOrInsert(mt *metaTx, logger log.Logger) *metaT
 		if mt.Tx.Traced {
 			logger.Info("TX TRACING: Replaced txn by nonce", "idHash", fmt.Sprintf("%x", mt.Tx.IDHash), "sender", mt.Tx.SenderID, "nonce", mt.Tx.Nonce)
 		}
+		b.addAuthorities(it.Tx, -1)
+		b.addAuthorities(mt.Tx, 1)
 		return it
 	}
 
@@ -2581,6 +3010,7 @@ func (b *BySenderAndNonce) replaceOrInsert(mt *metaTx, logger log.Logger) *metaT
 	if mt.Tx.Type == types.BlobTxType && mt.Tx.Blobs != nil {
 		b.senderIDBlobCount[mt.Tx.SenderID] += uint64(len(mt.Tx.Blobs))
 	}
+	b.addAuthorities(mt.Tx, 1)
 	return nil
 }
 
@@ -19,10 +19,13 @@ package txpool
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/big"
+	"math/rand"
 	"testing"
+	"time"
 
 	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
 	"github.com/holiman/uint256"
@@ -43,6 +46,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/kvcache"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/state"
 	"github.com/ledgerwatch/erigon-lib/txpool/txpoolcfg"
 	"github.com/ledgerwatch/erigon-lib/types"
 )
@@ -56,7 +60,7 @@ func TestNonceFromAddress(t *testing.T) {
 
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -168,6 +172,95 @@ func TestNonceFromAddress(t *testing.T) {
 	}
 }
 
+func TestPendingAccountView(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	ctx := context.Background()
+	// start blocks from 0, set empty hash - then kvcache will also work on this
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		StateVersionId:      0,
+		PendingBlockBaseFee: 200000,
+		BlockGasLimit:       1000000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr, otherAddr [20]byte
+	addr[0], otherAddr[0] = 1, 2
+	stateNonce, stateBalance := uint64(2), uint256.NewInt(1*common.Ether)
+	v := types.EncodeAccountBytesV3(stateNonce, stateBalance, make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+
+	var txSlots types.TxSlots
+	for i, nonce := range []uint64{2, 3, 5} { // nonce gap at 4
+		txSlot := &types.TxSlot{
+			Tip:    *uint256.NewInt(300000),
+			FeeCap: *uint256.NewInt(300000),
+			Gas:    100000,
+			Value:  *uint256.NewInt(uint64(i+1) * 1000),
+			Nonce:  nonce,
+		}
+		txSlot.IDHash[0] = byte(i + 1)
+		txSlots.Append(txSlot, addr[:], true)
+	}
+	reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+	assert.NoError(err)
+	for _, reason := range reasons {
+		assert.Equal(txpoolcfg.Success, reason, reason.String())
+	}
+	// max cost of each txn: feeCap*gas + value - same as validateTx checks
+	cost := func(i int) *uint256.Int {
+		require.Equal(uint256.NewInt(300000*100000+uint64(i+1)*1000), requiredBalance(txSlots.Txs[i]))
+		return requiredBalance(txSlots.Txs[i])
+	}
+
+	pendingNonce, available := pool.PendingAccountView(addr, stateNonce, stateBalance)
+	assert.Equal(uint64(4), pendingNonce) // stops at gap, txn with nonce 5 is not counted
+	expected := new(uint256.Int).Sub(stateBalance, cost(0))
+	expected.Sub(expected, cost(1))
+	assert.Equal(expected, available)
+	assert.Equal(uint256.NewInt(1*common.Ether), stateBalance, "caller's balance is not modified")
+
+	// provided state already includes txn with nonce 2: pool didn't see this block yet
+	pendingNonce, available = pool.PendingAccountView(addr, 3, stateBalance)
+	assert.Equal(uint64(4), pendingNonce)
+	assert.Equal(new(uint256.Int).Sub(stateBalance, cost(1)), available)
+
+	// nonce 4 mined by txn which is not in pool: txn with nonce 5 becomes executable
+	pendingNonce, available = pool.PendingAccountView(addr, 5, stateBalance)
+	assert.Equal(uint64(6), pendingNonce)
+	assert.Equal(new(uint256.Int).Sub(stateBalance, cost(2)), available)
+
+	// pooled txs cost more than balance
+	pendingNonce, available = pool.PendingAccountView(addr, stateNonce, uint256.NewInt(1000))
+	assert.Equal(uint64(4), pendingNonce)
+	assert.True(available.IsZero())
+
+	// sender without pooled txs
+	pendingNonce, available = pool.PendingAccountView(otherAddr, 7, stateBalance)
+	assert.Equal(uint64(7), pendingNonce)
+	assert.Equal(stateBalance, available)
+}
+
 func TestReplaceWithHigherFee(t *testing.T) {
 	t.Skip("TODO")
 	assert, require := assert.New(t), require.New(t)
@@ -177,7 +270,7 @@ func TestReplaceWithHigherFee(t *testing.T) {
 
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.NotEqual(nil, pool)
 	ctx := context.Background()
@@ -296,7 +389,7 @@ func TestReverseNonces(t *testing.T) {
 
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -422,7 +515,7 @@ func TestTxPoke(t *testing.T) {
 
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -705,7 +798,7 @@ func TestShanghaiValidateTx(t *testing.T) {
 			}
 
 			cache := &kvcache.DummyCache{}
-			pool, err := New(ch, coreDB, cfg, cache, *u256.N1, shanghaiTime, nil /* agraBlock */, nil /* cancunTime */, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
+			pool, err := New(ch, coreDB, cfg, cache, *u256.N1, shanghaiTime, nil /* agraBlock */, nil /* cancunTime */, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
 			asrt.NoError(err)
 			ctx := context.Background()
 			tx, err := coreDB.BeginRw(ctx)
@@ -744,6 +837,207 @@ func TestShanghaiValidateTx(t *testing.T) {
 	}
 }
 
+func TestMaxTxSizeValidateTx(t *testing.T) {
+	const limit = 128 * 1024
+	// RLP of 1 blob, commitment and proof: lists of strings, and 4 bytes of wrapper list prefix
+	sidecar := uint32(4+(4+fixedgas.BlobSize)+1+(1+48)+1+(1+48)) + 4
+	tests := map[string]struct {
+		size     uint32
+		blob     bool
+		isLocal  bool
+		tooLarge bool
+	}{
+		"under":                 {size: limit - 1},
+		"at":                    {size: limit},
+		"over":                  {size: limit + 1, tooLarge: true},
+		"blob under":            {size: sidecar + limit - 1, blob: true},
+		"blob at":               {size: sidecar + limit, blob: true},
+		"blob over":             {size: sidecar + limit + 1, blob: true, tooLarge: true},
+		"local over remote cap": {size: limit + 1, isLocal: true},
+		"local over local cap":  {size: 2*limit + 1, isLocal: true, tooLarge: true},
+	}
+
+	logger := log.New()
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch := make(chan types.Announcements, 100)
+			coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+
+			cfg := txpoolcfg.DefaultConfig
+			cfg.MaxTxSize = limit
+			cfg.MaxLocalTxSize = 2 * limit
+
+			cache := &kvcache.DummyCache{}
+			pool, err := New(ch, coreDB, cfg, cache, *u256.N1, nil, nil /* agraBlock */, nil /* cancunTime */, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
+			require.NoError(t, err)
+			ctx := context.Background()
+			tx, err := coreDB.BeginRw(ctx)
+			require.NoError(t, err)
+			defer tx.Rollback()
+
+			sndr := sender{nonce: 0, balance: *uint256.NewInt(math.MaxUint64)}
+			sndrBytes := make([]byte, types.EncodeSenderLengthForStorage(sndr.nonce, sndr.balance))
+			types.EncodeSender(sndr.nonce, sndr.balance, sndrBytes)
+			require.NoError(t, tx.Put(kv.PlainState, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, sndrBytes))
+
+			txn := &types.TxSlot{
+				Size:     test.size,
+				FeeCap:   *uint256.NewInt(21000),
+				Gas:      500000,
+				SenderID: 0,
+			}
+			if test.blob {
+				txn.Type = types.BlobTxType
+				txn.Blobs = [][]byte{make([]byte, fixedgas.BlobSize)}
+				txn.Commitments = make([]gokzg4844.KZGCommitment, 1)
+				txn.Proofs = make([]gokzg4844.KZGProof, 1)
+			}
+			txns := types.TxSlots{
+				Txs:     append([]*types.TxSlot{}, txn),
+				Senders: types.Addresses{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			}
+			require.NoError(t, pool.senders.registerNewSenders(&txns, logger))
+			view, err := cache.View(ctx, tx)
+			require.NoError(t, err)
+
+			reason := pool.validateTx(txn, test.isLocal, view)
+			if test.tooLarge {
+				require.Equal(t, txpoolcfg.TxTooLarge, reason, reason.String())
+				return
+			}
+			require.NotEqual(t, txpoolcfg.TxTooLarge, reason, reason.String())
+			if !test.blob { // blob txs fail later checks: cancun is not active
+				require.Equal(t, txpoolcfg.Success, reason, reason.String())
+			}
+		})
+	}
+}
+
+func TestSetCodeTxValidateTx(t *testing.T) {
+	logger := log.New()
+	senderAddr, authorityAddr, otherAddr := common.Address{1}, common.Address{2}, common.Address{3}
+
+	newPool := func(t *testing.T, pragueTime *big.Int) (pool *TxPool, view kvcache.CacheView, ids map[common.Address]uint64) {
+		t.Helper()
+		ch := make(chan types.Announcements, 100)
+		coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+		cfg := txpoolcfg.DefaultConfig
+		cfg.MaxAuthorizationsPerTx = 2
+		cache := &kvcache.DummyCache{}
+		pool, err := New(ch, coreDB, cfg, cache, *u256.N1, common.Big0, nil /* agraBlock */, common.Big0, pragueTime, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
+		require.NoError(t, err)
+		ctx := context.Background()
+		tx, err := coreDB.BeginRw(ctx)
+		require.NoError(t, err)
+		t.Cleanup(tx.Rollback)
+
+		sndr := sender{nonce: 0, balance: *uint256.NewInt(math.MaxUint64)}
+		sndrBytes := make([]byte, types.EncodeSenderLengthForStorage(sndr.nonce, sndr.balance))
+		types.EncodeSender(sndr.nonce, sndr.balance, sndrBytes)
+		txns := types.TxSlots{}
+		for _, addr := range []common.Address{senderAddr, authorityAddr, otherAddr} {
+			require.NoError(t, tx.Put(kv.PlainState, addr[:], sndrBytes))
+			txns.Append(&types.TxSlot{}, addr[:], false)
+		}
+		require.NoError(t, pool.senders.registerNewSenders(&txns, logger))
+		ids = map[common.Address]uint64{}
+		for i, txn := range txns.Txs {
+			ids[common.BytesToAddress(txns.Senders.At(i))] = txn.SenderID
+		}
+		view, err = cache.View(ctx, tx)
+		require.NoError(t, err)
+		return pool, view, ids
+	}
+	setCodeTxn := func(senderID, nonce uint64, authorities ...common.Address) *types.TxSlot {
+		txn := &types.TxSlot{
+			Type:     types.SetCodeTxType,
+			Tip:      *uint256.NewInt(1),
+			FeeCap:   *uint256.NewInt(21000),
+			Gas:      500000,
+			SenderID: senderID,
+			Nonce:    nonce,
+		}
+		for i := range authorities {
+			txn.Authorizations = append(txn.Authorizations, types.Authorization{Authority: &authorities[i]})
+		}
+		return txn
+	}
+	plainTxn := func(senderID, nonce uint64) *types.TxSlot {
+		return &types.TxSlot{FeeCap: *uint256.NewInt(21000), Gas: 500000, SenderID: senderID, Nonce: nonce}
+	}
+
+	t.Run("not activated", func(t *testing.T) {
+		pool, view, ids := newPool(t, nil)
+		reason := pool.validateTx(setCodeTxn(ids[senderAddr], 0, authorityAddr), false, view)
+		require.Equal(t, txpoolcfg.TypeNotActivated, reason, reason.String())
+	})
+
+	t.Run("admission", func(t *testing.T) {
+		pool, view, ids := newPool(t, common.Big0)
+		id := ids[senderAddr]
+
+		tooLowGas := setCodeTxn(id, 0, authorityAddr)
+		tooLowGas.Gas = fixedgas.TxGas + fixedgas.PerEmptyAccountCost - 1
+		creation := setCodeTxn(id, 0, authorityAddr)
+		creation.Creation = true
+		invalidSignature := setCodeTxn(id, 0)
+		invalidSignature.Authorizations = []types.Authorization{{}}
+		underpriced := setCodeTxn(id, 0, authorityAddr)
+		underpriced.FeeCap = *uint256.NewInt(0)
+
+		for name, test := range map[string]struct {
+			txn      *types.TxSlot
+			expected txpoolcfg.DiscardReason
+		}{
+			"well-formed":             {setCodeTxn(id, 0, authorityAddr), txpoolcfg.Success},
+			"max authorizations":      {setCodeTxn(id, 0, authorityAddr, otherAddr), txpoolcfg.Success},
+			"invalid signature":       {invalidSignature, txpoolcfg.Success},
+			"no authorizations":       {setCodeTxn(id, 0), txpoolcfg.InvalidAuthCount},
+			"too many authorizations": {setCodeTxn(id, 0, authorityAddr, otherAddr, senderAddr), txpoolcfg.InvalidAuthCount},
+			"creation":                {creation, txpoolcfg.CreateSetCodeTxn},
+			"authorization gas":       {tooLowGas, txpoolcfg.IntrinsicGas},
+			"underpriced":             {underpriced, txpoolcfg.UnderPriced},
+		} {
+			reason := pool.validateTx(test.txn, false, view)
+			require.Equal(t, test.expected, reason, "%s: %s", name, reason)
+		}
+	})
+
+	t.Run("authorities", func(t *testing.T) {
+		pool, view, ids := newPool(t, common.Big0)
+
+		// authority has own txn in pool: authorization would make its nonce invalid
+		authorityTxn := newMetaTx(plainTxn(ids[authorityAddr], 0), false, 0)
+		require.Nil(t, pool.all.replaceOrInsert(authorityTxn, logger))
+		reason := pool.validateTx(setCodeTxn(ids[senderAddr], 0, authorityAddr), false, view)
+		require.Equal(t, txpoolcfg.AuthorityReserved, reason, reason.String())
+		reason = pool.validateTx(setCodeTxn(ids[authorityAddr], 1, authorityAddr), false, view)
+		require.Equal(t, txpoolcfg.Success, reason, "self-authorization: %s", reason)
+		pool.all.delete(authorityTxn, txpoolcfg.Mined, logger)
+
+		// authority of pooled set-code txn: only 1 txn in flight
+		setCodeMt := newMetaTx(setCodeTxn(ids[otherAddr], 0, authorityAddr), false, 0)
+		require.Nil(t, pool.all.replaceOrInsert(setCodeMt, logger))
+		require.Equal(t, 1, pool.all.authorityCount(authorityAddr))
+		reason = pool.validateTx(plainTxn(ids[authorityAddr], 0), false, view)
+		require.Equal(t, txpoolcfg.Success, reason, reason.String())
+		require.Nil(t, pool.all.replaceOrInsert(authorityTxn, logger))
+		reason = pool.validateTx(plainTxn(ids[authorityAddr], 1), false, view)
+		require.Equal(t, txpoolcfg.InflightTxnLimit, reason, reason.String())
+		reason = pool.validateTx(plainTxn(ids[authorityAddr], 0), false, view)
+		require.Equal(t, txpoolcfg.Success, reason, "replacement: %s", reason)
+
+		// replaced and deleted set-code txs release authority
+		require.NotNil(t, pool.all.replaceOrInsert(newMetaTx(setCodeTxn(ids[otherAddr], 0, senderAddr), false, 0), logger))
+		require.Equal(t, 0, pool.all.authorityCount(authorityAddr))
+		require.Equal(t, 1, pool.all.authorityCount(senderAddr))
+		reason = pool.validateTx(plainTxn(ids[authorityAddr], 1), false, view)
+		require.Equal(t, txpoolcfg.Success, reason, reason.String())
+		pool.all.delete(pool.all.get(ids[otherAddr], 0), txpoolcfg.Mined, logger)
+		require.Equal(t, 0, pool.all.authorityCount(senderAddr))
+	})
+}
+
 // Blob gas price bump + other requirements to replace existing txns in the pool
 func TestBlobTxReplacement(t *testing.T) {
 	t.Skip("TODO")
@@ -754,7 +1048,7 @@ func TestBlobTxReplacement(t *testing.T) {
 
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, common.Big0, nil, common.Big0, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, common.Big0, nil, common.Big0, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -973,7 +1267,7 @@ func TestDropRemoteAtNoGossip(t *testing.T) {
 	logger := log.New()
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
 
-	txPool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, big.NewInt(0), big.NewInt(0), nil, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
+	txPool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, big.NewInt(0), big.NewInt(0), nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, logger)
 	assert.NoError(err)
 	require.True(txPool != nil)
 
@@ -1081,7 +1375,7 @@ func TestBlobSlots(t *testing.T) {
 	cfg.TotalBlobPoolLimit = 20
 
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, common.Big0, nil, common.Big0, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, common.Big0, nil, common.Big0, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -1157,7 +1451,7 @@ func TestGasLimitChanged(t *testing.T) {
 	db := memdb.NewTestPoolDB(t)
 	cfg := txpoolcfg.DefaultConfig
 	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
-	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
 	assert.NoError(err)
 	require.True(pool != nil)
 	ctx := context.Background()
@@ -1222,3 +1516,710 @@ func TestGasLimitChanged(t *testing.T) {
 
 	assert.Zero(mtx.subPool&NotTooMuchGas, "Should now have block space (again) for the tx")
 }
+
+func TestGasLimitStats(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	var reported []GasLimitStats
+	pool.SetOnGasLimitChange(func(s GasLimitStats) { reported = append(reported, s) })
+
+	ctx := context.Background()
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(2, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	require.Zero(pool.GasLimitStats(), "first block seen by pool is not a gas limit change")
+	require.Empty(reported)
+
+	// every second txn needs more gas than the shrunk block has
+	const txsAmount = 200
+	var txSlots types.TxSlots
+	for i := 0; i < txsAmount; i++ {
+		txn := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: uint64(2 + i)}
+		if i%2 == 1 {
+			txn.Gas = 300_000
+		}
+		txn.IDHash[0] = byte(i + 1)
+		txSlots.Append(txn, addr[:], true)
+	}
+	reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+	assert.NoError(err)
+	for _, reason := range reasons {
+		assert.Equal(txpoolcfg.Success, reason, reason.String())
+	}
+	require.Equal(txsAmount, pool.pending.Len())
+
+	change.ChangeBatch[0].Changes = nil
+	change.ChangeBatch[0].BlockHeight = 1
+	change.BlockGasLimit = 200_000
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	stats := pool.GasLimitStats()
+	require.Equal(uint64(1), stats.Block)
+	require.Equal(uint64(1_000_000), stats.OldGasLimit)
+	require.Equal(uint64(200_000), stats.NewGasLimit)
+	require.Equal(txsAmount/2, stats.Demoted)
+	require.Zero(stats.Promoted)
+	require.Equal(txsAmount/2, stats.Pending)
+	require.Equal(txsAmount, stats.Pending+stats.BaseFee+stats.Queued)
+	require.Equal([]GasLimitStats{stats}, reported)
+
+	// same gas limit - nothing to report, stats of last transition are kept
+	change.ChangeBatch[0].BlockHeight = 2
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	require.Equal(stats, pool.GasLimitStats())
+	require.Len(reported, 1)
+
+	change.ChangeBatch[0].BlockHeight = 3
+	change.BlockGasLimit = 1_000_000
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	stats = pool.GasLimitStats()
+	require.Equal(uint64(3), stats.Block)
+	require.Equal(uint64(200_000), stats.OldGasLimit)
+	require.Equal(uint64(1_000_000), stats.NewGasLimit)
+	require.Zero(stats.Demoted)
+	require.Equal(txsAmount/2, stats.Promoted)
+	require.Equal(txsAmount, stats.Pending)
+	require.Len(reported, 2)
+	require.Equal(stats, reported[1])
+}
+
+func TestQueuedExpiry(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	cfg.QueuedLifetime = time.Hour
+	cfg.LocalQueuedLifetime = 0
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	now := time.Unix(1_700_000_000, 0)
+	pool.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(2, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+
+	// nonce gaps: sender's nonce is 2, so both txs go to queued sub-pool
+	var txSlots types.TxSlots
+	localTxn := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: 5}
+	localTxn.IDHash[0] = 1
+	remoteTxn := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: 7}
+	remoteTxn.IDHash[0] = 2
+	txSlots.Append(localTxn, addr[:], true)
+	txSlots.Append(remoteTxn, addr[:], false)
+	reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+	assert.NoError(err)
+	for _, reason := range reasons {
+		assert.Equal(txpoolcfg.Success, reason, reason.String())
+	}
+	require.Equal(2, pool.queued.Len())
+
+	// not expired yet
+	now = now.Add(cfg.QueuedLifetime - time.Second)
+	pool.lock.Lock()
+	pool.expireQueuedLocked()
+	pool.lock.Unlock()
+	require.Equal(2, pool.queued.Len())
+
+	now = now.Add(2 * time.Second)
+	pool.lock.Lock()
+	pool.expireQueuedLocked()
+	pool.lock.Unlock()
+	require.Equal(1, pool.queued.Len())
+	require.Equal(localTxn.IDHash, pool.queued.Best().Tx.IDHash)
+
+	reason, ok := pool.discardReasonsLRU.Get(string(remoteTxn.IDHash[:]))
+	require.True(ok)
+	require.Equal(txpoolcfg.Expired, reason)
+	_, ok = pool.byHash[string(remoteTxn.IDHash[:])]
+	require.False(ok)
+}
+
+// TestQueuedExpiryAfterRestart - admission time is not persisted: lifetime of txs loaded from DB starts at restart
+func TestQueuedExpiryAfterRestart(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	cfg.QueuedLifetime = time.Hour
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	now := time.Unix(1_700_000_000, 0)
+	pool.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(2, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+
+	// legacy txn: nonce=7 (nonce gap - queued), gasPrice=300_000, gas=100_000, chainID=1
+	txRlp := hexutility.MustDecodeHex("e307830493e0830186a09400000000000000000000000000000000000000018080250101")
+	parseCtx := types.NewTxParseContext(*u256.N1)
+	parseCtx.WithSender(false)
+	txn := &types.TxSlot{}
+	_, err = parseCtx.ParseTransaction(txRlp, 0, txn, nil, false /* hasEnvelope */, true /* wrappedWithBlobs */, nil)
+	require.NoError(err)
+	var txSlots types.TxSlots
+	txSlots.Append(txn, addr[:], false)
+	reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+	assert.NoError(err)
+	for _, reason := range reasons {
+		assert.Equal(txpoolcfg.Success, reason, reason.String())
+	}
+	require.Equal(1, pool.queued.Len())
+	require.NoError(pool.flushLocked(tx))
+
+	// restart close to expiry
+	now = now.Add(cfg.QueuedLifetime - time.Minute)
+	p2, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	p2.now = func() time.Time { return now }
+	p2.senders = pool.senders // senders are not persisted
+	require.NoError(coreDB.View(ctx, func(coreTx kv.Tx) error { return p2.fromDB(ctx, tx, coreTx) }))
+	require.Equal(1, p2.queued.Len())
+	require.Equal(now, p2.queued.Best().addedAt)
+
+	// lifetime since first admission is over, but not since restart
+	now = now.Add(2 * time.Minute)
+	p2.lock.Lock()
+	p2.expireQueuedLocked()
+	p2.lock.Unlock()
+	require.Equal(1, p2.queued.Len())
+
+	now = now.Add(cfg.QueuedLifetime)
+	p2.lock.Lock()
+	p2.expireQueuedLocked()
+	p2.lock.Unlock()
+	require.Zero(p2.queued.Len())
+}
+
+func TestAddLocalTxsSingleAnnouncement(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 1)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+
+	ctx := context.Background()
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(4, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	select {
+	case <-ch:
+	default:
+	}
+
+	add := func(nonces ...uint64) {
+		var txSlots types.TxSlots
+		for _, nonce := range nonces {
+			txn := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: nonce}
+			txn.IDHash[0] = byte(nonce)
+			txSlots.Append(txn, addr[:], true)
+		}
+		reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+		assert.NoError(err)
+		for _, reason := range reasons {
+			assert.Equal(txpoolcfg.Success, reason, reason.String())
+		}
+	}
+
+	// txns are collected by both promote and success loop of AddLocalTxs: one message without duplicates
+	add(4, 5, 6)
+	require.Equal(3, pool.pending.Len())
+	require.Len(ch, 1)
+	announcements := <-ch
+	require.Equal(3, announcements.Len())
+	seen := map[byte]struct{}{}
+	for i := 0; i < announcements.Len(); i++ {
+		_, _, hash := announcements.At(i)
+		seen[hash[0]] = struct{}{}
+	}
+	require.Equal(map[byte]struct{}{4: {}, 5: {}, 6: {}}, seen)
+
+	// full channel: announcement is dropped, pool is not blocked
+	ch <- types.Announcements{}
+	dropped := announcementsDroppedCounter.GetValueUint64()
+	add(7)
+	require.Equal(4, pool.pending.Len())
+	require.Len(ch, 1)
+	require.Equal(dropped+1, announcementsDroppedCounter.GetValueUint64())
+}
+
+func TestAnnounceDelayJitter(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 10)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	cfg.AnnounceDelayJitter = 100 * time.Millisecond
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	pool.announceJitter.rand = rand.New(rand.NewSource(1))
+	expectedDelay := time.Duration(rand.New(rand.NewSource(1)).Int63n(int64(cfg.AnnounceDelayJitter)))
+
+	ctx := context.Background()
+	require.NoError(pool.Start(ctx, db))
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(4, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+	select {
+	case <-ch:
+	default:
+	}
+
+	newTxs := func(nonces ...uint64) (txSlots types.TxSlots) {
+		for _, nonce := range nonces {
+			txn := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: nonce}
+			txn.IDHash[0] = byte(nonce)
+			txSlots.Append(txn, addr[:], true)
+		}
+		return txSlots
+	}
+	addLocal := func(nonces ...uint64) {
+		reasons, err := pool.AddLocalTxs(ctx, newTxs(nonces...), tx)
+		assert.NoError(err)
+		for _, reason := range reasons {
+			assert.Equal(txpoolcfg.Success, reason, reason.String())
+		}
+	}
+	hashes := func(announcements types.Announcements) map[byte]struct{} {
+		seen := map[byte]struct{}{}
+		for i := 0; i < announcements.Len(); i++ {
+			_, _, hash := announcements.At(i)
+			seen[hash[0]] = struct{}{}
+		}
+		return seen
+	}
+
+	// local: delayed by injected randomness
+	start := time.Now()
+	addLocal(4, 5, 6)
+	require.Equal(3, pool.pending.Len())
+	require.Len(ch, 0)
+	pool.announceJitter.lock.Lock()
+	require.Len(pool.announceJitter.queue, 1)
+	due := pool.announceJitter.queue[0].due
+	pool.announceJitter.lock.Unlock()
+	require.WithinDuration(start.Add(expectedDelay), due, time.Since(start))
+
+	// remote: immediate
+	pool.AddRemoteTxs(ctx, newTxs(7))
+	require.NoError(pool.processRemoteTxs(ctx))
+	require.Len(ch, 1)
+	require.Equal(map[byte]struct{}{7: {}}, hashes(<-ch))
+
+	select {
+	case announcements := <-ch:
+		require.False(time.Now().Before(due))
+		require.Equal(map[byte]struct{}{4: {}, 5: {}, 6: {}}, hashes(announcements))
+	case <-time.After(10 * time.Second):
+		t.Fatal("delayed announcements are not sent")
+	}
+
+	// shutdown: waiting announcements are sent immediately, later ones are not delayed
+	pool.announceJitter.lock.Lock()
+	pool.announceJitter.jitter = time.Hour
+	pool.announceJitter.lock.Unlock()
+	addLocal(8)
+	require.Len(ch, 0)
+	pool.closeAnnounceJitter()
+	require.Len(ch, 1)
+	require.Equal(map[byte]struct{}{8: {}}, hashes(<-ch))
+	addLocal(9)
+	require.Len(ch, 1)
+	require.Equal(map[byte]struct{}{9: {}}, hashes(<-ch))
+}
+
+// shutdown flush waits for space in full channel, drops announcements only after announceFlushTimeout
+func TestCloseAnnounceJitterBlocks(t *testing.T) {
+	require := require.New(t)
+	ch := make(chan types.Announcements, 1)
+	pool := &TxPool{newPendingTxs: ch, logger: log.New()}
+	closeWith := func(hash byte) {
+		t.Helper()
+		pool.announceJitter = newAnnounceJitter(time.Hour, pool.sendAnnouncements)
+		var announcements types.Announcements
+		announcements.Append(types.DynamicFeeTxType, 100, []byte{hash})
+		require.True(pool.announceJitter.add(announcements))
+		pool.closeAnnounceJitter()
+	}
+
+	ch <- types.Announcements{} // channel is full
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		<-ch
+	}()
+	closeWith(1)
+	announcements := <-ch
+	require.Equal(1, announcements.Len())
+	_, _, hash := announcements.At(0)
+	require.Equal([]byte{1}, hash)
+
+	defer func(timeout time.Duration) { announceFlushTimeout = timeout }(announceFlushTimeout)
+	announceFlushTimeout = 10 * time.Millisecond
+	ch <- types.Announcements{} // nobody reads
+	dropped := announcementsDroppedCounter.GetValueUint64()
+	closeWith(2)
+	require.Equal(dropped+1, announcementsDroppedCounter.GetValueUint64())
+}
+
+func TestPromotedFromQueuedAnnouncement(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+
+	ctx := context.Background()
+	h1 := gointerfaces.ConvertHashToH256([32]byte{})
+	change := &remote.StateChangeBatch{
+		PendingBlockBaseFee: 200_000,
+		BlockGasLimit:       1_000_000,
+		ChangeBatch: []*remote.StateChange{
+			{BlockHeight: 0, BlockHash: h1},
+		},
+	}
+	var addr [20]byte
+	addr[0] = 1
+	v := types.EncodeAccountBytesV3(4, uint256.NewInt(1*common.Ether), make([]byte, 32), 1)
+	change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+		Action:  remote.Action_UPSERT,
+		Address: gointerfaces.ConvertAddressToH160(addr),
+		Data:    v,
+	})
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	err = pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx)
+	assert.NoError(err)
+
+	kindOf := func(announcements types.Announcements, hash [32]byte) (types.AnnouncementKind, bool) {
+		for i := 0; i < announcements.Len(); i++ {
+			if _, _, h := announcements.At(i); bytes.Equal(h, hash[:]) {
+				return announcements.KindAt(i), true
+			}
+		}
+		return 0, false
+	}
+	add := func(txn *types.TxSlot) types.Announcements {
+		var txSlots types.TxSlots
+		txSlots.Append(txn, addr[:], true)
+		reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+		assert.NoError(err)
+		for _, reason := range reasons {
+			assert.Equal(txpoolcfg.Success, reason, reason.String())
+		}
+		select {
+		case announcements := <-ch:
+			return announcements
+		default:
+			return types.Announcements{}
+		}
+	}
+
+	// sender's nonce is 4: nonce 5 has a gap and waits in queued
+	gapped := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: 5}
+	gapped.IDHash[0] = 1
+	add(gapped)
+	require.Equal(1, pool.queued.Len())
+
+	filler := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: 4}
+	filler.IDHash[0] = 2
+	announcements := add(filler)
+	require.Equal(0, pool.queued.Len())
+	require.Equal(2, pool.pending.Len())
+
+	kind, ok := kindOf(announcements, gapped.IDHash)
+	require.True(ok)
+	require.Equal(types.AnnouncePromotedFromQueued, kind, kind.String())
+	kind, ok = kindOf(announcements, filler.IDHash)
+	require.True(ok)
+	require.Equal(types.AnnounceNewPending, kind, kind.String())
+
+	// kinds survive dedup
+	dedup := announcements.DedupCopy()
+	kind, ok = kindOf(dedup, gapped.IDHash)
+	require.True(ok)
+	require.Equal(types.AnnouncePromotedFromQueued, kind, kind.String())
+}
+
+func TestPeerTxStats(t *testing.T) {
+	require := require.New(t)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	pool, err := New(make(chan types.Announcements, 100), coreDB, txpoolcfg.DefaultConfig, kvcache.New(kvcache.DefaultCoherentConfig), *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	require.NoError(err)
+	now := time.Unix(1_700_000_000, 0)
+	pool.now = func() time.Time { return now }
+
+	peerA, peerB := gointerfaces.ConvertHashToH512([64]byte{1}), gointerfaces.ConvertHashToH512([64]byte{2})
+	var addr [20]byte
+	addr[0] = 1
+	newTxs := func(from byte, n int) (txs types.TxSlots) {
+		for i := 0; i < n; i++ {
+			txn := &types.TxSlot{Nonce: uint64(i)}
+			txn.IDHash[0], txn.IDHash[1] = from, byte(i)
+			txs.Append(txn, addr[:], false)
+		}
+		return txs
+	}
+	ctx := context.Background()
+	pool.AddRemoteTxsFromPeer(ctx, newTxs(1, 4), peerA)
+	pool.AddRemoteTxsFromPeer(ctx, newTxs(2, 4), peerB)
+	pool.AddRemoteTxs(ctx, newTxs(3, 2))                // unknown source
+	pool.AddRemoteTxsFromPeer(ctx, newTxs(1, 4), peerA) // duplicates are not accounted
+	require.Len(pool.unprocessedRemotePeers, len(pool.unprocessedRemoteTxs.Txs))
+
+	// emulate processRemoteTxs: validation reasons aligned with all txs, add reasons - with valid txs only
+	reasons := []txpoolcfg.DiscardReason{
+		txpoolcfg.NotSet, txpoolcfg.NotSet, txpoolcfg.NotSet, txpoolcfg.UnderPriced, // peerA: mostly good
+		txpoolcfg.UnderPriced, txpoolcfg.UnderPriced, txpoolcfg.NonceTooLow, txpoolcfg.NotSet, // peerB: mostly spam
+		txpoolcfg.NotSet, txpoolcfg.FeeTooLow, // unknown
+	}
+	addReasons := []txpoolcfg.DiscardReason{
+		txpoolcfg.NotSet, txpoolcfg.NotSet, txpoolcfg.DuplicateHash, // peerA
+		txpoolcfg.PendingPoolOverflow, // peerB
+		txpoolcfg.NotSet,              // unknown
+	}
+	pool.lock.Lock()
+	pool.accountRemoteTxsLocked(reasons, addReasons)
+	pool.lock.Unlock()
+
+	stats := pool.PeerStats()
+	require.Len(stats, 2)
+	a, b := stats[gointerfaces.ConvertH512ToHash(peerA)], stats[gointerfaces.ConvertH512ToHash(peerB)]
+	require.Equal(uint64(2), a.Accepted)
+	require.Equal(map[txpoolcfg.DiscardReason]uint64{txpoolcfg.DuplicateHash: 1, txpoolcfg.UnderPriced: 1}, a.Rejected)
+	require.Equal(uint64(0), b.Accepted)
+	require.Equal(map[txpoolcfg.DiscardReason]uint64{txpoolcfg.UnderPriced: 2, txpoolcfg.NonceTooLow: 1, txpoolcfg.PendingPoolOverflow: 1}, b.Rejected)
+	require.Equal(uint64(4), b.RejectedTotal())
+
+	// sliding window: old results are forgotten
+	now = now.Add(peerStatsWindow / 2)
+	pool.peerStats.add(gointerfaces.ConvertH512ToHash(peerB), now, txpoolcfg.Success)
+	now = now.Add(peerStatsWindow/2 + time.Second)
+	stats = pool.PeerStats()
+	require.Len(stats, 1)
+	require.Equal(PeerTxStats{Accepted: 1, Rejected: map[txpoolcfg.DiscardReason]uint64{}}, stats[gointerfaces.ConvertH512ToHash(peerB)])
+	now = now.Add(peerStatsWindow)
+	pool.prunePeerStats() // silent peers are forgotten even if nobody calls PeerStats
+	require.Empty(pool.peerStats.peers)
+	require.Empty(pool.PeerStats())
+}
+
+func TestStateVersionRegression(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	ch := make(chan types.Announcements, 100)
+	coreDB, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+	db := memdb.NewTestPoolDB(t)
+
+	cfg := txpoolcfg.DefaultConfig
+	sendersCache := kvcache.New(kvcache.DefaultCoherentConfig)
+	pool, err := New(ch, coreDB, cfg, sendersCache, *u256.N1, nil, nil, nil, nil, fixedgas.DefaultMaxBlobsPerBlock, nil, log.New())
+	assert.NoError(err)
+	require.True(pool != nil)
+	ctx := context.Background()
+
+	var addr [20]byte
+	addr[0] = 1
+	var prevAcc []byte
+	// setState - state of node: sender account and state version
+	setState := func(stateVersionID uint64, balance *uint256.Int) []byte {
+		acc := types.EncodeAccountBytesV3(2, balance, nil, 0)
+		require.NoError(coreDB.Update(ctx, func(tx kv.RwTx) error {
+			d, err := state.NewSharedDomains(tx, log.New())
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			if err := d.DomainPut(kv.AccountsDomain, addr[:], nil, acc, prevAcc, 0); err != nil {
+				return err
+			}
+			if err := d.Flush(ctx, tx); err != nil {
+				return err
+			}
+			var versionID [8]byte
+			binary.BigEndian.PutUint64(versionID[:], stateVersionID)
+			return tx.Put(kv.Sequence, kv.PlainStateVersion, versionID[:])
+		}))
+		prevAcc = acc
+		return acc
+	}
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	newBlock := func(stateVersionID, blockNum uint64, acc []byte) {
+		change := &remote.StateChangeBatch{
+			StateVersionId:      stateVersionID,
+			PendingBlockBaseFee: 200_000,
+			BlockGasLimit:       1_000_000,
+			ChangeBatch: []*remote.StateChange{
+				{BlockHeight: blockNum, BlockHash: gointerfaces.ConvertHashToH256([32]byte{byte(blockNum)})},
+			},
+		}
+		if acc != nil {
+			change.ChangeBatch[0].Changes = append(change.ChangeBatch[0].Changes, &remote.AccountChange{
+				Action:  remote.Action_UPSERT,
+				Address: gointerfaces.ConvertAddressToH160(addr),
+				Data:    acc,
+			})
+		}
+		require.NoError(pool.OnNewBlock(ctx, change, types.TxSlots{}, types.TxSlots{}, types.TxSlots{}, tx))
+	}
+	addTx := func(idHash byte, nonce uint64, value *uint256.Int) txpoolcfg.DiscardReason {
+		var txSlots types.TxSlots
+		txSlot := &types.TxSlot{Tip: *uint256.NewInt(300_000), FeeCap: *uint256.NewInt(300_000), Gas: 100_000, Nonce: nonce, Value: *value}
+		txSlot.IDHash[0] = idHash
+		txSlots.Append(txSlot, addr[:], true)
+		reasons, err := pool.AddLocalTxs(ctx, txSlots, tx)
+		require.NoError(err)
+		require.Len(reasons, 1)
+		return reasons[0]
+	}
+	oneEther, tenEther := uint256.NewInt(common.Ether), uint256.NewInt(10*common.Ether)
+	halfEther, fiveEther := uint256.NewInt(common.Ether/2), uint256.NewInt(5*common.Ether)
+
+	newBlock(4, 1, setState(4, oneEther))
+	newBlock(5, 2, setState(5, oneEther))
+	// both txs are valid, but balance is enough only for 1 of them
+	require.Equal(txpoolcfg.Success, addTx(1, 2, halfEther))
+	require.Equal(txpoolcfg.Success, addTx(2, 3, halfEther))
+	require.Equal(1, pool.pending.Len())
+	require.Equal(txpoolcfg.InsufficientFunds, addTx(3, 4, fiveEther))
+
+	// node restarted with another state: version went backwards, block doesn't touch sender
+	regressions := stateRegressionsCounter.GetValueUint64()
+	setState(4, tenEther)
+	newBlock(4, 3, nil)
+	require.Equal(regressions+1, stateRegressionsCounter.GetValueUint64())
+
+	// pool txs are re-validated with fresh balance, and it is used for new txs
+	require.Equal(2, pool.pending.Len())
+	require.Equal(txpoolcfg.Success, addTx(4, 4, fiveEther))
+	require.Equal(3, pool.pending.Len())
+
+	// versions go forward again - no regression
+	newBlock(5, 4, setState(5, tenEther))
+	require.Equal(regressions+1, stateRegressionsCounter.GetValueUint64())
+}
@@ -45,6 +45,14 @@ type Config struct {
 	PriceBump           uint64 // Price bump percentage to replace an already existing transaction
 	BlobPriceBump       uint64 //Price bump percentage to replace an existing 4844 blob txn (type-3)
 
+	MaxAuthorizationsPerTx uint64 // Max number of authorizations in EIP-7702 set-code txn (type-4). 0 - unlimited
+
+	QueuedLifetime      time.Duration // Max time non-executable (queued) remote txn can stay in pool (since admission or restart). 0 - disabled
+	LocalQueuedLifetime time.Duration // Same as QueuedLifetime, but for local txs. 0 - disabled (local txs never expire)
+
+	MaxTxSize      datasize.ByteSize // Max size of remote txn RLP. Blob txs are measured without blobs, commitments and proofs. 0 - unlimited
+	MaxLocalTxSize datasize.ByteSize // Same as MaxTxSize, but for local txs. 0 - unlimited
+
 	// regular batch tasks processing
 	SyncToNewPeersEvery   time.Duration
 	ProcessRemoteTxsEvery time.Duration
@@ -57,6 +65,14 @@ type Config struct {
 	MdbxGrowthStep  datasize.ByteSize
 
 	NoGossip bool // this mode doesn't broadcast any txs, and if receive remote-txn - skip it
+
+	// Max amount of senders, whose nonce/balance are re-read when StateVersionId of new block goes backwards (cache
+	// can't be trusted). Senders of pending sub-pool go first. 0 - only senders changed by block are re-read
+	RevalidateSendersOnRegression int
+
+	// Announcements of local txs are sent after uniform random delay up to this bound and shuffled inside of batch: makes
+	// node harder to fingerprint as origin of txs. Announcements of remote txs are not delayed. 0 - disabled
+	AnnounceDelayJitter time.Duration
 }
 
 var DefaultConfig = Config{
@@ -76,7 +92,17 @@ var DefaultConfig = Config{
 	PriceBump:          10,  // Price bump percentage to replace an already existing transaction
 	BlobPriceBump:      100,
 
+	MaxAuthorizationsPerTx: 64,
+
+	QueuedLifetime:      3 * time.Hour,
+	LocalQueuedLifetime: 0,
+
+	MaxTxSize:      128 * datasize.KB, // compatible with Geth
+	MaxLocalTxSize: 128 * datasize.KB,
+
 	NoGossip: false,
+
+	RevalidateSendersOnRegression: 10_000,
 }
 
 type DiscardReason uint8
@@ -114,6 +140,12 @@ const (
 	UnmatchedBlobTxExt  DiscardReason = 29 // KZGcommitments must match the corresponding blobs and proofs
 	BlobTxReplace       DiscardReason = 30 // Cannot replace type-3 blob txn with another type of txn
 	BlobPoolOverflow    DiscardReason = 31 // The total number of blobs (through blob txs) in the pool has reached its limit
+	Expired             DiscardReason = 32 // Queued txn stayed in pool longer than Config.QueuedLifetime
+	TxTooLarge          DiscardReason = 33 // RLP of txn is bigger than Config.MaxTxSize
+	InvalidAuthCount    DiscardReason = 34 // Set-code txn must have at least one and at most Config.MaxAuthorizationsPerTx authorizations
+	CreateSetCodeTxn    DiscardReason = 35 // Set-code transactions cannot have the form of a create transaction
+	AuthorityReserved   DiscardReason = 36 // Authority of set-code txn has own txs in pool: authorization would invalidate their nonces
+	InflightTxnLimit    DiscardReason = 37 // Sender is authority of set-code txn in pool: only 1 txn in flight is allowed
 
 )
 
@@ -177,6 +209,18 @@ func (r DiscardReason) String() string {
 		return "can't replace blob-txn with a non-blob-txn"
 	case BlobPoolOverflow:
 		return "blobs limit in txpool is full"
+	case Expired:
+		return "queued txn lifetime expired"
+	case TxTooLarge:
+		return "transaction size exceeds limit"
+	case InvalidAuthCount:
+		return "set-code transactions must have at least one and not too many authorizations"
+	case CreateSetCodeTxn:
+		return "set-code transactions cannot have the form of a create transaction"
+	case AuthorityReserved:
+		return "authority of set-code transaction has pending transactions"
+	case InflightTxnLimit:
+		return "sender is authority of pending set-code transaction: in-flight transactions limit reached"
 	default:
 		panic(fmt.Sprintf("discard reason: %d", r))
 	}
@@ -255,6 +299,19 @@ func CalcIntrinsicGas(dataLen, dataNonZeroLen uint64, accessList types.AccessLis
 	return gas, Success
 }
 
+// AddAuthorizationsGas adds intrinsic gas of EIP-7702 authorization list: each authorization is charged as creation of empty account.
+func AddAuthorizationsGas(gas, authCount uint64) (uint64, DiscardReason) {
+	product, overflow := emath.SafeMul(authCount, fixedgas.PerEmptyAccountCost)
+	if overflow {
+		return 0, GasUintOverflow
+	}
+	gas, overflow = emath.SafeAdd(gas, product)
+	if overflow {
+		return 0, GasUintOverflow
+	}
+	return gas, Success
+}
+
 // toWordSize returns the ceiled word size required for memory expansion.
 func toWordSize(size uint64) uint64 {
 	if size > math.MaxUint64-31 {
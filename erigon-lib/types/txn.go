@@ -49,6 +49,7 @@ type TxParseConfig struct {
 type TxParseContext struct {
 	Keccak2         hash.Hash
 	Keccak1         hash.Hash
+	keccakAuth      hash.Hash // sighash of EIP-7702 authorizations: Keccak1 and Keccak2 hash txn while they are parsed
 	validateRlp     func([]byte) error
 	ChainID         uint256.Int // Signature values
 	R               uint256.Int // Signature values
@@ -74,6 +75,7 @@ func NewTxParseContext(chainID uint256.Int) *TxParseContext {
 		withSender: true,
 		Keccak1:    sha3.NewLegacyKeccak256(),
 		Keccak2:    sha3.NewLegacyKeccak256(),
+		keccakAuth: sha3.NewLegacyKeccak256(),
 	}
 
 	// behave as of London enabled
@@ -108,6 +110,24 @@ type TxSlot struct {
 	Blobs       [][]byte
 	Commitments []gokzg4844.KZGCommitment
 	Proofs      []gokzg4844.KZGProof
+
+	// EIP-7702: Set EOA account code
+	Authorizations []Authorization
+}
+
+// Authorization - tuple of EIP-7702 authorization list: [chain_id, address, nonce, y_parity, r, s]
+type Authorization struct {
+	ChainID uint256.Int
+	Address common.Address // code of this address is delegated to
+	Nonce   uint64
+	YParity byte
+	R, S    uint256.Int
+
+	// Authority - recovered signer of authorization. nil if signature is invalid (such authorization is skipped
+	// at execution - it doesn't make txn invalid) or if TxParseContext doesn't recover senders (see WithSender)
+	Authority *common.Address
+
+	sighash [32]byte // keccak256(MAGIC || rlp([chain_id, address, nonce])), hashed at parse to not hold parsed payload
 }
 
 const (
@@ -115,8 +135,12 @@ const (
 	AccessListTxType byte = 1 // EIP-2930
 	DynamicFeeTxType byte = 2 // EIP-1559
 	BlobTxType       byte = 3 // EIP-4844
+	SetCodeTxType    byte = 4 // EIP-7702
 )
 
+// AuthorizationMagic - prefix of authorization signing hash: keccak256(MAGIC || rlp([chain_id, address, nonce]))
+const AuthorizationMagic byte = 0x05
+
 var ErrParseTxn = fmt.Errorf("%w transaction", rlp.ErrParse)
 
 var ErrRejected = errors.New("rejected")
@@ -184,7 +208,7 @@ func (ctx *TxParseContext) ParseTransaction(payload []byte, pos int, slot *TxSlo
 	// If it is non-legacy transaction, the transaction type follows, and then the list
 	if !legacy {
 		slot.Type = payload[p]
-		if slot.Type > BlobTxType {
+		if slot.Type > SetCodeTxType {
 			return 0, fmt.Errorf("%w: unknown transaction type: %d", ErrParseTxn, slot.Type)
 		}
 		p++
@@ -465,6 +489,25 @@ func (ctx *TxParseContext) parseTransactionBody(payload []byte, pos, p0 int, slo
 		}
 		p = dataPos + dataLen
 	}
+	if slot.Type == SetCodeTxType {
+		dataPos, dataLen, err = rlp.List(payload, p)
+		if err != nil {
+			return 0, fmt.Errorf("%w: authorization list len: %s", ErrParseTxn, err) //nolint
+		}
+		authPos := dataPos
+		for authPos < dataPos+dataLen {
+			var auth Authorization
+			authPos, err = ctx.parseAuthorization(payload, authPos, &auth)
+			if err != nil {
+				return 0, err
+			}
+			slot.Authorizations = append(slot.Authorizations, auth)
+		}
+		if authPos != dataPos+dataLen {
+			return 0, fmt.Errorf("%w: extraneous space in the authorization list", ErrParseTxn)
+		}
+		p = dataPos + dataLen
+	}
 	// This is where the data for Sighash ends
 	// Next follows V of the signature
 	var vByte byte
@@ -618,9 +661,91 @@ func (ctx *TxParseContext) parseTransactionBody(payload []byte, pos, p0 int, slo
 	//take last 20 bytes as address
 	copy(sender, ctx.buf[12:32])
 
+	for i := range slot.Authorizations {
+		ctx.recoverAuthority(&slot.Authorizations[i])
+	}
 	return p, nil
 }
 
+// parseAuthorization - parses tuple of EIP-7702 authorization list. Out of bounds fields make whole txn invalid,
+// but signature is checked only by recoverAuthority: invalid signature only makes authorization skipped
+func (ctx *TxParseContext) parseAuthorization(payload []byte, pos int, auth *Authorization) (p int, err error) {
+	dataPos, dataLen, err := rlp.List(payload, pos)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization len: %s", ErrParseTxn, err) //nolint
+	}
+	p, err = rlp.U256(payload, dataPos, &auth.ChainID)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization chainId: %s", ErrParseTxn, err) //nolint
+	}
+	addrPos, err := rlp.StringOfLen(payload, p, 20)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization address len: %s", ErrParseTxn, err) //nolint
+	}
+	copy(auth.Address[:], payload[addrPos:addrPos+20])
+	p, auth.Nonce, err = rlp.U64(payload, addrPos+20)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization nonce: %s", ErrParseTxn, err) //nolint
+	}
+	if ctx.withSender {
+		var prefix [1 + 10]byte
+		prefix[0] = AuthorizationMagic
+		n := rlp.EncodeListPrefix(p-dataPos, prefix[1:])
+		ctx.keccakAuth.Reset()
+		_, _ = ctx.keccakAuth.Write(prefix[:1+n])
+		_, _ = ctx.keccakAuth.Write(payload[dataPos:p])
+		_, _ = ctx.keccakAuth.(io.Reader).Read(auth.sighash[:])
+	}
+	var yParity uint64
+	p, yParity, err = rlp.U64(payload, p)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization y_parity: %s", ErrParseTxn, err) //nolint
+	}
+	if yParity > 0xff {
+		return 0, fmt.Errorf("%w: authorization y_parity is too large: %d", ErrParseTxn, yParity)
+	}
+	auth.YParity = byte(yParity)
+	p, err = rlp.U256(payload, p, &auth.R)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization R: %s", ErrParseTxn, err) //nolint
+	}
+	p, err = rlp.U256(payload, p, &auth.S)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authorization S: %s", ErrParseTxn, err) //nolint
+	}
+	if p != dataPos+dataLen {
+		return 0, fmt.Errorf("%w: extraneous space in the authorization", ErrParseTxn)
+	}
+	return p, nil
+}
+
+// recoverAuthority - sets auth.Authority to signer of authorization, leaves it nil if signature is invalid.
+// Doesn't touch ctx.Sighash - it stays sighash of txn
+func (ctx *TxParseContext) recoverAuthority(auth *Authorization) {
+	auth.Authority = nil
+	if !crypto.TransactionSignatureIsValid(auth.YParity, &auth.R, &auth.S, false) {
+		return
+	}
+
+	binary.BigEndian.PutUint64(ctx.Sig[0:8], auth.R[3])
+	binary.BigEndian.PutUint64(ctx.Sig[8:16], auth.R[2])
+	binary.BigEndian.PutUint64(ctx.Sig[16:24], auth.R[1])
+	binary.BigEndian.PutUint64(ctx.Sig[24:32], auth.R[0])
+	binary.BigEndian.PutUint64(ctx.Sig[32:40], auth.S[3])
+	binary.BigEndian.PutUint64(ctx.Sig[40:48], auth.S[2])
+	binary.BigEndian.PutUint64(ctx.Sig[48:56], auth.S[1])
+	binary.BigEndian.PutUint64(ctx.Sig[56:64], auth.S[0])
+	ctx.Sig[64] = auth.YParity
+	if _, err := secp256k1.RecoverPubkeyWithContext(secp256k1.DefaultContext, auth.sighash[:], ctx.Sig[:], ctx.buf[:0]); err != nil {
+		return
+	}
+	ctx.Keccak2.Reset()
+	_, _ = ctx.Keccak2.Write(ctx.buf[1:65])
+	_, _ = ctx.Keccak2.(io.Reader).Read(ctx.buf[:32])
+	authority := common.BytesToAddress(ctx.buf[12:32])
+	auth.Authority = &authority
+}
+
 type PeerID *types.H512
 
 type Hashes []byte // flatten list of 32-byte hashes
@@ -664,40 +789,72 @@ func (h Hashes) DedupCopy() Hashes {
 	return c
 }
 
+// AnnouncementKind - why txn is announced. Local-only: p2p announcements carry only type, size and hash.
+type AnnouncementKind byte
+
+const (
+	AnnounceNewPending         AnnouncementKind = iota // txn entered pending (or basefee) sub-pool. Default kind
+	AnnouncePromotedFromQueued                         // txn was waiting in queued sub-pool (nonce gap, balance, ...) and became executable
+	AnnounceRepoked                                    // already known local txn re-announced, because its transition looks stuck
+)
+
+func (k AnnouncementKind) String() string {
+	switch k {
+	case AnnounceNewPending:
+		return "new-pending"
+	case AnnouncePromotedFromQueued:
+		return "promoted-from-queued"
+	case AnnounceRepoked:
+		return "repoked"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(k))
+	}
+}
+
 type Announcements struct {
 	ts     []byte
 	sizes  []uint32
 	hashes []byte
+	kinds  []AnnouncementKind
 }
 
 func (a *Announcements) Append(t byte, size uint32, hash []byte) {
+	a.AppendKind(AnnounceNewPending, t, size, hash)
+}
+
+func (a *Announcements) AppendKind(kind AnnouncementKind, t byte, size uint32, hash []byte) {
 	a.ts = append(a.ts, t)
 	a.sizes = append(a.sizes, size)
 	a.hashes = append(a.hashes, hash...)
+	a.kinds = append(a.kinds, kind)
 }
 
 func (a *Announcements) AppendOther(other Announcements) {
 	a.ts = append(a.ts, other.ts...)
 	a.sizes = append(a.sizes, other.sizes...)
 	a.hashes = append(a.hashes, other.hashes...)
+	a.kinds = append(a.kinds, other.kinds...)
 }
 
 func (a *Announcements) Reset() {
 	a.ts = a.ts[:0]
 	a.sizes = a.sizes[:0]
 	a.hashes = a.hashes[:0]
+	a.kinds = a.kinds[:0]
 }
 
 func (a Announcements) At(i int) (byte, uint32, []byte) {
 	return a.ts[i], a.sizes[i], a.hashes[i*length.Hash : (i+1)*length.Hash]
 }
-func (a Announcements) Len() int { return len(a.ts) }
+func (a Announcements) KindAt(i int) AnnouncementKind { return a.kinds[i] }
+func (a Announcements) Len() int                      { return len(a.ts) }
 func (a Announcements) Less(i, j int) bool {
 	return bytes.Compare(a.hashes[i*length.Hash:(i+1)*length.Hash], a.hashes[j*length.Hash:(j+1)*length.Hash]) < 0
 }
 func (a Announcements) Swap(i, j int) {
 	a.ts[i], a.ts[j] = a.ts[j], a.ts[i]
 	a.sizes[i], a.sizes[j] = a.sizes[j], a.sizes[i]
+	a.kinds[i], a.kinds[j] = a.kinds[j], a.kinds[i]
 	ii := i * length.Hash
 	jj := j * length.Hash
 	for k := 0; k < length.Hash; k++ {
@@ -723,10 +880,12 @@ func (a Announcements) DedupCopy() Announcements {
 		ts:     make([]byte, unique),
 		sizes:  make([]uint32, unique),
 		hashes: make([]byte, unique*length.Hash),
+		kinds:  make([]AnnouncementKind, unique),
 	}
 	copy(c.hashes, a.hashes[0:length.Hash])
 	c.ts[0] = a.ts[0]
 	c.sizes[0] = a.sizes[0]
+	c.kinds[0] = a.kinds[0]
 	dest := length.Hash
 	j := 1
 	origin := length.Hash
@@ -735,6 +894,7 @@ func (a Announcements) DedupCopy() Announcements {
 			copy(c.hashes[dest:dest+length.Hash], a.hashes[origin:origin+length.Hash])
 			c.ts[j] = a.ts[i]
 			c.sizes[j] = a.sizes[i]
+			c.kinds[j] = a.kinds[i]
 			dest += length.Hash
 			j++
 		}
@@ -770,6 +930,33 @@ func (a Announcements) DedupHashes() Hashes {
 	return c
 }
 
+// Dedup - copy without duplicated hashes, in order of first appearance. Kind of duplicate which is not
+// AnnounceNewPending wins: it's more specific
+func (a Announcements) Dedup() Announcements {
+	if len(a.ts) == 0 {
+		return a
+	}
+	c := Announcements{
+		ts:     make([]byte, 0, len(a.ts)),
+		sizes:  make([]uint32, 0, len(a.sizes)),
+		hashes: make([]byte, 0, len(a.hashes)),
+		kinds:  make([]AnnouncementKind, 0, len(a.kinds)),
+	}
+	seen := make(map[string]int, len(a.ts))
+	for i := range a.ts {
+		t, size, hash := a.At(i)
+		if j, ok := seen[string(hash)]; ok {
+			if c.kinds[j] == AnnounceNewPending {
+				c.kinds[j] = a.kinds[i]
+			}
+			continue
+		}
+		seen[string(hash)] = c.Len()
+		c.AppendKind(a.kinds[i], t, size, hash)
+	}
+	return c
+}
+
 func (a Announcements) Hashes() Hashes {
 	return Hashes(a.hashes)
 }
@@ -782,8 +969,10 @@ func (a Announcements) Copy() Announcements {
 		ts:     common.Copy(a.ts),
 		sizes:  make([]uint32, len(a.sizes)),
 		hashes: common.Copy(a.hashes),
+		kinds:  make([]AnnouncementKind, len(a.kinds)),
 	}
 	copy(c.sizes, a.sizes)
+	copy(c.kinds, a.kinds)
 	return c
 }
 
@@ -24,9 +24,12 @@ import (
 
 	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
 	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/secp256k1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
 
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/fixedgas"
 	"github.com/ledgerwatch/erigon-lib/common/hexutility"
 )
@@ -171,6 +174,28 @@ func TestDedupHashes(t *testing.T) {
 
 }
 
+func TestAnnouncementsDedup(t *testing.T) {
+	var a Announcements
+	a.Append(1, 10, toHashes(3))
+	a.Append(2, 20, toHashes(1))
+	a.AppendKind(AnnouncePromotedFromQueued, 1, 10, toHashes(3))
+	a.Append(2, 20, toHashes(1))
+	a.AppendKind(AnnounceRepoked, 0, 30, toHashes(2))
+
+	c := a.Dedup()
+	require.Equal(t, 5, a.Len())
+	require.Equal(t, 3, c.Len())
+	require.Equal(t, toHashes(3, 1, 2), c.Hashes())
+	tp, size, _ := c.At(0)
+	require.Equal(t, byte(1), tp)
+	require.Equal(t, uint32(10), size)
+	require.Equal(t, AnnouncePromotedFromQueued, c.KindAt(0))
+	require.Equal(t, AnnounceNewPending, c.KindAt(1))
+	require.Equal(t, AnnounceRepoked, c.KindAt(2))
+
+	require.Zero(t, Announcements{}.Dedup().Len())
+}
+
 func toHashes(h ...byte) (out Hashes) {
 	for i := range h {
 		hash := [32]byte{h[i]}
@@ -292,3 +317,111 @@ func TestBlobTxParsing(t *testing.T) {
 	assert.Equal(t, proof0, fatTx.Proofs[0])
 	assert.Equal(t, proof1, fatTx.Proofs[1])
 }
+
+func TestSetCodeTxParsing(t *testing.T) {
+	// minimal rlp encoder: enough to build set-code txn
+	encodePrefix := func(short, long byte, size int) []byte {
+		if size < 56 {
+			return []byte{short + byte(size)}
+		}
+		be := new(uint256.Int).SetUint64(uint64(size)).Bytes()
+		return append([]byte{long + byte(len(be))}, be...)
+	}
+	str := func(b []byte) []byte {
+		if len(b) == 1 && b[0] < 0x80 {
+			return b
+		}
+		return append(encodePrefix(0x80, 0xb7, len(b)), b...)
+	}
+	num := func(n uint64) []byte { return str(new(uint256.Int).SetUint64(n).Bytes()) }
+	list := func(items ...[]byte) []byte {
+		payload := bytes.Join(items, nil)
+		return append(encodePrefix(0xc0, 0xf7, len(payload)), payload...)
+	}
+	sign := func(key byte, prefix byte, content []byte) (yParity, r, s []byte) {
+		h := sha3.NewLegacyKeccak256()
+		h.Write([]byte{prefix})
+		h.Write(content)
+		seckey := make([]byte, 32)
+		seckey[31] = key
+		sig, err := secp256k1.Sign(h.Sum(nil), seckey)
+		require.NoError(t, err)
+		return num(uint64(sig[64])), str(bytes.TrimLeft(sig[:32], "\x00")), str(bytes.TrimLeft(sig[32:64], "\x00"))
+	}
+	// well-known addresses of private keys 0x01 and 0x02
+	key1Addr := common.HexToAddress("0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf")
+	key2Addr := common.HexToAddress("0x2B5AD5c4795c026514f8317c7a215E218DcCD6cF")
+	delegate := common.HexToAddress("0x00000000000000000000000000000000000000ff")
+
+	authorization := func(nonce uint64, tail ...[]byte) []byte {
+		signed := [][]byte{num(1), str(delegate[:]), num(nonce)}
+		v, r, s := sign(2, AuthorizationMagic, list(signed...))
+		items := append(signed, v, r, s)
+		return list(append(items, tail...)...)
+	}
+	invalidSigAuthorization := list(num(1), str(delegate[:]), num(0), num(0), num(1), num(0))
+	setCodeTx := func(authorizations ...[]byte) []byte {
+		unsigned := [][]byte{num(1), num(7), num(2), num(1_000_000_000), num(100_000), str(key2Addr[:]), num(0), str(nil), list(), list(authorizations...)}
+		v, r, s := sign(1, SetCodeTxType, list(unsigned...))
+		return append([]byte{SetCodeTxType}, list(append(unsigned, v, r, s)...)...)
+	}
+
+	t.Run("well-formed", func(t *testing.T) {
+		payload := setCodeTx(authorization(3), invalidSigAuthorization)
+		txType, err := PeekTransactionType(payload)
+		require.NoError(t, err)
+		require.Equal(t, SetCodeTxType, txType)
+
+		ctx := NewTxParseContext(*uint256.NewInt(1))
+		var slot TxSlot
+		var sender [20]byte
+		p, err := ctx.ParseTransaction(payload, 0, &slot, sender[:], false /* hasEnvelope */, false /* wrappedWithBlobs */, nil)
+		require.NoError(t, err)
+		require.Equal(t, len(payload), p)
+		require.Equal(t, key1Addr, common.Address(sender))
+		require.Equal(t, SetCodeTxType, slot.Type)
+		require.Equal(t, uint64(7), slot.Nonce)
+		require.Equal(t, uint64(2), slot.Tip.Uint64())
+		require.Equal(t, uint64(1_000_000_000), slot.FeeCap.Uint64())
+		require.False(t, slot.Creation)
+
+		require.Len(t, slot.Authorizations, 2)
+		auth := slot.Authorizations[0]
+		require.Equal(t, uint64(1), auth.ChainID.Uint64())
+		require.Equal(t, delegate, auth.Address)
+		require.Equal(t, uint64(3), auth.Nonce)
+		require.NotNil(t, auth.Authority)
+		require.Equal(t, key2Addr, *auth.Authority)
+		require.Nil(t, slot.Authorizations[1].Authority, "invalid signature doesn't make txn invalid")
+
+		// authorization doesn't refer to parsed payload: buffer of p2p message can be reused
+		for i := range payload {
+			payload[i] = 0
+		}
+		ctx.recoverAuthority(&auth)
+		require.NotNil(t, auth.Authority)
+		require.Equal(t, key2Addr, *auth.Authority)
+		payload = setCodeTx(authorization(3), invalidSigAuthorization)
+
+		ctx.WithSender(false)
+		slot = TxSlot{}
+		_, err = ctx.ParseTransaction(payload, 0, &slot, nil, false /* hasEnvelope */, false /* wrappedWithBlobs */, nil)
+		require.NoError(t, err)
+		require.Len(t, slot.Authorizations, 2)
+		require.Nil(t, slot.Authorizations[0].Authority)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for name, payload := range map[string][]byte{
+			"extra field in authorization": setCodeTx(authorization(3, num(1))),
+			"y_parity out of bounds":       setCodeTx(list(num(1), str(delegate[:]), num(0), num(256), num(1), num(1))),
+			"short address":                setCodeTx(list(num(1), str(delegate[:19]), num(0), num(0), num(1), num(1))),
+			"unknown type":                 append([]byte{SetCodeTxType + 1}, setCodeTx(authorization(0))[1:]...),
+		} {
+			ctx := NewTxParseContext(*uint256.NewInt(1))
+			var sender [20]byte
+			_, err := ctx.ParseTransaction(payload, 0, &TxSlot{}, sender[:], false /* hasEnvelope */, false /* wrappedWithBlobs */, nil)
+			require.ErrorIs(t, err, ErrParseTxn, name)
+		}
+	})
+}
@@ -70,6 +70,7 @@ import (
 	prototypes "github.com/ledgerwatch/erigon-lib/gointerfaces/typesproto"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/kvcache"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
 	"github.com/ledgerwatch/erigon-lib/kv/remotedbserver"
 	"github.com/ledgerwatch/erigon-lib/kv/temporal"
 	libstate "github.com/ledgerwatch/erigon-lib/state"
@@ -753,6 +754,8 @@ func New(ctx context.Context, stack *node.Node, config *ethconfig.Config, logger
 
 	agg.SetSnapshotBuildSema(blockSnapBuildSema)
 	blockRetire := freezeblocks.NewBlockRetire(1, dirs, blockReader, blockWriter, backend.chainDB, backend.chainConfig, backend.notifications.Events, blockSnapBuildSema, logger)
+	blockRetire.SetProvenance(freezeblocks.Provenance{Version: params.VersionWithCommit(params.GitCommit)})
+	blockRetire.SetFsyncPolicy(config.Snapshot.Fsync)
 
 	miningRPC = privateapi.NewMiningServer(ctx, backend, ethashApi, logger)
 
@@ -1455,15 +1458,31 @@ func setUpBlockReader(ctx context.Context, db kv.RwDB, dirs datadir.Dirs, snConf
 
 	var allBorSnapshots *freezeblocks.BorRoSnapshots
 	if isBor {
-		allBorSnapshots = freezeblocks.NewBorRoSnapshots(snConfig.Snapshot, dirs.Snap, minFrozenBlock, logger)
+		allBorSnapshots = freezeblocks.NewBorRoSnapshots(snConfig.Snapshot, dirs.Snap, minFrozenBlock, snConfig.Genesis.Config, logger)
 	}
 	cr := rawdb.NewCanonicalReader()
-	agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, cr, logger)
+	agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, cr, libstate.DefaultCommitmentValuesTransform, logger)
 	if err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
 
 	agg.SetProduceMod(snConfig.Snapshot.ProduceE3)
+	agg.SetCodeHashIndex(snConfig.Snapshot.CodeHashIndex)
+	agg.SetFsyncPolicy(snConfig.Snapshot.Fsync)
+	// histories without files (commitment) must keep in db txs of last MaxReorgDepthV3 executed blocks: enough for unwind
+	agg.SetHistoryRetentionProvider(func(tx kv.Tx) (uint64, error) {
+		execProgress, err := stages.GetStageProgress(tx, stages.Execution)
+		if err != nil {
+			return 0, err
+		}
+		if execProgress <= config3.MaxReorgDepthV3 {
+			return 0, nil
+		}
+		return rawdbv3.TxNums.Min(tx, execProgress-config3.MaxReorgDepthV3)
+	})
+	if err = agg.SetCompressionDictionaryFiles(snConfig.Snapshot.CompressionDictionaries); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
 
 	g := &errgroup.Group{}
 	g.Go(func() error {
@@ -31,6 +31,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/chain"
 	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/downloader/downloadercfg"
 	"github.com/ledgerwatch/erigon-lib/txpool/txpoolcfg"
 	"github.com/ledgerwatch/erigon/cl/beacon/beacon_router_configuration"
@@ -135,13 +136,30 @@ func init() {
 //go:generate gencodec -dir . -type Config -formats toml -out gen_config.go
 
 type BlocksFreezing struct {
-	Enabled        bool
-	KeepBlocks     bool // produce new snapshots of blocks but don't remove blocks from DB
-	ProduceE2      bool // produce new block files
-	ProduceE3      bool // produce new state files
-	NoDownloader   bool // possible to use snapshots without calling Downloader
-	Verify         bool // verify snapshots on startup
-	DownloaderAddr string
+	Enabled                 bool
+	KeepBlocks              bool // produce new snapshots of blocks but don't remove blocks from DB
+	ProduceE2               bool // produce new block files
+	ProduceE3               bool // produce new state files
+	CodeHashIndex           bool // build code-hash index of code state files, see state.Aggregator.SetCodeHashIndex
+	NoDownloader            bool // possible to use snapshots without calling Downloader
+	Verify                  bool // verify snapshots on startup
+	VerifyChecksumsStrict   bool // refuse to open block snapshots whose checksum differs from the one recorded in DB
+	QuarantineEmptySegments bool // rename empty block snapshots to .broken on open - then Downloader re-fetches them
+	DownloaderAddr          string
+
+	// Fsync - of produced block and state files, see dir.FsyncPolicy
+	Fsync dir.FsyncPolicy
+
+	// VerifyOpenFilesInterval - reads of block segment re-check that file on disk was not modified after open, if last
+	// check was more than interval ago. 0 - disabled. See freezeblocks.RoSnapshots.SetVerifyOpenFilesInterval
+	VerifyOpenFilesInterval time.Duration
+
+	// TxnHashIdxShards - txn-hash indices of new transactions segments are built as this amount of shards, see
+	// coresnaptype.BuildTxnHashIdxShards. 0 or 1 - single files
+	TxnHashIdxShards int
+
+	// CompressionDictionaries - domain name -> dictionary file of its .kv files, see state.Aggregator.SetCompressionDictionary
+	CompressionDictionaries map[string]string
 }
 
 func (s BlocksFreezing) String() string {
@@ -155,6 +173,12 @@ func (s BlocksFreezing) String() string {
 	if !s.ProduceE2 {
 		out = append(out, "--"+FlagSnapStop+"=true")
 	}
+	if s.CodeHashIndex {
+		out = append(out, "--"+FlagSnapStateCodeHashIndex+"=true")
+	}
+	if s.Fsync != dir.FsyncFull {
+		out = append(out, "--"+FlagSnapFsync+"="+s.Fsync.String())
+	}
 	return strings.Join(out, " ")
 }
 
@@ -162,6 +186,13 @@ var (
 	FlagSnapKeepBlocks = "snap.keepblocks"
 	FlagSnapStop       = "snap.stop"
 	FlagSnapStateStop  = "snap.state.stop"
+
+	FlagSnapStateCodeHashIndex         = "snap.state.code-hash-index"
+	FlagSnapStateCompressionDictionary = "snap.state.compression-dictionary"
+	FlagSnapFsync                      = "snap.fsync"
+	FlagSnapVerifyOpenFilesInterval    = "snap.verify-open-files-interval"
+	FlagSnapQuarantineEmptySegments    = "snap.quarantine-empty-segments"
+	FlagSnapTxnHashIdxShards           = "snap.txn-hash-idx-shards"
 )
 
 func NewSnapCfg(enabled, keepBlocks, produceE2, produceE3 bool) BlocksFreezing {
@@ -0,0 +1,16 @@
+package integrity
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+// AccountsCodeCrossCheck - code hash of every account of accounts files must match code of account in CodeDomain as of
+// end of file. Catches code lost by bad merge: reads of such contract return empty code. full=true - also check state
+// as of end of each step inside merged files. Reads only files.
+func AccountsCodeCrossCheck(ctx context.Context, agg *state.Aggregator, failFast bool, fromStep uint64, full bool) error {
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	return ac.DebugAccountsCodeCrossCheck(ctx, failFast, fromStep, full)
+}
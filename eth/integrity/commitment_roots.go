@@ -0,0 +1,96 @@
+package integrity
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/state"
+	"github.com/ledgerwatch/erigon/turbo/services"
+)
+
+// CommitmentRootsMatchHeaders - root hash stored in each commitment file must be equal to state root of header of the
+// block which ends at the file boundary. Boundaries in the middle of block are skipped: there is no header to compare with.
+// Cheap alternative of full trie re-computation - can be run after each new commitment file.
+func CommitmentRootsMatchHeaders(ctx context.Context, chainDB kv.RoDB, agg *state.Aggregator, br services.HeaderReader, failFast bool) error {
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+
+	roots, err := ac.CommitmentFilesRoots()
+	if err != nil {
+		return err
+	}
+	return chainDB.View(ctx, func(tx kv.Tx) error {
+		return checkCommitmentRoots(ctx, tx, roots, br, failFast)
+	})
+}
+
+func checkCommitmentRoots(ctx context.Context, tx kv.Tx, roots []state.CommitmentFileRoot, br services.HeaderReader, failFast bool) error {
+	logEvery := time.NewTicker(20 * time.Second)
+	defer logEvery.Stop()
+
+	var checked, skipped int
+	var firstMismatch error
+	for i, fr := range roots {
+		if fr.EndTxNum == 0 {
+			continue
+		}
+		lastTxNum := fr.EndTxNum - 1
+		ok, blockNum, err := rawdbv3.TxNums.FindBlockNum(tx, lastTxNum)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Info("[integrity] CommitmentRoots: skip file, no block for its end", "file", fr.FileName, "txNum", lastTxNum)
+			skipped++
+			continue
+		}
+		blockLastTxNum, err := rawdbv3.TxNums.Max(tx, blockNum)
+		if err != nil {
+			return err
+		}
+		if blockLastTxNum != lastTxNum {
+			log.Info("[integrity] CommitmentRoots: skip file, it ends in the middle of block", "file", fr.FileName, "block", blockNum, "txNum", lastTxNum, "blockLastTxNum", blockLastTxNum)
+			skipped++
+			continue
+		}
+
+		var mismatch error
+		header, err := br.HeaderByNumber(ctx, tx, blockNum)
+		if err != nil {
+			return err
+		}
+		switch {
+		case header == nil:
+			mismatch = fmt.Errorf("commitment file %s: header of block %d not found", fr.FileName, blockNum)
+		case fr.BlockNum != blockNum:
+			mismatch = fmt.Errorf("commitment file %s: stores state of block %d, expected block %d", fr.FileName, fr.BlockNum, blockNum)
+		case !bytes.Equal(fr.Root, header.Root[:]):
+			mismatch = fmt.Errorf("commitment file %s: root %x != state root %x of header of block %d", fr.FileName, fr.Root, header.Root, blockNum)
+		}
+		if mismatch != nil {
+			if failFast {
+				return mismatch
+			}
+			log.Error("[integrity] CommitmentRoots", "err", mismatch)
+			if firstMismatch == nil {
+				firstMismatch = mismatch
+			}
+		}
+		checked++
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			log.Info("[integrity] CommitmentRoots", "progress", fmt.Sprintf("%d/%d", i+1, len(roots)))
+		default:
+		}
+	}
+	log.Info("[integrity] CommitmentRoots: done", "checked", checked, "skipped", skipped)
+	return firstMismatch
+}
@@ -0,0 +1,79 @@
+package integrity
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	libcommon "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
+	"github.com/ledgerwatch/erigon-lib/state"
+
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/turbo/services"
+)
+
+type testHeaderReader struct {
+	services.HeaderReader
+	headers map[uint64]*types.Header
+}
+
+func (r testHeaderReader) HeaderByNumber(_ context.Context, _ kv.Getter, blockNum uint64) (*types.Header, error) {
+	return r.headers[blockNum], nil
+}
+
+func TestCommitmentRootsMatchHeaders(t *testing.T) {
+	ctx := context.Background()
+	db := memdb.NewTestDB(t)
+
+	// blocks of 5 txs, block 4 is of 8 txs: [20, 28)
+	blockMaxTxNums := []uint64{4, 9, 14, 19, 27, 32, 37, 39}
+	br := testHeaderReader{headers: map[uint64]*types.Header{}}
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		for blockNum, maxTxNum := range blockMaxTxNums {
+			if err := rawdbv3.TxNums.Append(tx, uint64(blockNum), maxTxNum); err != nil {
+				return err
+			}
+			br.headers[uint64(blockNum)] = &types.Header{Number: big.NewInt(int64(blockNum)), Root: libcommon.Hash{byte(blockNum + 1)}}
+		}
+		return nil
+	}))
+
+	// files of 10 txs: [20, 30) ends in the middle of block 5 - skipped
+	fileRoots := func() []state.CommitmentFileRoot {
+		return []state.CommitmentFileRoot{
+			{FileName: "v1-commitment.0-1.kv", StartTxNum: 0, EndTxNum: 10, TxNum: 9, BlockNum: 1, Root: libcommon.Hash{2}.Bytes()},
+			{FileName: "v1-commitment.1-2.kv", StartTxNum: 10, EndTxNum: 20, TxNum: 19, BlockNum: 3, Root: libcommon.Hash{4}.Bytes()},
+			{FileName: "v1-commitment.2-3.kv", StartTxNum: 20, EndTxNum: 30, TxNum: 27, BlockNum: 4, Root: libcommon.Hash{0xff}.Bytes()},
+			{FileName: "v1-commitment.3-4.kv", StartTxNum: 30, EndTxNum: 40, TxNum: 39, BlockNum: 7, Root: libcommon.Hash{8}.Bytes()},
+		}
+	}
+	check := func(roots []state.CommitmentFileRoot, failFast bool) (err error) {
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			err = checkCommitmentRoots(ctx, tx, roots, br, failFast)
+			return nil
+		}))
+		return err
+	}
+
+	require.NoError(t, check(fileRoots(), true))
+
+	roots := fileRoots()
+	roots[1].Root = libcommon.Hash{0xaa}.Bytes()
+	err := check(roots, true)
+	require.ErrorContains(t, err, "v1-commitment.1-2.kv")
+	require.ErrorContains(t, err, "block 3")
+
+	// not fail-fast: all files are checked, first mismatch is returned
+	roots[3].Root = libcommon.Hash{0xbb}.Bytes()
+	err = check(roots, false)
+	require.ErrorContains(t, err, "v1-commitment.1-2.kv")
+
+	roots = fileRoots()
+	roots[3].BlockNum = 6
+	require.ErrorContains(t, check(roots, true), "stores state of block 6, expected block 7")
+}
@@ -7,8 +7,12 @@ const (
 	BlocksTxnID        Check = "BlocksTxnID"
 	InvertedIndex      Check = "InvertedIndex"
 	HistoryNoSystemTxs Check = "HistoryNoSystemTxs"
+	HeadersFirstByte   Check = "HeadersFirstByte"
+	TxnHash2BlockNum   Check = "TxnHash2BlockNum"
+	CommitmentRoots    Check = "CommitmentRoots"
+	AccountsCode       Check = "AccountsCode"
 )
 
 var AllChecks = []Check{
-	Blocks, BlocksTxnID, InvertedIndex, HistoryNoSystemTxs,
+	Blocks, BlocksTxnID, InvertedIndex, HistoryNoSystemTxs, HeadersFirstByte, TxnHash2BlockNum, CommitmentRoots, AccountsCode,
 }
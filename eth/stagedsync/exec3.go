@@ -441,7 +441,7 @@ func ExecV3(ctx context.Context,
 							return err
 						}
 						ac := agg.BeginFilesRo()
-						if _, err = ac.PruneSmallBatches(ctx, 10*time.Second, tx); err != nil { // prune part of retired data, before commit
+						if _, err = ac.PruneSmallBatches(ctx, 10*time.Second, tx); err != nil && !errors.Is(err, state2.ErrPruneBusy) { // prune part of retired data, before commit
 							return err
 						}
 						ac.Close()
@@ -910,7 +910,7 @@ Loop:
 				t1 = time.Since(tt) + ts
 
 				tt = time.Now()
-				if _, err := applyTx.(state2.HasAggTx).AggTx().(*state2.AggregatorRoTx).PruneSmallBatches(ctx, 10*time.Hour, applyTx); err != nil {
+				if _, err := applyTx.(state2.HasAggTx).AggTx().(*state2.AggregatorRoTx).PruneSmallBatches(ctx, 10*time.Hour, applyTx); err != nil && !errors.Is(err, state2.ErrPruneBusy) {
 					return err
 				}
 				t3 = time.Since(tt)
@@ -457,7 +457,7 @@ func FillDBFromSnapshots(logPrefix string, ctx context.Context, tx kv.RwTx, dirs
 			}
 			ac := agg.BeginFilesRo()
 			defer ac.Close()
-			if err := rawdb.WriteSnapshots(tx, blockReader.FrozenFiles(), ac.Files()); err != nil {
+			if err := freezeblocks.WriteSnapshotsWithChecksums(tx, dirs.Snap, blockReader.FrozenFiles(), ac.Files()); err != nil {
 				return err
 			}
 			ac.Close()
@@ -496,15 +496,33 @@ func SnapshotsPrune(s *PruneState, cfg SnapshotsCfg, ctx context.Context, tx kv.
 
 	freezingCfg := cfg.blockReader.FreezingCfg()
 	if freezingCfg.Enabled {
+		// delta written by previous external tx is acknowledged only if that tx was committed
+		var listID uint64
+		if listID, err = rawdb.ReadSnapshotsListID(tx); err != nil {
+			return err
+		}
+		cfg.agg.ConfirmFilesListDelta(listID)
 		if cfg.blockRetire.HasNewFrozenFiles() || cfg.agg.HasNewFrozenFiles() {
-			ac := cfg.agg.BeginFilesRo()
-			defer ac.Close()
-			aggFiles := ac.Files()
-			ac.Close()
-
-			if err := rawdb.WriteSnapshots(tx, cfg.blockReader.FrozenFiles(), aggFiles); err != nil {
+			delta := cfg.agg.FilesListDelta()
+			if delta.Full {
+				err = freezeblocks.WriteSnapshotsWithChecksums(tx, cfg.dirs.Snap, cfg.blockReader.FrozenFiles(), delta.Added)
+			} else {
+				err = freezeblocks.UpdateSnapshotsWithChecksums(tx, cfg.dirs.Snap, cfg.blockReader.FrozenFiles(), delta.Added, delta.Removed)
+			}
+			if err != nil {
 				return err
 			}
+			listID = cfg.agg.PendFilesListDelta(delta)
+			if err = rawdb.WriteSnapshotsListID(tx, listID); err != nil {
+				return err
+			}
+			if !useExternalTx {
+				defer func() {
+					if err == nil { // tx is committed below
+						cfg.agg.ConfirmFilesListDelta(listID)
+					}
+				}()
+			}
 		}
 
 		if freezingCfg.ProduceE2 {
@@ -553,11 +571,16 @@ func SnapshotsPrune(s *PruneState, cfg SnapshotsCfg, ctx context.Context, tx kv.
 
 		}
 
-		pruneLimit := 100
+		pruneLimit, pruneTimeout := 100, 3*time.Second
 		if s.CurrentSyncCycle.IsInitialCycle {
-			pruneLimit = 10_000
+			pruneLimit, pruneTimeout = 10_000, 12*time.Hour
 		}
-		if _, err := cfg.blockRetire.PruneAncientBlocks(tx, pruneLimit); err != nil {
+		if aggTx, ok := tx.(state.HasAggTx); ok { // blocks and state share time budget: side with bigger backlog gets more
+			coordinator := prune.NewCoordinator(prune.BlocksPruner(cfg.blockRetire, pruneLimit), prune.StatePruner(aggTx.AggTx().(*state.AggregatorRoTx)), logger)
+			if _, err := coordinator.Prune(ctx, tx, pruneTimeout); err != nil {
+				return err
+			}
+		} else if _, err := cfg.blockRetire.PruneAncientBlocks(tx, pruneLimit); err != nil {
 			return err
 		}
 	}
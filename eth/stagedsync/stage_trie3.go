@@ -233,7 +233,7 @@ func RebuildPatriciaTrieBasedOnFiles(rwTx kv.RwTx, cfg TrieCfg, ctx context.Cont
 	}
 
 	var foundHash bool
-	toTxNum := rwTx.(*temporal.Tx).AggTx().(*state.AggregatorRoTx).EndTxNumNoCommitment()
+	toTxNum := rwTx.(*temporal.Tx).AggTx().(*state.AggregatorRoTx).MinimaxTxNum(false)
 	ok, blockNum, err := rawdbv3.TxNums.FindBlockNum(rwTx, toTxNum)
 	if err != nil {
 		return libcommon.Hash{}, err
@@ -152,6 +152,8 @@ func (s *EthBackendServer) Subscribe(r *remote.SubscribeRequest, subscribeServer
 	s.logger.Debug("Establishing event subscription channel with the RPC daemon ...")
 	ch, clean := s.events.AddHeaderSubscription()
 	defer clean()
+	// remote RPC daemon re-opens files after event is received and protocol has no message to acknowledge it: it's
+	// not an ack-subscriber (see shards.Events.AddNewSnapshotAckSubscription) and doesn't hold pruning of blocks
 	newSnCh, newSnClean := s.events.AddNewSnapshotSubscription()
 	defer newSnClean()
 	s.logger.Info("new subscription to newHeaders established")
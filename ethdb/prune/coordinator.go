@@ -0,0 +1,199 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+	"github.com/ledgerwatch/erigon-lib/state"
+)
+
+// Pruner - one side of coordinated prune (blocks or state)
+type Pruner interface {
+	// Backlog - remaining work in own units (blocks, steps). 0 - nothing to prune
+	Backlog(tx kv.Tx) (float64, error)
+	// Prune - prune by small batches until `budget` is spent or nothing left
+	Prune(ctx context.Context, tx kv.RwTx, budget time.Duration) (haveMore bool, err error)
+}
+
+type SideReport struct {
+	BacklogBefore, BacklogAfter float64
+	Took                        time.Duration
+	Rounds                      int
+	Share                       float64 // share of budget given on last round
+}
+
+func (r SideReport) String() string {
+	return fmt.Sprintf("backlog=%.1f->%.1f, took=%s, rounds=%d, share=%.2f", r.BacklogBefore, r.BacklogAfter, r.Took, r.Rounds, r.Share)
+}
+
+type Report struct {
+	Blocks, State SideReport
+	Took          time.Duration
+	HaveMore      bool
+}
+
+const (
+	// coordinatorRounds - budget is split into this amount of rounds. Split between sides is re-calculated every round.
+	coordinatorRounds = 10
+	// minShare - side with non-zero backlog gets at least this share of round: to not starve
+	minShare = 0.1
+)
+
+// Coordinator - prunes blocks and state within 1 shared time budget. Alternates small batches of both sides
+// and gives bigger share of time to side which needs more time to finish own backlog (backlog / observed prune speed).
+type Coordinator struct {
+	blocks, state Pruner
+	logger        log.Logger
+	now           func() time.Time // clock of budget. Pruners must use same clock
+}
+
+func NewCoordinator(blocks, state Pruner, logger log.Logger) *Coordinator {
+	return &Coordinator{blocks: blocks, state: state, logger: logger, now: time.Now}
+}
+
+type coordinatorSide struct {
+	p       Pruner
+	rep     *SideReport
+	backlog float64
+	done    bool
+}
+
+// timeToFinish - estimated time to prune whole backlog. Sides without measurements yet are treated as equal.
+func (s *coordinatorSide) timeToFinish() float64 {
+	if s.done || s.backlog <= 0 {
+		return 0
+	}
+	pruned := s.rep.BacklogBefore - s.backlog
+	if s.rep.Took <= 0 || pruned <= 0 {
+		return -1
+	}
+	return s.backlog / (pruned / s.rep.Took.Seconds())
+}
+
+func (c *Coordinator) Prune(ctx context.Context, tx kv.RwTx, budget time.Duration) (rep Report, err error) {
+	started := c.now()
+	deadline := started.Add(budget)
+	sides := [2]*coordinatorSide{{p: c.blocks, rep: &rep.Blocks}, {p: c.state, rep: &rep.State}}
+	for _, s := range sides {
+		if s.backlog, err = s.p.Backlog(tx); err != nil {
+			return rep, err
+		}
+		s.rep.BacklogBefore, s.rep.BacklogAfter = s.backlog, s.backlog
+		s.done = s.backlog <= 0
+	}
+
+	round := budget / coordinatorRounds
+	for !sides[0].done || !sides[1].done {
+		left := deadline.Sub(c.now())
+		if left <= 0 {
+			break
+		}
+		shares := splitShares(sides[0].timeToFinish(), sides[1].timeToFinish())
+		for i, s := range sides {
+			if s.done {
+				continue
+			}
+			s.rep.Share = shares[i]
+			slice := min(time.Duration(float64(round)*shares[i]), deadline.Sub(c.now()))
+			if slice <= 0 {
+				continue
+			}
+			sliceStarted := c.now()
+			haveMore, err := s.p.Prune(ctx, tx, slice)
+			if err != nil {
+				return rep, err
+			}
+			s.rep.Took += c.now().Sub(sliceStarted)
+			s.rep.Rounds++
+			if s.backlog, err = s.p.Backlog(tx); err != nil {
+				return rep, err
+			}
+			s.rep.BacklogAfter = s.backlog
+			s.done = !haveMore || s.backlog <= 0
+		}
+		select {
+		case <-ctx.Done():
+			return rep, ctx.Err()
+		default:
+		}
+	}
+	rep.Took = c.now().Sub(started)
+	rep.HaveMore = !sides[0].done || !sides[1].done
+	c.logger.Debug("[prune] coordinated prune", "took", rep.Took, "haveMore", rep.HaveMore, "blocks", rep.Blocks.String(), "state", rep.State.String())
+	return rep, nil
+}
+
+// splitShares - shares proportional to estimated time to finish. -1 means "unknown yet".
+func splitShares(a, b float64) (shares [2]float64) {
+	switch {
+	case a == 0 && b == 0:
+		return shares
+	case a == 0:
+		return [2]float64{0, 1}
+	case b == 0:
+		return [2]float64{1, 0}
+	case a < 0 || b < 0:
+		return [2]float64{0.5, 0.5}
+	}
+	shareA := min(max(a/(a+b), minShare), 1-minShare)
+	return [2]float64{shareA, 1 - shareA}
+}
+
+// BlockPruner - see services.BlockRetire
+type BlockPruner interface {
+	PruneAncientBlocks(tx kv.RwTx, limit int) (deleted int, err error)
+	PruneBacklog(tx kv.Tx) (blocks uint64, err error)
+}
+
+type blocksPruner struct {
+	br    BlockPruner
+	limit int
+}
+
+// BlocksPruner - prunes blocks by batches of `limit` blocks
+func BlocksPruner(br BlockPruner, limit int) Pruner { return &blocksPruner{br: br, limit: limit} }
+
+func (p *blocksPruner) Backlog(tx kv.Tx) (float64, error) {
+	blocks, err := p.br.PruneBacklog(tx)
+	return float64(blocks), err
+}
+
+func (p *blocksPruner) Prune(ctx context.Context, tx kv.RwTx, budget time.Duration) (haveMore bool, err error) {
+	deadline := time.Now().Add(budget)
+	for time.Now().Before(deadline) {
+		deleted, err := p.br.PruneAncientBlocks(tx, p.limit)
+		if err != nil {
+			return false, err
+		}
+		if deleted == 0 {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		default:
+		}
+	}
+	return true, nil
+}
+
+type statePruner struct {
+	ac *state.AggregatorRoTx
+}
+
+// StatePruner - prunes state which is already in files. Backlog is in steps.
+func StatePruner(ac *state.AggregatorRoTx) Pruner { return &statePruner{ac: ac} }
+
+func (p *statePruner) Backlog(tx kv.Tx) (float64, error) { return p.ac.PruneBacklog(tx), nil }
+
+func (p *statePruner) Prune(ctx context.Context, tx kv.RwTx, budget time.Duration) (haveMore bool, err error) {
+	haveMore, err = p.ac.PruneSmallBatches(ctx, budget, tx)
+	if errors.Is(err, state.ErrPruneBusy) { // other prune driver works on it
+		return false, nil
+	}
+	return haveMore, err
+}
@@ -0,0 +1,92 @@
+package prune
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+)
+
+// fakeClock - time moves only by pruning: tests don't depend on speed of machine
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// fakePruner - prunes 1 unit of backlog per `batch` of time
+type fakePruner struct {
+	clock   *fakeClock
+	backlog float64
+	batch   time.Duration
+}
+
+func (p *fakePruner) Backlog(kv.Tx) (float64, error) { return p.backlog, nil }
+
+func (p *fakePruner) Prune(_ context.Context, _ kv.RwTx, budget time.Duration) (bool, error) {
+	deadline := p.clock.now().Add(budget)
+	for p.clock.now().Before(deadline) {
+		if p.backlog <= 0 {
+			return false, nil
+		}
+		p.backlog--
+		p.clock.t = p.clock.t.Add(p.batch)
+	}
+	return p.backlog > 0, nil
+}
+
+// newTestCoordinator - pruners of `blocks` and `state` backlogs, 1 unit per `batch` of fake time
+func newTestCoordinator(blocks, state float64, batch time.Duration) *Coordinator {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	c := NewCoordinator(&fakePruner{clock: clock, backlog: blocks, batch: batch}, &fakePruner{clock: clock, backlog: state, batch: batch}, log.New())
+	c.now = clock.now
+	return c
+}
+
+func TestCoordinatorSkewedBacklog(t *testing.T) {
+	const budget = 200 * time.Millisecond
+	t.Run("blocks behind", func(t *testing.T) {
+		rep, err := newTestCoordinator(100_000, 1_000, 100*time.Microsecond).Prune(context.Background(), nil, budget)
+		require.NoError(t, err)
+		require.True(t, rep.HaveMore)
+		require.Less(t, rep.Blocks.BacklogAfter, rep.Blocks.BacklogBefore)
+		require.Less(t, rep.State.BacklogAfter, rep.State.BacklogBefore)
+		require.Greater(t, rep.Blocks.Share, rep.State.Share)
+		require.Greater(t, rep.Blocks.Took, rep.State.Took)
+		require.InDelta(t, budget, rep.Took, float64(100*time.Microsecond)) // last batch may overrun budget
+	})
+	t.Run("state behind", func(t *testing.T) {
+		rep, err := newTestCoordinator(1_000, 100_000, 100*time.Microsecond).Prune(context.Background(), nil, budget)
+		require.NoError(t, err)
+		require.True(t, rep.HaveMore)
+		require.Less(t, rep.Blocks.BacklogAfter, rep.Blocks.BacklogBefore)
+		require.Less(t, rep.State.BacklogAfter, rep.State.BacklogBefore)
+		require.Greater(t, rep.State.Share, rep.Blocks.Share)
+		require.Greater(t, rep.State.Took, rep.Blocks.Took)
+		require.InDelta(t, budget, rep.Took, float64(100*time.Microsecond)) // last batch may overrun budget
+	})
+	t.Run("one side finishes", func(t *testing.T) {
+		rep, err := newTestCoordinator(100_000, 5, 100*time.Microsecond).Prune(context.Background(), nil, budget)
+		require.NoError(t, err)
+		require.True(t, rep.HaveMore)
+		require.Zero(t, rep.State.BacklogAfter)
+		require.Equal(t, 1.0, rep.Blocks.Share)
+	})
+	t.Run("nothing to prune", func(t *testing.T) {
+		rep, err := newTestCoordinator(0, 0, 100*time.Microsecond).Prune(context.Background(), nil, budget)
+		require.NoError(t, err)
+		require.False(t, rep.HaveMore)
+		require.Zero(t, rep.Blocks.Rounds+rep.State.Rounds)
+	})
+}
+
+func TestSplitShares(t *testing.T) {
+	require.Equal(t, [2]float64{0.5, 0.5}, splitShares(-1, 10))
+	require.Equal(t, [2]float64{1, 0}, splitShares(10, 0))
+	require.Equal(t, [2]float64{0, 0}, splitShares(0, 0))
+	require.Equal(t, [2]float64{0.9, 1 - 0.9}, splitShares(1000, 1))
+	shares := splitShares(30, 10)
+	require.InDelta(t, 0.75, shares[0], 1e-9)
+}
@@ -19,7 +19,7 @@ var SqueezeCommitmentFiles = Migration{
 	Up: func(db kv.RwDB, dirs datadir.Dirs, progress []byte, BeforeCommit Callback, logger log.Logger) (err error) {
 		ctx := context.Background()
 
-		if !EnableSqueezeCommitmentFiles || !libstate.AggregatorSqueezeCommitmentValues { //nolint:staticcheck
+		if !EnableSqueezeCommitmentFiles || libstate.DefaultCommitmentValuesTransform != libstate.CommitmentValuesTransformAtMerge { //nolint:staticcheck
 			return db.Update(ctx, func(tx kv.RwTx) error {
 				return BeforeCommit(tx, nil, true)
 			})
@@ -29,7 +29,7 @@ var SqueezeCommitmentFiles = Migration{
 		logEvery := time.NewTicker(10 * time.Second)
 		defer logEvery.Stop()
 
-		agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, nil, logger)
+		agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, db, nil, libstate.DefaultCommitmentValuesTransform, logger)
 		if err != nil {
 			return err
 		}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/common/disk"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
 	"github.com/ledgerwatch/erigon-lib/common/mem"
 	"github.com/ledgerwatch/erigon-lib/config3"
 	"github.com/ledgerwatch/erigon-lib/downloader"
@@ -40,12 +42,14 @@ import (
 	"github.com/ledgerwatch/erigon-lib/metrics"
 	"github.com/ledgerwatch/erigon-lib/seg"
 	libstate "github.com/ledgerwatch/erigon-lib/state"
+	"github.com/ledgerwatch/erigon-lib/state/benchutil"
 	"github.com/ledgerwatch/erigon/cl/clparams"
 	"github.com/ledgerwatch/erigon/cmd/hack/tool/fromdb"
 	"github.com/ledgerwatch/erigon/cmd/utils"
 	"github.com/ledgerwatch/erigon/core/rawdb"
 	"github.com/ledgerwatch/erigon/core/rawdb/blockio"
 	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
 	"github.com/ledgerwatch/erigon/diagnostics"
 	"github.com/ledgerwatch/erigon/eth/ethconfig"
 	"github.com/ledgerwatch/erigon/eth/ethconfig/estimate"
@@ -115,6 +119,42 @@ var snapshotCommand = cli.Command{
 				&SnapshotFromFlag,
 				&SnapshotToFlag,
 				&SnapshotEveryFlag,
+				&cli.BoolFlag{Name: "dry-run", Usage: "print retire plan (dumps, merges, prunes) without writing anything: db is opened in read-only mode"},
+			}),
+		},
+		{
+			Name: "merge",
+			Action: func(c *cli.Context) error {
+				dirs, l, err := datadir.New(c.String(utils.DataDirFlag.Name)).MustFlock()
+				if err != nil {
+					return err
+				}
+				defer l.Unlock()
+
+				return doMergeCommand(c, dirs)
+			},
+			Usage: "Merge state snapshots. With --dry-run: only print files which merge will produce and estimated disk space",
+			Flags: joinFlags([]cli.Flag{
+				&utils.DataDirFlag,
+				&cli.BoolFlag{Name: "dry-run", Usage: "print merge plan without merging"},
+			}),
+		},
+		{
+			Name: "recover-step-mismatch",
+			Action: func(c *cli.Context) error {
+				dirs, l, err := datadir.New(c.String(utils.DataDirFlag.Name)).MustFlock()
+				if err != nil {
+					return err
+				}
+				defer l.Unlock()
+
+				return doRecoverStepMismatch(c, dirs)
+			},
+			Usage: "Produce missing files of state step ignored after `kill -9` during files build (e.g. commitment behind accounts). Asks before deleting orphaned files",
+			Flags: joinFlags([]cli.Flag{
+				&utils.DataDirFlag,
+				&cli.BoolFlag{Name: "dry-run", Usage: "print recovery plan without changing anything"},
+				&cli.BoolFlag{Name: "yes", Usage: "don't ask: delete orphaned files if nothing else is possible (for scripts)"},
 			}),
 		},
 		{
@@ -169,7 +209,12 @@ var snapshotCommand = cli.Command{
 			Action: doBtSearch,
 			Flags: joinFlags([]cli.Flag{
 				&cli.PathFlag{Name: "src", Required: true},
-				&cli.StringFlag{Name: "key", Required: true},
+				&cli.StringFlag{Name: "key", Usage: "hex. seek to this key. with --prefix or --limit: start of range scan"},
+				&cli.StringFlag{Name: "prefix", Usage: "hex. range scan of all keys with this prefix"},
+				&cli.IntFlag{Name: "limit", Value: -1, Usage: "max amount of keys in range scan. -1 - no limit"},
+				&cli.BoolFlag{Name: "json", Usage: "print results as json lines"},
+				&cli.StringFlag{Name: "decode", Usage: "decode values. one of: account"},
+				&compressionDictFlag,
 			}),
 		},
 		{
@@ -294,6 +339,7 @@ var snapshotCommand = cli.Command{
 			Action: doMeta,
 			Flags: joinFlags([]cli.Flag{
 				&cli.PathFlag{Name: "src", Required: true},
+				&compressionDictFlag,
 			}),
 		},
 		{
@@ -305,6 +351,21 @@ var snapshotCommand = cli.Command{
 				&cli.StringFlag{Name: "domain", Required: true},
 			}),
 		},
+		{
+			Name:        "bench-reads",
+			Action:      doBenchReads,
+			Description: "benchmark GetLatest/GetAsOf latency and throughput on state files",
+			Flags: joinFlags([]cli.Flag{
+				&utils.DataDirFlag,
+				&cli.StringFlag{Name: "domain", Value: "accounts", Usage: "one of: accounts, storage, code, commitment"},
+				&cli.StringFlag{Name: "workers", Value: "1,4,16", Usage: "comma-separated list of workers counts"},
+				&cli.DurationFlag{Name: "duration", Value: 10 * time.Second, Usage: "duration of each run"},
+				&cli.IntFlag{Name: "sample", Value: 100_000, Usage: "amount of keys to sample from files"},
+				&cli.StringFlag{Name: "keys", Usage: "comma-separated list of hex keys to use instead of sampling"},
+				&cli.Uint64Flag{Name: "asof", Usage: "txNum for GetAsOf benchmark. 0 - don't benchmark GetAsOf"},
+				&cli.BoolFlag{Name: "readahead", Usage: "enable OS readahead of domain files"},
+			}),
+		},
 		{
 			Name:        "integrity",
 			Action:      doIntegrity,
@@ -314,6 +375,17 @@ var snapshotCommand = cli.Command{
 				&cli.StringFlag{Name: "check", Usage: fmt.Sprintf("one of: %s", integrity.AllChecks)},
 				&cli.BoolFlag{Name: "failFast", Value: true, Usage: "to stop after 1st problem or print WARN log and continue check"},
 				&cli.Uint64Flag{Name: "fromStep", Value: 0, Usage: "skip files before given step"},
+				&cli.BoolFlag{Name: "full", Value: false, Usage: "TxnHash2BlockNum: check all blocks instead of sample. AccountsCode: check each step inside merged files"},
+			}),
+		},
+		{
+			Name:        "minimal-copy",
+			Action:      doMinimalCopy,
+			Description: "hard-link minimal set of state files (latest state, no history) to new datadir. Open it with latest-state-only aggregator",
+			Flags: joinFlags([]cli.Flag{
+				&utils.DataDirFlag,
+				&cli.PathFlag{Name: "out", Required: true, Usage: "destination datadir"},
+				&cli.Uint64Flag{Name: "txnum", Value: math.MaxUint64, Usage: "include only files ending before given txNum"},
 			}),
 		},
 	},
@@ -355,7 +427,11 @@ func doBtSearch(cliCtx *cli.Context) error {
 	dbg.ReadMemStats(&m)
 	logger.Info("before open", "alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
 	compress := libstate.CompressKeys | libstate.CompressVals
-	kv, idx, err := libstate.OpenBtreeIndexAndDataFile(srcF, dataFilePath, libstate.DefaultBtreeM, compress, false)
+	dict, err := readCompressionDict(cliCtx)
+	if err != nil {
+		return err
+	}
+	kv, idx, err := libstate.OpenBtreeIndexAndDataFileWithDictionary(srcF, dataFilePath, dict, libstate.DefaultBtreeM, compress)
 	if err != nil {
 		return err
 	}
@@ -367,22 +443,62 @@ func doBtSearch(cliCtx *cli.Context) error {
 	logger.Info("after open", "alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
 
 	seek := common.FromHex(cliCtx.String("key"))
-
 	getter := libstate.NewArchiveGetter(kv.MakeGetter(), compress)
 
-	cur, err := idx.Seek(getter, seek)
-	if err != nil {
+	decode := cliCtx.String("decode")
+	if decode != "" && decode != "account" {
+		return fmt.Errorf("unknown --decode: %s", decode)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	emit := func(k, v []byte) error {
+		var acc *accounts.Account
+		if decode == "account" {
+			acc = &accounts.Account{}
+			if err := accounts.DeserialiseV3(acc, v); err != nil {
+				return fmt.Errorf("decode account %x: %w", k, err)
+			}
+		}
+		if cliCtx.Bool("json") {
+			res := btSearchResult{Key: hexutility.Encode(k), Value: hexutility.Encode(v)}
+			if acc != nil {
+				res.Account = &btSearchAccount{Nonce: acc.Nonce, Balance: acc.Balance.Hex(), CodeHash: acc.CodeHash.Hex(), Incarnation: acc.Incarnation}
+			}
+			return json.NewEncoder(out).Encode(res)
+		}
+		if acc != nil {
+			_, err := fmt.Fprintf(out, "%x -> nonce=%d, balance=%s, codeHash=%x, incarnation=%d\n", k, acc.Nonce, acc.Balance.String(), acc.CodeHash, acc.Incarnation)
+			return err
+		}
+		_, err := fmt.Fprintf(out, "%x -> %x\n", k, v)
 		return err
 	}
-	if cur != nil {
-		fmt.Printf("seek: %x, -> %x, %x\n", seek, cur.Key(), cur.Value())
-	} else {
-		fmt.Printf("seek: %x, -> nil\n", seek)
+
+	if !cliCtx.IsSet("prefix") && !cliCtx.IsSet("limit") { // single seek
+		cur, err := idx.Seek(getter, seek)
+		if err != nil {
+			return err
+		}
+		if cur == nil {
+			fmt.Printf("seek: %x, -> nil\n", seek)
+			return nil
+		}
+		return emit(cur.Key(), cur.Value())
 	}
-	//var a = accounts.Account{}
-	//accounts.DeserialiseV3(&a, cur.Value())
-	//fmt.Printf("a: nonce=%d\n", a.Nonce)
-	return nil
+	return libstate.BtRangeScan(idx, getter, seek, common.FromHex(cliCtx.String("prefix")), cliCtx.Int("limit"), emit)
+}
+
+type btSearchResult struct {
+	Key     string           `json:"key"`
+	Value   string           `json:"value"`
+	Account *btSearchAccount `json:"account,omitempty"`
+}
+
+type btSearchAccount struct {
+	Nonce       uint64 `json:"nonce"`
+	Balance     string `json:"balance"`
+	CodeHash    string `json:"codeHash"`
+	Incarnation uint64 `json:"incarnation"`
 }
 
 func doDebugKey(cliCtx *cli.Context) error {
@@ -425,6 +541,92 @@ func doDebugKey(cliCtx *cli.Context) error {
 	return nil
 }
 
+func doBenchReads(cliCtx *cli.Context) error {
+	logger, _, _, err := debug.Setup(cliCtx, true /* root logger */)
+	if err != nil {
+		return err
+	}
+	domain, err := kv.String2Domain(cliCtx.String("domain"))
+	if err != nil {
+		return err
+	}
+	var workers []int
+	for _, w := range strings.Split(cliCtx.String("workers"), ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil {
+			return fmt.Errorf("--workers: %w", err)
+		}
+		if n <= 0 {
+			return fmt.Errorf("--workers: must be positive, got %d", n)
+		}
+		workers = append(workers, n)
+	}
+	keys := benchutil.SampleFromFiles(cliCtx.Int("sample"))
+	if cliCtx.String("keys") != "" {
+		var explicit [][]byte
+		for _, k := range strings.Split(cliCtx.String("keys"), ",") {
+			explicit = append(explicit, common.FromHex(strings.TrimSpace(k)))
+		}
+		keys = benchutil.ExplicitKeys(explicit)
+	}
+
+	ctx := cliCtx.Context
+	dirs := datadir.New(cliCtx.String(utils.DataDirFlag.Name))
+	chainDB := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
+	defer chainDB.Close()
+	agg := openAgg(ctx, dirs, chainDB, logger)
+	defer agg.Close()
+
+	report, err := benchutil.BenchmarkDomainReads(ctx, chainDB, agg, benchutil.Config{
+		Domain:    domain,
+		Keys:      keys,
+		Workers:   workers,
+		Duration:  cliCtx.Duration("duration"),
+		AsOfTxNum: cliCtx.Uint64("asof"),
+		ReadAhead: cliCtx.Bool("readahead"),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Print(report.String())
+	return nil
+}
+
+func doMinimalCopy(cliCtx *cli.Context) error {
+	logger, _, _, err := debug.Setup(cliCtx, true /* root logger */)
+	if err != nil {
+		return err
+	}
+
+	ctx := cliCtx.Context
+	dirs := datadir.New(cliCtx.String(utils.DataDirFlag.Name))
+	outDirs := datadir.New(cliCtx.String("out"))
+	chainDB := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
+	defer chainDB.Close()
+	agg := openAgg(ctx, dirs, chainDB, logger)
+	defer agg.Close()
+
+	files, err := agg.MinimalFileSet(cliCtx.Uint64("txnum"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		rel, err := filepath.Rel(dirs.DataDir, f)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(outDirs.DataDir, rel)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(f, to); err != nil {
+			return err
+		}
+	}
+	logger.Info("[snapshots] minimal copy done", "files", len(files), "out", outDirs.DataDir)
+	return nil
+}
+
 func doIntegrity(cliCtx *cli.Context) error {
 	logger, _, _, err := debug.Setup(cliCtx, true /* root logger */)
 	if err != nil {
@@ -435,6 +637,7 @@ func doIntegrity(cliCtx *cli.Context) error {
 	requestedCheck := integrity.Check(cliCtx.String("check"))
 	failFast := cliCtx.Bool("failFast")
 	fromStep := cliCtx.Uint64("fromStep")
+	full := cliCtx.Bool("full")
 	dirs := datadir.New(cliCtx.String(utils.DataDirFlag.Name))
 	chainDB := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
 	defer chainDB.Close()
@@ -460,6 +663,15 @@ func doIntegrity(cliCtx *cli.Context) error {
 			if err := blockReader.(*freezeblocks.BlockReader).IntegrityTxnID(failFast); err != nil {
 				return err
 			}
+		case integrity.HeadersFirstByte:
+			if err := blockReader.(*freezeblocks.BlockReader).IntegrityHeadersFirstByte(ctx, failFast); err != nil {
+				return err
+			}
+		case integrity.TxnHash2BlockNum:
+			// block files are named in steps of snaptype.Erigon2MinSegmentSize blocks
+			if err := blockReader.(*freezeblocks.BlockReader).IntegrityTxnHash2BlockNum(ctx, failFast, fromStep*snaptype.Erigon2MinSegmentSize, full); err != nil {
+				return err
+			}
 		case integrity.Blocks:
 			if err := integrity.SnapBlocksRead(chainDB, blockReader, ctx, failFast); err != nil {
 				return err
@@ -472,6 +684,14 @@ func doIntegrity(cliCtx *cli.Context) error {
 			if err := integrity.E3HistoryNoSystemTxs(ctx, chainDB, agg); err != nil {
 				return err
 			}
+		case integrity.CommitmentRoots:
+			if err := integrity.CommitmentRootsMatchHeaders(ctx, chainDB, agg, blockReader, failFast); err != nil {
+				return err
+			}
+		case integrity.AccountsCode:
+			if err := integrity.AccountsCodeCrossCheck(ctx, agg, failFast, fromStep, full); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("unknown check: %s", chk)
 		}
@@ -514,6 +734,21 @@ func doDiff(cliCtx *cli.Context) error {
 	return nil
 }
 
+var compressionDictFlag = cli.PathFlag{Name: "dict", Usage: "compression dictionary of .kv file, see --" + utils.SnapStateCompressionDictionaryFlag.Name}
+
+// readCompressionDict - nil if file was built without dictionary
+func readCompressionDict(cliCtx *cli.Context) (*seg.Dictionary, error) {
+	fPath := cliCtx.Path(compressionDictFlag.Name)
+	if fPath == "" {
+		return nil, nil
+	}
+	dict, err := os.ReadFile(fPath)
+	if err != nil {
+		return nil, err
+	}
+	return seg.NewDictionary(dict)
+}
+
 func doMeta(cliCtx *cli.Context) error {
 	fname := cliCtx.String("src")
 	if strings.HasSuffix(fname, ".seg") {
@@ -525,7 +760,11 @@ func doMeta(cliCtx *cli.Context) error {
 		log.Info("meta", "count", src.Count(), "size", datasize.ByteSize(src.Size()).String(), "name", src.FileName())
 	} else if strings.HasSuffix(fname, ".bt") {
 		kvFPath := strings.TrimSuffix(fname, ".bt") + ".kv"
-		src, err := seg.NewDecompressor(kvFPath)
+		dict, err := readCompressionDict(cliCtx)
+		if err != nil {
+			return err
+		}
+		src, err := seg.NewDecompressorWithDictionary(kvFPath, dict)
 		if err != nil {
 			return err
 		}
@@ -613,6 +852,15 @@ func doIndicesCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	if err := freezeblocks.RemoveIncompatibleIndices(dirs); err != nil {
 		return err
 	}
+	saltReport, err := libstate.VerifySalts(dirs)
+	if err != nil {
+		return err
+	}
+	if len(saltReport.Mismatches()) > 0 {
+		logger.Warn("[snapshots] some indices are built with salt different from salt file - they will fail to open. See state.RepairSalts", "report", saltReport.String())
+	} else {
+		logger.Info("[snapshots] salts", "report", saltReport.String())
+	}
 
 	cfg := ethconfig.NewSnapCfg(true, false, true, true)
 	chainConfig := fromdb.ChainConfig(chainDB)
@@ -625,6 +873,9 @@ func doIndicesCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	defer caplinSnaps.Close()
 	defer agg.Close()
 
+	if _, err := agg.CleanupOrphanedAccessors(ctx, false); err != nil {
+		return err
+	}
 	if err := br.BuildMissedIndicesIfNeed(ctx, "Indexing", nil, chainConfig); err != nil {
 		return err
 	}
@@ -633,12 +884,58 @@ func doIndicesCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	}
 	err = agg.BuildMissedIndices(ctx, estimate.IndexSnapshot.Workers())
 	if err != nil {
-		return err
+		return stateFilesErr(logger, err)
 	}
 
 	return nil
 }
 
+// stateFilesErr - logs what to do with typed failures of state files build/merge/indexing, returns `err` as is
+func stateFilesErr(logger log.Logger, err error) error {
+	var (
+		collErr  *libstate.ErrCollationFailed
+		buildErr *libstate.ErrBuildFailed
+		mergeErr *libstate.ErrMergeFailed
+		idxErr   *libstate.ErrIndexBuildFailed
+	)
+	switch {
+	case errors.As(err, &idxErr):
+		logger.Error("[snapshots] index build failed: remove the file (it will be re-downloaded) or re-run indexing", "file", idxErr.File, "err", idxErr.Err)
+	case errors.As(err, &mergeErr):
+		logger.Error("[snapshots] merge failed: merged files are not integrated, source files are kept - safe to re-run", "ranges", mergeErr.Ranges, "err", mergeErr.Err)
+	case errors.As(err, &collErr):
+		logger.Error("[snapshots] collation failed: DB doesn't have data of step", "domain", collErr.Domain, "step", collErr.Step, "err", collErr.Err)
+	case errors.As(err, &buildErr):
+		logger.Error("[snapshots] files build failed: files of step are removed - safe to re-run", "domain", buildErr.Domain, "step", buildErr.Step, "err", buildErr.Err)
+	}
+	return err
+}
+
+// printRetirePlan - planning halves of doRetireCommand phases. Uses only read-only transactions.
+func printRetirePlan(ctx context.Context, db kv.RoDB, br *freezeblocks.BlockRetire, agg *libstate.Aggregator) error {
+	return db.View(ctx, func(tx kv.Tx) error {
+		forwardProgress, err := stages.GetStageProgress(tx, stages.Senders)
+		if err != nil {
+			return err
+		}
+		blocksPlan, err := br.PlanRetire(tx, 0, forwardProgress)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("blocks:\n%s\n", blocksPlan.String())
+
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		fmt.Printf("state merge:\n%s\n", ac.PlanMerge(libstate.StepsInColdFile*agg.StepSize()).String())
+		if txTo := agg.EndTxNumMinimax(); txTo > 0 && ac.CanPrune(tx, txTo) {
+			fmt.Printf("state prune: until_tx=%d, backlog=%.1f steps\n", txTo, ac.PruneBacklog(tx))
+		} else {
+			fmt.Printf("state prune: nothing to prune\n")
+		}
+		return nil
+	})
+}
+
 func openSnaps(ctx context.Context, cfg ethconfig.BlocksFreezing, dirs datadir.Dirs, chainDB kv.RwDB, logger log.Logger) (
 	blockSnaps *freezeblocks.RoSnapshots, borSnaps *freezeblocks.BorRoSnapshots, csn *freezeblocks.CaplinSnapshots,
 	br *freezeblocks.BlockRetire, agg *libstate.Aggregator, err error,
@@ -649,13 +946,13 @@ func openSnaps(ctx context.Context, cfg ethconfig.BlocksFreezing, dirs datadir.D
 	}
 	blockSnaps.LogStat("block")
 
-	borSnaps = freezeblocks.NewBorRoSnapshots(cfg, dirs.Snap, 0, logger)
+	chainConfig := fromdb.ChainConfig(chainDB)
+
+	borSnaps = freezeblocks.NewBorRoSnapshots(cfg, dirs.Snap, 0, chainConfig, logger)
 	if err = borSnaps.ReopenFolder(); err != nil {
 		return
 	}
 
-	chainConfig := fromdb.ChainConfig(chainDB)
-
 	var beaconConfig *clparams.BeaconChainConfig
 	_, beaconConfig, _, err = clparams.GetConfigsByNetworkName(chainConfig.ChainName)
 	if err == nil {
@@ -694,6 +991,7 @@ func openSnaps(ctx context.Context, cfg ethconfig.BlocksFreezing, dirs datadir.D
 	blockSnapBuildSema := semaphore.NewWeighted(int64(dbg.BuildSnapshotAllowance))
 	agg.SetSnapshotBuildSema(blockSnapBuildSema)
 	br = freezeblocks.NewBlockRetire(estimate.CompressSnapshot.Workers(), dirs, blockReader, blockWriter, chainDB, chainConfig, nil, blockSnapBuildSema, logger)
+	br.SetProvenance(freezeblocks.Provenance{Version: params.VersionWithCommit(params.GitCommit)})
 	return
 }
 
@@ -812,7 +1110,12 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	to := cliCtx.Uint64(SnapshotToFlag.Name)
 	every := cliCtx.Uint64(SnapshotEveryFlag.Name)
 
-	db := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
+	dryRun := cliCtx.Bool("dry-run")
+	opts := dbCfg(kv.ChainDB, dirs.Chaindata)
+	if dryRun {
+		opts = opts.Readonly() // any RwTx will fail
+	}
+	db := opts.MustOpen()
 	defer db.Close()
 
 	cfg := ethconfig.NewSnapCfg(true, false, true, true)
@@ -821,9 +1124,18 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 		return err
 	}
 
+	if dryRun {
+		defer blockSnaps.Close()
+		defer borSnaps.Close()
+		defer caplinSnaps.Close()
+		defer agg.Close()
+		return printRetirePlan(ctx, db, br, agg)
+	}
+
 	// `erigon retire` command is designed to maximize resouces utilization. But `Erigon itself` does minimize background impact (because not in rush).
 	agg.SetCollateAndBuildWorkers(estimate.StateV3Collate.Workers())
 	agg.SetMergeWorkers(estimate.AlmostAllCPUs())
+	agg.SetPruneWorkers(estimate.AlmostAllCPUs())
 	agg.SetCompressWorkers(estimate.CompressSnapshot.Workers())
 
 	defer blockSnaps.Close()
@@ -863,7 +1175,7 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 		blockReader, _ := br.IO()
 		ac := agg.BeginFilesRo()
 		defer ac.Close()
-		if err := rawdb.WriteSnapshots(tx, blockReader.FrozenFiles(), ac.Files()); err != nil {
+		if err := freezeblocks.WriteSnapshotsWithChecksums(tx, dirs.Snap, blockReader.FrozenFiles(), ac.Files()); err != nil {
 			return err
 		}
 		return nil
@@ -910,7 +1222,7 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 		return err
 	}
 	if err = agg.BuildMissedIndices(ctx, indexWorkers); err != nil {
-		return err
+		return stateFilesErr(logger, err)
 	}
 
 	var lastTxNum uint64
@@ -961,26 +1273,26 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	ac.Close()
 
 	if err = agg.MergeLoop(ctx); err != nil {
-		return err
+		return stateFilesErr(logger, err)
 	}
 	if err = agg.BuildOptionalMissedIndices(ctx, indexWorkers); err != nil {
 		return err
 	}
 	if err = agg.BuildMissedIndices(ctx, indexWorkers); err != nil {
-		return err
+		return stateFilesErr(logger, err)
 	}
 	if err := db.UpdateNosync(ctx, func(tx kv.RwTx) error {
 		blockReader, _ := br.IO()
 		ac := agg.BeginFilesRo()
 		defer ac.Close()
-		return rawdb.WriteSnapshots(tx, blockReader.FrozenFiles(), ac.Files())
+		return freezeblocks.WriteSnapshotsWithChecksums(tx, dirs.Snap, blockReader.FrozenFiles(), ac.Files())
 	}); err != nil {
 		return err
 	}
 	if err := db.Update(ctx, func(tx kv.RwTx) error {
 		ac := agg.BeginFilesRo()
 		defer ac.Close()
-		return rawdb.WriteSnapshots(tx, blockSnaps.Files(), ac.Files())
+		return freezeblocks.WriteSnapshotsWithChecksums(tx, dirs.Snap, blockSnaps.Files(), ac.Files())
 	}); err != nil {
 		return err
 	}
@@ -988,6 +1300,102 @@ func doRetireCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
 	return nil
 }
 
+func doRecoverStepMismatch(cliCtx *cli.Context, dirs datadir.Dirs) error {
+	logger, _, _, err := debug.Setup(cliCtx, true /* rootLogger */)
+	if err != nil {
+		return err
+	}
+	ctx := cliCtx.Context
+
+	db := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
+	defer db.Close()
+	agg := openAgg(ctx, dirs, db, logger)
+	defer agg.Close()
+
+	plan, err := agg.AnalyseStepMismatch(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("plan: %s\n", plan)
+	if cliCtx.Bool("dry-run") || len(plan.Steps) == 0 {
+		return nil
+	}
+	if plan.Deletes() && !cliCtx.Bool("yes") {
+	AllowDelete:
+		fmt.Printf("some files can't be recovered and will be deleted (state will be behind them)\n1) Recover and delete\n2) Exit\n (pick number): ")
+		var ans uint8
+		if _, err := fmt.Scanf("%d\n", &ans); err != nil {
+			return err
+		}
+		switch ans {
+		case 1:
+		case 2:
+			return nil
+		default:
+			fmt.Printf("invalid input: %d; Just an answer number expected.\n", ans)
+			goto AllowDelete
+		}
+	}
+
+	report, err := agg.RecoverStepMismatch(ctx)
+	if err != nil {
+		return stateFilesErr(logger, err)
+	}
+	for _, s := range report.Steps {
+		fmt.Printf("%s\n", s)
+		for _, f := range s.Deleted {
+			fmt.Printf("  deleted: %s\n", f)
+		}
+	}
+	return nil
+}
+
+func doMergeCommand(cliCtx *cli.Context, dirs datadir.Dirs) error {
+	logger, _, _, err := debug.Setup(cliCtx, true /* rootLogger */)
+	if err != nil {
+		return err
+	}
+	ctx := cliCtx.Context
+
+	db := dbCfg(kv.ChainDB, dirs.Chaindata).MustOpen()
+	defer db.Close()
+
+	cfg := ethconfig.NewSnapCfg(true, false, true, true)
+	blockSnaps, borSnaps, caplinSnaps, _, agg, err := openSnaps(ctx, cfg, dirs, db, logger)
+	if err != nil {
+		return err
+	}
+	defer blockSnaps.Close()
+	defer borSnaps.Close()
+	defer caplinSnaps.Close()
+	defer agg.Close()
+
+	if cliCtx.Bool("dry-run") {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		fmt.Println(ac.PlanMerge(libstate.StepsInColdFile * agg.StepSize()).String())
+		return nil
+	}
+
+	agg.SetMergeWorkers(estimate.AlmostAllCPUs())
+	agg.SetCompressWorkers(estimate.CompressSnapshot.Workers())
+	if err = agg.MergeLoop(ctx); err != nil {
+		return stateFilesErr(logger, err)
+	}
+	indexWorkers := estimate.IndexSnapshot.Workers()
+	if err = agg.BuildOptionalMissedIndices(ctx, indexWorkers); err != nil {
+		return err
+	}
+	if err = agg.BuildMissedIndices(ctx, indexWorkers); err != nil {
+		return stateFilesErr(logger, err)
+	}
+	return db.Update(ctx, func(tx kv.RwTx) error {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		return freezeblocks.WriteSnapshotsWithChecksums(tx, dirs.Snap, blockSnaps.Files(), ac.Files())
+	})
+}
+
 func doUploaderCommand(cliCtx *cli.Context) error {
 	var logger log.Logger
 	var err error
@@ -1038,7 +1446,7 @@ func dbCfg(label kv.Label, path string) mdbx.MdbxOpts {
 }
 func openAgg(ctx context.Context, dirs datadir.Dirs, chainDB kv.RwDB, logger log.Logger) *libstate.Aggregator {
 	cr := rawdb.NewCanonicalReader()
-	agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, chainDB, cr, logger)
+	agg, err := libstate.NewAggregator(ctx, dirs, config3.HistoryV3AggregationStep, chainDB, cr, libstate.DefaultCommitmentValuesTransform, logger)
 	if err != nil {
 		panic(err)
 	}
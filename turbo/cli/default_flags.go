@@ -27,6 +27,8 @@ var DefaultFlags = []cli.Flag{
 	&utils.TxPoolLifetimeFlag,
 	&utils.TxPoolTraceSendersFlag,
 	&utils.TxPoolCommitEveryFlag,
+	&utils.TxPoolRevalidateOnRegressionFlag,
+	&utils.TxPoolAnnounceDelayJitterFlag,
 	&PruneFlag,
 	&PruneBlocksFlag,
 	&PruneHistoryFlag,
@@ -103,6 +105,13 @@ var DefaultFlags = []cli.Flag{
 	&utils.SnapKeepBlocksFlag,
 	&utils.SnapStopFlag,
 	&utils.SnapStateStopFlag,
+	&utils.SnapStateCodeHashIndexFlag,
+	&utils.SnapStateCompressionDictionaryFlag,
+	&utils.SnapFsyncFlag,
+	&utils.SnapVerifyOpenFilesIntervalFlag,
+	&utils.SnapQuarantineEmptySegmentsFlag,
+	&utils.SnapTxnHashIdxShardsFlag,
+	&utils.SnapOpenFilesSoftLimitFlag,
 	&utils.DbPageSizeFlag,
 	&utils.DbSizeLimitFlag,
 	&utils.DbWriteMapFlag,
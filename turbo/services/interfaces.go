@@ -115,6 +115,7 @@ type FullBlockReader interface {
 
 type BlockSnapshots interface {
 	LogStat(label string)
+	Dir() string
 	ReopenFolder() error
 	ReopenSegments(types []snaptype.Type, allowGaps bool) error
 	SegmentsMax() uint64
@@ -127,6 +128,7 @@ type BlockSnapshots interface {
 // BlockRetire - freezing blocks: moving old data from DB to snapshot files
 type BlockRetire interface {
 	PruneAncientBlocks(tx kv.RwTx, limit int) (deleted int, err error)
+	PruneBacklog(tx kv.Tx) (blocks uint64, err error)
 	RetireBlocksInBackground(ctx context.Context, miBlockNum uint64, maxBlockNum uint64, lvl log.Lvl, seedNewSnapshots func(downloadRequest []DownloadRequest) error, onDelete func(l []string) error, onFinishRetire func() error)
 	HasNewFrozenFiles() bool
 	BuildMissedIndicesIfNeed(ctx context.Context, logPrefix string, notifier DBEventNotifier, cc *chain.Config) error
@@ -138,6 +140,14 @@ type DBEventNotifier interface {
 	OnNewSnapshot()
 }
 
+// DBEventAckNotifier - DBEventNotifier which knows when consumers picked up new snapshots
+type DBEventAckNotifier interface {
+	DBEventNotifier
+	// OnNewSnapshotAck - same as OnNewSnapshot, then calls `ack` when all consumers which can acknowledge re-opened
+	// files. Remote RPC daemons can't: they don't hold `ack`
+	OnNewSnapshotAck(ack func())
+}
+
 type DownloadRequest struct {
 	Version     uint8
 	Path        string
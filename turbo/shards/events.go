@@ -22,6 +22,9 @@ type Events struct {
 	id                        int
 	headerSubscriptions       map[int]chan [][]byte
 	newSnapshotSubscription   map[int]chan struct{}
+	newSnapshotAckSubs        map[int]*newSnapshotAckSubscription
+	newSnapshotSeq            uint64                 // number of new snapshot notifications
+	newSnapshotAckWaiters     []newSnapshotAckWaiter // ordered by seq
 	pendingLogsSubscriptions  map[int]PendingLogsSubscription
 	pendingBlockSubscriptions map[int]PendingBlockSubscription
 	pendingTxsSubscriptions   map[int]PendingTxsSubscription
@@ -38,9 +41,21 @@ func NewEvents() *Events {
 		pendingTxsSubscriptions:   map[int]PendingTxsSubscription{},
 		logsSubscriptions:         map[int]chan []*remote.SubscribeLogsReply{},
 		newSnapshotSubscription:   map[int]chan struct{}{},
+		newSnapshotAckSubs:        map[int]*newSnapshotAckSubscription{},
 	}
 }
 
+// newSnapshotAckSubscription - subscriber which re-opens files on new snapshots and acknowledges it
+type newSnapshotAckSubscription struct {
+	ch    chan func()
+	acked uint64 // last acknowledged notification: files of all notifications before it are re-opened too
+}
+
+type newSnapshotAckWaiter struct {
+	seq uint64
+	ack func()
+}
+
 func (e *Events) AddHeaderSubscription() (chan [][]byte, func()) {
 	e.lock.Lock()
 	defer e.lock.Unlock()
@@ -67,6 +82,28 @@ func (e *Events) AddNewSnapshotSubscription() (chan struct{}, func()) {
 	}
 }
 
+// AddNewSnapshotAckSubscription - same as AddNewSnapshotSubscription, but subscriber receives `ack` func and must call
+// it after it re-opened files. OnNewSnapshotAck waits for acks of such subscribers
+func (e *Events) AddNewSnapshotAckSubscription() (chan func(), func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	ch := make(chan func(), 8)
+	e.id++
+	id := e.id
+	// new subscriber opens files on start: it knows all notified snapshots
+	e.newSnapshotAckSubs[id] = &newSnapshotAckSubscription{ch: ch, acked: e.newSnapshotSeq}
+	return ch, func() {
+		e.lock.Lock()
+		delete(e.newSnapshotAckSubs, id)
+		close(ch)
+		released := e.releaseNewSnapshotAcks()
+		e.lock.Unlock()
+		for _, ack := range released {
+			ack()
+		}
+	}
+}
+
 func (e *Events) AddLogsSubscription() (chan []*remote.SubscribeLogsReply, func()) {
 	e.lock.Lock()
 	defer e.lock.Unlock()
@@ -105,11 +142,57 @@ func (e *Events) AddPendingBlockSubscription(s PendingBlockSubscription) {
 }
 
 func (e *Events) OnNewSnapshot() {
+	e.OnNewSnapshotAck(nil)
+}
+
+// OnNewSnapshotAck - notifies all subscribers, then calls `ack` when all ack-subscribers (see
+// AddNewSnapshotAckSubscription) re-opened files. Subscribers which unsubscribe don't hold `ack`
+func (e *Events) OnNewSnapshotAck(ack func()) {
 	e.lock.Lock()
-	defer e.lock.Unlock()
 	for _, ch := range e.newSnapshotSubscription {
 		common.PrioritizedSend(ch, struct{}{})
 	}
+	e.newSnapshotSeq++
+	for id, sub := range e.newSnapshotAckSubs {
+		id, seq := id, e.newSnapshotSeq
+		// if slow subscriber drops notification - ack of next one covers it
+		common.PrioritizedSend(sub.ch, func() { e.ackNewSnapshot(id, seq) })
+	}
+	if ack != nil {
+		e.newSnapshotAckWaiters = append(e.newSnapshotAckWaiters, newSnapshotAckWaiter{seq: e.newSnapshotSeq, ack: ack})
+	}
+	released := e.releaseNewSnapshotAcks()
+	e.lock.Unlock()
+	for _, ack := range released {
+		ack()
+	}
+}
+
+func (e *Events) ackNewSnapshot(id int, seq uint64) {
+	e.lock.Lock()
+	if sub, ok := e.newSnapshotAckSubs[id]; ok && sub.acked < seq {
+		sub.acked = seq
+	}
+	released := e.releaseNewSnapshotAcks()
+	e.lock.Unlock()
+	for _, ack := range released {
+		ack()
+	}
+}
+
+// releaseNewSnapshotAcks - removes and returns waiters acknowledged by all ack-subscribers. Must be called under lock,
+// returned funcs must be called without lock
+func (e *Events) releaseNewSnapshotAcks() (released []func()) {
+	acked := e.newSnapshotSeq
+	for _, sub := range e.newSnapshotAckSubs {
+		acked = min(acked, sub.acked)
+	}
+	i := 0
+	for ; i < len(e.newSnapshotAckWaiters) && e.newSnapshotAckWaiters[i].seq <= acked; i++ {
+		released = append(released, e.newSnapshotAckWaiters[i].ack)
+	}
+	e.newSnapshotAckWaiters = e.newSnapshotAckWaiters[i:]
+	return released
 }
 
 func (e *Events) OnNewHeader(newHeadersRlp [][]byte) {
@@ -722,9 +722,10 @@ func (r *BlockReader) headerFromSnapshot(blockHeight uint64, sn *Segment, buf []
 	if index == nil {
 		return nil, buf, nil
 	}
-	headerOffset := index.OrdinalLookup(blockHeight - index.BaseDataID())
-	gg := sn.MakeGetter()
-	gg.Reset(headerOffset)
+	gg, err := sn.getterAt(index, index.OrdinalLookup(blockHeight-index.BaseDataID()))
+	if err != nil {
+		return nil, buf, err
+	}
 	if !gg.HasNext() {
 		return nil, buf, nil
 	}
@@ -761,9 +762,10 @@ func (r *BlockReader) headerFromSnapshotByHash(hash common.Hash, sn *Segment, bu
 	if !ok {
 		return nil, nil
 	}
-	headerOffset := index.OrdinalLookup(localID)
-	gg := sn.MakeGetter()
-	gg.Reset(headerOffset)
+	gg, err := sn.getterAt(index, index.OrdinalLookup(localID))
+	if err != nil {
+		return nil, err
+	}
 	if !gg.HasNext() {
 		return nil, nil
 	}
@@ -814,10 +816,10 @@ func (r *BlockReader) bodyForStorageFromSnapshot(blockHeight uint64, sn *Segment
 		return nil, buf, nil
 	}
 
-	bodyOffset := index.OrdinalLookup(blockHeight - index.BaseDataID())
-
-	gg := sn.MakeGetter()
-	gg.Reset(bodyOffset)
+	gg, err := sn.getterAt(index, index.OrdinalLookup(blockHeight-index.BaseDataID()))
+	if err != nil {
+		return nil, buf, err
+	}
 	if !gg.HasNext() {
 		return nil, buf, nil
 	}
@@ -855,9 +857,10 @@ func (r *BlockReader) txsFromSnapshot(baseTxnID uint64, txCount uint32, txsSeg *
 	if txCount == 0 {
 		return txs, senders, nil
 	}
-	txnOffset := idxTxnHash.OrdinalLookup(baseTxnID - idxTxnHash.BaseDataID())
-	gg := txsSeg.MakeGetter()
-	gg.Reset(txnOffset)
+	gg, err := txsSeg.getterAt(idxTxnHash, idxTxnHash.OrdinalLookup(baseTxnID-idxTxnHash.BaseDataID()))
+	if err != nil {
+		return nil, nil, err
+	}
 	for i := uint32(0); i < txCount; i++ {
 		if !gg.HasNext() {
 			return nil, nil, nil
@@ -881,9 +884,10 @@ func (r *BlockReader) txsFromSnapshot(baseTxnID uint64, txCount uint32, txsSeg *
 func (r *BlockReader) txnByID(txnID uint64, sn *Segment, buf []byte) (txn types.Transaction, err error) {
 	idxTxnHash := sn.Index(coresnaptype.Indexes.TxnHash)
 
-	offset := idxTxnHash.OrdinalLookup(txnID - idxTxnHash.BaseDataID())
-	gg := sn.MakeGetter()
-	gg.Reset(offset)
+	gg, err := sn.getterAt(idxTxnHash, idxTxnHash.OrdinalLookup(txnID-idxTxnHash.BaseDataID()))
+	if err != nil {
+		return nil, err
+	}
 	if !gg.HasNext() {
 		return nil, nil
 	}
@@ -902,10 +906,10 @@ func (r *BlockReader) txnByHash(txnHash common.Hash, segments []*Segment, buf []
 	for i := len(segments) - 1; i >= 0; i-- {
 		sn := segments[i]
 
-		idxTxnHash := sn.Index(coresnaptype.Indexes.TxnHash)
-		idxTxnHash2BlockNum := sn.Index(coresnaptype.Indexes.TxnHash2BlockNum)
+		idxTxnHash := sn.IndexByKey(coresnaptype.Indexes.TxnHash, txnHash[:])
+		idxTxnHash2BlockNum := sn.IndexByKey(coresnaptype.Indexes.TxnHash2BlockNum, txnHash[:])
 
-		if idxTxnHash == nil || idxTxnHash2BlockNum == nil {
+		if idxTxnHash == nil || idxTxnHash2BlockNum == nil || idxTxnHash.Empty() {
 			continue
 		}
 
@@ -914,9 +918,10 @@ func (r *BlockReader) txnByHash(txnHash common.Hash, segments []*Segment, buf []
 		if !ok {
 			continue
 		}
-		offset := idxTxnHash.OrdinalLookup(txnId)
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(idxTxnHash, idxTxnHash.OrdinalLookup(txnId))
+		if err != nil {
+			return nil, 0, false, err
+		}
 		// first byte txnHash check - reducing false-positives 256 times. Allows don't store and don't calculate full hash of entity - when checking many snapshots.
 		if !gg.MatchPrefix([]byte{txnHash[0]}) {
 			continue
@@ -1031,7 +1036,10 @@ func (r *BlockReader) IterateFrozenBodies(f func(blockNum, baseTxNum, txCount ui
 		defer sn.EnableReadAhead().DisableReadAhead()
 
 		var buf []byte
-		g := sn.MakeGetter()
+		g, err := sn.getter()
+		if err != nil {
+			return err
+		}
 		blockNum := sn.from
 		var b types.BodyForStorage
 		for g.HasNext() {
@@ -1074,6 +1082,169 @@ func (r *BlockReader) IntegrityTxnID(failFast bool) error {
 	return nil
 }
 
+// IntegrityHeadersFirstByte - re-hashes every header of headers segments and compares with first byte stored before it
+func (r *BlockReader) IntegrityHeadersFirstByte(ctx context.Context, failFast bool) error {
+	defer log.Info("[integrity] IntegrityHeadersFirstByte done")
+	view := r.sn.View()
+	defer view.Close()
+
+	var word []byte
+	for _, sn := range view.Headers() {
+		g, err := sn.getter()
+		if err != nil {
+			return err
+		}
+		for blockNum := sn.from; g.HasNext(); blockNum++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			word, _ = g.Next(word[:0])
+			if headerFirstByteValid(word) {
+				continue
+			}
+			err := fmt.Errorf("[integrity] IntegrityHeadersFirstByte: %w: %s, block_num=%d", ErrHeaderHashMismatch, sn.FileName(), blockNum)
+			if failFast {
+				return err
+			}
+			log.Error(err.Error())
+		}
+	}
+	return nil
+}
+
+// integrityTxnHashSampleEvery - IntegrityTxnHash2BlockNum checks only each N-th block if not `full`
+const integrityTxnHashSampleEvery = 100
+
+// IntegrityTxnHash2BlockNum - re-hashes transactions of blocks from segments and checks that TxnHash2BlockNum index
+// returns same block and TxnHash index returns offset of same transaction. Checks only sample of blocks if not `full`.
+// Errors name index file: bad shard of sharded indices can be rebuilt alone by coresnaptype.BuildTxnHashIdxShard
+func (r *BlockReader) IntegrityTxnHash2BlockNum(ctx context.Context, failFast bool, fromBlock uint64, full bool) error {
+	defer log.Info("[integrity] IntegrityTxnHash2BlockNum done")
+	view := r.sn.View()
+	defer view.Close()
+
+	report := func(err error) error {
+		if failFast {
+			return err
+		}
+		log.Error(err.Error())
+		return nil
+	}
+
+	var bodyBuf, word, word2 []byte
+	for _, sn := range view.Txs() {
+		if sn.to <= fromBlock {
+			continue
+		}
+		bodiesSn, ok := view.BodiesSegment(sn.from)
+		if !ok {
+			return fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: bodies segment not found for %s", sn.FileName())
+		}
+		if !sn.IsIndexed() {
+			if err := report(fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, indices not open", sn.FileName())); err != nil {
+				return err
+			}
+			continue
+		}
+		readers := map[*recsplit.Index]*recsplit.IndexReader{} // single indices or shards
+		readerByKey := func(index snaptype.Index, key []byte) (*recsplit.Index, *recsplit.IndexReader) {
+			idx := sn.IndexByKey(index, key)
+			reader, ok := readers[idx]
+			if !ok {
+				reader = recsplit.NewIndexReader(idx)
+				readers[idx] = reader
+			}
+			return idx, reader
+		}
+
+		g, err := sn.getter()
+		if err != nil {
+			return err
+		}
+		bodyGetter, err := bodiesSn.getter()
+		if err != nil {
+			return err
+		}
+		var b types.BodyForStorage
+		for blockNum := bodiesSn.from; bodyGetter.HasNext(); blockNum++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			bodyBuf, _ = bodyGetter.Next(bodyBuf[:0])
+			if err := rlp.DecodeBytes(bodyBuf, &b); err != nil {
+				return err
+			}
+			check := full || blockNum%integrityTxnHashSampleEvery == 0
+			for i := uint32(0); i < b.TxCount; i++ {
+				if !g.HasNext() {
+					return fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, not enough transactions for block_num=%d", sn.FileName(), blockNum)
+				}
+				isSystemTx := i == 0 || i == b.TxCount-1
+				if !check || isSystemTx {
+					g.Skip()
+					continue
+				}
+				word, _ = g.Next(word[:0])
+				txnIdx := i - 1
+				txn, err := types.DecodeTransaction(word[1+20:])
+				if err != nil {
+					return fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, block_num=%d, txn_idx=%d: %w", sn.FileName(), blockNum, txnIdx, err)
+				}
+				txnHash := txn.Hash()
+
+				idxTxnHash2BlockNum, reader2 := readerByKey(coresnaptype.Indexes.TxnHash2BlockNum, txnHash[:])
+				var foundBlockNum uint64
+				if !idxTxnHash2BlockNum.Empty() {
+					foundBlockNum, ok = reader2.Lookup(txnHash[:])
+				}
+				if idxTxnHash2BlockNum.Empty() || !ok || foundBlockNum != blockNum {
+					err := fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, block_num=%d, txn_idx=%d, txn_hash=%x: TxnHash2BlockNum index returned block_num=%d, index=%s", sn.FileName(), blockNum, txnIdx, txnHash, foundBlockNum, idxTxnHash2BlockNum.FileName())
+					if err := report(err); err != nil {
+						return err
+					}
+				}
+
+				idxTxnHash, reader := readerByKey(coresnaptype.Indexes.TxnHash, txnHash[:])
+				var txnId uint64
+				if !idxTxnHash.Empty() {
+					txnId, ok = reader.Lookup(txnHash[:])
+				}
+				if idxTxnHash.Empty() || !ok {
+					if err := report(fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, block_num=%d, txn_idx=%d, txn_hash=%x: not found in TxnHash index, index=%s", sn.FileName(), blockNum, txnIdx, txnHash, idxTxnHash.FileName())); err != nil {
+						return err
+					}
+					continue
+				}
+				gg, err := sn.getterAt(idxTxnHash, idxTxnHash.OrdinalLookup(txnId))
+				if err != nil {
+					if err := report(fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: block_num=%d, txn_idx=%d: %w", blockNum, txnIdx, err)); err != nil {
+						return err
+					}
+					continue
+				}
+				word2, _ = gg.Next(word2[:0])
+				var foundHash common.Hash
+				if len(word2) > 1+20 {
+					if foundTxn, err := types.DecodeTransaction(word2[1+20:]); err == nil {
+						foundHash = foundTxn.Hash()
+					}
+				}
+				if foundHash != txnHash {
+					err := fmt.Errorf("[integrity] IntegrityTxnHash2BlockNum: %s, block_num=%d, txn_idx=%d, txn_hash=%x: TxnHash index returned offset of txn_hash=%x, index=%s", sn.FileName(), blockNum, txnIdx, txnHash, foundHash, idxTxnHash.FileName())
+					if err := report(err); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (r *BlockReader) BadHeaderNumber(ctx context.Context, tx kv.Getter, hash common.Hash) (blockHeight *uint64, err error) {
 	return rawdb.ReadBadHeaderNumber(tx, hash)
 }
@@ -1201,9 +1372,10 @@ func (r *BlockReader) borBlockByEventHash(txnHash common.Hash, segments []*Segme
 		if !exists {
 			continue
 		}
-		offset := idxBorTxnHash.OrdinalLookup(blockEventId)
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(idxBorTxnHash, idxBorTxnHash.OrdinalLookup(blockEventId))
+		if err != nil {
+			return 0, false, err
+		}
 		if !gg.MatchPrefix(txnHash[:]) {
 			continue
 		}
@@ -1335,9 +1507,10 @@ func (r *BlockReader) EventsByBlock(ctx context.Context, tx kv.Tx, hash common.H
 		if !ok {
 			continue
 		}
-		offset := idxBorTxnHash.OrdinalLookup(blockEventId)
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(idxBorTxnHash, idxBorTxnHash.OrdinalLookup(blockEventId))
+		if err != nil {
+			return nil, err
+		}
 		for gg.HasNext() && gg.MatchPrefix(borTxHash[:]) {
 			buf, _ = gg.Next(buf[:0])
 			result = append(result, rlp.RawValue(common.Copy(buf[length.Hash+length.BlockNum+8:])))
@@ -1364,9 +1537,10 @@ func (r *BlockReader) EventsByIdFromSnapshot(from uint64, to time.Time, limit in
 			continue
 		}
 
-		offset := idxBorTxnHash.OrdinalLookup(0)
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(idxBorTxnHash, idxBorTxnHash.OrdinalLookup(0))
+		if err != nil {
+			return nil, false, err
+		}
 		for gg.HasNext() {
 			buf, _ = gg.Next(buf[:0])
 
@@ -1446,7 +1620,11 @@ func (r *BlockReader) LastFrozenEventId() uint64 {
 		return 0
 	}
 	var lastEventID uint64
-	gg := lastSegment.MakeGetter()
+	gg, err := lastSegment.getter()
+	if err != nil { // events of DB are used
+		log.Warn("[snapshots] LastFrozenEventId", "err", err)
+		return 0
+	}
 	var buf []byte
 	for gg.HasNext() {
 		buf, _ = gg.Next(buf[:0])
@@ -1550,9 +1728,10 @@ func (r *BlockReader) Span(ctx context.Context, tx kv.Getter, spanId uint64) ([]
 		if idx.KeyCount() == 0 {
 			continue
 		}
-		offset := idx.OrdinalLookup(spanId - idx.BaseDataID())
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(idx, idx.OrdinalLookup(spanId-idx.BaseDataID()))
+		if err != nil {
+			return nil, err
+		}
 		result, _ := gg.Next(nil)
 		return common.Copy(result), nil
 	}
@@ -1644,9 +1823,10 @@ func (r *BlockReader) Checkpoint(ctx context.Context, tx kv.Getter, checkpointId
 			continue
 		}
 
-		offset := index.OrdinalLookup(checkpointId - index.BaseDataID())
-		gg := sn.MakeGetter()
-		gg.Reset(offset)
+		gg, err := sn.getterAt(index, index.OrdinalLookup(checkpointId-index.BaseDataID()))
+		if err != nil {
+			return nil, err
+		}
 		result, _ := gg.Next(nil)
 		return common.Copy(result), nil
 	}
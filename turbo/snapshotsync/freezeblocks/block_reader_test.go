@@ -3,20 +3,27 @@ package freezeblocks
 import (
 	"context"
 	"encoding/binary"
+	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 
+	"github.com/ledgerwatch/erigon-lib/chain"
 	"github.com/ledgerwatch/erigon-lib/common/length"
 	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/seg"
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/crypto"
 	"github.com/ledgerwatch/erigon/eth/ethconfig"
 	borsnaptype "github.com/ledgerwatch/erigon/polygon/bor/snaptype"
+	"github.com/ledgerwatch/erigon/rlp"
 	"github.com/ledgerwatch/erigon/turbo/testlog"
 )
 
@@ -27,7 +34,7 @@ func TestBlockReaderLastFrozenSpanIdWhenSegmentFilesArePresent(t *testing.T) {
 	dir := t.TempDir()
 	createTestBorEventSegmentFile(t, 0, 500_000, 132, dir, logger)
 	createTestSegmentFile(t, 0, 500_000, borsnaptype.Enums.BorSpans, dir, 1, logger)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err := borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -41,7 +48,7 @@ func TestBlockReaderLastFrozenSpanIdWhenSegmentFilesAreNotPresent(t *testing.T)
 
 	logger := testlog.Logger(t, log.LvlInfo)
 	dir := t.TempDir()
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err := borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -65,7 +72,7 @@ func TestBlockReaderLastFrozenSpanIdReturnsLastSegWithIdx(t *testing.T) {
 	idxFileToDelete := filepath.Join(dir, snaptype.IdxFileName(1, 1_000_000, 1_500_000, borsnaptype.BorSpans.Name()))
 	err := os.Remove(idxFileToDelete)
 	require.NoError(t, err)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err = borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -95,7 +102,7 @@ func TestBlockReaderLastFrozenSpanIdReturnsZeroWhenAllSegmentsDoNotHaveIdx(t *te
 	idxFileToDelete = filepath.Join(dir, snaptype.IdxFileName(1, 1_000_000, 1_500_000, borsnaptype.BorSpans.Name()))
 	err = os.Remove(idxFileToDelete)
 	require.NoError(t, err)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err = borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -111,7 +118,7 @@ func TestBlockReaderLastFrozenEventIdWhenSegmentFilesArePresent(t *testing.T) {
 	dir := t.TempDir()
 	createTestBorEventSegmentFile(t, 0, 500_000, 132, dir, logger)
 	createTestSegmentFile(t, 0, 500_000, borsnaptype.Enums.BorSpans, dir, 1, logger)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err := borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -125,7 +132,7 @@ func TestBlockReaderLastFrozenEventIdWhenSegmentFilesAreNotPresent(t *testing.T)
 
 	logger := testlog.Logger(t, log.LvlInfo)
 	dir := t.TempDir()
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err := borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -149,7 +156,7 @@ func TestBlockReaderLastFrozenEventIdReturnsLastSegWithIdx(t *testing.T) {
 	idxFileToDelete := filepath.Join(dir, snaptype.IdxFileName(1, 1_000_000, 1_500_000, borsnaptype.BorEvents.Name()))
 	err := os.Remove(idxFileToDelete)
 	require.NoError(t, err)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err = borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -179,7 +186,7 @@ func TestBlockReaderLastFrozenEventIdReturnsZeroWhenAllSegmentsDoNotHaveIdx(t *t
 	idxFileToDelete = filepath.Join(dir, snaptype.IdxFileName(1, 1_000_000, 1_500_000, borsnaptype.BorEvents.Name()))
 	err = os.Remove(idxFileToDelete)
 	require.NoError(t, err)
-	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	borRoSnapshots := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
 	defer borRoSnapshots.Close()
 	err = borRoSnapshots.ReopenFolder()
 	require.NoError(t, err)
@@ -188,6 +195,187 @@ func TestBlockReaderLastFrozenEventIdReturnsZeroWhenAllSegmentsDoNotHaveIdx(t *t
 	require.Equal(t, uint64(0), blockReader.LastFrozenEventId())
 }
 
+func TestBorRoSnapshotsIgnoredOnNonBorChain(t *testing.T) {
+	t.Parallel()
+
+	logger := testlog.Logger(t, log.LvlInfo)
+	dir := t.TempDir()
+	createTestBorEventSegmentFile(t, 0, 500_000, 132, dir, logger)
+	createTestSegmentFile(t, 0, 500_000, borsnaptype.Enums.BorSpans, dir, 1, logger)
+
+	// unknown chain: bor files are used
+	unknown := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, nil, logger)
+	defer unknown.Close()
+	require.NoError(t, unknown.ReopenFolder())
+	require.Len(t, unknown.Files(), 2)
+	require.Positive(t, unknown.OpenFilesCount())
+	names := unknown.Files()
+
+	nonBor := NewBorRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, &chain.Config{}, logger)
+	defer nonBor.Close()
+	require.Empty(t, nonBor.Types())
+	require.NoError(t, nonBor.ReopenFolder())
+	require.Empty(t, nonBor.Files())
+	require.Zero(t, nonBor.OpenFilesCount())
+	require.Zero(t, nonBor.BlocksAvailable())
+	require.Zero(t, nonBor.SegmentsMax())
+
+	// list from db (for example from other chain's datadir) is ignored too
+	require.NoError(t, nonBor.ReopenList(names, false))
+	require.Empty(t, nonBor.Files())
+	require.Zero(t, nonBor.OpenFilesCount())
+	require.Zero(t, nonBor.BlocksAvailable())
+}
+
+func TestBlockReaderHeaderByNumberCorruptedIndex(t *testing.T) {
+	t.Parallel()
+
+	logger := testlog.Logger(t, log.LvlInfo)
+	dir := t.TempDir()
+	c, err := seg.NewCompressor(context.Background(), "test", filepath.Join(dir, snaptype.SegmentFileName(1, 0, 1_000, coresnaptype.Enums.Headers)), dir, 100, 1, log.LvlDebug, logger)
+	require.NoError(t, err)
+	defer c.Close()
+	c.DisableFsync()
+	require.NoError(t, c.AddWord([]byte{1}))
+	require.NoError(t, c.Compress())
+	idx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   1,
+		Enums:      true,
+		BucketSize: 10,
+		TmpDir:     dir,
+		IndexFile:  filepath.Join(dir, snaptype.IdxFileName(1, 0, 1_000, coresnaptype.Enums.Headers.String())),
+		LeafSize:   8,
+	}, logger)
+	require.NoError(t, err)
+	defer idx.Close()
+	idx.DisableFsync()
+	require.NoError(t, idx.AddKey([]byte{1}, 1<<20)) // bogus offset: far beyond segment data
+	require.NoError(t, idx.Build(context.Background()))
+
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(t, s.ReopenFolder())
+
+	blockReader := NewBlockReader(s, nil)
+	h, err := blockReader.HeaderByNumber(context.Background(), nil, 0)
+	require.Nil(t, h)
+	var corrupted *ErrCorruptedIndex
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, uint64(1<<20), corrupted.Offset)
+	require.Equal(t, snaptype.SegmentFileName(1, 0, 1_000, coresnaptype.Enums.Headers), corrupted.Segment)
+	require.Equal(t, snaptype.IdxFileName(1, 0, 1_000, coresnaptype.Enums.Headers.String()), corrupted.Index)
+}
+
+func TestBlockReaderSegmentModifiedOnDisk(t *testing.T) {
+	t.Parallel()
+
+	logger := testlog.Logger(t, log.LvlInfo)
+	dir := t.TempDir()
+	headerRLP, err := rlp.EncodeToBytes(&types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)})
+	require.NoError(t, err)
+	segName := snaptype.SegmentFileName(1, 0, 1_000, coresnaptype.Enums.Headers)
+
+	c, err := seg.NewCompressor(context.Background(), "test", filepath.Join(dir, segName), dir, 100, 1, log.LvlDebug, logger)
+	require.NoError(t, err)
+	defer c.Close()
+	c.DisableFsync()
+	require.NoError(t, c.AddWord(append([]byte{crypto.Keccak256(headerRLP)[0]}, headerRLP...)))
+	require.NoError(t, c.Compress())
+	idx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   1,
+		Enums:      true,
+		BucketSize: 10,
+		TmpDir:     dir,
+		IndexFile:  filepath.Join(dir, snaptype.IdxFileName(1, 0, 1_000, coresnaptype.Enums.Headers.String())),
+		LeafSize:   8,
+	}, logger)
+	require.NoError(t, err)
+	defer idx.Close()
+	idx.DisableFsync()
+	require.NoError(t, idx.AddKey([]byte{1}, 0))
+	require.NoError(t, idx.Build(context.Background()))
+
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true, VerifyOpenFilesInterval: time.Nanosecond}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(t, s.ReopenFolder())
+
+	blockReader := NewBlockReader(s, nil)
+	h, err := blockReader.HeaderByNumber(context.Background(), nil, 0)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	require.Empty(t, s.VerifyOpenFilesUnchanged())
+
+	// external process modifies file in-place: same inode, but other size and mtime
+	f, err := os.OpenFile(filepath.Join(dir, segName), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xde, 0xad})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	modTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, segName), modTime, modTime))
+
+	// automatic check before read
+	h, err = blockReader.HeaderByNumber(context.Background(), nil, 0)
+	require.Nil(t, h)
+	var modified *ErrSegmentModified
+	require.ErrorAs(t, err, &modified)
+	require.Equal(t, segName, modified.Segment)
+
+	require.Equal(t, []string{segName}, s.VerifyOpenFilesUnchanged())
+
+	// poisoned: without automatic checks reads still refused
+	s.SetVerifyOpenFilesInterval(0)
+	_, err = blockReader.HeaderByNumber(context.Background(), nil, 0)
+	require.ErrorAs(t, err, &modified)
+
+	// iterators over whole segment too
+	require.ErrorAs(t, blockReader.IntegrityHeadersFirstByte(context.Background(), true), &modified)
+	require.ErrorAs(t, ForEachHeader(context.Background(), s, func(*types.Header) error { return nil }), &modified)
+}
+
+func TestBlockReaderIntegrityHeadersFirstByte(t *testing.T) {
+	t.Parallel()
+
+	logger := testlog.Logger(t, log.LvlInfo)
+	dir := t.TempDir()
+	headerRLP, err := rlp.EncodeToBytes(&types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)})
+	require.NoError(t, err)
+	valid := append([]byte{crypto.Keccak256(headerRLP)[0]}, headerRLP...)
+	corrupted := append([]byte{valid[0] + 1}, headerRLP...)
+
+	c, err := seg.NewCompressor(context.Background(), "test", filepath.Join(dir, snaptype.SegmentFileName(1, 0, 1_000, coresnaptype.Enums.Headers)), dir, 100, 1, log.LvlDebug, logger)
+	require.NoError(t, err)
+	defer c.Close()
+	c.DisableFsync()
+	require.NoError(t, c.AddWord(valid))
+	require.NoError(t, c.AddWord(corrupted))
+	require.NoError(t, c.Compress())
+	idx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   2,
+		Enums:      true,
+		BucketSize: 10,
+		TmpDir:     dir,
+		IndexFile:  filepath.Join(dir, snaptype.IdxFileName(1, 0, 1_000, coresnaptype.Enums.Headers.String())),
+		LeafSize:   8,
+	}, logger)
+	require.NoError(t, err)
+	defer idx.Close()
+	idx.DisableFsync()
+	require.NoError(t, idx.AddKey([]byte{1}, 0))
+	require.NoError(t, idx.AddKey([]byte{2}, 0))
+	require.NoError(t, idx.Build(context.Background()))
+
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(t, s.ReopenFolder())
+
+	blockReader := NewBlockReader(s, nil)
+	err = blockReader.IntegrityHeadersFirstByte(context.Background(), true)
+	require.ErrorIs(t, err, ErrHeaderHashMismatch)
+	require.ErrorContains(t, err, "block_num=1")
+	require.NoError(t, blockReader.IntegrityHeadersFirstByte(context.Background(), false)) // only logs
+}
+
 func createTestBorEventSegmentFile(t *testing.T, from, to, eventId uint64, dir string, logger log.Logger) {
 	compressor, err := seg.NewCompressor(
 		context.Background(),
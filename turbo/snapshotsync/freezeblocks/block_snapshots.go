@@ -7,9 +7,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime"
 	"strings"
 	"sync"
@@ -33,9 +33,11 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/dbg"
 	dir2 "github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/snapbuild"
 	"github.com/ledgerwatch/erigon-lib/diagnostics"
 	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/metrics"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/seg"
 	types2 "github.com/ledgerwatch/erigon-lib/types"
@@ -43,6 +45,7 @@ import (
 	"github.com/ledgerwatch/erigon/core/rawdb/blockio"
 	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
 	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/crypto"
 	"github.com/ledgerwatch/erigon/eth/ethconfig"
 	"github.com/ledgerwatch/erigon/eth/ethconfig/estimate"
 	"github.com/ledgerwatch/erigon/eth/stagedsync/stages"
@@ -69,8 +72,43 @@ type Segment struct {
 	Range
 	*seg.Decompressor
 	indexes []*recsplit.Index
+	shards  [][]*recsplit.Index // shards[index.Offset]: indices built as shards, see ethconfig.BlocksFreezing.TxnHashIdxShards
 	segType snaptype.Type
 	version snaptype.Version
+
+	identity       *fileIdentity // of .seg file at open time. See RoSnapshots.VerifyOpenFilesUnchanged
+	verifyInterval *atomic.Int64 // shared with owner RoSnapshots. nil or 0 - no automatic verification on read
+
+	names *segmentNames // parse-once names of files of segment. See Segment.cachedNames
+}
+
+// segmentNames - file name, FileInfo and index file names of segment: formatting and parsing of them is not cheap,
+// and they are needed in loops over all segments (closeWhatNotInList, delete, indexing)
+type segmentNames struct {
+	version      snaptype.Version
+	from, to     uint64
+	dir          string
+	fileName     string
+	info         snaptype.FileInfo
+	idxFileNames []string
+}
+
+func newSegmentNames(dir string, segType snaptype.Type, version snaptype.Version, from, to uint64) *segmentNames {
+	return &segmentNames{version: version, from: from, to: to, dir: dir, fileName: segType.FileName(version, from, to),
+		info: segType.FileInfo(dir, from, to), idxFileNames: segType.IdxFileNames(version, from, to)}
+}
+
+func newSegment(dir string, segType snaptype.Type, version snaptype.Version, from, to uint64) *Segment {
+	return &Segment{segType: segType, version: version, Range: Range{from, to}, names: newSegmentNames(dir, segType, version, from, to)}
+}
+
+// cachedNames - names of segment's files. Cache is valid while version and range of segment are same as at
+// construction (or last reopen). Stale cache is not used: names are derived again
+func (s Segment) cachedNames() *segmentNames {
+	if n := s.names; n != nil && n.version == s.version && n.from == s.from && n.to == s.to {
+		return n
+	}
+	return newSegmentNames("", s.segType, s.version, s.from, s.to)
 }
 
 func (s Segment) Type() snaptype.Type {
@@ -93,7 +131,21 @@ func (s Segment) Index(index ...snaptype.Index) *recsplit.Index {
 	return s.indexes[index[0].Offset]
 }
 
+// IndexByKey - index which has `key`: shard of index built as shards (key space partitioned by leading byte of key) or
+// single index. Ordinal lookups must use Index: in sharded layout it returns ordinals index, see snaptype.Index.Ordinals
+func (s Segment) IndexByKey(index snaptype.Index, key []byte) *recsplit.Index {
+	if len(s.shards) <= index.Offset {
+		return s.Index(index)
+	}
+	shards := s.shards[index.Offset]
+	return shards[snaptype.IdxShardOf(key, len(shards))]
+}
+
 func (s Segment) IsIndexed() bool {
+	if len(s.shards) > 0 {
+		return len(s.indexes) > 0 && s.indexes[0] != nil && len(s.shards) == len(s.Type().Indexes())
+	}
+
 	if len(s.indexes) < len(s.Type().Indexes()) {
 		return false
 	}
@@ -108,19 +160,187 @@ func (s Segment) IsIndexed() bool {
 }
 
 func (s Segment) FileName() string {
-	return s.Type().FileName(s.version, s.from, s.to)
+	return s.cachedNames().fileName
 }
 
+// FileInfo - of current version of segment's type (not of segment's version), see snaptype.Type.FileInfo
 func (s Segment) FileInfo(dir string) snaptype.FileInfo {
+	if n := s.cachedNames(); n.dir == dir {
+		return n.info
+	}
 	return s.Type().FileInfo(dir, s.from, s.to)
 }
 
+// IdxFileNames - names of index files of segment, see snaptype.Type.IdxFileNames. If indices are open in sharded
+// layout - names of open ordinals index and shards
+func (s Segment) IdxFileNames() []string {
+	if len(s.shards) > 0 {
+		fileNames := make([]string, 0, len(s.indexes)+len(s.shards)*len(s.shards[0]))
+		for _, index := range s.indexes {
+			fileNames = append(fileNames, index.FileName())
+		}
+		for _, shards := range s.shards {
+			for _, index := range shards {
+				fileNames = append(fileNames, index.FileName())
+			}
+		}
+		return fileNames
+	}
+	return s.cachedNames().idxFileNames
+}
+
+var mxCorruptedIndex = metrics.GetOrCreateCounter("snapshots_corrupted_index")
+
+// ErrCorruptedIndex - index lookup returned offset outside of segment data: index doesn't match segment and must be rebuilt
+type ErrCorruptedIndex struct {
+	Segment, Index string
+	Offset, Size   uint64
+}
+
+func (e *ErrCorruptedIndex) Error() string {
+	return fmt.Sprintf("corrupted index %s: offset %d is out of segment %s data (size %d)", e.Index, e.Offset, e.Segment, e.Size)
+}
+
+var mxModifiedSegment = metrics.GetOrCreateCounter("snapshots_modified_segment")
+
+// ErrSegmentModified - .seg file was modified on disk after open (for example overwritten in-place by external process):
+// mmaped data may not match indices anymore. Segment is poisoned until reopen
+type ErrSegmentModified struct {
+	Segment string
+}
+
+func (e *ErrSegmentModified) Error() string {
+	return fmt.Sprintf("segment %s was modified on disk after open, must be reopened", e.Segment)
+}
+
+var mxEmptySegment = metrics.GetOrCreateCounter("snapshots_empty_segment")
+
+// ErrEmptySegment - .seg file is smaller than seg.MinFileSize (usually 0-byte file left by crashed dump). Such segment is
+// skipped by reopen in both optimistic and strict modes: its range is not available, see BlocksFreezing.QuarantineEmptySegments
+type ErrEmptySegment struct {
+	Segment string
+	Size    int64
+}
+
+func (e *ErrEmptySegment) Error() string {
+	return fmt.Sprintf("empty segment %s: size %d is less than minimal %d", e.Segment, e.Size, seg.MinFileSize)
+}
+
+// fileIdentity - (size, mtime, inode) of file at open time
+type fileIdentity struct {
+	info      os.FileInfo
+	lastCheck atomic.Int64 // unix nano
+	poisoned  atomic.Bool
+}
+
+func newFileIdentity(filePath string) (*fileIdentity, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	id := &fileIdentity{info: info}
+	id.lastCheck.Store(time.Now().UnixNano())
+	return id, nil
+}
+
+// changed - reason if file on disk is not the file which was opened. Removed file is not a change:
+// it stays readable while mmaped (happens after merge)
+func (id *fileIdentity) changed(filePath string) (reason string) {
+	info, err := os.Stat(filePath)
+	switch {
+	case err != nil:
+		return ""
+	case !os.SameFile(id.info, info):
+		return "inode"
+	case info.Size() != id.info.Size():
+		return fmt.Sprintf("size %d -> %d", id.info.Size(), info.Size())
+	case !info.ModTime().Equal(id.info.ModTime()):
+		return fmt.Sprintf("mtime %s -> %s", id.info.ModTime().Format(time.RFC3339Nano), info.ModTime().Format(time.RFC3339Nano))
+	}
+	return ""
+}
+
+// verifyUnchanged - stat of .seg file. If it was modified: logs error and poisons segment, all reads return *ErrSegmentModified
+func (s *Segment) verifyUnchanged() (changed bool) {
+	id := s.identity
+	if id == nil || s.Decompressor == nil {
+		return false
+	}
+	if id.poisoned.Load() {
+		return true
+	}
+	id.lastCheck.Store(time.Now().UnixNano())
+	reason := id.changed(s.FilePath())
+	if reason == "" {
+		return false
+	}
+	if id.poisoned.CompareAndSwap(false, true) {
+		mxModifiedSegment.Inc()
+		log.Error("[snapshots] segment file was modified on disk after open, refusing to read it until reopen", "file", s.FileName(), "changed", reason)
+	}
+	return true
+}
+
+// checkUnchanged - cheap: stat of file happens not more often than `verifyInterval`
+func (s *Segment) checkUnchanged() error {
+	id := s.identity
+	if id == nil {
+		return nil
+	}
+	if s.verifyInterval != nil && !id.poisoned.Load() {
+		if interval := s.verifyInterval.Load(); interval > 0 {
+			last := id.lastCheck.Load()
+			if now := time.Now().UnixNano(); now-last >= interval && id.lastCheck.CompareAndSwap(last, now) {
+				s.verifyUnchanged()
+			}
+		}
+	}
+	if id.poisoned.Load() {
+		return &ErrSegmentModified{Segment: s.FileName()}
+	}
+	return nil
+}
+
+// getterAt - getter positioned at `offset` returned by lookup in `idx`. Returns *ErrCorruptedIndex instead of panic on read
+// and *ErrSegmentModified if file was modified on disk after open
+func (s *Segment) getterAt(idx *recsplit.Index, offset uint64) (*seg.Getter, error) {
+	if err := s.checkUnchanged(); err != nil {
+		return nil, err
+	}
+	gg := s.MakeGetter()
+	if size := uint64(gg.Size()); offset >= size {
+		mxCorruptedIndex.Inc()
+		return nil, &ErrCorruptedIndex{Segment: s.FileName(), Index: idx.FileName(), Offset: offset, Size: size}
+	}
+	gg.Reset(offset)
+	return gg, nil
+}
+
+// getter - getter from start of segment, for iteration over all its words. Returns *ErrSegmentModified as getterAt
+func (s *Segment) getter() (*seg.Getter, error) {
+	if err := s.checkUnchanged(); err != nil {
+		return nil, err
+	}
+	return s.MakeGetter(), nil
+}
+
 func (s *Segment) reopenSeg(dir string) (err error) {
 	s.closeSeg()
-	s.Decompressor, err = seg.NewDecompressor(filepath.Join(dir, s.FileName()))
+	if n := s.cachedNames(); n != s.names || n.dir != dir {
+		s.names = newSegmentNames(dir, s.segType, s.version, s.from, s.to)
+	}
+	filePath := filepath.Join(dir, s.FileName())
+	if info, statErr := os.Stat(filePath); statErr == nil && info.Size() < seg.MinFileSize {
+		return &ErrEmptySegment{Segment: s.FileName(), Size: info.Size()}
+	}
+	s.Decompressor, err = seg.NewDecompressor(filePath)
 	if err != nil {
 		return fmt.Errorf("%w, fileName: %s", err, s.FileName())
 	}
+	if s.identity, err = newFileIdentity(s.FilePath()); err != nil {
+		s.closeSeg()
+		return fmt.Errorf("%w, fileName: %s", err, s.FileName())
+	}
 	return nil
 }
 
@@ -129,14 +349,21 @@ func (s *Segment) closeSeg() {
 		s.Close()
 		s.Decompressor = nil
 	}
+	s.identity = nil
 }
 
 func (s *Segment) closeIdx() {
 	for _, index := range s.indexes {
 		index.Close()
 	}
+	for _, shards := range s.shards {
+		for _, index := range shards {
+			index.Close()
+		}
+	}
 
 	s.indexes = nil
+	s.shards = nil
 }
 
 func (s *Segment) close() {
@@ -156,12 +383,17 @@ func (s *Segment) openFiles() []string {
 	for _, index := range s.indexes {
 		files = append(files, index.FilePath())
 	}
+	for _, shards := range s.shards {
+		for _, index := range shards {
+			files = append(files, index.FilePath())
+		}
+	}
 
 	return files
 }
 
 func (s *Segment) reopenIdxIfNeed(dir string, optimistic bool) (err error) {
-	if len(s.Type().IdxFileNames(s.version, s.from, s.to)) == 0 {
+	if len(s.IdxFileNames()) == 0 {
 		return nil
 	}
 
@@ -186,10 +418,15 @@ func (s *Segment) reopenIdx(dir string) (err error) {
 		return nil
 	}
 
-	for _, fileName := range s.Type().IdxFileNames(s.version, s.from, s.to) {
+	for i, fileName := range s.IdxFileNames() {
 		index, err := recsplit.OpenIndex(filepath.Join(dir, fileName))
 
 		if err != nil {
+			if i == 0 && errors.Is(err, os.ErrNotExist) {
+				if sharded, err := s.reopenShardedIdx(dir); sharded {
+					return err
+				}
+			}
 			return fmt.Errorf("%w, fileName: %s", err, fileName)
 		}
 
@@ -199,6 +436,51 @@ func (s *Segment) reopenIdx(dir string) (err error) {
 	return nil
 }
 
+// reopenShardedIdx - opens indices of segment built as shards and ordinals index of them. sharded=false if there is no
+// shards on disk: segment has single-file indices (or is not indexed)
+func (s *Segment) reopenShardedIdx(dir string) (sharded bool, err error) {
+	info := s.FileInfo(dir)
+	indexes := s.Type().Indexes()
+	shardsOf := make([]int, len(indexes))
+	for i, index := range indexes {
+		if shardsOf[i], err = index.Shards(info); err != nil {
+			return true, err
+		}
+		if shardsOf[i] == 0 {
+			return false, nil
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			s.closeIdx()
+		}
+	}()
+	fileName := snaptype.IdxFileName(s.version, s.from, s.to, indexes[0].Ordinals().Name)
+	ordinals, err := recsplit.OpenIndex(filepath.Join(dir, fileName))
+	if err != nil {
+		return true, fmt.Errorf("%w, fileName: %s", err, fileName)
+	}
+	s.indexes = append(s.indexes, ordinals)
+
+	for i, index := range indexes {
+		n := shardsOf[i]
+		shards := make([]*recsplit.Index, 0, n)
+		for shard := 0; shard < n; shard++ {
+			fileName := snaptype.IdxShardFileName(s.version, s.from, s.to, index.Name, shard, n)
+			idx, err := recsplit.OpenIndex(filepath.Join(dir, fileName))
+			if err != nil {
+				s.shards = append(s.shards, shards)
+				return true, fmt.Errorf("%w, fileName: %s", err, fileName)
+			}
+			shards = append(shards, idx)
+		}
+		s.shards = append(s.shards, shards)
+	}
+
+	return true, nil
+}
+
 func (sn *Segment) mappedHeaderSnapshot() *silkworm.MappedHeaderSnapshot {
 	segmentRegion := silkworm.NewMemoryMappedRegion(sn.FilePath(), sn.DataHandle(), sn.Size())
 	idxRegion := silkworm.NewMemoryMappedRegion(sn.Index().FilePath(), sn.Index().DataHandle(), sn.Index().Size())
@@ -260,8 +542,9 @@ type RoSnapshots struct {
 	indicesReady  atomic.Bool
 	segmentsReady atomic.Bool
 
-	types    []snaptype.Type
-	segments btree.Map[snaptype.Enum, *segments]
+	types        []snaptype.Type
+	ignoredTypes []snaptype.Type // types not used by chain: their files are not opened (for example copied from other chain's datadir)
+	segments     btree.Map[snaptype.Enum, *segments]
 
 	dir         string
 	segmentsMax atomic.Uint64 // all types of .seg files are available - up to this number
@@ -271,6 +554,17 @@ type RoSnapshots struct {
 
 	// allows for pruning segments - this is the min availible segment
 	segmentsMin atomic.Uint64
+
+	availabilityLock    sync.Mutex
+	availabilityChanged chan struct{} // closed (and replaced by new one) when idxMax advances
+
+	generation atomic.Uint64 // incremented at end of every rebuildSegments. See FilesGeneration
+
+	emptySegments atomic.Pointer[[]string] // skipped by last rebuildSegments. See EmptySegments
+
+	pinnedLock sync.Mutex // guards PinnedFileName
+
+	verifyInterval atomic.Int64 // nanoseconds. See SetVerifyOpenFilesInterval
 }
 
 // NewRoSnapshots - opens all snapshots. But to simplify everything:
@@ -279,17 +573,25 @@ type RoSnapshots struct {
 //   - gaps are not allowed
 //   - segment have [from:to) semantic
 func NewRoSnapshots(cfg ethconfig.BlocksFreezing, snapDir string, segmentsMin uint64, logger log.Logger) *RoSnapshots {
-	return newRoSnapshots(cfg, snapDir, coresnaptype.BlockSnapshotTypes, segmentsMin, logger)
+	return newRoSnapshots(cfg, snapDir, coresnaptype.BlockSnapshotTypes, segmentsMin, nil, logger)
 }
 
-func newRoSnapshots(cfg ethconfig.BlocksFreezing, snapDir string, types []snaptype.Type, segmentsMin uint64, logger log.Logger) *RoSnapshots {
+// newRoSnapshots - registers only `types` used by chain. chainConfig=nil: chain is unknown, all types are used
+func newRoSnapshots(cfg ethconfig.BlocksFreezing, snapDir string, types []snaptype.Type, segmentsMin uint64, chainConfig *chain.Config, logger log.Logger) *RoSnapshots {
 	var segs btree.Map[snaptype.Enum, *segments]
+	var used, ignored []snaptype.Type
 	for _, snapType := range types {
+		if !typeUsedByChain(snapType, chainConfig) {
+			ignored = append(ignored, snapType)
+			continue
+		}
+		used = append(used, snapType)
 		segs.Set(snapType.Enum(), &segments{})
 	}
 
-	s := &RoSnapshots{dir: snapDir, cfg: cfg, segments: segs, logger: logger, types: types}
+	s := &RoSnapshots{dir: snapDir, cfg: cfg, segments: segs, logger: logger, types: used, ignoredTypes: ignored}
 	s.segmentsMin.Store(segmentsMin)
+	s.SetVerifyOpenFilesInterval(cfg.VerifyOpenFilesInterval)
 
 	return s
 }
@@ -302,6 +604,10 @@ func (s *RoSnapshots) IndicesMax() uint64            { return s.idxMax.Load() }
 func (s *RoSnapshots) SegmentsMax() uint64           { return s.segmentsMax.Load() }
 func (s *RoSnapshots) SegmentsMin() uint64           { return s.segmentsMin.Load() }
 func (s *RoSnapshots) SetSegmentsMin(min uint64)     { s.segmentsMin.Store(min) }
+
+// FilesGeneration - monotonically increasing counter of segments re-opens. Equal generations imply identical open segments.
+func (s *RoSnapshots) FilesGeneration() uint64 { return s.generation.Load() }
+
 func (s *RoSnapshots) BlocksAvailable() uint64 {
 	if s == nil {
 		return 0
@@ -309,6 +615,46 @@ func (s *RoSnapshots) BlocksAvailable() uint64 {
 
 	return s.idxMax.Load()
 }
+
+// AvailabilityChanged - channel which will be closed when BlocksAvailable advances. Take new channel after each signal.
+func (s *RoSnapshots) AvailabilityChanged() <-chan struct{} {
+	s.availabilityLock.Lock()
+	defer s.availabilityLock.Unlock()
+	if s.availabilityChanged == nil {
+		s.availabilityChanged = make(chan struct{})
+	}
+	return s.availabilityChanged
+}
+
+// notifyAvailability - must be called without segments lock
+func (s *RoSnapshots) notifyAvailability(prevIdxMax uint64) {
+	if s.idxMax.Load() <= prevIdxMax {
+		return
+	}
+	s.availabilityLock.Lock()
+	defer s.availabilityLock.Unlock()
+	if s.availabilityChanged != nil {
+		close(s.availabilityChanged)
+		s.availabilityChanged = nil
+	}
+}
+
+// WaitBlocksAvailable - blocks until `blockNum` is available in indexed snapshots (by ReopenFolder/ReopenList, for example
+// after download or buildMissedIndices)
+func (s *RoSnapshots) WaitBlocksAvailable(ctx context.Context, blockNum uint64) error {
+	for {
+		changed := s.AvailabilityChanged() // must be taken before check: to not miss signal
+		if s.BlocksAvailable() >= blockNum {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (s *RoSnapshots) LogStat(label string) {
 	var m runtime.MemStats
 	dbg.ReadMemStats(&m)
@@ -325,6 +671,47 @@ func (s *RoSnapshots) EnsureExpectedBlocksAreAvailable(cfg *snapcfg.Cfg) error {
 	return nil
 }
 
+// EmptySegments - names of .seg files skipped by last reopen because they are empty, see ErrEmptySegment
+func (s *RoSnapshots) EmptySegments() []string {
+	if empty := s.emptySegments.Load(); empty != nil {
+		return *empty
+	}
+	return nil
+}
+
+// handleEmptySegment - logs empty segment and renames it to .broken if BlocksFreezing.QuarantineEmptySegments is set:
+// file is kept for investigation, but its name is free for Downloader
+func (s *RoSnapshots) handleEmptySegment(emptyErr *ErrEmptySegment) {
+	mxEmptySegment.Inc()
+	filePath := filepath.Join(s.dir, emptyErr.Segment)
+	if !s.cfg.QuarantineEmptySegments {
+		s.logger.Warn("[snapshots] skip empty segment, likely left by crashed dump or download", "file", emptyErr.Segment, "size", emptyErr.Size)
+		return
+	}
+	if err := os.Rename(filePath, filePath+".broken"); err != nil {
+		s.logger.Warn("[snapshots] skip empty segment, quarantine failed", "file", emptyErr.Segment, "size", emptyErr.Size, "err", err)
+		return
+	}
+	s.logger.Warn("[snapshots] empty segment quarantined, likely left by crashed dump or download", "file", emptyErr.Segment, "size", emptyErr.Size, "to", filepath.Base(filePath)+".broken")
+}
+
+// logIgnored - one summary line instead of per-file noise
+func (s *RoSnapshots) logIgnored(ignored int) {
+	if ignored == 0 {
+		return
+	}
+	s.logger.Info(fmt.Sprintf("[snapshots] ignored %d files of types not used by this chain", ignored), "types", s.ignoredTypes)
+}
+
+func (s *RoSnapshots) isIgnoredType(in snaptype.Type) bool {
+	for _, t := range s.ignoredTypes {
+		if t.Enum() == in.Enum() {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *RoSnapshots) Types() []snaptype.Type { return s.types }
 func (s *RoSnapshots) HasType(in snaptype.Type) bool {
 	for _, t := range s.types {
@@ -398,10 +785,13 @@ func (s *RoSnapshots) idxAvailability() uint64 {
 			return true
 		}
 
-		for _, seg := range value.segments {
+		for j, seg := range value.segments {
 			if !seg.IsIndexed() {
 				break
 			}
+			if j > 0 && seg.from > value.segments[j-1].to { // gap: for example empty segment was skipped
+				break
+			}
 
 			maximums[i] = seg.to - 1
 		}
@@ -466,6 +856,32 @@ func (s *RoSnapshots) OpenFiles() (list []string) {
 	return list
 }
 
+// VerifyOpenFilesUnchanged - stat of all open .seg files: returns names of files whose (size, mtime, inode) changed since open.
+// Such segments are poisoned: reads from them return *ErrSegmentModified until reopen. Cheap - can be called periodically
+func (s *RoSnapshots) VerifyOpenFilesUnchanged() (changed []string) {
+	s.segments.Scan(func(segtype snaptype.Enum, value *segments) bool {
+		value.lock.RLock()
+		defer value.lock.RUnlock()
+
+		for _, sn := range value.segments {
+			if sn.verifyUnchanged() {
+				changed = append(changed, sn.FileName())
+			}
+		}
+		return true
+	})
+	slices.Sort(changed)
+	return changed
+}
+
+// SetVerifyOpenFilesInterval - reads from segment do VerifyOpenFilesUnchanged-check of it if last check was more than `interval` ago. 0 - disabled
+func (s *RoSnapshots) SetVerifyOpenFilesInterval(interval time.Duration) {
+	s.verifyInterval.Store(int64(interval))
+}
+
+// OpenFilesCount - amount of .seg and .idx files kept open. For whole process see dir.OpenFilesCount
+func (s *RoSnapshots) OpenFilesCount() int { return len(s.OpenFiles()) }
+
 // ReopenList stops on optimistic=false, continue opening files on optimistic=true
 func (s *RoSnapshots) ReopenList(fileNames []string, optimistic bool) error {
 	if err := s.rebuildSegments(fileNames, true, optimistic); err != nil {
@@ -496,12 +912,18 @@ func (s *RoSnapshots) unlockSegments() {
 }
 
 func (s *RoSnapshots) rebuildSegments(fileNames []string, open bool, optimistic bool) error {
+	defer s.notifyAvailability(s.idxMax.Load()) // runs after unlockSegments
 	s.lockSegments()
 	defer s.unlockSegments()
+	defer s.generation.Add(1) // under lock: View sees generation consistent with segments
 
 	s.closeWhatNotInList(fileNames)
 	var segmentsMax uint64
 	var segmentsMaxSet bool
+	var ignored int
+	defer func() { s.logIgnored(ignored) }()
+	var empty []string
+	var emptyFrom uint64 = math.MaxUint64
 
 	for _, fName := range fileNames {
 		f, isState, ok := snaptype.ParseFileName(s.dir, fName)
@@ -509,6 +931,9 @@ func (s *RoSnapshots) rebuildSegments(fileNames []string, open bool, optimistic
 			continue
 		}
 		if !s.HasType(f.Type) {
+			if s.isIgnoredType(f.Type) {
+				ignored++
+			}
 			continue
 		}
 
@@ -534,11 +959,19 @@ func (s *RoSnapshots) rebuildSegments(fileNames []string, open bool, optimistic
 		}
 
 		if !exists {
-			sn = &Segment{segType: f.Type, version: f.Version, Range: Range{f.From, f.To}}
+			sn = newSegment(s.dir, f.Type, f.Version, f.From, f.To)
+			sn.verifyInterval = &s.verifyInterval
 		}
 
 		if open {
 			if err := sn.reopenSeg(s.dir); err != nil {
+				var emptyErr *ErrEmptySegment
+				if errors.As(err, &emptyErr) {
+					s.handleEmptySegment(emptyErr)
+					empty = append(empty, fName)
+					emptyFrom = min(emptyFrom, f.From)
+					continue
+				}
 				if errors.Is(err, os.ErrNotExist) {
 					if optimistic {
 						continue
@@ -574,9 +1007,13 @@ func (s *RoSnapshots) rebuildSegments(fileNames []string, open bool, optimistic
 		segmentsMaxSet = true
 	}
 
+	if segmentsMaxSet && emptyFrom <= segmentsMax { // range of empty segment is not available
+		segmentsMax = max(emptyFrom, 1) - 1
+	}
 	if segmentsMaxSet {
 		s.segmentsMax.Store(segmentsMax)
 	}
+	s.emptySegments.Store(&empty)
 	s.segmentsReady.Store(true)
 	s.idxMax.Store(s.idxAvailability())
 	s.indicesReady.Store(true)
@@ -605,6 +1042,13 @@ func (s *RoSnapshots) ReopenSegments(types []snaptype.Type, allowGaps bool) erro
 	if err != nil {
 		return err
 	}
+	if len(s.ignoredTypes) > 0 {
+		ignored, _, err := typedSegments(s.dir, s.segmentsMin.Load(), s.ignoredTypes, true)
+		if err != nil {
+			return err
+		}
+		s.logIgnored(len(ignored))
+	}
 	list := make([]string, 0, len(files))
 	for _, f := range files {
 		_, fName := filepath.Split(f.Path)
@@ -619,6 +1063,13 @@ func (s *RoSnapshots) ReopenWithDB(db kv.RoDB) error {
 		if err != nil {
 			return err
 		}
+		checksums, err := rawdb.ReadSnapshotsChecksums(tx)
+		if err != nil {
+			return err
+		}
+		if err := s.verifyChecksums(snList, checksums, s.cfg.VerifyChecksumsStrict); err != nil {
+			return err
+		}
 		return s.ReopenList(snList, true)
 	}); err != nil {
 		return fmt.Errorf("ReopenWithDB: %w", err)
@@ -642,7 +1093,7 @@ func (s *RoSnapshots) closeWhatNotInList(l []string) {
 			if sn.Decompressor == nil {
 				continue Segments
 			}
-			_, name := filepath.Split(sn.FilePath())
+			name := sn.FileName()
 			for _, fName := range l {
 				if fName == name {
 					continue Segments
@@ -687,7 +1138,7 @@ func (s *RoSnapshots) removeOverlapsAfterMerge() error {
 			filesToRemove = append(filesToRemove, info.Path)
 		}
 
-		removeOldFiles(filesToRemove, s.dir)
+		removeOldFiles(s.withoutPinned(filesToRemove), s.dir)
 	}
 
 	return nil
@@ -736,7 +1187,7 @@ func (s *RoSnapshots) delete(fileName string) error {
 			if sn.Decompressor == nil {
 				continue
 			}
-			if sn.segType.FileName(sn.version, sn.from, sn.to) != fName {
+			if sn.FileName() != fName {
 				continue
 			}
 			files := sn.openFiles()
@@ -817,7 +1268,7 @@ func (s *RoSnapshots) buildMissedIndices(logPrefix string, ctx context.Context,
 				ps.Add(p)
 				defer notifySegmentIndexingFinished(info.Name())
 				defer ps.Delete(p)
-				if err := segtype.BuildIndexes(gCtx, info, chainConfig, tmpDir, p, log.LvlInfo, logger); err != nil {
+				if err := buildIndexes(gCtx, info, chainConfig, tmpDir, s.cfg.TxnHashIdxShards, p, log.LvlInfo, logger); err != nil {
 					// unsuccessful indexing should allow other indexing to finish
 					fmu.Lock()
 					failedIndexes[info.Name()] = err
@@ -905,6 +1356,9 @@ func (s *RoSnapshots) AddSnapshotsToSilkworm(silkwormInstance *silkworm.Silkworm
 	if txs, ok := s.segments.Get(coresnaptype.Enums.Transactions); ok {
 		err := txs.View(func(segments []*Segment) error {
 			for _, txnSegment := range segments {
+				if len(txnSegment.shards) > 0 {
+					return fmt.Errorf("addSnapshots: silkworm doesn't support sharded txn-hash indices: %s", txnSegment.FileName())
+				}
 				mappedTxnSnapshots = append(mappedTxnSnapshots, txnSegment.mappedTxnSnapshot())
 			}
 			return nil
@@ -933,15 +1387,24 @@ func (s *RoSnapshots) AddSnapshotsToSilkworm(silkwormInstance *silkworm.Silkworm
 	return nil
 }
 
-func buildIdx(ctx context.Context, sn snaptype.FileInfo, chainConfig *chain.Config, tmpDir string, p *background.Progress, lvl log.Lvl, logger log.Logger) error {
+func buildIdx(ctx context.Context, sn snaptype.FileInfo, chainConfig *chain.Config, tmpDir string, txnHashIdxShards int, p *background.Progress, lvl log.Lvl, logger log.Logger) error {
 	//log.Info("[snapshots] build idx", "file", sn.Name())
-	if err := sn.Type.BuildIndexes(ctx, sn, chainConfig, tmpDir, p, lvl, logger); err != nil {
+	if err := buildIndexes(ctx, sn, chainConfig, tmpDir, txnHashIdxShards, p, lvl, logger); err != nil {
 		return fmt.Errorf("buildIdx: %s: %s", sn.Type, err)
 	}
 	//log.Info("[snapshots] finish build idx", "file", fName)
 	return nil
 }
 
+// buildIndexes - same as sn.Type.BuildIndexes, but txn-hash indices of transactions segments are built as
+// `txnHashIdxShards` shards if > 1, see BlocksFreezing.TxnHashIdxShards
+func buildIndexes(ctx context.Context, sn snaptype.FileInfo, chainConfig *chain.Config, tmpDir string, txnHashIdxShards int, p *background.Progress, lvl log.Lvl, logger log.Logger) error {
+	if txnHashIdxShards > 1 && sn.Type.Enum() == coresnaptype.Enums.Transactions {
+		return coresnaptype.BuildTxnHashIdxShards(ctx, sn, txnHashIdxShards, chainConfig, tmpDir, p, logger)
+	}
+	return sn.Type.BuildIndexes(ctx, sn, chainConfig, tmpDir, p, lvl, logger)
+}
+
 func notifySegmentIndexingFinished(name string) {
 	diagnostics.Send(
 		diagnostics.SnapshotSegmentIndexingFinishedUpdate{
@@ -1007,33 +1470,64 @@ MainLoop:
 	return res
 }
 
-// noOverlaps - keep largest ranges and avoid overlap
+var (
+	mxNoOverlapsPass   = metrics.GetOrCreateSummary(`snapshots_overlaps_pass{func="noOverlaps"}`)
+	mxFindOverlapsPass = metrics.GetOrCreateSummary(`snapshots_overlaps_pass{func="findOverlaps"}`)
+)
+
+// overlapsSlowPass - noOverlaps/findOverlaps are linear: even dirs with tens of thousands of leftover files must pass
+// in milliseconds. Longer pass is logged - to make regressions visible
+const overlapsSlowPass = 100 * time.Millisecond
+
+func observeOverlapsPass(mx metrics.Summary, funcName string, files int, start time.Time) {
+	mx.ObserveDuration(start)
+	if took := time.Since(start); took > overlapsSlowPass {
+		log.Warn("[snapshots] slow pass over files", "func", funcName, "files", files, "took", took)
+	}
+}
+
+// noOverlaps - keep largest ranges and avoid overlap. `in` is sorted by (from, to) - as snaptype.Segments returns:
+// of run of files with same `from` the last (largest) one is selected, file covered by already selected one is skipped.
+// Single pass on any order of `in` (for example on boundary of versions): each file is visited twice at most
 func noOverlaps(in []snaptype.FileInfo) (res []snaptype.FileInfo) {
-	for i := range in {
-		f := in[i]
-		if f.From == f.To {
+	defer observeOverlapsPass(mxNoOverlapsPass, "noOverlaps", len(in), time.Now())
+	for i := 0; i < len(in); {
+		if in[i].From == in[i].To {
+			i++
 			continue
 		}
 
-		for j := i + 1; j < len(in); j++ { // if there is file with larger range - use it instead
-			f2 := in[j]
-			if f2.From == f2.To {
+		// run [i, j): each next non-empty file starts not after previous one - use the last (largest) one instead
+		last, j := i, i+1
+		for ; j < len(in); j++ {
+			if in[j].From == in[j].To {
 				continue
 			}
-			if f2.From > f.From {
+			if in[j].From > in[last].From {
 				break
 			}
-			f = f2
-			i++
+			last = j
 		}
 
-		res = append(res, f)
+		for ; i < j; i++ {
+			f := in[i]
+			if f.From == f.To {
+				continue
+			}
+			if len(res) > 0 && res[len(res)-1].To >= f.To { // covered by already selected larger file (for example pinned)
+				continue
+			}
+			res = append(res, in[last])
+		}
 	}
 
 	return res
 }
 
+// findOverlaps - splits `in` to files to keep and files covered by other files (or empty). Linear: inner loop
+// advances `i` - each file is visited once
 func findOverlaps(in []snaptype.FileInfo) (res []snaptype.FileInfo, overlapped []snaptype.FileInfo) {
+	defer observeOverlapsPass(mxFindOverlapsPass, "findOverlaps", len(in), time.Now())
 	for i := 0; i < len(in); i++ {
 		f := in[i]
 
@@ -1063,7 +1557,7 @@ func findOverlaps(in []snaptype.FileInfo) (res []snaptype.FileInfo, overlapped [
 				continue
 			}
 
-			if i < len(in)-1 && (f2.To >= f.To && f2.From <= f.From) {
+			if f2.To >= f.To && f2.From <= f.From {
 				overlapped = append(overlapped, f)
 			}
 
@@ -1176,9 +1670,10 @@ type BlockRetire struct {
 	maxScheduledBlock     atomic.Uint64
 	working               atomic.Bool
 	needSaveFilesListInDB atomic.Bool
+	acks                  frozenAcks
 
-	// shared semaphore with AggregatorV3 to allow only one type of snapshot building at a time
-	snBuildAllowed *semaphore.Weighted
+	// slots of semaphore shared with AggregatorV3 to limit snapshot building at a time. Fair: acquired per unit of work
+	coord *snapbuild.Coordinator
 
 	workers int
 	tmpDir  string
@@ -1190,6 +1685,8 @@ type BlockRetire struct {
 	blockWriter *blockio.BlockWriter
 	dirs        datadir.Dirs
 	chainConfig *chain.Config
+	fsync       dir2.FsyncPolicy
+	provenance  Provenance
 }
 
 func NewBlockRetire(
@@ -1204,22 +1701,28 @@ func NewBlockRetire(
 	logger log.Logger,
 ) *BlockRetire {
 	return &BlockRetire{
-		workers:        compressWorkers,
-		tmpDir:         dirs.Tmp,
-		dirs:           dirs,
-		blockReader:    blockReader,
-		blockWriter:    blockWriter,
-		db:             db,
-		snBuildAllowed: snBuildAllowed,
-		chainConfig:    chainConfig,
-		notifier:       notifier,
-		logger:         logger,
+		workers:     compressWorkers,
+		tmpDir:      dirs.Tmp,
+		dirs:        dirs,
+		blockReader: blockReader,
+		blockWriter: blockWriter,
+		db:          db,
+		coord:       snapbuild.Shared(snBuildAllowed),
+		chainConfig: chainConfig,
+		notifier:    notifier,
+		logger:      logger,
 	}
 }
 
 func (br *BlockRetire) SetWorkers(workers int) { br.workers = workers }
 func (br *BlockRetire) GetWorkers() int        { return br.workers }
 
+// SetFsyncPolicy - applied to dumped and merged segments. See dir2.FsyncPolicy
+func (br *BlockRetire) SetFsyncPolicy(p dir2.FsyncPolicy) { br.fsync = p }
+
+// SetProvenance - recorded into `.meta` sidecar of dumped and merged segments
+func (br *BlockRetire) SetProvenance(p Provenance) { br.provenance = p }
+
 func (br *BlockRetire) IO() (services.FullBlockReader, *blockio.BlockWriter) {
 	return br.blockReader, br.blockWriter
 }
@@ -1236,13 +1739,24 @@ func (br *BlockRetire) HasNewFrozenFiles() bool {
 	return br.needSaveFilesListInDB.CompareAndSwap(true, false)
 }
 
+const retireKeepBlocks uint64 = 1024 //TODO: we will increase it to params.FullImmutabilityThreshold after some db optimizations
+
 func CanRetire(curBlockNum uint64, blocksInSnapshots uint64, snapType snaptype.Enum, chainConfig *chain.Config) (blockFrom, blockTo uint64, can bool) {
-	var keep uint64 = 1024 //TODO: we will increase it to params.FullImmutabilityThreshold after some db optimizations
-	if curBlockNum <= keep {
+	if curBlockNum <= retireKeepBlocks {
 		return
 	}
 	blockFrom = blocksInSnapshots + 1
-	return canRetire(blockFrom, curBlockNum-keep, snapType, chainConfig)
+	return canRetire(blockFrom, curBlockNum-retireKeepBlocks, snapType, chainConfig)
+}
+
+// CanRetireBor - same as CanRetire, but range never gets ahead of blocks which are already in indexed block segments:
+// span-id lookups of bor range need blocks of this range. If bor is behind blocks - it catches up.
+func CanRetireBor(curBlockNum uint64, borBlocksInSnapshots uint64, blocksInSnapshots uint64, snapType snaptype.Enum, chainConfig *chain.Config) (blockFrom, blockTo uint64, can bool) {
+	if curBlockNum <= retireKeepBlocks {
+		return
+	}
+	blockFrom = borBlocksInSnapshots + 1
+	return canRetire(blockFrom, min(curBlockNum-retireKeepBlocks, blocksInSnapshots+1), snapType, chainConfig)
 }
 
 func canRetire(from, to uint64, snapType snaptype.Enum, chainConfig *chain.Config) (blockFrom, blockTo uint64, can bool) {
@@ -1329,11 +1843,22 @@ func (br *BlockRetire) retireBlocks(ctx context.Context, minBlockNum uint64, max
 	default:
 	}
 
-	notifier, logger, blockReader, tmpDir, db, workers := br.notifier, br.logger, br.blockReader, br.tmpDir, br.db, br.workers
+	logger, blockReader, tmpDir, db, workers := br.logger, br.blockReader, br.tmpDir, br.db, br.workers
 	snapshots := br.snapshots()
 
 	blockFrom, blockTo, ok := CanRetire(maxBlockNum, minBlockNum, snaptype.Unknown, br.chainConfig)
 
+	progress, err := br.readRetireProgress(ctx)
+	if err != nil {
+		return false, err
+	}
+	// restart after merge, but before its files were announced
+	if progress.Merged != progress.Notified {
+		if err := br.seedOnce(ctx, &progress, Range{from: progress.Merged.From, to: progress.Merged.To}, seedNewSnapshots); err != nil {
+			return false, err
+		}
+	}
+
 	if ok {
 		if has, err := br.dbHasEnoughDataForBlocksRetire(ctx); err != nil {
 			return false, err
@@ -1342,41 +1867,39 @@ func (br *BlockRetire) retireBlocks(ctx context.Context, minBlockNum uint64, max
 		}
 		logger.Log(lvl, "[snapshots] Retire Blocks", "range", fmt.Sprintf("%dk-%dk", blockFrom/1000, blockTo/1000))
 		// in future we will do it in background
-		if err := DumpBlocks(ctx, blockFrom, blockTo, br.chainConfig, tmpDir, snapshots.Dir(), db, workers, lvl, logger, blockReader); err != nil {
+		dumps := &retireDumps{br: br, ctx: ctx, progress: &progress}
+		if err := dumpBlocks(ctx, blockFrom, blockTo, br.chainConfig, tmpDir, snapshots.Dir(), db, workers, lvl, logger, blockReader, br.fsync, br.provenance, snapshots.cfg.TxnHashIdxShards, dumps); err != nil {
 			return ok, fmt.Errorf("DumpBlocks: %w", err)
 		}
 
-		if err := snapshots.ReopenFolder(); err != nil {
+		if err := br.reopenAndNotify(snapshots.ReopenFolder); err != nil {
 			return ok, fmt.Errorf("reopen: %w", err)
 		}
-		snapshots.LogStat("blocks:retire")
-		if notifier != nil && !reflect.ValueOf(notifier).IsNil() { // notify about new snapshots of any size
-			notifier.OnNewSnapshot()
+		if err := br.recordChecksums(ctx); err != nil {
+			return ok, err
 		}
+		snapshots.LogStat("blocks:retire")
 	}
 
 	merger := NewMerger(tmpDir, workers, lvl, db, br.chainConfig, logger)
+	merger.SetFsyncPolicy(br.fsync)
+	merger.SetProvenance(br.provenance)
 	rangesToMerge := merger.FindMergeRanges(snapshots.Ranges(), snapshots.BlocksAvailable())
 	if len(rangesToMerge) == 0 {
-		return ok, nil
+		return ok, br.clearRetireProgress(ctx, progress)
 	}
 	ok = true // have something to merge
 	onMerge := func(r Range) error {
-		if notifier != nil && !reflect.ValueOf(notifier).IsNil() { // notify about new snapshots of any size
-			notifier.OnNewSnapshot()
-		}
-
+		br.notifyNewSnapshot(nil)
 		if seedNewSnapshots != nil {
-			downloadRequest := []services.DownloadRequest{
-				services.NewDownloadRequest("", ""),
-			}
-			if err := seedNewSnapshots(downloadRequest); err != nil {
+			progress.Merged = rawdb.RetireRange{From: r.from, To: r.to}
+			if err := br.writeRetireProgress(ctx, progress); err != nil {
 				return err
 			}
 		}
-		return nil
+		return br.seedOnce(ctx, &progress, r, seedNewSnapshots)
 	}
-	err := merger.Merge(ctx, snapshots, snapshots.Types(), rangesToMerge, snapshots.Dir(), true /* doIndex */, onMerge, onDelete)
+	err = merger.Merge(ctx, snapshots, snapshots.Types(), rangesToMerge, snapshots.Dir(), true /* doIndex */, onMerge, onDelete)
 	if err != nil {
 		return ok, err
 	}
@@ -1385,7 +1908,108 @@ func (br *BlockRetire) retireBlocks(ctx context.Context, minBlockNum uint64, max
 	if err := snapshots.removeOverlapsAfterMerge(); err != nil {
 		return false, err
 	}
-	return ok, nil
+	if err := br.recordChecksums(ctx); err != nil {
+		return ok, err
+	}
+	return ok, br.clearRetireProgress(ctx, progress)
+}
+
+// recordChecksums - checksums of retired and merged files. List of files is recorded later (by SnapshotsPrune), but files
+// may be reopened from DB before it
+func (br *BlockRetire) recordChecksums(ctx context.Context) error {
+	rwDB, ok := br.db.(kv.RwDB)
+	if !ok {
+		return nil
+	}
+	if err := rwDB.Update(ctx, func(tx kv.RwTx) error {
+		return writeBlockFilesChecksums(tx, br.snapshots().Dir(), br.blockReader.FrozenFiles())
+	}); err != nil {
+		return fmt.Errorf("record checksums: %w", err)
+	}
+	return nil
+}
+
+// readRetireProgress - progress of retire cycle interrupted by restart. Not persisted if there is no blockWriter or db is read-only
+func (br *BlockRetire) readRetireProgress(ctx context.Context) (progress rawdb.RetireProgress, err error) {
+	if br.blockWriter == nil {
+		return progress, nil
+	}
+	err = br.db.View(ctx, func(tx kv.Tx) error {
+		progress, err = br.blockWriter.ReadRetireProgress(tx)
+		return err
+	})
+	return progress, err
+}
+
+func (br *BlockRetire) writeRetireProgress(ctx context.Context, progress rawdb.RetireProgress) error {
+	rwDB, ok := br.db.(kv.RwDB)
+	if br.blockWriter == nil || !ok {
+		return nil
+	}
+	return rwDB.Update(ctx, func(tx kv.RwTx) error {
+		return br.blockWriter.WriteRetireProgress(tx, progress)
+	})
+}
+
+// clearRetireProgress - retire cycle finished, nothing to skip after restart
+func (br *BlockRetire) clearRetireProgress(ctx context.Context, progress rawdb.RetireProgress) error {
+	if progress.Empty() {
+		return nil
+	}
+	return br.writeRetireProgress(ctx, rawdb.RetireProgress{})
+}
+
+// retireDumps - segments dumped by retire cycle: after restart they are not dumped again (see rawdb.RetireProgress).
+// nil - nothing is tracked
+type retireDumps struct {
+	br       *BlockRetire
+	ctx      context.Context
+	progress *rawdb.RetireProgress
+}
+
+// dumped - segment and all its indices were built by interrupted retire cycle. lastKey - returned by dump of segment
+func (d *retireDumps) dumped(f snaptype.FileInfo) (lastKey uint64, ok bool) {
+	if d == nil {
+		return 0, false
+	}
+	r, ok := d.progress.Dumped[f.Type.Name()]
+	if !ok || r.From != f.From || r.To != f.To {
+		return 0, false
+	}
+	if !f.Type.HasIndexFiles(f, d.br.logger) { // opens segment too
+		return 0, false
+	}
+	return r.LastKey, true
+}
+
+func (d *retireDumps) markDumped(f snaptype.FileInfo, lastKey uint64) error {
+	if d == nil {
+		return nil
+	}
+	if d.progress.Dumped == nil {
+		d.progress.Dumped = map[string]rawdb.RetireRange{}
+	}
+	d.progress.Dumped[f.Type.Name()] = rawdb.RetireRange{From: f.From, To: f.To, LastKey: lastKey}
+	return d.br.writeRetireProgress(d.ctx, *d.progress)
+}
+
+// seedOnce - calls seedNewSnapshots for merged range `r`, unless it was already called for `r` before restart
+func (br *BlockRetire) seedOnce(ctx context.Context, progress *rawdb.RetireProgress, r Range, seedNewSnapshots func(downloadRequest []services.DownloadRequest) error) error {
+	if seedNewSnapshots == nil {
+		return nil
+	}
+	notified := rawdb.RetireRange{From: r.from, To: r.to}
+	if progress.Notified == notified {
+		return nil
+	}
+	downloadRequest := []services.DownloadRequest{
+		services.NewDownloadRequest("", ""),
+	}
+	if err := seedNewSnapshots(downloadRequest); err != nil {
+		return err
+	}
+	progress.Notified = notified
+	return br.writeRetireProgress(ctx, *progress)
 }
 
 var ErrNothingToPrune = errors.New("nothing to prune")
@@ -1399,7 +2023,8 @@ func (br *BlockRetire) PruneAncientBlocks(tx kv.RwTx, limit int) (deleted int, e
 		return deleted, err
 	}
 
-	if canDeleteTo := CanDeleteTo(currentProgress, br.blockReader.FrozenBlocks()); canDeleteTo > 0 {
+	frozen, frozenBor := br.frozenToPrune()
+	if canDeleteTo := CanDeleteTo(currentProgress, frozen); canDeleteTo > 0 {
 		br.logger.Debug("[snapshots] Prune Blocks", "to", canDeleteTo, "limit", limit)
 		deletedBlocks, err := br.blockWriter.PruneBlocks(context.Background(), tx, canDeleteTo, limit)
 		if err != nil {
@@ -1409,7 +2034,7 @@ func (br *BlockRetire) PruneAncientBlocks(tx kv.RwTx, limit int) (deleted int, e
 	}
 
 	if br.chainConfig.Bor != nil {
-		if canDeleteTo := CanDeleteTo(currentProgress, br.blockReader.FrozenBorBlocks()); canDeleteTo > 0 {
+		if canDeleteTo := CanDeleteTo(currentProgress, frozenBor); canDeleteTo > 0 {
 			br.logger.Debug("[snapshots] Prune Bor Blocks", "to", canDeleteTo, "limit", limit)
 			deletedBorBlocks, err := br.blockWriter.PruneBorBlocks(context.Background(), tx, canDeleteTo, limit,
 				func(block uint64) uint64 { return uint64(heimdall.SpanIdAt(block)) })
@@ -1424,6 +2049,39 @@ func (br *BlockRetire) PruneAncientBlocks(tx kv.RwTx, limit int) (deleted int, e
 	return deleted, nil
 }
 
+// PruneBacklog - amount of blocks which are already in snapshots but still in DB. 0 - nothing to prune.
+func (br *BlockRetire) PruneBacklog(tx kv.Tx) (blocks uint64, err error) {
+	if br.blockReader.FreezingCfg().KeepBlocks {
+		return 0, nil
+	}
+	currentProgress, err := stages.GetStageProgress(tx, stages.Senders)
+	if err != nil {
+		return 0, err
+	}
+	frozen, _ := br.frozenToPrune()
+	canDeleteTo := CanDeleteTo(currentProgress, frozen)
+	if canDeleteTo == 0 {
+		return 0, nil
+	}
+	c, err := tx.Cursor(kv.Headers)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	firstK, _, err := c.Seek(hexutility.EncodeTs(1)) // genesis is never pruned
+	if err != nil {
+		return 0, err
+	}
+	if firstK == nil {
+		return 0, nil
+	}
+	blockFrom := binary.BigEndian.Uint64(firstK)
+	if blockFrom >= canDeleteTo {
+		return 0, nil
+	}
+	return canDeleteTo - blockFrom, nil
+}
+
 func (br *BlockRetire) RetireBlocksInBackground(ctx context.Context, minBlockNum, maxBlockNum uint64, lvl log.Lvl, seedNewSnapshots func(downloadRequest []services.DownloadRequest) error, onDeleteSnapshots func(l []string) error, onFinishRetire func() error) {
 	if maxBlockNum > br.maxScheduledBlock.Load() {
 		br.maxScheduledBlock.Store(maxBlockNum)
@@ -1436,15 +2094,6 @@ func (br *BlockRetire) RetireBlocksInBackground(ctx context.Context, minBlockNum
 	go func() {
 		defer br.working.Store(false)
 
-		if br.snBuildAllowed != nil {
-			//we are inside own goroutine - it's fine to block here
-			if err := br.snBuildAllowed.Acquire(ctx, 1); err != nil {
-				br.logger.Warn("[snapshots] retire blocks", "err", err)
-				return
-			}
-			defer br.snBuildAllowed.Release(1)
-		}
-
 		err := br.RetireBlocks(ctx, minBlockNum, maxBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots, onFinishRetire)
 		if err != nil {
 			br.logger.Warn("[snapshots] retire blocks", "err", err)
@@ -1459,33 +2108,68 @@ func (br *BlockRetire) RetireBlocks(ctx context.Context, minBlockNum uint64, max
 	}
 	includeBor := br.chainConfig.Bor != nil
 
-	if err := br.BuildMissedIndicesIfNeed(ctx, "RetireBlocks", br.notifier, br.chainConfig); err != nil {
+	// slot per unit of work: state files build and merge get their turn between them
+	if err := br.acquireSlot(ctx); err != nil {
+		return err
+	}
+	err := br.BuildMissedIndicesIfNeed(ctx, "RetireBlocks", br.notifier, br.chainConfig)
+	br.coord.Release(snapbuild.BlockRetire)
+	if err != nil {
 		return err
 	}
 
-	var err error
+	retire := func(minBlockNum, maxBlockNum uint64) (bool, error) {
+		if err := br.acquireSlot(ctx); err != nil {
+			return false, err
+		}
+		defer br.coord.Release(snapbuild.BlockRetire)
+		return br.retireBlocks(ctx, minBlockNum, maxBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots)
+	}
+	var retireBor func(minBlockNum, maxBlockNum uint64) (bool, error)
+	if includeBor {
+		retireBor = func(minBlockNum, maxBlockNum uint64) (bool, error) {
+			if err := br.acquireSlot(ctx); err != nil {
+				return false, err
+			}
+			defer br.coord.Release(snapbuild.BlockRetire)
+			return br.retireBorBlocks(ctx, minBlockNum, maxBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots)
+		}
+	}
+	return retireLoop(br.blockReader, minBlockNum, br.maxScheduledBlock.Load, retire, retireBor, onFinish)
+}
+
+// acquireSlot - slot of snapshot building for one unit of work, caller must Release it
+func (br *BlockRetire) acquireSlot(ctx context.Context) error {
+	if current := br.coord.Current(); current != "" {
+		br.logger.Debug("[snapshots] retire blocks waiting for slot", "current", current)
+	}
+	if err := br.coord.Acquire(ctx, snapbuild.BlockRetire); err != nil {
+		return fmt.Errorf("retire blocks: waiting for slot: %w", err)
+	}
+	return nil
+}
+
+// retireLoop - retires blocks, then bor (if retireBor != nil), until nothing left.
+// Bor goes after blocks: bor range is retired only when block segments of this range exist (see CanRetireBor).
+// "bor snaps" can be behind "block snaps", it's ok: for example because of `kill -9` in the middle of merge - then bor catches up.
+func retireLoop(frozen interface {
+	FrozenBlocks() uint64
+	FrozenBorBlocks() uint64
+}, minBlockNum uint64, maxScheduledBlock func() uint64, retire, retireBor func(minBlockNum, maxBlockNum uint64) (bool, error), onFinish func() error) error {
 	for {
 		var ok, okBor bool
+		var err error
 
-		minBlockNum = max(br.blockReader.FrozenBlocks(), minBlockNum)
-		maxBlockNum = br.maxScheduledBlock.Load()
-
-		if includeBor {
-			// "bor snaps" can be behind "block snaps", it's ok: for example because of `kill -9` in the middle of merge
-			okBor, err = br.retireBorBlocks(ctx, br.blockReader.FrozenBorBlocks(), minBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots)
-			if err != nil {
-				return err
-			}
-		}
+		minBlockNum = max(frozen.FrozenBlocks(), minBlockNum)
+		maxBlockNum := maxScheduledBlock()
 
-		ok, err = br.retireBlocks(ctx, minBlockNum, maxBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots)
+		ok, err = retire(minBlockNum, maxBlockNum)
 		if err != nil {
 			return err
 		}
 
-		if includeBor {
-			minBorBlockNum := max(br.blockReader.FrozenBorBlocks(), minBlockNum)
-			okBor, err = br.retireBorBlocks(ctx, minBorBlockNum, maxBlockNum, lvl, seedNewSnapshots, onDeleteSnapshots)
+		if retireBor != nil {
+			okBor, err = retireBor(frozen.FrozenBorBlocks(), maxBlockNum)
 			if err != nil {
 				return err
 			}
@@ -1517,10 +2201,15 @@ func (br *BlockRetire) BuildMissedIndicesIfNeed(ctx context.Context, logPrefix s
 	return nil
 }
 
-func DumpBlocks(ctx context.Context, blockFrom, blockTo uint64, chainConfig *chain.Config, tmpDir, snapDir string, chainDB kv.RoDB, workers int, lvl log.Lvl, logger log.Logger, blockReader services.FullBlockReader) error {
+// DumpBlocks - txnHashIdxShards: see BlocksFreezing.TxnHashIdxShards
+func DumpBlocks(ctx context.Context, blockFrom, blockTo uint64, chainConfig *chain.Config, tmpDir, snapDir string, chainDB kv.RoDB, workers int, lvl log.Lvl, logger log.Logger, blockReader services.FullBlockReader, fsync dir2.FsyncPolicy, prov Provenance, txnHashIdxShards int) error {
+	return dumpBlocks(ctx, blockFrom, blockTo, chainConfig, tmpDir, snapDir, chainDB, workers, lvl, logger, blockReader, fsync, prov, txnHashIdxShards, nil)
+}
+
+func dumpBlocks(ctx context.Context, blockFrom, blockTo uint64, chainConfig *chain.Config, tmpDir, snapDir string, chainDB kv.RoDB, workers int, lvl log.Lvl, logger log.Logger, blockReader services.FullBlockReader, fsync dir2.FsyncPolicy, prov Provenance, txnHashIdxShards int, dumps *retireDumps) error {
 	firstTxNum := blockReader.FirstTxnNumNotInSnapshots()
 	for i := blockFrom; i < blockTo; i = chooseSegmentEnd(i, blockTo, coresnaptype.Enums.Headers, chainConfig) {
-		lastTxNum, err := dumpBlocksRange(ctx, i, chooseSegmentEnd(i, blockTo, coresnaptype.Enums.Headers, chainConfig), tmpDir, snapDir, firstTxNum, chainDB, chainConfig, workers, lvl, logger)
+		lastTxNum, err := dumpBlocksRange(ctx, i, chooseSegmentEnd(i, blockTo, coresnaptype.Enums.Headers, chainConfig), tmpDir, snapDir, firstTxNum, chainDB, chainConfig, workers, lvl, logger, fsync, prov, txnHashIdxShards, dumps)
 		if err != nil {
 			return err
 		}
@@ -1529,22 +2218,34 @@ func DumpBlocks(ctx context.Context, blockFrom, blockTo uint64, chainConfig *cha
 	return nil
 }
 
-func dumpBlocksRange(ctx context.Context, blockFrom, blockTo uint64, tmpDir, snapDir string, firstTxNum uint64, chainDB kv.RoDB, chainConfig *chain.Config, workers int, lvl log.Lvl, logger log.Logger) (lastTxNum uint64, err error) {
+func dumpBlocksRange(ctx context.Context, blockFrom, blockTo uint64, tmpDir, snapDir string, firstTxNum uint64, chainDB kv.RoDB, chainConfig *chain.Config, workers int, lvl log.Lvl, logger log.Logger, fsync dir2.FsyncPolicy, prov Provenance, txnHashIdxShards int, dumps *retireDumps) (lastTxNum uint64, err error) {
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
 
-	if _, err = dumpRange(ctx, coresnaptype.Headers.FileInfo(snapDir, blockFrom, blockTo),
-		DumpHeaders, nil, chainDB, chainConfig, tmpDir, workers, lvl, logger); err != nil {
+	dump := func(f snaptype.FileInfo, dumper dumpFunc, firstKey firstKeyGetter) (uint64, error) {
+		if lastKey, ok := dumps.dumped(f); ok {
+			logger.Debug("[snapshots] segment is already dumped before restart", "file", f.Name())
+			return lastKey, nil
+		}
+		lastKey, err := dumpRange(ctx, f, dumper, firstKey, chainDB, chainConfig, tmpDir, workers, lvl, logger, fsync, prov, txnHashIdxShards)
+		if err != nil {
+			return lastKey, err
+		}
+		return lastKey, dumps.markDumped(f, lastKey)
+	}
+
+	if _, err = dump(coresnaptype.Headers.FileInfo(snapDir, blockFrom, blockTo), DumpHeaders, nil); err != nil {
 		return 0, err
 	}
 
-	if lastTxNum, err = dumpRange(ctx, coresnaptype.Bodies.FileInfo(snapDir, blockFrom, blockTo),
-		DumpBodies, func(context.Context) uint64 { return firstTxNum }, chainDB, chainConfig, tmpDir, workers, lvl, logger); err != nil {
+	// DumpBodies is strict: missing body aborts retire instead of publishing segment with a gap
+	if lastTxNum, err = dump(coresnaptype.Bodies.FileInfo(snapDir, blockFrom, blockTo),
+		DumpBodies, func(context.Context) uint64 { return firstTxNum }); err != nil {
 		return lastTxNum, err
 	}
 
-	if _, err = dumpRange(ctx, coresnaptype.Transactions.FileInfo(snapDir, blockFrom, blockTo),
-		DumpTxs, func(context.Context) uint64 { return firstTxNum }, chainDB, chainConfig, tmpDir, workers, lvl, logger); err != nil {
+	if _, err = dump(coresnaptype.Transactions.FileInfo(snapDir, blockFrom, blockTo),
+		DumpTxs, func(context.Context) uint64 { return firstTxNum }); err != nil {
 		return lastTxNum, err
 	}
 
@@ -1554,7 +2255,7 @@ func dumpBlocksRange(ctx context.Context, blockFrom, blockTo uint64, tmpDir, sna
 type firstKeyGetter func(ctx context.Context) uint64
 type dumpFunc func(ctx context.Context, db kv.RoDB, chainConfig *chain.Config, blockFrom, blockTo uint64, firstKey firstKeyGetter, collecter func(v []byte) error, workers int, lvl log.Lvl, logger log.Logger) (uint64, error)
 
-func dumpRange(ctx context.Context, f snaptype.FileInfo, dumper dumpFunc, firstKey firstKeyGetter, chainDB kv.RoDB, chainConfig *chain.Config, tmpDir string, workers int, lvl log.Lvl, logger log.Logger) (uint64, error) {
+func dumpRange(ctx context.Context, f snaptype.FileInfo, dumper dumpFunc, firstKey firstKeyGetter, chainDB kv.RoDB, chainConfig *chain.Config, tmpDir string, workers int, lvl log.Lvl, logger log.Logger, fsync dir2.FsyncPolicy, prov Provenance, txnHashIdxShards int) (uint64, error) {
 	var lastKeyValue uint64
 
 	sn, err := seg.NewCompressor(ctx, "Snapshot "+f.Type.Name(), f.Path, tmpDir, seg.MinPatternScore, workers, log.LvlTrace, logger)
@@ -1563,13 +2264,16 @@ func dumpRange(ctx context.Context, f snaptype.FileInfo, dumper dumpFunc, firstK
 		return lastKeyValue, err
 	}
 	defer sn.Close()
+	if fsync == dir2.FsyncNone {
+		sn.DisableFsync()
+	}
 
 	lastKeyValue, err = dumper(ctx, chainDB, chainConfig, f.From, f.To, firstKey, func(v []byte) error {
 		return sn.AddWord(v)
 	}, workers, lvl, logger)
 
 	if err != nil {
-		return lastKeyValue, fmt.Errorf("DumpBodies: %w", err)
+		return lastKeyValue, fmt.Errorf("dump %s: %w", f.Name(), err)
 	}
 
 	ext := filepath.Ext(f.Name())
@@ -1578,12 +2282,23 @@ func dumpRange(ctx context.Context, f snaptype.FileInfo, dumper dumpFunc, firstK
 	if err := sn.Compress(); err != nil {
 		return lastKeyValue, fmt.Errorf("compress: %w", err)
 	}
+	if _, err := writeChecksumSidecar(f.Path); err != nil {
+		return lastKeyValue, fmt.Errorf("checksum: %w", err)
+	}
+	if err := writeProvenanceSidecar(f.Path, prov, chainConfig.ChainName, nil); err != nil {
+		return lastKeyValue, fmt.Errorf("provenance: %w", err)
+	}
 
 	p := &background.Progress{}
 
-	if err := f.Type.BuildIndexes(ctx, f, chainConfig, tmpDir, p, lvl, logger); err != nil {
+	if err := buildIndexes(ctx, f, chainConfig, tmpDir, txnHashIdxShards, p, lvl, logger); err != nil {
 		return lastKeyValue, err
 	}
+	if fsync.Final() {
+		if err := dir2.FsyncDir(filepath.Dir(f.Path)); err != nil {
+			return lastKeyValue, err
+		}
+	}
 
 	return lastKeyValue, nil
 }
@@ -1793,6 +2508,18 @@ func DumpTxs(ctx context.Context, db kv.RoDB, chainConfig *chain.Config, blockFr
 	return 0, nil
 }
 
+// ErrHeaderHashMismatch - header RLP doesn't hash to its canonical hash (DumpHeaders) or to first byte stored
+// before it in headers segment (merge, integrity check). Index of headers segment relies on this byte.
+var ErrHeaderHashMismatch = errors.New("header hash mismatch")
+
+// headersFirstByteCheckEvery - merge of headers segments re-hashes every Nth word
+const headersFirstByteCheckEvery = 1024
+
+// headerFirstByteValid - word of headers segment is `first_byte_of_header_hash + header_rlp`. Empty word is valid.
+func headerFirstByteValid(word []byte) bool {
+	return len(word) == 0 || crypto.Keccak256(word[1:])[0] == word[0]
+}
+
 // DumpHeaders - [from, to)
 func DumpHeaders(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blockTo uint64, _ firstKeyGetter, collect func([]byte) error, workers int, lvl log.Lvl, logger log.Logger) (uint64, error) {
 	logEvery := time.NewTicker(20 * time.Second)
@@ -1818,9 +2545,13 @@ func DumpHeaders(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, bl
 		if err := rlp.DecodeBytes(dataRLP, &h); err != nil {
 			return false, err
 		}
+		hash := h.Hash()
+		if !bytes.Equal(hash[:], v) {
+			return false, fmt.Errorf("%w: block_num=%d, canonical=%x, computed=%x", ErrHeaderHashMismatch, blockNum, v, hash)
+		}
 
 		value := make([]byte, len(dataRLP)+1) // first_byte_of_header_hash + header_rlp
-		value[0] = h.Hash()[0]
+		value[0] = hash[0]
 		copy(value[1:], dataRLP)
 		if err := collect(value); err != nil {
 			return false, err
@@ -1846,8 +2577,22 @@ func DumpHeaders(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, bl
 	return 0, nil
 }
 
+// ErrBodyMissed - canonical block has no body in DB. Dumping such range would produce segment with a silent gap.
+var ErrBodyMissed = errors.New("body missed")
+
 // DumpBodies - [from, to)
+// Missing canonical body is a hard error - because it would produce `.seg` with a gap (txnID discontinuity).
 func DumpBodies(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blockTo uint64, firstTxNum firstKeyGetter, collect func([]byte) error, workers int, lvl log.Lvl, logger log.Logger) (uint64, error) {
+	lastTxNum, _, err := dumpBodies(ctx, db, blockFrom, blockTo, firstTxNum, collect, false, lvl, logger)
+	return lastTxNum, err
+}
+
+// DumpBodiesAllowMissing - same as DumpBodies, but skips blocks without body and returns their numbers - caller decides what to do with them.
+func DumpBodiesAllowMissing(ctx context.Context, db kv.RoDB, blockFrom, blockTo uint64, firstTxNum firstKeyGetter, collect func([]byte) error, lvl log.Lvl, logger log.Logger) (lastTxNum uint64, missed []uint64, err error) {
+	return dumpBodies(ctx, db, blockFrom, blockTo, firstTxNum, collect, true, lvl, logger)
+}
+
+func dumpBodies(ctx context.Context, db kv.RoDB, blockFrom, blockTo uint64, firstTxNum firstKeyGetter, collect func([]byte) error, allowMissingBodies bool, lvl log.Lvl, logger log.Logger) (uint64, []uint64, error) {
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
 
@@ -1857,6 +2602,8 @@ func DumpBodies(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blo
 	from := hexutility.EncodeTs(blockFrom)
 
 	lastTxNum := firstTxNum(ctx)
+	var collected uint64
+	var missed []uint64
 
 	if err := kv.BigChunks(db, kv.HeaderCanonical, from, func(tx kv.Tx, k, v []byte) (bool, error) {
 		blockNum := binary.BigEndian.Uint64(k)
@@ -1876,7 +2623,11 @@ func DumpBodies(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blo
 			return false, err
 		}
 		if body == nil {
+			if !allowMissingBodies {
+				return false, fmt.Errorf("%w: block_num=%d, hash=%x", ErrBodyMissed, blockNum, v)
+			}
 			logger.Warn("body missed", "block_num", blockNum, "hash", hex.EncodeToString(v))
+			missed = append(missed, blockNum)
 			return true, nil
 		}
 		body.BaseTxnID = types.BaseTxnID(lastTxNum)
@@ -1890,6 +2641,7 @@ func DumpBodies(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blo
 		if err := collect(dataRLP); err != nil {
 			return false, err
 		}
+		collected++
 
 		select {
 		case <-ctx.Done():
@@ -1906,10 +2658,13 @@ func DumpBodies(ctx context.Context, db kv.RoDB, _ *chain.Config, blockFrom, blo
 		}
 		return true, nil
 	}); err != nil {
-		return lastTxNum, err
+		return lastTxNum, missed, err
 	}
 
-	return lastTxNum, nil
+	if collected+uint64(len(missed)) != blockTo-blockFrom {
+		return lastTxNum, missed, fmt.Errorf("bodies amount mismatch: collected=%d, missed=%d, expected=%d, range=%d-%d", collected, len(missed), blockTo-blockFrom, blockFrom, blockTo)
+	}
+	return lastTxNum, missed, nil
 }
 
 func ForEachHeader(ctx context.Context, s *RoSnapshots, walker func(header *types.Header) error) error {
@@ -1921,7 +2676,10 @@ func ForEachHeader(ctx context.Context, s *RoSnapshots, walker func(header *type
 
 	for _, sn := range view.Headers() {
 		if err := sn.WithReadAhead(func() error {
-			g := sn.MakeGetter()
+			g, err := sn.getter()
+			if err != nil {
+				return err
+			}
 			for g.HasNext() {
 				word, _ = g.Next(word[:0])
 				var header types.Header
@@ -1949,13 +2707,17 @@ type Merger struct {
 	chainConfig     *chain.Config
 	chainDB         kv.RoDB
 	logger          log.Logger
-	noFsync         bool // fsync is enabled by default, but tests can manually disable
+	fsync           dir2.FsyncPolicy       // fsync is enabled by default, but tests can manually disable
+	fsyncDir        func(dir string) error // dir2.FsyncDir, tests can replace
+	provenance      Provenance
 }
 
 func NewMerger(tmpDir string, compressWorkers int, lvl log.Lvl, chainDB kv.RoDB, chainConfig *chain.Config, logger log.Logger) *Merger {
-	return &Merger{tmpDir: tmpDir, compressWorkers: compressWorkers, lvl: lvl, chainDB: chainDB, chainConfig: chainConfig, logger: logger}
+	return &Merger{tmpDir: tmpDir, compressWorkers: compressWorkers, lvl: lvl, chainDB: chainDB, chainConfig: chainConfig, logger: logger, fsyncDir: dir2.FsyncDir}
 }
-func (m *Merger) DisableFsync() { m.noFsync = true }
+func (m *Merger) DisableFsync()                     { m.fsync = dir2.FsyncNone }
+func (m *Merger) SetFsyncPolicy(p dir2.FsyncPolicy) { m.fsync = p }
+func (m *Merger) SetProvenance(p Provenance)        { m.provenance = p }
 
 func (m *Merger) FindMergeRanges(currentRanges []Range, maxBlockNum uint64) (toMerge []Range) {
 	for i := len(currentRanges) - 1; i > 0; i-- {
@@ -2013,7 +2775,7 @@ func (m *Merger) filesByRangeOfType(view *View, from, to uint64, snapshotType sn
 	return paths
 }
 
-func (m *Merger) mergeSubSegment(ctx context.Context, sn snaptype.FileInfo, toMerge []string, snapDir string, doIndex bool, onMerge func(r Range) error) (err error) {
+func (m *Merger) mergeSubSegment(ctx context.Context, sn snaptype.FileInfo, toMerge []string, snapDir string, doIndex bool, txnHashIdxShards int, onMerge func(r Range) error) (err error) {
 	defer func() {
 		if err == nil {
 			if rec := recover(); rec != nil {
@@ -2024,12 +2786,15 @@ func (m *Merger) mergeSubSegment(ctx context.Context, sn snaptype.FileInfo, toMe
 			f := sn.Path
 			_ = os.Remove(f)
 			_ = os.Remove(f + ".torrent")
+			_ = os.Remove(f + checksumExt)
+			_ = os.Remove(f + provenanceExt)
 			ext := filepath.Ext(f)
 			withoutExt := f[:len(f)-len(ext)]
 			_ = os.Remove(withoutExt + ".idx")
 			isTxnType := strings.HasSuffix(withoutExt, coresnaptype.Transactions.Name())
 			if isTxnType {
 				_ = os.Remove(withoutExt + "-to-block.idx")
+				removeIdxShards(withoutExt)
 			}
 		}
 	}()
@@ -2043,7 +2808,12 @@ func (m *Merger) mergeSubSegment(ctx context.Context, sn snaptype.FileInfo, toMe
 
 	if doIndex {
 		p := &background.Progress{}
-		if err = buildIdx(ctx, sn, m.chainConfig, m.tmpDir, p, m.lvl, m.logger); err != nil {
+		if err = buildIdx(ctx, sn, m.chainConfig, m.tmpDir, txnHashIdxShards, p, m.lvl, m.logger); err != nil {
+			return
+		}
+	}
+	if m.fsync.Final() {
+		if err = m.fsyncDir(snapDir); err != nil {
 			return
 		}
 	}
@@ -2065,7 +2835,7 @@ func (m *Merger) Merge(ctx context.Context, snapshots *RoSnapshots, snapTypes []
 		}
 
 		for _, t := range snapTypes {
-			if err := m.mergeSubSegment(ctx, t.FileInfo(snapDir, r.from, r.to), toMerge[t.Enum()], snapDir, doIndex, onMerge); err != nil {
+			if err := m.mergeSubSegment(ctx, t.FileInfo(snapDir, r.from, r.to), toMerge[t.Enum()], snapDir, doIndex, snapshots.cfg.TxnHashIdxShards, onMerge); err != nil {
 				return err
 			}
 		}
@@ -2082,15 +2852,16 @@ func (m *Merger) Merge(ctx context.Context, snapshots *RoSnapshots, snapTypes []
 		}
 
 		for _, t := range snapTypes {
-			if len(toMerge[t.Enum()]) == 0 {
+			toDel := snapshots.withoutPinned(toMerge[t.Enum()])
+			if len(toDel) == 0 {
 				continue
 			}
 			if onDelete != nil {
-				if err := onDelete(toMerge[t.Enum()]); err != nil {
+				if err := onDelete(toDel); err != nil {
 					return err
 				}
 			}
-			removeOldFiles(toMerge[t.Enum()], snapDir)
+			removeOldFiles(toDel, snapDir)
 		}
 	}
 	m.logger.Log(m.lvl, "[snapshots] Merge done", "from", mergeRanges[0].from, "to", mergeRanges[0].to)
@@ -2116,18 +2887,23 @@ func (m *Merger) merge(ctx context.Context, toMerge []string, targetFile string,
 		return err
 	}
 	defer f.Close()
-	if m.noFsync {
+	if m.fsync == dir2.FsyncNone {
 		f.DisableFsync()
 	}
 
 	_, fName := filepath.Split(targetFile)
 	m.logger.Debug("[snapshots] merge", "file", fName)
+	fInfo, _, _ := snaptype.ParseFileName("", fName)
+	isHeaders := fInfo.Type != nil && fInfo.Type.Enum() == coresnaptype.Enums.Headers
 
 	for _, d := range cList {
 		if err := d.WithReadAhead(func() error {
 			g := d.MakeGetter()
-			for g.HasNext() {
+			for i := 0; g.HasNext(); i++ {
 				word, _ = g.Next(word[:0])
+				if isHeaders && i%headersFirstByteCheckEvery == 0 && !headerFirstByteValid(word) {
+					return fmt.Errorf("%w: %s, word %d", ErrHeaderHashMismatch, d.FileName(), i)
+				}
 				if err := f.AddWord(word); err != nil {
 					return err
 				}
@@ -2143,19 +2919,37 @@ func (m *Merger) merge(ctx context.Context, toMerge []string, targetFile string,
 	if err = f.Compress(); err != nil {
 		return err
 	}
+	if _, err = writeChecksumSidecar(targetFile); err != nil {
+		return err
+	}
+	if err = writeProvenanceSidecar(targetFile, m.provenance, m.chainConfig.ChainName, toMerge); err != nil {
+		return err
+	}
 	return nil
 }
 
+// removeIdxShards - ordinals index and shards of sharded indices of segment, see ethconfig.BlocksFreezing.TxnHashIdxShards
+func removeIdxShards(withoutExt string) {
+	_ = os.Remove(withoutExt + "-ids.idx")
+	shards, _ := filepath.Glob(withoutExt + "*-shard*-of-*.idx")
+	for _, f := range shards {
+		_ = os.Remove(f)
+	}
+}
+
 func removeOldFiles(toDel []string, snapDir string) {
 	for _, f := range toDel {
 		_ = os.Remove(f)
 		_ = os.Remove(f + ".torrent")
+		_ = os.Remove(f + checksumExt)
+		_ = os.Remove(f + provenanceExt)
 		ext := filepath.Ext(f)
 		withoutExt := f[:len(f)-len(ext)]
 		_ = os.Remove(withoutExt + ".idx")
 		isTxnType := strings.HasSuffix(withoutExt, coresnaptype.Transactions.Name())
 		if isTxnType {
 			_ = os.Remove(withoutExt + "-to-block.idx")
+			removeIdxShards(withoutExt)
 		}
 	}
 	tmpFiles, err := snaptype.TmpFiles(snapDir)
@@ -2171,14 +2965,19 @@ type View struct {
 	s           *RoSnapshots
 	baseSegType snaptype.Type
 	closed      bool
+	generation  uint64
 }
 
 func (s *RoSnapshots) View() *View {
 	v := &View{s: s, baseSegType: coresnaptype.Headers}
 	s.lockSegments()
+	v.generation = s.generation.Load()
 	return v
 }
 
+// Generation - RoSnapshots.FilesGeneration captured at View creation
+func (v *View) Generation() uint64 { return v.generation }
+
 func (v *View) Close() {
 	if v.closed {
 		return
@@ -2,9 +2,13 @@ package freezeblocks
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/slices"
@@ -13,16 +17,76 @@ import (
 
 	"github.com/ledgerwatch/erigon-lib/chain/networkname"
 	"github.com/ledgerwatch/erigon-lib/chain/snapcfg"
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	dir2 "github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/erigon-lib/seg"
 
 	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/rawdb/blockio"
 	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
 	"github.com/ledgerwatch/erigon/eth/ethconfig"
 	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/turbo/services"
 )
 
+func TestSegmentNamesCache(t *testing.T) {
+	logger := log.New()
+	dir := t.TempDir()
+	createTestSegmentFile(t, 0, 500_000, coresnaptype.Headers.Enum(), dir, 1, logger)
+
+	sn := newSegment(dir, coresnaptype.Headers, 1, 0, 500_000)
+	defer sn.close()
+	require.NoError(t, sn.reopenSeg(dir))
+	require.NoError(t, sn.reopenIdxIfNeed(dir, false))
+	require.True(t, sn.IsIndexed())
+	require.Equal(t, "v1-000000-000500-headers.seg", sn.FileName())
+	require.Equal(t, []string{"v1-000000-000500-headers.idx"}, sn.IdxFileNames())
+	require.Equal(t, filepath.Join(dir, sn.FileName()), sn.FileInfo(dir).Path)
+	require.Equal(t, filepath.Join("other", sn.FileName()), sn.FileInfo("other").Path)
+
+	// reopen of same file: names are not derived again
+	names := sn.names
+	require.NoError(t, sn.reopenSeg(dir))
+	require.Same(t, names, sn.names)
+
+	// reopen with other version
+	require.NoError(t, os.Rename(filepath.Join(dir, "v1-000000-000500-headers.seg"), filepath.Join(dir, "v2-000000-000500-headers.seg")))
+	sn.version = 2
+	require.Equal(t, "v2-000000-000500-headers.seg", sn.FileName(), "stale cache must not be used")
+	require.NoError(t, sn.reopenSeg(dir))
+	require.NotSame(t, names, sn.names)
+	require.Equal(t, "v2-000000-000500-headers.seg", sn.FileName())
+	require.Equal(t, []string{"v2-000000-000500-headers.idx"}, sn.IdxFileNames())
+	require.Equal(t, coresnaptype.Headers.FileInfo(dir, 0, 500_000), sn.FileInfo(dir), "version of type, as without cache")
+	require.Equal(t, filepath.Join(dir, sn.FileName()), sn.FilePath())
+}
+
+func BenchmarkSegmentNames(b *testing.B) {
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, b.TempDir(), 0, log.New())
+	var list []string
+	for _, t := range coresnaptype.BlockSnapshotTypes {
+		value := &segments{}
+		for i := uint64(0); i < 1_000; i++ {
+			sn := newSegment(s.dir, t, 1, i*1_000, (i+1)*1_000)
+			sn.Decompressor = &seg.Decompressor{} // closeWhatNotInList checks names of open segments only
+			value.segments = append(value.segments, sn)
+			list = append(list, sn.FileName())
+		}
+		s.segments.Set(t.Enum(), value)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.closeWhatNotInList(list)
+		s.idxAvailability()
+	}
+}
+
 func createTestSegmentFile(t *testing.T, from, to uint64, name snaptype.Enum, dir string, version snaptype.Version, logger log.Logger) {
 	c, err := seg.NewCompressor(context.Background(), "test", filepath.Join(dir, snaptype.SegmentFileName(version, from, to, name)), dir, 100, 1, log.LvlDebug, logger)
 	require.NoError(t, err)
@@ -215,6 +279,89 @@ func TestMergeSnapshots(t *testing.T) {
 	// require.Equal(10, a)
 }
 
+func TestMergeSnapshotsKeepsPinned(t *testing.T) {
+	logger := log.New()
+	dir, require := t.TempDir(), require.New(t)
+	for i := uint64(0); i < 70; i++ {
+		for _, snT := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, i*10_000, (i+1)*10_000, snT.Enum(), dir, 1, logger)
+		}
+	}
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenFolder())
+	pinned := Range{from: 10_000, to: 20_000}
+	require.NoError(s.Pin(pinned, coresnaptype.BlockSnapshotTypes))
+
+	merger := NewMerger(dir, 1, log.LvlInfo, nil, params.MainnetChainConfig, logger)
+	merger.DisableFsync()
+	ranges := merger.FindMergeRanges(s.Ranges(), s.SegmentsMax())
+	require.NotEmpty(ranges)
+	require.NoError(merger.Merge(context.Background(), s, coresnaptype.BlockSnapshotTypes, ranges, s.Dir(), false, nil, nil))
+
+	exists := func(from, to uint64) bool {
+		_, err := os.Stat(filepath.Join(dir, snaptype.SegmentFileName(1, from, to, coresnaptype.Headers.Enum())))
+		return err == nil
+	}
+	require.True(exists(10_000, 20_000))
+	require.False(exists(0, 10_000))
+	require.False(exists(20_000, 30_000))
+
+	view := s.View()
+	seg, ok := view.HeadersSegment(15_000)
+	require.True(ok)
+	require.Equal(uint64(0), seg.from)
+	require.Equal(uint64(500_000), seg.to)
+	view.Close()
+
+	require.NoError(s.removeOverlapsAfterMerge())
+	require.True(exists(10_000, 20_000))
+
+	require.NoError(s.Unpin(pinned, coresnaptype.BlockSnapshotTypes))
+	require.NoError(s.removeOverlapsAfterMerge())
+	require.False(exists(10_000, 20_000))
+	_, err := os.Stat(filepath.Join(dir, PinnedFileName))
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestMergeFsyncPolicy(t *testing.T) {
+	logger := log.New()
+	dir, require := t.TempDir(), require.New(t)
+	for i := uint64(0); i < 70; i++ {
+		for _, snT := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, i*10_000, (i+1)*10_000, snT.Enum(), dir, 1, logger)
+		}
+	}
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenFolder())
+
+	var synced []string
+	merger := NewMerger(dir, 1, log.LvlInfo, nil, params.MainnetChainConfig, logger)
+	merger.fsyncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return nil
+	}
+	merger.SetFsyncPolicy(dir2.FsyncFinalOnly)
+	ranges := merger.FindMergeRanges(s.Ranges(), s.SegmentsMax())
+	require.NotEmpty(ranges)
+	require.NoError(merger.Merge(context.Background(), s, coresnaptype.BlockSnapshotTypes, ranges, s.Dir(), false, nil, nil))
+	require.Len(synced, len(ranges)*len(coresnaptype.BlockSnapshotTypes)) // after every merged file
+	for _, d := range synced {
+		require.Equal(dir, d)
+	}
+
+	synced = nil
+	for _, snT := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 700_000, 710_000, snT.Enum(), dir, 1, logger)
+		createTestSegmentFile(t, 710_000, 720_000, snT.Enum(), dir, 1, logger)
+	}
+	require.NoError(s.ReopenFolder())
+	merger.DisableFsync()
+	require.NoError(merger.Merge(context.Background(), s, coresnaptype.BlockSnapshotTypes, []Range{{from: 700_000, to: 720_000}}, s.Dir(), false, nil, nil))
+	require.Empty(synced)
+}
+
 func TestDeleteSnapshots(t *testing.T) {
 	logger := log.New()
 	dir, require := t.TempDir(), require.New(t)
@@ -312,6 +459,128 @@ func TestCanRetire(t *testing.T) {
 		require.Equal(tc.can, can, tc.inFrom, tc.inTo, i)
 	}
 }
+
+type fakeFrozenReader struct{ blocks, bor uint64 }
+
+func (r *fakeFrozenReader) FrozenBlocks() uint64    { return r.blocks }
+func (r *fakeFrozenReader) FrozenBorBlocks() uint64 { return r.bor }
+
+func TestRetireLoopBorNotAheadOfBlocks(t *testing.T) {
+	const tip = 2_500_000
+	run := func(t *testing.T, frozen *fakeFrozenReader, blocksStuck bool) []string {
+		t.Helper()
+		var calls []string
+		retire := func(minBlockNum, maxBlockNum uint64) (bool, error) {
+			from, to, ok := CanRetire(maxBlockNum, minBlockNum, snaptype.Unknown, nil)
+			if !ok || blocksStuck {
+				return false, nil
+			}
+			calls = append(calls, fmt.Sprintf("blocks %d-%d", from, to))
+			frozen.blocks = to - 1
+			return true, nil
+		}
+		retireBor := func(minBlockNum, maxBlockNum uint64) (bool, error) {
+			from, to, ok := CanRetireBor(maxBlockNum, minBlockNum, frozen.blocks, snaptype.Unknown, nil)
+			if !ok {
+				return false, nil
+			}
+			require.LessOrEqual(t, to-1, frozen.blocks, "bor %d-%d is ahead of blocks", from, to)
+			calls = append(calls, fmt.Sprintf("bor %d-%d", from, to))
+			frozen.bor = to - 1
+			return true, nil
+		}
+		require.NoError(t, retireLoop(frozen, 0, func() uint64 { return tip }, retire, retireBor, nil))
+		return calls
+	}
+
+	t.Run("in sync", func(t *testing.T) {
+		frozen := &fakeFrozenReader{blocks: 999_999, bor: 999_999}
+		calls := run(t, frozen, false)
+		require.True(t, strings.HasPrefix(calls[0], "blocks 1000000-"))
+		require.Equal(t, strings.TrimPrefix(calls[0], "blocks "), strings.TrimPrefix(calls[1], "bor "))
+		require.Equal(t, frozen.blocks, frozen.bor)
+	})
+	t.Run("bor behind blocks", func(t *testing.T) {
+		frozen := &fakeFrozenReader{blocks: 999_999, bor: 499_999}
+		calls := run(t, frozen, false)
+		require.True(t, strings.HasPrefix(calls[1], "bor 500000-"), calls[1])
+		require.Equal(t, frozen.blocks, frozen.bor)
+	})
+	t.Run("blocks can't retire", func(t *testing.T) {
+		frozen := &fakeFrozenReader{blocks: 999_999, bor: 999_999}
+		calls := run(t, frozen, true)
+		require.Empty(t, calls)
+		require.Equal(t, uint64(999_999), frozen.bor)
+	})
+}
+
+func TestRetireProgressAfterRestart(t *testing.T) {
+	logger := log.New()
+	dirs, require := datadir.New(t.TempDir()), require.New(t)
+	ctx := context.Background()
+	for _, snT := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 0, 10_000, snT.Enum(), dirs.Snap, 1, logger)
+	}
+	db := memdb.NewTestDB(t)
+	newRetire := func() *BlockRetire { // restart: only files and db survive
+		s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+		t.Cleanup(s.Close)
+		require.NoError(s.ReopenFolder())
+		return NewBlockRetire(1, dirs, NewBlockReader(s, nil), blockio.NewBlockWriter(), db, params.MainnetChainConfig, nil, nil, logger)
+	}
+	var seeds int
+	seed := func([]services.DownloadRequest) error {
+		seeds++
+		return nil
+	}
+
+	br := newRetire()
+	progress, err := br.readRetireProgress(ctx)
+	require.NoError(err)
+	require.True(progress.Empty())
+	dumps := &retireDumps{br: br, ctx: ctx, progress: &progress}
+	bodies := coresnaptype.Bodies.FileInfo(dirs.Snap, 0, 10_000)
+	_, ok := dumps.dumped(bodies)
+	require.False(ok, "segment exists, but it's not dumped by retire cycle")
+	require.NoError(dumps.markDumped(bodies, 42))
+
+	// restart between dumps: dumped segment is skipped, last key of its dump is known
+	br = newRetire()
+	progress, err = br.readRetireProgress(ctx)
+	require.NoError(err)
+	dumps = &retireDumps{br: br, ctx: ctx, progress: &progress}
+	lastKey, ok := dumps.dumped(bodies)
+	require.True(ok)
+	require.Equal(uint64(42), lastKey)
+	_, ok = dumps.dumped(coresnaptype.Headers.FileInfo(dirs.Snap, 0, 10_000))
+	require.False(ok)
+	_, ok = dumps.dumped(coresnaptype.Bodies.FileInfo(dirs.Snap, 10_000, 20_000))
+	require.False(ok)
+
+	// index of dumped segment is lost - dump again
+	require.NoError(os.Remove(filepath.Join(dirs.Snap, snaptype.IdxFileName(1, 0, 10_000, coresnaptype.Bodies.Name()))))
+	_, ok = dumps.dumped(bodies)
+	require.False(ok)
+
+	// restart after merge, but before seed: merged range is announced by next retire, once
+	progress.Merged = rawdb.RetireRange{From: 0, To: 100_000}
+	require.NoError(br.writeRetireProgress(ctx, progress))
+	br = newRetire()
+	ok, err = br.retireBlocks(ctx, 0, 0, log.LvlInfo, seed, nil)
+	require.NoError(err)
+	require.False(ok)
+	require.Equal(1, seeds)
+
+	// cycle finished: nothing is skipped or announced after next restart
+	progress, err = newRetire().readRetireProgress(ctx)
+	require.NoError(err)
+	require.True(progress.Empty())
+	ok, err = newRetire().retireBlocks(ctx, 0, 0, log.LvlInfo, seed, nil)
+	require.NoError(err)
+	require.False(ok)
+	require.Equal(1, seeds)
+}
+
 func TestOpenAllSnapshot(t *testing.T) {
 	logger := log.New()
 	baseDir, require := t.TempDir(), require.New(t)
@@ -399,6 +668,57 @@ func TestOpenAllSnapshot(t *testing.T) {
 	}
 }
 
+func TestOpenEmptySegment(t *testing.T) {
+	logger := log.New()
+	dir, require := t.TempDir(), require.New(t)
+	var fileNames []string
+	for _, r := range []Range{{0, 500_000}, {500_000, 1_000_000}, {1_000_000, 1_500_000}} {
+		for _, typ := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, r.from, r.to, typ.Enum(), dir, 1, logger)
+			fileNames = append(fileNames, snaptype.SegmentFileName(1, r.from, r.to, typ.Enum()))
+		}
+	}
+	emptyName := snaptype.SegmentFileName(1, 500_000, 1_000_000, coresnaptype.Enums.Bodies)
+	emptyPath := filepath.Join(dir, emptyName)
+
+	sn := newSegment(dir, coresnaptype.Bodies, 1, 500_000, 1_000_000)
+	for _, size := range []int{0, seg.MinFileSize - 1} {
+		require.NoError(os.WriteFile(emptyPath, make([]byte, size), 0644))
+		var emptyErr *ErrEmptySegment
+		require.ErrorAs(sn.reopenSeg(dir), &emptyErr)
+		require.Equal(emptyName, emptyErr.Segment)
+		require.Equal(int64(size), emptyErr.Size)
+	}
+	require.NoError(os.WriteFile(emptyPath, nil, 0644))
+
+	for _, optimistic := range []bool{false, true} {
+		s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+		require.NoError(s.ReopenList(fileNames, optimistic))
+		require.Equal([]string{emptyName}, s.EmptySegments())
+		view := s.View()
+		require.Equal(3, len(view.Headers()))
+		require.Equal(3, len(view.Txs()))
+		require.Equal(2, len(view.Bodies()), "other segments are open")
+		view.Close()
+		require.Equal(uint64(499_999), s.SegmentsMax())
+		require.Equal(uint64(499_999), s.BlocksAvailable(), "range of empty segment is not available")
+		require.FileExists(emptyPath, "not quarantined by default")
+		s.Close()
+	}
+
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true, QuarantineEmptySegments: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenList(fileNames, false))
+	require.Equal([]string{emptyName}, s.EmptySegments())
+	require.NoFileExists(emptyPath)
+	require.FileExists(emptyPath + ".broken")
+	require.Equal(uint64(499_999), s.BlocksAvailable())
+
+	require.NoError(s.ReopenFolder())
+	require.Empty(s.EmptySegments())
+	require.Equal(uint64(499_999), s.BlocksAvailable(), "quarantined file is not opened")
+}
+
 func TestParseCompressedFileName(t *testing.T) {
 	require := require.New(t)
 	fs := fstest.MapFS{
@@ -437,3 +757,85 @@ func TestParseCompressedFileName(t *testing.T) {
 	require.Equal(1_000, int(f.From))
 	require.Equal(2_000, int(f.To))
 }
+
+func TestFilesGeneration(t *testing.T) {
+	logger := log.New()
+	dir := t.TempDir()
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+	gen := s.FilesGeneration()
+
+	for _, snapType := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 0, 500_000, snapType.Enum(), dir, 1, logger)
+	}
+	require.NoError(t, s.ReopenFolder())
+	require.Greater(t, s.FilesGeneration(), gen)
+
+	view := s.View()
+	require.Equal(t, s.FilesGeneration(), view.Generation())
+	view.Close()
+}
+
+func TestWaitBlocksAvailable(t *testing.T) {
+	logger := log.New()
+	dir := t.TempDir()
+	var list []string
+	for _, snapType := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 0, 500_000, snapType.Enum(), dir, 1, logger)
+		list = append(list, snaptype.SegmentFileName(1, 0, 500_000, snapType.Enum()))
+	}
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s.Close()
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.WaitBlocksAvailable(context.Background(), 400_000) }()
+	changed := s.AvailabilityChanged()
+	select {
+	case err := <-waitErr:
+		t.Fatalf("waiter returned before files are open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, s.ReopenList(list, false))
+	select {
+	case err := <-waitErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not unblocked by ReopenList")
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("AvailabilityChanged was not signaled")
+	}
+
+	// already available: returns immediately, even with cancelled ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, s.WaitBlocksAvailable(ctx, 499_999))
+
+	// reopen without progress doesn't signal
+	changed = s.AvailabilityChanged()
+	require.NoError(t, s.ReopenList(list, false))
+	select {
+	case <-changed:
+		t.Fatal("AvailabilityChanged signaled without progress")
+	default:
+	}
+}
+
+func TestWaitBlocksAvailableCtxCancel(t *testing.T) {
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, t.TempDir(), 0, log.New())
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.WaitBlocksAvailable(ctx, 1_000_000) }()
+	cancel()
+	select {
+	case err := <-waitErr:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter ignored ctx cancellation")
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"reflect"
 
+	"github.com/ledgerwatch/erigon-lib/chain"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
 	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
 	"github.com/ledgerwatch/erigon-lib/log/v3"
 	"github.com/ledgerwatch/erigon/cmd/hack/tool/fromdb"
@@ -29,17 +30,19 @@ func (br *BlockRetire) retireBorBlocks(ctx context.Context, minBlockNum uint64,
 	snapshots := br.borSnapshots()
 
 	chainConfig := fromdb.ChainConfig(br.db)
-	notifier, logger, blockReader, tmpDir, db, workers := br.notifier, br.logger, br.blockReader, br.tmpDir, br.db, br.workers
+	logger, blockReader, tmpDir, db, workers := br.logger, br.blockReader, br.tmpDir, br.db, br.workers
 
 	blocksRetired := false
 
 	minBlockNum = max(blockReader.FrozenBorBlocks(), minBlockNum)
+	// block segments must be present and indexed before bor segments of same range
+	blocksInSnapshots := blockReader.FrozenBlocks()
 	for _, snaptype := range blockReader.BorSnapshots().Types() {
 		if maxBlockNum <= minBlockNum {
 			continue
 		}
 
-		blockFrom, blockTo, ok := CanRetire(maxBlockNum, minBlockNum, snaptype.Enum(), br.chainConfig)
+		blockFrom, blockTo, ok := CanRetireBor(maxBlockNum, minBlockNum, blocksInSnapshots, snaptype.Enum(), br.chainConfig)
 		if ok {
 			blocksRetired = true
 
@@ -61,16 +64,23 @@ func (br *BlockRetire) retireBorBlocks(ctx context.Context, minBlockNum uint64,
 	}
 
 	if blocksRetired {
-		if err := snapshots.ReopenFolder(); err != nil {
+		if br.fsync.Final() {
+			if err := dir.FsyncDir(snapshots.Dir()); err != nil {
+				return blocksRetired, err
+			}
+		}
+		if err := br.reopenAndNotify(snapshots.ReopenFolder); err != nil {
 			return blocksRetired, fmt.Errorf("reopen: %w", err)
 		}
-		snapshots.LogStat("bor:retire")
-		if notifier != nil && !reflect.ValueOf(notifier).IsNil() { // notify about new snapshots of any size
-			notifier.OnNewSnapshot()
+		if err := br.recordChecksums(ctx); err != nil {
+			return blocksRetired, err
 		}
+		snapshots.LogStat("bor:retire")
 	}
 
 	merger := NewMerger(tmpDir, workers, lvl, db, chainConfig, logger)
+	merger.SetFsyncPolicy(br.fsync)
+	merger.SetProvenance(br.provenance)
 	rangesToMerge := merger.FindMergeRanges(snapshots.Ranges(), snapshots.BlocksAvailable())
 	if len(rangesToMerge) > 0 {
 		logger.Log(lvl, "[bor snapshots] Retire Bor Blocks", "rangesToMerge", Ranges(rangesToMerge))
@@ -80,9 +90,7 @@ func (br *BlockRetire) retireBorBlocks(ctx context.Context, minBlockNum uint64,
 	}
 	blocksRetired = true // have something to merge
 	onMerge := func(r Range) error {
-		if notifier != nil && !reflect.ValueOf(notifier).IsNil() { // notify about new snapshots of any size
-			notifier.OnNewSnapshot()
-		}
+		br.notifyNewSnapshot(nil)
 
 		if seedNewSnapshots != nil {
 			downloadRequest := []services.DownloadRequest{
@@ -111,7 +119,7 @@ func (br *BlockRetire) retireBorBlocks(ctx context.Context, minBlockNum uint64,
 		removeBorOverlaps(br.borSnapshots().dir, files, br.borSnapshots().BlocksAvailable())
 	}
 
-	return blocksRetired, nil
+	return blocksRetired, br.recordChecksums(ctx)
 }
 
 // Bor Events
@@ -131,8 +139,22 @@ type BorRoSnapshots struct {
 //   - all snapshots of given blocks range must exist - to make this blocks range available
 //   - gaps are not allowed
 //   - segment have [from:to] semantic
-func NewBorRoSnapshots(cfg ethconfig.BlocksFreezing, snapDir string, segmentsMin uint64, logger log.Logger) *BorRoSnapshots {
-	return &BorRoSnapshots{*newRoSnapshots(cfg, snapDir, borsnaptype.BorSnapshotTypes(), segmentsMin, logger)}
+//   - on chain without Bor config no types are registered: bor files (if any) are ignored. chainConfig=nil - unknown chain
+func NewBorRoSnapshots(cfg ethconfig.BlocksFreezing, snapDir string, segmentsMin uint64, chainConfig *chain.Config, logger log.Logger) *BorRoSnapshots {
+	return &BorRoSnapshots{*newRoSnapshots(cfg, snapDir, borsnaptype.BorSnapshotTypes(), segmentsMin, chainConfig, logger)}
+}
+
+// typeUsedByChain - bor types are used only by chains with Bor config. chainConfig=nil: all types are used
+func typeUsedByChain(t snaptype.Type, chainConfig *chain.Config) bool {
+	if chainConfig == nil {
+		return true
+	}
+	for _, borType := range borsnaptype.BorSnapshotTypes() {
+		if t.Enum() == borType.Enum() {
+			return chainConfig.Bor != nil
+		}
+	}
+	return true
 }
 
 func (s *BorRoSnapshots) Ranges() []Range {
@@ -160,7 +160,7 @@ Loop:
 				}
 			}
 			if !exists {
-				sn = &Segment{segType: snaptype.BeaconBlocks, version: f.Version, Range: Range{f.From, f.To}}
+				sn = newSegment(s.dir, snaptype.BeaconBlocks, f.Version, f.From, f.To)
 			}
 			if err := sn.reopenSeg(s.dir); err != nil {
 				if errors.Is(err, os.ErrNotExist) {
@@ -209,7 +209,7 @@ Loop:
 				}
 			}
 			if !exists {
-				sn = &Segment{segType: snaptype.BlobSidecars, version: f.Version, Range: Range{f.From, f.To}}
+				sn = newSegment(s.dir, snaptype.BlobSidecars, f.Version, f.From, f.To)
 			}
 			if err := sn.reopenSeg(s.dir); err != nil {
 				if errors.Is(err, os.ErrNotExist) {
@@ -0,0 +1,189 @@
+package freezeblocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+)
+
+// checksumExt - sidecar file which caches short checksum of .seg file: `v1-000000-000500-headers.seg.sha256`
+// Sidecar is created when file is produced (dump/merge) or first recorded (downloaded files) - so recording checksums into DB
+// doesn't need to read whole files again.
+const checksumExt = ".sha256"
+
+// ChecksumMismatchError - on-disk file content differs from the one recorded in DB (re-downloaded different file, manual tampering, etc...)
+type ChecksumMismatchError struct {
+	FileName string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("snapshot file checksum mismatch: %s, recorded=%s, on_disk=%s", e.FileName, e.Expected, e.Actual)
+}
+
+// computeChecksum - first 8 bytes of sha256 of file content, hex-encoded
+func computeChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+// writeChecksumSidecar - computes checksum of just-produced file and caches it in sidecar
+func writeChecksumSidecar(filePath string) (string, error) {
+	sum, err := computeChecksum(filePath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filePath+checksumExt, []byte(sum), 0644); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// readChecksumSidecar - returns cached checksum. ok=false if sidecar doesn't exist or older than file (file was modified after sidecar creation).
+// Sidecar is only a cache: mismatch with recorded checksum is confirmed by re-reading file, see verifyChecksums
+func readChecksumSidecar(filePath string) (sum string, ok bool, err error) {
+	sidecarInfo, err := os.Stat(filePath + checksumExt)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", false, err
+	}
+	if fileInfo.ModTime().After(sidecarInfo.ModTime()) {
+		return "", false, nil
+	}
+	v, err := os.ReadFile(filePath + checksumExt)
+	if err != nil {
+		return "", false, err
+	}
+	sum = strings.TrimSpace(string(v))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != 8 {
+		return "", false, fmt.Errorf("parse %s: unexpected checksum %q", filepath.Base(filePath)+checksumExt, sum)
+	}
+	return sum, true, nil
+}
+
+// SegmentChecksum - cached checksum of file. Re-computes (and re-caches) it if sidecar is missing or stale.
+func SegmentChecksum(filePath string) (string, error) {
+	sum, ok, err := readChecksumSidecar(filePath)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return sum, nil
+	}
+	return writeChecksumSidecar(filePath)
+}
+
+// checksumsToRecord - checksums of `files` to record in DB. Files already recorded in DB keep recorded checksum if they have
+// no fresh sidecar: it's verified on reopen, don't read whole snapshots dir just to re-record it. New files without sidecar
+// (downloaded ones) are read once to create it.
+func checksumsToRecord(snapDir string, files []string, recorded map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(files))
+	for _, fName := range files {
+		filePath := filepath.Join(snapDir, fName)
+		sum, ok, err := readChecksumSidecar(filePath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		if !ok {
+			if sum, ok = recorded[fName]; !ok {
+				if sum, err = writeChecksumSidecar(filePath); err != nil {
+					if errors.Is(err, os.ErrNotExist) {
+						continue
+					}
+					return nil, err
+				}
+			}
+		}
+		res[fName] = sum
+	}
+	return res, nil
+}
+
+// WriteSnapshotsWithChecksums - same as rawdb.WriteSnapshots, but also records checksums of block files
+func WriteSnapshotsWithChecksums(tx kv.RwTx, snapDir string, blockFiles, stateFiles []string) error {
+	if err := rawdb.WriteSnapshots(tx, blockFiles, stateFiles); err != nil {
+		return err
+	}
+	return writeBlockFilesChecksums(tx, snapDir, blockFiles)
+}
+
+// UpdateSnapshotsWithChecksums - same as rawdb.UpdateSnapshots, but also records checksums of block files
+func UpdateSnapshotsWithChecksums(tx kv.RwTx, snapDir string, blockFiles, stateAdded, stateRemoved []string) error {
+	if err := rawdb.UpdateSnapshots(tx, blockFiles, stateAdded, stateRemoved); err != nil {
+		return err
+	}
+	return writeBlockFilesChecksums(tx, snapDir, blockFiles)
+}
+
+func writeBlockFilesChecksums(tx kv.RwTx, snapDir string, blockFiles []string) error {
+	recorded, err := rawdb.ReadSnapshotsChecksums(tx)
+	if err != nil {
+		return err
+	}
+	checksums, err := checksumsToRecord(snapDir, blockFiles, recorded)
+	if err != nil {
+		return err
+	}
+	return rawdb.WriteSnapshotsChecksums(tx, checksums)
+}
+
+// verifyChecksums - compares recorded checksums with on-disk files. Files without recorded checksum are not checked.
+// Returns *ChecksumMismatchError only if `strict`, otherwise - only logs warning.
+func (s *RoSnapshots) verifyChecksums(files []string, recorded map[string]string, strict bool) error {
+	for _, fName := range files {
+		expected, ok := recorded[fName]
+		if !ok {
+			continue
+		}
+		actual, err := SegmentChecksum(filepath.Join(s.dir, fName))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if actual == expected {
+			continue
+		}
+		// cached checksum may be stale (mtime is not reliable): confirm mismatch by content
+		if actual, err = writeChecksumSidecar(filepath.Join(s.dir, fName)); err != nil {
+			return err
+		}
+		if actual == expected {
+			continue
+		}
+		mismatch := &ChecksumMismatchError{FileName: fName, Expected: expected, Actual: actual}
+		if strict {
+			return mismatch
+		}
+		s.logger.Warn("[snapshots] !!! file was modified on disk after it was recorded in DB - it may contain unexpected data !!!", "err", mismatch)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package freezeblocks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+)
+
+func TestReopenWithDBChecksumMismatch(t *testing.T) {
+	logger := log.New()
+	dir := t.TempDir()
+	db := memdb.NewTestDB(t)
+
+	for _, snapType := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 0, 500_000, snapType.Enum(), dir, 1, logger)
+		_, err := writeChecksumSidecar(filepath.Join(dir, snaptype.SegmentFileName(1, 0, 500_000, snapType.Enum())))
+		require.NoError(t, err)
+	}
+
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true, VerifyChecksumsStrict: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(t, s.ReopenFolder())
+	files := s.Files()
+	require.NotEmpty(t, files)
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		return WriteSnapshotsWithChecksums(tx, dir, files, nil)
+	}))
+	require.NoError(t, s.ReopenWithDB(db))
+
+	// overwrite one segment with different bytes
+	tampered := snaptype.SegmentFileName(1, 0, 500_000, coresnaptype.Enums.Bodies)
+	s.Close()
+	tamperedPath := filepath.Join(dir, tampered)
+	require.NoError(t, os.WriteFile(tamperedPath, []byte("different content"), 0644))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(tamperedPath, future, future))
+
+	err := s.ReopenWithDB(db)
+	var mismatch *ChecksumMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, tampered, mismatch.FileName)
+
+	// non-strict mode only warns
+	s2 := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+	defer s2.Close()
+	require.NoError(t, s2.verifyChecksums(files, map[string]string{tampered: mismatch.Expected}, false))
+}
+
+func TestChecksumsOfFilesWithoutSidecar(t *testing.T) {
+	logger := log.New()
+	dir := t.TempDir()
+	db := memdb.NewTestDB(t)
+
+	// downloaded files have no sidecar
+	for _, snapType := range coresnaptype.BlockSnapshotTypes {
+		createTestSegmentFile(t, 0, 500_000, snapType.Enum(), dir, 1, logger)
+	}
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true, VerifyChecksumsStrict: true}, dir, 0, logger)
+	defer s.Close()
+	require.NoError(t, s.ReopenFolder())
+	files := s.Files()
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		return WriteSnapshotsWithChecksums(tx, dir, files, nil)
+	}))
+	var recorded map[string]string
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) (err error) {
+		recorded, err = rawdb.ReadSnapshotsChecksums(tx)
+		return err
+	}))
+	require.Len(t, recorded, len(files))
+	for _, fName := range files {
+		require.FileExists(t, filepath.Join(dir, fName+checksumExt))
+	}
+
+	// stale sidecar (file replaced with same content, mtime is not updated) - mismatch is confirmed by content
+	bodies := snaptype.SegmentFileName(1, 0, 500_000, coresnaptype.Enums.Bodies)
+	sidecar := filepath.Join(dir, bodies+checksumExt)
+	require.NoError(t, os.WriteFile(sidecar, []byte("0000000000000000"), 0644))
+	require.NoError(t, s.ReopenWithDB(db))
+	sum, ok, err := readChecksumSidecar(filepath.Join(dir, bodies))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, recorded[bodies], sum)
+
+	// corrupted sidecar is not ignored
+	require.NoError(t, os.WriteFile(sidecar, []byte("not a checksum"), 0644))
+	require.ErrorContains(t, s.ReopenWithDB(db), "unexpected checksum")
+
+	// corrupted record in DB is not ignored
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		return tx.Put(kv.DatabaseInfo, rawdb.SnapshotsChecksumsKey, []byte("{"))
+	}))
+	require.ErrorContains(t, s.ReopenWithDB(db), "parse snapshots checksums")
+}
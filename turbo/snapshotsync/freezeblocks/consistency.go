@@ -0,0 +1,245 @@
+package freezeblocks
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+)
+
+// ConsistencyFindingKind - class of ConsistencyFinding
+type ConsistencyFindingKind uint8
+
+const (
+	RecordedFileMissing ConsistencyFindingKind = iota // recorded in DB (see rawdb.ReadSnapshots), but not on disk
+	UnrecordedFile                                    // on disk, but not recorded in DB
+	SegmentsGap                                       // block files of type don't chain contiguously
+	StateFilesGap                                     // state files of type don't chain contiguously
+)
+
+func (k ConsistencyFindingKind) String() string {
+	switch k {
+	case RecordedFileMissing:
+		return "recorded_file_missing"
+	case UnrecordedFile:
+		return "unrecorded_file"
+	case SegmentsGap:
+		return "segments_gap"
+	case StateFilesGap:
+		return "state_files_gap"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// ConsistencyFinding - one mismatch between recorded snapshots list and on-disk files
+type ConsistencyFinding struct {
+	Kind ConsistencyFindingKind
+	// Fatal - files below expected (recorded) blocks/steps are unavailable. Otherwise - informational (extra files)
+	Fatal bool
+	// FileName - for RecordedFileMissing and UnrecordedFile
+	FileName string
+	// Type - type of block files (`headers`) or kind of state files (`accounts.kv`)
+	Type string
+	// From, To - [From, To) of gap: blocks for SegmentsGap, steps for StateFilesGap
+	From, To uint64
+}
+
+func (f ConsistencyFinding) String() string {
+	severity := "info"
+	if f.Fatal {
+		severity = "fatal"
+	}
+	switch f.Kind {
+	case SegmentsGap, StateFilesGap:
+		return fmt.Sprintf("%s %s: %s [%d-%d)", severity, f.Kind, f.Type, f.From, f.To)
+	default:
+		return fmt.Sprintf("%s %s: %s", severity, f.Kind, f.FileName)
+	}
+}
+
+// ConsistencyReport - result of ValidateSnapshotConsistency. Caller decides: proceed, heal (re-download) or abort
+type ConsistencyReport struct {
+	Findings []ConsistencyFinding
+}
+
+func (r ConsistencyReport) Fatal() (res []ConsistencyFinding) {
+	for _, f := range r.Findings {
+		if f.Fatal {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func (r ConsistencyReport) HasFatal() bool { return len(r.Fatal()) > 0 }
+func (r ConsistencyReport) Empty() bool    { return len(r.Findings) == 0 }
+
+// ValidateSnapshotConsistency - strict alternative of RoSnapshots.OptimisticReopenWithDB for node start: compares list of
+// files recorded in DB with files on disk. Block files - only of given `types`, state files - data files of Aggregator
+// (.kv, .v, .ef). Doesn't open files.
+func ValidateSnapshotConsistency(db kv.RoDB, dirs datadir.Dirs, types []snaptype.Type) (report ConsistencyReport, err error) {
+	var blockList, stateList []string
+	if err := db.View(context.Background(), func(tx kv.Tx) (err error) {
+		blockList, stateList, err = rawdb.ReadSnapshots(tx)
+		return err
+	}); err != nil {
+		return report, fmt.Errorf("ValidateSnapshotConsistency: %w", err)
+	}
+	if err := validateBlockFiles(&report, dirs.Snap, blockList, types); err != nil {
+		return report, fmt.Errorf("ValidateSnapshotConsistency: %w", err)
+	}
+	if err := validateStateFiles(&report, dirs, stateList); err != nil {
+		return report, fmt.Errorf("ValidateSnapshotConsistency: %w", err)
+	}
+	return report, nil
+}
+
+func validateBlockFiles(report *ConsistencyReport, snapDir string, recordedList []string, types []snaptype.Type) error {
+	onDisk, err := snaptype.Segments(snapDir)
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		var recorded, present []snaptype.FileInfo
+		for _, name := range recordedList {
+			f, _, ok := snaptype.ParseFileName(snapDir, name)
+			if ok && f.Ext == ".seg" && f.Type != nil && f.Type.Enum() == t.Enum() {
+				recorded = append(recorded, f)
+			}
+		}
+		for _, f := range onDisk {
+			if f.Type.Enum() == t.Enum() {
+				present = append(present, f)
+			}
+		}
+		var expected uint64 // blocks which node expects to have in files
+		for _, f := range recorded {
+			expected = max(expected, f.To)
+			if !slices.ContainsFunc(present, func(p snaptype.FileInfo) bool { return p.Name() == f.Name() }) {
+				report.Findings = append(report.Findings, ConsistencyFinding{Kind: RecordedFileMissing, Fatal: true, FileName: f.Name(), Type: t.Name()})
+			}
+		}
+		for _, f := range present {
+			if !slices.ContainsFunc(recorded, func(r snaptype.FileInfo) bool { return r.Name() == f.Name() }) {
+				report.Findings = append(report.Findings, ConsistencyFinding{Kind: UnrecordedFile, FileName: f.Name(), Type: t.Name()})
+			}
+		}
+		_, gaps := noGaps(noOverlaps(present))
+		for _, gap := range gaps {
+			report.Findings = append(report.Findings, ConsistencyFinding{Kind: SegmentsGap, Fatal: gap.from < expected, Type: t.Name(), From: gap.from, To: gap.to})
+		}
+	}
+	return nil
+}
+
+// stateFile - parsed name of Aggregator's data file: `v1-accounts.0-32.kv`
+type stateFile struct {
+	name     string
+	kind     string // `accounts.kv`
+	from, to uint64 // steps
+}
+
+func parseStateFile(name string) (f stateFile, ok bool) {
+	info, isStateFile, ok := snaptype.ParseFileName("", name)
+	if !ok || !isStateFile {
+		return f, false
+	}
+	base, _, _ := strings.Cut(name, ".")
+	_, base, ok = strings.Cut(base, "-") // remove version
+	if !ok {
+		return f, false
+	}
+	return stateFile{name: name, kind: base + filepath.Ext(name), from: info.From, to: info.To}, true
+}
+
+// stateDataDirs - ext of data files of Aggregator -> dir where they are
+func stateDataDirs(dirs datadir.Dirs) map[string]string {
+	return map[string]string{".kv": dirs.SnapDomain, ".v": dirs.SnapHistory, ".ef": dirs.SnapIdx}
+}
+
+func validateStateFiles(report *ConsistencyReport, dirs datadir.Dirs, recordedList []string) error {
+	recorded := map[string][]stateFile{} // kind -> files
+	for _, name := range recordedList {
+		if f, ok := parseStateFile(name); ok {
+			recorded[f.kind] = append(recorded[f.kind], f)
+		}
+	}
+	present := map[string][]stateFile{}
+	for ext, dir := range stateDataDirs(dirs) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) != ext {
+				continue
+			}
+			if f, ok := parseStateFile(e.Name()); ok {
+				present[f.kind] = append(present[f.kind], f)
+			}
+		}
+	}
+
+	kinds := make([]string, 0, len(recorded)+len(present))
+	for kind := range recorded {
+		kinds = append(kinds, kind)
+	}
+	for kind := range present {
+		if _, ok := recorded[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	slices.Sort(kinds)
+
+	for _, kind := range kinds {
+		var expected uint64 // steps which node expects to have in files
+		for _, f := range recorded[kind] {
+			expected = max(expected, f.to)
+			if !slices.ContainsFunc(present[kind], func(p stateFile) bool { return p.name == f.name }) {
+				report.Findings = append(report.Findings, ConsistencyFinding{Kind: RecordedFileMissing, Fatal: true, FileName: f.name, Type: kind})
+			}
+		}
+		for _, f := range present[kind] {
+			if !slices.ContainsFunc(recorded[kind], func(r stateFile) bool { return r.name == f.name }) {
+				report.Findings = append(report.Findings, ConsistencyFinding{Kind: UnrecordedFile, FileName: f.name, Type: kind})
+			}
+		}
+		for _, gap := range stateFilesGaps(present[kind]) {
+			report.Findings = append(report.Findings, ConsistencyFinding{Kind: StateFilesGap, Fatal: gap.from < expected, Type: kind, From: gap.from, To: gap.to})
+		}
+	}
+	return nil
+}
+
+// stateFilesGaps - ranges of steps not covered by files. State files always start from step 0.
+// Small files covered by merged one are fine: they are deleted after merge
+func stateFilesGaps(files []stateFile) (gaps []Range) {
+	files = slices.Clone(files)
+	slices.SortFunc(files, func(a, b stateFile) int {
+		if c := cmp.Compare(a.from, b.from); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.to, a.to)
+	})
+	var covered uint64
+	for _, f := range files {
+		if f.from > covered {
+			gaps = append(gaps, Range{covered, f.from})
+		}
+		covered = max(covered, f.to)
+	}
+	return gaps
+}
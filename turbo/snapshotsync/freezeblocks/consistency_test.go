@@ -0,0 +1,100 @@
+package freezeblocks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+)
+
+func TestValidateSnapshotConsistency(t *testing.T) {
+	headers := coresnaptype.Enums.Headers
+	types := []snaptype.Type{coresnaptype.Headers}
+	seg := func(from, to uint64) string { return snaptype.SegmentFileName(1, from, to, headers) }
+
+	// fixture: `onDisk` files are created (state files - in their dirs by ext), `recorded` are written to DB
+	validate := func(t *testing.T, onDisk, recorded, recordedState []string) ConsistencyReport {
+		t.Helper()
+		dirs := datadir.New(t.TempDir())
+		db := memdb.NewTestDB(t)
+		for _, name := range onDisk {
+			dir := dirs.Snap
+			if d, ok := stateDataDirs(dirs)[filepath.Ext(name)]; ok {
+				dir = d
+			}
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{1}, 0644))
+		}
+		require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+			return rawdb.WriteSnapshots(tx, recorded, recordedState)
+		}))
+		report, err := ValidateSnapshotConsistency(db, dirs, types)
+		require.NoError(t, err)
+		return report
+	}
+
+	t.Run("consistent", func(t *testing.T) {
+		files := []string{seg(0, 500_000), seg(500_000, 1_000_000)}
+		state := []string{"v1-accounts.0-32.kv", "v1-accounts.32-48.kv", "v1-accounts.0-32.v", "v1-accounts.0-32.ef"}
+		report := validate(t, append(files, state...), files, state)
+		require.True(t, report.Empty(), "%v", report.Findings)
+	})
+
+	t.Run("recorded file missing", func(t *testing.T) {
+		report := validate(t, []string{seg(0, 500_000)}, []string{seg(0, 500_000), seg(500_000, 1_000_000)}, nil)
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: RecordedFileMissing, Fatal: true, FileName: seg(500_000, 1_000_000), Type: coresnaptype.Headers.Name()},
+		}, report.Findings)
+		require.True(t, report.HasFatal())
+	})
+
+	t.Run("unrecorded file", func(t *testing.T) {
+		report := validate(t, []string{seg(0, 500_000), seg(500_000, 1_000_000)}, []string{seg(0, 500_000)}, nil)
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: UnrecordedFile, FileName: seg(500_000, 1_000_000), Type: coresnaptype.Headers.Name()},
+		}, report.Findings)
+		require.False(t, report.HasFatal())
+	})
+
+	t.Run("segments gap", func(t *testing.T) {
+		// gap below recorded blocks is fatal
+		files := []string{seg(0, 500_000), seg(1_000_000, 1_500_000)}
+		report := validate(t, files, files, nil)
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: SegmentsGap, Fatal: true, Type: coresnaptype.Headers.Name(), From: 500_000, To: 1_000_000},
+		}, report.Findings)
+
+		// gap before extra files is informational
+		report = validate(t, files, files[:1], nil)
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: UnrecordedFile, FileName: seg(1_000_000, 1_500_000), Type: coresnaptype.Headers.Name()},
+			{Kind: SegmentsGap, Type: coresnaptype.Headers.Name(), From: 500_000, To: 1_000_000},
+		}, report.Findings)
+		require.False(t, report.HasFatal())
+	})
+
+	t.Run("state files gap", func(t *testing.T) {
+		// small files covered by merged one are not a gap
+		state := []string{"v1-storage.0-32.kv", "v1-storage.0-16.kv", "v1-storage.48-64.kv"}
+		report := validate(t, state, nil, []string{"v1-storage.0-32.kv", "v1-storage.48-64.kv"})
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: UnrecordedFile, FileName: "v1-storage.0-16.kv", Type: "storage.kv"},
+			{Kind: StateFilesGap, Fatal: true, Type: "storage.kv", From: 32, To: 48},
+		}, report.Findings)
+
+		report = validate(t, []string{"v1-code.16-32.ef"}, nil, nil)
+		require.Equal(t, []ConsistencyFinding{
+			{Kind: UnrecordedFile, FileName: "v1-code.16-32.ef", Type: "code.ef"},
+			{Kind: StateFilesGap, Type: "code.ef", From: 0, To: 16},
+		}, report.Findings)
+	})
+}
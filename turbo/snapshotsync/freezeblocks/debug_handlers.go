@@ -0,0 +1,82 @@
+package freezeblocks
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+)
+
+// RegisterDebugHandlers - read-only JSON view of segments inventory for incident response. Embedder mounts it on
+// existing pprof/metrics mux. Doesn't open files - cheap enough to poll every few seconds. nil `s` - responds with empty inventory
+//
+//	/debug/snapshots/segments - availability and all segments of each type with their open/indexed state
+func RegisterDebugHandlers(mux *http.ServeMux, s *RoSnapshots) {
+	mux.HandleFunc("/debug/snapshots/segments", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.debugInventory()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+type DebugSegment struct {
+	Type    string `json:"type"`
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	File    string `json:"file"`
+	Open    bool   `json:"open"`
+	Size    int64  `json:"size"` // 0 if segment is not open
+	Indexed bool   `json:"indexed"`
+}
+
+type DebugSnapshots struct {
+	Dir             string         `json:"dir"`
+	SegmentsReady   bool           `json:"segmentsReady"`
+	IndicesReady    bool           `json:"indicesReady"`
+	SegmentsMin     uint64         `json:"segmentsMin"`
+	SegmentsMax     uint64         `json:"segmentsMax"`
+	IndicesMax      uint64         `json:"indicesMax"`
+	BlocksAvailable uint64         `json:"blocksAvailable"`
+	FilesGeneration uint64         `json:"filesGeneration"`
+	EmptySegments   []string       `json:"emptySegments"`
+	Segments        []DebugSegment `json:"segments"`
+}
+
+func (s *RoSnapshots) debugInventory() DebugSnapshots {
+	if s == nil {
+		return DebugSnapshots{EmptySegments: []string{}, Segments: []DebugSegment{}}
+	}
+	res := DebugSnapshots{
+		Dir:             s.dir,
+		SegmentsReady:   s.SegmentsReady(),
+		IndicesReady:    s.IndicesReady(),
+		SegmentsMin:     s.SegmentsMin(),
+		SegmentsMax:     s.SegmentsMax(),
+		IndicesMax:      s.IndicesMax(),
+		BlocksAvailable: s.BlocksAvailable(),
+		FilesGeneration: s.FilesGeneration(),
+		EmptySegments:   append([]string{}, s.EmptySegments()...),
+		Segments:        []DebugSegment{},
+	}
+	s.segments.Scan(func(segtype snaptype.Enum, value *segments) bool {
+		value.lock.RLock()
+		defer value.lock.RUnlock()
+		for _, seg := range value.segments {
+			ds := DebugSegment{
+				Type:    seg.Type().Name(),
+				From:    seg.from,
+				To:      seg.to,
+				File:    seg.FileName(),
+				Open:    seg.Decompressor != nil,
+				Indexed: seg.IsIndexed(),
+			}
+			if seg.Decompressor != nil {
+				ds.Size = seg.Decompressor.Size()
+			}
+			res.Segments = append(res.Segments, ds)
+		}
+		return true
+	})
+	return res
+}
@@ -0,0 +1,72 @@
+package freezeblocks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+)
+
+func TestRegisterDebugHandlers(t *testing.T) {
+	getInventory := func(t *testing.T, s *RoSnapshots) (inv DebugSnapshots) {
+		t.Helper()
+		mux := http.NewServeMux()
+		RegisterDebugHandlers(mux, s)
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL + "/debug/snapshots/segments")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		var raw map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(body, &raw))
+		for _, field := range []string{"segmentsMax", "indicesMax", "blocksAvailable", "filesGeneration", "emptySegments", "segments"} {
+			require.Contains(t, raw, field)
+		}
+		require.NoError(t, json.Unmarshal(body, &inv))
+		return inv
+	}
+
+	t.Run("snapshots", func(t *testing.T) {
+		logger := log.New()
+		dir := t.TempDir()
+		var fileNames []string
+		for _, typ := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, 0, 500_000, typ.Enum(), dir, 1, logger)
+			fileNames = append(fileNames, snaptype.SegmentFileName(1, 0, 500_000, typ.Enum()))
+		}
+		s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dir, 0, logger)
+		defer s.Close()
+		require.NoError(t, s.ReopenList(fileNames, false))
+
+		inv := getInventory(t, s)
+		require.Equal(t, dir, inv.Dir)
+		require.Equal(t, s.BlocksAvailable(), inv.BlocksAvailable)
+		require.Equal(t, s.FilesGeneration(), inv.FilesGeneration)
+		require.Len(t, inv.Segments, len(coresnaptype.BlockSnapshotTypes))
+		for _, seg := range inv.Segments {
+			require.True(t, seg.Open, seg.File)
+			require.True(t, seg.Indexed, seg.File)
+			require.Positive(t, seg.Size, seg.File)
+			require.Equal(t, uint64(500_000), seg.To)
+		}
+	})
+
+	t.Run("nil snapshots", func(t *testing.T) {
+		inv := getInventory(t, nil)
+		require.Empty(t, inv.Segments)
+	})
+}
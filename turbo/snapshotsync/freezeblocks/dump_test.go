@@ -2,9 +2,14 @@ package freezeblocks_test
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
 	"math/big"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/ledgerwatch/erigon/polygon/bor/borcfg"
 
@@ -17,11 +22,22 @@ import (
 
 	"github.com/ledgerwatch/erigon-lib/chain"
 	libcommon "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/dbutils"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
 	types2 "github.com/ledgerwatch/erigon-lib/types"
 	"github.com/ledgerwatch/erigon/common/math"
 	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/rawdb/blockio"
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
 	"github.com/ledgerwatch/erigon/core/types"
 	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
 	"github.com/ledgerwatch/erigon/ethdb/prune"
 	"github.com/ledgerwatch/erigon/params"
 	"github.com/ledgerwatch/erigon/rlp"
@@ -207,7 +223,7 @@ func TestDump(t *testing.T) {
 			firstTxNum += txsAmount
 			i = 0
 			baseIdList = baseIdList[:0]
-			_, err = freezeblocks.DumpBodies(m.Ctx, m.DB, m.ChainConfig, 2, uint64(2*test.chainSize), func(context.Context) uint64 { return firstTxNum }, func(v []byte) error {
+			_, err = freezeblocks.DumpBodies(m.Ctx, m.DB, m.ChainConfig, 2, uint64(test.chainSize+1), func(context.Context) uint64 { return firstTxNum }, func(v []byte) error {
 				i++
 				body := &types.BodyForStorage{}
 				require.NoError(rlp.DecodeBytes(v, body))
@@ -251,12 +267,74 @@ func TestDump(t *testing.T) {
 			snConfig := snapcfg.KnownCfg(networkname.MainnetChainName)
 			snConfig.ExpectBlocks = math.MaxUint64
 
-			err := freezeblocks.DumpBlocks(m.Ctx, 0, uint64(test.chainSize), m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, m.BlockReader)
+			err := freezeblocks.DumpBlocks(m.Ctx, 0, uint64(test.chainSize), m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, m.BlockReader, dir.FsyncNone, freezeblocks.Provenance{}, 0)
 			require.NoError(err)
 		})
 	}
 }
 
+func TestDumpBodiesMissedBody(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+
+	chainSize := 10
+	m := createDumpTestKV(t, params.TestChainConfig, chainSize)
+
+	missedBlock := uint64(5)
+	tx, err := m.DB.BeginRw(m.Ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	hash, err := rawdb.ReadCanonicalHash(tx, missedBlock)
+	require.NoError(t, err)
+	rawdb.DeleteBody(tx, hash, missedBlock)
+	require.NoError(t, tx.Commit())
+
+	collect := func(v []byte) error { return nil }
+	firstTxNum := func(context.Context) uint64 { return 0 }
+
+	_, err = freezeblocks.DumpBodies(m.Ctx, m.DB, m.ChainConfig, 0, uint64(chainSize+1), firstTxNum, collect, 1, log.LvlInfo, log.New())
+	require.ErrorIs(t, err, freezeblocks.ErrBodyMissed)
+	require.Contains(t, err.Error(), fmt.Sprintf("block_num=%d", missedBlock))
+	require.Contains(t, err.Error(), fmt.Sprintf("%x", hash))
+
+	_, missed, err := freezeblocks.DumpBodiesAllowMissing(m.Ctx, m.DB, 0, uint64(chainSize+1), firstTxNum, collect, log.LvlInfo, log.New())
+	require.NoError(t, err)
+	require.Equal(t, []uint64{missedBlock}, missed)
+}
+
+func TestDumpHeadersHashMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+	require := require.New(t)
+	m := createDumpTestKV(t, params.BorDevnetChainConfig, 10)
+
+	// header RLP doesn't match canonical hash: first byte in segment would be wrong
+	require.NoError(m.DB.Update(m.Ctx, func(tx kv.RwTx) error {
+		hash, err := rawdb.ReadCanonicalHash(tx, 5)
+		if err != nil {
+			return err
+		}
+		h := rawdb.ReadHeader(tx, hash, 5)
+		h.Extra = []byte("corrupted")
+		data, err := rlp.EncodeToBytes(h)
+		if err != nil {
+			return err
+		}
+		return tx.Put(kv.Headers, dbutils.HeaderKey(5, hash), data)
+	}))
+
+	var collected int
+	_, err := freezeblocks.DumpHeaders(m.Ctx, m.DB, m.ChainConfig, 0, 10, nil, func(v []byte) error {
+		collected++
+		return nil
+	}, 1, log.LvlInfo, log.New())
+	require.ErrorIs(err, freezeblocks.ErrHeaderHashMismatch)
+	require.ErrorContains(err, "block_num=5")
+	require.Equal(5, collected)
+}
+
 func createDumpTestKV(t *testing.T, chainConfig *chain.Config, chainSize int) *mock.MockSentry {
 	var (
 		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
@@ -289,3 +367,296 @@ func createDumpTestKV(t *testing.T, chainConfig *chain.Config, chainSize int) *m
 
 	return m
 }
+
+// restart in the middle of blocks retire: segments which were dumped are not dumped again
+func TestRetireBlocksAfterRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+	require, logger := require.New(t), log.New()
+	chainSize := 2100 // [0, 1000) is retired: last blocks stay in DB
+	m := createDumpTestKV(t, params.TestChainConfig, chainSize)
+	dirs := datadir.New(t.TempDir())
+	newRetire := func() *freezeblocks.BlockRetire { // restart: only files and db survive
+		s := freezeblocks.NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+		t.Cleanup(s.Close)
+		require.NoError(s.ReopenFolder())
+		return freezeblocks.NewBlockRetire(1, dirs, freezeblocks.NewBlockReader(s, nil), blockio.NewBlockWriter(), m.DB, m.ChainConfig, nil, nil, logger)
+	}
+	retire := func() error {
+		return newRetire().RetireBlocks(m.Ctx, 0, uint64(chainSize), log.LvlInfo, nil, nil, nil)
+	}
+	segment := func(t snaptype.Type) string {
+		return filepath.Join(dirs.Snap, snaptype.SegmentFileName(1, 0, 1000, t.Enum()))
+	}
+
+	// transaction of block 10 can't be parsed: retire fails after headers and bodies are dumped
+	txKey, txVal := make([]byte, 8), []byte(nil)
+	require.NoError(m.DB.Update(m.Ctx, func(tx kv.RwTx) error {
+		hash, err := rawdb.ReadCanonicalHash(tx, 10)
+		if err != nil {
+			return err
+		}
+		body, err := rawdb.ReadBodyForStorageByKey(tx, dbutils.BlockBodyKey(10, hash))
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(txKey, body.BaseTxnID.First())
+		if txVal, err = tx.GetOne(kv.EthTx, txKey); err != nil {
+			return err
+		}
+		txVal = libcommon.Copy(txVal)
+		return tx.Put(kv.EthTx, txKey, []byte{0xff})
+	}))
+	require.Error(retire())
+	require.NoFileExists(segment(coresnaptype.Transactions))
+	dumped := map[snaptype.Type]os.FileInfo{}
+	for _, typ := range []snaptype.Type{coresnaptype.Headers, coresnaptype.Bodies} {
+		var err error
+		dumped[typ], err = os.Stat(segment(typ))
+		require.NoError(err)
+	}
+	require.NoError(m.DB.View(m.Ctx, func(tx kv.Tx) error {
+		progress, err := rawdb.ReadRetireProgress(tx)
+		require.NoError(err)
+		require.Len(progress.Dumped, 2)
+		return nil
+	}))
+
+	require.NoError(m.DB.Update(m.Ctx, func(tx kv.RwTx) error { return tx.Put(kv.EthTx, txKey, txVal) }))
+	require.NoError(retire())
+	for typ, before := range dumped {
+		after, err := os.Stat(segment(typ))
+		require.NoError(err)
+		require.True(os.SameFile(before, after), "%s is dumped again", typ.Name())
+	}
+	require.FileExists(segment(coresnaptype.Transactions))
+	require.NoError(m.DB.View(m.Ctx, func(tx kv.Tx) error {
+		progress, err := rawdb.ReadRetireProgress(tx)
+		require.NoError(err)
+		require.True(progress.Empty(), "retire cycle is finished")
+		return nil
+	}))
+
+	s := freezeblocks.NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenFolder())
+	require.Equal(uint64(999), s.BlocksAvailable())
+	require.NoError(freezeblocks.NewBlockReader(s, nil).IntegrityTxnHash2BlockNum(m.Ctx, true, 0, true))
+}
+
+func TestIntegrityTxnHash2BlockNum(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+	require, logger := require.New(t), log.New()
+	chainSize := 1000
+	m := createDumpTestKV(t, params.TestChainConfig, chainSize)
+
+	tmpDir, snapDir := t.TempDir(), t.TempDir()
+	err := freezeblocks.DumpBlocks(m.Ctx, 0, uint64(chainSize), m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, m.BlockReader, dir.FsyncNone, freezeblocks.Provenance{}, 0)
+	require.NoError(err)
+
+	integrity := func(full bool) error {
+		s := freezeblocks.NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, snapDir, 0, logger)
+		defer s.Close()
+		require.NoError(s.ReopenFolder())
+		return freezeblocks.NewBlockReader(s, nil).IntegrityTxnHash2BlockNum(m.Ctx, true, 0, full)
+	}
+	require.NoError(integrity(true))
+	require.NoError(integrity(false))
+
+	// rebuild -to-block.idx with off-by-one
+	var hashes []libcommon.Hash
+	var blockNums []uint64
+	require.NoError(m.DB.View(m.Ctx, func(tx kv.Tx) error {
+		for blockNum := uint64(0); blockNum < uint64(chainSize); blockNum++ {
+			b, err := m.BlockReader.BlockByNumber(m.Ctx, tx, blockNum)
+			if err != nil {
+				return err
+			}
+			for _, txn := range b.Transactions() {
+				hashes = append(hashes, txn.Hash())
+				blockNums = append(blockNums, blockNum)
+			}
+		}
+		return nil
+	}))
+	idxFile := filepath.Join(snapDir, snaptype.IdxFileName(1, 0, uint64(chainSize), coresnaptype.Indexes.TxnHash2BlockNum.Name))
+	require.NoError(os.Remove(idxFile))
+	idx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   len(hashes),
+		BucketSize: 2000,
+		LeafSize:   8,
+		TmpDir:     tmpDir,
+		IndexFile:  idxFile,
+	}, logger)
+	require.NoError(err)
+	defer idx.Close()
+	idx.DisableFsync()
+	for i, h := range hashes {
+		require.NoError(idx.AddKey(h[:], blockNums[i]+1))
+	}
+	require.NoError(idx.Build(m.Ctx))
+
+	txsFileName := snaptype.SegmentFileName(1, 0, uint64(chainSize), coresnaptype.Transactions.Enum())
+	err = integrity(true)
+	require.ErrorContains(err, txsFileName)
+	require.ErrorContains(err, "block_num=1, txn_idx=0")
+	require.ErrorContains(err, "TxnHash2BlockNum index returned block_num=2")
+
+	err = integrity(false)
+	require.ErrorContains(err, "block_num=100, txn_idx=0")
+}
+
+func TestTxnHashIdxShards(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+	require, logger := require.New(t), log.New()
+	chainSize, shards := 2000, 4
+	m := createDumpTestKV(t, params.TestChainConfig, chainSize)
+
+	tmpDir, snapDir := t.TempDir(), t.TempDir()
+	openSnapshots := func() *freezeblocks.RoSnapshots {
+		s := freezeblocks.NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, snapDir, 0, logger)
+		require.NoError(s.ReopenFolder())
+		return s
+	}
+	// mixed datadir: first segment has single-file indices, second - sharded
+	require.NoError(freezeblocks.DumpBlocks(m.Ctx, 0, 1000, m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, m.BlockReader, dir.FsyncNone, freezeblocks.Provenance{}, 0))
+	s := openSnapshots()
+	require.NoError(freezeblocks.DumpBlocks(m.Ctx, 1000, uint64(chainSize), m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, freezeblocks.NewBlockReader(s, nil), dir.FsyncNone, freezeblocks.Provenance{}, shards))
+	s.Close()
+
+	require.FileExists(filepath.Join(snapDir, snaptype.IdxFileName(1, 0, 1000, coresnaptype.Indexes.TxnHash.Name)))
+	require.NoFileExists(filepath.Join(snapDir, snaptype.IdxFileName(1, 1000, 2000, coresnaptype.Indexes.TxnHash.Name)))
+	require.NoFileExists(filepath.Join(snapDir, snaptype.IdxFileName(1, 1000, 2000, coresnaptype.Indexes.TxnHash2BlockNum.Name)))
+	shardFile := func(index snaptype.Index, shard int) string {
+		return filepath.Join(snapDir, snaptype.IdxShardFileName(1, 1000, 2000, index.Name, shard, shards))
+	}
+	for shard := 0; shard < shards; shard++ {
+		require.FileExists(shardFile(coresnaptype.Indexes.TxnHash, shard))
+		require.FileExists(shardFile(coresnaptype.Indexes.TxnHash2BlockNum, shard))
+	}
+
+	var hashes []libcommon.Hash
+	var blockNums []uint64
+	require.NoError(m.DB.View(m.Ctx, func(tx kv.Tx) error {
+		for blockNum := uint64(0); blockNum < uint64(chainSize); blockNum++ {
+			b, err := m.BlockReader.BlockByNumber(m.Ctx, tx, blockNum)
+			if err != nil {
+				return err
+			}
+			for _, txn := range b.Transactions() {
+				hashes = append(hashes, txn.Hash())
+				blockNums = append(blockNums, blockNum)
+			}
+		}
+		return nil
+	}))
+	require.Equal(0, snaptype.IdxShardOf([]byte{0x3f}, shards))
+	require.Equal(1, snaptype.IdxShardOf([]byte{0x40}, shards))
+	require.Equal(shards-1, snaptype.IdxShardOf([]byte{0xff}, shards))
+
+	_, tx := memdb.NewTestTx(t) // no txn lookup entries in DB: lookups go to segments
+	check := func() {
+		s := openSnapshots()
+		defer s.Close()
+		br := freezeblocks.NewBlockReader(s, nil)
+		require.NoError(br.IntegrityTxnHash2BlockNum(m.Ctx, true, 0, true))
+
+		hitShards := map[int]bool{}
+		for i, h := range hashes {
+			blockNum, ok, err := br.TxnLookup(m.Ctx, tx, h)
+			require.NoError(err)
+			require.True(ok, h)
+			require.Equal(blockNums[i], blockNum, h)
+			if blockNum >= 1000 {
+				hitShards[snaptype.IdxShardOf(h[:], shards)] = true
+			}
+		}
+		require.Len(hitShards, shards, "lookups in all shards")
+		_, ok, err := br.TxnLookup(m.Ctx, tx, libcommon.Hash{0xff, 1})
+		require.NoError(err)
+		require.False(ok)
+
+		// ordinal lookups are served by ordinals index of sharded layout
+		for _, blockNum := range []uint64{1, 999, 1000, 1001, uint64(chainSize) - 1} {
+			txn, err := br.TxnByIdxInBlock(m.Ctx, tx, blockNum, 0)
+			require.NoError(err)
+			require.NotNil(txn, blockNum)
+			i := 0
+			for blockNums[i] != blockNum {
+				i++
+			}
+			require.Equal(hashes[i], txn.Hash(), blockNum)
+		}
+	}
+	check()
+
+	// bad shard: rebuild -to-block shard 1 with off-by-one
+	badShard := 1
+	var shardHashes []libcommon.Hash
+	var shardBlockNums []uint64
+	for i, h := range hashes {
+		if blockNums[i] >= 1000 && snaptype.IdxShardOf(h[:], shards) == badShard {
+			shardHashes, shardBlockNums = append(shardHashes, h), append(shardBlockNums, blockNums[i])
+		}
+	}
+	require.NoError(os.Remove(shardFile(coresnaptype.Indexes.TxnHash2BlockNum, badShard)))
+	idx, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
+		KeyCount:   len(shardHashes),
+		BucketSize: 2000,
+		LeafSize:   8,
+		TmpDir:     tmpDir,
+		IndexFile:  shardFile(coresnaptype.Indexes.TxnHash2BlockNum, badShard),
+	}, logger)
+	require.NoError(err)
+	defer idx.Close()
+	idx.DisableFsync()
+	for i, h := range shardHashes {
+		require.NoError(idx.AddKey(h[:], shardBlockNums[i]+1))
+	}
+	require.NoError(idx.Build(m.Ctx))
+
+	s = openSnapshots()
+	err = freezeblocks.NewBlockReader(s, nil).IntegrityTxnHash2BlockNum(m.Ctx, true, 0, true)
+	s.Close()
+	require.ErrorContains(err, "TxnHash2BlockNum index returned block_num=")
+	require.ErrorContains(err, filepath.Base(shardFile(coresnaptype.Indexes.TxnHash2BlockNum, badShard)))
+
+	// only bad shard is rebuilt
+	modTimes := map[string]time.Time{}
+	for shard := 0; shard < shards; shard++ {
+		if shard == badShard {
+			continue
+		}
+		for _, f := range []string{shardFile(coresnaptype.Indexes.TxnHash, shard), shardFile(coresnaptype.Indexes.TxnHash2BlockNum, shard)} {
+			st, err := os.Stat(f)
+			require.NoError(err)
+			modTimes[f] = st.ModTime()
+		}
+	}
+	info := coresnaptype.Transactions.FileInfo(snapDir, 1000, uint64(chainSize))
+	require.Error(coresnaptype.BuildTxnHashIdxShard(m.Ctx, info, shards, m.ChainConfig, tmpDir, nil, logger))
+	require.NoError(coresnaptype.BuildTxnHashIdxShard(m.Ctx, info, badShard, m.ChainConfig, tmpDir, nil, logger))
+	for f, modTime := range modTimes {
+		st, err := os.Stat(f)
+		require.NoError(err)
+		require.Equal(modTime, st.ModTime(), f)
+	}
+	check()
+
+	// shard can be rebuilt after removal
+	require.NoError(os.Remove(shardFile(coresnaptype.Indexes.TxnHash, badShard)))
+	require.NoError(coresnaptype.BuildTxnHashIdxShard(m.Ctx, info, badShard, m.ChainConfig, tmpDir, nil, logger))
+	check()
+
+	// leftover of other layout: shard files disagree about amount of shards
+	leftover := filepath.Join(snapDir, snaptype.IdxShardFileName(1, 1000, 2000, coresnaptype.Indexes.TxnHash.Name, 0, shards*2))
+	require.NoError(os.WriteFile(leftover, nil, 0644))
+	_, err = coresnaptype.Indexes.TxnHash.Shards(info)
+	require.ErrorContains(err, "different amount of shards")
+	require.Error(coresnaptype.BuildTxnHashIdxShard(m.Ctx, info, badShard, m.ChainConfig, tmpDir, nil, logger))
+}
@@ -0,0 +1,296 @@
+package freezeblocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+
+	"github.com/ledgerwatch/erigon/cl/merkle_tree"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Era1 - cross-client archive format of pre-merge blocks. File of 1 epoch is:
+//
+//	Version | (CompressedHeader | CompressedBody | CompressedReceipts | TotalDifficulty)* | Accumulator | BlockIndex
+//
+// every entry is e2store record: type (2 bytes LE) | length (4 bytes LE) | reserved (2 bytes) | data.
+// Compressed entries are snappy-framed RLP, TotalDifficulty is uint256 LE, Accumulator is SSZ hash_tree_root
+// of List[HeaderRecord(hash, td), Era1EpochSize], BlockIndex is: first block | offsets of blocks relative to BlockIndex | count.
+const Era1EpochSize = 8192
+
+const (
+	e2Version            uint16 = 0x3265
+	e2CompressedHeader   uint16 = 0x03
+	e2CompressedBody     uint16 = 0x04
+	e2CompressedReceipts uint16 = 0x05
+	e2TotalDifficulty    uint16 = 0x06
+	e2Accumulator        uint16 = 0x07
+	e2BlockIndex         uint16 = 0x3266
+
+	e2HeaderSize = 8
+)
+
+var ErrEra1BlockNotFound = errors.New("block not found in snapshots")
+
+type Era1ExportCfg struct {
+	Network string // prefix of file names: <network>-<epoch>-<short accumulator root>.era1
+
+	// TD - total difficulty of given block: block files don't store it. Called once per epoch (for block before epoch),
+	// TD of other blocks is computed by adding difficulties. nil - allowed only for export from genesis, then epochs are
+	// exported sequentially.
+	TD func(blockNum uint64) (*big.Int, error)
+
+	// Receipts - block files don't store receipts. nil - empty list is written (valid only for blocks without txs)
+	Receipts func(block *types.Block) (types.Receipts, error)
+}
+
+// ExportEra1 - writes blocks [from, to) from block snapshots to era1 files: 1 file per Era1EpochSize blocks.
+// `from` must be beginning of epoch, last file may have less blocks.
+func ExportEra1(ctx context.Context, s *RoSnapshots, from, to uint64, outDir string, workers int, cfg Era1ExportCfg) error {
+	if from%Era1EpochSize != 0 {
+		return fmt.Errorf("ExportEra1: from=%d is not beginning of epoch (%d blocks)", from, Era1EpochSize)
+	}
+	if to <= from {
+		return fmt.Errorf("ExportEra1: empty range %d-%d", from, to)
+	}
+	if to > s.BlocksAvailable()+1 {
+		return fmt.Errorf("ExportEra1: range %d-%d: %w, available up to %d", from, to, ErrEra1BlockNotFound, s.BlocksAvailable())
+	}
+	if cfg.Network == "" {
+		return errors.New("ExportEra1: network name is required")
+	}
+	if cfg.TD == nil && from > 0 {
+		return errors.New("ExportEra1: TD lookup is required for export not from genesis")
+	}
+	dir.MustExist(outDir)
+
+	r := NewBlockReader(s, nil)
+	view := s.View()
+	defer view.Close()
+
+	if cfg.TD == nil { // TD is carried from genesis
+		td := new(big.Int)
+		for epochFrom := from; epochFrom < to; epochFrom += Era1EpochSize {
+			if err := exportEra1Epoch(ctx, r, view, epochFrom, min(epochFrom+Era1EpochSize, to), td, outDir, cfg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(workers, 1))
+	for epochFrom := from; epochFrom < to; epochFrom += Era1EpochSize {
+		epochFrom := epochFrom
+		g.Go(func() error {
+			td := new(big.Int)
+			if epochFrom > 0 {
+				parentTD, err := cfg.TD(epochFrom - 1)
+				if err != nil {
+					return fmt.Errorf("ExportEra1: TD of block %d: %w", epochFrom-1, err)
+				}
+				td.Set(parentTD)
+			}
+			return exportEra1Epoch(ctx, r, view, epochFrom, min(epochFrom+Era1EpochSize, to), td, outDir, cfg)
+		})
+	}
+	return g.Wait()
+}
+
+// exportEra1Epoch - `td` is TD of block before `from`, it's advanced to TD of `to-1`
+func exportEra1Epoch(ctx context.Context, r *BlockReader, view *View, from, to uint64, td *big.Int, outDir string, cfg Era1ExportCfg) (err error) {
+	epoch := from / Era1EpochSize
+	tmpPath := filepath.Join(outDir, fmt.Sprintf("%s-%05d.era1.tmp", cfg.Network, epoch))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	w := &e2Writer{w: bufio.NewWriter(f)}
+	if err = w.write(e2Version, nil); err != nil {
+		return err
+	}
+	offsets := make([]int64, 0, to-from)
+	records := make([][32]byte, 0, to-from)
+	var buf []byte
+	for blockNum := from; blockNum < to; blockNum++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		var block *types.Block
+		if block, buf, err = blockFromView(r, view, blockNum, buf); err != nil {
+			return err
+		}
+		receipts := types.Receipts{}
+		if cfg.Receipts != nil {
+			if receipts, err = cfg.Receipts(block); err != nil {
+				return fmt.Errorf("receipts of block %d: %w", blockNum, err)
+			}
+		}
+		td.Add(td, block.Difficulty())
+		tdLE := era1TD(td)
+
+		offsets = append(offsets, w.offset)
+		if err = w.writeSnappyRLP(e2CompressedHeader, block.HeaderNoCopy()); err != nil {
+			return err
+		}
+		if err = w.writeSnappyRLP(e2CompressedBody, block.Body()); err != nil {
+			return err
+		}
+		if err = w.writeSnappyRLP(e2CompressedReceipts, receipts); err != nil {
+			return err
+		}
+		if err = w.write(e2TotalDifficulty, tdLE[:]); err != nil {
+			return err
+		}
+		hash := block.Hash()
+		records = append(records, sha256.Sum256(append(hash[:], tdLE[:]...)))
+	}
+
+	root, err := era1Accumulator(records)
+	if err != nil {
+		return err
+	}
+	if err = w.write(e2Accumulator, root[:]); err != nil {
+		return err
+	}
+	index := make([]byte, 8+8*len(offsets)+8)
+	binary.LittleEndian.PutUint64(index, from)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint64(index[8+8*i:], uint64(offset-w.offset))
+	}
+	binary.LittleEndian.PutUint64(index[len(index)-8:], uint64(len(offsets)))
+	if err = w.write(e2BlockIndex, index); err != nil {
+		return err
+	}
+	if err = w.w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(outDir, Era1FileName(cfg.Network, epoch, root))); err != nil {
+		return err
+	}
+	return dir.FsyncDir(outDir)
+}
+
+func Era1FileName(network string, epoch uint64, accumulatorRoot [32]byte) string {
+	return fmt.Sprintf("%s-%05d-%x.era1", network, epoch, accumulatorRoot[:4])
+}
+
+// blockFromView - same as BlockReader.BlockWithSenders, but doesn't open View: caller already holds it
+func blockFromView(r *BlockReader, view *View, blockNum uint64, buf []byte) (*types.Block, []byte, error) {
+	headersSeg, ok := view.HeadersSegment(blockNum)
+	if !ok {
+		return nil, buf, fmt.Errorf("header %d: %w", blockNum, ErrEra1BlockNotFound)
+	}
+	h, buf, err := r.headerFromSnapshot(blockNum, headersSeg, buf)
+	if err != nil {
+		return nil, buf, err
+	}
+	if h == nil {
+		return nil, buf, fmt.Errorf("header %d: %w", blockNum, ErrEra1BlockNotFound)
+	}
+	bodiesSeg, ok := view.BodiesSegment(blockNum)
+	if !ok {
+		return nil, buf, fmt.Errorf("body %d: %w", blockNum, ErrEra1BlockNotFound)
+	}
+	body, baseTxnID, txCount, buf, err := r.bodyFromSnapshot(blockNum, bodiesSeg, buf)
+	if err != nil {
+		return nil, buf, err
+	}
+	if body == nil {
+		return nil, buf, fmt.Errorf("body %d: %w", blockNum, ErrEra1BlockNotFound)
+	}
+	var txs []types.Transaction
+	if txCount > 0 {
+		txsSeg, ok := view.TxsSegment(blockNum)
+		if !ok {
+			return nil, buf, fmt.Errorf("txs of block %d: %w", blockNum, ErrEra1BlockNotFound)
+		}
+		if txs, _, err = r.txsFromSnapshot(baseTxnID, txCount, txsSeg, buf); err != nil {
+			return nil, buf, err
+		}
+		if txs == nil {
+			return nil, buf, fmt.Errorf("txs of block %d: %w", blockNum, ErrEra1BlockNotFound)
+		}
+	}
+	return types.NewBlockFromStorage(h.Hash(), h, txs, body.Uncles, body.Withdrawals, body.Requests), buf, nil
+}
+
+// era1TD - uint256 LE
+func era1TD(td *big.Int) (res [32]byte) {
+	td.FillBytes(res[:])
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// era1Accumulator - hash_tree_root of List[HeaderRecord, Era1EpochSize]. `records` - roots of HeaderRecord, they are overwritten
+func era1Accumulator(records [][32]byte) ([32]byte, error) {
+	count := len(records)
+	root, err := merkle_tree.MerkleizeVector(records, Era1EpochSize)
+	if err != nil {
+		return root, err
+	}
+	var length [32]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(count))
+	return sha256.Sum256(append(root[:], length[:]...)), nil
+}
+
+type e2Writer struct {
+	w      *bufio.Writer
+	offset int64
+}
+
+func (w *e2Writer) write(typ uint16, data []byte) error {
+	var header [e2HeaderSize]byte
+	binary.LittleEndian.PutUint16(header[:], typ)
+	binary.LittleEndian.PutUint32(header[2:], uint32(len(data)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.offset += int64(e2HeaderSize + len(data))
+	return nil
+}
+
+func (w *e2Writer) writeSnappyRLP(typ uint16, v interface{}) error {
+	var b bytes.Buffer
+	sw := snappy.NewBufferedWriter(&b)
+	if err := rlp.Encode(sw, v); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	return w.write(typ, b.Bytes())
+}
@@ -0,0 +1,151 @@
+package freezeblocks_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/rlp"
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync/freezeblocks"
+)
+
+func TestExportEra1(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win")
+	}
+	logger := log.New()
+	require := require.New(t)
+
+	chainSize := uint64(1000)
+	m := createDumpTestKV(t, params.BorDevnetChainConfig, int(chainSize))
+	tmpDir, snapDir, outDir := t.TempDir(), t.TempDir(), t.TempDir()
+	require.NoError(freezeblocks.DumpBlocks(m.Ctx, 0, chainSize, m.ChainConfig, tmpDir, snapDir, m.DB, 1, log.LvlInfo, logger, m.BlockReader, dir.FsyncNone, freezeblocks.Provenance{}, 0))
+	s := freezeblocks.NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, snapDir, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenFolder())
+
+	err := freezeblocks.ExportEra1(m.Ctx, s, 0, chainSize+1, outDir, 2, freezeblocks.Era1ExportCfg{Network: "devnet"})
+	require.ErrorIs(err, freezeblocks.ErrEra1BlockNotFound)
+	err = freezeblocks.ExportEra1(m.Ctx, s, 1, chainSize, outDir, 2, freezeblocks.Era1ExportCfg{Network: "devnet"}) // not beginning of epoch
+	require.Error(err)
+
+	require.NoError(freezeblocks.ExportEra1(m.Ctx, s, 0, chainSize, outDir, 2, freezeblocks.Era1ExportCfg{Network: "devnet"}))
+	files, err := filepath.Glob(filepath.Join(outDir, "*"))
+	require.NoError(err)
+	require.Len(files, 1)
+	require.True(strings.HasPrefix(filepath.Base(files[0]), "devnet-00000-"), files[0])
+	require.True(strings.HasSuffix(files[0], ".era1"))
+
+	start, blocks := readEra1(t, files[0])
+	require.Zero(start)
+	require.Len(blocks, int(chainSize))
+
+	br := freezeblocks.NewBlockReader(s, nil)
+	td := new(big.Int)
+	var txsAmount int
+	for i, b := range blocks {
+		h, err := br.HeaderByNumber(m.Ctx, nil, uint64(i))
+		require.NoError(err)
+		require.NotNil(h)
+		require.Equal(h.Hash(), b.header.Hash())
+
+		body, err := br.BodyWithTransactions(m.Ctx, nil, h.Hash(), uint64(i))
+		require.NoError(err)
+		require.Equal(len(body.Transactions), len(b.body.Transactions))
+		for j, txn := range body.Transactions {
+			require.Equal(txn.Hash(), b.body.Transactions[j].Hash())
+		}
+		txsAmount += len(b.body.Transactions)
+
+		td.Add(td, h.Difficulty)
+		require.Zero(td.Cmp(b.td), "block %d", i)
+	}
+	require.Equal(int(chainSize)-1, txsAmount) // 1 txn per block except genesis
+}
+
+type era1Block struct {
+	header *types.Header
+	body   *types.Body
+	td     *big.Int
+}
+
+// readEra1 - parses e2store entries of era1 file and checks block index
+func readEra1(t *testing.T, path string) (start uint64, blocks []era1Block) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	unsnappy := func(b []byte) []byte {
+		res, err := io.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+		require.NoError(t, err)
+		return res
+	}
+
+	var headerOffsets []int
+	var hasVersion, hasAccumulator, hasIndex bool
+	for pos := 0; pos < len(data); {
+		require.GreaterOrEqual(t, len(data)-pos, 8)
+		typ, size := binary.LittleEndian.Uint16(data[pos:]), int(binary.LittleEndian.Uint32(data[pos+2:]))
+		payload := data[pos+8 : pos+8+size]
+		switch typ {
+		case 0x3265:
+			require.Zero(t, pos)
+			hasVersion = true
+		case 0x03:
+			h := new(types.Header)
+			require.NoError(t, rlp.DecodeBytes(unsnappy(payload), h))
+			blocks = append(blocks, era1Block{header: h})
+			headerOffsets = append(headerOffsets, pos)
+		case 0x04:
+			body := new(types.Body)
+			require.NoError(t, rlp.DecodeBytes(unsnappy(payload), body))
+			blocks[len(blocks)-1].body = body
+		case 0x05:
+			var receipts types.Receipts
+			require.NoError(t, rlp.DecodeBytes(unsnappy(payload), &receipts))
+		case 0x06:
+			require.Len(t, payload, 32)
+			be := make([]byte, 32)
+			for i := range payload {
+				be[31-i] = payload[i]
+			}
+			blocks[len(blocks)-1].td = new(big.Int).SetBytes(be)
+		case 0x07:
+			require.Len(t, payload, 32)
+			hasAccumulator = true
+			require.Contains(t, filepath.Base(path), fmt.Sprintf("-%x.era1", payload[:4]))
+		case 0x3266:
+			hasIndex = true
+			start = binary.LittleEndian.Uint64(payload)
+			count := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+			require.Equal(t, len(blocks), int(count))
+			for i := range headerOffsets {
+				offset := int64(binary.LittleEndian.Uint64(payload[8+8*i:]))
+				require.Equal(t, headerOffsets[i], pos+int(offset))
+			}
+			require.Equal(t, len(data), pos+8+size) // index is last entry
+		default:
+			t.Fatalf("unexpected entry type %x", typ)
+		}
+		pos += 8 + size
+	}
+	require.True(t, hasVersion)
+	require.True(t, hasAccumulator)
+	require.True(t, hasIndex)
+	return start, blocks
+}
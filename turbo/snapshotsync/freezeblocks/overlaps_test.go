@@ -0,0 +1,209 @@
+package freezeblocks
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+)
+
+// noOverlapsQuadratic - previous implementation of noOverlaps, reference for exact selection semantics
+func noOverlapsQuadratic(in []snaptype.FileInfo) (res []snaptype.FileInfo) {
+	for i := range in {
+		f := in[i]
+		if f.From == f.To {
+			continue
+		}
+		if len(res) > 0 && res[len(res)-1].To >= f.To {
+			continue
+		}
+
+		for j := i + 1; j < len(in); j++ {
+			f2 := in[j]
+			if f2.From == f2.To {
+				continue
+			}
+			if f2.From > f.From {
+				break
+			}
+			f = f2
+			i++ //nolint:ineffassign
+		}
+
+		res = append(res, f)
+	}
+
+	return res
+}
+
+// findOverlapsReference - previous implementation of findOverlaps, reference for exact selection semantics
+func findOverlapsReference(in []snaptype.FileInfo) (res []snaptype.FileInfo, overlapped []snaptype.FileInfo) {
+	for i := 0; i < len(in); i++ {
+		f := in[i]
+
+		if f.From == f.To {
+			overlapped = append(overlapped, f)
+			continue
+		}
+
+		for j := i + 1; j < len(in); i, j = i+1, j+1 {
+			f2 := in[j]
+
+			if f.Type.Enum() != f2.Type.Enum() {
+				break
+			}
+
+			if f2.From == f2.To {
+				overlapped = append(overlapped, f2)
+				continue
+			}
+
+			if f2.From > f.From && f2.To > f.To {
+				break
+			}
+
+			if f.To >= f2.To && f.From <= f2.From {
+				overlapped = append(overlapped, f2)
+				continue
+			}
+
+			if i < len(in)-1 && (f2.To >= f.To && f2.From <= f.From) {
+				overlapped = append(overlapped, f)
+			}
+
+			f = f2
+		}
+
+		res = append(res, f)
+	}
+
+	return res, overlapped
+}
+
+// randomFileInfos - files of given types on 1K grid: leftover small files, merged files, pinned large files and empty files
+func randomFileInfos(rnd *rand.Rand, n int, types []snaptype.Type) []snaptype.FileInfo {
+	res := make([]snaptype.FileInfo, 0, n)
+	for i := 0; i < n; i++ {
+		from := uint64(rnd.Intn(20)) * 1_000
+		to := from + uint64(rnd.Intn(6))*1_000
+		res = append(res, snaptype.FileInfo{Version: 1, From: from, To: to, Type: types[rnd.Intn(len(types))]})
+	}
+	return res
+}
+
+// sortLikeParseDir - order of snaptype.Segments
+func sortLikeParseDir(in []snaptype.FileInfo) {
+	slices.SortFunc(in, func(a, b snaptype.FileInfo) int {
+		if c := cmp.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.To, b.To); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Type.Enum(), b.Type.Enum())
+	})
+}
+
+func TestNoOverlapsSameAsQuadratic(t *testing.T) {
+	single := []snaptype.Type{coresnaptype.Headers}
+	for seed := int64(0); seed < 2_000; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		in := randomFileInfos(rnd, rnd.Intn(40), single)
+		if seed%4 != 0 { // callers pass sorted list, but selection must be same on any input
+			sortLikeParseDir(in)
+		}
+		require.Equal(t, noOverlapsQuadratic(in), noOverlaps(in), "seed=%d in=%v", seed, in)
+	}
+
+	t.Run("same from", func(t *testing.T) {
+		in := []snaptype.FileInfo{
+			{From: 0, To: 0, Type: coresnaptype.Headers},
+			{From: 0, To: 1_000, Type: coresnaptype.Headers},
+			{From: 0, To: 10_000, Type: coresnaptype.Headers},
+			{From: 0, To: 10_000, Type: coresnaptype.Headers},
+			{From: 0, To: 500_000, Type: coresnaptype.Headers},
+			{From: 1_000, To: 2_000, Type: coresnaptype.Headers},
+			{From: 500_000, To: 500_000, Type: coresnaptype.Headers},
+			{From: 500_000, To: 501_000, Type: coresnaptype.Headers},
+		}
+		res := noOverlaps(in)
+		require.Equal(t, noOverlapsQuadratic(in), res)
+		require.Equal(t, []snaptype.FileInfo{in[4], in[7]}, res)
+	})
+}
+
+func TestFindOverlapsSameAsReference(t *testing.T) {
+	types := []snaptype.Type{coresnaptype.Headers, coresnaptype.Bodies, coresnaptype.Transactions}
+	for seed := int64(0); seed < 2_000; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		in := randomFileInfos(rnd, rnd.Intn(40), types[:1+rnd.Intn(len(types))])
+		if seed%4 != 0 {
+			sortLikeParseDir(in)
+		}
+		expectRes, expectOverlapped := findOverlapsReference(in)
+		res, overlapped := findOverlaps(in)
+		require.Equal(t, expectRes, res, "seed=%d in=%v", seed, in)
+		require.Equal(t, expectOverlapped, overlapped, "seed=%d in=%v", seed, in)
+	}
+}
+
+func benchmarkFileInfos(shape string) []snaptype.FileInfo {
+	const n = 50_000
+	res := make([]snaptype.FileInfo, 0, n)
+	switch shape {
+	case "small files": // leftover small files, covered by merged ones
+		for i := uint64(0); i < n; i++ {
+			res = append(res, snaptype.FileInfo{From: i * 1_000, To: (i + 1) * 1_000, Type: coresnaptype.Headers})
+			if i%100 == 0 {
+				res = append(res, snaptype.FileInfo{From: i * 1_000, To: (i + 100) * 1_000, Type: coresnaptype.Headers})
+			}
+		}
+		sortLikeParseDir(res)
+	case "same from": // many files starting at same block
+		for i := uint64(1); i <= n; i++ {
+			res = append(res, snaptype.FileInfo{From: 0, To: i * 1_000, Type: coresnaptype.Headers})
+		}
+		sortLikeParseDir(res)
+	case "descending": // `from` goes down - as on boundary of versions in order of snaptype.Segments. Worst case of quadratic noOverlaps
+		for i := uint64(0); i < n; i++ {
+			res = append(res, snaptype.FileInfo{From: (n - i) * 1_000, To: (n - i + 1) * 1_000, Type: coresnaptype.Headers})
+		}
+	}
+	return res
+}
+
+func BenchmarkNoOverlaps(b *testing.B) {
+	for _, shape := range []string{"small files", "same from", "descending"} {
+		in := benchmarkFileInfos(shape)
+		b.Run(fmt.Sprintf("%s/quadratic", shape), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				noOverlapsQuadratic(in)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/linear", shape), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				noOverlaps(in)
+			}
+		})
+	}
+}
+
+func BenchmarkFindOverlaps(b *testing.B) {
+	for _, shape := range []string{"small files", "same from", "descending"} {
+		in := benchmarkFileInfos(shape)
+		b.Run(shape, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				findOverlaps(in)
+			}
+		})
+	}
+}
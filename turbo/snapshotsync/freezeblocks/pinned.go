@@ -0,0 +1,129 @@
+package freezeblocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+)
+
+// PinnedFileName - list of pinned ranges, stored in snapshots dir. See RoSnapshots.Pin
+const PinnedFileName = "pinned-segments.json"
+
+type pinnedRange struct {
+	From  uint64   `json:"from"`
+	To    uint64   `json:"to"`
+	Types []string `json:"types"`
+}
+
+func (p pinnedRange) has(f snaptype.FileInfo) bool {
+	return f.From >= p.From && f.To <= p.To && slices.Contains(p.Types, f.Type.Name())
+}
+
+func readPinned(snapDir string) ([]pinnedRange, error) {
+	data, err := os.ReadFile(filepath.Join(snapDir, PinnedFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []pinnedRange
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", PinnedFileName, err)
+	}
+	return res, nil
+}
+
+func writePinned(snapDir string, pinned []pinnedRange) error {
+	if len(pinned) == 0 {
+		if err := os.Remove(filepath.Join(snapDir, PinnedFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(pinned)
+	if err != nil {
+		return err
+	}
+	return dir.WriteFileWithFsync(filepath.Join(snapDir, PinnedFileName), data, 0644)
+}
+
+func typeNames(types []snaptype.Type) []string {
+	res := make([]string, 0, len(types))
+	for _, t := range types {
+		res = append(res, t.Name())
+	}
+	return res
+}
+
+// Pin - segments of given types inside `rng` will not be deleted by merge and by overlaps removal.
+// Pinned segments covered by bigger segment are not used for reads. Persisted in snapshots dir.
+func (s *RoSnapshots) Pin(rng Range, types []snaptype.Type) error {
+	s.pinnedLock.Lock()
+	defer s.pinnedLock.Unlock()
+	pinned, err := readPinned(s.dir)
+	if err != nil {
+		return err
+	}
+	names := typeNames(types)
+	for i := range pinned {
+		if pinned[i].From == rng.from && pinned[i].To == rng.to {
+			for _, name := range names {
+				if !slices.Contains(pinned[i].Types, name) {
+					pinned[i].Types = append(pinned[i].Types, name)
+				}
+			}
+			return writePinned(s.dir, pinned)
+		}
+	}
+	pinned = append(pinned, pinnedRange{From: rng.from, To: rng.to, Types: names})
+	return writePinned(s.dir, pinned)
+}
+
+// Unpin - reverts Pin of same range. Unpinned segments will be deleted by next merge or overlaps removal.
+func (s *RoSnapshots) Unpin(rng Range, types []snaptype.Type) error {
+	s.pinnedLock.Lock()
+	defer s.pinnedLock.Unlock()
+	pinned, err := readPinned(s.dir)
+	if err != nil {
+		return err
+	}
+	names := typeNames(types)
+	for i := range pinned {
+		if pinned[i].From == rng.from && pinned[i].To == rng.to {
+			pinned[i].Types = slices.DeleteFunc(pinned[i].Types, func(name string) bool { return slices.Contains(names, name) })
+		}
+	}
+	pinned = slices.DeleteFunc(pinned, func(p pinnedRange) bool { return len(p.Types) == 0 })
+	return writePinned(s.dir, pinned)
+}
+
+// withoutPinned - filters out pinned segments from list of files to delete
+func (s *RoSnapshots) withoutPinned(toDel []string) []string {
+	s.pinnedLock.Lock()
+	defer s.pinnedLock.Unlock()
+	pinned, err := readPinned(s.dir)
+	if err != nil {
+		s.logger.Warn("[snapshots] can't read pinned segments, keep all files", "err", err)
+		return nil
+	}
+	if len(pinned) == 0 {
+		return toDel
+	}
+	res := make([]string, 0, len(toDel))
+	for _, f := range toDel {
+		info, _, ok := snaptype.ParseFileName(s.dir, filepath.Base(f))
+		if ok && slices.ContainsFunc(pinned, func(p pinnedRange) bool { return p.has(info) }) {
+			s.logger.Info("[snapshots] keep pinned file", "file", filepath.Base(f))
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
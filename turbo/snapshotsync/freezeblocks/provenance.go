@@ -0,0 +1,109 @@
+package freezeblocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// provenanceExt - sidecar file with provenance record of produced file: `v1-000000-000500-headers.seg.meta`
+// Sidecar is created when file is produced (dump/merge). Merged file embeds records of its inputs - because inputs are deleted after merge.
+const provenanceExt = ".meta"
+
+// Provenance - producer of files. Injected by node (params.VersionWithCommit) - this package doesn't depend on params
+type Provenance struct {
+	Version string
+}
+
+// ProvenanceRecord - content of `.meta` sidecar
+type ProvenanceRecord struct {
+	File      string              `json:"file"`
+	Version   string              `json:"version,omitempty"`
+	Chain     string              `json:"chain,omitempty"`
+	CreatedAt time.Time           `json:"createdAt"`
+	Sources   []*ProvenanceRecord `json:"sources,omitempty"` // merge inputs. Record has only `File` if input had no sidecar
+}
+
+// Leaves - records of dumped (not merged) files this file was built from
+func (r *ProvenanceRecord) Leaves() (res []*ProvenanceRecord) {
+	if len(r.Sources) == 0 {
+		return []*ProvenanceRecord{r}
+	}
+	for _, s := range r.Sources {
+		res = append(res, s.Leaves()...)
+	}
+	return res
+}
+
+// writeProvenanceSidecar - records provenance of just-produced file. sources - merge inputs, nil for dumped files
+func writeProvenanceSidecar(filePath string, p Provenance, chain string, sources []string) error {
+	r := &ProvenanceRecord{File: filepath.Base(filePath), Version: p.Version, Chain: chain, CreatedAt: time.Now().UTC()}
+	for _, src := range sources {
+		srcRecord, ok, err := ReadProvenance(src)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			srcRecord = &ProvenanceRecord{File: filepath.Base(src)}
+		}
+		r.Sources = append(r.Sources, srcRecord)
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath+provenanceExt, v, 0644)
+}
+
+// ReadProvenance - record from sidecar of file. ok=false if sidecar doesn't exist
+func ReadProvenance(filePath string) (r *ProvenanceRecord, ok bool, err error) {
+	v, err := os.ReadFile(filePath + provenanceExt)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	r = &ProvenanceRecord{}
+	if err := json.Unmarshal(v, r); err != nil {
+		return nil, false, fmt.Errorf("%s: %w", filepath.Base(filePath)+provenanceExt, err)
+	}
+	return r, true, nil
+}
+
+// ProvenanceChain - chain of custody of file: embedded records of sources, and for sources without embedded record -
+// sidecars of source files which are still on disk (next to file)
+func ProvenanceChain(filePath string) (*ProvenanceRecord, error) {
+	r, ok, err := ReadProvenance(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, filepath.Base(filePath)+provenanceExt)
+	}
+	if err := resolveProvenanceSources(filepath.Dir(filePath), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func resolveProvenanceSources(dir string, r *ProvenanceRecord) error {
+	for i, s := range r.Sources {
+		if s.Version == "" && len(s.Sources) == 0 {
+			onDisk, ok, err := ReadProvenance(filepath.Join(dir, s.File))
+			if err != nil {
+				return err
+			}
+			if ok {
+				r.Sources[i] = onDisk
+			}
+		}
+		if err := resolveProvenanceSources(dir, r.Sources[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package freezeblocks
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestProvenanceChainAfterTwoLevelMerge(t *testing.T) {
+	logger := log.New()
+	dir, require := t.TempDir(), require.New(t)
+	bodies := coresnaptype.Bodies.Enum()
+	fileName := func(from, to uint64) string { return snaptype.SegmentFileName(1, from, to, bodies) }
+
+	// dumped files: 1k
+	var dumped []string
+	for from := uint64(0); from < 100_000; from += 1_000 {
+		createTestSegmentFile(t, from, from+1_000, bodies, dir, 1, logger)
+		require.NoError(writeProvenanceSidecar(filepath.Join(dir, fileName(from, from+1_000)), Provenance{Version: "dumper"}, params.MainnetChainConfig.ChainName, nil))
+		dumped = append(dumped, fileName(from, from+1_000))
+	}
+
+	merger := NewMerger(dir, 1, log.LvlInfo, nil, params.MainnetChainConfig, logger)
+	merger.DisableFsync()
+	merger.SetProvenance(Provenance{Version: "merger"})
+	mergeRange := func(from, to, step uint64) {
+		var toMerge []string
+		for i := from; i < to; i += step {
+			toMerge = append(toMerge, filepath.Join(dir, fileName(i, i+step)))
+		}
+		require.NoError(merger.merge(context.Background(), toMerge, filepath.Join(dir, fileName(from, to)), nil))
+		removeOldFiles(toMerge, dir) // merged files embed provenance of inputs - chain must survive inputs deletion
+	}
+	// 1k -> 10k
+	for from := uint64(0); from < 100_000; from += 10_000 {
+		mergeRange(from, from+10_000, 1_000)
+	}
+	// 10k -> 100k
+	mergeRange(0, 100_000, 10_000)
+
+	r, err := ProvenanceChain(filepath.Join(dir, fileName(0, 100_000)))
+	require.NoError(err)
+	require.Equal(fileName(0, 100_000), r.File)
+	require.Equal("merger", r.Version)
+	require.Equal(params.MainnetChainConfig.ChainName, r.Chain)
+	require.False(r.CreatedAt.IsZero())
+	require.Len(r.Sources, 10)
+	for i, s := range r.Sources {
+		require.Equal(fileName(uint64(i)*10_000, uint64(i+1)*10_000), s.File)
+		require.Equal("merger", s.Version)
+		require.Len(s.Sources, 10)
+	}
+
+	var leaves []string
+	for _, l := range r.Leaves() {
+		require.Equal("dumper", l.Version)
+		require.Equal(params.MainnetChainConfig.ChainName, l.Chain)
+		leaves = append(leaves, l.File)
+	}
+	require.Equal(dumped, leaves)
+
+	// file without sidecar (produced by older version) is a leaf without provenance
+	createTestSegmentFile(t, 100_000, 101_000, bodies, dir, 1, logger)
+	createTestSegmentFile(t, 101_000, 102_000, bodies, dir, 1, logger)
+	mergeRange(100_000, 102_000, 1_000)
+	r, err = ProvenanceChain(filepath.Join(dir, fileName(100_000, 102_000)))
+	require.NoError(err)
+	require.Len(r.Leaves(), 2)
+	require.Equal(&ProvenanceRecord{File: fileName(100_000, 101_000)}, r.Leaves()[0])
+}
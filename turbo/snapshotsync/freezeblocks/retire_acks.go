@@ -0,0 +1,95 @@
+package freezeblocks
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/erigon/turbo/services"
+)
+
+// Blocks are pruned from DB only when they are in indexed files. But consumers which refresh files on
+// DBEventNotifier.OnNewSnapshot (RPC) see new files with delay - and until then they can't read blocks which are
+// already pruned from DB. If notifier supports acks (services.DBEventAckNotifier): blocks of new files can be pruned
+// only after consumers acknowledged these files - there is always DB or indexed file which serves every canonical block.
+
+// snapshotsAckTimeout - consumer which didn't acknowledge new files in time doesn't hold blocks pruning anymore
+var snapshotsAckTimeout = 5 * time.Minute
+
+type frozenAcks struct {
+	lock              sync.Mutex
+	pending           int    // notifications which are not acknowledged yet
+	frozen, frozenBor uint64 // known to consumers: frozen blocks before first not acknowledged notification
+}
+
+// holdFrozen - must be called before new files are opened. Returned `ack` releases hold, it's idempotent
+func (br *BlockRetire) holdFrozen() (ack func()) {
+	if _, ok := br.notifier.(services.DBEventAckNotifier); !ok {
+		return func() {}
+	}
+	br.acks.lock.Lock()
+	defer br.acks.lock.Unlock()
+	if br.acks.pending == 0 {
+		br.acks.frozen, br.acks.frozenBor = br.blockReader.FrozenBlocks(), br.blockReader.FrozenBorBlocks()
+	}
+	br.acks.pending++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			br.acks.lock.Lock()
+			defer br.acks.lock.Unlock()
+			br.acks.pending--
+		})
+	}
+}
+
+// reopenAndNotify - opens new files by `reopen` and notifies consumers about them. Blocks of new files are not pruned
+// from DB until consumers acknowledged them
+func (br *BlockRetire) reopenAndNotify(reopen func() error) error {
+	ack := br.holdFrozen()
+	if err := reopen(); err != nil {
+		ack()
+		return err
+	}
+	br.notifyNewSnapshot(ack)
+	return nil
+}
+
+// notifyNewSnapshot - calls `ack` when consumers acknowledged new files (or right away if notifier doesn't support acks).
+// ack=nil - nothing to wait for: for example merge doesn't change set of available blocks
+func (br *BlockRetire) notifyNewSnapshot(ack func()) {
+	if ack == nil {
+		ack = func() {}
+	}
+	notifier := br.notifier
+	if notifier == nil || reflect.ValueOf(notifier).IsNil() {
+		ack()
+		return
+	}
+	ackNotifier, ok := notifier.(services.DBEventAckNotifier)
+	if !ok {
+		notifier.OnNewSnapshot() // notify about new snapshots of any size
+		ack()
+		return
+	}
+	timer := time.AfterFunc(snapshotsAckTimeout, func() {
+		br.logger.Warn("[snapshots] new files are not acknowledged by consumers, allow to prune their blocks", "timeout", snapshotsAckTimeout)
+		ack()
+	})
+	ackNotifier.OnNewSnapshotAck(func() {
+		timer.Stop()
+		ack()
+	})
+}
+
+// frozenToPrune - frozen blocks which can be deleted from DB: they are in files known to all consumers
+func (br *BlockRetire) frozenToPrune() (frozen, frozenBor uint64) {
+	frozen, frozenBor = br.blockReader.FrozenBlocks(), br.blockReader.FrozenBorBlocks()
+	br.acks.lock.Lock()
+	defer br.acks.lock.Unlock()
+	if br.acks.pending > 0 {
+		frozen, frozenBor = min(frozen, br.acks.frozen), min(frozenBor, br.acks.frozenBor)
+	}
+	return frozen, frozenBor
+}
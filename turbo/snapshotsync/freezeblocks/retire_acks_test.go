@@ -0,0 +1,176 @@
+package freezeblocks
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/rawdb/blockio"
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+	"github.com/ledgerwatch/erigon/eth/stagedsync/stages"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/turbo/services"
+	"github.com/ledgerwatch/erigon/turbo/shards"
+)
+
+// slowNotifier - consumer which picks up new files only when test tells it
+type slowNotifier struct {
+	lock sync.Mutex
+	acks []func()
+}
+
+func (n *slowNotifier) OnNewSnapshot() {}
+func (n *slowNotifier) OnNewSnapshotAck(ack func()) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.acks = append(n.acks, ack)
+}
+func (n *slowNotifier) ackAll() {
+	n.lock.Lock()
+	acks := n.acks
+	n.acks = nil
+	n.lock.Unlock()
+	for _, ack := range acks {
+		ack()
+	}
+}
+
+func TestRetirePruneWaitsForConsumers(t *testing.T) {
+	logger := log.New()
+	dirs := datadir.New(t.TempDir())
+	ctx := context.Background()
+	createSegments := func(from, to uint64) {
+		for _, snT := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, from, to, snT.Enum(), dirs.Snap, 1, logger)
+		}
+	}
+	createSegments(0, 500_000)
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+	t.Cleanup(s.Close)
+	require.NoError(t, s.ReopenFolder())
+
+	db := memdb.NewTestDB(t)
+	notifier := &slowNotifier{}
+	blockReader := NewBlockReader(s, nil)
+	br := NewBlockRetire(1, dirs, blockReader, blockio.NewBlockWriter(), db, params.MainnetChainConfig, notifier, nil, logger)
+
+	probe := &types.Header{Number: big.NewInt(600_000)}
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		if err := rawdb.WriteHeader(tx, &types.Header{Number: big.NewInt(1)}); err != nil {
+			return err
+		}
+		if err := rawdb.WriteHeader(tx, probe); err != nil {
+			return err
+		}
+		return stages.SaveStageProgress(tx, stages.Senders, 2_000_000)
+	}))
+
+	// consumer reads blocks from files it opened, or from DB
+	consumerFrozen := blockReader.FrozenBlocks()
+	pruneAndCheckProbe := func() {
+		t.Helper()
+		require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+			_, err := br.PruneAncientBlocks(tx, 10_000_000)
+			return err
+		}))
+		var inDB bool
+		require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+			inDB = rawdb.ReadHeader(tx, probe.Hash(), probe.Number.Uint64()) != nil
+			return nil
+		}))
+		require.True(t, inDB || probe.Number.Uint64() <= consumerFrozen, "probe block is unavailable: frozen=%d, consumer frozen=%d", blockReader.FrozenBlocks(), consumerFrozen)
+	}
+	pruneAndCheckProbe()
+
+	// probe block is retired: files are opened, but consumer didn't pick them up yet
+	createSegments(500_000, 1_000_000)
+	require.NoError(t, br.reopenAndNotify(s.ReopenFolder))
+	require.Equal(t, uint64(999_999), blockReader.FrozenBlocks())
+	pruneAndCheckProbe()
+	pruneAndCheckProbe()
+
+	// consumer picked up new files
+	consumerFrozen = blockReader.FrozenBlocks()
+	notifier.ackAll()
+	pruneAndCheckProbe()
+	require.NoError(t, db.View(ctx, func(tx kv.Tx) error {
+		require.Nil(t, rawdb.ReadHeader(tx, probe.Hash(), probe.Number.Uint64()), "probe block must be pruned after ack")
+		return nil
+	}))
+
+	// consumer which never acknowledges doesn't hold prune forever
+	defer func(v time.Duration) { snapshotsAckTimeout = v }(snapshotsAckTimeout)
+	snapshotsAckTimeout = 10 * time.Millisecond
+	createSegments(1_000_000, 1_500_000)
+	require.NoError(t, br.reopenAndNotify(s.ReopenFolder))
+	require.Eventually(t, func() bool {
+		frozen, _ := br.frozenToPrune()
+		return frozen == 1_499_999
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestRetirePruneWaitsForEvents - production notifier: prune waits for subscribers of shards.Events which re-open files
+func TestRetirePruneWaitsForEvents(t *testing.T) {
+	logger := log.New()
+	dirs := datadir.New(t.TempDir())
+	createSegments := func(from, to uint64) {
+		for _, snT := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, from, to, snT.Enum(), dirs.Snap, 1, logger)
+		}
+	}
+	createSegments(0, 500_000)
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+	t.Cleanup(s.Close)
+	require.NoError(t, s.ReopenFolder())
+
+	events := shards.NewEvents()
+	var _ services.DBEventAckNotifier = events
+	br := NewBlockRetire(1, dirs, NewBlockReader(s, nil), blockio.NewBlockWriter(), memdb.NewTestDB(t), params.MainnetChainConfig, events, nil, logger)
+	plainCh, plainClean := events.AddNewSnapshotSubscription() // doesn't hold prune
+	defer plainClean()
+	ackCh, ackClean := events.AddNewSnapshotAckSubscription()
+	lateCh, lateClean := events.AddNewSnapshotAckSubscription()
+
+	createSegments(500_000, 1_000_000)
+	require.NoError(t, br.reopenAndNotify(s.ReopenFolder))
+	<-plainCh
+	frozen, _ := br.frozenToPrune()
+	require.Equal(t, uint64(499_999), frozen)
+
+	// 1 of 2 subscribers re-opened files
+	(<-ackCh)()
+	frozen, _ = br.frozenToPrune()
+	require.Equal(t, uint64(499_999), frozen)
+
+	// next files: ack of 2nd notification covers 1st one
+	createSegments(1_000_000, 1_500_000)
+	require.NoError(t, br.reopenAndNotify(s.ReopenFolder))
+	<-lateCh
+	(<-lateCh)()
+	frozen, _ = br.frozenToPrune()
+	require.Equal(t, uint64(499_999), frozen, "1st subscriber didn't ack 2nd notification")
+
+	// subscriber which is gone doesn't hold prune
+	ackClean()
+	frozen, _ = br.frozenToPrune()
+	require.Equal(t, uint64(1_499_999), frozen)
+	lateClean()
+
+	// no ack-subscribers: acked right away
+	createSegments(1_500_000, 2_000_000)
+	require.NoError(t, br.reopenAndNotify(s.ReopenFolder))
+	frozen, _ = br.frozenToPrune()
+	require.Equal(t, uint64(1_999_999), frozen)
+}
@@ -0,0 +1,148 @@
+package freezeblocks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/downloader/snaptype"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/eth/stagedsync/stages"
+)
+
+// RetirePlanItem - range of blocks for which new segments will be produced (1 segment per snapshot type)
+type RetirePlanItem struct {
+	Range
+	Files         int   // segments which will be produced
+	Inputs        int   // merge only: segments which will be replaced by produced ones
+	EstimatedSize int64 // estimated by avg block size in existing segments of same type
+}
+
+// RetirePlan - result of retire dry-run. See BlockRetire.PlanRetire
+type RetirePlan struct {
+	Dumps  []RetirePlanItem // blocks to move from DB to new segments
+	Merges []RetirePlanItem // merges of existing and dumped segments
+
+	// blocks in [PruneFrom, PruneTo) will be deleted from DB after retire. PruneTo=0 - nothing to prune
+	PruneFrom, PruneTo uint64
+	// NotEnoughDataInDB - there is gap between files and DB, nothing will be dumped. See dbHasEnoughDataForBlocksRetire
+	NotEnoughDataInDB bool
+}
+
+func (p RetirePlan) Empty() bool {
+	return len(p.Dumps) == 0 && len(p.Merges) == 0 && p.PruneTo <= p.PruneFrom
+}
+
+func (p RetirePlan) String() string {
+	if p.Empty() {
+		return "nothing to retire"
+	}
+	var b strings.Builder
+	var files int
+	var size int64
+	for _, it := range p.Dumps {
+		fmt.Fprintf(&b, "dump: %dk-%dk, files=%d, estimated=%s\n", it.from/1000, it.to/1000, it.Files, datasize.ByteSize(it.EstimatedSize).HR())
+		files, size = files+it.Files, size+it.EstimatedSize
+	}
+	for _, it := range p.Merges {
+		fmt.Fprintf(&b, "merge: %dk-%dk, inputs=%d, files=%d, estimated=%s\n", it.from/1000, it.to/1000, it.Inputs, it.Files, datasize.ByteSize(it.EstimatedSize).HR())
+		files, size = files+it.Files, size+it.EstimatedSize
+	}
+	if p.NotEnoughDataInDB {
+		fmt.Fprintf(&b, "dump: skipped, not enough blocks in db\n")
+	}
+	if p.PruneTo > p.PruneFrom {
+		fmt.Fprintf(&b, "prune: blocks=%d-%d (%d)\n", p.PruneFrom, p.PruneTo, p.PruneTo-p.PruneFrom)
+	}
+	fmt.Fprintf(&b, "total: files=%d, estimated=%s", files, datasize.ByteSize(size).HR())
+	return b.String()
+}
+
+// PlanRetire - dry-run of RetireBlocks and PruneAncientBlocks: runs same CanRetire/FindMergeRanges/CanDeleteTo
+// as they do, but doesn't produce files and doesn't write to DB. Bor snapshots are not planned.
+func (br *BlockRetire) PlanRetire(tx kv.Tx, minBlockNum, maxBlockNum uint64) (plan RetirePlan, err error) {
+	snapshots := br.snapshots()
+	view := snapshots.View()
+	defer view.Close()
+	avgBlockSize := avgBlockSizeByType(view, snapshots.Types())
+
+	firstInDB, hasBlocksInDB, err := rawdb.ReadFirstNonGenesisHeaderNumber(tx)
+	if err != nil {
+		return plan, err
+	}
+	frozen := max(br.blockReader.FrozenBlocks(), minBlockNum)
+	if hasBlocksInDB && snapshots.SegmentsMax()+1 < firstInDB {
+		plan.NotEnoughDataInDB = true
+	}
+	ranges := view.Ranges()
+	for !plan.NotEnoughDataInDB {
+		blockFrom, blockTo, ok := CanRetire(maxBlockNum, frozen, snaptype.Unknown, br.chainConfig)
+		if !ok {
+			break
+		}
+		dump := RetirePlanItem{Range: Range{from: blockFrom, to: blockTo}, Files: len(snapshots.Types())}
+		for _, size := range avgBlockSize {
+			dump.EstimatedSize += int64(size * float64(blockTo-blockFrom))
+		}
+		plan.Dumps = append(plan.Dumps, dump)
+		ranges = append(ranges, dump.Range)
+		frozen = blockTo - 1
+	}
+
+	merger := NewMerger(br.tmpDir, br.workers, log.LvlInfo, nil, br.chainConfig, br.logger)
+	for _, r := range merger.FindMergeRanges(ranges, frozen) {
+		it := RetirePlanItem{Range: r, Files: len(snapshots.Types())}
+		for _, t := range snapshots.Types() {
+			for _, sn := range view.Segments(t) {
+				if sn.from < r.from || sn.to > r.to || sn.Decompressor == nil {
+					continue
+				}
+				it.Inputs++
+				it.EstimatedSize += sn.Size()
+			}
+		}
+		for _, dump := range plan.Dumps {
+			if dump.from >= r.from && dump.to <= r.to {
+				it.Inputs += dump.Files
+				it.EstimatedSize += dump.EstimatedSize
+			}
+		}
+		plan.Merges = append(plan.Merges, it)
+	}
+
+	if br.blockReader.FreezingCfg().KeepBlocks || !hasBlocksInDB {
+		return plan, nil
+	}
+	currentProgress, err := stages.GetStageProgress(tx, stages.Senders)
+	if err != nil {
+		return plan, err
+	}
+	if canDeleteTo := CanDeleteTo(currentProgress, frozen); canDeleteTo > firstInDB {
+		plan.PruneFrom, plan.PruneTo = firstInDB, canDeleteTo
+	}
+	return plan, nil
+}
+
+// avgBlockSizeByType - bytes per block in existing segments. Types without segments are skipped.
+func avgBlockSizeByType(view *View, types []snaptype.Type) map[snaptype.Enum]float64 {
+	res := make(map[snaptype.Enum]float64, len(types))
+	for _, t := range types {
+		var size int64
+		var blocks uint64
+		for _, sn := range view.Segments(t) {
+			if sn.Decompressor == nil {
+				continue
+			}
+			size += sn.Size()
+			blocks += sn.to - sn.from
+		}
+		if blocks > 0 {
+			res[t.Enum()] = float64(size) / float64(blocks)
+		}
+	}
+	return res
+}
@@ -0,0 +1,114 @@
+package freezeblocks
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	libcommon "github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/datadir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/dbutils"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/erigon-lib/log/v3"
+
+	coresnaptype "github.com/ledgerwatch/erigon/core/snaptype"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+	"github.com/ledgerwatch/erigon/eth/stagedsync/stages"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestPlanRetire(t *testing.T) {
+	logger := log.New()
+	dirs := datadir.New(t.TempDir())
+	require := require.New(t)
+
+	for i := uint64(0); i < 70; i++ {
+		for _, snT := range coresnaptype.BlockSnapshotTypes {
+			createTestSegmentFile(t, i*10_000, (i+1)*10_000, snT.Enum(), dirs.Snap, 1, logger)
+		}
+	}
+	s := NewRoSnapshots(ethconfig.BlocksFreezing{Enabled: true}, dirs.Snap, 0, logger)
+	defer s.Close()
+	require.NoError(s.ReopenFolder())
+
+	db := memdb.NewTestDB(t)
+	require.NoError(db.Update(context.Background(), func(tx kv.RwTx) error {
+		for _, blockNum := range []uint64{0, 650_000} {
+			if err := tx.Put(kv.Headers, dbutils.HeaderKey(blockNum, libcommon.Hash{}), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return stages.SaveStageProgress(tx, stages.Senders, 720_000)
+	}))
+	br := NewBlockRetire(1, dirs, NewBlockReader(s, nil), nil, db, params.MainnetChainConfig, nil, nil, logger)
+
+	filesBefore, dbBefore := dirFiles(t, dirs.DataDir), dbContent(t, db, kv.Headers, kv.SyncStageProgress)
+	tx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer tx.Rollback()
+	plan, err := br.PlanRetire(tx, 0, 720_000)
+	require.NoError(err)
+	tx.Rollback()
+	// dry-run: no files created, changed or removed (including tmp), no DB writes
+	require.Equal(filesBefore, dirFiles(t, dirs.DataDir))
+	require.Equal(dbBefore, dbContent(t, db, kv.Headers, kv.SyncStageProgress))
+
+	require.False(plan.Empty())
+	require.False(plan.NotEnoughDataInDB)
+	require.NotEmpty(plan.Dumps)
+	require.Equal(uint64(700_000), plan.Dumps[0].From())
+	require.NotEmpty(plan.Merges)
+	for _, m := range plan.Merges {
+		require.Greater(m.Inputs, m.Files)
+		require.Positive(m.EstimatedSize)
+	}
+	require.Equal(uint64(650_000), plan.PruneFrom)
+	require.Greater(plan.PruneTo, plan.PruneFrom)
+	require.NotEqual("nothing to retire", plan.String())
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// dirFiles - all files under `dir` (recursively) with their size and mod time
+func dirFiles(t *testing.T, dir string) map[string]fileState {
+	t.Helper()
+	res := map[string]fileState{}
+	require.NoError(t, filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		res[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	}))
+	return res
+}
+
+// dbContent - all key-values of `tables`
+func dbContent(t *testing.T, db kv.RoDB, tables ...string) map[string]string {
+	t.Helper()
+	res := map[string]string{}
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		for _, table := range tables {
+			if err := tx.ForEach(table, nil, func(k, v []byte) error {
+				res[table+"/"+string(k)] = string(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return res
+}
@@ -30,6 +30,7 @@ import (
 	snaptype2 "github.com/ledgerwatch/erigon/core/snaptype"
 	"github.com/ledgerwatch/erigon/ethdb/prune"
 	"github.com/ledgerwatch/erigon/turbo/services"
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync/freezeblocks"
 )
 
 type CaplinMode int
@@ -464,7 +465,7 @@ func WaitForDownloader(ctx context.Context, logPrefix string, headerchain, blobs
 		}
 	}
 
-	if err := rawdb.WriteSnapshots(tx, blockReader.FrozenFiles(), agg.Files()); err != nil {
+	if err := freezeblocks.WriteSnapshotsWithChecksums(tx, snapshots.Dir(), blockReader.FrozenFiles(), agg.Files()); err != nil {
 		return err
 	}
 